@@ -124,6 +124,18 @@ func (s *StaticACL) ACLModify() bool {
 	return s.allowManage
 }
 
+// explain returns the decision of the static policy, named after the
+// root policy it implements
+func (s *StaticACL) explain(op Operation, name string) Explanation {
+	root := "deny"
+	if s.allowManage {
+		root = "manage"
+	} else if s.defaultAllow {
+		root = "allow"
+	}
+	return Explanation{Allowed: check(s, op, name), Root: root}
+}
+
 // AllowAll returns an ACL rule that allows all operations
 func AllowAll() ACL {
 	return allowAll
@@ -208,161 +220,185 @@ func New(parent ACL, policy *Policy) (*PolicyACL, error) {
 
 // KeyRead returns if a key is allowed to be read
 func (p *PolicyACL) KeyRead(key string) bool {
+	return p.keyRead(key).Allowed
+}
+
+func (p *PolicyACL) keyRead(key string) Explanation {
 	// Look for a matching rule
-	_, rule, ok := p.keyRules.LongestPrefix(key)
+	prefix, rule, ok := p.keyRules.LongestPrefix(key)
 	if ok {
-		switch rule.(string) {
-		case KeyPolicyRead:
-			return true
-		case KeyPolicyWrite:
-			return true
+		switch policy := rule.(string); policy {
+		case KeyPolicyRead, KeyPolicyWrite:
+			return matched("key", prefix, policy, true)
 		default:
-			return false
+			return matched("key", prefix, policy, false)
 		}
 	}
 
 	// No matching rule, use the parent.
-	return p.parent.KeyRead(key)
+	return explain(p.parent, OpKeyRead, key)
 }
 
 // KeyWrite returns if a key is allowed to be written
 func (p *PolicyACL) KeyWrite(key string) bool {
+	return p.keyWrite(key).Allowed
+}
+
+func (p *PolicyACL) keyWrite(key string) Explanation {
 	// Look for a matching rule
-	_, rule, ok := p.keyRules.LongestPrefix(key)
+	prefix, rule, ok := p.keyRules.LongestPrefix(key)
 	if ok {
-		switch rule.(string) {
-		case KeyPolicyWrite:
-			return true
-		default:
-			return false
-		}
+		policy := rule.(string)
+		return matched("key", prefix, policy, policy == KeyPolicyWrite)
 	}
 
 	// No matching rule, use the parent.
-	return p.parent.KeyWrite(key)
+	return explain(p.parent, OpKeyWrite, key)
 }
 
 // KeyWritePrefix returns if a prefix is allowed to be written
 func (p *PolicyACL) KeyWritePrefix(prefix string) bool {
+	return p.keyWritePrefix(prefix).Allowed
+}
+
+func (p *PolicyACL) keyWritePrefix(prefix string) Explanation {
 	// Look for a matching rule that denies
-	_, rule, ok := p.keyRules.LongestPrefix(prefix)
+	match, rule, ok := p.keyRules.LongestPrefix(prefix)
 	if ok && rule.(string) != KeyPolicyWrite {
-		return false
+		return matched("key", match, rule.(string), false)
 	}
 
 	// Look if any of our children have a deny policy
-	deny := false
+	var deny *Explanation
 	p.keyRules.WalkPrefix(prefix, func(path string, rule interface{}) bool {
 		// We have a rule to prevent a write in a sub-directory!
 		if rule.(string) != KeyPolicyWrite {
-			deny = true
+			denied := matched("key", path, rule.(string), false)
+			deny = &denied
 			return true
 		}
 		return false
 	})
 
 	// Deny the write if any sub-rules may be violated
-	if deny {
-		return false
+	if deny != nil {
+		return *deny
 	}
 
 	// If we had a matching rule, done
 	if ok {
-		return true
+		return matched("key", match, KeyPolicyWrite, true)
 	}
 
 	// No matching rule, use the parent.
-	return p.parent.KeyWritePrefix(prefix)
+	return explain(p.parent, OpKeyWritePrefix, prefix)
 }
 
 // ServiceRead checks if reading (discovery) of a service is allowed
 func (p *PolicyACL) ServiceRead(name string) bool {
+	return p.serviceRead(name).Allowed
+}
+
+func (p *PolicyACL) serviceRead(name string) Explanation {
 	// Check for an exact rule or catch-all
-	_, rule, ok := p.serviceRules.LongestPrefix(name)
+	prefix, rule, ok := p.serviceRules.LongestPrefix(name)
 
 	if ok {
-		switch rule {
-		case ServicePolicyWrite:
-			return true
-		case ServicePolicyRead:
-			return true
+		switch policy := rule.(string); policy {
+		case ServicePolicyWrite, ServicePolicyRead:
+			return matched("service", prefix, policy, true)
 		default:
-			return false
+			return matched("service", prefix, policy, false)
 		}
 	}
 
 	// No matching rule, use the parent.
-	return p.parent.ServiceRead(name)
+	return explain(p.parent, OpServiceRead, name)
 }
 
 // ServiceWrite checks if writing (registering) a service is allowed
 func (p *PolicyACL) ServiceWrite(name string) bool {
+	return p.serviceWrite(name).Allowed
+}
+
+func (p *PolicyACL) serviceWrite(name string) Explanation {
 	// Check for an exact rule or catch-all
-	_, rule, ok := p.serviceRules.LongestPrefix(name)
+	prefix, rule, ok := p.serviceRules.LongestPrefix(name)
 
 	if ok {
-		switch rule {
-		case ServicePolicyWrite:
-			return true
-		default:
-			return false
-		}
+		policy := rule.(string)
+		return matched("service", prefix, policy, policy == ServicePolicyWrite)
 	}
 
 	// No matching rule, use the parent.
-	return p.parent.ServiceWrite(name)
+	return explain(p.parent, OpServiceWrite, name)
 }
 
 // EventRead is used to determine if the policy allows for a
 // specific user event to be read.
 func (p *PolicyACL) EventRead(name string) bool {
+	return p.eventRead(name).Allowed
+}
+
+func (p *PolicyACL) eventRead(name string) Explanation {
 	// Longest-prefix match on event names
-	if _, rule, ok := p.eventRules.LongestPrefix(name); ok {
-		switch rule {
-		case EventPolicyRead:
-			return true
-		case EventPolicyWrite:
-			return true
+	if prefix, rule, ok := p.eventRules.LongestPrefix(name); ok {
+		switch policy := rule.(string); policy {
+		case EventPolicyRead, EventPolicyWrite:
+			return matched("event", prefix, policy, true)
 		default:
-			return false
+			return matched("event", prefix, policy, false)
 		}
 	}
 
 	// Nothing matched, use parent
-	return p.parent.EventRead(name)
+	return explain(p.parent, OpEventRead, name)
 }
 
 // EventWrite is used to determine if new events can be created
 // (fired) by the policy.
 func (p *PolicyACL) EventWrite(name string) bool {
+	return p.eventWrite(name).Allowed
+}
+
+func (p *PolicyACL) eventWrite(name string) Explanation {
 	// Longest-prefix match event names
-	if _, rule, ok := p.eventRules.LongestPrefix(name); ok {
-		return rule == EventPolicyWrite
+	if prefix, rule, ok := p.eventRules.LongestPrefix(name); ok {
+		policy := rule.(string)
+		return matched("event", prefix, policy, policy == EventPolicyWrite)
 	}
 
 	// No match, use parent
-	return p.parent.EventWrite(name)
+	return explain(p.parent, OpEventWrite, name)
 }
 
 // KeyringRead is used to determine if the keyring can be
 // read by the current ACL token.
 func (p *PolicyACL) KeyringRead() bool {
+	return p.keyringRead().Allowed
+}
+
+func (p *PolicyACL) keyringRead() Explanation {
 	switch p.keyringRule {
 	case KeyringPolicyRead, KeyringPolicyWrite:
-		return true
+		return matched("keyring", "", p.keyringRule, true)
 	case KeyringPolicyDeny:
-		return false
+		return matched("keyring", "", p.keyringRule, false)
 	default:
-		return p.parent.KeyringRead()
+		return explain(p.parent, OpKeyringRead, "")
 	}
 }
 
 // KeyringWrite determines if the keyring can be manipulated.
 func (p *PolicyACL) KeyringWrite() bool {
+	return p.keyringWrite().Allowed
+}
+
+func (p *PolicyACL) keyringWrite() Explanation {
 	if p.keyringRule == KeyringPolicyWrite {
-		return true
+		return matched("keyring", "", p.keyringRule, true)
 	}
-	return p.parent.KeyringWrite()
+	return explain(p.parent, OpKeyringWrite, "")
 }
 
 // ACLList checks if listing of ACLs is allowed
@@ -374,3 +410,30 @@ func (p *PolicyACL) ACLList() bool {
 func (p *PolicyACL) ACLModify() bool {
 	return p.parent.ACLModify()
 }
+
+// explain dispatches an operation to the check explaining it
+func (p *PolicyACL) explain(op Operation, name string) Explanation {
+	switch op {
+	case OpKeyRead:
+		return p.keyRead(name)
+	case OpKeyWrite:
+		return p.keyWrite(name)
+	case OpKeyWritePrefix:
+		return p.keyWritePrefix(name)
+	case OpServiceRead:
+		return p.serviceRead(name)
+	case OpServiceWrite:
+		return p.serviceWrite(name)
+	case OpEventRead:
+		return p.eventRead(name)
+	case OpEventWrite:
+		return p.eventWrite(name)
+	case OpKeyringRead:
+		return p.keyringRead()
+	case OpKeyringWrite:
+		return p.keyringWrite()
+	default:
+		// The ACL operations are always decided by the parent
+		return explain(p.parent, op, name)
+	}
+}
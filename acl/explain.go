@@ -0,0 +1,117 @@
+package acl
+
+import (
+	"fmt"
+)
+
+// Operation is an operation checked by an ACL, named after the method
+// checking it
+type Operation string
+
+const (
+	OpKeyRead        Operation = "key:read"
+	OpKeyWrite       Operation = "key:write"
+	OpKeyWritePrefix Operation = "key:write-prefix"
+	OpServiceRead    Operation = "service:read"
+	OpServiceWrite   Operation = "service:write"
+	OpEventRead      Operation = "event:read"
+	OpEventWrite     Operation = "event:write"
+	OpKeyringRead    Operation = "keyring:read"
+	OpKeyringWrite   Operation = "keyring:write"
+	OpACLList        Operation = "acl:list"
+	OpACLModify      Operation = "acl:modify"
+)
+
+// Rule is a rule of a policy. Name is the key prefix, service or event
+// of the rule, and is empty for the keyring.
+type Rule struct {
+	Resource string
+	Name     string
+	Policy   string
+}
+
+// String returns the rule as it is written in a policy
+func (r Rule) String() string {
+	if r.Resource == "keyring" {
+		return fmt.Sprintf("keyring = %q", r.Policy)
+	}
+	return fmt.Sprintf("%s %q { policy = %q }", r.Resource, r.Name, r.Policy)
+}
+
+// Explanation is the decision of an ACL on an operation, along with what
+// decided it. Either a rule of a policy matched, or the decision was
+// inherited from the root policy, which is "allow", "deny" or "manage".
+type Explanation struct {
+	Allowed bool
+	Matched bool
+	Rule    Rule
+	Root    string
+}
+
+// explainer is implemented by the ACLs which can tell what decided
+// their checks. The checks of these ACLs are made by explain, so the
+// explanations can't drift from the enforcement.
+type explainer interface {
+	explain(op Operation, name string) Explanation
+}
+
+// Explain returns the decision of an ACL on an operation on the named
+// resource, along with the rule that decided it. The name is ignored by
+// the keyring and ACL operations.
+func Explain(acl ACL, op Operation, name string) (Explanation, error) {
+	switch op {
+	case OpKeyRead, OpKeyWrite, OpKeyWritePrefix, OpServiceRead, OpServiceWrite,
+		OpEventRead, OpEventWrite, OpKeyringRead, OpKeyringWrite, OpACLList, OpACLModify:
+	default:
+		return Explanation{}, fmt.Errorf("Unknown ACL operation %q", op)
+	}
+	return explain(acl, op, name), nil
+}
+
+// explain returns the explanation of an ACL, which only has the decision
+// if the ACL can't explain it
+func explain(acl ACL, op Operation, name string) Explanation {
+	if e, ok := acl.(explainer); ok {
+		return e.explain(op, name)
+	}
+	return Explanation{Allowed: check(acl, op, name)}
+}
+
+// check makes the check of an operation
+func check(acl ACL, op Operation, name string) bool {
+	switch op {
+	case OpKeyRead:
+		return acl.KeyRead(name)
+	case OpKeyWrite:
+		return acl.KeyWrite(name)
+	case OpKeyWritePrefix:
+		return acl.KeyWritePrefix(name)
+	case OpServiceRead:
+		return acl.ServiceRead(name)
+	case OpServiceWrite:
+		return acl.ServiceWrite(name)
+	case OpEventRead:
+		return acl.EventRead(name)
+	case OpEventWrite:
+		return acl.EventWrite(name)
+	case OpKeyringRead:
+		return acl.KeyringRead()
+	case OpKeyringWrite:
+		return acl.KeyringWrite()
+	case OpACLList:
+		return acl.ACLList()
+	case OpACLModify:
+		return acl.ACLModify()
+	default:
+		return false
+	}
+}
+
+// matched returns the explanation of a decision made by a rule
+func matched(resource, name, policy string, allowed bool) Explanation {
+	return Explanation{
+		Allowed: allowed,
+		Matched: true,
+		Rule:    Rule{Resource: resource, Name: name, Policy: policy},
+	}
+}
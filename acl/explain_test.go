@@ -0,0 +1,77 @@
+package acl
+
+import (
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	policy, err := Parse(`
+key "foo/" {
+	policy = "write"
+}
+key "foo/priv/" {
+	policy = "deny"
+}
+service "web" {
+	policy = "read"
+}
+keyring = "read"
+`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	acl, err := New(DenyAll(), policy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	type tcase struct {
+		op      Operation
+		name    string
+		allowed bool
+		rule    string
+		root    string
+	}
+	cases := []tcase{
+		{OpKeyRead, "foo/bar", true, `key "foo/" { policy = "write" }`, ""},
+		{OpKeyWrite, "foo/priv/key", false, `key "foo/priv/" { policy = "deny" }`, ""},
+		{OpKeyWritePrefix, "foo/", false, `key "foo/priv/" { policy = "deny" }`, ""},
+		{OpKeyRead, "other", false, "", "deny"},
+		{OpServiceRead, "web", true, `service "web" { policy = "read" }`, ""},
+		{OpServiceWrite, "web", false, `service "web" { policy = "read" }`, ""},
+		{OpEventWrite, "deploy", false, "", "deny"},
+		{OpKeyringRead, "", true, `keyring = "read"`, ""},
+		{OpKeyringWrite, "", false, "", "deny"},
+		{OpACLList, "", false, "", "deny"},
+	}
+	for _, c := range cases {
+		e, err := Explain(acl, c.op, c.name)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if e.Allowed != c.allowed || e.Root != c.root || e.Matched != (c.rule != "") {
+			t.Fatalf("bad: %#v %#v", c, e)
+		}
+		if e.Matched && e.Rule.String() != c.rule {
+			t.Fatalf("bad: %#v %s", c, e.Rule)
+		}
+
+		// The explanation matches the enforcement
+		if e.Allowed != check(acl, c.op, c.name) {
+			t.Fatalf("bad: %#v", c)
+		}
+	}
+
+	// A management token inherits from the manage root policy
+	e, err := Explain(ManageAll(), OpACLModify, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !e.Allowed || e.Root != "manage" {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	if _, err := Explain(acl, Operation("key:delete"), "foo"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
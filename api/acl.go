@@ -1,5 +1,9 @@
 package api
 
+import (
+	"time"
+)
+
 const (
 	// ACLCLientType is the client type token
 	ACLClientType = "client"
@@ -18,6 +22,37 @@ type ACLEntry struct {
 	Rules       string
 }
 
+// ACLExplainRequest is an operation, like "key:read", to check on the
+// named resource. The token of ID is checked, or the rules of Rules if
+// set, or the token of the query if neither is.
+type ACLExplainRequest struct {
+	ID        string
+	Rules     string
+	Operation string
+	Name      string
+}
+
+// ACLExplanation is the decision on an operation. Rule is the rule that
+// decided, or is empty if the decision was inherited from the Root
+// policy: "allow", "deny" or "manage".
+type ACLExplanation struct {
+	Allowed bool
+	Rule    string
+	Root    string
+}
+
+// ACLReplicationStatus is the state of the replication of the ACLs of
+// the ACL datacenter to a secondary datacenter
+type ACLReplicationStatus struct {
+	Enabled          bool
+	Running          bool
+	SourceDatacenter string
+	ReplicatedIndex  uint64
+	LastSuccess      time.Time
+	LastError        time.Time
+	LastErrorMessage string
+}
+
 // ACL can be used to query the ACL endpoints
 type ACL struct {
 	c *Client
@@ -138,3 +173,59 @@ func (a *ACL) List(q *QueryOptions) ([]*ACLEntry, *QueryMeta, error) {
 	}
 	return entries, qm, nil
 }
+
+// Explain is used to check whether a token, or a set of rules, allows an
+// operation, and which rule decided
+func (a *ACL) Explain(explain *ACLExplainRequest, q *QueryOptions) (*ACLExplanation, *QueryMeta, error) {
+	method := "GET"
+	if explain.Rules != "" {
+		method = "PUT"
+	}
+	r := a.c.newRequest(method, "/v1/acl/explain")
+	r.setQueryOptions(q)
+	if explain.ID != "" {
+		r.params.Set("id", explain.ID)
+	}
+	r.params.Set("op", explain.Operation)
+	r.params.Set("name", explain.Name)
+	if explain.Rules != "" {
+		r.obj = struct{ Rules string }{explain.Rules}
+	}
+	rtt, resp, err := requireOK(a.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out ACLExplanation
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return &out, qm, nil
+}
+
+// Replication is used to get the state of the replication of the ACLs
+// of the ACL datacenter
+func (a *ACL) Replication(q *QueryOptions) (*ACLReplicationStatus, *QueryMeta, error) {
+	r := a.c.newRequest("GET", "/v1/acl/replication")
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(a.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out ACLReplicationStatus
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return &out, qm, nil
+}
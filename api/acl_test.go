@@ -126,3 +126,49 @@ func TestACL_List(t *testing.T) {
 		t.Fatalf("bad: %v", qm)
 	}
 }
+
+func TestACL_Explain(t *testing.T) {
+	t.Parallel()
+	c, s := makeACLClient(t)
+	defer s.Stop()
+
+	acl := c.ACL()
+
+	// The management token of the client
+	out, _, err := acl.Explain(&ACLExplainRequest{Operation: "acl:modify"}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Allowed || out.Root != "manage" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Raw rules
+	req := &ACLExplainRequest{
+		Rules:     `key "foo/" { policy = "read" }`,
+		Operation: "key:write",
+		Name:      "foo/bar",
+	}
+	out, _, err = acl.Explain(req, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Allowed || out.Rule != `key "foo/" { policy = "read" }` {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestACL_Replication(t *testing.T) {
+	t.Parallel()
+	c, s := makeACLClient(t)
+	defer s.Stop()
+
+	// The ACL datacenter doesn't replicate
+	status, _, err := c.ACL().Replication(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if status.Enabled || status.Running {
+		t.Fatalf("bad: %v", status)
+	}
+}
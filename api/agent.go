@@ -18,11 +18,45 @@ type AgentCheck struct {
 
 // AgentService represents a service known to the agent
 type AgentService struct {
-	ID      string
-	Service string
-	Tags    []string
-	Port    int
-	Address string
+	ID            string
+	Service       string
+	Tags          []string
+	Port          int
+	Address       string
+	WeightPassing int
+	WeightWarning int
+	Kind          ServiceKind
+	Proxy         AgentServiceConnectProxyConfig
+	WANAddress    string
+	WANPort       int
+}
+
+// ServiceKind is the kind of a service. A typical service is an
+// application, while the other kinds are proxies of the service mesh.
+type ServiceKind string
+
+const (
+	ServiceKindTypical      ServiceKind = ""
+	ServiceKindConnectProxy ServiceKind = "connect-proxy"
+	ServiceKindMeshGateway  ServiceKind = "mesh-gateway"
+)
+
+// AgentServiceConnectProxyConfig is the configuration of a connect-proxy,
+// which fronts an instance of its destination service
+type AgentServiceConnectProxyConfig struct {
+	DestinationServiceName string
+	DestinationServiceID   string     `json:",omitempty"`
+	LocalServiceAddress    string     `json:",omitempty"`
+	LocalServicePort       int        `json:",omitempty"`
+	Upstreams              []Upstream `json:",omitempty"`
+}
+
+// Upstream is a service a proxy exposes on a local port
+type Upstream struct {
+	DestinationName  string
+	Datacenter       string `json:",omitempty"`
+	LocalBindAddress string `json:",omitempty"`
+	LocalBindPort    int
 }
 
 // AgentMember represents a cluster member known to the agent
@@ -49,6 +83,21 @@ type AgentServiceRegistration struct {
 	Address string   `json:",omitempty"`
 	Check   *AgentServiceCheck
 	Checks  AgentServiceChecks
+
+	// WeightPassing and WeightWarning are the weights of the SRV records of
+	// the service when its checks are passing or warning, defaulting to 1
+	WeightPassing int `json:",omitempty"`
+	WeightWarning int `json:",omitempty"`
+
+	// Kind is the kind of the service, and Proxy the configuration of a
+	// connect-proxy
+	Kind  ServiceKind                     `json:",omitempty"`
+	Proxy *AgentServiceConnectProxyConfig `json:",omitempty"`
+
+	// WANAddress and WANPort are where a mesh-gateway is reached from the
+	// other datacenters, defaulting to its address and port
+	WANAddress string `json:",omitempty"`
+	WANPort    int    `json:",omitempty"`
 }
 
 // AgentCheckRegistration is used to register a new check
@@ -69,7 +118,36 @@ type AgentServiceCheck struct {
 	TTL      string `json:",omitempty"`
 	HTTP     string `json:",omitempty"`
 	TCP      string `json:",omitempty"`
+	UDP      string `json:",omitempty"`
 	Status   string `json:",omitempty"`
+
+	// TLS has a TCP check complete a TLS handshake, and TLSSkipVerify
+	// skips the verification of the server certificate
+	TLS           bool `json:",omitempty"`
+	TLSSkipVerify bool `json:",omitempty"`
+
+	// Method, Header and Body customize the request of an HTTP check,
+	// and ExpectedStatus lists the passing status code ranges, such as
+	// "200-299"
+	Method         string              `json:",omitempty"`
+	Header         map[string][]string `json:",omitempty"`
+	Body           string              `json:",omitempty"`
+	ExpectedStatus []string            `json:",omitempty"`
+
+	// DockerContainerID has the Script run inside a container, by the
+	// Shell
+	DockerContainerID string `json:",omitempty"`
+	Shell             string `json:",omitempty"`
+
+	// DeregisterCriticalServiceAfter is a duration, such as "90m", after
+	// which the service is deregistered if the check stays critical
+	DeregisterCriticalServiceAfter string `json:",omitempty"`
+
+	// SuccessBeforePassing and FailuresBeforeCritical are how many
+	// consecutive passing or critical outcomes it takes to change the
+	// status of the check
+	SuccessBeforePassing   int `json:",omitempty"`
+	FailuresBeforeCritical int `json:",omitempty"`
 }
 type AgentServiceChecks []*AgentServiceCheck
 
@@ -13,6 +13,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,6 +43,40 @@ type QueryOptions struct {
 	// Token is used to provide a per-request ACL token
 	// which overrides the agent's default token.
 	Token string
+
+	// MinAppliedIndex delays the query until the servicing server has
+	// applied at least this index. Using the LastIndex of a write with
+	// AllowStale gives a stale read that observes the write.
+	MinAppliedIndex uint64
+
+	// MaxStaleDuration and MaxStaleIndex bound the staleness of a read,
+	// which implies AllowStale. The query fails if the servicing server
+	// last heard from the leader longer than MaxStaleDuration ago, or is
+	// more than MaxStaleIndex entries behind it.
+	MaxStaleDuration time.Duration
+	MaxStaleIndex    uint64
+
+	// SortBy orders the results of the session, ACL and KV list queries
+	// by "name" or "create_index" instead of their ID or key.
+	SortBy string
+
+	// Limit paginates the results of the catalog node and service
+	// queries and of the health service query. NextToken is the
+	// NextToken of the QueryMeta of the previous page.
+	Limit     int
+	NextToken string
+
+	// UseCache answers the catalog service, health service and KV
+	// queries from the cache of the agent, which may be stale
+	UseCache bool
+
+	// MaxAge bounds the age of a response served from the cache of the
+	// client. Zero serves any cached response.
+	MaxAge time.Duration
+
+	// Peer answers the health service query with the service imported
+	// from the peer of this name, instead of the local one
+	Peer string
 }
 
 // WriteOptions are used to parameterize a write
@@ -53,6 +88,10 @@ type WriteOptions struct {
 	// Token is used to provide a per-request ACL token
 	// which overrides the agent's default token.
 	Token string
+
+	// ReturnIndex requests the index of the write in the WriteMeta.
+	// This costs an extra request to the leader.
+	ReturnIndex bool
 }
 
 // QueryMeta is used to return meta data about a query
@@ -68,14 +107,31 @@ type QueryMeta struct {
 	// Is there a known leader
 	KnownLeader bool
 
+	// IndexLag is how many entries the server servicing a read with a
+	// MaxStaleIndex was behind the leader
+	IndexLag uint64
+
 	// How long did the request take
 	RequestTime time.Duration
+
+	// NextToken is set when a paginated query has more results
+	NextToken string
+
+	// CacheHit is set if the response was served from the cache of the
+	// agent or of the client, and CacheAge is how long ago it was
+	// fetched from the servers
+	CacheHit bool
+	CacheAge time.Duration
 }
 
 // WriteMeta is used to return meta data about a write
 type WriteMeta struct {
 	// How long did the request take
 	RequestTime time.Duration
+
+	// LastIndex is at least the index of the write, if requested
+	// with ReturnIndex. It can be used as a MinAppliedIndex.
+	LastIndex uint64
 }
 
 // HttpBasicAuth is used to authenticate http client with HTTP Basic Authentication
@@ -92,6 +148,14 @@ type Config struct {
 	// Address is the address of the Consul server
 	Address string
 
+	// Addresses are other addresses to fail over to. The GET requests
+	// are retried against the next address on a connection error, and
+	// an address failing to connect is skipped for ServerCooldown,
+	// which defaults to DefaultServerCooldown. They are ignored for a
+	// unix socket.
+	Addresses      []string
+	ServerCooldown time.Duration
+
 	// Scheme is the URI scheme for the Consul server
 	Scheme string
 
@@ -112,6 +176,25 @@ type Config struct {
 	// Token is used to provide a per-request ACL token
 	// which overrides the agent's default token.
 	Token string
+
+	// CacheTTL enables a cache of the catalog, health and KV queries in
+	// the client, so the same queries are answered locally. Each cached
+	// query is refreshed in the background with a blocking query, and
+	// dropped once it isn't made for the TTL. Responses with a
+	// Cache-Control of no-store or no-cache aren't cached, and those
+	// with a max-age are only served for that long.
+	CacheTTL time.Duration
+
+	// RateLimitRetries is how many times a request throttled by the
+	// agent with a 429 response is retried, after the wait given by its
+	// Retry-After header. Zero uses DefaultRateLimitRetries, and a
+	// negative value disables the retries. A request with a streamed
+	// body, like a snapshot restore, isn't retried.
+	RateLimitRetries int
+
+	// RateLimitHandler, if set, is called each time a request is
+	// throttled, so that applications can observe it
+	RateLimitHandler func(e *RateLimitEvent)
 }
 
 // DefaultConfig returns a default configuration for the client
@@ -177,7 +260,13 @@ func DefaultConfig() *Config {
 
 // Client provides a client to the Consul API
 type Client struct {
-	config Config
+	// throttled counts the 429 responses. It comes first so that it is
+	// aligned for the atomic operations.
+	throttled uint64
+
+	config  Config
+	servers *serverList
+	cache   *responseCache
 }
 
 // NewClient returns a new client
@@ -198,18 +287,26 @@ func NewClient(config *Config) (*Client, error) {
 	}
 
 	if parts := strings.SplitN(config.Address, "unix://", 2); len(parts) == 2 {
-		config.HttpClient = &http.Client{
-			Transport: &http.Transport{
-				Dial: func(_, _ string) (net.Conn, error) {
-					return net.Dial("unix", parts[1])
-				},
-			},
+		// Keep the TLS settings, for an HTTPS socket
+		trans := &http.Transport{}
+		if orig, ok := config.HttpClient.Transport.(*http.Transport); ok {
+			trans.TLSClientConfig = orig.TLSClientConfig
+		}
+		trans.Dial = func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", parts[1])
 		}
+		config.HttpClient = &http.Client{Transport: trans}
 		config.Address = parts[1]
+		config.Addresses = nil
 	}
 
+	addrs := append([]string{config.Address}, config.Addresses...)
 	client := &Client{
-		config: *config,
+		config:  *config,
+		servers: newServerList(addrs, config.ServerCooldown),
+	}
+	if config.CacheTTL > 0 {
+		client.cache = newResponseCache(client, config.CacheTTL)
 	}
 	return client, nil
 }
@@ -222,6 +319,9 @@ type request struct {
 	params url.Values
 	body   io.Reader
 	obj    interface{}
+
+	// maxAge bounds the age of a response served from the client cache
+	maxAge time.Duration
 }
 
 // setQueryOptions is used to annotate the request with
@@ -248,6 +348,31 @@ func (r *request) setQueryOptions(q *QueryOptions) {
 	if q.Token != "" {
 		r.params.Set("token", q.Token)
 	}
+	if q.MinAppliedIndex != 0 {
+		r.params.Set("applied", strconv.FormatUint(q.MinAppliedIndex, 10))
+	}
+	if q.MaxStaleDuration != 0 {
+		r.params.Set("max_stale", q.MaxStaleDuration.String())
+	}
+	if q.MaxStaleIndex != 0 {
+		r.params.Set("max_stale_index", strconv.FormatUint(q.MaxStaleIndex, 10))
+	}
+	if q.SortBy != "" {
+		r.params.Set("sort", q.SortBy)
+	}
+	if q.Limit != 0 {
+		r.params.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.NextToken != "" {
+		r.params.Set("next-token", q.NextToken)
+	}
+	if q.UseCache {
+		r.params.Set("cached", "")
+	}
+	if q.Peer != "" {
+		r.params.Set("peer", q.Peer)
+	}
+	r.maxAge = q.MaxAge
 }
 
 // durToMsec converts a duration to a millisecond specified string
@@ -267,6 +392,9 @@ func (r *request) setWriteOptions(q *WriteOptions) {
 	if q.Token != "" {
 		r.params.Set("token", q.Token)
 	}
+	if q.ReturnIndex {
+		r.params.Set("index", "")
+	}
 }
 
 // toHTTP converts the request to an HTTP request
@@ -325,16 +453,84 @@ func (c *Client) newRequest(method, path string) *request {
 	return r
 }
 
-// doRequest runs a request with our client
+// doRequest runs a request with our client, through the client cache
+// if enabled
 func (c *Client) doRequest(r *request) (time.Duration, *http.Response, error) {
-	req, err := r.toHTTP()
+	if c.cache == nil || !cacheable(r) {
+		return c.sendRequest(r)
+	}
+	start := time.Now()
+	if resp := c.cache.get(r); resp != nil {
+		return time.Now().Sub(start), resp, nil
+	}
+	rtt, resp, err := c.sendRequest(r)
 	if err != nil {
-		return 0, nil, err
+		return rtt, resp, err
 	}
+	resp, err = c.cache.store(r, resp)
+	return rtt, resp, err
+}
+
+// sendRequest sends a request to the agent. A request throttled with a
+// 429 response is retried after the wait of its Retry-After header,
+// unless its body is streamed.
+func (c *Client) sendRequest(r *request) (time.Duration, *http.Response, error) {
 	start := time.Now()
-	resp, err := c.config.HttpClient.Do(req)
-	diff := time.Now().Sub(start)
-	return diff, resp, err
+	replay := r.body == nil
+	for attempt := 1; ; attempt++ {
+		// The object of the request is encoded again for each attempt
+		if replay {
+			r.body = nil
+		}
+		resp, err := c.tryServers(r)
+		if err != nil || resp.StatusCode != 429 {
+			return time.Now().Sub(start), resp, err
+		}
+
+		atomic.AddUint64(&c.throttled, 1)
+		event := &RateLimitEvent{
+			Method:     r.method,
+			Path:       r.url.Path,
+			Attempt:    attempt,
+			RetryAfter: retryAfter(resp.Header, attempt),
+			Retrying:   replay && attempt <= c.rateLimitRetries(),
+		}
+		if c.config.RateLimitHandler != nil {
+			c.config.RateLimitHandler(event)
+		}
+		if !event.Retrying {
+			return time.Now().Sub(start), resp, nil
+		}
+		resp.Body.Close()
+		time.Sleep(event.RetryAfter)
+	}
+}
+
+// tryServers sends a request to the first address that accepts the
+// connection. A GET request without a body is retried against the other
+// addresses on a connection error.
+func (c *Client) tryServers(r *request) (*http.Response, error) {
+	retry := r.method == "GET" && r.body == nil && r.obj == nil
+	var resp *http.Response
+	var err error
+	for _, addr := range c.servers.order() {
+		r.url.Host = addr
+		var req *http.Request
+		req, err = r.toHTTP()
+		if err != nil {
+			return nil, err
+		}
+		resp, err = c.config.HttpClient.Do(req)
+		if err == nil {
+			c.servers.success(addr)
+			break
+		}
+		c.servers.failure(addr)
+		if !retry {
+			break
+		}
+	}
+	return resp, err
 }
 
 // Query is used to do a GET request against an endpoint
@@ -372,6 +568,9 @@ func (c *Client) write(endpoint string, in, out interface{}, q *WriteOptions) (*
 	defer resp.Body.Close()
 
 	wm := &WriteMeta{RequestTime: rtt}
+	if err := parseWriteMeta(resp, wm); err != nil {
+		return nil, err
+	}
 	if out != nil {
 		if err := decodeBody(resp, &out); err != nil {
 			return nil, err
@@ -405,6 +604,39 @@ func parseQueryMeta(resp *http.Response, q *QueryMeta) error {
 	default:
 		q.KnownLeader = false
 	}
+
+	// Parse the X-Consul-IndexLag of bounded stale reads
+	if lag := header.Get("X-Consul-IndexLag"); lag != "" {
+		n, err := strconv.ParseUint(lag, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse X-Consul-IndexLag: %v", err)
+		}
+		q.IndexLag = n
+	}
+
+	// Parse the X-Consul-NextToken of paginated queries
+	q.NextToken = header.Get("X-Consul-NextToken")
+
+	// Parse the X-Cache and Age of cached responses
+	if header.Get("X-Cache") == "HIT" {
+		q.CacheHit = true
+		if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+			q.CacheAge = time.Duration(age) * time.Second
+		}
+	}
+	return nil
+}
+
+// parseWriteMeta is used to help parse the index of a write, which
+// is only returned if requested
+func parseWriteMeta(resp *http.Response, w *WriteMeta) error {
+	if idx := resp.Header.Get("X-Consul-Index"); idx != "" {
+		index, err := strconv.ParseUint(idx, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse X-Consul-Index: %v", err)
+		}
+		w.LastIndex = index
+	}
 	return nil
 }
 
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheRetryInterval is the base wait after a failed refresh
+	cacheRetryInterval = time.Second
+
+	// cacheMaxBackoff bounds the wait between failed refreshes
+	cacheMaxBackoff = time.Minute
+
+	// cacheMaxWait bounds the blocking queries of the refreshes
+	cacheMaxWait = 5 * time.Minute
+)
+
+// cachePrefixes are the paths of the queries the client caches
+var cachePrefixes = []string{"/v1/catalog/", "/v1/health/", "/v1/kv/"}
+
+// responseCache caches the responses of the GET queries of a client, so
+// the same queries made by many goroutines are answered locally. The
+// entries are keyed by path and parameters, without the index and wait,
+// and a blocking query per entry refreshes it in the background. A
+// blocking query is answered from the cache if the cached index is past
+// its index. Entries that aren't read for the TTL are dropped.
+type responseCache struct {
+	c   *Client
+	ttl time.Duration
+
+	entries map[string]*cachedResponse
+	l       sync.Mutex
+}
+
+// cachedResponse is a cached response and the request to refresh it
+type cachedResponse struct {
+	path   string
+	params url.Values
+
+	status  int
+	header  http.Header
+	body    []byte
+	index   uint64
+	fetched time.Time
+
+	// maxAge is set from the Cache-Control of the response, and bounds
+	// how long it is served
+	maxAge time.Duration
+
+	lastRead time.Time
+}
+
+// newResponseCache returns a cache for the client
+func newResponseCache(c *Client, ttl time.Duration) *responseCache {
+	return &responseCache{
+		c:       c,
+		ttl:     ttl,
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+// cacheable returns if the response of a request can be cached
+func cacheable(r *request) bool {
+	if r.method != "GET" || r.body != nil || r.obj != nil {
+		return false
+	}
+	if _, ok := r.params["consistent"]; ok {
+		return false
+	}
+	for _, prefix := range cachePrefixes {
+		if strings.HasPrefix(r.url.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheKey returns the cache key of a request, and its wait index
+func cacheKey(r *request) (string, uint64) {
+	params := make(url.Values, len(r.params))
+	for k, v := range r.params {
+		params[k] = v
+	}
+	index, _ := strconv.ParseUint(params.Get("index"), 10, 64)
+	params.Del("index")
+	params.Del("wait")
+	return r.url.Path + "?" + params.Encode(), index
+}
+
+// get returns a cached response to the request, or nil. The response
+// has the X-Cache and Age headers set.
+func (rc *responseCache) get(r *request) *http.Response {
+	key, index := cacheKey(r)
+	rc.l.Lock()
+	defer rc.l.Unlock()
+	entry, ok := rc.entries[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	age := now.Sub(entry.fetched)
+	if entry.index <= index || (r.maxAge > 0 && age > r.maxAge) ||
+		(entry.maxAge > 0 && age > entry.maxAge) {
+		return nil
+	}
+	entry.lastRead = now
+
+	header := make(http.Header, len(entry.header)+2)
+	for k, v := range entry.header {
+		header[k] = v
+	}
+	header.Set("X-Cache", "HIT")
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	return &http.Response{
+		Status:     strconv.Itoa(entry.status) + " " + http.StatusText(entry.status),
+		StatusCode: entry.status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(entry.body)),
+	}
+}
+
+// store caches the response of a request, and returns a response to
+// use in its place, since its body is consumed. A new entry is refreshed
+// in the background.
+func (rc *responseCache) store(r *request, resp *http.Response) (*http.Response, error) {
+	key, _ := cacheKey(r)
+	maxAge, ok := cacheControl(resp.Header)
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if !ok || err != nil || index == 0 || (resp.StatusCode != 200 && resp.StatusCode != 404) {
+		// An entry that can't be cached anymore is dropped
+		rc.l.Lock()
+		delete(rc.entries, key)
+		rc.l.Unlock()
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// A response served from the cache of the agent is as old as it says
+	fetched := time.Now()
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil {
+		fetched = fetched.Add(-time.Duration(age) * time.Second)
+	}
+
+	params := make(url.Values, len(r.params))
+	for k, v := range r.params {
+		params[k] = v
+	}
+	params.Del("index")
+	params.Del("wait")
+	entry := &cachedResponse{
+		path:     r.url.Path,
+		params:   params,
+		status:   resp.StatusCode,
+		header:   resp.Header,
+		body:     body,
+		index:    index,
+		fetched:  fetched,
+		maxAge:   maxAge,
+		lastRead: time.Now(),
+	}
+
+	rc.l.Lock()
+	exist, ok := rc.entries[key]
+	if ok {
+		entry.lastRead = exist.lastRead
+	}
+	if !ok || exist.index <= index {
+		rc.entries[key] = entry
+	}
+	rc.l.Unlock()
+	if !ok {
+		go rc.refresh(key)
+	}
+	return resp, nil
+}
+
+// cacheControl returns if a response can be cached given its
+// Cache-Control header, and for how long if it has a max-age
+func cacheControl(header http.Header) (time.Duration, bool) {
+	var maxAge time.Duration
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || secs <= 0 {
+				return 0, false
+			}
+			maxAge = time.Duration(secs) * time.Second
+		}
+	}
+	return maxAge, true
+}
+
+// refresh keeps an entry up to date with blocking queries until it isn't
+// read for the TTL
+func (rc *responseCache) refresh(key string) {
+	failures := 0
+	for {
+		rc.l.Lock()
+		entry, ok := rc.entries[key]
+		if ok && time.Since(entry.lastRead) > rc.ttl {
+			delete(rc.entries, key)
+			ok = false
+		}
+		rc.l.Unlock()
+		if !ok {
+			return
+		}
+
+		wait := rc.ttl
+		if wait > cacheMaxWait {
+			wait = cacheMaxWait
+		}
+		r := rc.c.newRequest("GET", entry.path)
+		for k, v := range entry.params {
+			r.params[k] = v
+		}
+		r.params.Set("index", strconv.FormatUint(entry.index, 10))
+		r.params.Set("wait", durToMsec(wait))
+
+		_, resp, err := rc.c.sendRequest(r)
+		if err == nil && (resp.StatusCode == 429 || resp.StatusCode >= 500) {
+			resp.Body.Close()
+			err = fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+		}
+		if err != nil {
+			failures++
+			retry := cacheRetryInterval * time.Duration(failures*failures)
+			if retry > cacheMaxBackoff {
+				retry = cacheMaxBackoff
+			}
+			time.Sleep(retry)
+			continue
+		}
+		failures = 0
+		if _, err := rc.store(r, resp); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestCache_Hit(t *testing.T) {
+	t.Parallel()
+	c, s := makeClientWithConfig(t, func(conf *Config) {
+		conf.CacheTTL = time.Minute
+	}, nil)
+	defer s.Stop()
+
+	kv := c.KV()
+	key := testKey()
+	if _, err := kv.Put(&KVPair{Key: key, Value: []byte("foo")}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first read is a miss
+	pair, meta, err := kv.Get(key, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair == nil || !bytes.Equal(pair.Value, []byte("foo")) {
+		t.Fatalf("bad: %v", pair)
+	}
+	if meta.CacheHit {
+		t.Fatalf("bad: %v", meta)
+	}
+
+	// The second is answered from the cache
+	pair, meta2, err := kv.Get(key, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair == nil || !bytes.Equal(pair.Value, []byte("foo")) {
+		t.Fatalf("bad: %v", pair)
+	}
+	if !meta2.CacheHit || meta2.LastIndex != meta.LastIndex {
+		t.Fatalf("bad: %v", meta2)
+	}
+
+	// A write is picked up by the refresh
+	if _, err := kv.Put(&KVPair{Key: key, Value: []byte("bar")}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		pair, meta, err := kv.Get(key, nil)
+		if err != nil {
+			return false, err
+		}
+		return meta.CacheHit && pair != nil && bytes.Equal(pair.Value, []byte("bar")), nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// A blocking query on the cached index goes to the agent
+	_, meta3, err := kv.Get(key, &QueryOptions{WaitIndex: meta.LastIndex + 1000, WaitTime: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta3.CacheHit {
+		t.Fatalf("bad: %v", meta3)
+	}
+
+	// So does a consistent read
+	_, meta4, err := kv.Get(key, &QueryOptions{RequireConsistent: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta4.CacheHit {
+		t.Fatalf("bad: %v", meta4)
+	}
+}
+
+func TestCache_MaxAge(t *testing.T) {
+	t.Parallel()
+	c, s := makeClientWithConfig(t, func(conf *Config) {
+		conf.CacheTTL = time.Minute
+	}, nil)
+	defer s.Stop()
+
+	kv := c.KV()
+	key := testKey()
+	if _, err := kv.Put(&KVPair{Key: key, Value: []byte("foo")}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := kv.Get(key, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	_, meta, err := kv.Get(key, &QueryOptions{MaxAge: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.CacheHit {
+		t.Fatalf("bad: %v", meta)
+	}
+}
+
+func TestCache_Control(t *testing.T) {
+	cases := []struct {
+		header string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{"", 0, true},
+		{"public", 0, true},
+		{"max-age=30", 30 * time.Second, true},
+		{"public, Max-Age=5", 5 * time.Second, true},
+		{"no-store", 0, false},
+		{"max-age=10, no-cache", 0, false},
+		{"private", 0, false},
+		{"max-age=0", 0, false},
+		{"max-age=foo", 0, false},
+	}
+	for _, tc := range cases {
+		header := make(http.Header)
+		header.Set("Cache-Control", tc.header)
+		maxAge, ok := cacheControl(header)
+		if maxAge != tc.maxAge || ok != tc.ok {
+			t.Fatalf("%q: bad: %v %v", tc.header, maxAge, ok)
+		}
+	}
+}
+
+func TestCache_Cacheable(t *testing.T) {
+	c, err := NewClient(DefaultConfig())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	r := c.newRequest("GET", "/v1/health/service/web")
+	if !cacheable(r) {
+		t.Fatalf("should be cacheable")
+	}
+	r.params.Set("consistent", "")
+	if cacheable(r) {
+		t.Fatalf("consistent reads should not be cacheable")
+	}
+	if cacheable(c.newRequest("PUT", "/v1/kv/foo")) {
+		t.Fatalf("writes should not be cacheable")
+	}
+	if cacheable(c.newRequest("GET", "/v1/session/list")) {
+		t.Fatalf("sessions should not be cacheable")
+	}
+}
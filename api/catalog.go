@@ -1,18 +1,34 @@
 package api
 
+import (
+	"time"
+)
+
 type Node struct {
-	Node    string
-	Address string
+	Node        string
+	Address     string
+	Meta        map[string]string
+	CreateIndex uint64
+	ModifyIndex uint64
 }
 
 type CatalogService struct {
-	Node           string
-	Address        string
-	ServiceID      string
-	ServiceName    string
-	ServiceAddress string
-	ServiceTags    []string
-	ServicePort    int
+	Node                 string
+	Address              string
+	ServiceID            string
+	ServiceName          string
+	ServiceAddress       string
+	ServiceTags          []string
+	ServicePort          int
+	ServiceMeta          map[string]string
+	ServiceWeightPassing int
+	ServiceWeightWarning int
+	ServiceKind          ServiceKind
+	ServiceProxy         AgentServiceConnectProxyConfig
+	ServiceWANAddress    string
+	ServiceWANPort       int
+	CreateIndex          uint64
+	ModifyIndex          uint64
 }
 
 type CatalogNode struct {
@@ -20,20 +36,61 @@ type CatalogNode struct {
 	Services map[string]*AgentService
 }
 
+// CatalogRegistration registers a node, and optionally a service and
+// a check. If CAS is set, the registration only applies if ModifyIndex
+// matches the service if one is provided, otherwise the check if one is
+// provided, otherwise the node. A zero ModifyIndex requires that the
+// entry does not exist yet.
 type CatalogRegistration struct {
-	Node       string
-	Address    string
-	Datacenter string
-	Service    *AgentService
-	Check      *AgentCheck
+	Node        string
+	Address     string
+	Datacenter  string
+	Service     *AgentService
+	Check       *AgentCheck
+	CAS         bool
+	ModifyIndex uint64
 }
 
+// CatalogDeregistration deregisters a node, service or check. If CAS is
+// set, the deregistration only applies if ModifyIndex matches the
+// deregistered entry.
 type CatalogDeregistration struct {
+	Node        string
+	Address     string
+	Datacenter  string
+	ServiceID   string
+	CheckID     string
+	CAS         bool
+	ModifyIndex uint64
+}
+
+// CatalogPatchOp is a single change applied by a CatalogPatch. The Op
+// is one of "add-tag", "remove-tag", "set-meta" or "delete-meta".
+type CatalogPatchOp struct {
+	Op    string
+	Key   string
+	Value string
+}
+
+// CatalogPatch changes the tags or metadata of a node, or of one of
+// its services if a ServiceID is given
+type CatalogPatch struct {
 	Node       string
-	Address    string
 	Datacenter string
 	ServiceID  string
-	CheckID    string
+	Ops        []*CatalogPatchOp
+}
+
+// Maintenance is the maintenance flag of a node, or of one of its
+// services if a ServiceID is set. Expires is the time the flag is
+// lifted in Unix nanoseconds, or zero if it doesn't expire.
+type Maintenance struct {
+	Node        string
+	ServiceID   string
+	Reason      string
+	Expires     int64
+	CreateIndex uint64
+	ModifyIndex uint64
 }
 
 // Catalog can be used to query the Catalog endpoints
@@ -78,6 +135,23 @@ func (c *Catalog) Deregister(dereg *CatalogDeregistration, q *WriteOptions) (*Wr
 	return wm, nil
 }
 
+// Patch is used to apply tag and metadata changes without re-registering
+func (c *Catalog) Patch(patch *CatalogPatch, q *WriteOptions) (*WriteMeta, error) {
+	r := c.c.newRequest("PUT", "/v1/catalog/patch")
+	r.setWriteOptions(q)
+	r.obj = patch
+	rtt, resp, err := requireOK(c.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	wm := &WriteMeta{}
+	wm.RequestTime = rtt
+
+	return wm, nil
+}
+
 // Datacenters is used to query for all the known datacenters
 func (c *Catalog) Datacenters() ([]string, error) {
 	r := c.c.newRequest("GET", "/v1/catalog/datacenters")
@@ -160,6 +234,28 @@ func (c *Catalog) Service(service, tag string, q *QueryOptions) ([]*CatalogServi
 	return out, qm, nil
 }
 
+// Connect is used to query the connect-proxies of a service
+func (c *Catalog) Connect(service string, q *QueryOptions) ([]*CatalogService, *QueryMeta, error) {
+	r := c.c.newRequest("GET", "/v1/catalog/service/"+service)
+	r.setQueryOptions(q)
+	r.params.Set("connect", "")
+	rtt, resp, err := requireOK(c.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out []*CatalogService
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
 // Node is used to query for service information about a single node
 func (c *Catalog) Node(node string, q *QueryOptions) (*CatalogNode, *QueryMeta, error) {
 	r := c.c.newRequest("GET", "/v1/catalog/node/"+node)
@@ -180,3 +276,71 @@ func (c *Catalog) Node(node string, q *QueryOptions) (*CatalogNode, *QueryMeta,
 	}
 	return out, qm, nil
 }
+
+// EnableMaintenance puts a node, or one of its services if a serviceID is
+// given, in maintenance mode. A non-zero ttl lifts it after that long.
+func (c *Catalog) EnableMaintenance(node, serviceID, reason string, ttl time.Duration,
+	q *WriteOptions) (*WriteMeta, error) {
+	r := c.c.newRequest("PUT", "/v1/catalog/maintenance/"+node)
+	r.setWriteOptions(q)
+	r.params.Set("enable", "true")
+	if serviceID != "" {
+		r.params.Set("service", serviceID)
+	}
+	if reason != "" {
+		r.params.Set("reason", reason)
+	}
+	if ttl != 0 {
+		r.params.Set("ttl", ttl.String())
+	}
+	rtt, resp, err := requireOK(c.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	wm := &WriteMeta{}
+	wm.RequestTime = rtt
+	return wm, nil
+}
+
+// DisableMaintenance takes a node, or one of its services if a serviceID
+// is given, out of maintenance mode
+func (c *Catalog) DisableMaintenance(node, serviceID string, q *WriteOptions) (*WriteMeta, error) {
+	r := c.c.newRequest("PUT", "/v1/catalog/maintenance/"+node)
+	r.setWriteOptions(q)
+	r.params.Set("enable", "false")
+	if serviceID != "" {
+		r.params.Set("service", serviceID)
+	}
+	rtt, resp, err := requireOK(c.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	wm := &WriteMeta{}
+	wm.RequestTime = rtt
+	return wm, nil
+}
+
+// Maintenance is used to list the maintenance flags
+func (c *Catalog) Maintenance(q *QueryOptions) ([]*Maintenance, *QueryMeta, error) {
+	r := c.c.newRequest("GET", "/v1/catalog/maintenance")
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(c.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out []*Maintenance
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
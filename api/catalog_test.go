@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/hashicorp/consul/testutil"
@@ -111,6 +112,50 @@ func TestCatalog_Service(t *testing.T) {
 	})
 }
 
+func TestCatalog_Connect(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	proxy := &AgentServiceRegistration{
+		Name: "web-proxy",
+		Port: 21000,
+		Kind: ServiceKindConnectProxy,
+		Proxy: &AgentServiceConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams:              []Upstream{{DestinationName: "db", LocalBindPort: 9191}},
+		},
+	}
+	if err := c.Agent().ServiceRegister(proxy); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForResult(func() (bool, error) {
+		services, _, err := c.Catalog().Connect("web", nil)
+		if err != nil {
+			return false, err
+		}
+		if len(services) != 1 {
+			return false, fmt.Errorf("Bad: %v", services)
+		}
+		service := services[0]
+		if service.ServiceKind != ServiceKindConnectProxy || !reflect.DeepEqual(service.ServiceProxy, *proxy.Proxy) {
+			return false, fmt.Errorf("Bad: %#v", service)
+		}
+
+		entries, _, err := c.Health().Connect("web", false, nil)
+		if err != nil {
+			return false, err
+		}
+		if len(entries) != 1 || entries[0].Service.Proxy.DestinationServiceName != "web" {
+			return false, fmt.Errorf("Bad: %v", entries)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %s", err)
+	})
+}
+
 func TestCatalog_Node(t *testing.T) {
 	t.Parallel()
 	c, s := makeClient(t)
@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"time"
 )
 
 // HealthCheck is used to represent a single check
@@ -14,6 +15,30 @@ type HealthCheck struct {
 	Output      string
 	ServiceID   string
 	ServiceName string
+	CreateIndex uint64
+	ModifyIndex uint64
+
+	// Type, Target, Interval, Timeout, TTL, TLS and TLSSkipVerify describe
+	// how the agent runs the check. Type is empty for checks registered
+	// without a definition.
+	Type          string
+	Target        string
+	Interval      time.Duration
+	Timeout       time.Duration
+	TTL           time.Duration
+	TLS           bool
+	TLSSkipVerify bool
+
+	// Method, Header, Body and ExpectedStatus describe the request of
+	// an HTTP check
+	Method         string
+	Header         map[string][]string
+	Body           string
+	ExpectedStatus []string
+
+	// DockerContainerID and Shell describe where a Docker check runs
+	DockerContainerID string
+	Shell             string
 }
 
 // ServiceEntry is used for the health service endpoint
@@ -23,6 +48,33 @@ type ServiceEntry struct {
 	Checks  []*HealthCheck
 }
 
+// ServiceHealthSummary is the number of instances of a service in each
+// health state, used for the health summary endpoint
+type ServiceHealthSummary struct {
+	Service  string
+	Passing  int
+	Warning  int
+	Critical int
+}
+
+// ServiceEndpoint is an address dialed to reach a service
+type ServiceEndpoint struct {
+	Node    string
+	Address string
+	Port    int
+}
+
+// ServiceResolution is how the proxies of a datacenter reach a service of
+// another datacenter. The proxies dial the Endpoints, which are the local
+// mesh gateways when the service is remote, and those forward to the
+// mesh gateways of the remote datacenter at their WAN Gateways addresses.
+type ServiceResolution struct {
+	Datacenter  string
+	ServiceName string
+	Endpoints   []ServiceEndpoint
+	Gateways    []ServiceEndpoint
+}
+
 // Health can be used to query the Health endpoints
 type Health struct {
 	c *Client
@@ -104,6 +156,84 @@ func (h *Health) Service(service, tag string, passingOnly bool, q *QueryOptions)
 	return out, qm, nil
 }
 
+// Connect is used to query the connect-proxies of a service, with their
+// health checks. The passingOnly flag filters as in Service.
+func (h *Health) Connect(service string, passingOnly bool, q *QueryOptions) ([]*ServiceEntry, *QueryMeta, error) {
+	r := h.c.newRequest("GET", "/v1/health/service/"+service)
+	r.setQueryOptions(q)
+	r.params.Set("connect", "")
+	if passingOnly {
+		r.params.Set("passing", "1")
+	}
+	rtt, resp, err := requireOK(h.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out []*ServiceEntry
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
+// MeshGateways is used to query the mesh gateways of a datacenter. The
+// passingOnly flag filters as in Service.
+func (h *Health) MeshGateways(passingOnly bool, q *QueryOptions) ([]*ServiceEntry, *QueryMeta, error) {
+	r := h.c.newRequest("GET", "/v1/health/mesh-gateways")
+	r.setQueryOptions(q)
+	if passingOnly {
+		r.params.Set("passing", "1")
+	}
+	rtt, resp, err := requireOK(h.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out []*ServiceEntry
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
+// Resolve is used to resolve a service of the target datacenter to the
+// endpoints the proxies dial to reach it, through the mesh gateways if
+// the datacenter isn't the local one. An empty target is the local
+// datacenter.
+func (h *Health) Resolve(service, targetDC string, q *QueryOptions) (*ServiceResolution, *QueryMeta, error) {
+	r := h.c.newRequest("GET", "/v1/health/resolve/"+service)
+	r.setQueryOptions(q)
+	if targetDC != "" {
+		r.params.Set("target-dc", targetDC)
+	}
+	rtt, resp, err := requireOK(h.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out ServiceResolution
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return &out, qm, nil
+}
+
 // State is used to retrieve all the checks in a given state.
 // The wildcard "any" state can also be used for all checks.
 func (h *Health) State(state string, q *QueryOptions) ([]*HealthCheck, *QueryMeta, error) {
@@ -134,3 +264,25 @@ func (h *Health) State(state string, q *QueryOptions) ([]*HealthCheck, *QueryMet
 	}
 	return out, qm, nil
 }
+
+// Summary is used to retrieve the number of passing, warning and critical
+// instances of each service, without pulling the instances
+func (h *Health) Summary(q *QueryOptions) ([]*ServiceHealthSummary, *QueryMeta, error) {
+	r := h.c.newRequest("GET", "/v1/health/summary")
+	r.setQueryOptions(q)
+	rtt, resp, err := requireOK(h.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var out []*ServiceHealthSummary
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
@@ -123,3 +123,52 @@ func TestHealth_State(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	})
 }
+
+func TestHealth_MeshGateways(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	agent := c.Agent()
+	gateway := &AgentServiceRegistration{
+		Name:       "mesh-gateway",
+		Port:       8443,
+		Kind:       ServiceKindMeshGateway,
+		WANAddress: "198.51.100.1",
+		WANPort:    443,
+	}
+	if err := agent.ServiceRegister(gateway); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	proxy := &AgentServiceRegistration{
+		Name:  "web-proxy",
+		Port:  21000,
+		Kind:  ServiceKindConnectProxy,
+		Proxy: &AgentServiceConnectProxyConfig{DestinationServiceName: "web"},
+	}
+	if err := agent.ServiceRegister(proxy); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForResult(func() (bool, error) {
+		gateways, _, err := c.Health().MeshGateways(false, nil)
+		if err != nil {
+			return false, err
+		}
+		if len(gateways) != 1 || gateways[0].Service.WANAddress != "198.51.100.1" ||
+			gateways[0].Service.WANPort != 443 {
+			return false, fmt.Errorf("Bad: %v", gateways)
+		}
+
+		out, _, err := c.Health().Resolve("web", "", nil)
+		if err != nil {
+			return false, err
+		}
+		if out.Datacenter != "dc1" || len(out.Endpoints) != 1 || out.Endpoints[0].Port != 21000 {
+			return false, fmt.Errorf("Bad: %v", out)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %s", err)
+	})
+}
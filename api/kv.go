@@ -54,9 +54,46 @@ func (k *KV) Get(key string, q *QueryOptions) (*KVPair, *QueryMeta, error) {
 	return nil, qm, nil
 }
 
+// GetAtIndex is used to lookup a single key as it existed at a Raft
+// index, from the KV history of the servers. A nil pair is returned if
+// the key didn't exist at the index, and an error if the history needed
+// to answer has not been retained.
+func (k *KV) GetAtIndex(key string, index uint64, q *QueryOptions) (*KVPair, *QueryMeta, error) {
+	params := map[string]string{"at": strconv.FormatUint(index, 10)}
+	resp, qm, err := k.getInternal(key, params, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp == nil {
+		return nil, qm, nil
+	}
+	defer resp.Body.Close()
+
+	var entries []*KVPair
+	if err := decodeBody(resp, &entries); err != nil {
+		return nil, nil, err
+	}
+	if len(entries) > 0 {
+		return entries[0], qm, nil
+	}
+	return nil, qm, nil
+}
+
 // List is used to lookup all keys under a prefix
 func (k *KV) List(prefix string, q *QueryOptions) (KVPairs, *QueryMeta, error) {
-	resp, qm, err := k.getInternal(prefix, map[string]string{"recurse": ""}, q)
+	return k.list(prefix, map[string]string{"recurse": ""}, q)
+}
+
+// ListGlob is used to lookup all keys matching a glob pattern, such as
+// "config/*/database", or under a key matching it. The wildcards don't
+// match a '/'.
+func (k *KV) ListGlob(pattern string, q *QueryOptions) (KVPairs, *QueryMeta, error) {
+	return k.list(pattern, map[string]string{"recurse": "", "glob": ""}, q)
+}
+
+// list is used to lookup the keys of a recursive query
+func (k *KV) list(key string, params map[string]string, q *QueryOptions) (KVPairs, *QueryMeta, error) {
+	resp, qm, err := k.getInternal(key, params, q)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -186,6 +223,9 @@ func (k *KV) put(key string, params map[string]string, body []byte, q *WriteOpti
 
 	qm := &WriteMeta{}
 	qm.RequestTime = rtt
+	if err := parseWriteMeta(resp, qm); err != nil {
+		return false, nil, err
+	}
 
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, resp.Body); err != nil {
@@ -230,6 +270,9 @@ func (k *KV) deleteInternal(key string, params map[string]string, q *WriteOption
 
 	qm := &WriteMeta{}
 	qm.RequestTime = rtt
+	if err := parseWriteMeta(resp, qm); err != nil {
+		return false, nil, err
+	}
 
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, resp.Body); err != nil {
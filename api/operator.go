@@ -0,0 +1,401 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Operator can be used to perform cluster-wide operations
+type Operator struct {
+	c *Client
+}
+
+// Operator returns a handle to the operator endpoints
+func (c *Client) Operator() *Operator {
+	return &Operator{c}
+}
+
+// KeyringResponse is the keyring of a gossip pool of a datacenter
+type KeyringResponse struct {
+	// WAN is set for the WAN pool, otherwise it is the LAN pool of the
+	// datacenter
+	WAN bool
+
+	Datacenter string
+
+	// Messages has the errors reported by some nodes, by node name
+	Messages map[string]string
+
+	// Keys counts the nodes having each key installed
+	Keys map[string]int
+
+	// NumNodes is the number of nodes of the pool
+	NumNodes int
+}
+
+// StateProblem is an inconsistency found in the state store
+type StateProblem struct {
+	// Table is the table of the inconsistent row
+	Table string
+
+	// Key identifies the row, e.g. "node/service-id"
+	Key string
+
+	Problem string
+}
+
+// StateVerifyReport is the result of checking the integrity of the state
+// store of a server
+type StateVerifyReport struct {
+	// Server is the name of the server that verified its state
+	Server string
+
+	// Index is the last index of the state that was verified
+	Index uint64
+
+	// Rows is the number of rows verified in each table
+	Rows map[string]int
+
+	// Problems are the inconsistencies that were found
+	Problems []StateProblem
+}
+
+// RaftServer is a server of the Raft configuration
+type RaftServer struct {
+	// Node is the name of the server, or empty if no member of the LAN
+	// pool has its address
+	Node string
+
+	// Address is the address of the server for Raft
+	Address string
+
+	// Status is the status of the server in the LAN pool, or "unknown"
+	Status string
+
+	// Leader is set for the current leader
+	Leader bool
+}
+
+// AutopilotConfiguration is the configuration of the management of the
+// servers by the leader
+type AutopilotConfiguration struct {
+	// CleanupDeadServers controls if failed servers are removed from the
+	// Raft configuration once healthy replacements have been added
+	CleanupDeadServers bool
+
+	// ServerStabilizationTime is how long a new server must be healthy
+	// before it is added to the Raft configuration, and how long a
+	// server must have failed before it is removed
+	ServerStabilizationTime time.Duration
+
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// keyringRequest is the body of the keyring modifications
+type keyringRequest struct {
+	Key string
+}
+
+// KeyringInstall is used to install a new gossip encryption key on every
+// node of the cluster
+func (op *Operator) KeyringInstall(key string, q *WriteOptions) error {
+	return op.keyring("POST", key, q)
+}
+
+// KeyringList is used to list the gossip encryption keys installed on
+// the nodes of every pool
+func (op *Operator) KeyringList(q *QueryOptions) ([]*KeyringResponse, error) {
+	r := op.c.newRequest("GET", "/v1/operator/keyring")
+	r.setQueryOptions(q)
+	_, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out []*KeyringResponse
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KeyringRemove is used to remove a gossip encryption key from every node
+// of the cluster. The key in use can't be removed.
+func (op *Operator) KeyringRemove(key string, q *WriteOptions) error {
+	return op.keyring("DELETE", key, q)
+}
+
+// KeyringUse is used to switch the encryption of the gossip messages to
+// an installed key
+func (op *Operator) KeyringUse(key string, q *WriteOptions) error {
+	return op.keyring("PUT", key, q)
+}
+
+// keyring makes a keyring modification
+func (op *Operator) keyring(method, key string, q *WriteOptions) error {
+	r := op.c.newRequest(method, "/v1/operator/keyring")
+	r.setWriteOptions(q)
+	r.obj = keyringRequest{Key: key}
+	_, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RaftGetConfiguration is used to list the servers of the Raft
+// configuration
+func (op *Operator) RaftGetConfiguration(q *QueryOptions) ([]*RaftServer, *QueryMeta, error) {
+	var out []*RaftServer
+	qm, err := op.c.query("/v1/operator/raft/configuration", &out, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
+// RaftRemovePeerByAddress is used to remove a failed server from the
+// Raft configuration, given its address for Raft
+func (op *Operator) RaftRemovePeerByAddress(address string, q *WriteOptions) error {
+	r := op.c.newRequest("DELETE", "/v1/operator/raft/peer")
+	r.setWriteOptions(q)
+	r.params.Set("address", address)
+	_, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// StateVerify is used to check the integrity of the state store of the
+// leader, or of any server with a stale query
+func (op *Operator) StateVerify(q *QueryOptions) (*StateVerifyReport, error) {
+	r := op.c.newRequest("GET", "/v1/operator/state/verify")
+	r.setQueryOptions(q)
+	_, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out StateVerifyReport
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AutopilotGetConfiguration is used to get the autopilot configuration,
+// which is that of the servers until one is set
+func (op *Operator) AutopilotGetConfiguration(q *QueryOptions) (*AutopilotConfiguration, *QueryMeta, error) {
+	var out AutopilotConfiguration
+	qm, err := op.c.query("/v1/operator/autopilot/configuration", &out, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &out, qm, nil
+}
+
+// AutopilotSetConfiguration is used to set the autopilot configuration
+func (op *Operator) AutopilotSetConfiguration(conf *AutopilotConfiguration, q *WriteOptions) error {
+	_, err := op.autopilotSet(conf, false, q)
+	return err
+}
+
+// AutopilotCASConfiguration is used to set the autopilot configuration
+// only if its ModifyIndex matches that of the current configuration, 0
+// matching a configuration that was never set. It returns false if the
+// configuration was modified since.
+func (op *Operator) AutopilotCASConfiguration(conf *AutopilotConfiguration, q *WriteOptions) (bool, error) {
+	return op.autopilotSet(conf, true, q)
+}
+
+// autopilotSet sets the autopilot configuration, with a CAS on its
+// ModifyIndex if requested
+func (op *Operator) autopilotSet(conf *AutopilotConfiguration, cas bool, q *WriteOptions) (bool, error) {
+	r := op.c.newRequest("PUT", "/v1/operator/autopilot/configuration")
+	r.setWriteOptions(q)
+	if cas {
+		r.params.Set("cas", strconv.FormatUint(conf.ModifyIndex, 10))
+	}
+	r.obj = conf
+	_, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var out bool
+	if err := decodeBody(resp, &out); err != nil {
+		return false, err
+	}
+	return out, nil
+}
+
+// AutoEncryptTokenRequest is used to create a one-time auto-encrypt
+// token for the certificate of a node. A zero TTL uses the default of
+// the servers.
+type AutoEncryptTokenRequest struct {
+	Node        string
+	Description string
+	TTL         time.Duration
+}
+
+// AutoEncryptToken is a one-time token with which an agent obtains its
+// TLS certificate from the servers. The secret can't be read again.
+type AutoEncryptToken struct {
+	Secret    string
+	ExpiresAt time.Time
+}
+
+// AutoEncryptTokenCreate is used to create a one-time auto-encrypt token
+func (op *Operator) AutoEncryptTokenCreate(req *AutoEncryptTokenRequest, q *WriteOptions) (*AutoEncryptToken, *WriteMeta, error) {
+	r := op.c.newRequest("PUT", "/v1/operator/auto-encrypt/token")
+	r.setWriteOptions(q)
+	if req != nil {
+		r.obj = req
+	}
+	rtt, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	var out AutoEncryptToken
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return &out, wm, nil
+}
+
+// Area is a network area, linking the datacenter to a peer datacenter
+// without the WAN gossip pool. The servers of the peer are discovered
+// from the server RPC addresses of RetryJoin.
+type Area struct {
+	ID             string
+	PeerDatacenter string
+	RetryJoin      []string
+	UseTLS         bool
+	CreateIndex    uint64
+	ModifyIndex    uint64
+}
+
+// AreaServer is a server of the peer datacenter of an area
+type AreaServer struct {
+	Address     string
+	Healthy     bool
+	LastContact time.Time
+	LastError   string
+}
+
+// AreaMembers are the servers of the peer datacenter of an area
+type AreaMembers struct {
+	Datacenter string
+	Servers    []*AreaServer
+}
+
+// AreaCreate is used to create a network area, returning its ID
+func (op *Operator) AreaCreate(area *Area, q *WriteOptions) (string, *WriteMeta, error) {
+	return op.areaUpsert("POST", "/v1/operator/area", area, q)
+}
+
+// AreaUpdate is used to update the network area of the given ID
+func (op *Operator) AreaUpdate(id string, area *Area, q *WriteOptions) (*WriteMeta, error) {
+	_, wm, err := op.areaUpsert("PUT", "/v1/operator/area/"+id, area, q)
+	return wm, err
+}
+
+// areaUpsert creates or updates a network area
+func (op *Operator) areaUpsert(method, endpoint string, area *Area, q *WriteOptions) (string, *WriteMeta, error) {
+	r := op.c.newRequest(method, endpoint)
+	r.setWriteOptions(q)
+	r.obj = area
+	rtt, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	var out struct{ ID string }
+	if err := decodeBody(resp, &out); err != nil {
+		return "", nil, err
+	}
+	return out.ID, wm, nil
+}
+
+// AreaGet is used to get a network area, or nil if it doesn't exist
+func (op *Operator) AreaGet(id string, q *QueryOptions) (*Area, *QueryMeta, error) {
+	r := op.c.newRequest("GET", "/v1/operator/area/"+id)
+	r.setQueryOptions(q)
+	rtt, resp, err := op.c.doRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	if resp.StatusCode == 404 {
+		return nil, qm, nil
+	} else if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+
+	var out []*Area
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	if len(out) == 0 {
+		return nil, qm, nil
+	}
+	return out[0], qm, nil
+}
+
+// AreaList is used to list the network areas
+func (op *Operator) AreaList(q *QueryOptions) ([]*Area, *QueryMeta, error) {
+	var out []*Area
+	qm, err := op.c.query("/v1/operator/area", &out, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
+// AreaDelete is used to delete a network area
+func (op *Operator) AreaDelete(id string, q *WriteOptions) (*WriteMeta, error) {
+	r := op.c.newRequest("DELETE", "/v1/operator/area/"+id)
+	r.setWriteOptions(q)
+	rtt, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &WriteMeta{RequestTime: rtt}, nil
+}
+
+// AreaMembers is used to list the servers of the peer datacenter of a
+// network area, as seen by the server answering
+func (op *Operator) AreaMembers(id string, q *QueryOptions) (*AreaMembers, error) {
+	r := op.c.newRequest("GET", "/v1/operator/area/"+id+"/members")
+	r.setQueryOptions(q)
+	_, resp, err := requireOK(op.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out AreaMembers
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
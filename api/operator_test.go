@@ -0,0 +1,173 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestOperator_Keyring(t *testing.T) {
+	t.Parallel()
+	key1 := "tbLJg26ZJyJ9pK3qhc9jig=="
+	key2 := "4leC33rgtXKIVUr9Nr0snQ=="
+	c, s := makeClientWithConfig(t, nil, func(c *testutil.TestServerConfig) {
+		c.Encrypt = key1
+	})
+	defer s.Stop()
+
+	operator := c.Operator()
+	if err := operator.KeyringInstall(key2, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := operator.KeyringUse(key2, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := operator.KeyringRemove(key1, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	keys, err := operator.KeyringList(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("bad: %v", keys)
+	}
+	for _, pool := range keys {
+		if len(pool.Keys) != 1 || pool.Keys[key2] != 1 || pool.NumNodes != 1 {
+			t.Fatalf("bad: %v", pool)
+		}
+	}
+}
+
+func TestOperator_Raft(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	operator := c.Operator()
+	servers, qm, err := operator.RaftGetConfiguration(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(servers) != 1 || !servers[0].Leader || servers[0].Status != "alive" {
+		t.Fatalf("bad: %v", servers)
+	}
+	if qm.LastIndex == 0 {
+		t.Fatalf("bad: %v", qm)
+	}
+
+	err = operator.RaftRemovePeerByAddress("127.0.0.1:1", nil)
+	if err == nil || !strings.Contains(err.Error(), "not found in the Raft configuration") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_AutopilotConfiguration(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	operator := c.Operator()
+	conf, _, err := operator.AutopilotGetConfiguration(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !conf.CleanupDeadServers {
+		t.Fatalf("bad: %#v", conf)
+	}
+
+	conf.CleanupDeadServers = false
+	conf.ServerStabilizationTime = 30 * time.Second
+	ok, err := operator.AutopilotCASConfiguration(conf, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("should set")
+	}
+
+	// The index is stale now
+	ok, err = operator.AutopilotCASConfiguration(conf, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("should fail")
+	}
+
+	conf.CleanupDeadServers = true
+	if err := operator.AutopilotSetConfiguration(conf, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf, _, err = operator.AutopilotGetConfiguration(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !conf.CleanupDeadServers || conf.ServerStabilizationTime != 30*time.Second {
+		t.Fatalf("bad: %#v", conf)
+	}
+}
+
+func TestOperator_StateVerify(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	report, err := c.Operator().StateVerify(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Index == 0 || report.Rows["nodes"] != 1 || len(report.Problems) != 0 {
+		t.Fatalf("bad: %#v", report)
+	}
+}
+
+func TestOperator_Area(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	operator := c.Operator()
+	area := &Area{
+		PeerDatacenter: "dc2",
+		RetryJoin:      []string{"127.0.0.1:1"},
+	}
+	id, _, err := operator.AreaCreate(area, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, _, err := operator.AreaGet(id, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out == nil || out.ID != id || out.PeerDatacenter != "dc2" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	area.RetryJoin = []string{"127.0.0.1:2"}
+	if _, err := operator.AreaUpdate(id, area, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	areas, _, err := operator.AreaList(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(areas) != 1 || areas[0].RetryJoin[0] != "127.0.0.1:2" {
+		t.Fatalf("bad: %#v", areas)
+	}
+
+	if _, err := operator.AreaDelete(id, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, _, err = operator.AreaGet(id, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+}
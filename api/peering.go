@@ -0,0 +1,183 @@
+package api
+
+import (
+	"fmt"
+)
+
+const (
+	// PeeringPending is the state of a peering a token was generated
+	// for, until the peer establishes it
+	PeeringPending = "pending"
+
+	// PeeringEstablishing is the state of a peering established from a
+	// token, until the peer first answers
+	PeeringEstablishing = "establishing"
+
+	// PeeringActive is the state of a peering whose last exchange of
+	// services succeeded
+	PeeringActive = "active"
+
+	// PeeringFailing is the state of a peering whose last exchange of
+	// services failed
+	PeeringFailing = "failing"
+)
+
+// Peering links the datacenter to a peer cluster, with which it shares
+// the exported services without WAN federation
+type Peering struct {
+	ID    string
+	Name  string
+	State string
+
+	// PeerID, PeerDatacenter and PeerServerAddresses identify the peer on
+	// the side that established the peering from a token
+	PeerID              string
+	PeerDatacenter      string
+	PeerServerAddresses []string
+
+	// LastError is the error of the last exchange of services, if it
+	// failed
+	LastError string
+
+	// ImportedServices are the names of the services imported from the
+	// peer. They are only returned by Read.
+	ImportedServices []string
+
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// ExportedService selects a service, or all of them with the name "*",
+// to share with the peers named by Consumers
+type ExportedService struct {
+	Name      string
+	Consumers []string
+}
+
+// ExportedServicesConfig is the configuration of the services shared
+// with the peers
+type ExportedServicesConfig struct {
+	Services    []ExportedService
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// Peerings can be used to manage the peerings with other clusters
+type Peerings struct {
+	c *Client
+}
+
+// Peerings returns a handle to the peering endpoints
+func (c *Client) Peerings() *Peerings {
+	return &Peerings{c}
+}
+
+// GenerateToken is used to create a pending peering with the named peer,
+// and returns the token the peer establishes it with
+func (p *Peerings) GenerateToken(peerName string, q *WriteOptions) (string, *WriteMeta, error) {
+	in := map[string]string{"PeerName": peerName}
+	var out struct{ PeeringToken string }
+	wm, err := p.post("/v1/peering/token", in, &out, q)
+	if err != nil {
+		return "", nil, err
+	}
+	return out.PeeringToken, wm, nil
+}
+
+// Establish is used to establish a peering with the token generated by
+// the peer, under the given name, and returns its ID
+func (p *Peerings) Establish(peerName, token string, q *WriteOptions) (string, *WriteMeta, error) {
+	in := map[string]string{"PeerName": peerName, "PeeringToken": token}
+	var out struct{ ID string }
+	wm, err := p.post("/v1/peering/establish", in, &out, q)
+	if err != nil {
+		return "", nil, err
+	}
+	return out.ID, wm, nil
+}
+
+// post sends the body of a POST to a peering endpoint, and decodes its
+// response
+func (p *Peerings) post(endpoint string, in, out interface{}, q *WriteOptions) (*WriteMeta, error) {
+	r := p.c.newRequest("POST", endpoint)
+	r.setWriteOptions(q)
+	r.obj = in
+	rtt, resp, err := requireOK(p.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	if err := decodeBody(resp, out); err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+// List is used to list the peerings
+func (p *Peerings) List(q *QueryOptions) ([]*Peering, *QueryMeta, error) {
+	var out []*Peering
+	qm, err := p.c.query("/v1/peerings", &out, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, qm, nil
+}
+
+// Read is used to get the peering with the named peer, with the names of
+// the services imported from it, or nil if it doesn't exist
+func (p *Peerings) Read(peerName string, q *QueryOptions) (*Peering, *QueryMeta, error) {
+	r := p.c.newRequest("GET", "/v1/peering/"+peerName)
+	r.setQueryOptions(q)
+	rtt, resp, err := p.c.doRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	if resp.StatusCode == 404 {
+		return nil, qm, nil
+	} else if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+
+	var out Peering
+	if err := decodeBody(resp, &out); err != nil {
+		return nil, nil, err
+	}
+	return &out, qm, nil
+}
+
+// Delete is used to delete the peering with the named peer, along with
+// the services imported from it
+func (p *Peerings) Delete(peerName string, q *WriteOptions) (*WriteMeta, error) {
+	r := p.c.newRequest("DELETE", "/v1/peering/"+peerName)
+	r.setWriteOptions(q)
+	rtt, resp, err := requireOK(p.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &WriteMeta{RequestTime: rtt}, nil
+}
+
+// ExportedServices is used to get the services exported to the peers
+func (p *Peerings) ExportedServices(q *QueryOptions) (*ExportedServicesConfig, *QueryMeta, error) {
+	var out ExportedServicesConfig
+	qm, err := p.c.query("/v1/exported-services", &out, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &out, qm, nil
+}
+
+// SetExportedServices is used to replace the services exported to the
+// peers
+func (p *Peerings) SetExportedServices(config *ExportedServicesConfig, q *WriteOptions) (*WriteMeta, error) {
+	return p.c.write("/v1/exported-services", config, nil, q)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestPeerings(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	reg := &CatalogRegistration{
+		Datacenter: "dc1",
+		Node:       "foobar",
+		Address:    "192.168.10.10",
+		Service:    &AgentService{ID: "web", Service: "web", Port: 80},
+	}
+	if _, err := c.Catalog().Register(reg, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The cluster peers with itself, under two names
+	peerings := c.Peerings()
+	config := &ExportedServicesConfig{
+		Services: []ExportedService{{Name: "web", Consumers: []string{"self"}}},
+	}
+	if _, err := peerings.SetExportedServices(config, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, _, err := peerings.ExportedServices(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Services) != 1 || out.Services[0].Consumers[0] != "self" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	token, _, err := peerings.GenerateToken("self", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id, _, err := peerings.Establish("loop", token, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForResult(func() (bool, error) {
+		peering, _, err := peerings.Read("loop", nil)
+		if err != nil {
+			return false, err
+		}
+		if peering == nil || peering.ID != id || peering.State != PeeringActive {
+			return false, fmt.Errorf("bad: %#v", peering)
+		}
+		return len(peering.ImportedServices) == 1, fmt.Errorf("bad: %v", peering.ImportedServices)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// The imported service is queried with the peer name
+	entries, _, err := c.Health().Service("web", "", false, &QueryOptions{Peer: "loop"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Node.Address != "192.168.10.10" {
+		t.Fatalf("bad: %#v", entries)
+	}
+
+	list, _, err := peerings.List(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "loop" || list[1].Name != "self" {
+		t.Fatalf("bad: %#v", list)
+	}
+
+	if _, err := peerings.Delete("loop", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	peering, _, err := peerings.Read("loop", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if peering != nil {
+		t.Fatalf("bad: %#v", peering)
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRateLimitRetries is how many times a throttled request is
+	// retried, if the Config doesn't set RateLimitRetries
+	DefaultRateLimitRetries = 3
+
+	// rateLimitWait is the base wait before retrying a throttled request
+	// whose response has no Retry-After header, which grows with the
+	// attempts
+	rateLimitWait = time.Second
+
+	// rateLimitMaxWait bounds the wait before retrying a throttled request
+	rateLimitMaxWait = time.Minute
+)
+
+// RateLimitEvent describes a request throttled by the agent with a 429
+// response. It is passed to the RateLimitHandler of the Config.
+type RateLimitEvent struct {
+	Method string
+	Path   string
+
+	// Attempt is the number of times the request was throttled so far
+	Attempt int
+
+	// RetryAfter is how long the client waits before retrying, from the
+	// Retry-After header of the response
+	RetryAfter time.Duration
+
+	// Retrying is false once the retries are exhausted, or if the body
+	// of the request can't be sent again, in which case the 429 response
+	// is returned
+	Retrying bool
+}
+
+// Throttled returns how many responses of the agent throttled the
+// requests of the client
+func (c *Client) Throttled() uint64 {
+	return atomic.LoadUint64(&c.throttled)
+}
+
+// rateLimitRetries returns how many times a throttled request is retried
+func (c *Client) rateLimitRetries() int {
+	switch {
+	case c.config.RateLimitRetries < 0:
+		return 0
+	case c.config.RateLimitRetries == 0:
+		return DefaultRateLimitRetries
+	default:
+		return c.config.RateLimitRetries
+	}
+}
+
+// retryAfter returns how long to wait before retrying a throttled
+// request, from the Retry-After header of the response, in seconds or as
+// a date. Without one, the wait grows with the attempts.
+func retryAfter(header http.Header, attempt int) time.Duration {
+	wait := rateLimitWait * time.Duration(attempt*attempt)
+	if raw := header.Get("Retry-After"); raw != "" {
+		if secs, err := strconv.Atoi(raw); err == nil && secs >= 0 {
+			wait = time.Duration(secs) * time.Second
+		} else if date, err := http.ParseTime(raw); err == nil {
+			wait = date.Sub(time.Now())
+			if wait < 0 {
+				wait = 0
+			}
+		}
+	}
+	if wait > rateLimitMaxWait {
+		wait = rateLimitMaxWait
+	}
+	return wait
+}
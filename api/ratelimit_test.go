@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_RateLimit(t *testing.T) {
+	t.Parallel()
+	var l sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		calls++
+		throttle := calls <= 2 || r.Method == "PUT"
+		l.Unlock()
+		if throttle {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(429)
+			return
+		}
+		w.Write([]byte(`"127.0.0.1:8300"`))
+	}))
+	defer srv.Close()
+
+	var events []*RateLimitEvent
+	conf := DefaultConfig()
+	conf.Address = strings.TrimPrefix(srv.URL, "http://")
+	conf.RateLimitRetries = 2
+	conf.RateLimitHandler = func(e *RateLimitEvent) {
+		events = append(events, e)
+	}
+	c, err := NewClient(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The read succeeds after two retries
+	leader, err := c.Status().Leader()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if leader != "127.0.0.1:8300" {
+		t.Fatalf("bad: %v", leader)
+	}
+	if len(events) != 2 || !events[0].Retrying || events[1].Attempt != 2 ||
+		events[1].Path != "/v1/status/leader" {
+		t.Fatalf("bad: %#v", events)
+	}
+
+	// The write gives up after its retries
+	events = nil
+	_, err = c.KV().Put(&KVPair{Key: "foo", Value: []byte("bar")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("bad: %v", err)
+	}
+	if len(events) != 3 || events[2].Retrying || events[1].Method != "PUT" {
+		t.Fatalf("bad: %#v", events)
+	}
+	if n := c.Throttled(); n != 5 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestClient_RetryAfter(t *testing.T) {
+	header := make(http.Header)
+	if wait := retryAfter(header, 1); wait != rateLimitWait {
+		t.Fatalf("bad: %v", wait)
+	}
+	if wait := retryAfter(header, 3); wait != 9*rateLimitWait {
+		t.Fatalf("bad: %v", wait)
+	}
+
+	header.Set("Retry-After", "5")
+	if wait := retryAfter(header, 1); wait != 5*time.Second {
+		t.Fatalf("bad: %v", wait)
+	}
+	header.Set("Retry-After", "3600")
+	if wait := retryAfter(header, 1); wait != rateLimitMaxWait {
+		t.Fatalf("bad: %v", wait)
+	}
+
+	header.Set("Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	if wait := retryAfter(header, 1); wait != 0 {
+		t.Fatalf("bad: %v", wait)
+	}
+	header.Set("Retry-After", time.Now().Add(30*time.Second).UTC().Format(http.TimeFormat))
+	if wait := retryAfter(header, 1); wait <= 20*time.Second || wait > 30*time.Second {
+		t.Fatalf("bad: %v", wait)
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultServerCooldown is how long a server is skipped after a
+// connection error, if the Config doesn't set ServerCooldown
+const DefaultServerCooldown = 30 * time.Second
+
+// serverState is the health of an address of the client
+type serverState struct {
+	addr string
+
+	// failedAt is the time of the last connection error, and is zero
+	// while the server is healthy
+	failedAt time.Time
+}
+
+// serverList tracks the health of the addresses of a client, to fail
+// over between them. A connection error opens the circuit of a server,
+// which is then only tried after the healthy ones until the cooldown
+// passes.
+type serverList struct {
+	servers  []*serverState
+	cooldown time.Duration
+	l        sync.Mutex
+}
+
+// newServerList returns a server list of the given addresses, in order
+// of preference, skipping duplicates
+func newServerList(addrs []string, cooldown time.Duration) *serverList {
+	if cooldown <= 0 {
+		cooldown = DefaultServerCooldown
+	}
+	l := &serverList{cooldown: cooldown}
+	seen := make(map[string]struct{})
+	for _, addr := range addrs {
+		if _, ok := seen[addr]; ok || addr == "" {
+			continue
+		}
+		seen[addr] = struct{}{}
+		l.servers = append(l.servers, &serverState{addr: addr})
+	}
+	return l
+}
+
+// order returns the addresses to try. The healthy servers and those whose
+// cooldown passed come first, in order of preference, followed by the
+// others, from the oldest failure.
+func (l *serverList) order() []string {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	now := time.Now()
+	var ready, open []*serverState
+	for _, s := range l.servers {
+		if s.failedAt.IsZero() || now.Sub(s.failedAt) >= l.cooldown {
+			ready = append(ready, s)
+		} else {
+			open = append(open, s)
+		}
+	}
+	sort.Sort(serversByFailure(open))
+
+	addrs := make([]string, 0, len(l.servers))
+	for _, s := range append(ready, open...) {
+		addrs = append(addrs, s.addr)
+	}
+	return addrs
+}
+
+// success closes the circuit of a server
+func (l *serverList) success(addr string) {
+	l.update(addr, time.Time{})
+}
+
+// failure opens the circuit of a server
+func (l *serverList) failure(addr string) {
+	l.update(addr, time.Now())
+}
+
+func (l *serverList) update(addr string, failedAt time.Time) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	for _, s := range l.servers {
+		if s.addr == addr {
+			s.failedAt = failedAt
+		}
+	}
+}
+
+// healthy returns the addresses of the servers whose circuit is closed
+func (l *serverList) healthy() []string {
+	l.l.Lock()
+	defer l.l.Unlock()
+	var addrs []string
+	for _, s := range l.servers {
+		if s.failedAt.IsZero() {
+			addrs = append(addrs, s.addr)
+		}
+	}
+	return addrs
+}
+
+// serversByFailure sorts servers by the time of their last failure
+type serversByFailure []*serverState
+
+func (s serversByFailure) Len() int      { return len(s) }
+func (s serversByFailure) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s serversByFailure) Less(i, j int) bool {
+	return s[i].failedAt.Before(s[j].failedAt)
+}
+
+// CheckServers checks the health of every address of the client with a
+// request to the status endpoint, opening or closing their circuits,
+// and returns the healthy addresses. It can be run periodically so that
+// requests don't have to find the failed servers.
+func (c *Client) CheckServers() []string {
+	for _, addr := range c.servers.order() {
+		r := c.newRequest("GET", "/v1/status/leader")
+		r.url.Host = addr
+		req, err := r.toHTTP()
+		if err != nil {
+			continue
+		}
+		resp, err := c.config.HttpClient.Do(req)
+		if err != nil {
+			c.servers.failure(addr)
+			continue
+		}
+		resp.Body.Close()
+		c.servers.success(addr)
+	}
+	return c.servers.healthy()
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClient_Failover(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	// Nothing listens on the first address
+	conf := DefaultConfig()
+	conf.Address = "127.0.0.1:1"
+	conf.Addresses = []string{s.HTTPAddr}
+	conf.ServerCooldown = time.Hour
+	client, err := NewClient(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	kv := client.KV()
+	key := testKey()
+
+	// A write isn't retried
+	if _, err := kv.Put(&KVPair{Key: key, Value: []byte("test")}, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// A read is, and the failed server is skipped afterwards
+	if _, _, err := kv.Get(key, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if order := client.servers.order(); order[0] != s.HTTPAddr {
+		t.Fatalf("bad: %v", order)
+	}
+	if _, err := kv.Put(&KVPair{Key: key, Value: []byte("test")}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pair, _, err := c.KV().Get(key, nil)
+	if err != nil || pair == nil {
+		t.Fatalf("bad: %v %v", pair, err)
+	}
+
+	healthy := client.CheckServers()
+	if len(healthy) != 1 || healthy[0] != s.HTTPAddr {
+		t.Fatalf("bad: %v", healthy)
+	}
+}
+
+func TestServerList_Order(t *testing.T) {
+	l := newServerList([]string{"a", "b", "c", "a", ""}, 50*time.Millisecond)
+	if order := l.order(); len(order) != 3 {
+		t.Fatalf("bad: %v", order)
+	}
+
+	l.failure("b")
+	time.Sleep(time.Millisecond)
+	l.failure("a")
+	if order := l.order(); order[0] != "c" || order[1] != "b" || order[2] != "a" {
+		t.Fatalf("bad: %v", order)
+	}
+	if healthy := l.healthy(); len(healthy) != 1 || healthy[0] != "c" {
+		t.Fatalf("bad: %v", healthy)
+	}
+
+	// Once the cooldown passes, they are tried in order again
+	time.Sleep(60 * time.Millisecond)
+	if order := l.order(); order[0] != "a" || order[1] != "b" || order[2] != "c" {
+		t.Fatalf("bad: %v", order)
+	}
+	l.success("a")
+	if healthy := l.healthy(); len(healthy) != 2 {
+		t.Fatalf("bad: %v", healthy)
+	}
+}
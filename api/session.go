@@ -22,6 +22,7 @@ var ErrSessionExpired = errors.New("session expired")
 // SessionEntry represents a session in consul
 type SessionEntry struct {
 	CreateIndex uint64
+	ModifyIndex uint64
 	ID          string
 	Name        string
 	Node        string
@@ -215,3 +216,26 @@ func (s *Session) List(q *QueryOptions) ([]*SessionEntry, *QueryMeta, error) {
 	}
 	return entries, qm, nil
 }
+
+// Expiring gets the sessions whose TTL expires within the window unless
+// they are renewed, soonest first
+func (s *Session) Expiring(window time.Duration, q *QueryOptions) ([]*SessionEntry, *QueryMeta, error) {
+	r := s.c.newRequest("GET", "/v1/session/expiring")
+	r.setQueryOptions(q)
+	r.params.Set("window", window.String())
+	rtt, resp, err := requireOK(s.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+
+	var entries []*SessionEntry
+	if err := decodeBody(resp, &entries); err != nil {
+		return nil, nil, err
+	}
+	return entries, qm, nil
+}
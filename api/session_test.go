@@ -312,3 +312,37 @@ func TestSession_List(t *testing.T) {
 		t.Fatalf("bad: %v", qm)
 	}
 }
+
+func TestSession_Expiring(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	session := c.Session()
+
+	id, _, err := session.Create(&SessionEntry{TTL: "10s"}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer session.Destroy(id, nil)
+
+	sessions, qm, err := session.Expiring(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != id {
+		t.Fatalf("bad: %v", sessions)
+	}
+	if qm.LastIndex == 0 {
+		t.Fatalf("bad: %v", qm)
+	}
+
+	// The timer of the session is further than the window
+	sessions, _, err = session.Expiring(time.Second, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("bad: %v", sessions)
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"io"
+)
+
+// Snapshot can be used to back up and restore the state of the servers
+type Snapshot struct {
+	c *Client
+}
+
+// Snapshot returns a handle to the snapshot endpoints
+func (c *Client) Snapshot() *Snapshot {
+	return &Snapshot{c}
+}
+
+// Save requests a point in time snapshot archive of the state. The
+// archive must be read from the returned reader, which the caller must
+// close.
+func (s *Snapshot) Save(q *QueryOptions) (io.ReadCloser, *QueryMeta, error) {
+	return s.save(false, nil, q)
+}
+
+// SaveRedacted is like Save, but the ACL tokens and session IDs of the
+// archive are replaced and the values of the keys under the prefixes are
+// masked, so the archive can be shared
+func (s *Snapshot) SaveRedacted(prefixes []string, q *QueryOptions) (io.ReadCloser, *QueryMeta, error) {
+	return s.save(true, prefixes, q)
+}
+
+func (s *Snapshot) save(redact bool, prefixes []string, q *QueryOptions) (io.ReadCloser, *QueryMeta, error) {
+	r := s.c.newRequest("GET", "/v1/snapshot")
+	r.setQueryOptions(q)
+	if redact {
+		r.params.Set("redact", "")
+		for _, prefix := range prefixes {
+			r.params.Add("redact-prefix", prefix)
+		}
+	}
+	rtt, resp, err := requireOK(s.c.doRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	qm := &QueryMeta{}
+	parseQueryMeta(resp, qm)
+	qm.RequestTime = rtt
+	return resp.Body, qm, nil
+}
+
+// Restore replaces the state of the servers with the state of the
+// snapshot archive read from in
+func (s *Snapshot) Restore(in io.Reader, q *WriteOptions) (*WriteMeta, error) {
+	r := s.c.newRequest("PUT", "/v1/snapshot")
+	r.setWriteOptions(q)
+	r.body = in
+	rtt, resp, err := requireOK(s.c.doRequest(r))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	return wm, nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	kv := c.KV()
+	if _, err := kv.Put(&KVPair{Key: "test", Value: []byte("before")}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snapshot := c.Snapshot()
+	rc, qm, err := snapshot.Save(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	archive, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if qm.LastIndex == 0 || len(archive) == 0 {
+		t.Fatalf("bad: %v %d", qm, len(archive))
+	}
+
+	if _, err := kv.Put(&KVPair{Key: "test", Value: []byte("after")}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := snapshot.Restore(bytes.NewReader(archive), nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pair, _, err := kv.Get("test", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair == nil || string(pair.Value) != "before" {
+		t.Fatalf("bad: %v", pair)
+	}
+}
+
+func TestSnapshot_SaveRedacted(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	kv := c.KV()
+	if _, err := kv.Put(&KVPair{Key: "secret/db", Value: []byte("hunter2")}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rc, _, err := c.Snapshot().SaveRedacted([]string{"secret/"}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	archive, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(archive) == 0 || bytes.Contains(archive, []byte("hunter2")) {
+		t.Fatalf("bad: %d", len(archive))
+	}
+}
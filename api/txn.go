@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// The verbs of the transaction operations. The KV operations use the
+// KV verbs, and the node, service and check operations use get, set
+// and delete.
+const (
+	TxnKVSet          = "set"
+	TxnKVCAS          = "cas"
+	TxnKVLock         = "lock"
+	TxnKVUnlock       = "unlock"
+	TxnKVGet          = "get"
+	TxnKVCheckIndex   = "check-index"
+	TxnKVCheckSession = "check-session"
+	TxnKVDelete       = "delete"
+	TxnKVDeleteCAS    = "delete-cas"
+	TxnKVDeleteTree   = "delete-tree"
+
+	TxnGet    = "get"
+	TxnSet    = "set"
+	TxnDelete = "delete"
+)
+
+// KVTxnOp is a Key-Value operation of a transaction. The ModifyIndex of
+// the pair is the index of the check-and-set operations.
+type KVTxnOp struct {
+	Verb   string
+	DirEnt KVPair
+}
+
+// NodeTxnOp is a node operation of a transaction
+type NodeTxnOp struct {
+	Verb string
+	Node Node
+}
+
+// ServiceTxnOp is a service operation of a transaction
+type ServiceTxnOp struct {
+	Verb    string
+	Node    string
+	Service AgentService
+}
+
+// CheckTxnOp is a health check operation of a transaction
+type CheckTxnOp struct {
+	Verb  string
+	Check HealthCheck
+}
+
+// TxnOp is a single operation of a transaction, with exactly one of its
+// fields set. They are built with the Op functions, such as KVSetOp.
+type TxnOp struct {
+	KV      *KVTxnOp      `json:",omitempty"`
+	Node    *NodeTxnOp    `json:",omitempty"`
+	Service *ServiceTxnOp `json:",omitempty"`
+	Check   *CheckTxnOp   `json:",omitempty"`
+}
+
+// TxnOps is a list of transaction operations
+type TxnOps []*TxnOp
+
+// TxnResult is the result of an operation, with the field of its kind
+// set. The KV writes return the pair without its value, and the deletes
+// return nothing.
+type TxnResult struct {
+	KV      *KVPair
+	Node    *Node
+	Service *AgentService
+	Check   *HealthCheck
+}
+
+// TxnResults is the results of the operations of a transaction
+type TxnResults []*TxnResult
+
+// TxnError is the error of an operation, which rolled back the
+// transaction. OpIndex is the position of the operation.
+type TxnError struct {
+	OpIndex int
+	What    string
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("op %d: %s", e.OpIndex, e.What)
+}
+
+// TxnErrors is the errors of a transaction
+type TxnErrors []*TxnError
+
+// TxnResponse is the outcome of a transaction, with either the results
+// of every operation, or the errors that rolled it back
+type TxnResponse struct {
+	Results TxnResults
+	Errors  TxnErrors
+}
+
+// KVSetOp sets a pair
+func KVSetOp(p *KVPair) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVSet, DirEnt: *p}}
+}
+
+// KVCASOp sets a pair if its ModifyIndex is that of the current pair,
+// or if it is 0 and the key doesn't exist
+func KVCASOp(p *KVPair) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVCAS, DirEnt: *p}}
+}
+
+// KVLockOp sets a pair while acquiring a lock with its Session
+func KVLockOp(p *KVPair) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVLock, DirEnt: *p}}
+}
+
+// KVUnlockOp sets a pair while releasing the lock of its Session
+func KVUnlockOp(p *KVPair) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVUnlock, DirEnt: *p}}
+}
+
+// KVGetOp returns a pair, failing if the key doesn't exist
+func KVGetOp(key string) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVGet, DirEnt: KVPair{Key: key}}}
+}
+
+// KVCheckIndexOp fails unless the key has the given ModifyIndex
+func KVCheckIndexOp(key string, index uint64) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVCheckIndex, DirEnt: KVPair{Key: key, ModifyIndex: index}}}
+}
+
+// KVCheckSessionOp fails unless the key is locked by the session
+func KVCheckSessionOp(key, session string) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVCheckSession, DirEnt: KVPair{Key: key, Session: session}}}
+}
+
+// KVDeleteOp deletes a key
+func KVDeleteOp(key string) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVDelete, DirEnt: KVPair{Key: key}}}
+}
+
+// KVDeleteCASOp deletes a key if it has the given ModifyIndex
+func KVDeleteCASOp(key string, index uint64) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVDeleteCAS, DirEnt: KVPair{Key: key, ModifyIndex: index}}}
+}
+
+// KVDeleteTreeOp deletes every key with the prefix
+func KVDeleteTreeOp(prefix string) *TxnOp {
+	return &TxnOp{KV: &KVTxnOp{Verb: TxnKVDeleteTree, DirEnt: KVPair{Key: prefix}}}
+}
+
+// NodeGetOp returns a node, failing if it isn't registered
+func NodeGetOp(node string) *TxnOp {
+	return &TxnOp{Node: &NodeTxnOp{Verb: TxnGet, Node: Node{Node: node}}}
+}
+
+// NodeSetOp registers a node
+func NodeSetOp(node *Node) *TxnOp {
+	return &TxnOp{Node: &NodeTxnOp{Verb: TxnSet, Node: *node}}
+}
+
+// NodeDeleteOp deregisters a node along with its services and checks
+func NodeDeleteOp(node string) *TxnOp {
+	return &TxnOp{Node: &NodeTxnOp{Verb: TxnDelete, Node: Node{Node: node}}}
+}
+
+// ServiceGetOp returns a service of a node, failing if it isn't
+// registered
+func ServiceGetOp(node, id string) *TxnOp {
+	return &TxnOp{Service: &ServiceTxnOp{Verb: TxnGet, Node: node, Service: AgentService{ID: id}}}
+}
+
+// ServiceSetOp registers a service on a node, which must be registered
+func ServiceSetOp(node string, service *AgentService) *TxnOp {
+	return &TxnOp{Service: &ServiceTxnOp{Verb: TxnSet, Node: node, Service: *service}}
+}
+
+// ServiceDeleteOp deregisters a service of a node along with its checks
+func ServiceDeleteOp(node, id string) *TxnOp {
+	return &TxnOp{Service: &ServiceTxnOp{Verb: TxnDelete, Node: node, Service: AgentService{ID: id}}}
+}
+
+// CheckGetOp returns a check of a node, failing if it isn't registered
+func CheckGetOp(node, id string) *TxnOp {
+	return &TxnOp{Check: &CheckTxnOp{Verb: TxnGet, Check: HealthCheck{Node: node, CheckID: id}}}
+}
+
+// CheckSetOp registers a check
+func CheckSetOp(check *HealthCheck) *TxnOp {
+	return &TxnOp{Check: &CheckTxnOp{Verb: TxnSet, Check: *check}}
+}
+
+// CheckDeleteOp deregisters a check of a node
+func CheckDeleteOp(node, id string) *TxnOp {
+	return &TxnOp{Check: &CheckTxnOp{Verb: TxnDelete, Check: HealthCheck{Node: node, CheckID: id}}}
+}
+
+// Txn is used to apply operations to the KV store and the catalog
+// atomically
+type Txn struct {
+	c *Client
+}
+
+// Txn returns a handle to the transaction endpoint
+func (c *Client) Txn() *Txn {
+	return &Txn{c}
+}
+
+// Apply applies the operations atomically. It returns true along with
+// the results if the transaction was applied, or false along with the
+// errors of the operations that prevented it. An error is only returned
+// if the transaction couldn't be attempted.
+func (t *Txn) Apply(ops TxnOps, q *WriteOptions) (bool, *TxnResponse, *WriteMeta, error) {
+	r := t.c.newRequest("PUT", "/v1/txn")
+	r.setWriteOptions(q)
+	r.obj = ops
+	rtt, resp, err := t.c.doRequest(r)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	wm := &WriteMeta{RequestTime: rtt}
+	if resp.StatusCode != 200 && resp.StatusCode != 409 {
+		var buf bytes.Buffer
+		io.Copy(&buf, resp.Body)
+		return false, nil, nil, fmt.Errorf("Unexpected response code: %d (%s)", resp.StatusCode, buf.Bytes())
+	}
+
+	var out TxnResponse
+	if err := decodeBody(resp, &out); err != nil {
+		return false, nil, nil, err
+	}
+	return resp.StatusCode == 200, &out, wm, nil
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	txn := c.Txn()
+	key := testKey()
+	node := testKey()
+
+	ops := TxnOps{
+		KVSetOp(&KVPair{Key: key, Value: []byte("test"), Flags: 42}),
+		KVGetOp(key),
+		NodeSetOp(&Node{Node: node, Address: "127.0.0.1"}),
+		ServiceSetOp(node, &AgentService{Service: "redis", Port: 8000}),
+		CheckSetOp(&HealthCheck{Node: node, CheckID: "redis", ServiceID: "redis", Status: "passing"}),
+	}
+	ok, resp, _, err := txn.Apply(ops, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok || len(resp.Results) != len(ops) {
+		t.Fatalf("bad: %v %#v", ok, resp)
+	}
+	if resp.Results[0].KV.Value != nil || string(resp.Results[1].KV.Value) != "test" ||
+		resp.Results[1].KV.Flags != 42 {
+		t.Fatalf("bad: %v %v", resp.Results[0].KV, resp.Results[1].KV)
+	}
+	if resp.Results[3].Service.ID != "redis" || resp.Results[4].Check.ServiceName != "redis" {
+		t.Fatalf("bad: %v %v", resp.Results[3].Service, resp.Results[4].Check)
+	}
+	index := resp.Results[1].KV.ModifyIndex
+
+	// A stale check rolls back the deletes
+	ops = TxnOps{
+		KVDeleteOp(key),
+		NodeDeleteOp(node),
+		KVCheckIndexOp(key, index+1),
+	}
+	ok, resp, _, err = txn.Apply(ops, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok || len(resp.Errors) != 1 || resp.Errors[0].OpIndex != 2 {
+		t.Fatalf("bad: %v %#v", ok, resp)
+	}
+	if !strings.Contains(resp.Errors[0].Error(), "op 2") {
+		t.Fatalf("bad: %v", resp.Errors[0])
+	}
+	pair, _, err := c.KV().Get(key, nil)
+	if err != nil || pair == nil {
+		t.Fatalf("bad: %v %v", pair, err)
+	}
+	nodes, _, err := c.Catalog().Node(node, nil)
+	if err != nil || nodes == nil || nodes.Services["redis"] == nil {
+		t.Fatalf("bad: %v %v", nodes, err)
+	}
+}
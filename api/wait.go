@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWaitRetryInterval is the base of the backoff applied by a
+	// WaitIndex after a failed query
+	DefaultWaitRetryInterval = time.Second
+
+	// DefaultWaitMaxBackoff bounds the backoff applied by a WaitIndex
+	DefaultWaitMaxBackoff = time.Minute
+)
+
+// ErrWaitStopped is returned by WaitIndex.Next once it is stopped
+var ErrWaitStopped = fmt.Errorf("Wait stopped")
+
+// WaitFunc runs a blocking query with the given options, capturing its
+// result, and returns the metadata of the query
+type WaitFunc func(q *QueryOptions) (*QueryMeta, error)
+
+// WaitIndex is used to loop over a blocking query. It tracks the index of
+// the last result, following it when it goes backwards, such as after a
+// snapshot restore or a new leader with an older state. Failed
+// queries are retried after an exponential backoff with a random jitter,
+// so that many clients don't retry in lockstep.
+type WaitIndex struct {
+	// Options are used for every query. Their WaitIndex is managed.
+	Options QueryOptions
+
+	// RetryInterval is the base of the backoff after a failure, and
+	// MaxBackoff bounds it. They default to DefaultWaitRetryInterval
+	// and DefaultWaitMaxBackoff.
+	RetryInterval time.Duration
+	MaxBackoff    time.Duration
+
+	index    uint64
+	failures int
+	stop     bool
+	stopCh   chan struct{}
+	stopLock sync.Mutex
+}
+
+// NewWaitIndex returns a WaitIndex using the given options, which may be
+// nil
+func NewWaitIndex(q *QueryOptions) *WaitIndex {
+	w := &WaitIndex{stopCh: make(chan struct{})}
+	if q != nil {
+		w.Options = *q
+	}
+	return w
+}
+
+// LastIndex returns the index of the last result, or 0 if there wasn't
+// any yet
+func (w *WaitIndex) LastIndex() uint64 {
+	return w.index
+}
+
+// Next runs the query until its index moves, and returns the metadata of
+// the result that changed it. The first call returns immediately. An
+// error of the query is returned as is, and the next call backs off
+// before querying again. ErrWaitStopped is returned once Stop is called,
+// though a query in flight isn't interrupted.
+func (w *WaitIndex) Next(fn WaitFunc) (*QueryMeta, error) {
+	if w.failures > 0 {
+		select {
+		case <-time.After(w.backoff()):
+		case <-w.stopCh:
+			return nil, ErrWaitStopped
+		}
+	}
+
+	for {
+		select {
+		case <-w.stopCh:
+			return nil, ErrWaitStopped
+		default:
+		}
+
+		opts := w.Options
+		opts.WaitIndex = w.index
+		meta, err := fn(&opts)
+		if err != nil {
+			w.failures++
+			return nil, err
+		}
+		w.failures = 0
+
+		// An index of 0 would never block
+		index := meta.LastIndex
+		if index == 0 {
+			index = 1
+		}
+		if index == w.index {
+			// The wait timed out without a change
+			continue
+		}
+
+		// The index can also go backwards, in which case the result is
+		// new and the next query blocks on the lower index, since
+		// blocking on the old one could wait forever
+		w.index = index
+		return meta, nil
+	}
+}
+
+// Stop makes Next return ErrWaitStopped. It is safe to call more than
+// once.
+func (w *WaitIndex) Stop() {
+	w.stopLock.Lock()
+	defer w.stopLock.Unlock()
+	if w.stop {
+		return
+	}
+	w.stop = true
+	close(w.stopCh)
+}
+
+// backoff returns the time to wait before retrying a failed query. It
+// grows with the square of the consecutive failures, like the watches,
+// plus up to a quarter of it of jitter.
+func (w *WaitIndex) backoff() time.Duration {
+	base, max := w.RetryInterval, w.MaxBackoff
+	if base <= 0 {
+		base = DefaultWaitRetryInterval
+	}
+	if max <= 0 {
+		max = DefaultWaitMaxBackoff
+	}
+	retry := base * time.Duration(w.failures*w.failures)
+	if retry > max || retry <= 0 {
+		retry = max
+	}
+	return retry + time.Duration(rand.Int63n(int64(retry/4)+1))
+}
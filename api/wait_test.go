@@ -0,0 +1,125 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWaitIndex_KV(t *testing.T) {
+	t.Parallel()
+	c, s := makeClient(t)
+	defer s.Stop()
+
+	kv := c.KV()
+	key := testKey()
+	w := NewWaitIndex(&QueryOptions{WaitTime: 100 * time.Millisecond})
+	defer w.Stop()
+
+	var pair *KVPair
+	get := func(q *QueryOptions) (*QueryMeta, error) {
+		var meta *QueryMeta
+		var err error
+		pair, meta, err = kv.Get(key, q)
+		return meta, err
+	}
+
+	// The first call returns right away
+	if _, err := w.Next(get); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pair != nil {
+		t.Fatalf("bad: %v", pair)
+	}
+
+	// The next one blocks until the key changes, even past a timeout
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		kv.Put(&KVPair{Key: key, Value: []byte("test")}, nil)
+	}()
+	start := time.Now()
+	meta, err := w.Next(get)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatalf("should block")
+	}
+	if pair == nil || string(pair.Value) != "test" || w.LastIndex() != meta.LastIndex {
+		t.Fatalf("bad: %v %v", pair, meta)
+	}
+
+	w.Stop()
+	if _, err := w.Next(get); err != ErrWaitStopped {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestWaitIndex_Regression(t *testing.T) {
+	indexes := []uint64{10, 10, 4, 0}
+	var waits []uint64
+	fn := func(q *QueryOptions) (*QueryMeta, error) {
+		waits = append(waits, q.WaitIndex)
+		index := indexes[0]
+		indexes = indexes[1:]
+		return &QueryMeta{LastIndex: index}, nil
+	}
+
+	w := NewWaitIndex(nil)
+	for _, expect := range []uint64{10, 4, 1} {
+		if _, err := w.Next(fn); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if w.LastIndex() != expect {
+			t.Fatalf("bad: %d %d", w.LastIndex(), expect)
+		}
+	}
+
+	// An unchanged index is waited on again, and a lower one is followed
+	expect := []uint64{0, 10, 10, 4}
+	if fmt.Sprintf("%v", waits) != fmt.Sprintf("%v", expect) {
+		t.Fatalf("bad: %v", waits)
+	}
+}
+
+func TestWaitIndex_Backoff(t *testing.T) {
+	w := NewWaitIndex(nil)
+	w.RetryInterval = 10 * time.Millisecond
+	w.MaxBackoff = 50 * time.Millisecond
+
+	failures := 3
+	fn := func(q *QueryOptions) (*QueryMeta, error) {
+		if failures > 0 {
+			failures--
+			return nil, fmt.Errorf("failed")
+		}
+		return &QueryMeta{LastIndex: 5}, nil
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := w.Next(fn); err == nil || err.Error() != "failed" {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if _, err := w.Next(fn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// 10ms, 40ms, then capped at 50ms, each with up to a quarter of jitter
+	elapsed := time.Since(start)
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if w.failures != 0 {
+		t.Fatalf("failures should be cleared")
+	}
+
+	// A stop interrupts the backoff
+	failures = 1
+	w.Next(fn)
+	w.Stop()
+	if _, err := w.Next(fn); err != ErrWaitStopped {
+		t.Fatalf("err: %v", err)
+	}
+}
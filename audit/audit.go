@@ -0,0 +1,201 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-syslog"
+)
+
+const (
+	// DefaultMaxBytes is the size from which the audit log is rotated
+	DefaultMaxBytes = 64 * 1024 * 1024
+
+	// DefaultMaxFiles is the number of rotated audit logs kept
+	DefaultMaxFiles = 5
+
+	// anonymousAccessor identifies the requests without a token
+	anonymousAccessor = "anonymous"
+)
+
+// Event is an audit record of a mutating HTTP request or RPC call: who
+// made it, what it was, when, and its result
+type Event struct {
+	Time time.Time
+
+	// Type is "http" or "rpc"
+	Type string
+
+	// Source is the address of the client
+	Source string
+
+	// Accessor identifies the ACL token of the request, see Accessor
+	Accessor string
+
+	// Operation is the method and path of an HTTP request, or the
+	// method of an RPC call
+	Operation string
+
+	// Datacenter is the target datacenter of an RPC call
+	Datacenter string `json:",omitempty"`
+
+	// Result is "ok" or "error", along with the Error or the HTTP status
+	Result string
+	Status int    `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// Config is the configuration of an audit log
+type Config struct {
+	// Path is the file the events are appended to, as JSON lines. An
+	// empty path disables the file.
+	Path string
+
+	// MaxBytes is the size from which the file is rotated, moving it to
+	// Path.1 and the older files up to Path.MaxFiles
+	MaxBytes int64
+	MaxFiles int
+
+	// Syslog also sends the events to syslog, with the facility
+	Syslog         bool
+	SyslogFacility string
+}
+
+// Log writes the audit events. A nil Log discards them.
+type Log struct {
+	config Config
+	file   *os.File
+	size   int64
+	syslog gsyslog.Syslogger
+	l      sync.Mutex
+}
+
+// New opens an audit log
+func New(config *Config) (*Log, error) {
+	l := &Log{config: *config}
+	if l.config.MaxBytes <= 0 {
+		l.config.MaxBytes = DefaultMaxBytes
+	}
+	if l.config.MaxFiles <= 0 {
+		l.config.MaxFiles = DefaultMaxFiles
+	}
+	if l.config.Path != "" {
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+	if l.config.Syslog {
+		s, err := gsyslog.NewLogger(gsyslog.LOG_NOTICE, l.config.SyslogFacility, "consul-audit")
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Failed to set up audit syslog: %v", err)
+		}
+		l.syslog = s
+	}
+	return l, nil
+}
+
+// open opens the file for appending
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves the file to Path.1, shifting the older files and dropping
+// the oldest, and opens a new one
+func (l *Log) rotate() error {
+	l.file.Close()
+	l.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", l.config.Path, l.config.MaxFiles))
+	for i := l.config.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.config.Path, i), fmt.Sprintf("%s.%d", l.config.Path, i+1))
+	}
+	if err := os.Rename(l.config.Path, l.config.Path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Log writes an event. An event that fails to be written is returned as
+// an error, so it can be reported.
+func (l *Log) Log(e *Event) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	if l.syslog != nil {
+		if err := l.syslog.WriteLevel(gsyslog.LOG_NOTICE, buf); err != nil {
+			return err
+		}
+	}
+	if l.config.Path == "" {
+		return nil
+	}
+	if l.file == nil {
+		// A failed rotation is retried
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(buf)) > l.config.MaxBytes {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("Failed to rotate audit log: %v", err)
+		}
+	}
+	n, err := l.file.Write(buf)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the audit log
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.l.Lock()
+	defer l.l.Unlock()
+	if l.syslog != nil {
+		l.syslog.Close()
+	}
+	if l.file != nil {
+		err := l.file.Close()
+		l.file = nil
+		return err
+	}
+	return nil
+}
+
+// Accessor identifies a token without revealing it, since the token
+// itself grants access
+func Accessor(token string) string {
+	if token == "" {
+		return anonymousAccessor
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
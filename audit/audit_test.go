@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readEvents(t *testing.T, path string) []*Event {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+
+	var events []*Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		events = append(events, &e)
+	}
+	return events
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := New(&Config{Path: path})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	event := &Event{
+		Type:      "http",
+		Source:    "127.0.0.1:1234",
+		Accessor:  Accessor("secret"),
+		Operation: "PUT /v1/kv/foo",
+		Result:    "ok",
+		Status:    200,
+	}
+	if err := l.Log(event); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	events := readEvents(t, path)
+	if len(events) != 1 || events[0].Operation != "PUT /v1/kv/foo" || events[0].Time.IsZero() {
+		t.Fatalf("bad: %v", events)
+	}
+
+	// A nil log discards the events
+	var nilLog *Log
+	if err := nilLog.Log(event); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// Every event is rotated into its own file
+	l, err := New(&Config{Path: path, MaxBytes: 10, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	for _, op := range []string{"a", "b", "c", "d"} {
+		if err := l.Log(&Event{Type: "rpc", Operation: op}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	for suffix, op := range map[string]string{"": "d", ".1": "c", ".2": "b"} {
+		events := readEvents(t, path+suffix)
+		if len(events) != 1 || events[0].Operation != op {
+			t.Fatalf("bad: %s %v", suffix, events)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAccessor(t *testing.T) {
+	if Accessor("") != "anonymous" {
+		t.Fatalf("bad: %s", Accessor(""))
+	}
+	a := Accessor("secret")
+	if len(a) != 16 || a == "secret" || a != Accessor("secret") || a == Accessor("other") {
+		t.Fatalf("bad: %s", a)
+	}
+}
@@ -195,3 +195,72 @@ func (s *HTTPServer) ACLList(resp http.ResponseWriter, req *http.Request) (inter
 	}
 	return out.ACLs, nil
 }
+
+// ACLExplain checks whether the token of ?id=, or that of the request,
+// allows the operation of ?op= on the resource of ?name=, and returns the
+// rule that decided. With a PUT, the rules of the body are checked
+// instead of a token.
+func (s *HTTPServer) ACLExplain(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "GET" && req.Method != "PUT" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.ACLExplainRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	query := req.URL.Query()
+	args.ACL = query.Get("id")
+	args.Operation = query.Get("op")
+	args.Name = query.Get("name")
+	if args.Operation == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing operation"))
+		return nil, nil
+	}
+
+	if req.Method == "PUT" {
+		var body struct {
+			Rules string
+		}
+		if err := decodeBody(req, &body, nil); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+			return nil, nil
+		}
+		if body.Rules == "" {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Missing rules"))
+			return nil, nil
+		}
+		args.Rules = body.Rules
+	}
+
+	var out structs.ACLExplanation
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("ACL.Explain", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ACLReplicationStatus returns the state of the replication of the ACLs
+// of the ACL datacenter to the datacenter of the request
+func (s *HTTPServer) ACLReplicationStatus(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "GET" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.ACLReplicationStatus
+	if err := s.agent.RPC("ACL.ReplicationStatus", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
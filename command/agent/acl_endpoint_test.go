@@ -187,3 +187,79 @@ func TestACLList(t *testing.T) {
 		}
 	})
 }
+
+func TestACLExplain(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		id := makeTestACL(t, srv)
+
+		// A token without rules inherits the default policy
+		req, err := http.NewRequest("GET", "/v1/acl/explain?id="+id+"&op=key:write&name=foo", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.ACLExplain(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out := obj.(structs.ACLExplanation)
+		if !out.Allowed || out.Rule != "" || out.Root != "allow" {
+			t.Fatalf("bad: %v", out)
+		}
+
+		// Rules are given in the body
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(map[string]interface{}{
+			"Rules": `key "foo/" { policy = "deny" }`,
+		})
+		req, err = http.NewRequest("PUT", "/v1/acl/explain?op=key:read&name=foo/bar", body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		obj, err = srv.ACLExplain(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out = obj.(structs.ACLExplanation)
+		if out.Allowed || out.Rule != `key "foo/" { policy = "deny" }` {
+			t.Fatalf("bad: %v", out)
+		}
+
+		// The operation is required
+		req, err = http.NewRequest("GET", "/v1/acl/explain?name=foo", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.ACLExplain(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 400 {
+			t.Fatalf("bad: %d", resp.Code)
+		}
+	})
+}
+
+func TestACLReplicationStatus(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		req, err := http.NewRequest("GET", "/v1/acl/replication", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.ACLReplicationStatus(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The ACL datacenter doesn't replicate
+		out, ok := obj.(structs.ACLReplicationStatus)
+		if !ok {
+			t.Fatalf("should work")
+		}
+		if out.Enabled || out.Running {
+			t.Fatalf("bad: %v", out)
+		}
+	})
+}
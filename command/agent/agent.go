@@ -14,6 +14,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/audit"
 	"github.com/hashicorp/consul/consul"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/serf/serf"
@@ -78,6 +80,24 @@ type Agent struct {
 	// checkTCPs maps the check ID to an associated TCP check
 	checkTCPs map[string]*CheckTCP
 
+	// checkUDPs maps the check ID to an associated UDP check
+	checkUDPs map[string]*CheckUDP
+
+	// checkDockers maps the check ID to an associated Docker check
+	checkDockers map[string]*CheckDocker
+
+	// cache serves the HTTP requests made with the cached parameter,
+	// nil if disabled
+	cache *rpcCache
+
+	// metrics keeps the metrics served by /v1/agent/metrics, nil if
+	// disabled
+	metrics *metricsSink
+
+	// auditLog records the mutating HTTP requests and RPC calls, nil if
+	// disabled
+	auditLog *audit.Log
+
 	// checkTTLs maps the check ID to an associated check TTL
 	checkTTLs map[string]*CheckTTL
 
@@ -149,6 +169,8 @@ func Create(config *Config, logOutput io.Writer) (*Agent, error) {
 		checkTTLs:     make(map[string]*CheckTTL),
 		checkHTTPs:    make(map[string]*CheckHTTP),
 		checkTCPs:     make(map[string]*CheckTCP),
+		checkUDPs:     make(map[string]*CheckUDP),
+		checkDockers:  make(map[string]*CheckDocker),
 		eventCh:       make(chan serf.UserEvent, 1024),
 		eventBuf:      make([]*UserEvent, 256),
 		shutdownCh:    make(chan struct{}),
@@ -157,6 +179,27 @@ func Create(config *Config, logOutput io.Writer) (*Agent, error) {
 	// Initialize the local state
 	agent.state.Init(config, agent.logger)
 
+	// Open the audit log
+	if config.AuditLog != "" || config.AuditSyslog {
+		auditLog, err := audit.New(&audit.Config{
+			Path:           config.AuditLog,
+			MaxBytes:       config.AuditLogMaxBytes,
+			MaxFiles:       config.AuditLogMaxFiles,
+			Syslog:         config.AuditSyslog,
+			SyslogFacility: config.SyslogFacility,
+		})
+		if err != nil {
+			return nil, err
+		}
+		agent.auditLog = auditLog
+	}
+
+	// Setup the cache of the read RPCs
+	if config.CacheTTL > 0 {
+		agent.cache = newRPCCache(agent.RPC, config.CacheTTL,
+			config.CacheMaxEntries, agent.shutdownCh)
+	}
+
 	// Setup either the client or the server
 	var err error
 	if config.Server {
@@ -190,6 +233,9 @@ func Create(config *Config, logOutput io.Writer) (*Agent, error) {
 	// Start handling events
 	go agent.handleEvents()
 
+	// Start replicating KV from another datacenter
+	agent.startKVReplication()
+
 	// Write out the PID file if necessary
 	err = agent.storePid()
 	if err != nil {
@@ -291,9 +337,75 @@ func (a *Agent) consulConfig() *consul.Config {
 	if a.config.ACLDownPolicy != "" {
 		base.ACLDownPolicy = a.config.ACLDownPolicy
 	}
+	if a.config.ACLReplicationToken != "" {
+		base.ACLReplicationToken = a.config.ACLReplicationToken
+	}
 	if a.config.SessionTTLMinRaw != "" {
 		base.SessionTTLMin = a.config.SessionTTLMin
 	}
+	if a.config.SlowQueryThresholdRaw != "" {
+		base.SlowQueryThreshold = a.config.SlowQueryThreshold
+	}
+	if a.config.SessionLimitPerNode != 0 {
+		base.SessionLimitPerNode = a.config.SessionLimitPerNode
+	}
+	if a.config.CheckOutputMaxSize != 0 {
+		base.CheckOutputMaxSize = a.config.CheckOutputMaxSize
+	}
+	if a.config.LeaveDrainTimeRaw != "" {
+		base.LeaveDrainTime = a.config.LeaveDrainTime
+	}
+	if a.config.CatalogAuditLimit != 0 {
+		base.CatalogAuditLimit = a.config.CatalogAuditLimit
+	}
+	if a.config.KVHistoryVersions != 0 {
+		base.KVSHistoryVersions = a.config.KVHistoryVersions
+	}
+	if a.config.KVHistoryTTLRaw != "" {
+		base.KVSHistoryTTL = a.config.KVHistoryTTL
+	}
+	if a.config.QueryCacheSize != 0 {
+		base.QueryCacheSize = a.config.QueryCacheSize
+	}
+	if len(a.config.KVSNotifyLimits) != 0 {
+		base.KVSNotifyLimits = a.config.KVSNotifyLimits
+	}
+	for _, rule := range a.config.EventBridge {
+		base.EventBridge = append(base.EventBridge, &consul.EventBridgeRule{
+			Type:      rule.Type,
+			Service:   rule.Service,
+			Prefix:    rule.Prefix,
+			Name:      rule.Name,
+			Payload:   rule.Payload,
+			RateLimit: rule.RateLimit,
+		})
+	}
+	for _, sub := range a.config.OutboxSubscriptions {
+		base.OutboxSubscriptions = append(base.OutboxSubscriptions, &structs.OutboxSubscription{
+			Name:       sub.Name,
+			Prefix:     sub.Prefix,
+			URL:        sub.URL,
+			MaxPending: sub.MaxPending,
+		})
+	}
+	if a.config.StateMaxSizeMB != 0 {
+		base.StateMaxSize = uint64(a.config.StateMaxSizeMB) * 1024 * 1024
+	}
+	if a.config.MaxPageSize != 0 {
+		base.MaxPageSize = a.config.MaxPageSize
+	}
+	if a.config.RPCReadRate != 0 {
+		base.RPCReadRate = a.config.RPCReadRate
+	}
+	if a.config.RPCReadBurst != 0 {
+		base.RPCReadBurst = a.config.RPCReadBurst
+	}
+	if a.config.RPCWriteRate != 0 {
+		base.RPCWriteRate = a.config.RPCWriteRate
+	}
+	if a.config.RPCWriteBurst != 0 {
+		base.RPCWriteBurst = a.config.RPCWriteBurst
+	}
 
 	// Format the build string
 	revision := a.config.Revision
@@ -307,10 +419,19 @@ func (a *Agent) consulConfig() *consul.Config {
 	base.VerifyIncoming = a.config.VerifyIncoming
 	base.VerifyOutgoing = a.config.VerifyOutgoing
 	base.VerifyServerHostname = a.config.VerifyServerHostname
+	base.TLSMigrate = a.config.TLSMigrate
 	base.CAFile = a.config.CAFile
 	base.CertFile = a.config.CertFile
 	base.KeyFile = a.config.KeyFile
 	base.ServerName = a.config.ServerName
+	base.AutoEncryptAllowTLS = a.config.AutoEncryptAllowTLS
+	base.CAKeyFile = a.config.CAKeyFile
+	if a.config.AutoEncryptCertTTL != 0 {
+		base.AutoEncryptCertTTL = a.config.AutoEncryptCertTTL
+	}
+	base.AutoEncryptTLS = a.config.AutoEncryptTLS
+	base.AutoEncryptToken = a.config.AutoEncryptToken
+	base.AuditLog = a.auditLog
 	base.Domain = a.config.Domain
 
 	// Setup the ServerUp callback
@@ -405,12 +526,38 @@ LOAD:
 // RPC is used to make an RPC call to the Consul servers
 // This allows the agent to implement the Consul.Interface
 func (a *Agent) RPC(method string, args interface{}, reply interface{}) error {
+	defer metrics.MeasureSince([]string{"consul", "agent", "rpc", method}, time.Now())
 	if a.server != nil {
 		return a.server.RPC(method, args, reply)
 	}
 	return a.client.RPC(method, args, reply)
 }
 
+// ReloadTLS applies the TLS settings of a reloaded configuration to the
+// RPC connections of the server or client, reading the certificates
+// again
+func (a *Agent) ReloadTLS(config *Config) error {
+	conf := &consul.Config{
+		NodeName:             a.config.NodeName,
+		Domain:               a.config.Domain,
+		VerifyIncoming:       config.VerifyIncoming,
+		VerifyOutgoing:       config.VerifyOutgoing,
+		VerifyServerHostname: config.VerifyServerHostname,
+		TLSMigrate:           config.TLSMigrate,
+		CAFile:               config.CAFile,
+		CertFile:             config.CertFile,
+		KeyFile:              config.KeyFile,
+		ServerName:           config.ServerName,
+
+		// Auto-encrypt can't be toggled without a restart
+		AutoEncryptTLS: a.config.AutoEncryptTLS,
+	}
+	if a.server != nil {
+		return a.server.ReloadTLS(conf)
+	}
+	return a.client.ReloadTLS(conf)
+}
+
 // Leave is used to prepare the agent for a graceful shutdown
 func (a *Agent) Leave() error {
 	if a.server != nil {
@@ -448,6 +595,14 @@ func (a *Agent) Shutdown() error {
 		chk.Stop()
 	}
 
+	for _, chk := range a.checkUDPs {
+		chk.Stop()
+	}
+
+	for _, chk := range a.checkDockers {
+		chk.Stop()
+	}
+
 	a.logger.Println("[INFO] agent: requesting shutdown")
 	var err error
 	if a.server != nil {
@@ -456,6 +611,10 @@ func (a *Agent) Shutdown() error {
 		err = a.client.Shutdown()
 	}
 
+	if err := a.auditLog.Close(); err != nil {
+		a.logger.Printf("[WARN] agent: failed to close audit log: %v", err)
+	}
+
 	pidErr := a.deletePid()
 	if pidErr != nil {
 		a.logger.Println("[WARN] agent: could not delete pid file ", pidErr)
@@ -642,6 +801,17 @@ func (a *Agent) AddService(service *structs.NodeService, chkTypes CheckTypes, pe
 			return fmt.Errorf("Check type is not valid")
 		}
 	}
+	if service.WeightPassing < 0 || service.WeightWarning < 0 {
+		return fmt.Errorf("Service weights can't be negative")
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+	addr, err := structs.NormalizeAddress(service.Address)
+	if err != nil {
+		return err
+	}
+	service.Address = addr
 
 	// Warn if the service name is incompatible with DNS
 	if !dnsNameRe.MatchString(service.Service) {
@@ -753,6 +923,24 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 	if chkType != nil && !chkType.Valid() {
 		return fmt.Errorf("Check type is not valid")
 	}
+	if chkType != nil && chkType.DeregisterCriticalServiceAfter > 0 {
+		if check.ServiceID == "" {
+			return fmt.Errorf("DeregisterCriticalServiceAfter requires a service check")
+		}
+		check.DeregisterCriticalServiceAfter = chkType.DeregisterCriticalServiceAfter
+	}
+	if chkType != nil {
+		if chkType.SuccessBeforePassing < 0 || chkType.FailuresBeforeCritical < 0 {
+			return fmt.Errorf("Check thresholds can't be negative")
+		}
+		check.SuccessBeforePassing = chkType.SuccessBeforePassing
+		check.FailuresBeforeCritical = chkType.FailuresBeforeCritical
+	}
+	if chkType != nil && chkType.IsHTTP() {
+		if _, err := parseStatusRanges(chkType.ExpectedStatus); err != nil {
+			return err
+		}
+	}
 
 	if check.ServiceID != "" {
 		svc, ok := a.state.Services()[check.ServiceID]
@@ -799,12 +987,17 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 			}
 
 			http := &CheckHTTP{
-				Notify:   &a.state,
-				CheckID:  check.CheckID,
-				HTTP:     chkType.HTTP,
-				Interval: chkType.Interval,
-				Timeout:  chkType.Timeout,
-				Logger:   a.logger,
+				Notify:         &a.state,
+				CheckID:        check.CheckID,
+				HTTP:           chkType.HTTP,
+				Method:         chkType.Method,
+				Header:         chkType.Header,
+				Body:           chkType.Body,
+				ExpectedStatus: chkType.ExpectedStatus,
+				TLSSkipVerify:  chkType.TLSSkipVerify,
+				Interval:       chkType.Interval,
+				Timeout:        chkType.Timeout,
+				Logger:         a.logger,
 			}
 			http.Start()
 			a.checkHTTPs[check.CheckID] = http
@@ -820,15 +1013,66 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 			}
 
 			tcp := &CheckTCP{
+				Notify:        &a.state,
+				CheckID:       check.CheckID,
+				TCP:           chkType.TCP,
+				Interval:      chkType.Interval,
+				Timeout:       chkType.Timeout,
+				TLS:           chkType.TLS,
+				TLSSkipVerify: chkType.TLSSkipVerify,
+				Logger:        a.logger,
+			}
+			tcp.Start()
+			a.checkTCPs[check.CheckID] = tcp
+
+		} else if chkType.IsUDP() {
+			if existing, ok := a.checkUDPs[check.CheckID]; ok {
+				existing.Stop()
+			}
+			if chkType.Interval < MinInterval {
+				a.logger.Println(fmt.Sprintf("[WARN] agent: check '%s' has interval below minimum of %v",
+					check.CheckID, MinInterval))
+				chkType.Interval = MinInterval
+			}
+
+			udp := &CheckUDP{
 				Notify:   &a.state,
 				CheckID:  check.CheckID,
-				TCP:      chkType.TCP,
+				UDP:      chkType.UDP,
 				Interval: chkType.Interval,
 				Timeout:  chkType.Timeout,
 				Logger:   a.logger,
 			}
-			tcp.Start()
-			a.checkTCPs[check.CheckID] = tcp
+			udp.Start()
+			a.checkUDPs[check.CheckID] = udp
+
+		} else if chkType.IsDocker() {
+			if existing, ok := a.checkDockers[check.CheckID]; ok {
+				existing.Stop()
+			}
+			if chkType.Interval < MinInterval {
+				a.logger.Println(fmt.Sprintf("[WARN] agent: check '%s' has interval below minimum of %v",
+					check.CheckID, MinInterval))
+				chkType.Interval = MinInterval
+			}
+
+			client, err := newDockerClient("")
+			if err != nil {
+				return err
+			}
+			docker := &CheckDocker{
+				Notify:            &a.state,
+				CheckID:           check.CheckID,
+				Script:            chkType.Script,
+				DockerContainerID: chkType.DockerContainerID,
+				Shell:             chkType.Shell,
+				Interval:          chkType.Interval,
+				Timeout:           chkType.Timeout,
+				Logger:            a.logger,
+				client:            client,
+			}
+			docker.Start()
+			a.checkDockers[check.CheckID] = docker
 
 		} else {
 			if existing, ok := a.checkMonitors[check.CheckID]; ok {
@@ -852,6 +1096,11 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 		}
 	}
 
+	// Record the definition in the catalog
+	if chkType != nil {
+		chkType.describe(check)
+	}
+
 	// Add to the local state for anti-entropy
 	a.state.AddCheck(check, token)
 
@@ -890,6 +1139,14 @@ func (a *Agent) RemoveCheck(checkID string, persist bool) error {
 		check.Stop()
 		delete(a.checkTCPs, checkID)
 	}
+	if check, ok := a.checkUDPs[checkID]; ok {
+		check.Stop()
+		delete(a.checkUDPs, checkID)
+	}
+	if check, ok := a.checkDockers[checkID]; ok {
+		check.Stop()
+		delete(a.checkDockers, checkID)
+	}
 	if check, ok := a.checkTTLs[checkID]; ok {
 		check.Stop()
 		delete(a.checkTTLs, checkID)
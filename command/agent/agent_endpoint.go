@@ -21,6 +21,55 @@ func (s *HTTPServer) AgentSelf(resp http.ResponseWriter, req *http.Request) (int
 	}, nil
 }
 
+// AgentMetrics returns the metrics kept by the agent, as JSON or in the
+// Prometheus text format with ?format=prometheus
+func (s *HTTPServer) AgentMetrics(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if s.agent.metrics == nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte("Metrics are disabled"))
+		return nil, nil
+	}
+
+	switch format := req.URL.Query().Get("format"); format {
+	case "":
+		return s.agent.metrics.Summary(), nil
+	case "prometheus":
+		resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		resp.Write(s.agent.metrics.Prometheus())
+		return nil, nil
+	default:
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Invalid format %q", format)))
+		return nil, nil
+	}
+}
+
+// AgentSlowQueries returns the slow query log of the local server. It
+// requires a management token, as the logged parameters reveal keys and
+// names.
+func (s *HTTPServer) AgentSlowQueries(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if s.agent.server == nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte("Slow queries are only logged by servers"))
+		return nil, nil
+	}
+
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	// Answer from the local server instead of the leader
+	args.Datacenter = s.agent.config.Datacenter
+	args.AllowStale = true
+
+	var out structs.SlowQueryReport
+	if err := s.agent.RPC("Operator.SlowQueries", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (s *HTTPServer) AgentServices(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	services := s.agent.state.Services()
 	return services, nil
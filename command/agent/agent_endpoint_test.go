@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -94,6 +95,103 @@ func TestHTTPAgentSelf(t *testing.T) {
 	}
 }
 
+func TestHTTPAgentMetrics(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	// Disabled without a sink
+	req, err := http.NewRequest("GET", "/v1/agent/metrics", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	if _, err := srv.AgentMetrics(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 404 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+
+	srv.agent.metrics = newMetricsSink(time.Hour)
+	srv.agent.metrics.IncrCounter([]string{"consul", "rpc", "query"}, 1)
+
+	obj, err := srv.AgentMetrics(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := obj.(*MetricsSummary)
+	if len(summary.Counters) != 1 || summary.Counters[0].Name != "consul_rpc_query" {
+		t.Fatalf("bad: %#v", summary)
+	}
+
+	req, err = http.NewRequest("GET", "/v1/agent/metrics?format=prometheus", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.AgentMetrics(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(resp.Body.String(), "consul_rpc_query 1\n") {
+		t.Fatalf("bad: %s", resp.Body.String())
+	}
+	if ct := resp.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("bad: %s", ct)
+	}
+
+	req, err = http.NewRequest("GET", "/v1/agent/metrics?format=nope", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.AgentMetrics(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+}
+
+func TestHTTPAgentSlowQueries(t *testing.T) {
+	dir, srv := makeHTTPServerWithConfig(t, func(c *Config) {
+		c.ACLDefaultPolicy = "deny"
+		c.SlowQueryThreshold = time.Nanosecond
+		c.SlowQueryThresholdRaw = "1ns"
+	})
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// A management token is required
+	req, err := http.NewRequest("GET", "/v1/agent/slow-queries", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := srv.AgentSlowQueries(nil, req); err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	req, err = http.NewRequest("GET", "/v1/agent/slow-queries?token=root", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, err := srv.AgentSlowQueries(nil, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	report := obj.(structs.SlowQueryReport)
+	if report.Server != srv.agent.config.NodeName || report.Threshold != time.Nanosecond {
+		t.Fatalf("bad: %#v", report)
+	}
+	if len(report.Queries) == 0 {
+		t.Fatalf("bad: %#v", report)
+	}
+}
+
 func TestHTTPAgentMembers(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
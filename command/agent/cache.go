@@ -0,0 +1,235 @@
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// cacheRetryInterval is the base wait after a failed refresh
+	cacheRetryInterval = time.Second
+
+	// cacheMaxBackoff bounds the wait between failed refreshes
+	cacheMaxBackoff = time.Minute
+
+	// cacheMaxWait bounds the blocking queries of the refreshes, the
+	// servers don't wait longer
+	cacheMaxWait = 10 * time.Minute
+)
+
+// rpcCache caches the replies of read RPCs for the HTTP endpoints, so
+// the same discovery queries made over and over are answered locally.
+// Hits are served instantly, even if stale, while a blocking query per
+// entry refreshes it in the background. Entries that aren't read for the
+// TTL are dropped, and the least recently read ones are evicted beyond
+// the size limit.
+type rpcCache struct {
+	rpc        func(method string, args interface{}, reply interface{}) error
+	ttl        time.Duration
+	maxEntries int
+	shutdownCh <-chan struct{}
+
+	entries map[string]*cacheEntry
+	lock    sync.Mutex
+}
+
+// cacheEntry is the cached reply of an RPC. The reply is kept encoded,
+// so every hit decodes its own copy the caller may modify.
+type cacheEntry struct {
+	key    string
+	method string
+	args   interface{}
+
+	// ready is closed once the first fetch completes, which sets reply
+	// on success
+	ready chan struct{}
+
+	reply    []byte
+	index    uint64
+	fetched  time.Time
+	lastRead time.Time
+}
+
+// newRPCCache returns a cache using the given RPC function
+func newRPCCache(rpc func(string, interface{}, interface{}) error,
+	ttl time.Duration, maxEntries int, shutdownCh <-chan struct{}) *rpcCache {
+	return &rpcCache{
+		rpc:        rpc,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		shutdownCh: shutdownCh,
+		entries:    make(map[string]*cacheEntry),
+	}
+}
+
+// queryOptions returns the query options embedded in the request args
+func queryOptions(args interface{}) *structs.QueryOptions {
+	v := reflect.ValueOf(args)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	return v.FieldByName("QueryOptions").Addr().Interface().(*structs.QueryOptions)
+}
+
+// queryMeta returns the query meta embedded in a reply
+func queryMeta(reply interface{}) *structs.QueryMeta {
+	v := reflect.ValueOf(reply).Elem()
+	return v.FieldByName("QueryMeta").Addr().Interface().(*structs.QueryMeta)
+}
+
+// Get makes a read RPC through the cache. The args and reply must be
+// pointers to structs embedding the QueryOptions and QueryMeta. It
+// returns if the reply came from the cache, and its age.
+func (c *rpcCache) Get(method string, args interface{}, reply interface{}) (bool, time.Duration, error) {
+	// The cache answers right away, it doesn't block
+	opts := queryOptions(args)
+	opts.MinQueryIndex, opts.MaxQueryTime = 0, 0
+	raw, err := encodeMsgPack(args)
+	if err != nil {
+		return false, 0, err
+	}
+	key := fmt.Sprintf("%s/%T/%x", method, args, raw)
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		entry.lastRead = time.Now()
+		c.lock.Unlock()
+
+		<-entry.ready
+		c.lock.Lock()
+		buf, fetched := entry.reply, entry.fetched
+		c.lock.Unlock()
+		if buf != nil {
+			metrics.IncrCounter([]string{"consul", "agent", "cache", "hit"}, 1)
+			return true, time.Now().Sub(fetched), decodeMsgPack(buf, reply)
+		}
+
+		// The first fetch failed, try on our own
+		return false, 0, c.rpc(method, args, reply)
+	}
+
+	// Own a copy of the args for the refreshes
+	own := reflect.New(reflect.TypeOf(args).Elem()).Interface()
+	if err := decodeMsgPack(raw, own); err != nil {
+		c.lock.Unlock()
+		return false, 0, err
+	}
+	entry = &cacheEntry{
+		key:      key,
+		method:   method,
+		args:     own,
+		ready:    make(chan struct{}),
+		lastRead: time.Now(),
+	}
+	c.entries[key] = entry
+	c.evict()
+	c.lock.Unlock()
+
+	metrics.IncrCounter([]string{"consul", "agent", "cache", "miss"}, 1)
+	err = c.rpc(method, args, reply)
+	if err == nil {
+		err = c.store(entry, reply)
+	}
+	if err != nil {
+		c.lock.Lock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		c.lock.Unlock()
+		close(entry.ready)
+		return false, 0, err
+	}
+	close(entry.ready)
+
+	go c.refresh(entry, reflect.TypeOf(reply).Elem())
+	return false, 0, nil
+}
+
+// store records a reply of an entry
+func (c *rpcCache) store(entry *cacheEntry, reply interface{}) error {
+	buf, err := encodeMsgPack(reply)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry.reply = buf
+	entry.index = queryMeta(reply).Index
+	entry.fetched = time.Now()
+	return nil
+}
+
+// evict drops the least recently read entries beyond the size limit.
+// The cache lock must be held.
+func (c *rpcCache) evict() {
+	for c.maxEntries > 0 && len(c.entries) > c.maxEntries {
+		var oldest *cacheEntry
+		for _, entry := range c.entries {
+			if oldest == nil || entry.lastRead.Before(oldest.lastRead) {
+				oldest = entry
+			}
+		}
+		delete(c.entries, oldest.key)
+	}
+}
+
+// live returns if an entry is still cached, dropping it once it hasn't
+// been read for the TTL
+func (c *rpcCache) live(entry *cacheEntry) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries[entry.key] != entry {
+		return false
+	}
+	if time.Now().Sub(entry.lastRead) > c.ttl {
+		delete(c.entries, entry.key)
+		return false
+	}
+	return true
+}
+
+// refresh keeps an entry up to date with blocking queries, until it is
+// dropped or the agent shuts down
+func (c *rpcCache) refresh(entry *cacheEntry, replyType reflect.Type) {
+	opts := queryOptions(entry.args)
+	opts.MaxQueryTime = c.ttl
+	if opts.MaxQueryTime > cacheMaxWait {
+		opts.MaxQueryTime = cacheMaxWait
+	}
+
+	var failures uint
+	for c.live(entry) {
+		c.lock.Lock()
+		opts.MinQueryIndex = entry.index
+		c.lock.Unlock()
+
+		reply := reflect.New(replyType).Interface()
+		err := c.rpc(entry.method, entry.args, reply)
+		if err == nil {
+			err = c.store(entry, reply)
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		// Keep serving the stale reply, and back off
+		wait := cacheRetryInterval << failures
+		if wait > cacheMaxBackoff || wait <= 0 {
+			wait = cacheMaxBackoff
+		} else {
+			failures++
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.shutdownCh:
+			return
+		}
+	}
+}
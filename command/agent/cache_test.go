@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+// fakeCatalog answers the Catalog.ServiceNodes RPCs of the cache tests,
+// blocking the queries until the index changes like the servers do
+type fakeCatalog struct {
+	index uint64
+	nodes structs.ServiceNodes
+	err   error
+	calls int
+
+	changeCh chan struct{}
+	lock     sync.Mutex
+}
+
+func newFakeCatalog() *fakeCatalog {
+	return &fakeCatalog{index: 1, changeCh: make(chan struct{})}
+}
+
+func (f *fakeCatalog) set(index uint64, nodes structs.ServiceNodes, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.index, f.nodes, f.err = index, nodes, err
+	close(f.changeCh)
+	f.changeCh = make(chan struct{})
+}
+
+func (f *fakeCatalog) numCalls() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls
+}
+
+func (f *fakeCatalog) RPC(method string, args interface{}, reply interface{}) error {
+	if method != "Catalog.ServiceNodes" {
+		return fmt.Errorf("unexpected method %s", method)
+	}
+	req := args.(*structs.ServiceSpecificRequest)
+
+	f.lock.Lock()
+	f.calls++
+	if req.MinQueryIndex > 0 && req.MinQueryIndex >= f.index {
+		changeCh := f.changeCh
+		f.lock.Unlock()
+		select {
+		case <-changeCh:
+		case <-time.After(req.MaxQueryTime):
+		}
+		f.lock.Lock()
+	}
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+
+	out := reply.(*structs.IndexedServiceNodes)
+	out.Index = f.index
+	out.ServiceNodes = append(structs.ServiceNodes(nil), f.nodes...)
+	return nil
+}
+
+func TestRPCCache_Get(t *testing.T) {
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	fake := newFakeCatalog()
+	fake.set(10, structs.ServiceNodes{{Node: "foo", ServiceName: "db"}}, nil)
+	cache := newRPCCache(fake.RPC, time.Minute, 10, shutdownCh)
+
+	get := func(wait time.Duration) (bool, structs.IndexedServiceNodes) {
+		args := structs.ServiceSpecificRequest{
+			Datacenter:   "dc1",
+			ServiceName:  "db",
+			QueryOptions: structs.QueryOptions{MaxQueryTime: wait},
+		}
+		var out structs.IndexedServiceNodes
+		hit, _, err := cache.Get("Catalog.ServiceNodes", &args, &out)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return hit, out
+	}
+
+	// The first query misses
+	hit, out := get(0)
+	if hit || out.Index != 10 || len(out.ServiceNodes) != 1 {
+		t.Fatalf("bad: %v %v", hit, out)
+	}
+
+	// The same query hits, whatever its wait
+	hit, out = get(time.Second)
+	if !hit || out.Index != 10 || len(out.ServiceNodes) != 1 {
+		t.Fatalf("bad: %v %v", hit, out)
+	}
+
+	// The replies are copies
+	out.ServiceNodes[0].Node = "bar"
+	if _, out = get(0); out.ServiceNodes[0].Node != "foo" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Changes are picked up in the background
+	fake.set(11, structs.ServiceNodes{{Node: "foo"}, {Node: "bar"}}, nil)
+	testutil.WaitForResult(func() (bool, error) {
+		hit, out := get(0)
+		return hit && out.Index == 11 && len(out.ServiceNodes) == 2, nil
+	}, func(err error) {
+		t.Fatalf("not refreshed")
+	})
+
+	// Failed refreshes keep the stale reply
+	fake.set(12, nil, fmt.Errorf("no leader"))
+	time.Sleep(50 * time.Millisecond)
+	if hit, out = get(0); !hit || out.Index != 11 {
+		t.Fatalf("bad: %v %v", hit, out)
+	}
+}
+
+func TestRPCCache_Error(t *testing.T) {
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	fake := newFakeCatalog()
+	fake.set(1, nil, fmt.Errorf("no leader"))
+	cache := newRPCCache(fake.RPC, time.Minute, 10, shutdownCh)
+
+	// Failures aren't cached
+	for i := 0; i < 2; i++ {
+		args := structs.ServiceSpecificRequest{ServiceName: "db"}
+		var out structs.IndexedServiceNodes
+		hit, _, err := cache.Get("Catalog.ServiceNodes", &args, &out)
+		if hit || err == nil {
+			t.Fatalf("bad: %v %v", hit, err)
+		}
+	}
+	if n := fake.numCalls(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+	if len(cache.entries) != 0 {
+		t.Fatalf("bad: %v", cache.entries)
+	}
+}
+
+func TestRPCCache_Expire(t *testing.T) {
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	fake := newFakeCatalog()
+	cache := newRPCCache(fake.RPC, 50*time.Millisecond, 10, shutdownCh)
+
+	args := structs.ServiceSpecificRequest{ServiceName: "db"}
+	var out structs.IndexedServiceNodes
+	if _, _, err := cache.Get("Catalog.ServiceNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Entries that aren't read are dropped once their refresh returns
+	testutil.WaitForResult(func() (bool, error) {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+		return len(cache.entries) == 0, nil
+	}, func(err error) {
+		t.Fatalf("not expired")
+	})
+}
+
+func TestRPCCache_Evict(t *testing.T) {
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	fake := newFakeCatalog()
+	cache := newRPCCache(fake.RPC, time.Minute, 2, shutdownCh)
+
+	get := func(service string) bool {
+		args := structs.ServiceSpecificRequest{ServiceName: service}
+		var out structs.IndexedServiceNodes
+		hit, _, err := cache.Get("Catalog.ServiceNodes", &args, &out)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return hit
+	}
+
+	// The least recently read entry is evicted
+	get("a")
+	time.Sleep(time.Millisecond)
+	get("b")
+	time.Sleep(time.Millisecond)
+	get("a")
+	time.Sleep(time.Millisecond)
+	get("c")
+	if !get("a") || !get("c") {
+		t.Fatalf("should hit")
+	}
+	if get("b") {
+		t.Fatalf("should miss")
+	}
+}
@@ -3,8 +3,11 @@ package agent
 import (
 	"fmt"
 	"github.com/hashicorp/consul/consul/structs"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func (s *HTTPServer) CatalogRegister(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
@@ -19,10 +22,16 @@ func (s *HTTPServer) CatalogRegister(resp http.ResponseWriter, req *http.Request
 	if args.Datacenter == "" {
 		args.Datacenter = s.agent.config.Datacenter
 	}
+	args.Audit.SourceAddr = auditSourceAddr(req)
 
 	// Forward to the servers
 	var out struct{}
 	if err := s.agent.RPC("Catalog.Register", &args, &out); err != nil {
+		if structs.IsRegistrationConflict(err) {
+			resp.WriteHeader(409)
+			resp.Write([]byte(err.Error()))
+			return nil, nil
+		}
 		return nil, err
 	}
 	return true, nil
@@ -40,15 +49,110 @@ func (s *HTTPServer) CatalogDeregister(resp http.ResponseWriter, req *http.Reque
 	if args.Datacenter == "" {
 		args.Datacenter = s.agent.config.Datacenter
 	}
+	args.Audit.SourceAddr = auditSourceAddr(req)
 
 	// Forward to the servers
 	var out struct{}
 	if err := s.agent.RPC("Catalog.Deregister", &args, &out); err != nil {
+		if structs.IsRegistrationConflict(err) {
+			resp.WriteHeader(409)
+			resp.Write([]byte(err.Error()))
+			return nil, nil
+		}
 		return nil, err
 	}
 	return true, nil
 }
 
+func (s *HTTPServer) CatalogPatch(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	var args structs.CatalogPatchRequest
+	if err := decodeBody(req, &args, nil); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+
+	// Setup the default DC if not provided
+	if args.Datacenter == "" {
+		args.Datacenter = s.agent.config.Datacenter
+	}
+	s.parseToken(req, &args.Token)
+
+	// Forward to the servers
+	var out struct{}
+	if err := s.agent.RPC("Catalog.Patch", &args, &out); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func (s *HTTPServer) CatalogMaintenance(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Only PUT supported
+	if req.Method != "PUT" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.MaintenanceRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+
+	// Pull out the node name
+	args.Maintenance.Node = strings.TrimPrefix(req.URL.Path, "/v1/catalog/maintenance/")
+	if args.Maintenance.Node == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing node name"))
+		return nil, nil
+	}
+
+	// Ensure we have some action
+	params := req.URL.Query()
+	raw := params.Get("enable")
+	enable, err := strconv.ParseBool(raw)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Invalid value for enable: %q", raw)))
+		return nil, nil
+	}
+	args.Maintenance.ServiceID = params.Get("service")
+
+	if enable {
+		args.Op = structs.MaintenanceEnable
+		args.Maintenance.Reason = params.Get("reason")
+		if ttl := params.Get("ttl"); ttl != "" {
+			dur, err := time.ParseDuration(ttl)
+			if err != nil || dur < 0 {
+				resp.WriteHeader(400)
+				resp.Write([]byte(fmt.Sprintf("Invalid ttl: %q", ttl)))
+				return nil, nil
+			}
+			args.TTL = dur
+		}
+	} else {
+		args.Op = structs.MaintenanceDisable
+	}
+
+	var out bool
+	if err := s.agent.RPC("Catalog.Maintenance", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *HTTPServer) CatalogMaintenanceList(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.IndexedMaintenances
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Catalog.ListMaintenance", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.Maintenances, nil
+}
+
 func (s *HTTPServer) CatalogDatacenters(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	var out []string
 	if err := s.agent.RPC("Catalog.ListDatacenters", struct{}{}, &out); err != nil {
@@ -63,6 +167,9 @@ func (s *HTTPServer) CatalogNodes(resp http.ResponseWriter, req *http.Request) (
 	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
 		return nil, nil
 	}
+	if parsePage(resp, req, &args.QueryOptions) {
+		return nil, nil
+	}
 
 	var out structs.IndexedNodes
 	defer setMeta(resp, &out.QueryMeta)
@@ -93,6 +200,9 @@ func (s *HTTPServer) CatalogServiceNodes(resp http.ResponseWriter, req *http.Req
 	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
 		return nil, nil
 	}
+	if parsePage(resp, req, &args.QueryOptions) {
+		return nil, nil
+	}
 
 	// Check for a tag
 	params := req.URL.Query()
@@ -101,6 +211,11 @@ func (s *HTTPServer) CatalogServiceNodes(resp http.ResponseWriter, req *http.Req
 		args.TagFilter = true
 	}
 
+	// Check for a lookup of the connect-proxies of the service
+	if _, ok := params["connect"]; ok {
+		args.Connect = true
+	}
+
 	// Pull out the service name
 	args.ServiceName = strings.TrimPrefix(req.URL.Path, "/v1/catalog/service/")
 	if args.ServiceName == "" {
@@ -112,7 +227,7 @@ func (s *HTTPServer) CatalogServiceNodes(resp http.ResponseWriter, req *http.Req
 	// Make the RPC request
 	var out structs.IndexedServiceNodes
 	defer setMeta(resp, &out.QueryMeta)
-	if err := s.agent.RPC("Catalog.ServiceNodes", &args, &out); err != nil {
+	if err := s.cachedRPC(resp, req, "Catalog.ServiceNodes", &args, &args.QueryOptions, &out); err != nil {
 		return nil, err
 	}
 	return out.ServiceNodes, nil
@@ -141,3 +256,44 @@ func (s *HTTPServer) CatalogNodeServices(resp http.ResponseWriter, req *http.Req
 	}
 	return out.NodeServices, nil
 }
+
+func (s *HTTPServer) CatalogAudit(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.CatalogAuditRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	// Parse the optional node and time range
+	query := req.URL.Query()
+	args.Node = query.Get("node")
+	for param, out := range map[string]*int64{"start": &args.Start, "end": &args.End} {
+		val := query.Get(param)
+		if val == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid %s time: %v", param, err)))
+			return nil, nil
+		}
+		*out = t.UnixNano()
+	}
+
+	var out structs.IndexedCatalogAudits
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Catalog.Audit", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.Audits, nil
+}
+
+// auditSourceAddr returns the address of the client making a catalog
+// change, for the audit table
+func auditSourceAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -2,10 +2,12 @@ package agent
 
 import (
 	"fmt"
+	"github.com/hashicorp/consul/consul"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
 	"time"
@@ -52,6 +54,37 @@ func TestCatalogRegister(t *testing.T) {
 	}
 }
 
+func TestCatalogRegister_CAS(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// The node must not exist yet, so the second registration conflicts
+	args := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		CAS:     true,
+	}
+	for i, code := range []int{200, 409} {
+		req, err := http.NewRequest("PUT", "/v1/catalog/register", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req.Body = encodeReq(args)
+
+		resp := httptest.NewRecorder()
+		if _, err := srv.CatalogRegister(resp, req); err != nil {
+			t.Fatalf("%d err: %v", i, err)
+		}
+		if resp.Code != code {
+			t.Fatalf("%d bad: %d %s", i, resp.Code, resp.Body.String())
+		}
+	}
+}
+
 func TestCatalogDeregister(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -81,6 +114,84 @@ func TestCatalogDeregister(t *testing.T) {
 	}
 }
 
+func TestCatalogMaintenance(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Wait for the leader to register the agent's node
+	node := srv.agent.config.NodeName
+	testutil.WaitForResult(func() (bool, error) {
+		args := structs.NodeSpecificRequest{Datacenter: "dc1", Node: node}
+		var out structs.IndexedNodeServices
+		if err := srv.agent.RPC("Catalog.NodeServices", &args, &out); err != nil {
+			return false, err
+		}
+		return out.NodeServices != nil, nil
+	}, func(err error) {
+		t.Fatalf("node should be registered")
+	})
+
+	// Missing or invalid enable
+	for _, path := range []string{"/v1/catalog/maintenance/" + node, "/v1/catalog/maintenance/" + node + "?enable=nope"} {
+		req, _ := http.NewRequest("PUT", path, nil)
+		resp := httptest.NewRecorder()
+		if _, err := srv.CatalogMaintenance(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 400 {
+			t.Fatalf("bad: %d", resp.Code)
+		}
+	}
+
+	// Enable node maintenance
+	req, _ := http.NewRequest("PUT", "/v1/catalog/maintenance/"+node+"?enable=true&reason=broken&ttl=1h", nil)
+	obj, err := srv.CatalogMaintenance(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if obj != true {
+		t.Fatalf("bad: %v", obj)
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/catalog/maintenance", nil)
+	resp := httptest.NewRecorder()
+	obj, err = srv.CatalogMaintenanceList(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+	flags := obj.(structs.Maintenances)
+	if len(flags) != 1 || flags[0].Node != node || flags[0].Reason != "broken" || flags[0].Expires == 0 {
+		t.Fatalf("bad: %v", flags)
+	}
+
+	// Anti-entropy leaves the check of the flag alone
+	if err := srv.agent.state.setSyncState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := srv.agent.state.checkStatus[consul.MaintenanceCheckID]; ok {
+		t.Fatalf("bad: %v", srv.agent.state.checkStatus)
+	}
+
+	// Disable it
+	req, _ = http.NewRequest("PUT", "/v1/catalog/maintenance/"+node+"?enable=false", nil)
+	if _, err := srv.CatalogMaintenance(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var out structs.IndexedMaintenances
+	if err := srv.agent.RPC("Catalog.ListMaintenance", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Maintenances) != 0 {
+		t.Fatalf("bad: %v", out.Maintenances)
+	}
+}
+
 func TestCatalogDatacenters(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -143,6 +254,76 @@ func TestCatalogNodes(t *testing.T) {
 	}
 }
 
+func TestCatalogNodes_Paginate(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register node
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "/v1/catalog/nodes?limit=1", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.CatalogNodes(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	nodes := obj.(structs.Nodes)
+	if len(nodes) != 1 {
+		t.Fatalf("bad: %v", obj)
+	}
+	token := resp.Header().Get("X-Consul-NextToken")
+	if token == "" {
+		t.Fatalf("missing next token")
+	}
+
+	// Get the last page
+	req, err = http.NewRequest("GET", "/v1/catalog/nodes?limit=1&next-token="+url.QueryEscape(token), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	obj, err = srv.CatalogNodes(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	last := obj.(structs.Nodes)
+	if len(last) != 1 || last[0].Node == nodes[0].Node {
+		t.Fatalf("bad: %v", obj)
+	}
+	if token := resp.Header().Get("X-Consul-NextToken"); token != "" {
+		t.Fatalf("bad: %v", token)
+	}
+
+	// A bad limit is rejected
+	req, err = http.NewRequest("GET", "/v1/catalog/nodes?limit=-1", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.CatalogNodes(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad: %v", resp.Code)
+	}
+}
+
 func TestCatalogNodes_Blocking(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -289,6 +470,62 @@ func TestCatalogServiceNodes(t *testing.T) {
 	}
 }
 
+func TestCatalogServiceNodes_Connect(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register a proxy of the api
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "api-proxy",
+			Port:    21000,
+			Kind:    structs.ServiceKindConnectProxy,
+			Proxy:   structs.ConnectProxyConfig{DestinationServiceName: "api"},
+		},
+	}
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "/v1/catalog/service/api?connect", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.CatalogServiceNodes(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+
+	nodes := obj.(structs.ServiceNodes)
+	if len(nodes) != 1 || nodes[0].ServiceName != "api-proxy" ||
+		nodes[0].ServiceKind != structs.ServiceKindConnectProxy {
+		t.Fatalf("bad: %v", obj)
+	}
+
+	// The service itself has no instance
+	req, err = http.NewRequest("GET", "/v1/catalog/service/api", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, err = srv.CatalogServiceNodes(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if nodes := obj.(structs.ServiceNodes); len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestCatalogNodeServices(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -1,12 +1,16 @@
 package agent
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -32,28 +36,62 @@ const (
 
 // CheckType is used to create either the CheckMonitor
 // or the CheckTTL.
-// Four types are supported: Script, HTTP, TCP and TTL
-// Script, HTTP and TCP all require Interval
+// Six types are supported: Script, Docker, HTTP, TCP, UDP and TTL
+// Script, Docker, HTTP, TCP and UDP all require Interval
+// Docker checks run the Script inside the DockerContainerID
 // Only one of the types needs to be provided
-//  TTL or Script/Interval or HTTP/Interval or TCP/Interval
+//
+//	TTL or Script/Interval or Script/DockerContainerID/Interval or
+//	HTTP/Interval or TCP/Interval or UDP/Interval
 type CheckType struct {
 	Script   string
 	HTTP     string
 	TCP      string
+	UDP      string
 	Interval time.Duration
 
+	// DockerContainerID has the Script run inside a container through
+	// the Docker API, by the Shell, /bin/sh by default
+	DockerContainerID string
+	Shell             string
+
+	// TLS has a TCP check complete a TLS handshake after connecting.
+	// TLSSkipVerify skips the verification of the server certificate,
+	// for TCP and HTTPS checks.
+	TLS           bool
+	TLSSkipVerify bool
+
+	// Method, Header and Body customize the request of an HTTP check,
+	// a GET without a body by default. ExpectedStatus lists the ranges
+	// of the passing status codes, such as "200-299" or "301", any 2xx
+	// by default.
+	Method         string
+	Header         map[string][]string
+	Body           string
+	ExpectedStatus []string
+
 	Timeout time.Duration
 	TTL     time.Duration
 
 	Status string
 
 	Notes string
+
+	// DeregisterCriticalServiceAfter, if set, has the servers deregister
+	// the service of the check once it has been critical for this long
+	DeregisterCriticalServiceAfter time.Duration
+
+	// SuccessBeforePassing and FailuresBeforeCritical, if set, are how
+	// many consecutive passing or critical outcomes it takes to change
+	// the status of the check
+	SuccessBeforePassing   int
+	FailuresBeforeCritical int
 }
 type CheckTypes []*CheckType
 
 // Valid checks if the CheckType is valid
 func (c *CheckType) Valid() bool {
-	return c.IsTTL() || c.IsMonitor() || c.IsHTTP() || c.IsTCP()
+	return c.IsTTL() || c.IsMonitor() || c.IsDocker() || c.IsHTTP() || c.IsTCP() || c.IsUDP()
 }
 
 // IsTTL checks if this is a TTL type
@@ -63,7 +101,12 @@ func (c *CheckType) IsTTL() bool {
 
 // IsMonitor checks if this is a Monitor type
 func (c *CheckType) IsMonitor() bool {
-	return c.Script != "" && c.Interval != 0
+	return c.Script != "" && c.DockerContainerID == "" && c.Interval != 0
+}
+
+// IsDocker checks if this is a Docker type
+func (c *CheckType) IsDocker() bool {
+	return c.Script != "" && c.DockerContainerID != "" && c.Interval != 0
 }
 
 // IsHTTP checks if this is a HTTP type
@@ -76,6 +119,67 @@ func (c *CheckType) IsTCP() bool {
 	return c.TCP != "" && c.Interval != 0
 }
 
+// IsUDP checks if this is a UDP type
+func (c *CheckType) IsUDP() bool {
+	return c.UDP != "" && c.Interval != 0
+}
+
+// describe records the definition of the check type on a health check,
+// so the catalog shows how the check is run
+func (c *CheckType) describe(check *structs.HealthCheck) {
+	switch {
+	case c.IsTTL():
+		check.Type = structs.CheckTypeTTL
+	case c.IsHTTP():
+		check.Type, check.Target = structs.CheckTypeHTTP, c.HTTP
+		check.TLSSkipVerify = c.TLSSkipVerify
+		check.Method, check.Header, check.Body = c.Method, c.Header, c.Body
+		check.ExpectedStatus = c.ExpectedStatus
+	case c.IsTCP():
+		check.Type, check.Target = structs.CheckTypeTCP, c.TCP
+		check.TLS, check.TLSSkipVerify = c.TLS, c.TLSSkipVerify
+	case c.IsUDP():
+		check.Type, check.Target = structs.CheckTypeUDP, c.UDP
+	case c.IsDocker():
+		check.Type, check.Target = structs.CheckTypeDocker, c.Script
+		check.DockerContainerID, check.Shell = c.DockerContainerID, c.Shell
+	default:
+		check.Type, check.Target = structs.CheckTypeScript, c.Script
+	}
+	check.Interval = c.Interval
+	check.Timeout = c.Timeout
+	check.TTL = c.TTL
+}
+
+// statusRange is an inclusive range of HTTP status codes
+type statusRange struct {
+	min, max int
+}
+
+// parseStatusRanges parses the expected status of an HTTP check, each
+// either a status code or a range of them such as "200-299"
+func parseStatusRanges(specs []string) ([]statusRange, error) {
+	var ranges []statusRange
+	for _, spec := range specs {
+		parts := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+		min, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expected status %q", spec)
+		}
+		max := min
+		if len(parts) == 2 {
+			if max, err = strconv.Atoi(parts[1]); err != nil {
+				return nil, fmt.Errorf("Invalid expected status %q", spec)
+			}
+		}
+		if min < 100 || max > 599 || min > max {
+			return nil, fmt.Errorf("Invalid expected status %q", spec)
+		}
+		ranges = append(ranges, statusRange{min, max})
+	}
+	return ranges, nil
+}
+
 // CheckNotifier interface is used by the CheckMonitor
 // to notify when a check has a status update. The update
 // should take care to be idempotent.
@@ -203,6 +307,124 @@ func (c *CheckMonitor) check() {
 	c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, outputStr)
 }
 
+// CheckDocker is used to periodically run a script inside a Docker
+// container through the Docker API, to determine the health of a given
+// check. The exit code of the script maps to a status like for the
+// CheckMonitor.
+type CheckDocker struct {
+	Notify            CheckNotifier
+	CheckID           string
+	Script            string
+	DockerContainerID string
+	Shell             string
+	Interval          time.Duration
+	Timeout           time.Duration
+	Logger            *log.Logger
+
+	client   *dockerClient
+	stop     bool
+	stopCh   chan struct{}
+	stopLock sync.Mutex
+}
+
+// Start is used to start a Docker check.
+// The check runs until stop is called
+func (c *CheckDocker) Start() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if c.Shell == "" {
+		c.Shell = "/bin/sh"
+	}
+	c.stop = false
+	c.stopCh = make(chan struct{})
+	go c.run()
+}
+
+// Stop is used to stop a Docker check.
+func (c *CheckDocker) Stop() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if !c.stop {
+		c.stop = true
+		close(c.stopCh)
+	}
+}
+
+// run is invoked by a goroutine to run until Stop() is called
+func (c *CheckDocker) run() {
+	// Get the randomized initial pause time
+	initialPauseTime := randomStagger(c.Interval)
+	c.Logger.Printf("[DEBUG] agent: pausing %v before first invocation of %s in container %s",
+		initialPauseTime, c.Script, c.DockerContainerID)
+	next := time.After(initialPauseTime)
+	for {
+		select {
+		case <-next:
+			c.check()
+			next = time.After(c.Interval)
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// check is invoked periodically to perform the Docker check
+func (c *CheckDocker) check() {
+	// Scripts get 30 seconds to complete like for the CheckMonitor,
+	// unless a timeout is given
+	timeout := 30 * time.Second
+	if c.Timeout > 0 {
+		timeout = c.Timeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	execID, err := c.client.createExec(c.DockerContainerID, []string{c.Shell, "-c", c.Script}, deadline)
+	if err != nil {
+		c.Logger.Printf("[ERR] agent: failed to setup invoke '%s' in container '%s': %s",
+			c.Script, c.DockerContainerID, err)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
+		return
+	}
+
+	// Collect the output
+	output, _ := circbuf.NewBuffer(CheckBufSize)
+	if err := c.client.startExec(execID, output, deadline); err != nil {
+		c.Logger.Printf("[ERR] agent: failed to invoke '%s' in container '%s': %s",
+			c.Script, c.DockerContainerID, err)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
+		return
+	}
+	code, err := c.client.inspectExec(execID, deadline)
+	if err != nil {
+		c.Logger.Printf("[ERR] agent: failed to inspect '%s' in container '%s': %s",
+			c.Script, c.DockerContainerID, err)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
+		return
+	}
+
+	// Get the output, add a message about truncation
+	outputStr := string(output.Bytes())
+	if output.TotalWritten() > output.Size() {
+		outputStr = fmt.Sprintf("Captured %d of %d bytes\n...\n%s",
+			output.Size(), output.TotalWritten(), outputStr)
+	}
+
+	c.Logger.Printf("[DEBUG] agent: check '%s' script '%s' output: %s",
+		c.CheckID, c.Script, outputStr)
+
+	switch code {
+	case 0:
+		c.Logger.Printf("[DEBUG] agent: Check '%v' is passing", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing, outputStr)
+	case 1:
+		c.Logger.Printf("[WARN] agent: Check '%v' is now warning", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthWarning, outputStr)
+	default:
+		c.Logger.Printf("[WARN] agent: Check '%v' is now critical", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, outputStr)
+	}
+}
+
 // CheckTTL is used to apply a TTL to check status,
 // and enables clients to set the status of a check
 // but upon the TTL expiring, the check status is
@@ -286,22 +508,29 @@ type persistedCheckState struct {
 
 // CheckHTTP is used to periodically make an HTTP request to
 // determine the health of a given check.
-// The check is passing if the response code is 2XX.
+// The check is passing if the response code is 2XX, or in one
+// of the ExpectedStatus ranges if given.
 // The check is warning if the response code is 429.
 // The check is critical if the response code is anything else
 // or if the request returns an error
 type CheckHTTP struct {
-	Notify   CheckNotifier
-	CheckID  string
-	HTTP     string
-	Interval time.Duration
-	Timeout  time.Duration
-	Logger   *log.Logger
-
-	httpClient *http.Client
-	stop       bool
-	stopCh     chan struct{}
-	stopLock   sync.Mutex
+	Notify         CheckNotifier
+	CheckID        string
+	HTTP           string
+	Method         string
+	Header         map[string][]string
+	Body           string
+	ExpectedStatus []string
+	TLSSkipVerify  bool
+	Interval       time.Duration
+	Timeout        time.Duration
+	Logger         *log.Logger
+
+	httpClient   *http.Client
+	statusRanges []statusRange
+	stop         bool
+	stopCh       chan struct{}
+	stopLock     sync.Mutex
 }
 
 // Start is used to start an HTTP check.
@@ -315,6 +544,9 @@ func (c *CheckHTTP) Start() {
 		// failing checks due to the keepalive interval.
 		trans := *http.DefaultTransport.(*http.Transport)
 		trans.DisableKeepAlives = true
+		if c.TLSSkipVerify {
+			trans.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
 
 		// Create the HTTP client.
 		c.httpClient = &http.Client{
@@ -332,6 +564,9 @@ func (c *CheckHTTP) Start() {
 		}
 	}
 
+	// The ranges are validated when the check is added
+	c.statusRanges, _ = parseStatusRanges(c.ExpectedStatus)
+
 	c.stop = false
 	c.stopCh = make(chan struct{})
 	go c.run()
@@ -366,7 +601,15 @@ func (c *CheckHTTP) run() {
 
 // check is invoked periodically to perform the HTTP check
 func (c *CheckHTTP) check() {
-	req, err := http.NewRequest("GET", c.HTTP, nil)
+	method := c.Method
+	if method == "" {
+		method = "GET"
+	}
+	var body io.Reader
+	if c.Body != "" {
+		body = strings.NewReader(c.Body)
+	}
+	req, err := http.NewRequest(method, c.HTTP, body)
 	if err != nil {
 		c.Logger.Printf("[WARN] agent: http request failed '%s': %s", c.HTTP, err)
 		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
@@ -374,6 +617,13 @@ func (c *CheckHTTP) check() {
 	}
 
 	req.Header.Set("User-Agent", HttpUserAgent)
+	for name, values := range c.Header {
+		if http.CanonicalHeaderKey(name) == "Host" && len(values) > 0 {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -384,14 +634,14 @@ func (c *CheckHTTP) check() {
 	defer resp.Body.Close()
 
 	// Format the response body
-	body, err := ioutil.ReadAll(resp.Body)
+	output, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		c.Logger.Printf("[WARN] agent: check '%v': Get error while reading body: %s", c.CheckID, err)
-		body = []byte{}
+		output = []byte{}
 	}
-	result := fmt.Sprintf("HTTP GET %s: %s Output: %s", c.HTTP, resp.Status, body)
+	result := fmt.Sprintf("HTTP %s %s: %s Output: %s", method, c.HTTP, resp.Status, output)
 
-	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+	if c.passing(resp.StatusCode) {
 		// PASSING (2xx)
 		c.Logger.Printf("[DEBUG] agent: check '%v' is passing", c.CheckID)
 		c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing, result)
@@ -410,17 +660,33 @@ func (c *CheckHTTP) check() {
 	}
 }
 
-// CheckTCP is used to periodically make an TCP/UDP connection to
+// passing returns if a response status code is passing
+func (c *CheckHTTP) passing(code int) bool {
+	if len(c.statusRanges) == 0 {
+		return code >= 200 && code <= 299
+	}
+	for _, r := range c.statusRanges {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTCP is used to periodically make an TCP connection to
 // determine the health of a given check.
-// The check is passing if the connection succeeds
+// The check is passing if the connection succeeds, along with the TLS
+// handshake if enabled
 // The check is critical if the connection returns an error
 type CheckTCP struct {
-	Notify   CheckNotifier
-	CheckID  string
-	TCP      string
-	Interval time.Duration
-	Timeout  time.Duration
-	Logger   *log.Logger
+	Notify        CheckNotifier
+	CheckID       string
+	TCP           string
+	Interval      time.Duration
+	Timeout       time.Duration
+	TLS           bool
+	TLSSkipVerify bool
+	Logger        *log.Logger
 
 	dialer   *net.Dialer
 	stop     bool
@@ -482,7 +748,14 @@ func (c *CheckTCP) run() {
 
 // check is invoked periodically to perform the TCP check
 func (c *CheckTCP) check() {
-	conn, err := c.dialer.Dial(`tcp`, c.TCP)
+	var conn net.Conn
+	var err error
+	if c.TLS {
+		conf := &tls.Config{InsecureSkipVerify: c.TLSSkipVerify}
+		conn, err = tls.DialWithDialer(c.dialer, `tcp`, c.TCP, conf)
+	} else {
+		conn, err = c.dialer.Dial(`tcp`, c.TCP)
+	}
 	if err != nil {
 		c.Logger.Printf("[WARN] agent: socket connection failed '%s': %s", c.TCP, err)
 		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
@@ -490,5 +763,112 @@ func (c *CheckTCP) check() {
 	}
 	conn.Close()
 	c.Logger.Printf("[DEBUG] agent: check '%v' is passing", c.CheckID)
+	if c.TLS {
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing, fmt.Sprintf("TLS connect %s: Success", c.TCP))
+		return
+	}
 	c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing, fmt.Sprintf("TCP connect %s: Success", c.TCP))
 }
+
+// CheckUDP is used to periodically send an empty datagram to a UDP port
+// to determine the health of a given check. UDP has no handshake, so
+// the check only notices a closed port, reported by an ICMP port
+// unreachable message.
+// The check is passing if a response is received, or if none arrives
+// before the timeout
+// The check is critical if the port is reported closed, or if sending
+// returns an error
+type CheckUDP struct {
+	Notify   CheckNotifier
+	CheckID  string
+	UDP      string
+	Interval time.Duration
+	Timeout  time.Duration
+	Logger   *log.Logger
+
+	timeout  time.Duration
+	stop     bool
+	stopCh   chan struct{}
+	stopLock sync.Mutex
+}
+
+// Start is used to start a UDP check.
+// The check runs until stop is called
+func (c *CheckUDP) Start() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+
+	// For long (>10s) interval checks the response timeout is 10s,
+	// otherwise the timeout is the interval. This means that a check
+	// *should* return before the next check begins.
+	c.timeout = 10 * time.Second
+	if c.Timeout > 0 && c.Timeout < c.Interval {
+		c.timeout = c.Timeout
+	} else if c.Interval < 10*time.Second {
+		c.timeout = c.Interval
+	}
+
+	c.stop = false
+	c.stopCh = make(chan struct{})
+	go c.run()
+}
+
+// Stop is used to stop a UDP check.
+func (c *CheckUDP) Stop() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if !c.stop {
+		c.stop = true
+		close(c.stopCh)
+	}
+}
+
+// run is invoked by a goroutine to run until Stop() is called
+func (c *CheckUDP) run() {
+	// Get the randomized initial pause time
+	initialPauseTime := randomStagger(c.Interval)
+	c.Logger.Printf("[DEBUG] agent: pausing %v before first UDP probe of %s", initialPauseTime, c.UDP)
+	next := time.After(initialPauseTime)
+	for {
+		select {
+		case <-next:
+			c.check()
+			next = time.After(c.Interval)
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// check is invoked periodically to perform the UDP check
+func (c *CheckUDP) check() {
+	conn, err := net.DialTimeout(`udp`, c.UDP, c.timeout)
+	if err != nil {
+		c.Logger.Printf("[WARN] agent: UDP probe failed '%s': %s", c.UDP, err)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// A closed port answers with an ICMP message, which the next read of
+	// the connected socket reports as an error
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := conn.Write(nil); err != nil {
+		c.Logger.Printf("[WARN] agent: UDP probe failed '%s': %s", c.UDP, err)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
+		return
+	}
+	buf := make([]byte, 512)
+	_, err = conn.Read(buf)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		c.Logger.Printf("[DEBUG] agent: check '%v' is passing", c.CheckID)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing, fmt.Sprintf("UDP probe %s: No response", c.UDP))
+		return
+	} else if err != nil {
+		c.Logger.Printf("[WARN] agent: UDP probe failed '%s': %s", c.UDP, err)
+		c.Notify.UpdateCheck(c.CheckID, structs.HealthCritical, err.Error())
+		return
+	}
+	c.Logger.Printf("[DEBUG] agent: check '%v' is passing", c.CheckID)
+	c.Notify.UpdateCheck(c.CheckID, structs.HealthPassing, fmt.Sprintf("UDP probe %s: Response received", c.UDP))
+}
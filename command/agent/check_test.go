@@ -2,11 +2,13 @@ package agent
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -262,6 +264,97 @@ func TestCheckHTTPWarning(t *testing.T) {
 	server.Close()
 }
 
+func TestCheckHTTP_Request(t *testing.T) {
+	var lock sync.Mutex
+	var method, host, token, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		method, host, token, body = r.Method, r.Host, r.Header.Get("X-Token"), string(raw)
+		lock.Unlock()
+		w.WriteHeader(304)
+	}))
+	defer server.Close()
+
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+	check := &CheckHTTP{
+		Notify:         mock,
+		CheckID:        "foo",
+		HTTP:           server.URL,
+		Method:         "POST",
+		Header:         map[string][]string{"x-token": []string{"secret"}, "Host": []string{"example.com"}},
+		Body:           "ping",
+		ExpectedStatus: []string{"200-299", "304"},
+		Interval:       10 * time.Millisecond,
+		Logger:         log.New(os.Stderr, "", log.LstdFlags),
+	}
+	check.Start()
+	time.Sleep(50 * time.Millisecond)
+	check.Stop()
+
+	if mock.state["foo"] != structs.HealthPassing {
+		t.Fatalf("bad: %v %v", mock.state, mock.output)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if method != "POST" || host != "example.com" || token != "secret" || body != "ping" {
+		t.Fatalf("bad: %s %s %s %s", method, host, token, body)
+	}
+}
+
+func TestCheckHTTP_TLSSkipVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	for _, skip := range []bool{true, false} {
+		mock := &MockNotify{
+			state:   make(map[string]string),
+			updates: make(map[string]int),
+			output:  make(map[string]string),
+		}
+		check := &CheckHTTP{
+			Notify:        mock,
+			CheckID:       "foo",
+			HTTP:          server.URL,
+			TLSSkipVerify: skip,
+			Interval:      10 * time.Millisecond,
+			Logger:        log.New(os.Stderr, "", log.LstdFlags),
+		}
+		check.Start()
+		time.Sleep(50 * time.Millisecond)
+		check.Stop()
+
+		// The certificate of the test server is self-signed
+		expected := structs.HealthPassing
+		if !skip {
+			expected = structs.HealthCritical
+		}
+		if mock.state["foo"] != expected {
+			t.Fatalf("should be %v %v %v", expected, mock.state, mock.output)
+		}
+	}
+}
+
+func TestParseStatusRanges(t *testing.T) {
+	ranges, err := parseStatusRanges([]string{"200-299", " 404 "})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ranges) != 2 || ranges[0] != (statusRange{200, 299}) || ranges[1] != (statusRange{404, 404}) {
+		t.Fatalf("bad: %v", ranges)
+	}
+
+	for _, spec := range []string{"", "2xx", "300-200", "99", "200-600"} {
+		if _, err := parseStatusRanges([]string{spec}); err == nil {
+			t.Fatalf("should fail: %q", spec)
+		}
+	}
+}
+
 func mockSlowHTTPServer(responseCode int, sleep time.Duration) *httptest.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -393,3 +486,135 @@ func TestCheckTCPPassing(t *testing.T) {
 	expectTCPStatus(t, tcpServer.Addr().String(), "passing")
 	tcpServer.Close()
 }
+
+func TestCheckTCP_TLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	for _, skip := range []bool{true, false} {
+		mock := &MockNotify{
+			state:   make(map[string]string),
+			updates: make(map[string]int),
+			output:  make(map[string]string),
+		}
+		check := &CheckTCP{
+			Notify:        mock,
+			CheckID:       "foo",
+			TCP:           addr,
+			Interval:      50 * time.Millisecond,
+			Timeout:       40 * time.Millisecond,
+			TLS:           true,
+			TLSSkipVerify: skip,
+			Logger:        log.New(os.Stderr, "", log.LstdFlags),
+		}
+		check.Start()
+		time.Sleep(150 * time.Millisecond)
+		check.Stop()
+
+		// The certificate of the test server is self-signed
+		expected := structs.HealthPassing
+		if !skip {
+			expected = structs.HealthCritical
+		}
+		if mock.state["foo"] != expected {
+			t.Fatalf("should be %v %v %v", expected, mock.state, mock.output)
+		}
+	}
+}
+
+func expectUDPStatus(t *testing.T, udp string, status string) {
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+	check := &CheckUDP{
+		Notify:   mock,
+		CheckID:  "foo",
+		UDP:      udp,
+		Interval: 10 * time.Millisecond,
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+	}
+	check.Start()
+	defer check.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Should have at least 2 updates
+	if mock.updates["foo"] < 2 {
+		t.Fatalf("should have 2 updates %v", mock.updates)
+	}
+
+	if mock.state["foo"] != status {
+		t.Fatalf("should be %v %v", status, mock.state)
+	}
+}
+
+func TestCheckUDPCritical(t *testing.T) {
+	// Grab a free port, and close it so the probes are refused
+	conn, err := net.ListenPacket(`udp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	expectUDPStatus(t, addr, "critical")
+}
+
+func TestCheckUDPPassing(t *testing.T) {
+	conn, err := net.ListenPacket(`udp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	expectUDPStatus(t, conn.LocalAddr().String(), "passing")
+}
+
+func expectDockerStatus(t *testing.T, exitCode int, status string) {
+	server := mockDockerServer("checked", exitCode)
+	defer server.Close()
+	client, err := newDockerClient("tcp://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	mock := &MockNotify{
+		state:   make(map[string]string),
+		updates: make(map[string]int),
+		output:  make(map[string]string),
+	}
+	check := &CheckDocker{
+		Notify:            mock,
+		CheckID:           "foo",
+		Script:            "/health.sh",
+		DockerContainerID: "web",
+		Interval:          10 * time.Millisecond,
+		Logger:            log.New(os.Stderr, "", log.LstdFlags),
+		client:            client,
+	}
+	check.Start()
+	defer check.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Should have at least 2 updates
+	if mock.updates["foo"] < 2 {
+		t.Fatalf("should have 2 updates %v", mock.updates)
+	}
+
+	if mock.state["foo"] != status {
+		t.Fatalf("should be %v %v", status, mock.state)
+	}
+	if mock.output["foo"] != "checked" {
+		t.Fatalf("bad: %v", mock.output)
+	}
+}
+
+func TestCheckDocker(t *testing.T) {
+	expectDockerStatus(t, 0, "passing")
+	expectDockerStatus(t, 1, "warning")
+	expectDockerStatus(t, 2, "critical")
+}
@@ -48,6 +48,15 @@ type Command struct {
 	dnsServer         *DNSServer
 	scadaProvider     *scada.Provider
 	scadaHttp         *HTTPServer
+
+	// configPaths are the configuration files and directories, and
+	// configChangeCh is notified when polling finds them changed
+	configPaths    []string
+	configChangeCh chan struct{}
+
+	// metricsSink keeps the metrics for /v1/agent/metrics, nil if
+	// disabled
+	metricsSink *metricsSink
 }
 
 // readConfig is responsible for setup of our configuration using
@@ -134,6 +143,8 @@ func (c *Command) readConfig() *Config {
 		cmdConfig.RetryIntervalWan = dur
 	}
 
+	c.configPaths = configFiles
+
 	config := DefaultConfig()
 	if len(configFiles) > 0 {
 		fileConfig, err := ReadConfigPaths(configFiles)
@@ -204,6 +215,19 @@ func (c *Command) readConfig() *Config {
 		return nil
 	}
 
+	// The KV replication mirrors another datacenter
+	if config.KVReplicationSource != "" {
+		config.KVReplicationSource = strings.ToLower(config.KVReplicationSource)
+		if config.KVReplicationSource == config.Datacenter {
+			c.Ui.Error("KV replication source must be another datacenter")
+			return nil
+		}
+		if len(config.KVReplicationPrefixes) == 0 {
+			c.Ui.Error("KV replication requires at least one prefix")
+			return nil
+		}
+	}
+
 	// Only allow bootstrap mode when acting as a server
 	if config.Bootstrap && !config.Server {
 		c.Ui.Error("Bootstrap mode cannot be enabled when server mode is not enabled")
@@ -319,6 +343,7 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer, logWriter *log
 		return err
 	}
 	c.agent = agent
+	agent.metrics = c.metricsSink
 
 	// Setup the RPC listener
 	rpcAddr, err := config.ClientListener(config.Addresses.RPC, config.Ports.RPC)
@@ -604,10 +629,21 @@ func (c *Command) Run(args []string) int {
 		fanout = append(fanout, sink)
 	}
 
+	// Keep the metrics for Prometheus
+	if config.MetricsRetention > 0 {
+		c.metricsSink = newMetricsSink(config.MetricsRetention)
+	}
+
 	// Initialize the global sink
 	if len(fanout) > 0 {
 		fanout = append(fanout, inm)
+		if c.metricsSink != nil {
+			fanout = append(fanout, c.metricsSink)
+		}
 		metrics.NewGlobal(metricsConf, fanout)
+	} else if c.metricsSink != nil {
+		metricsConf.EnableHostname = false
+		metrics.NewGlobal(metricsConf, metrics.FanoutSink{inm, c.metricsSink})
 	} else {
 		metricsConf.EnableHostname = false
 		metrics.NewGlobal(metricsConf, inm)
@@ -661,7 +697,7 @@ func (c *Command) Run(args []string) int {
 		go func(wp *watch.WatchPlan) {
 			wp.Handler = makeWatchHandler(logOutput, wp.Exempt["handler"])
 			wp.LogOutput = c.logOutput
-			if err := wp.Run(httpAddr.String()); err != nil {
+			if err := wp.Run(httpClientAddr(httpAddr)); err != nil {
 				c.Ui.Error(fmt.Sprintf("Error running watch: %v", err))
 			}
 		}(wp)
@@ -709,6 +745,12 @@ func (c *Command) Run(args []string) int {
 	errWanCh := make(chan struct{})
 	go c.retryJoinWan(config, errWanCh)
 
+	// Poll the configuration files for changes
+	c.configChangeCh = make(chan struct{}, 1)
+	if config.ConfigReloadInterval > 0 && len(c.configPaths) > 0 {
+		go c.watchConfig(c.configPaths, config.ConfigReloadInterval, c.configChangeCh)
+	}
+
 	// Wait for exit
 	return c.handleSignals(config, errCh, errWanCh)
 }
@@ -726,6 +768,11 @@ WAIT:
 		sig = s
 	case <-c.rpcServer.ReloadCh():
 		sig = syscall.SIGHUP
+	case <-c.configChangeCh:
+		if conf := c.handleReload(config); conf != nil {
+			config = conf
+		}
+		goto WAIT
 	case <-c.ShutdownCh:
 		sig = os.Interrupt
 	case <-retryJoin:
@@ -832,6 +879,11 @@ func (c *Command) handleReload(config *Config) *Config {
 		return nil
 	}
 
+	// Reload the TLS certificates of the RPC connections
+	if err := c.agent.ReloadTLS(newConf); err != nil {
+		c.Ui.Error(fmt.Sprintf("Failed reloading TLS configuration: %s", err))
+	}
+
 	// Get the new client listener addr
 	httpAddr, err := newConf.ClientListener(config.Addresses.HTTP, config.Ports.HTTP)
 	if err != nil {
@@ -848,7 +900,7 @@ func (c *Command) handleReload(config *Config) *Config {
 		go func(wp *watch.WatchPlan) {
 			wp.Handler = makeWatchHandler(c.logOutput, wp.Exempt["handler"])
 			wp.LogOutput = c.logOutput
-			if err := wp.Run(httpAddr.String()); err != nil {
+			if err := wp.Run(httpClientAddr(httpAddr)); err != nil {
 				c.Ui.Error(fmt.Sprintf("Error running watch: %v", err))
 			}
 		}(wp)
@@ -58,8 +58,10 @@ type DNSConfig struct {
 	NodeTTLRaw string        `mapstructure:"node_ttl" json:"-"`
 
 	// ServiceTTL provides the TTL value for a service
-	// query for given service. The "*" wildcard can be used
-	// to set a default for all services.
+	// query for given service. A name ending with the "*"
+	// wildcard matches the services with that prefix, and
+	// the longest one applies. A lone "*" sets a default
+	// for all services.
 	ServiceTTL    map[string]time.Duration `mapstructure:"-"`
 	ServiceTTLRaw map[string]string        `mapstructure:"service_ttl" json:"-"`
 
@@ -76,6 +78,20 @@ type DNSConfig struct {
 	// returned by default for UDP.
 	EnableTruncate bool `mapstructure:"enable_truncate"`
 
+	// UDPAnswerLimit is the number of records returned in a UDP response
+	// to clients that don't advertise a larger buffer with EDNS0, to
+	// spread their load. It defaults to 3.
+	UDPAnswerLimit int `mapstructure:"udp_answer_limit"`
+
+	// MaxAnswers caps the number of instances returned by a service
+	// lookup over any transport, picked at random in proportion to their
+	// weights. Zero returns them all.
+	MaxAnswers int `mapstructure:"max_answers"`
+
+	// NodeMetaFilter restricts the answers of service lookups to the
+	// nodes with all these metadata, such as those of the same zone
+	NodeMetaFilter map[string]string `mapstructure:"node_meta"`
+
 	// MaxStale is used to bound how stale of a result is
 	// accepted for a DNS lookup. This can be used with
 	// AllowStale to limit how old of a value is served up.
@@ -84,6 +100,14 @@ type DNSConfig struct {
 	MaxStale    time.Duration `mapstructure:"-"`
 	MaxStaleRaw string        `mapstructure:"max_stale" json:"-"`
 
+	// RecursorTimeout bounds each attempt to resolve a name through a
+	// recursor, before trying the next one. RecursorDeadline bounds the
+	// attempts altogether. They default to 2 and 5 seconds.
+	RecursorTimeout     time.Duration `mapstructure:"-"`
+	RecursorTimeoutRaw  string        `mapstructure:"recursor_timeout" json:"-"`
+	RecursorDeadline    time.Duration `mapstructure:"-"`
+	RecursorDeadlineRaw string        `mapstructure:"recursor_deadline" json:"-"`
+
 	// OnlyPassing is used to determine whether to filter nodes
 	// whose health checks are in any non-passing state. By
 	// default, only nodes in a critical state are excluded.
@@ -184,6 +208,12 @@ type Config struct {
 	// metrics will be sent to that instance.
 	StatsdAddr string `mapstructure:"statsd_addr"`
 
+	// MetricsRetention is how long the agent keeps a metric in memory
+	// for /v1/agent/metrics after its last update. Zero disables the
+	// endpoint.
+	MetricsRetention    time.Duration `mapstructure:"-"`
+	MetricsRetentionRaw string        `mapstructure:"metrics_retention" json:"-"`
+
 	// Protocol is the Consul protocol version to use.
 	Protocol int `mapstructure:"protocol"`
 
@@ -208,6 +238,12 @@ type Config struct {
 	// existing clients.
 	VerifyServerHostname bool `mapstructure:"verify_server_hostname"`
 
+	// TLSMigrate makes the servers accept plaintext RPC connections even
+	// with VerifyIncoming set, while TLS connections must still present
+	// a verified certificate. It is used to move the clients to TLS one
+	// at a time, and is removed once they all use it.
+	TLSMigrate bool `mapstructure:"tls_migrate"`
+
 	// CAFile is a path to a certificate authority file. This is used with VerifyIncoming
 	// or VerifyOutgoing to verify the TLS connection.
 	CAFile string `mapstructure:"ca_file"`
@@ -220,6 +256,21 @@ type Config struct {
 	// Must be provided to serve TLS connections.
 	KeyFile string `mapstructure:"key_file"`
 
+	// AutoEncryptAllowTLS lets the servers sign the TLS certificates of
+	// the clients using auto-encrypt, with the CA of the first
+	// certificate of the CAFile and its key in CAKeyFile. The
+	// certificates expire after AutoEncryptCertTTL.
+	AutoEncryptAllowTLS   bool          `mapstructure:"auto_encrypt_allow_tls"`
+	CAKeyFile             string        `mapstructure:"ca_key_file"`
+	AutoEncryptCertTTL    time.Duration `mapstructure:"-"`
+	AutoEncryptCertTTLRaw string        `mapstructure:"auto_encrypt_cert_ttl" json:"-"`
+
+	// AutoEncryptTLS has a client obtain its TLS certificate from the
+	// servers, authenticating with the gossip encryption key or the
+	// one-time AutoEncryptToken
+	AutoEncryptTLS   bool   `mapstructure:"auto_encrypt_tls"`
+	AutoEncryptToken string `mapstructure:"auto_encrypt_token" json:"-"`
+
 	// ServerName is used with the TLS certificates to ensure the name we
 	// provide matches the certificate
 	ServerName string `mapstructure:"server_name"`
@@ -273,6 +324,16 @@ type Config struct {
 	// on linux and OSX. Other platforms will generate an error.
 	EnableSyslog bool `mapstructure:"enable_syslog"`
 
+	// AuditLog is the file the audit events of the mutating HTTP
+	// requests and RPC calls are written to, rotated once it reaches
+	// AuditLogMaxBytes and keeping AuditLogMaxFiles rotated files.
+	// AuditSyslog also sends them to syslog, with the SyslogFacility.
+	// Auditing is disabled unless either is set.
+	AuditLog         string `mapstructure:"audit_log"`
+	AuditLogMaxBytes int64  `mapstructure:"audit_log_max_bytes"`
+	AuditLogMaxFiles int    `mapstructure:"audit_log_max_files"`
+	AuditSyslog      bool   `mapstructure:"audit_syslog"`
+
 	// SyslogFacility is used to control where the syslog messages go
 	// By default, goes to LOCAL0
 	SyslogFacility string `mapstructure:"syslog_facility"`
@@ -291,6 +352,22 @@ type Config struct {
 	CheckUpdateInterval    time.Duration `mapstructure:"-"`
 	CheckUpdateIntervalRaw string        `mapstructure:"check_update_interval" json:"-"`
 
+	// ConfigReloadInterval is how often the configuration files and
+	// directories are polled for changes, which are applied like on a
+	// SIGHUP. Zero disables the polling.
+	ConfigReloadInterval    time.Duration `mapstructure:"-"`
+	ConfigReloadIntervalRaw string        `mapstructure:"config_reload_interval" json:"-"`
+
+	// CacheTTL is how long an entry of the agent cache is kept and
+	// refreshed without being read. Zero disables the cache, which
+	// serves the HTTP requests made with the cached parameter.
+	CacheTTL    time.Duration `mapstructure:"-"`
+	CacheTTLRaw string        `mapstructure:"cache_ttl" json:"-"`
+
+	// CacheMaxEntries bounds the number of entries of the agent cache,
+	// the least recently read are evicted first
+	CacheMaxEntries int `mapstructure:"cache_max_entries"`
+
 	// ACLToken is the default token used to make requests if a per-request
 	// token is not provided. If not configured the 'anonymous' token is used.
 	ACLToken string `mapstructure:"acl_token" json:"-"`
@@ -326,6 +403,20 @@ type Config struct {
 	//                    this acts like deny.
 	ACLDownPolicy string `mapstructure:"acl_down_policy"`
 
+	// ACLReplicationToken enables the replication of the ACLs of the
+	// ACLDatacenter to the servers of other datacenters, which use them
+	// when the ACLDatacenter can't be reached. It must be a management
+	// token, since it lists the ACLs.
+	ACLReplicationToken string `mapstructure:"acl_replication_token" json:"-"`
+
+	// KVReplicationSource is the datacenter whose KVReplicationPrefixes
+	// are mirrored into the local datacenter, using KVReplicationToken or
+	// else ACLToken. Every agent configured with it campaigns for a lock,
+	// and the agent holding it replicates.
+	KVReplicationSource   string   `mapstructure:"kv_replication_source"`
+	KVReplicationPrefixes []string `mapstructure:"kv_replication_prefixes"`
+	KVReplicationToken    string   `mapstructure:"kv_replication_token" json:"-"`
+
 	// Watches are used to monitor various endpoints and to invoke a
 	// handler to act appropriately. These are managed entirely in the
 	// agent layer using the standard APIs.
@@ -346,6 +437,18 @@ type Config struct {
 	// HTTPAPIResponseHeaders are used to add HTTP header response fields to the HTTP API responses.
 	HTTPAPIResponseHeaders map[string]string `mapstructure:"http_api_response_headers"`
 
+	// HTTPSVerifyIncoming requires the clients of the HTTPS API to present
+	// a certificate signed by the CAFile, without requiring TLS for the
+	// RPC connections as VerifyIncoming does
+	HTTPSVerifyIncoming bool `mapstructure:"https_verify_incoming"`
+
+	// HTTPSCertTokens maps the verified client certificates of the HTTPS
+	// API to ACL tokens, used by the requests without a ?token. The keys
+	// are "<field>:<value>" rules, with a field of cn, ou, dns or email,
+	// and a value that matches by prefix if it ends with "*". The most
+	// specific rule matching a certificate applies.
+	HTTPSCertTokens map[string]string `mapstructure:"https_cert_tokens" json:"-"`
+
 	// AtlasInfrastructure is the name of the infrastructure we belong to. e.g. hashicorp/stage
 	AtlasInfrastructure string `mapstructure:"atlas_infrastructure"`
 
@@ -399,6 +502,72 @@ type Config struct {
 	// Minimum Session TTL
 	SessionTTLMin    time.Duration `mapstructure:"-"`
 	SessionTTLMinRaw string        `mapstructure:"session_ttl_min"`
+
+	// SessionLimitPerNode caps the number of active sessions per node.
+	// Zero disables the limit.
+	SessionLimitPerNode int `mapstructure:"session_limit_per_node"`
+
+	// CheckOutputMaxSize is the number of bytes of output the servers
+	// keep for a health check. Zero disables the limit.
+	CheckOutputMaxSize int `mapstructure:"check_output_max_size"`
+
+	// LeaveDrainTime is how long a leaving server waits for its blocking
+	// queries to complete
+	LeaveDrainTime    time.Duration `mapstructure:"-"`
+	LeaveDrainTimeRaw string        `mapstructure:"leave_drain_time"`
+
+	// CatalogAuditLimit is the number of catalog changes retained in
+	// the audit table. Zero disables the audit table.
+	CatalogAuditLimit int `mapstructure:"catalog_audit_limit"`
+
+	// KVHistoryVersions is the number of prior versions of each KV entry
+	// the servers retain, so the entry can be read at an earlier index.
+	// Zero disables the history. KVHistoryTTL, if set, bounds how long
+	// a version is retained.
+	KVHistoryVersions int           `mapstructure:"kv_history_versions"`
+	KVHistoryTTL      time.Duration `mapstructure:"-"`
+	KVHistoryTTLRaw   string        `mapstructure:"kv_history_ttl" json:"-"`
+
+	// KVSNotifyLimits rate limits the notifications of the blocking
+	// queries watching KV prefixes, by prefix to the minimum interval
+	// between two notifications
+	KVSNotifyLimits    map[string]time.Duration `mapstructure:"-"`
+	KVSNotifyLimitsRaw map[string]string        `mapstructure:"kvs_notify_limits" json:"-"`
+
+	// OutboxSubscriptions route the committed changes of the KV entries
+	// under a prefix to a webhook. The leader delivers them until they
+	// are acknowledged.
+	OutboxSubscriptions []OutboxSubscriptionConfig `mapstructure:"outbox_subscriptions"`
+
+	// EventBridge converts the state changes seen by the leader into
+	// user events, so agents can react to them without polling
+	EventBridge []EventBridgeConfig `mapstructure:"event_bridge"`
+
+	// QueryCacheSize is the number of results of hot queries cached by
+	// the servers. Zero disables the cache.
+	QueryCacheSize int `mapstructure:"query_cache_size"`
+
+	// SlowQueryThreshold is the duration after which a state store query
+	// of the servers is logged as slow. Zero disables the log.
+	SlowQueryThreshold    time.Duration `mapstructure:"-"`
+	SlowQueryThresholdRaw string        `mapstructure:"slow_query_threshold" json:"-"`
+
+	// StateMaxSizeMB is the maximum size of the state store of the
+	// servers, in megabytes. Zero uses the default.
+	StateMaxSizeMB int `mapstructure:"state_max_size_mb"`
+
+	// MaxPageSize caps the number of entries returned by the paginated
+	// catalog and health queries of the servers. Zero disables the cap.
+	MaxPageSize int `mapstructure:"max_page_size"`
+
+	// RPCReadRate and RPCWriteRate limit the read and write RPC requests
+	// per second made to the servers from each source address and with
+	// each ACL token, with bursts of RPCReadBurst and RPCWriteBurst. Zero
+	// rates disable the limits.
+	RPCReadRate   float64 `mapstructure:"rpc_read_rate"`
+	RPCReadBurst  int     `mapstructure:"rpc_read_burst"`
+	RPCWriteRate  float64 `mapstructure:"rpc_write_rate"`
+	RPCWriteBurst int     `mapstructure:"rpc_write_burst"`
 }
 
 // UnixSocketPermissions contains information about a unix socket, and
@@ -421,12 +590,45 @@ func (u UnixSocketPermissions) Mode() string {
 	return u.Perms
 }
 
+// OutboxSubscriptionConfig is the configuration of an outbox
+// subscription. A positive MaxPending caps its undelivered entries,
+// dropping the oldest ones once it is reached. By default they are not
+// capped.
+type OutboxSubscriptionConfig struct {
+	Name       string `mapstructure:"name"`
+	Prefix     string `mapstructure:"prefix"`
+	URL        string `mapstructure:"url"`
+	MaxPending int    `mapstructure:"max_pending"`
+}
+
+// EventBridgeConfig is the configuration of an event bridge rule. Name
+// and Payload are templates of the fired user event, and RateLimit is
+// the minimum interval between two events of the rule.
+type EventBridgeConfig struct {
+	Type         string        `mapstructure:"type"`
+	Service      string        `mapstructure:"service"`
+	Prefix       string        `mapstructure:"prefix"`
+	Name         string        `mapstructure:"name"`
+	Payload      string        `mapstructure:"payload"`
+	RateLimit    time.Duration `mapstructure:"-"`
+	RateLimitRaw string        `mapstructure:"rate_limit" json:"-"`
+}
+
 // UnixSocketConfig stores information about various unix sockets which
 // Consul creates and uses for communication.
 type UnixSocketConfig struct {
 	UnixSocketPermissions `mapstructure:",squash"`
 }
 
+// httpClientAddr returns the address of a listener as the API clients
+// take it, prefixing domain sockets with unix://
+func httpClientAddr(addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return "unix://" + addr.String()
+	}
+	return addr.String()
+}
+
 // unixSocketAddr tests if a given address describes a domain socket,
 // and returns the relevant path part of the string if it is.
 func unixSocketAddr(addr string) (string, bool) {
@@ -462,9 +664,12 @@ func DefaultConfig() *Config {
 			MaxStale: 5 * time.Second,
 		},
 		StatsitePrefix:      "consul",
+		MetricsRetention:    time.Hour,
 		SyslogFacility:      "LOCAL0",
 		Protocol:            consul.ProtocolVersionMax,
 		CheckUpdateInterval: 5 * time.Minute,
+		CacheTTL:            10 * time.Minute,
+		CacheMaxEntries:     1024,
 		AEInterval:          time.Minute,
 		ACLTTL:              30 * time.Second,
 		ACLDownPolicy:       "extend-cache",
@@ -596,11 +801,30 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.DNSConfig.MaxStale = dur
 	}
 
+	if raw := result.DNSConfig.RecursorTimeoutRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("RecursorTimeout invalid: %v", err)
+		}
+		result.DNSConfig.RecursorTimeout = dur
+	}
+
+	if raw := result.DNSConfig.RecursorDeadlineRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("RecursorDeadline invalid: %v", err)
+		}
+		result.DNSConfig.RecursorDeadline = dur
+	}
+
 	if len(result.DNSConfig.ServiceTTLRaw) != 0 {
 		if result.DNSConfig.ServiceTTL == nil {
 			result.DNSConfig.ServiceTTL = make(map[string]time.Duration)
 		}
 		for service, raw := range result.DNSConfig.ServiceTTLRaw {
+			if i := strings.Index(service, "*"); i != -1 && i != len(service)-1 {
+				return nil, fmt.Errorf("ServiceTTL %s invalid: a wildcard must be last", service)
+			}
 			dur, err := time.ParseDuration(raw)
 			if err != nil {
 				return nil, fmt.Errorf("ServiceTTL %s invalid: %v", service, err)
@@ -646,6 +870,78 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.DNSRecursors = append(result.DNSRecursors, result.DNSRecursor)
 	}
 
+	if len(result.KVSNotifyLimitsRaw) != 0 {
+		if result.KVSNotifyLimits == nil {
+			result.KVSNotifyLimits = make(map[string]time.Duration)
+		}
+		for prefix, raw := range result.KVSNotifyLimitsRaw {
+			dur, err := time.ParseDuration(raw)
+			if err != nil {
+				return nil, fmt.Errorf("KVSNotifyLimits %s invalid: %v", prefix, err)
+			}
+			result.KVSNotifyLimits[prefix] = dur
+		}
+	}
+
+	if raw := result.ConfigReloadIntervalRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("ConfigReloadInterval invalid: %v", err)
+		}
+		result.ConfigReloadInterval = dur
+	}
+
+	if raw := result.AutoEncryptCertTTLRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("AutoEncryptCertTTL invalid: %v", err)
+		}
+		result.AutoEncryptCertTTL = dur
+	}
+
+	if raw := result.CacheTTLRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("CacheTTL invalid: %v", err)
+		}
+		result.CacheTTL = dur
+	}
+
+	if raw := result.MetricsRetentionRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("MetricsRetention invalid: %v", err)
+		}
+		result.MetricsRetention = dur
+	}
+
+	if raw := result.LeaveDrainTimeRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("LeaveDrainTime invalid: %v", err)
+		}
+		result.LeaveDrainTime = dur
+	}
+
+	if raw := result.KVHistoryTTLRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil || dur < 0 {
+			return nil, fmt.Errorf("KVHistoryTTL invalid: %v", raw)
+		}
+		result.KVHistoryTTL = dur
+	}
+
+	for i := range result.EventBridge {
+		rule := &result.EventBridge[i]
+		if raw := rule.RateLimitRaw; raw != "" {
+			dur, err := time.ParseDuration(raw)
+			if err != nil || dur < 0 {
+				return nil, fmt.Errorf("EventBridge rate limit invalid: %v", raw)
+			}
+			rule.RateLimit = dur
+		}
+	}
+
 	if raw := result.SessionTTLMinRaw; raw != "" {
 		dur, err := time.ParseDuration(raw)
 		if err != nil {
@@ -654,6 +950,14 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.SessionTTLMin = dur
 	}
 
+	if raw := result.SlowQueryThresholdRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil || dur < 0 {
+			return nil, fmt.Errorf("SlowQueryThreshold invalid: %v", raw)
+		}
+		result.SlowQueryThreshold = dur
+	}
+
 	if result.AdvertiseAddrs.SerfLanRaw != "" {
 		addr, err := net.ResolveTCPAddr("tcp", result.AdvertiseAddrs.SerfLanRaw)
 		if err != nil {
@@ -730,7 +1034,7 @@ AFTER_FIX:
 }
 
 func FixupCheckType(raw interface{}) error {
-	var ttlKey, intervalKey, timeoutKey string
+	var ttlKey, intervalKey, timeoutKey, deregisterKey string
 
 	// Handle decoding of time durations
 	rawMap, ok := raw.(map[string]interface{})
@@ -746,9 +1050,30 @@ func FixupCheckType(raw interface{}) error {
 			intervalKey = k
 		case "timeout":
 			timeoutKey = k
+		case "deregistercriticalserviceafter":
+			deregisterKey = k
+		case "deregister_critical_service_after":
+			deregisterKey = "deregistercriticalserviceafter"
+			rawMap[deregisterKey] = v
+			delete(rawMap, k)
 		case "service_id":
 			rawMap["serviceid"] = v
 			delete(rawMap, "service_id")
+		case "success_before_passing":
+			rawMap["successbeforepassing"] = v
+			delete(rawMap, k)
+		case "failures_before_critical":
+			rawMap["failuresbeforecritical"] = v
+			delete(rawMap, k)
+		case "tls_skip_verify":
+			rawMap["tlsskipverify"] = v
+			delete(rawMap, k)
+		case "expected_status":
+			rawMap["expectedstatus"] = v
+			delete(rawMap, k)
+		case "docker_container_id":
+			rawMap["dockercontainerid"] = v
+			delete(rawMap, k)
 		}
 	}
 
@@ -785,6 +1110,17 @@ func FixupCheckType(raw interface{}) error {
 		}
 	}
 
+	if deregister, ok := rawMap[deregisterKey]; ok {
+		deregisterS, ok := deregister.(string)
+		if ok {
+			if dur, err := time.ParseDuration(deregisterS); err != nil {
+				return err
+			} else {
+				rawMap[deregisterKey] = dur
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -889,6 +1225,9 @@ func MergeConfig(a, b *Config) *Config {
 	if b.StatsdAddr != "" {
 		result.StatsdAddr = b.StatsdAddr
 	}
+	if b.MetricsRetentionRaw != "" || b.MetricsRetention != 0 {
+		result.MetricsRetention = b.MetricsRetention
+	}
 	if b.EnableDebug {
 		result.EnableDebug = true
 	}
@@ -901,6 +1240,9 @@ func MergeConfig(a, b *Config) *Config {
 	if b.VerifyServerHostname {
 		result.VerifyServerHostname = true
 	}
+	if b.TLSMigrate {
+		result.TLSMigrate = true
+	}
 	if b.CAFile != "" {
 		result.CAFile = b.CAFile
 	}
@@ -910,6 +1252,21 @@ func MergeConfig(a, b *Config) *Config {
 	if b.KeyFile != "" {
 		result.KeyFile = b.KeyFile
 	}
+	if b.AutoEncryptAllowTLS {
+		result.AutoEncryptAllowTLS = true
+	}
+	if b.CAKeyFile != "" {
+		result.CAKeyFile = b.CAKeyFile
+	}
+	if b.AutoEncryptCertTTLRaw != "" || b.AutoEncryptCertTTL != 0 {
+		result.AutoEncryptCertTTL = b.AutoEncryptCertTTL
+	}
+	if b.AutoEncryptTLS {
+		result.AutoEncryptTLS = true
+	}
+	if b.AutoEncryptToken != "" {
+		result.AutoEncryptToken = b.AutoEncryptToken
+	}
 	if b.ServerName != "" {
 		result.ServerName = b.ServerName
 	}
@@ -993,15 +1350,56 @@ func MergeConfig(a, b *Config) *Config {
 	if b.DNSConfig.EnableTruncate {
 		result.DNSConfig.EnableTruncate = true
 	}
+	if b.DNSConfig.UDPAnswerLimit != 0 {
+		result.DNSConfig.UDPAnswerLimit = b.DNSConfig.UDPAnswerLimit
+	}
+	if b.DNSConfig.MaxAnswers != 0 {
+		result.DNSConfig.MaxAnswers = b.DNSConfig.MaxAnswers
+	}
+	if len(b.DNSConfig.NodeMetaFilter) != 0 {
+		if result.DNSConfig.NodeMetaFilter == nil {
+			result.DNSConfig.NodeMetaFilter = make(map[string]string)
+		}
+		for k, v := range b.DNSConfig.NodeMetaFilter {
+			result.DNSConfig.NodeMetaFilter[k] = v
+		}
+	}
 	if b.DNSConfig.MaxStale != 0 {
 		result.DNSConfig.MaxStale = b.DNSConfig.MaxStale
 	}
+	if b.DNSConfig.RecursorTimeout != 0 {
+		result.DNSConfig.RecursorTimeout = b.DNSConfig.RecursorTimeout
+	}
+	if b.DNSConfig.RecursorDeadline != 0 {
+		result.DNSConfig.RecursorDeadline = b.DNSConfig.RecursorDeadline
+	}
 	if b.DNSConfig.OnlyPassing {
 		result.DNSConfig.OnlyPassing = true
 	}
 	if b.CheckUpdateIntervalRaw != "" || b.CheckUpdateInterval != 0 {
 		result.CheckUpdateInterval = b.CheckUpdateInterval
 	}
+	if b.ConfigReloadIntervalRaw != "" || b.ConfigReloadInterval != 0 {
+		result.ConfigReloadInterval = b.ConfigReloadInterval
+	}
+	if b.CacheTTLRaw != "" || b.CacheTTL != 0 {
+		result.CacheTTL = b.CacheTTL
+	}
+	if b.CacheMaxEntries != 0 {
+		result.CacheMaxEntries = b.CacheMaxEntries
+	}
+	if b.AuditLog != "" {
+		result.AuditLog = b.AuditLog
+	}
+	if b.AuditLogMaxBytes != 0 {
+		result.AuditLogMaxBytes = b.AuditLogMaxBytes
+	}
+	if b.AuditLogMaxFiles != 0 {
+		result.AuditLogMaxFiles = b.AuditLogMaxFiles
+	}
+	if b.AuditSyslog {
+		result.AuditSyslog = true
+	}
 	if b.SyslogFacility != "" {
 		result.SyslogFacility = b.SyslogFacility
 	}
@@ -1024,6 +1422,15 @@ func MergeConfig(a, b *Config) *Config {
 	if b.ACLDefaultPolicy != "" {
 		result.ACLDefaultPolicy = b.ACLDefaultPolicy
 	}
+	if b.ACLReplicationToken != "" {
+		result.ACLReplicationToken = b.ACLReplicationToken
+	}
+	if b.KVReplicationSource != "" {
+		result.KVReplicationSource = b.KVReplicationSource
+	}
+	if b.KVReplicationToken != "" {
+		result.KVReplicationToken = b.KVReplicationToken
+	}
 	if len(b.Watches) != 0 {
 		result.Watches = append(result.Watches, b.Watches...)
 	}
@@ -1067,6 +1474,76 @@ func MergeConfig(a, b *Config) *Config {
 		result.SessionTTLMin = b.SessionTTLMin
 		result.SessionTTLMinRaw = b.SessionTTLMinRaw
 	}
+	if b.SlowQueryThresholdRaw != "" {
+		result.SlowQueryThreshold = b.SlowQueryThreshold
+		result.SlowQueryThresholdRaw = b.SlowQueryThresholdRaw
+	}
+	if b.SessionLimitPerNode != 0 {
+		result.SessionLimitPerNode = b.SessionLimitPerNode
+	}
+	if b.CheckOutputMaxSize != 0 {
+		result.CheckOutputMaxSize = b.CheckOutputMaxSize
+	}
+	if b.LeaveDrainTimeRaw != "" {
+		result.LeaveDrainTime = b.LeaveDrainTime
+		result.LeaveDrainTimeRaw = b.LeaveDrainTimeRaw
+	}
+	if b.CatalogAuditLimit != 0 {
+		result.CatalogAuditLimit = b.CatalogAuditLimit
+	}
+	if b.KVHistoryVersions != 0 {
+		result.KVHistoryVersions = b.KVHistoryVersions
+	}
+	if b.KVHistoryTTLRaw != "" {
+		result.KVHistoryTTL = b.KVHistoryTTL
+		result.KVHistoryTTLRaw = b.KVHistoryTTLRaw
+	}
+	if len(b.EventBridge) != 0 {
+		result.EventBridge = append(result.EventBridge, b.EventBridge...)
+	}
+	if len(b.OutboxSubscriptions) != 0 {
+		result.OutboxSubscriptions = append(result.OutboxSubscriptions, b.OutboxSubscriptions...)
+	}
+	if b.QueryCacheSize != 0 {
+		result.QueryCacheSize = b.QueryCacheSize
+	}
+	if len(b.KVSNotifyLimits) != 0 {
+		if result.KVSNotifyLimits == nil {
+			result.KVSNotifyLimits = make(map[string]time.Duration)
+		}
+		for prefix, dur := range b.KVSNotifyLimits {
+			result.KVSNotifyLimits[prefix] = dur
+		}
+	}
+	if b.StateMaxSizeMB != 0 {
+		result.StateMaxSizeMB = b.StateMaxSizeMB
+	}
+	if b.MaxPageSize != 0 {
+		result.MaxPageSize = b.MaxPageSize
+	}
+	if b.RPCReadRate != 0 {
+		result.RPCReadRate = b.RPCReadRate
+	}
+	if b.RPCReadBurst != 0 {
+		result.RPCReadBurst = b.RPCReadBurst
+	}
+	if b.RPCWriteRate != 0 {
+		result.RPCWriteRate = b.RPCWriteRate
+	}
+	if b.RPCWriteBurst != 0 {
+		result.RPCWriteBurst = b.RPCWriteBurst
+	}
+	if b.HTTPSVerifyIncoming {
+		result.HTTPSVerifyIncoming = true
+	}
+	if len(b.HTTPSCertTokens) != 0 {
+		if result.HTTPSCertTokens == nil {
+			result.HTTPSCertTokens = make(map[string]string)
+		}
+		for rule, token := range b.HTTPSCertTokens {
+			result.HTTPSCertTokens[rule] = token
+		}
+	}
 	if len(b.HTTPAPIResponseHeaders) != 0 {
 		if result.HTTPAPIResponseHeaders == nil {
 			result.HTTPAPIResponseHeaders = make(map[string]string)
@@ -1096,6 +1573,11 @@ func MergeConfig(a, b *Config) *Config {
 	result.RetryJoinWan = append(result.RetryJoinWan, a.RetryJoinWan...)
 	result.RetryJoinWan = append(result.RetryJoinWan, b.RetryJoinWan...)
 
+	// Copy the replicated KV prefixes
+	result.KVReplicationPrefixes = make([]string, 0, len(a.KVReplicationPrefixes)+len(b.KVReplicationPrefixes))
+	result.KVReplicationPrefixes = append(result.KVReplicationPrefixes, a.KVReplicationPrefixes...)
+	result.KVReplicationPrefixes = append(result.KVReplicationPrefixes, b.KVReplicationPrefixes...)
+
 	return &result
 }
 
@@ -11,6 +11,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
 )
 
 func TestConfigEncryptBytes(t *testing.T) {
@@ -303,6 +305,39 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// TLS migration
+	input = `{"verify_incoming": true, "tls_migrate": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.TLSMigrate {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Auto-encrypt
+	input = `{"auto_encrypt_allow_tls": true, "ca_key_file": "ca.key", "auto_encrypt_cert_ttl": "24h"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.AutoEncryptAllowTLS || config.CAKeyFile != "ca.key" ||
+		config.AutoEncryptCertTTL != 24*time.Hour {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	input = `{"auto_encrypt_tls": true, "auto_encrypt_token": "abcd"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.AutoEncryptTLS || config.AutoEncryptToken != "abcd" {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// TLS keys
 	input = `{"ca_file": "my/ca/file", "cert_file": "my.cert", "key_file": "key.pem", "server_name": "example.com"}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -522,6 +557,57 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// DNS node meta filter
+	input = `{"dns_config": {"node_meta": {"zone": "us-east-1a"}}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.DNSConfig.NodeMetaFilter["zone"] != "us-east-1a" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// DNS max answers
+	input = `{"dns_config": {"max_answers": 4}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.DNSConfig.MaxAnswers != 4 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// DNS service TTL patterns
+	input = `{"dns_config": {"service_ttl": {"db-*": "10s"}}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.DNSConfig.ServiceTTL["db-*"] != 10*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	input = `{"dns_config": {"service_ttl": {"db-*-west": "10s"}}}`
+	_, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err == nil || !strings.Contains(err.Error(), "wildcard must be last") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// DNS recursor timeouts
+	input = `{"dns_config": {"recursor_timeout": "1s", "recursor_deadline": "3s"}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.DNSConfig.RecursorTimeout != time.Second ||
+		config.DNSConfig.RecursorDeadline != 3*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// DNS enable truncate
 	input = `{"dns_config": {"enable_truncate": true}}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -533,6 +619,17 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// DNS UDP answer limit
+	input = `{"dns_config": {"udp_answer_limit": 10}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.DNSConfig.UDPAnswerLimit != 10 {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// DNS only passing
 	input = `{"dns_config": {"only_passing": true}}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -555,10 +652,53 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// ConfigReloadInterval
+	input = `{"config_reload_interval": "5s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.ConfigReloadInterval != 5*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Cache
+	input = `{"cache_ttl": "1h", "cache_max_entries": 100}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.CacheTTL != time.Hour || config.CacheMaxEntries != 100 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	input = `{"leave_drain_time": "30s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.LeaveDrainTime != 30*time.Second || config.LeaveDrainTimeRaw != "30s" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	input = `{"metrics_retention": "10m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.MetricsRetention != 10*time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// ACLs
 	input = `{"acl_token": "1234", "acl_datacenter": "dc2",
 	"acl_ttl": "60s", "acl_down_policy": "deny",
-	"acl_default_policy": "deny", "acl_master_token": "2345"}`
+	"acl_default_policy": "deny", "acl_master_token": "2345",
+	"acl_replication_token": "3456"}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
 	if err != nil {
 		t.Fatalf("err: %s", err)
@@ -570,6 +710,9 @@ func TestDecodeConfig(t *testing.T) {
 	if config.ACLMasterToken != "2345" {
 		t.Fatalf("bad: %#v", config)
 	}
+	if config.ACLReplicationToken != "3456" {
+		t.Fatalf("bad: %#v", config)
+	}
 	if config.ACLDatacenter != "dc2" {
 		t.Fatalf("bad: %#v", config)
 	}
@@ -583,6 +726,23 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// KV replication
+	input = `{"kv_replication_source": "dc1", "kv_replication_prefixes": ["global/", "shared/"],
+	"kv_replication_token": "1234"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if config.KVReplicationSource != "dc1" {
+		t.Fatalf("bad: %#v", config)
+	}
+	if !reflect.DeepEqual(config.KVReplicationPrefixes, []string{"global/", "shared/"}) {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.KVReplicationToken != "1234" {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// Watches
 	input = `{"watches": [{"type":"keyprefix", "prefix":"foo/", "handler":"foobar"}]}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -705,6 +865,29 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// Audit log
+	input = `{"audit_log": "/var/log/consul/audit.log", "audit_log_max_bytes": 1024, "audit_log_max_files": 3, "audit_syslog": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.AuditLog != "/var/log/consul/audit.log" || config.AuditLogMaxBytes != 1024 ||
+		config.AuditLogMaxFiles != 3 || !config.AuditSyslog {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// HTTPS client certificates
+	input = `{"https_verify_incoming": true, "https_cert_tokens": {"cn:web-*": "secret"}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !config.HTTPSVerifyIncoming || config.HTTPSCertTokens["cn:web-*"] != "secret" {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// Atlas configs
 	input = `{
 		"atlas_infrastructure": "hashicorp/prod",
@@ -744,6 +927,155 @@ func TestDecodeConfig(t *testing.T) {
 	if config.SessionTTLMin != 5*time.Second {
 		t.Fatalf("bad: %s %#v", config.SessionTTLMin.String(), config)
 	}
+
+	// SessionLimitPerNode
+	input = `{"session_limit_per_node": 100}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.SessionLimitPerNode != 100 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// CheckOutputMaxSize
+	input = `{"check_output_max_size": 4096}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.CheckOutputMaxSize != 4096 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// CatalogAuditLimit
+	input = `{"catalog_audit_limit": 1000}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.CatalogAuditLimit != 1000 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// SlowQueryThreshold
+	input = `{"slow_query_threshold": "250ms"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.SlowQueryThreshold != 250*time.Millisecond {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// KVHistory
+	input = `{"kv_history_versions": 5, "kv_history_ttl": "1h"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.KVHistoryVersions != 5 || config.KVHistoryTTL != time.Hour {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// EventBridge
+	input = `{"event_bridge": [{"type": "service-critical", "service": "web", "name": "web-down", "payload": "{{.Node}}", "rate_limit": "10s"}, {"type": "key-changed", "prefix": "deploy/", "name": "deploy"}]}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expectRules := []EventBridgeConfig{
+		{Type: "service-critical", Service: "web", Name: "web-down", Payload: "{{.Node}}",
+			RateLimit: 10 * time.Second, RateLimitRaw: "10s"},
+		{Type: "key-changed", Prefix: "deploy/", Name: "deploy"},
+	}
+	if !reflect.DeepEqual(config.EventBridge, expectRules) {
+		t.Fatalf("bad: %#v", config.EventBridge)
+	}
+
+	input = `{"event_bridge": [{"type": "key-changed", "name": "deploy", "rate_limit": "soon"}]}`
+	if _, err = DecodeConfig(bytes.NewReader([]byte(input))); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// OutboxSubscriptions
+	input = `{"outbox_subscriptions": [{"name": "deploy", "prefix": "deploy/", "url": "http://127.0.0.1/hook", "max_pending": 100}]}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expectSubs := []OutboxSubscriptionConfig{
+		{Name: "deploy", Prefix: "deploy/", URL: "http://127.0.0.1/hook", MaxPending: 100},
+	}
+	if !reflect.DeepEqual(config.OutboxSubscriptions, expectSubs) {
+		t.Fatalf("bad: %#v", config.OutboxSubscriptions)
+	}
+
+	// QueryCacheSize
+	input = `{"query_cache_size": 512}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.QueryCacheSize != 512 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// MaxPageSize
+	input = `{"max_page_size": 1000}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.MaxPageSize != 1000 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// RPC rate limits
+	input = `{"rpc_read_rate": 100.5, "rpc_read_burst": 200, "rpc_write_rate": 10, "rpc_write_burst": 20}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.RPCReadRate != 100.5 || config.RPCReadBurst != 200 ||
+		config.RPCWriteRate != 10 || config.RPCWriteBurst != 20 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// KVSNotifyLimits
+	input = `{"kvs_notify_limits": {"hot/": "1s", "metrics/": "250ms"}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.KVSNotifyLimits["hot/"] != time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.KVSNotifyLimits["metrics/"] != 250*time.Millisecond {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// StateMaxSizeMB
+	input = `{"state_max_size_mb": 65536}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if config.StateMaxSizeMB != 65536 {
+		t.Fatalf("bad: %#v", config)
+	}
 }
 
 func TestDecodeConfig_invalidKeys(t *testing.T) {
@@ -853,9 +1185,10 @@ func TestDecodeConfig_Services(t *testing.T) {
 			},
 			&ServiceDefinition{
 				Check: CheckType{
-					HTTP:     "http://localhost:9200/_cluster_health",
-					Interval: 10 * time.Second,
-					Timeout:  100 * time.Millisecond,
+					HTTP:                           "http://localhost:9200/_cluster_health",
+					Interval:                       10 * time.Second,
+					Timeout:                        100 * time.Millisecond,
+					DeregisterCriticalServiceAfter: 90 * time.Minute,
 				},
 				ID:   "es0",
 				Name: "elasticsearch",
@@ -897,7 +1230,44 @@ func TestDecodeConfig_Checks(t *testing.T) {
 				"HTTP": "http://localhost:9200/_cluster_health",
 				"interval": "10s",
 				"timeout": "100ms",
-				"service_id": "elasticsearch"
+				"service_id": "elasticsearch",
+				"deregister_critical_service_after": "90m",
+				"success_before_passing": 2,
+				"failures_before_critical": 3
+			},
+			{
+				"id": "chk5",
+				"name": "service:ldap:tls",
+				"tcp": "localhost:636",
+				"interval": "30s",
+				"tls": true,
+				"tls_skip_verify": true
+			},
+			{
+				"id": "chk6",
+				"name": "dns",
+				"udp": "localhost:53",
+				"interval": "10s",
+				"timeout": "1s"
+			},
+			{
+				"id": "chk7",
+				"name": "api",
+				"http": "https://localhost:8443/health",
+				"method": "POST",
+				"header": {"X-Token": ["secret"]},
+				"body": "{}",
+				"expected_status": ["200-299", "304"],
+				"tls_skip_verify": true,
+				"interval": "10s"
+			},
+			{
+				"id": "chk8",
+				"name": "web",
+				"docker_container_id": "f972c95ebf0e",
+				"shell": "/bin/bash",
+				"script": "/health.sh",
+				"interval": "10s"
 			}
 		]
 	}`
@@ -939,9 +1309,54 @@ func TestDecodeConfig_Checks(t *testing.T) {
 				Name:      "service:elasticsearch:health",
 				ServiceID: "elasticsearch",
 				CheckType: CheckType{
-					HTTP:     "http://localhost:9200/_cluster_health",
+					HTTP:                           "http://localhost:9200/_cluster_health",
+					Interval:                       10 * time.Second,
+					Timeout:                        100 * time.Millisecond,
+					DeregisterCriticalServiceAfter: 90 * time.Minute,
+					SuccessBeforePassing:           2,
+					FailuresBeforeCritical:         3,
+				},
+			},
+			&CheckDefinition{
+				ID:   "chk5",
+				Name: "service:ldap:tls",
+				CheckType: CheckType{
+					TCP:           "localhost:636",
+					Interval:      30 * time.Second,
+					TLS:           true,
+					TLSSkipVerify: true,
+				},
+			},
+			&CheckDefinition{
+				ID:   "chk6",
+				Name: "dns",
+				CheckType: CheckType{
+					UDP:      "localhost:53",
 					Interval: 10 * time.Second,
-					Timeout:  100 * time.Millisecond,
+					Timeout:  time.Second,
+				},
+			},
+			&CheckDefinition{
+				ID:   "chk7",
+				Name: "api",
+				CheckType: CheckType{
+					HTTP:           "https://localhost:8443/health",
+					Method:         "POST",
+					Header:         map[string][]string{"X-Token": []string{"secret"}},
+					Body:           "{}",
+					ExpectedStatus: []string{"200-299", "304"},
+					TLSSkipVerify:  true,
+					Interval:       10 * time.Second,
+				},
+			},
+			&CheckDefinition{
+				ID:   "chk8",
+				Name: "web",
+				CheckType: CheckType{
+					DockerContainerID: "f972c95ebf0e",
+					Shell:             "/bin/bash",
+					Script:            "/health.sh",
+					Interval:          10 * time.Second,
 				},
 			},
 		},
@@ -1059,6 +1474,34 @@ func TestDecodeConfig_Service(t *testing.T) {
 	}
 }
 
+func TestDecodeConfig_ServiceProxy(t *testing.T) {
+	input := `{"service": {"name": "web-proxy", "port": 21000, "kind": "connect-proxy",
+		"proxy": {"destinationServiceName": "web", "localServicePort": 8080,
+			"upstreams": [{"destinationName": "db", "datacenter": "dc2", "localBindPort": 9191}]}}}`
+	config, err := DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(config.Services) != 1 {
+		t.Fatalf("missing service")
+	}
+
+	expected := structs.ConnectProxyConfig{
+		DestinationServiceName: "web",
+		LocalServicePort:       8080,
+		Upstreams: []structs.Upstream{
+			{DestinationName: "db", Datacenter: "dc2", LocalBindPort: 9191},
+		},
+	}
+	ns := config.Services[0].NodeService()
+	if ns.Kind != structs.ServiceKindConnectProxy || !reflect.DeepEqual(ns.Proxy, expected) {
+		t.Fatalf("bad: %#v", ns)
+	}
+	if err := ns.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestDecodeConfig_Check(t *testing.T) {
 	// Basics
 	input := `{"check": {"id": "chk1", "name": "mem", "notes": "foobar", "script": "/bin/check_redis", "interval": "10s", "ttl": "15s" }}`
@@ -1129,9 +1572,14 @@ func TestMergeConfig(t *testing.T) {
 			ServiceTTL: map[string]time.Duration{
 				"api": 10 * time.Second,
 			},
-			AllowStale:     true,
-			MaxStale:       30 * time.Second,
-			EnableTruncate: true,
+			AllowStale:       true,
+			MaxStale:         30 * time.Second,
+			EnableTruncate:   true,
+			UDPAnswerLimit:   10,
+			MaxAnswers:       4,
+			NodeMetaFilter:   map[string]string{"zone": "a"},
+			RecursorTimeout:  time.Second,
+			RecursorDeadline: 3 * time.Second,
 		},
 		Domain:           "other",
 		LogLevel:         "info",
@@ -1181,6 +1629,10 @@ func TestMergeConfig(t *testing.T) {
 		CheckUpdateIntervalRaw: "8m",
 		ACLToken:               "1234",
 		ACLMasterToken:         "2345",
+		ACLReplicationToken:    "3456",
+		KVReplicationSource:    "dc1",
+		KVReplicationPrefixes:  []string{"global/"},
+		KVReplicationToken:     "4567",
 		ACLDatacenter:          "dc2",
 		ACLTTL:                 15 * time.Second,
 		ACLTTLRaw:              "15s",
@@ -1209,12 +1661,14 @@ func TestMergeConfig(t *testing.T) {
 				Perms: "0700",
 			},
 		},
-		AtlasInfrastructure: "hashicorp/prod",
-		AtlasToken:          "123456789",
-		AtlasACLToken:       "abcdefgh",
-		AtlasJoin:           true,
-		SessionTTLMinRaw:    "1000s",
-		SessionTTLMin:       1000 * time.Second,
+		AtlasInfrastructure:   "hashicorp/prod",
+		AtlasToken:            "123456789",
+		AtlasACLToken:         "abcdefgh",
+		AtlasJoin:             true,
+		SessionTTLMinRaw:      "1000s",
+		SessionTTLMin:         1000 * time.Second,
+		SlowQueryThresholdRaw: "1s",
+		SlowQueryThreshold:    time.Second,
 		AdvertiseAddrs: AdvertiseAddrsConfig{
 			SerfLan:    &net.TCPAddr{},
 			SerfLanRaw: "127.0.0.5:1231",
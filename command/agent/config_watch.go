@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configFingerprint summarizes the configuration files read from the
+// given paths by their names, sizes and modification times, so polling
+// can tell when a file was added, removed or changed. It follows the
+// rules of ReadConfigPaths: directories aren't read recursively and
+// only their JSON files are considered.
+func configFingerprint(paths []string) (string, error) {
+	var parts []string
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			parts = append(parts, fileFingerprint(path, fi))
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		contents, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		sort.Sort(dirEnts(contents))
+		for _, fi := range contents {
+			if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+				continue
+			}
+			parts = append(parts, fileFingerprint(filepath.Join(path, fi.Name()), fi))
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// fileFingerprint summarizes a single configuration file
+func fileFingerprint(path string, fi os.FileInfo) string {
+	return fmt.Sprintf("%s %d %d", path, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// watchConfig polls the configuration paths until the agent shuts down,
+// and notifies changeCh when they change. A change that fails to decode,
+// such as a file being written, is retried once the file changes again.
+func (c *Command) watchConfig(paths []string, interval time.Duration, changeCh chan<- struct{}) {
+	last, err := configFingerprint(paths)
+	if err != nil {
+		c.agent.logger.Printf("[WARN] agent: failed to read the configuration paths: %v", err)
+	}
+	for {
+		select {
+		case <-time.After(interval):
+		case <-c.agent.ShutdownCh():
+			return
+		}
+
+		current, err := configFingerprint(paths)
+		if err != nil {
+			c.agent.logger.Printf("[WARN] agent: failed to read the configuration paths: %v", err)
+			continue
+		}
+		if current == last {
+			continue
+		}
+		last = current
+
+		c.agent.logger.Printf("[INFO] agent: configuration files changed, reloading")
+		select {
+		case changeCh <- struct{}{}:
+		default:
+		}
+	}
+}
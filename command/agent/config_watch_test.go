@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigFingerprint(t *testing.T) {
+	td, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(td, name), []byte(content), 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	fingerprint := func() string {
+		fp, err := configFingerprint([]string{td})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return fp
+	}
+
+	write("web.json", `{"service": {"name": "web"}}`)
+	base := fingerprint()
+	if base != fingerprint() {
+		t.Fatalf("should be stable")
+	}
+
+	// Files that aren't read don't matter
+	write("notes.txt", "hello")
+	if err := os.Mkdir(filepath.Join(td, "sub"), 0700); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fp := fingerprint(); fp != base {
+		t.Fatalf("bad: %v", fp)
+	}
+
+	// Adding, changing and removing definitions do
+	write("db.json", `{"service": {"name": "db"}}`)
+	added := fingerprint()
+	if added == base {
+		t.Fatalf("should change")
+	}
+	write("db.json", `{"service": {"name": "db", "port": 5432}}`)
+	changed := fingerprint()
+	if changed == added {
+		t.Fatalf("should change")
+	}
+	if err := os.Remove(filepath.Join(td, "db.json")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fp := fingerprint(); fp != base {
+		t.Fatalf("bad: %v", fp)
+	}
+
+	// A missing path is an error
+	if _, err := configFingerprint([]string{filepath.Join(td, "nope")}); err == nil {
+		t.Fatalf("should fail")
+	}
+}
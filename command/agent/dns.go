@@ -4,19 +4,31 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/miekg/dns"
 )
 
 const (
-	maxServiceResponses = 3 // For UDP only
+	maxServiceResponses = 3 // Default UDP answer limit
 	maxRecurseRecords   = 5
+
+	// defaultRecursorTimeout bounds each attempt through a recursor, and
+	// defaultRecursorDeadline all of them, unless configured
+	defaultRecursorTimeout  = 2 * time.Second
+	defaultRecursorDeadline = 5 * time.Second
+
+	// ednsOPTLen is the length of the OPT record of an EDNS0 response,
+	// which has the root name and no options
+	ednsOPTLen = 11
 )
 
 // DNSServer is used to wrap an Agent and expose various
@@ -140,6 +152,12 @@ func NewDNSServer(agent *Agent, config *DNSConfig, logOutput io.Writer, domain s
 
 // recursorAddr is used to add a port to the recursor if omitted.
 func recursorAddr(recursor string) (string, error) {
+	// Add the port to a bare IPv6 address, which SplitHostPort can't
+	// tell apart from a host:port pair
+	if ip := net.ParseIP(recursor); ip != nil {
+		recursor = net.JoinHostPort(recursor, "53")
+	}
+
 	// Add the port if none
 START:
 	_, _, err := net.SplitHostPort(recursor)
@@ -183,31 +201,23 @@ func (d *DNSServer) handlePtr(resp dns.ResponseWriter, req *dns.Msg) {
 
 	datacenter := d.agent.config.Datacenter
 
-	// Get the QName without the domain suffix
-	qName := strings.ToLower(dns.Fqdn(req.Question[0].Name))
-
-	args := structs.DCSpecificRequest{
-		Datacenter: datacenter,
-		QueryOptions: structs.QueryOptions{
-			Token:      d.agent.config.ACLToken,
-			AllowStale: d.config.AllowStale,
-		},
-	}
-	var out structs.IndexedNodes
-
-	// TODO: Replace ListNodes with an internal RPC that can do the filter
-	// server side to avoid transferring the entire node list.
-	if err := d.agent.RPC("Catalog.ListNodes", &args, &out); err == nil {
+	// Only the names of complete addresses are looked up
+	if ip := reverseAddrIP(req.Question[0].Name); ip != nil {
+		args := structs.AddressSpecificRequest{
+			Datacenter: datacenter,
+			Address:    ip.String(),
+		}
+		var out structs.IndexedNodes
+		if err := d.lookupRPC("Catalog.NodesByAddress", &args, &args.QueryOptions,
+			&out, &out.QueryMeta); err != nil {
+			d.logger.Printf("[ERR] dns: rpc error: %v", err)
+		}
 		for _, n := range out.Nodes {
-			arpa, _ := dns.ReverseAddr(n.Address)
-			if arpa == qName {
-				ptr := &dns.PTR{
-					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0},
-					Ptr: fmt.Sprintf("%s.node.%s.%s", n.Node, datacenter, d.domain),
-				}
-				m.Answer = append(m.Answer, ptr)
-				break
+			ptr := &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0},
+				Ptr: fmt.Sprintf("%s.node.%s.%s", n.Node, datacenter, d.domain),
 			}
+			m.Answer = append(m.Answer, ptr)
 		}
 	}
 
@@ -223,6 +233,41 @@ func (d *DNSServer) handlePtr(resp dns.ResponseWriter, req *dns.Msg) {
 	}
 }
 
+// reverseAddrIP returns the IP address of an in-addr.arpa or ip6.arpa
+// name, or nil if it doesn't name a complete address
+func reverseAddrIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		var buf []byte
+		for i := len(labels) - 1; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			buf = append(buf, labels[i][0])
+			if i > 0 && i%4 == 0 {
+				buf = append(buf, ':')
+			}
+		}
+		return net.ParseIP(string(buf))
+	}
+	return nil
+}
+
 // handleQuery is used to handle DNS queries in the configured domain
 func (d *DNSServer) handleQuery(resp dns.ResponseWriter, req *dns.Msg) {
 	q := req.Question[0]
@@ -252,12 +297,47 @@ func (d *DNSServer) handleQuery(resp dns.ResponseWriter, req *dns.Msg) {
 	// Dispatch the correct handler
 	d.dispatch(network, req, m)
 
+	// Fit UDP responses in the buffer of the client
+	if network == "udp" {
+		d.trimUDPResponse(req, m)
+	}
+
 	// Write out the complete response
 	if err := resp.WriteMsg(m); err != nil {
 		d.logger.Printf("[WARN] dns: failed to respond: %v", err)
 	}
 }
 
+// trimUDPResponse drops the records that don't fit the UDP buffer size
+// advertised by the client with EDNS0, or 512 bytes without it. The
+// additional records go first, and dropping answers sets the truncated
+// flag so the client retries over TCP rather than silently missing them.
+func (d *DNSServer) trimUDPResponse(req, resp *dns.Msg) {
+	size := dns.MinMsgSize
+	edns := req.IsEdns0()
+	if edns != nil {
+		if s := int(edns.UDPSize()); s > size {
+			size = s
+		}
+		size -= ednsOPTLen
+	}
+
+	for resp.Len() > size {
+		if n := len(resp.Extra); n > 0 {
+			resp.Extra = resp.Extra[:n-1]
+		} else if n := len(resp.Answer); n > 0 {
+			resp.Answer = resp.Answer[:n-1]
+			resp.Truncated = true
+		} else {
+			break
+		}
+	}
+
+	if edns != nil {
+		resp.SetEdns0(uint16(size+ednsOPTLen), false)
+	}
+}
+
 // addSOA is used to add an SOA record to a message for the given domain
 func (d *DNSServer) addSOA(domain string, msg *dns.Msg) {
 	soa := &dns.SOA{
@@ -350,6 +430,35 @@ INVALID:
 	resp.SetRcode(req, dns.RcodeNameError)
 }
 
+// lookupRPC makes the RPC of a lookup with the token of the agent. With
+// stale lookups allowed, it is served by whichever server the agent
+// talks to, sparing the leader. A result that is staler than the max
+// staleness is requested again from the leader.
+func (d *DNSServer) lookupRPC(method string, args interface{}, opts *structs.QueryOptions,
+	reply interface{}, meta *structs.QueryMeta) error {
+	opts.Token = d.agent.config.ACLToken
+	opts.AllowStale = d.config.AllowStale
+	for {
+		if err := d.agent.RPC(method, args, reply); err != nil {
+			return err
+		}
+		if !opts.AllowStale {
+			metrics.IncrCounter([]string{"consul", "dns", "consistent_lookup"}, 1)
+			return nil
+		}
+		if meta.LastContact <= d.config.MaxStale {
+			metrics.IncrCounter([]string{"consul", "dns", "stale_lookup"}, 1)
+			return nil
+		}
+
+		// Verify that request is not too stale, redo the request
+		opts.AllowStale = false
+		metrics.IncrCounter([]string{"consul", "dns", "stale_fallback"}, 1)
+		d.logger.Printf("[WARN] dns: Query results too stale (%v), re-requesting",
+			meta.LastContact)
+	}
+}
+
 // nodeLookup is used to handle a node query
 func (d *DNSServer) nodeLookup(network, datacenter, node string, req, resp *dns.Msg) {
 	// Only handle ANY, A and AAAA type requests
@@ -362,26 +471,15 @@ func (d *DNSServer) nodeLookup(network, datacenter, node string, req, resp *dns.
 	args := structs.NodeSpecificRequest{
 		Datacenter: datacenter,
 		Node:       node,
-		QueryOptions: structs.QueryOptions{
-			Token:      d.agent.config.ACLToken,
-			AllowStale: d.config.AllowStale,
-		},
 	}
 	var out structs.IndexedNodeServices
-RPC:
-	if err := d.agent.RPC("Catalog.NodeServices", &args, &out); err != nil {
+	if err := d.lookupRPC("Catalog.NodeServices", &args, &args.QueryOptions,
+		&out, &out.QueryMeta); err != nil {
 		d.logger.Printf("[ERR] dns: rpc error: %v", err)
 		resp.SetRcode(req, dns.RcodeServerFailure)
 		return
 	}
 
-	// Verify that request is not too stale, redo the request
-	if args.AllowStale && out.LastContact > d.config.MaxStale {
-		args.AllowStale = false
-		d.logger.Printf("[WARN] dns: Query results too stale, re-requesting")
-		goto RPC
-	}
-
 	// If we have no address, return not found!
 	if out.NodeServices == nil {
 		d.addSOA(d.domain, resp)
@@ -464,39 +562,22 @@ func (d *DNSServer) formatNodeRecord(node *structs.Node, addr, qName string, qTy
 func (d *DNSServer) serviceLookup(network, datacenter, service, tag string, req, resp *dns.Msg) {
 	// Make an RPC request
 	args := structs.ServiceSpecificRequest{
-		Datacenter:  datacenter,
-		ServiceName: service,
-		ServiceTag:  tag,
-		TagFilter:   tag != "",
-		QueryOptions: structs.QueryOptions{
-			Token:      d.agent.config.ACLToken,
-			AllowStale: d.config.AllowStale,
-		},
+		Datacenter:      datacenter,
+		ServiceName:     service,
+		ServiceTag:      tag,
+		TagFilter:       tag != "",
+		NodeMetaFilters: d.config.NodeMetaFilter,
 	}
 	var out structs.IndexedCheckServiceNodes
-RPC:
-	if err := d.agent.RPC("Health.ServiceNodes", &args, &out); err != nil {
+	if err := d.lookupRPC("Health.ServiceNodes", &args, &args.QueryOptions,
+		&out, &out.QueryMeta); err != nil {
 		d.logger.Printf("[ERR] dns: rpc error: %v", err)
 		resp.SetRcode(req, dns.RcodeServerFailure)
 		return
 	}
 
-	// Verify that request is not too stale, redo the request
-	if args.AllowStale && out.LastContact > d.config.MaxStale {
-		args.AllowStale = false
-		d.logger.Printf("[WARN] dns: Query results too stale, re-requesting")
-		goto RPC
-	}
-
 	// Determine the TTL
-	var ttl time.Duration
-	if d.config.ServiceTTL != nil {
-		var ok bool
-		ttl, ok = d.config.ServiceTTL[service]
-		if !ok {
-			ttl = d.config.ServiceTTL["*"]
-		}
-	}
+	ttl := d.serviceTTL(service)
 
 	// Filter out any service nodes due to health checks
 	out.Nodes = d.filterServiceNodes(out.Nodes)
@@ -508,9 +589,14 @@ RPC:
 		return
 	}
 
-	// Perform a random shuffle
+	// Perform a random shuffle, favoring the heavier instances
 	shuffleServiceNodes(out.Nodes)
 
+	// Only keep the first instances if capped
+	if max := d.config.MaxAnswers; max > 0 && len(out.Nodes) > max {
+		out.Nodes = out.Nodes[:max]
+	}
+
 	// Add various responses depending on the request
 	qType := req.Question[0].Qtype
 	d.serviceNodeRecords(out.Nodes, req, resp, ttl)
@@ -519,9 +605,14 @@ RPC:
 		d.serviceSRVRecords(datacenter, out.Nodes, req, resp, ttl)
 	}
 
-	// If the network is not TCP, restrict the number of responses
-	if network != "tcp" && len(resp.Answer) > maxServiceResponses {
-		resp.Answer = resp.Answer[:maxServiceResponses]
+	// If the network is not TCP, restrict the number of responses of the
+	// clients without EDNS0. Those with it get as many as fit their buffer.
+	limit := d.config.UDPAnswerLimit
+	if limit <= 0 {
+		limit = maxServiceResponses
+	}
+	if network != "tcp" && req.IsEdns0() == nil && len(resp.Answer) > limit {
+		resp.Answer = resp.Answer[:limit]
 
 		// Flag that there are more records to return in the UDP response
 		if d.config.EnableTruncate {
@@ -536,34 +627,91 @@ RPC:
 	}
 }
 
+// serviceTTL returns the TTL of the records of a service lookup. An exact
+// match wins, then the longest matching "prefix*" pattern, which includes
+// the "*" default.
+func (d *DNSServer) serviceTTL(service string) time.Duration {
+	service = strings.ToLower(service)
+	var ttl time.Duration
+	matched := -1
+	for pattern, dur := range d.config.ServiceTTL {
+		pattern = strings.ToLower(pattern)
+		if pattern == service {
+			return dur
+		}
+		if !strings.HasSuffix(pattern, "*") {
+			continue
+		}
+		prefix := strings.TrimSuffix(pattern, "*")
+		if strings.HasPrefix(service, prefix) && len(prefix) > matched {
+			ttl, matched = dur, len(prefix)
+		}
+	}
+	return ttl
+}
+
 // filterServiceNodes is used to filter out nodes that are failing
-// health checks to prevent routing to unhealthy nodes
+// health checks to prevent routing to unhealthy nodes. The healthy nodes
+// are copied into a new slice, which is safe to shuffle, since the nodes
+// may be shared with the server's query cache.
 func (d *DNSServer) filterServiceNodes(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
-	n := len(nodes)
+	out := make(structs.CheckServiceNodes, 0, len(nodes))
 OUTER:
-	for i := 0; i < n; i++ {
-		node := nodes[i]
+	for _, node := range nodes {
 		for _, check := range node.Checks {
 			if check.Status == structs.HealthCritical ||
 				(d.config.OnlyPassing && check.Status != structs.HealthPassing) {
 				d.logger.Printf("[WARN] dns: node '%s' failing health check '%s: %s', dropping from service '%s'",
 					node.Node.Node, check.CheckID, check.Name, node.Service.Service)
-				nodes[i], nodes[n-1] = nodes[n-1], structs.CheckServiceNode{}
-				n--
-				i--
 				continue OUTER
 			}
 		}
+		out = append(out, node)
 	}
-	return nodes[:n]
+	return out
 }
 
-// shuffleServiceNodes does an in-place random shuffle using the Fisher-Yates algorithm
+// shuffleServiceNodes does an in-place weighted random shuffle, so an
+// instance is ahead of another in proportion to their weights. Each
+// instance gets a key of u^(1/weight) for a uniform u, and the keys are
+// sorted in descending order. With equal weights, this is a uniform
+// shuffle.
 func shuffleServiceNodes(nodes structs.CheckServiceNodes) {
-	for i := len(nodes) - 1; i > 0; i-- {
-		j := rand.Int31() % int32(i+1)
-		nodes[i], nodes[j] = nodes[j], nodes[i]
+	keys := make([]float64, len(nodes))
+	for i, node := range nodes {
+		keys[i] = math.Pow(rand.Float64(), 1/float64(serviceNodeWeight(node)))
 	}
+	sort.Sort(&weightedServiceNodes{nodes, keys})
+}
+
+// weightedServiceNodes sorts service nodes by descending shuffle keys
+type weightedServiceNodes struct {
+	nodes structs.CheckServiceNodes
+	keys  []float64
+}
+
+func (w *weightedServiceNodes) Len() int           { return len(w.nodes) }
+func (w *weightedServiceNodes) Less(i, j int) bool { return w.keys[i] > w.keys[j] }
+func (w *weightedServiceNodes) Swap(i, j int) {
+	w.nodes[i], w.nodes[j] = w.nodes[j], w.nodes[i]
+	w.keys[i], w.keys[j] = w.keys[j], w.keys[i]
+}
+
+// serviceNodeWeight returns the weight of a service instance, which is
+// its warning weight if any check isn't passing. The critical instances
+// are already filtered out.
+func serviceNodeWeight(node structs.CheckServiceNode) int {
+	status := structs.HealthPassing
+	for _, check := range node.Checks {
+		if check.Status != structs.HealthPassing {
+			status = structs.HealthWarning
+		}
+	}
+	weight := node.Service.Weight(status)
+	if weight > math.MaxUint16 {
+		weight = math.MaxUint16
+	}
+	return weight
 }
 
 // serviceNodeRecords is used to add the node records for a service lookup
@@ -613,7 +761,7 @@ func (d *DNSServer) serviceSRVRecords(dc string, nodes structs.CheckServiceNodes
 				Ttl:    uint32(ttl / time.Second),
 			},
 			Priority: 1,
-			Weight:   1,
+			Weight:   uint16(serviceNodeWeight(node)),
 			Port:     uint16(node.Service.Port),
 			Target:   fmt.Sprintf("%s.node.%s.%s", node.Node.Node, dc, d.domain),
 		}
@@ -649,26 +797,18 @@ func (d *DNSServer) handleRecurse(resp dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	// Recursively resolve
-	c := &dns.Client{Net: network}
-	var r *dns.Msg
-	var rtt time.Duration
-	var err error
-	for _, recursor := range d.recursors {
-		r, rtt, err = c.Exchange(req, recursor)
-		if err == nil {
-			// Forward the response
-			d.logger.Printf("[DEBUG] dns: recurse RTT for %v (%v)", q, rtt)
-			if err := resp.WriteMsg(r); err != nil {
-				d.logger.Printf("[WARN] dns: failed to respond: %v", err)
-			}
-			return
+	r, err := d.recurse(network, req)
+	if err == nil {
+		// Forward the response
+		if err := resp.WriteMsg(r); err != nil {
+			d.logger.Printf("[WARN] dns: failed to respond: %v", err)
 		}
-		d.logger.Printf("[ERR] dns: recurse failed: %v", err)
+		return
 	}
 
 	// If all resolvers fail, return a SERVFAIL message
-	d.logger.Printf("[ERR] dns: all resolvers failed for %v from client %s (%s)",
-		q, resp.RemoteAddr().String(), resp.RemoteAddr().Network())
+	d.logger.Printf("[ERR] dns: all resolvers failed for %v from client %s (%s): %v",
+		q, resp.RemoteAddr().String(), resp.RemoteAddr().Network(), err)
 	m := &dns.Msg{}
 	m.SetReply(req)
 	m.RecursionAvailable = true
@@ -676,6 +816,58 @@ func (d *DNSServer) handleRecurse(resp dns.ResponseWriter, req *dns.Msg) {
 	resp.WriteMsg(m)
 }
 
+// recurse resolves a query through the recursors, in order. Each attempt
+// is bounded by the recursor timeout, and all of them by the recursor
+// deadline. A recursor that fails, or answers with SERVFAIL or REFUSED,
+// is skipped for the next one.
+func (d *DNSServer) recurse(network string, req *dns.Msg) (*dns.Msg, error) {
+	defer metrics.MeasureSince([]string{"consul", "dns", "recurse"}, time.Now())
+	timeout := d.config.RecursorTimeout
+	if timeout <= 0 {
+		timeout = defaultRecursorTimeout
+	}
+	deadlineDur := d.config.RecursorDeadline
+	if deadlineDur <= 0 {
+		deadlineDur = defaultRecursorDeadline
+	}
+	deadline := time.Now().Add(deadlineDur)
+
+	q := req.Question[0]
+	err := fmt.Errorf("no recursors")
+	for _, recursor := range d.recursors {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			err = fmt.Errorf("recursor deadline of %v exceeded", deadlineDur)
+			break
+		}
+		attempt := timeout
+		if left < attempt {
+			attempt = left
+		}
+
+		c := &dns.Client{
+			Net:          network,
+			DialTimeout:  attempt,
+			ReadTimeout:  attempt,
+			WriteTimeout: attempt,
+		}
+		var r *dns.Msg
+		var rtt time.Duration
+		r, rtt, err = c.Exchange(req, recursor)
+		if err == nil && (r.Rcode == dns.RcodeServerFailure || r.Rcode == dns.RcodeRefused) {
+			err = fmt.Errorf("%s answered %s", recursor, dns.RcodeToString[r.Rcode])
+		}
+		if err == nil {
+			d.logger.Printf("[DEBUG] dns: recurse RTT for %v (%v)", q, rtt)
+			return r, nil
+		}
+		d.logger.Printf("[ERR] dns: recurse failed for %v through %s: %v", q, recursor, err)
+		metrics.IncrCounter([]string{"consul", "dns", "recurse", "error"}, 1)
+	}
+	metrics.IncrCounter([]string{"consul", "dns", "recurse", "failed"}, 1)
+	return nil, err
+}
+
 // resolveCNAME is used to recursively resolve CNAME records
 func (d *DNSServer) resolveCNAME(name string) []dns.RR {
 	// Do nothing if we don't have a recursor
@@ -688,18 +880,10 @@ func (d *DNSServer) resolveCNAME(name string) []dns.RR {
 	m.SetQuestion(name, dns.TypeA)
 
 	// Make a DNS lookup request
-	c := &dns.Client{Net: "udp"}
-	var r *dns.Msg
-	var rtt time.Duration
-	var err error
-	for _, recursor := range d.recursors {
-		r, rtt, err = c.Exchange(m, recursor)
-		if err == nil {
-			d.logger.Printf("[DEBUG] dns: cname recurse RTT for %v (%v)", name, rtt)
-			return r.Answer
-		}
-		d.logger.Printf("[ERR] dns: cname recurse failed for %v: %v", name, err)
+	r, err := d.recurse("udp", m)
+	if err != nil {
+		d.logger.Printf("[ERR] dns: all resolvers failed for %v: %v", name, err)
+		return nil
 	}
-	d.logger.Printf("[ERR] dns: all resolvers failed for %v", name)
-	return nil
+	return r.Answer
 }
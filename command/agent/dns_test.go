@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -103,6 +105,16 @@ func TestRecursorAddr(t *testing.T) {
 	if addr != "8.8.8.8:53" {
 		t.Fatalf("bad: %v", addr)
 	}
+
+	for _, recursor := range []string{"2001:4860:4860::8888", "[2001:4860:4860::8888]"} {
+		addr, err = recursorAddr(recursor)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if addr != "[2001:4860:4860::8888]:53" {
+			t.Fatalf("bad: %v", addr)
+		}
+	}
 }
 
 func TestDNS_NodeLookup(t *testing.T) {
@@ -499,6 +511,73 @@ func TestDNS_ReverseLookup_IPV6(t *testing.T) {
 	}
 }
 
+func TestDNS_ReverseLookup_SharedAddress(t *testing.T) {
+	dir, srv := makeDNSServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Both nodes are found, however their address is written
+	for node, address := range map[string]string{
+		"foo": "::4242:4242",
+		"bar": "0:0::4242:4242",
+	} {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    address,
+		}
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("2.4.2.4.2.4.2.4.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", dns.TypePTR)
+
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var names []string
+	for _, rr := range in.Answer {
+		ptrRec, ok := rr.(*dns.PTR)
+		if !ok {
+			t.Fatalf("Bad: %#v", rr)
+		}
+		names = append(names, ptrRec.Ptr)
+	}
+	sort.Strings(names)
+	expect := []string{"bar.node.dc1.consul.", "foo.node.dc1.consul."}
+	if !reflect.DeepEqual(names, expect) {
+		t.Fatalf("Bad: %v", names)
+	}
+}
+
+func TestDNS_ReverseAddrIP(t *testing.T) {
+	cases := map[string]string{
+		"2.0.0.127.in-addr.arpa.": "127.0.0.2",
+		"2.0.0.127.IN-ADDR.ARPA":  "127.0.0.2",
+		"0.0.127.in-addr.arpa.":   "",
+		"2.0.0.300.in-addr.arpa.": "",
+		"1.0.0.127.ip6.arpa.":     "",
+		"2.0.0.127.node.consul.":  "",
+		"2.4.2.4.2.4.2.4.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.": "::4242:4242",
+		"b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.2.ip6.arpa.": "2001::567:89ab",
+	}
+	for name, expect := range cases {
+		ip := reverseAddrIP(name)
+		if (ip == nil && expect != "") || (ip != nil && ip.String() != expect) {
+			t.Fatalf("%s: bad: %v", name, ip)
+		}
+	}
+}
+
 func TestDNS_ServiceLookup(t *testing.T) {
 	dir, srv := makeDNSServer(t)
 	defer os.RemoveAll(dir)
@@ -967,6 +1046,255 @@ func TestDNS_Recurse(t *testing.T) {
 	}
 }
 
+// makeSilentRecursor returns a UDP socket that never answers
+func makeSilentRecursor(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return conn
+}
+
+func TestDNS_Recurse_Failover(t *testing.T) {
+	silent := makeSilentRecursor(t)
+	defer silent.Close()
+
+	failing := makeRecursor(t, nil)
+	failing.Handler.(*dns.ServeMux).HandleFunc(".", func(resp dns.ResponseWriter, msg *dns.Msg) {
+		ans := new(dns.Msg)
+		ans.SetRcode(msg, dns.RcodeServerFailure)
+		resp.WriteMsg(ans)
+	})
+	defer failing.Shutdown()
+
+	recursor := makeRecursor(t, []dns.RR{dnsA("apple.com", "1.2.3.4")})
+	defer recursor.Shutdown()
+
+	dir, srv := makeDNSServerConfig(t, func(c *Config) {
+		c.DNSRecursors = []string{silent.LocalAddr().String(), failing.Addr, recursor.Addr}
+	}, func(c *DNSConfig) {
+		c.RecursorTimeout = 100 * time.Millisecond
+	})
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("apple.com.", dns.TypeANY)
+
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 1 {
+		t.Fatalf("Bad: %#v", in)
+	}
+}
+
+func TestDNS_Recurse_Deadline(t *testing.T) {
+	silent1 := makeSilentRecursor(t)
+	defer silent1.Close()
+	silent2 := makeSilentRecursor(t)
+	defer silent2.Close()
+	recursor := makeRecursor(t, []dns.RR{dnsA("apple.com", "1.2.3.4")})
+	defer recursor.Shutdown()
+
+	dir, srv := makeDNSServerConfig(t, func(c *Config) {
+		c.DNSRecursors = []string{silent1.LocalAddr().String(),
+			silent2.LocalAddr().String(), recursor.Addr}
+	}, func(c *DNSConfig) {
+		c.RecursorTimeout = 200 * time.Millisecond
+		c.RecursorDeadline = 300 * time.Millisecond
+	})
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("apple.com.", dns.TypeANY)
+
+	// The deadline is reached before the working recursor is tried
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	start := time.Now()
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if in.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Bad: %#v", in)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		t.Fatalf("took too long: %v", elapsed)
+	}
+}
+
+func TestDNS_ServiceLookup_Weights(t *testing.T) {
+	dir, srv := makeDNSServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// A warning instance gets its warning weight, and an instance without
+	// weights the default one
+	for _, args := range []*structs.RegisterRequest{
+		{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service:       "db",
+				Port:          12345,
+				WeightPassing: 10,
+				WeightWarning: 2,
+			},
+			Check: &structs.HealthCheck{
+				CheckID:   "db",
+				Name:      "db",
+				ServiceID: "db",
+				Status:    structs.HealthWarning,
+			},
+		},
+		{
+			Datacenter: "dc1",
+			Node:       "bar",
+			Address:    "127.0.0.2",
+			Service: &structs.NodeService{
+				Service:       "db",
+				Port:          12345,
+				WeightPassing: 10,
+			},
+		},
+		{
+			Datacenter: "dc1",
+			Node:       "baz",
+			Address:    "127.0.0.3",
+			Service: &structs.NodeService{
+				Service: "db",
+				Port:    12345,
+			},
+		},
+	} {
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("db.service.consul.", dns.TypeSRV)
+
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	weights := make(map[string]uint16)
+	for _, rr := range in.Answer {
+		srvRec, ok := rr.(*dns.SRV)
+		if !ok {
+			t.Fatalf("Bad: %#v", rr)
+		}
+		weights[srvRec.Target] = srvRec.Weight
+	}
+	expect := map[string]uint16{
+		"foo.node.dc1.consul.": 2,
+		"bar.node.dc1.consul.": 10,
+		"baz.node.dc1.consul.": 1,
+	}
+	if !reflect.DeepEqual(weights, expect) {
+		t.Fatalf("Bad: %v", weights)
+	}
+
+	// Negative weights are rejected
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service:       "db",
+			WeightWarning: -1,
+		},
+	}
+	var out struct{}
+	err = srv.agent.RPC("Catalog.Register", args, &out)
+	if err == nil || !strings.Contains(err.Error(), "can't be negative") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDNS_ShuffleServiceNodes_Weights(t *testing.T) {
+	heavy := structs.CheckServiceNode{
+		Node:    structs.Node{Node: "heavy"},
+		Service: structs.NodeService{WeightPassing: 1000},
+	}
+	light := structs.CheckServiceNode{
+		Node: structs.Node{Node: "light"},
+	}
+
+	first := 0
+	for i := 0; i < 100; i++ {
+		nodes := structs.CheckServiceNodes{light, heavy}
+		shuffleServiceNodes(nodes)
+		if nodes[0].Node.Node == "heavy" {
+			first++
+		}
+	}
+	if first < 90 {
+		t.Fatalf("heavy node only first %d times", first)
+	}
+}
+
+func TestDNS_ServiceLookup_NodeMetaFilter(t *testing.T) {
+	dir, srv := makeDNSServerConfig(t, nil, func(c *DNSConfig) {
+		c.NodeMetaFilter = map[string]string{"zone": "a"}
+	})
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Only the node of the same zone is returned, tag lookups included
+	for node, zone := range map[string]string{"foo": "a", "bar": "b"} {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			NodeMeta:   map[string]string{"zone": zone},
+			Service: &structs.NodeService{
+				Service: "db",
+				Tags:    []string{"master"},
+				Port:    12345,
+			},
+		}
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	for _, name := range []string{"db.service.consul.", "master.db.service.consul."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeSRV)
+		in, _, err := c.Exchange(m, addr.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(in.Answer) != 1 {
+			t.Fatalf("%s: Bad: %#v", name, in)
+		}
+		srvRec, ok := in.Answer[0].(*dns.SRV)
+		if !ok || srvRec.Target != "foo.node.dc1.consul." {
+			t.Fatalf("%s: Bad: %#v", name, in.Answer[0])
+		}
+	}
+}
+
 func TestDNS_ServiceLookup_FilterCritical(t *testing.T) {
 	dir, srv := makeDNSServer(t)
 	defer os.RemoveAll(dir)
@@ -1304,6 +1632,48 @@ func TestDNS_ServiceLookup_OnlyPassing(t *testing.T) {
 	}
 }
 
+func TestDNS_ServiceLookup_MaxPageSize(t *testing.T) {
+	dir, srv := makeDNSServerConfig(t, func(c *Config) {
+		c.MaxPageSize = 2
+	}, nil)
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register more instances than fit a page
+	for i := 0; i < 5; i++ {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("foo%d", i),
+			Address:    fmt.Sprintf("127.0.0.%d", i+1),
+			Service: &structs.NodeService{
+				Service: "web",
+				Port:    8000,
+			},
+		}
+
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Every instance is returned over TCP
+	m := new(dns.Msg)
+	m.SetQuestion("web.service.consul.", dns.TypeANY)
+
+	c := &dns.Client{Net: "tcp"}
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(in.Answer) != 5 {
+		t.Fatalf("Bad: %#v", in)
+	}
+}
+
 func TestDNS_ServiceLookup_Randomize(t *testing.T) {
 	dir, srv := makeDNSServer(t)
 	defer os.RemoveAll(dir)
@@ -1416,6 +1786,163 @@ func TestDNS_ServiceLookup_Truncate(t *testing.T) {
 	}
 }
 
+func TestDNS_ServiceLookup_AnswerLimit(t *testing.T) {
+	dir, srv := makeDNSServerConfig(t, nil, func(c *DNSConfig) {
+		c.UDPAnswerLimit = 5
+	})
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register nodes
+	for i := 0; i < 10; i++ {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("foo%d", i),
+			Address:    fmt.Sprintf("127.0.0.%d", i+1),
+			Service: &structs.NodeService{
+				Service: "web",
+				Port:    8000,
+			},
+		}
+
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("web.service.consul.", dns.TypeA)
+
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	c := new(dns.Client)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(in.Answer) != 5 || in.Truncated {
+		t.Fatalf("Bad: %#v", in)
+	}
+
+	// Clients with EDNS0 get every record that fits their buffer
+	m.SetEdns0(4096, false)
+	in, _, err = c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(in.Answer) != 10 || in.Truncated {
+		t.Fatalf("Bad: %#v", in)
+	}
+	if opt := in.IsEdns0(); opt == nil || opt.UDPSize() != 4096 {
+		t.Fatalf("Bad: %#v", in.Extra)
+	}
+}
+
+func TestDNS_ServiceLookup_MaxAnswers(t *testing.T) {
+	dir, srv := makeDNSServerConfig(t, nil, func(c *DNSConfig) {
+		c.MaxAnswers = 2
+	})
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register nodes
+	for i := 0; i < 10; i++ {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("foo%d", i),
+			Address:    fmt.Sprintf("127.0.0.%d", i+1),
+			Service: &structs.NodeService{
+				Service: "web",
+				Port:    8000,
+			},
+		}
+
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The cap applies over TCP too, and the picked instances vary
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	c := &dns.Client{Net: "tcp"}
+	uniques := make(map[string]struct{})
+	for i := 0; i < 10; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("web.service.consul.", dns.TypeSRV)
+		in, _, err := c.Exchange(m, addr.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(in.Answer) != 2 || len(in.Extra) != 2 || in.Truncated {
+			t.Fatalf("Bad: %#v", in)
+		}
+		for _, rr := range in.Answer {
+			uniques[rr.(*dns.SRV).Target] = struct{}{}
+		}
+	}
+	if len(uniques) <= 2 {
+		t.Fatalf("should vary the answers: %v", uniques)
+	}
+}
+
+func TestDNS_ServiceLookup_TruncateSize(t *testing.T) {
+	dir, srv := makeDNSServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register enough nodes to overflow a 512 byte response
+	for i := 0; i < 40; i++ {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("a-rather-long-node-name-%d", i),
+			Address:    fmt.Sprintf("127.0.0.%d", i+1),
+			Service: &structs.NodeService{
+				Service: "web",
+				Port:    8000,
+			},
+		}
+
+		var out struct{}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("web.service.consul.", dns.TypeSRV)
+	m.SetEdns0(512, false)
+
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	c := new(dns.Client)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !in.Truncated || len(in.Answer) == 0 || len(in.Answer) >= 40 {
+		t.Fatalf("Bad: %d %v", len(in.Answer), in.Truncated)
+	}
+	if in.Len() > 512 {
+		t.Fatalf("Bad: %d", in.Len())
+	}
+
+	// The whole set is returned over TCP
+	c.Net = "tcp"
+	in, _, err = c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if in.Truncated || len(in.Answer) != 40 {
+		t.Fatalf("Bad: %d %v", len(in.Answer), in.Truncated)
+	}
+}
+
 func TestDNS_ServiceLookup_MaxResponses(t *testing.T) {
 	dir, srv := makeDNSServer(t)
 	defer os.RemoveAll(dir)
@@ -1781,6 +2308,134 @@ func TestDNS_ServiceLookup_TTL(t *testing.T) {
 	}
 }
 
+func TestDNS_ServiceTTL(t *testing.T) {
+	d := &DNSServer{config: &DNSConfig{
+		ServiceTTL: map[string]time.Duration{
+			"db":       10 * time.Second,
+			"db*":      20 * time.Second,
+			"db-west*": 30 * time.Second,
+			"Web*":     40 * time.Second,
+			"*":        5 * time.Second,
+		},
+	}}
+	cases := map[string]time.Duration{
+		"db":         10 * time.Second,
+		"db-east":    20 * time.Second,
+		"db-west-1":  30 * time.Second,
+		"webserver":  40 * time.Second,
+		"api":        5 * time.Second,
+		"redis-db-1": 5 * time.Second,
+	}
+	for service, expect := range cases {
+		if ttl := d.serviceTTL(service); ttl != expect {
+			t.Fatalf("%s: bad: %v", service, ttl)
+		}
+	}
+
+	// Without a default, unmatched services get no TTL
+	delete(d.config.ServiceTTL, "*")
+	if ttl := d.serviceTTL("api"); ttl != 0 {
+		t.Fatalf("bad: %v", ttl)
+	}
+}
+
+func TestDNS_ServiceLookup_SRV_IPv6(t *testing.T) {
+	dir, srv := makeDNSServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// A bracketed service address is served as an AAAA record
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Address: "[2001:db8::1]",
+			Port:    12345,
+		},
+	}
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("db.service.consul.", dns.TypeSRV)
+
+	c := new(dns.Client)
+	addr, _ := srv.agent.config.ClientListener("", srv.agent.config.Ports.DNS)
+	in, _, err := c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(in.Answer) != 1 || len(in.Extra) != 1 {
+		t.Fatalf("Bad: %#v", in)
+	}
+	srvRec, ok := in.Answer[0].(*dns.SRV)
+	if !ok || srvRec.Target != "foo.node.dc1.consul." {
+		t.Fatalf("Bad: %#v", in.Answer[0])
+	}
+	aaaaRec, ok := in.Extra[0].(*dns.AAAA)
+	if !ok || aaaaRec.Hdr.Name != srvRec.Target || aaaaRec.AAAA.String() != "2001:db8::1" {
+		t.Fatalf("Bad: %#v", in.Extra[0])
+	}
+
+	// And only answers AAAA lookups
+	m.SetQuestion("db.service.consul.", dns.TypeAAAA)
+	in, _, err = c.Exchange(m, addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(in.Answer) != 1 {
+		t.Fatalf("Bad: %#v", in)
+	}
+	if _, ok := in.Answer[0].(*dns.AAAA); !ok {
+		t.Fatalf("Bad: %#v", in.Answer[0])
+	}
+}
+
+func TestDNS_LookupRPC_Stale(t *testing.T) {
+	dir, srv := makeDNSServerConfig(t, nil, func(c *DNSConfig) {
+		c.AllowStale = true
+		c.MaxStale = time.Hour
+	})
+	defer os.RemoveAll(dir)
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// A fresh enough result is served stale
+	args := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       srv.agent.config.NodeName,
+	}
+	var out structs.IndexedNodeServices
+	if err := srv.lookupRPC("Catalog.NodeServices", &args, &args.QueryOptions,
+		&out, &out.QueryMeta); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !args.AllowStale || out.NodeServices == nil {
+		t.Fatalf("bad: %v %v", args.AllowStale, out.NodeServices)
+	}
+
+	// A result staler than the bound is requested again from the leader
+	srv.config.MaxStale = -1
+	if err := srv.lookupRPC("Catalog.NodeServices", &args, &args.QueryOptions,
+		&out, &out.QueryMeta); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if args.AllowStale || out.NodeServices == nil {
+		t.Fatalf("bad: %v %v", args.AllowStale, out.NodeServices)
+	}
+	if args.Token != srv.agent.config.ACLToken {
+		t.Fatalf("bad: %v", args.Token)
+	}
+}
+
 func TestDNS_ServiceLookup_SRV_RFC(t *testing.T) {
 	dir, srv := makeDNSServer(t)
 	defer os.RemoveAll(dir)
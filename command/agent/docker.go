@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultDockerHost is the endpoint of the Docker daemon used when
+	// the DOCKER_HOST environment variable is not set
+	defaultDockerHost = "unix:///var/run/docker.sock"
+)
+
+// dockerClient is a minimal client of the Docker remote API, enough to
+// run the commands of the Docker checks inside their containers
+type dockerClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+// newDockerClient returns a client of the Docker daemon at the given
+// host, either a unix:// socket or a tcp:// address. The DOCKER_HOST
+// environment variable is used when the host is empty.
+func newDockerClient(host string) (*dockerClient, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	// Keep-alives are disabled like for the HTTP checks, the requests
+	// are few and far apart
+	trans := &http.Transport{DisableKeepAlives: true}
+	d := &dockerClient{client: &http.Client{Transport: trans}}
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		path := strings.TrimPrefix(host, "unix://")
+		trans.Dial = func(string, string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}
+		d.endpoint = "http://docker"
+	case strings.HasPrefix(host, "tcp://"):
+		d.endpoint = "http://" + strings.TrimPrefix(host, "tcp://")
+	case strings.HasPrefix(host, "http://"):
+		d.endpoint = host
+	default:
+		return nil, fmt.Errorf("Unsupported Docker host %q", host)
+	}
+	return d, nil
+}
+
+// call makes a request to the Docker API before a deadline, encoding the
+// body as JSON. The response must be closed by the caller on success.
+func (d *dockerClient) call(method, path string, body interface{}, deadline time.Time) (*http.Response, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, d.endpoint+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// The calls of a check share its deadline, which also bounds
+	// reading the responses
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return nil, fmt.Errorf("Timed out calling the Docker API")
+	}
+	client := *d.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Docker API %s %s failed: %s %s",
+			method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// createExec sets up the run of a command in a container, returning the
+// ID of the exec instance
+func (d *dockerClient) createExec(containerID string, cmd []string, deadline time.Time) (string, error) {
+	req := map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          false,
+		"Cmd":          cmd,
+	}
+	resp, err := d.call("POST", "/containers/"+containerID+"/exec", req, deadline)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var out struct{ Id string }
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Id, nil
+}
+
+// startExec runs an exec instance until it completes, copying its
+// standard output and error to out
+func (d *dockerClient) startExec(execID string, out io.Writer, deadline time.Time) error {
+	req := map[string]interface{}{
+		"Detach": false,
+		"Tty":    false,
+	}
+	resp, err := d.call("POST", "/exec/"+execID+"/start", req, deadline)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Without a TTY both streams are multiplexed, each frame has an 8
+	// bytes header ending with the big endian size of the payload
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(resp.Body, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(out, resp.Body, size); err != nil {
+			return err
+		}
+	}
+}
+
+// inspectExec returns the exit code of a completed exec instance
+func (d *dockerClient) inspectExec(execID string, deadline time.Time) (int, error) {
+	resp, err := d.call("GET", "/exec/"+execID+"/json", nil, deadline)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Running  bool
+		ExitCode int
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	if out.Running {
+		return 0, fmt.Errorf("Exec %s is still running", execID)
+	}
+	return out.ExitCode, nil
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockDockerServer emulates the exec endpoints of the Docker API, running
+// every command with the given output and exit code
+func mockDockerServer(output string, exitCode int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/containers/web/exec") {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"message":"No such container"}`))
+			return
+		}
+		w.WriteHeader(201)
+		w.Write([]byte(`{"Id":"exec1"}`))
+	})
+	mux.HandleFunc("/exec/exec1/start", func(w http.ResponseWriter, r *http.Request) {
+		// Split the output in a stdout and a stderr frame
+		var buf bytes.Buffer
+		half := len(output) / 2
+		for i, part := range []string{output[:half], output[half:]} {
+			header := [8]byte{byte(i + 1)}
+			binary.BigEndian.PutUint32(header[4:], uint32(len(part)))
+			buf.Write(header[:])
+			buf.WriteString(part)
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("/exec/exec1/json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Running":  false,
+			"ExitCode": exitCode,
+		})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestDockerClient_Host(t *testing.T) {
+	d, err := newDockerClient("unix:///var/run/docker.sock")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.endpoint != "http://docker" {
+		t.Fatalf("bad: %v", d.endpoint)
+	}
+
+	d, err = newDockerClient("tcp://127.0.0.1:2375")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.endpoint != "http://127.0.0.1:2375" {
+		t.Fatalf("bad: %v", d.endpoint)
+	}
+
+	if _, err := newDockerClient("ssh://docker"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestDockerClient_Exec(t *testing.T) {
+	server := mockDockerServer("hello world", 2)
+	defer server.Close()
+
+	d, err := newDockerClient("tcp://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+
+	if _, err := d.createExec("nope", []string{"true"}, deadline); err == nil ||
+		!strings.Contains(err.Error(), "No such container") {
+		t.Fatalf("err: %v", err)
+	}
+
+	id, err := d.createExec("web", []string{"true"}, deadline)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out bytes.Buffer
+	if err := d.startExec(id, &out, deadline); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.String() != "hello world" {
+		t.Fatalf("bad: %q", out.String())
+	}
+	code, err := d.inspectExec(id, deadline)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != 2 {
+		t.Fatalf("bad: %v", code)
+	}
+
+	// A passed deadline fails the calls
+	if _, err := d.inspectExec(id, time.Now()); err == nil {
+		t.Fatalf("should fail")
+	}
+}
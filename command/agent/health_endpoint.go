@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"fmt"
 	"github.com/hashicorp/consul/consul/structs"
 	"net/http"
 	"strings"
@@ -84,6 +85,9 @@ func (s *HTTPServer) HealthServiceNodes(resp http.ResponseWriter, req *http.Requ
 	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
 		return nil, nil
 	}
+	if parsePage(resp, req, &args.QueryOptions) {
+		return nil, nil
+	}
 
 	// Check for a tag
 	params := req.URL.Query()
@@ -92,6 +96,28 @@ func (s *HTTPServer) HealthServiceNodes(resp http.ResponseWriter, req *http.Requ
 		args.TagFilter = true
 	}
 
+	// Check for a lookup of the connect-proxies of the service
+	if _, ok := params["connect"]; ok {
+		args.Connect = true
+	}
+
+	// Check for a lookup of a service imported from a peer
+	args.PeerName = params.Get("peer")
+
+	// Check for node metadata, as key:value pairs
+	for _, pair := range params["node-meta"] {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid node-meta %q, must be key:value", pair)))
+			return nil, nil
+		}
+		if args.NodeMetaFilters == nil {
+			args.NodeMetaFilters = make(map[string]string)
+		}
+		args.NodeMetaFilters[parts[0]] = parts[1]
+	}
+
 	// Pull out the service name
 	args.ServiceName = strings.TrimPrefix(req.URL.Path, "/v1/health/service/")
 	if args.ServiceName == "" {
@@ -103,7 +129,7 @@ func (s *HTTPServer) HealthServiceNodes(resp http.ResponseWriter, req *http.Requ
 	// Make the RPC request
 	var out structs.IndexedCheckServiceNodes
 	defer setMeta(resp, &out.QueryMeta)
-	if err := s.agent.RPC("Health.ServiceNodes", &args, &out); err != nil {
+	if err := s.cachedRPC(resp, req, "Health.ServiceNodes", &args, &args.QueryOptions, &out); err != nil {
 		return nil, err
 	}
 
@@ -114,20 +140,93 @@ func (s *HTTPServer) HealthServiceNodes(resp http.ResponseWriter, req *http.Requ
 	return out.Nodes, nil
 }
 
-// filterNonPassing is used to filter out any nodes that have check that are not passing
+func (s *HTTPServer) HealthSummary(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Set default DC
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	// Make the RPC request
+	var out structs.IndexedServiceHealthSummaries
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Health.Summary", &args, &out); err != nil {
+		return nil, err
+	}
+
+	// Use empty list instead of nil
+	if out.Summaries == nil {
+		out.Summaries = make(structs.ServiceHealthSummaries, 0)
+	}
+	return out.Summaries, nil
+}
+
+// HealthMeshGateways lists the mesh gateways of a datacenter, with their
+// checks
+func (s *HTTPServer) HealthMeshGateways(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.IndexedCheckServiceNodes
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Health.MeshGateways", &args, &out); err != nil {
+		return nil, err
+	}
+
+	if _, ok := req.URL.Query()["passing"]; ok {
+		out.Nodes = filterNonPassing(out.Nodes)
+	}
+	if out.Nodes == nil {
+		out.Nodes = make(structs.CheckServiceNodes, 0)
+	}
+	return out.Nodes, nil
+}
+
+// HealthResolveService resolves a service of the datacenter given by the
+// "?target-dc=" parameter to the endpoints the proxies dial to reach it
+func (s *HTTPServer) HealthResolveService(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.ServiceResolveRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	args.TargetDatacenter = req.URL.Query().Get("target-dc")
+
+	args.ServiceName = strings.TrimPrefix(req.URL.Path, "/v1/health/resolve/")
+	if args.ServiceName == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing service name"))
+		return nil, nil
+	}
+
+	var out structs.ServiceResolution
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Health.ResolveService", &args, &out); err != nil {
+		return nil, err
+	}
+	if out.Endpoints == nil {
+		out.Endpoints = make([]structs.ServiceEndpoint, 0)
+	}
+	if out.Gateways == nil {
+		out.Gateways = make([]structs.ServiceEndpoint, 0)
+	}
+	return out, nil
+}
+
+// filterNonPassing is used to filter out any nodes that have check that are not passing.
+// The nodes may be shared with the server's query cache, so the passing ones
+// are copied into a new slice.
 func filterNonPassing(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
-	n := len(nodes)
+	out := make(structs.CheckServiceNodes, 0, len(nodes))
 OUTER:
-	for i := 0; i < n; i++ {
-		node := nodes[i]
+	for _, node := range nodes {
 		for _, check := range node.Checks {
 			if check.Status != structs.HealthPassing {
-				nodes[i], nodes[n-1] = nodes[n-1], structs.CheckServiceNode{}
-				n--
-				i--
 				continue OUTER
 			}
 		}
+		out = append(out, node)
 	}
-	return nodes[:n]
+	return out
 }
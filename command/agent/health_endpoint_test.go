@@ -138,6 +138,85 @@ func TestHealthServiceNodes(t *testing.T) {
 	}
 }
 
+func TestHealthServiceNodes_NodeMetaFilter(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	args := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "bar",
+		Address:    "127.0.0.1",
+		NodeMeta:   map[string]string{"zone": "a"},
+		Service: &structs.NodeService{
+			Service: "test",
+		},
+	}
+	var out struct{}
+	if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for filter, expect := range map[string]int{"zone:a": 1, "zone:b": 0} {
+		req, err := http.NewRequest("GET", "/v1/health/service/test?node-meta="+filter, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.HealthServiceNodes(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		assertIndex(t, resp)
+		if nodes := obj.(structs.CheckServiceNodes); len(nodes) != expect {
+			t.Fatalf("%s: bad: %v", filter, obj)
+		}
+	}
+
+	// A filter must be a key:value pair
+	req, err := http.NewRequest("GET", "/v1/health/service/test?node-meta=zone", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	if _, err := srv.HealthServiceNodes(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+}
+
+func TestHealthSummary(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	req, err := http.NewRequest("GET", "/v1/health/summary?dc=dc1", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	obj, err := srv.HealthSummary(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+
+	// Should be the passing consul service
+	summaries := obj.(structs.ServiceHealthSummaries)
+	if len(summaries) != 1 || summaries[0].Service != "consul" || summaries[0].Passing != 1 {
+		t.Fatalf("bad: %v", obj)
+	}
+}
+
 func TestHealthServiceNodes_PassingFilter(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -184,6 +263,72 @@ func TestHealthServiceNodes_PassingFilter(t *testing.T) {
 	}
 }
 
+func TestHealthMeshGateways(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// Register a gateway and a proxy of the api
+	var out struct{}
+	for _, service := range []*structs.NodeService{
+		{
+			Service:    "mesh-gateway",
+			Port:       8443,
+			Kind:       structs.ServiceKindMeshGateway,
+			WANAddress: "198.51.100.1",
+		},
+		{
+			Service: "api-proxy",
+			Port:    21000,
+			Kind:    structs.ServiceKindConnectProxy,
+			Proxy:   structs.ConnectProxyConfig{DestinationServiceName: "api"},
+		},
+	} {
+		args := &structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service:    service,
+		}
+		if err := srv.agent.RPC("Catalog.Register", args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/v1/health/mesh-gateways", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.HealthMeshGateways(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+	nodes := obj.(structs.CheckServiceNodes)
+	if len(nodes) != 1 || nodes[0].Service.WANAddress != "198.51.100.1" {
+		t.Fatalf("bad: %v", obj)
+	}
+
+	// Within the datacenter, the api resolves to its proxy
+	req, err = http.NewRequest("GET", "/v1/health/resolve/api", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, err = srv.HealthResolveService(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resolution := obj.(structs.ServiceResolution)
+	expected := []structs.ServiceEndpoint{{Node: "foo", Address: "127.0.0.1", Port: 21000}}
+	if resolution.Datacenter != "dc1" || !reflect.DeepEqual(resolution.Endpoints, expected) {
+		t.Fatalf("bad: %#v", resolution)
+	}
+}
+
 func TestFilterNonPassing(t *testing.T) {
 	nodes := structs.CheckServiceNodes{
 		structs.CheckServiceNode{
@@ -218,4 +363,9 @@ func TestFilterNonPassing(t *testing.T) {
 	if len(out) != 1 && reflect.DeepEqual(out[0], nodes[2]) {
 		t.Fatalf("bad: %v", out)
 	}
+
+	// The input may be shared, so it must be left untouched
+	if len(nodes[0].Checks) != 2 || nodes[2].Checks[0].Status != structs.HealthPassing {
+		t.Fatalf("bad: %v", nodes)
+	}
 }
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"compress/gzip"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -13,8 +14,10 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/hashicorp/consul/audit"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/tlsutil"
 	"github.com/mitchellh/mapstructure"
@@ -28,6 +31,20 @@ var (
 	scadaHTTPAddr = "SCADA"
 )
 
+const (
+	// gzipMinSize is the size from which the JSON responses are gzip
+	// encoded, for the clients that accept it. Smaller responses are not
+	// worth the CPU.
+	gzipMinSize = 1024
+)
+
+// gzipWriters recycles the gzip writers, which are expensive to allocate
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
 // HTTPServer is used to wrap an Agent and expose various API's
 // in a RESTful manner
 type HTTPServer struct {
@@ -37,6 +54,10 @@ type HTTPServer struct {
 	logger   *log.Logger
 	uiDir    string
 	addr     string
+
+	// certTokens maps the client certificates of the HTTPS API to ACL
+	// tokens
+	certTokens []*certTokenRule
 }
 
 // NewHTTPServers starts new HTTP servers to provide an interface to
@@ -51,7 +72,7 @@ func NewHTTPServers(agent *Agent, config *Config, logOutput io.Writer) ([]*HTTPS
 		}
 
 		tlsConf := &tlsutil.Config{
-			VerifyIncoming: config.VerifyIncoming,
+			VerifyIncoming: config.VerifyIncoming || config.HTTPSVerifyIncoming,
 			VerifyOutgoing: config.VerifyOutgoing,
 			CAFile:         config.CAFile,
 			CertFile:       config.CertFile,
@@ -64,12 +85,25 @@ func NewHTTPServers(agent *Agent, config *Config, logOutput io.Writer) ([]*HTTPS
 			return nil, err
 		}
 
-		ln, err := net.Listen(httpAddr.Network(), httpAddr.String())
+		// Without verify_incoming, the certificates are still verified
+		// if given, so they can be mapped to ACL tokens
+		if tlsConfig.ClientAuth == tls.NoClientCert && len(config.HTTPSCertTokens) != 0 {
+			if config.CAFile == "" {
+				return nil, fmt.Errorf("HTTPS certificate tokens require a CA file")
+			}
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		certTokens, err := compileCertTokens(config.HTTPSCertTokens)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to get Listen on %s: %v", httpAddr.String(), err)
+			return nil, err
 		}
 
-		list := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, tlsConfig)
+		ln, err := httpListener(agent, config, httpAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		list := tls.NewListener(ln, tlsConfig)
 
 		// Create the mux
 		mux := http.NewServeMux()
@@ -83,6 +117,7 @@ func NewHTTPServers(agent *Agent, config *Config, logOutput io.Writer) ([]*HTTPS
 			uiDir:    config.UiDir,
 			addr:     httpAddr.String(),
 		}
+		srv.certTokens = certTokens
 		srv.registerHandlers(config.EnableDebug)
 
 		// Start the server
@@ -96,31 +131,9 @@ func NewHTTPServers(agent *Agent, config *Config, logOutput io.Writer) ([]*HTTPS
 			return nil, fmt.Errorf("Failed to get ClientListener address:port: %v", err)
 		}
 
-		// Error if we are trying to bind a domain socket to an existing path
-		socketPath, isSocket := unixSocketAddr(config.Addresses.HTTP)
-		if isSocket {
-			if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
-				agent.logger.Printf("[WARN] agent: Replacing socket %q", socketPath)
-			}
-			if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
-				return nil, fmt.Errorf("error removing socket file: %s", err)
-			}
-		}
-
-		ln, err := net.Listen(httpAddr.Network(), httpAddr.String())
+		list, err := httpListener(agent, config, httpAddr)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to get Listen on %s: %v", httpAddr.String(), err)
-		}
-
-		var list net.Listener
-		if isSocket {
-			// Set up ownership/permission bits on the socket file
-			if err := setFilePermissions(socketPath, config.UnixSockets); err != nil {
-				return nil, fmt.Errorf("Failed setting up HTTP socket: %s", err)
-			}
-			list = ln
-		} else {
-			list = tcpKeepAliveListener{ln.(*net.TCPListener)}
+			return nil, err
 		}
 
 		// Create the mux
@@ -145,6 +158,40 @@ func NewHTTPServers(agent *Agent, config *Config, logOutput io.Writer) ([]*HTTPS
 	return servers, nil
 }
 
+// httpListener listens on the address of an HTTP(S) server, either a TCP
+// address or a domain socket. An existing socket file is replaced, and the
+// new one gets the ownership and permissions of the unix_sockets config.
+func httpListener(agent *Agent, config *Config, httpAddr net.Addr) (net.Listener, error) {
+	// Error if we are trying to bind a domain socket to an existing path
+	unixAddr, isSocket := httpAddr.(*net.UnixAddr)
+	var socketPath string
+	if isSocket {
+		socketPath = unixAddr.Name
+		if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+			agent.logger.Printf("[WARN] agent: Replacing socket %q", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error removing socket file: %s", err)
+		}
+	}
+
+	ln, err := net.Listen(httpAddr.Network(), httpAddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get Listen on %s: %v", httpAddr.String(), err)
+	}
+
+	if !isSocket {
+		return tcpKeepAliveListener{ln.(*net.TCPListener)}, nil
+	}
+
+	// Set up ownership/permission bits on the socket file
+	if err := setFilePermissions(socketPath, config.UnixSockets); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("Failed setting up HTTP socket: %s", err)
+	}
+	return ln, nil
+}
+
 // newScadaHttp creates a new HTTP server wrapping the SCADA
 // listener such that HTTP calls can be sent from the brokers.
 func newScadaHttp(agent *Agent, list net.Listener) *HTTPServer {
@@ -200,6 +247,10 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 
 	s.mux.HandleFunc("/v1/catalog/register", s.wrap(s.CatalogRegister))
 	s.mux.HandleFunc("/v1/catalog/deregister", s.wrap(s.CatalogDeregister))
+	s.mux.HandleFunc("/v1/catalog/patch", s.wrap(s.CatalogPatch))
+	s.mux.HandleFunc("/v1/catalog/audit", s.wrap(s.CatalogAudit))
+	s.mux.HandleFunc("/v1/catalog/maintenance", s.wrap(s.CatalogMaintenanceList))
+	s.mux.HandleFunc("/v1/catalog/maintenance/", s.wrap(s.CatalogMaintenance))
 	s.mux.HandleFunc("/v1/catalog/datacenters", s.wrap(s.CatalogDatacenters))
 	s.mux.HandleFunc("/v1/catalog/nodes", s.wrap(s.CatalogNodes))
 	s.mux.HandleFunc("/v1/catalog/services", s.wrap(s.CatalogServices))
@@ -210,8 +261,13 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 	s.mux.HandleFunc("/v1/health/checks/", s.wrap(s.HealthServiceChecks))
 	s.mux.HandleFunc("/v1/health/state/", s.wrap(s.HealthChecksInState))
 	s.mux.HandleFunc("/v1/health/service/", s.wrap(s.HealthServiceNodes))
+	s.mux.HandleFunc("/v1/health/summary", s.wrap(s.HealthSummary))
+	s.mux.HandleFunc("/v1/health/mesh-gateways", s.wrap(s.HealthMeshGateways))
+	s.mux.HandleFunc("/v1/health/resolve/", s.wrap(s.HealthResolveService))
 
 	s.mux.HandleFunc("/v1/agent/self", s.wrap(s.AgentSelf))
+	s.mux.HandleFunc("/v1/agent/metrics", s.wrap(s.AgentMetrics))
+	s.mux.HandleFunc("/v1/agent/slow-queries", s.wrap(s.AgentSlowQueries))
 	s.mux.HandleFunc("/v1/agent/maintenance", s.wrap(s.AgentNodeMaintenance))
 	s.mux.HandleFunc("/v1/agent/services", s.wrap(s.AgentServices))
 	s.mux.HandleFunc("/v1/agent/checks", s.wrap(s.AgentChecks))
@@ -240,6 +296,27 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 	s.mux.HandleFunc("/v1/session/info/", s.wrap(s.SessionGet))
 	s.mux.HandleFunc("/v1/session/node/", s.wrap(s.SessionsForNode))
 	s.mux.HandleFunc("/v1/session/list", s.wrap(s.SessionList))
+	s.mux.HandleFunc("/v1/session/expiring", s.wrap(s.SessionExpiring))
+
+	s.mux.HandleFunc("/v1/operator/state", s.wrap(s.OperatorState))
+	s.mux.HandleFunc("/v1/operator/state/verify", s.wrap(s.OperatorStateVerify))
+	s.mux.HandleFunc("/v1/operator/keyring", s.wrap(s.OperatorKeyring))
+	s.mux.HandleFunc("/v1/operator/raft/configuration", s.wrap(s.OperatorRaftConfiguration))
+	s.mux.HandleFunc("/v1/operator/raft/peer", s.wrap(s.OperatorRaftPeer))
+	s.mux.HandleFunc("/v1/operator/autopilot/configuration", s.wrap(s.OperatorAutopilotConfiguration))
+	s.mux.HandleFunc("/v1/operator/auto-encrypt/token", s.wrap(s.OperatorAutoEncryptToken))
+	s.mux.HandleFunc("/v1/operator/area", s.wrap(s.OperatorAreas))
+	s.mux.HandleFunc("/v1/operator/area/", s.wrap(s.OperatorArea))
+
+	s.mux.HandleFunc("/v1/peering/token", s.wrap(s.PeeringGenerateToken))
+	s.mux.HandleFunc("/v1/peering/establish", s.wrap(s.PeeringEstablish))
+	s.mux.HandleFunc("/v1/peering/", s.wrap(s.PeeringEndpoint))
+	s.mux.HandleFunc("/v1/peerings", s.wrap(s.PeeringList))
+	s.mux.HandleFunc("/v1/exported-services", s.wrap(s.ExportedServices))
+
+	s.mux.HandleFunc("/v1/snapshot", s.wrap(s.Snapshot))
+
+	s.mux.HandleFunc("/v1/txn", s.wrap(s.Txn))
 
 	if s.agent.config.ACLDatacenter != "" {
 		s.mux.HandleFunc("/v1/acl/create", s.wrap(s.ACLCreate))
@@ -248,6 +325,8 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 		s.mux.HandleFunc("/v1/acl/info/", s.wrap(s.ACLGet))
 		s.mux.HandleFunc("/v1/acl/clone/", s.wrap(s.ACLClone))
 		s.mux.HandleFunc("/v1/acl/list", s.wrap(s.ACLList))
+		s.mux.HandleFunc("/v1/acl/explain", s.wrap(s.ACLExplain))
+		s.mux.HandleFunc("/v1/acl/replication", s.wrap(s.ACLReplicationStatus))
 	} else {
 		s.mux.HandleFunc("/v1/acl/create", s.wrap(aclDisabled))
 		s.mux.HandleFunc("/v1/acl/update", s.wrap(aclDisabled))
@@ -255,6 +334,8 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 		s.mux.HandleFunc("/v1/acl/info/", s.wrap(aclDisabled))
 		s.mux.HandleFunc("/v1/acl/clone/", s.wrap(aclDisabled))
 		s.mux.HandleFunc("/v1/acl/list", s.wrap(aclDisabled))
+		s.mux.HandleFunc("/v1/acl/explain", s.wrap(aclDisabled))
+		s.mux.HandleFunc("/v1/acl/replication", s.wrap(aclDisabled))
 	}
 
 	if enableDebug {
@@ -274,6 +355,7 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 	s.mux.HandleFunc("/v1/internal/ui/nodes", s.wrap(s.UINodes))
 	s.mux.HandleFunc("/v1/internal/ui/node/", s.wrap(s.UINodeInfo))
 	s.mux.HandleFunc("/v1/internal/ui/services", s.wrap(s.UIServices))
+	s.mux.HandleFunc("/v1/internal/watches", s.wrap(s.InternalWatchStats))
 }
 
 // wrap is used to wrap functions to make them more convenient
@@ -299,6 +381,13 @@ func (s *HTTPServer) wrap(handler func(resp http.ResponseWriter, req *http.Reque
 			}
 		}
 
+		// Record the mutating requests in the audit log
+		if s.agent.auditLog != nil && req.Method != "GET" && req.Method != "HEAD" {
+			rec := &statusRecorder{ResponseWriter: resp}
+			resp = rec
+			defer s.audit(req, rec)
+		}
+
 		// Invoke the handler
 		start := time.Now()
 		defer func() {
@@ -315,6 +404,10 @@ func (s *HTTPServer) wrap(handler func(resp http.ResponseWriter, req *http.Reque
 			if strings.Contains(errMsg, "Permission denied") || strings.Contains(errMsg, "ACL not found") {
 				code = 403
 			}
+			if strings.Contains(errMsg, structs.ErrRPCRateLimited.Error()) {
+				resp.Header().Set("Retry-After", "1")
+				code = 429
+			}
 			resp.WriteHeader(code)
 			resp.Write([]byte(err.Error()))
 			return
@@ -336,12 +429,102 @@ func (s *HTTPServer) wrap(handler func(resp http.ResponseWriter, req *http.Reque
 				goto HAS_ERR
 			}
 			resp.Header().Set("Content-Type", "application/json")
-			resp.Write(buf)
+			writeBody(resp, req, buf)
 		}
 	}
 	return f
 }
 
+// statusRecorder records the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(buf []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	return r.ResponseWriter.Write(buf)
+}
+
+// audit records a mutating request and its status in the audit log
+func (s *HTTPServer) audit(req *http.Request, rec *statusRecorder) {
+	var token string
+	s.parseToken(req, &token)
+	status := rec.status
+	if status == 0 {
+		status = 200
+	}
+	event := &audit.Event{
+		Type:      "http",
+		Source:    req.RemoteAddr,
+		Accessor:  audit.Accessor(token),
+		Operation: req.Method + " " + req.URL.Path,
+		Result:    "ok",
+		Status:    status,
+	}
+	if status >= 400 {
+		event.Result = "error"
+	}
+	if err := s.agent.auditLog.Log(event); err != nil {
+		s.logger.Printf("[ERR] http: Failed to write audit event: %v", err)
+	}
+}
+
+// writeBody writes a response body, gzip encoded if it is large enough
+// and the client accepts it
+func writeBody(resp http.ResponseWriter, req *http.Request, buf []byte) {
+	resp.Header().Add("Vary", "Accept-Encoding")
+	if len(buf) < gzipMinSize || !acceptsGzip(req) {
+		resp.Write(buf)
+		return
+	}
+
+	resp.Header().Set("Content-Encoding", "gzip")
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+	gz.Reset(resp)
+	gz.Write(buf)
+	gz.Close()
+}
+
+// acceptsGzip returns if the Accept-Encoding header of a request allows
+// a gzip encoded response. An explicit gzip entry takes precedence over
+// the wildcard, and a zero quality refuses the encoding.
+func acceptsGzip(req *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
 // Renders a simple index page
 func (s *HTTPServer) Index(resp http.ResponseWriter, req *http.Request) {
 	// Check if this is a non-index path
@@ -402,6 +585,12 @@ func setMeta(resp http.ResponseWriter, m *structs.QueryMeta) {
 	setIndex(resp, m.Index)
 	setLastContact(resp, m.LastContact)
 	setKnownLeader(resp, m.KnownLeader)
+	if m.IndexLag != 0 {
+		resp.Header().Set("X-Consul-IndexLag", strconv.FormatUint(m.IndexLag, 10))
+	}
+	if m.NextToken != "" {
+		resp.Header().Set("X-Consul-NextToken", m.NextToken)
+	}
 }
 
 // setHeaders is used to set canonical response header fields
@@ -436,8 +625,8 @@ func parseWait(resp http.ResponseWriter, req *http.Request, b *structs.QueryOpti
 	return false
 }
 
-// parseConsistency is used to parse the ?stale and ?consistent query params.
-// Returns true on error
+// parseConsistency is used to parse the ?stale, ?consistent and ?applied
+// query params. Returns true on error
 func parseConsistency(resp http.ResponseWriter, req *http.Request, b *structs.QueryOptions) bool {
 	query := req.URL.Query()
 	if _, ok := query["stale"]; ok {
@@ -446,6 +635,35 @@ func parseConsistency(resp http.ResponseWriter, req *http.Request, b *structs.Qu
 	if _, ok := query["consistent"]; ok {
 		b.RequireConsistent = true
 	}
+	if idx := query.Get("applied"); idx != "" {
+		index, err := strconv.ParseUint(idx, 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid applied index"))
+			return true
+		}
+		b.MinAppliedIndex = index
+	}
+	if max := query.Get("max_stale"); max != "" {
+		dur, err := time.ParseDuration(max)
+		if err != nil || dur < 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid max_stale value"))
+			return true
+		}
+		b.AllowStale = true
+		b.MaxStaleDuration = dur
+	}
+	if max := query.Get("max_stale_index"); max != "" {
+		index, err := strconv.ParseUint(max, 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid max_stale_index value"))
+			return true
+		}
+		b.AllowStale = true
+		b.MaxStaleIndex = index
+	}
 	if b.AllowStale && b.RequireConsistent {
 		resp.WriteHeader(400)
 		resp.Write([]byte("Cannot specify ?stale with ?consistent, conflicting semantics."))
@@ -454,6 +672,76 @@ func parseConsistency(resp http.ResponseWriter, req *http.Request, b *structs.Qu
 	return false
 }
 
+// parseSort is used to parse the ?sort query param. Returns true on error
+func parseSort(resp http.ResponseWriter, req *http.Request, b *structs.QueryOptions) bool {
+	by := req.URL.Query().Get("sort")
+	if !structs.ValidSortBy(by) {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Invalid sort key"))
+		return true
+	}
+	b.SortBy = by
+	return false
+}
+
+// parsePage is used to parse the ?limit and ?next-token query params of
+// the paginated endpoints. Returns true on error
+func parsePage(resp http.ResponseWriter, req *http.Request, b *structs.QueryOptions) bool {
+	query := req.URL.Query()
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid limit"))
+			return true
+		}
+		b.Limit = limit
+	}
+	b.NextToken = query.Get("next-token")
+	return false
+}
+
+// setWriteIndex is used to return the index of a completed write when
+// the ?index query param is provided. The index can be passed to a
+// stale read with ?applied, so the read observes the write.
+func (s *HTTPServer) setWriteIndex(resp http.ResponseWriter, req *http.Request, dc string) error {
+	if _, ok := req.URL.Query()["index"]; !ok {
+		return nil
+	}
+	args := structs.DCSpecificRequest{Datacenter: dc}
+	var index uint64
+	if err := s.agent.RPC("Status.AppliedIndex", &args, &index); err != nil {
+		return err
+	}
+	setIndex(resp, index)
+	return nil
+}
+
+// cachedRPC makes a read RPC, through the agent cache with the ?cached
+// query param. Blocking and consistent queries always go to the servers.
+// The X-Cache header tells if the reply was cached, and Age its age in
+// seconds.
+func (s *HTTPServer) cachedRPC(resp http.ResponseWriter, req *http.Request, method string,
+	args interface{}, opts *structs.QueryOptions, reply interface{}) error {
+	_, cached := req.URL.Query()["cached"]
+	if !cached || s.agent.cache == nil || opts.MinQueryIndex != 0 ||
+		opts.MinAppliedIndex != 0 || opts.RequireConsistent {
+		return s.agent.RPC(method, args, reply)
+	}
+
+	hit, age, err := s.agent.cache.Get(method, args, reply)
+	if err != nil {
+		return err
+	}
+	if hit {
+		resp.Header().Set("X-Cache", "HIT")
+		resp.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	} else {
+		resp.Header().Set("X-Cache", "MISS")
+	}
+	return nil
+}
+
 // parseDC is used to parse the ?dc query param
 func (s *HTTPServer) parseDC(req *http.Request, dc *string) {
 	if other := req.URL.Query().Get("dc"); other != "" {
@@ -470,6 +758,12 @@ func (s *HTTPServer) parseToken(req *http.Request, token *string) {
 		return
 	}
 
+	// Use the token of the client certificate, if mapped to one
+	if other, ok := s.certToken(req); ok {
+		*token = other
+		return
+	}
+
 	// Set the AtlasACLToken if SCADA
 	if s.addr == scadaHTTPAddr && s.agent.config.AtlasACLToken != "" {
 		*token = s.agent.config.AtlasACLToken
@@ -488,5 +782,8 @@ func (s *HTTPServer) parse(resp http.ResponseWriter, req *http.Request, dc *stri
 	if parseConsistency(resp, req, b) {
 		return true
 	}
+	if parseSort(resp, req, b) {
+		return true
+	}
 	return parseWait(resp, req, b)
 }
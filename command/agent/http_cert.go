@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/tlsutil"
+)
+
+// certTokenRule maps the identities of the verified client certificates
+// of the HTTPS API to an ACL token. A rule matches a field of the
+// certificate exactly, or by prefix if its value ends with "*".
+type certTokenRule struct {
+	field  string
+	value  string
+	prefix bool
+	token  string
+}
+
+// certFields returns the values of a field of a certificate
+var certFields = map[string]func(cert *x509.Certificate) []string{
+	"cn": func(cert *x509.Certificate) []string {
+		return []string{cert.Subject.CommonName}
+	},
+	"ou": func(cert *x509.Certificate) []string {
+		return cert.Subject.OrganizationalUnit
+	},
+	"dns": func(cert *x509.Certificate) []string {
+		return cert.DNSNames
+	},
+	"email": func(cert *x509.Certificate) []string {
+		return cert.EmailAddresses
+	},
+}
+
+// compileCertTokens parses the rules of the https_cert_tokens, keyed by
+// "<field>:<value>" with a field of cn, ou, dns or email. The rules are
+// returned from the most specific: the exact matches first, then the
+// longest prefixes.
+func compileCertTokens(raw map[string]string) ([]*certTokenRule, error) {
+	var rules []*certTokenRule
+	for key, token := range raw {
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid certificate rule %q, must be <field>:<value>", key)
+		}
+		field := strings.ToLower(parts[0])
+		if _, ok := certFields[field]; !ok {
+			return nil, fmt.Errorf("Invalid certificate rule %q, unknown field %q", key, parts[0])
+		}
+		rule := &certTokenRule{field: field, value: parts[1], token: token}
+		if strings.HasSuffix(rule.value, "*") {
+			rule.value = strings.TrimSuffix(rule.value, "*")
+			rule.prefix = true
+		}
+		if field == "ou" && (rule.value == tlsutil.AutoEncryptOU ||
+			rule.prefix && strings.HasPrefix(tlsutil.AutoEncryptOU, rule.value)) {
+			return nil, fmt.Errorf("Invalid certificate rule %q, auto-encrypt certificates can't be mapped to a token", key)
+		}
+		rules = append(rules, rule)
+	}
+	sort.Sort(certTokenRules(rules))
+	return rules, nil
+}
+
+// matches returns if the rule matches a certificate
+func (r *certTokenRule) matches(cert *x509.Certificate) bool {
+	for _, value := range certFields[r.field](cert) {
+		if value == r.value || (r.prefix && strings.HasPrefix(value, r.value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// certTokenRules sorts the rules from the most specific
+type certTokenRules []*certTokenRule
+
+func (s certTokenRules) Len() int      { return len(s) }
+func (s certTokenRules) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s certTokenRules) Less(i, j int) bool {
+	if s[i].prefix != s[j].prefix {
+		return !s[i].prefix
+	}
+	if len(s[i].value) != len(s[j].value) {
+		return len(s[i].value) > len(s[j].value)
+	}
+	if s[i].field != s[j].field {
+		return s[i].field < s[j].field
+	}
+	return s[i].value < s[j].value
+}
+
+// certToken returns the ACL token of the verified client certificate of a
+// request, if any rule matches it. The certificates the servers signed
+// with auto-encrypt never match, since any agent can obtain one for the
+// node name it chooses.
+func (s *HTTPServer) certToken(req *http.Request) (string, bool) {
+	if len(s.certTokens) == 0 || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if ou == tlsutil.AutoEncryptOU {
+			return "", false
+		}
+	}
+	for _, rule := range s.certTokens {
+		if rule.matches(cert) {
+			return rule.token, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/consul/tlsutil"
+)
+
+func TestCompileCertTokens(t *testing.T) {
+	for _, key := range []string{"Alice", "cn:", "serial:1234", "ou:consul-auto-encrypt", "ou:consul*"} {
+		if _, err := compileCertTokens(map[string]string{key: "token"}); err == nil {
+			t.Fatalf("expected error for %q", key)
+		}
+	}
+
+	rules, err := compileCertTokens(map[string]string{
+		"cn:A*":                 "short",
+		"cn:Ali*":               "long",
+		"dns:server.dc1.consul": "exact",
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var tokens []string
+	for _, rule := range rules {
+		tokens = append(tokens, rule.token)
+	}
+	if len(tokens) != 3 || tokens[0] != "exact" || tokens[1] != "long" || tokens[2] != "short" {
+		t.Fatalf("bad: %v", tokens)
+	}
+}
+
+func TestHTTPServer_certToken(t *testing.T) {
+	data, err := ioutil.ReadFile("../../test/hostname/Alice.crt")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rules, err := compileCertTokens(map[string]string{
+		"cn:Ali*": "alice",
+		"cn:Bob":  "bob",
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	srv := &HTTPServer{agent: &Agent{config: &Config{ACLToken: "default"}}, certTokens: rules}
+
+	req, _ := http.NewRequest("GET", "/v1/kv/foo", nil)
+	var token string
+	srv.parseToken(req, &token)
+	if token != "default" {
+		t.Fatalf("bad: %s", token)
+	}
+
+	// Only a verified certificate is mapped
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	srv.parseToken(req, &token)
+	if token != "default" {
+		t.Fatalf("bad: %s", token)
+	}
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	srv.parseToken(req, &token)
+	if token != "alice" {
+		t.Fatalf("bad: %s", token)
+	}
+
+	// The ?token wins over the certificate
+	req, _ = http.NewRequest("GET", "/v1/kv/foo?token=other", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	srv.parseToken(req, &token)
+	if token != "other" {
+		t.Fatalf("bad: %s", token)
+	}
+}
+
+func TestHTTPServer_certToken_AutoEncrypt(t *testing.T) {
+	rules, err := compileCertTokens(map[string]string{"cn:Alice": "alice"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	srv := &HTTPServer{agent: &Agent{config: &Config{ACLToken: "default"}}, certTokens: rules}
+
+	// A certificate signed with auto-encrypt for the name of a rule
+	// doesn't get its token
+	cert := &x509.Certificate{Subject: pkix.Name{
+		CommonName:         "Alice",
+		OrganizationalUnit: []string{tlsutil.AutoEncryptOU},
+	}}
+	req, _ := http.NewRequest("GET", "/v1/kv/foo", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	var token string
+	srv.parseToken(req, &token)
+	if token != "default" {
+		t.Fatalf("bad: %s", token)
+	}
+
+	cert.Subject.OrganizationalUnit = nil
+	srv.parseToken(req, &token)
+	if token != "alice" {
+		t.Fatalf("bad: %s", token)
+	}
+}
@@ -2,6 +2,8 @@ package agent
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -117,6 +119,59 @@ func TestHTTPServer_UnixSocket(t *testing.T) {
 	}
 }
 
+func TestHTTPServer_UnixSocket_HTTPS(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+
+	tempDir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	socket := filepath.Join(tempDir, "test.sock")
+
+	dir, srv := makeHTTPServerWithConfig(t, func(c *Config) {
+		c.Ports.HTTP = -1
+		c.Ports.HTTPS = 1
+		c.Addresses.HTTPS = "unix://" + socket
+		c.CertFile = "../../test/key/ourdomain.cer"
+		c.KeyFile = "../../test/key/ourdomain.key"
+		c.UnixSockets = UnixSocketConfig{}
+		c.UnixSockets.Perms = "0700"
+	})
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if fi.Mode().String() != "Srwx------" {
+		t.Fatalf("bad permissions: %s", fi.Mode())
+	}
+
+	// Talk TLS over the socket
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("https://127.0.0.1/v1/agent/self")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if body, err := ioutil.ReadAll(resp.Body); err != nil || len(body) == 0 {
+		t.Fatalf("bad: %s %v", body, err)
+	}
+}
+
 func TestHTTPServer_UnixSocket_FileExists(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.SkipNow()
@@ -276,6 +331,66 @@ func TestContentTypeIsJSON(t *testing.T) {
 	}
 }
 
+func TestHTTP_wrap_gzip(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	large := &structs.DirEntry{Key: "key", Value: bytes.Repeat([]byte("a"), 2*gzipMinSize)}
+	small := &structs.DirEntry{Key: "key"}
+	get := func(obj interface{}, encoding string) *httptest.ResponseRecorder {
+		handler := func(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+			return obj, nil
+		}
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/kv/key", nil)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		srv.wrap(handler)(resp, req)
+		return resp
+	}
+
+	// Large responses are compressed
+	resp := get(large, "deflate, gzip")
+	if resp.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("bad: %v", resp.Header())
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	actual, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected, _ := json.Marshal(large)
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("bad: %q", string(actual))
+	}
+
+	// Small responses, and clients refusing gzip, are not
+	for _, tc := range []struct {
+		obj      interface{}
+		encoding string
+	}{
+		{small, "gzip"},
+		{large, ""},
+		{large, "deflate"},
+		{large, "gzip;q=0, *"},
+	} {
+		resp := get(tc.obj, tc.encoding)
+		if enc := resp.Header().Get("Content-Encoding"); enc != "" {
+			t.Fatalf("bad: %q %v", tc.encoding, enc)
+		}
+		expected, _ := json.Marshal(tc.obj)
+		if !bytes.Equal(expected, resp.Body.Bytes()) {
+			t.Fatalf("bad: %q", resp.Body.String())
+		}
+	}
+}
+
 func TestHTTP_wrap_obfuscateLog(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -455,6 +570,66 @@ func TestParseConsistency_Invalid(t *testing.T) {
 	}
 }
 
+func TestParseConsistency_MaxStale(t *testing.T) {
+	resp := httptest.NewRecorder()
+	var b structs.QueryOptions
+
+	req, err := http.NewRequest("GET",
+		"/v1/catalog/nodes?max_stale=5s&max_stale_index=100", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseConsistency(resp, req, &b); d {
+		t.Fatalf("unexpected done")
+	}
+	if !b.AllowStale || b.MaxStaleDuration != 5*time.Second || b.MaxStaleIndex != 100 {
+		t.Fatalf("bad: %v", b)
+	}
+
+	// Bounded staleness conflicts with consistent reads
+	b = structs.QueryOptions{}
+	req, err = http.NewRequest("GET",
+		"/v1/catalog/nodes?max_stale=5s&consistent", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseConsistency(resp, req, &b); !d {
+		t.Fatalf("expected done")
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad code: %v", resp.Code)
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	resp := httptest.NewRecorder()
+	var b structs.QueryOptions
+
+	req, err := http.NewRequest("GET",
+		"/v1/session/list?sort=create_index", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseSort(resp, req, &b); d {
+		t.Fatalf("unexpected done")
+	}
+	if b.SortBy != structs.SortByCreateIndex {
+		t.Fatalf("Bad: %v", b)
+	}
+
+	req, err = http.NewRequest("GET",
+		"/v1/session/list?sort=nope", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := parseSort(resp, req, &b); !d {
+		t.Fatalf("expected done")
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad code: %v", resp.Code)
+	}
+}
+
 // Test ACL token is resolved in correct order
 func TestACLResolution(t *testing.T) {
 	var token string
@@ -0,0 +1,437 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// kvReplicationPrefix is the prefix of the keys used by the KV
+	// replication, which are never replicated
+	kvReplicationPrefix = "_replicate/"
+
+	// kvReplicationLockKey is locked by the agent replicating, so only
+	// one of the agents configured to replicate does
+	kvReplicationLockKey = kvReplicationPrefix + "leader"
+
+	// kvReplicationStatusPrefix is followed by a replicated prefix, and
+	// holds the index of the source datacenter last replicated for it,
+	// so a new leader resumes where the previous one stopped
+	kvReplicationStatusPrefix = kvReplicationPrefix + "status/"
+
+	// kvReplicationBatch is the most operations of a transaction
+	kvReplicationBatch = 64
+
+	// kvReplicationRetry is how long to wait after a failure, doubled
+	// with each consecutive failure up to kvReplicationMaxRetry
+	kvReplicationRetry    = 5 * time.Second
+	kvReplicationMaxRetry = 2 * time.Minute
+)
+
+// kvReplication mirrors the KV prefixes of a source datacenter into the
+// local datacenter. The agents configured to replicate elect a leader
+// with a session lock, and only the leader replicates, with one blocking
+// query per prefix. The changes are applied with transactions, so the
+// local prefixes are never seen half replicated within a batch.
+type kvReplication struct {
+	agent    *Agent
+	source   string
+	prefixes []string
+	token    string
+}
+
+// startKVReplication starts the KV replication if it is configured
+func (a *Agent) startKVReplication() {
+	if a.config.KVReplicationSource == "" {
+		return
+	}
+	r := &kvReplication{
+		agent:    a,
+		source:   a.config.KVReplicationSource,
+		prefixes: a.config.KVReplicationPrefixes,
+		token:    a.config.KVReplicationToken,
+	}
+	if r.token == "" {
+		r.token = a.config.ACLToken
+	}
+	go r.run()
+}
+
+// run campaigns for the lock until the agent shuts down, and replicates
+// while it is held
+func (r *kvReplication) run() {
+	logger := r.agent.logger
+	shutdownCh := r.agent.shutdownCh
+	retry := kvReplicationRetry
+	for {
+		session, err := r.acquire(shutdownCh)
+		if err != nil {
+			logger.Printf("[ERR] agent: failed to acquire the KV replication lock: %v", err)
+			select {
+			case <-time.After(retry):
+			case <-shutdownCh:
+				return
+			}
+			if retry *= 2; retry > kvReplicationMaxRetry {
+				retry = kvReplicationMaxRetry
+			}
+			continue
+		}
+		if session == "" {
+			return
+		}
+
+		retry = kvReplicationRetry
+		logger.Printf("[INFO] agent: acquired the KV replication lock, replicating %v from %s",
+			r.prefixes, r.source)
+		r.lead(session)
+		logger.Printf("[INFO] agent: stopped replicating KV from %s", r.source)
+		r.destroySession(session)
+	}
+}
+
+// acquire creates a session and locks the leader key with it, waiting
+// for the key to be released while another agent holds it. It returns
+// an empty session if the agent shut down first.
+func (r *kvReplication) acquire(shutdownCh chan struct{}) (string, error) {
+	a := r.agent
+	create := structs.SessionRequest{
+		Datacenter: a.config.Datacenter,
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Name:      "KV replication",
+			Node:      a.config.NodeName,
+			Checks:    []string{consul.SerfCheckID},
+			LockDelay: 15 * time.Second,
+			Behavior:  structs.SessionKeysRelease,
+		},
+	}
+	create.Token = r.token
+	var session string
+	if err := a.RPC("Session.Apply", &create, &session); err != nil {
+		return "", err
+	}
+
+	var index uint64
+	for {
+		lock := structs.KVSRequest{
+			Datacenter: a.config.Datacenter,
+			Op:         structs.KVSLock,
+			DirEnt: structs.DirEntry{
+				Key:     kvReplicationLockKey,
+				Value:   []byte(a.config.NodeName),
+				Session: session,
+			},
+		}
+		lock.Token = r.token
+		var locked bool
+		if err := a.RPC("KVS.Apply", &lock, &locked); err != nil {
+			r.destroySession(session)
+			return "", err
+		}
+		if locked {
+			return session, nil
+		}
+
+		// Wait for the holder to release the lock. A released lock may
+		// still be in its lock delay, so it is retried with a pause.
+		holder, meta, err := r.getLock(index)
+		if err != nil {
+			r.destroySession(session)
+			return "", err
+		}
+		index = meta.Index
+		var wait <-chan time.Time
+		if holder == "" {
+			wait = time.After(time.Second)
+		} else {
+			wait = time.After(0)
+		}
+		select {
+		case <-wait:
+		case <-shutdownCh:
+			r.destroySession(session)
+			return "", nil
+		}
+	}
+}
+
+// getLock returns the session holding the leader key, waiting for it to
+// change past the given index
+func (r *kvReplication) getLock(index uint64) (string, structs.QueryMeta, error) {
+	a := r.agent
+	get := structs.KeyRequest{
+		Datacenter: a.config.Datacenter,
+		Key:        kvReplicationLockKey,
+		QueryOptions: structs.QueryOptions{
+			Token:         r.token,
+			MinQueryIndex: index,
+		},
+	}
+	var out structs.IndexedDirEntries
+	if err := a.RPC("KVS.Get", &get, &out); err != nil {
+		return "", out.QueryMeta, err
+	}
+	if len(out.Entries) == 0 {
+		return "", out.QueryMeta, nil
+	}
+	return out.Entries[0].Session, out.QueryMeta, nil
+}
+
+// destroySession destroys the session of the lock, which releases it
+func (r *kvReplication) destroySession(session string) {
+	a := r.agent
+	destroy := structs.SessionRequest{
+		Datacenter: a.config.Datacenter,
+		Op:         structs.SessionDestroy,
+		Session:    structs.Session{ID: session},
+	}
+	destroy.Token = r.token
+	var out string
+	if err := a.RPC("Session.Apply", &destroy, &out); err != nil {
+		a.logger.Printf("[WARN] agent: failed to destroy the KV replication session: %v", err)
+	}
+}
+
+// lead replicates the prefixes until the lock is lost or the agent shuts
+// down
+func (r *kvReplication) lead(session string) {
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, prefix := range r.prefixes {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			r.replicatePrefix(prefix, stopCh)
+		}(prefix)
+	}
+
+	r.watchLock(session)
+	close(stopCh)
+	wg.Wait()
+}
+
+// watchLock returns once the session no longer holds the lock, or the
+// agent shuts down
+func (r *kvReplication) watchLock(session string) {
+	var index uint64
+	for {
+		holder, meta, err := r.getLock(index)
+		if err == nil && holder != session {
+			r.agent.logger.Printf("[WARN] agent: lost the KV replication lock")
+			return
+		}
+		if err != nil {
+			r.agent.logger.Printf("[ERR] agent: failed to check the KV replication lock: %v", err)
+			index = 0
+		} else {
+			index = meta.Index
+		}
+		select {
+		case <-r.agent.shutdownCh:
+			return
+		default:
+		}
+		if err != nil {
+			select {
+			case <-time.After(kvReplicationRetry):
+			case <-r.agent.shutdownCh:
+				return
+			}
+		}
+	}
+}
+
+// replicatePrefix mirrors a prefix until stopCh is closed
+func (r *kvReplication) replicatePrefix(prefix string, stopCh chan struct{}) {
+	logger := r.agent.logger
+	retry := kvReplicationRetry
+	index, err := r.replicatedIndex(prefix)
+	if err != nil {
+		logger.Printf("[WARN] agent: failed to read the replicated index of '%s', replicating it fully: %v",
+			prefix, err)
+	}
+	for {
+		next, err := r.replicateOnce(prefix, index, stopCh)
+		if err == nil {
+			index = next
+			retry = kvReplicationRetry
+			select {
+			case <-stopCh:
+				return
+			default:
+				continue
+			}
+		}
+
+		logger.Printf("[ERR] agent: failed to replicate '%s' from %s: %v", prefix, r.source, err)
+		metrics.IncrCounter([]string{"consul", "kv", "replication", "error"}, 1)
+		select {
+		case <-time.After(retry):
+		case <-stopCh:
+			return
+		}
+		if retry *= 2; retry > kvReplicationMaxRetry {
+			retry = kvReplicationMaxRetry
+		}
+	}
+}
+
+// replicateOnce waits for the prefix to change in the source datacenter
+// past the given index, and applies the changes locally. It returns the
+// index of the source datacenter replicated.
+func (r *kvReplication) replicateOnce(prefix string, index uint64, stopCh chan struct{}) (uint64, error) {
+	a := r.agent
+	list := structs.KeyRequest{
+		Datacenter: r.source,
+		Key:        prefix,
+		QueryOptions: structs.QueryOptions{
+			Token:         r.token,
+			MinQueryIndex: index,
+			AllowStale:    true,
+		},
+	}
+	var remote structs.IndexedDirEntries
+	if err := a.RPC("KVS.List", &list, &remote); err != nil {
+		return 0, err
+	}
+	select {
+	case <-stopCh:
+		return index, nil
+	default:
+	}
+	if remote.Index == index {
+		return index, nil
+	}
+	start := time.Now()
+
+	list.Datacenter = a.config.Datacenter
+	list.MinQueryIndex = 0
+	list.AllowStale = false
+	var local structs.IndexedDirEntries
+	if err := a.RPC("KVS.List", &list, &local); err != nil {
+		return 0, err
+	}
+
+	ops := diffKVReplication(local.Entries, remote.Entries)
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > kvReplicationBatch {
+			n = kvReplicationBatch
+		}
+		txn := structs.TxnRequest{
+			Datacenter: a.config.Datacenter,
+			Ops:        ops[:n],
+		}
+		txn.Token = r.token
+		var out structs.TxnResponse
+		if err := a.RPC("Txn.Apply", &txn, &out); err != nil {
+			return 0, err
+		}
+		if len(out.Errors) > 0 {
+			return 0, fmt.Errorf("transaction failed: %v", out.Errors[0])
+		}
+		ops = ops[n:]
+	}
+
+	if err := r.setReplicatedIndex(prefix, remote.Index); err != nil {
+		return 0, err
+	}
+
+	// The lag is how stale the source server was, plus how long the
+	// changes took to apply
+	lag := remote.LastContact + time.Since(start)
+	metrics.SetGauge([]string{"consul", "kv", "replication", "lag"},
+		float32(lag.Nanoseconds())/float32(time.Millisecond))
+	metrics.MeasureSince([]string{"consul", "kv", "replication", "apply"}, start)
+	return remote.Index, nil
+}
+
+// replicatedIndex returns the index last replicated for a prefix
+func (r *kvReplication) replicatedIndex(prefix string) (uint64, error) {
+	a := r.agent
+	get := structs.KeyRequest{
+		Datacenter:   a.config.Datacenter,
+		Key:          kvReplicationStatusPrefix + prefix,
+		QueryOptions: structs.QueryOptions{Token: r.token},
+	}
+	var out structs.IndexedDirEntries
+	if err := a.RPC("KVS.Get", &get, &out); err != nil {
+		return 0, err
+	}
+	if len(out.Entries) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(out.Entries[0].Value), 10, 64)
+}
+
+// setReplicatedIndex records the index last replicated for a prefix
+func (r *kvReplication) setReplicatedIndex(prefix string, index uint64) error {
+	a := r.agent
+	set := structs.KVSRequest{
+		Datacenter: a.config.Datacenter,
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   kvReplicationStatusPrefix + prefix,
+			Value: []byte(strconv.FormatUint(index, 10)),
+		},
+	}
+	set.Token = r.token
+	var out bool
+	return a.RPC("KVS.Apply", &set, &out)
+}
+
+// diffKVReplication returns the operations turning the local entries of
+// a prefix into the remote ones. The locks aren't replicated, since the
+// sessions are local to a datacenter, and the keys of the replication
+// itself are left alone.
+func diffKVReplication(local, remote structs.DirEntries) structs.TxnOps {
+	existing := make(map[string]*structs.DirEntry, len(local))
+	for _, ent := range local {
+		existing[ent.Key] = ent
+	}
+
+	var ops structs.TxnOps
+	for _, ent := range remote {
+		if strings.HasPrefix(ent.Key, kvReplicationPrefix) {
+			continue
+		}
+		l, ok := existing[ent.Key]
+		delete(existing, ent.Key)
+		if ok && l.Flags == ent.Flags && bytes.Equal(l.Value, ent.Value) {
+			continue
+		}
+		ops = append(ops, &structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb: structs.KVSSet,
+				DirEnt: structs.DirEntry{
+					Key:   ent.Key,
+					Flags: ent.Flags,
+					Value: ent.Value,
+				},
+			},
+		})
+	}
+
+	// Deleted in the order they were listed
+	for _, ent := range local {
+		if _, ok := existing[ent.Key]; !ok || strings.HasPrefix(ent.Key, kvReplicationPrefix) {
+			continue
+		}
+		ops = append(ops, &structs.TxnOp{
+			KV: &structs.TxnKVOp{
+				Verb:   structs.KVSDelete,
+				DirEnt: structs.DirEntry{Key: ent.Key},
+			},
+		})
+	}
+	return ops
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestDiffKVReplication(t *testing.T) {
+	local := structs.DirEntries{
+		&structs.DirEntry{Key: "g/same", Value: []byte("a"), ModifyIndex: 10},
+		&structs.DirEntry{Key: "g/changed", Value: []byte("a")},
+		&structs.DirEntry{Key: "g/flags", Value: []byte("a")},
+		&structs.DirEntry{Key: "g/gone", Value: []byte("a")},
+		&structs.DirEntry{Key: kvReplicationLockKey},
+	}
+	remote := structs.DirEntries{
+		&structs.DirEntry{Key: "g/same", Value: []byte("a"), ModifyIndex: 20},
+		&structs.DirEntry{Key: "g/changed", Value: []byte("b")},
+		&structs.DirEntry{Key: "g/flags", Value: []byte("a"), Flags: 42},
+		&structs.DirEntry{Key: "g/new", Value: []byte("c"), Session: "foo"},
+		&structs.DirEntry{Key: kvReplicationStatusPrefix + "g/"},
+	}
+
+	ops := diffKVReplication(local, remote)
+	expect := []struct {
+		verb structs.KVSOp
+		key  string
+	}{
+		{structs.KVSSet, "g/changed"},
+		{structs.KVSSet, "g/flags"},
+		{structs.KVSSet, "g/new"},
+		{structs.KVSDelete, "g/gone"},
+	}
+	if len(ops) != len(expect) {
+		t.Fatalf("bad: %#v", ops)
+	}
+	for i, e := range expect {
+		if ops[i].KV.Verb != e.verb || ops[i].KV.DirEnt.Key != e.key {
+			t.Fatalf("bad op %d: %#v", i, ops[i].KV)
+		}
+	}
+
+	// The flags are copied, the sessions aren't
+	if ops[1].KV.DirEnt.Flags != 42 {
+		t.Fatalf("bad: %#v", ops[1].KV)
+	}
+	if ops[2].KV.DirEnt.Session != "" || string(ops[2].KV.DirEnt.Value) != "c" {
+		t.Fatalf("bad: %#v", ops[2].KV)
+	}
+}
+
+func TestKVReplication(t *testing.T) {
+	dir1, agent1 := makeAgent(t, nextConfig())
+	defer os.RemoveAll(dir1)
+	defer agent1.Shutdown()
+
+	conf2 := nextConfig()
+	conf2.Datacenter = "dc2"
+	conf2.KVReplicationSource = "dc1"
+	conf2.KVReplicationPrefixes = []string{"global/"}
+	conf2.KVReplicationToken = "root"
+	dir2, agent2 := makeAgent(t, conf2)
+	defer os.RemoveAll(dir2)
+	defer agent2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", agent1.config.Ports.SerfWan)
+	if _, err := agent2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, agent1.RPC, "dc1")
+	testutil.WaitForLeader(t, agent2.RPC, "dc2")
+
+	apply := func(op structs.KVSOp, key, value string) {
+		args := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         op,
+			DirEnt:     structs.DirEntry{Key: key, Value: []byte(value)},
+		}
+		args.Token = "root"
+		var out bool
+		if err := agent1.RPC("KVS.Apply", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	get := func(key string) *structs.DirEntry {
+		args := structs.KeyRequest{Datacenter: "dc2", Key: key}
+		args.Token = "root"
+		var out structs.IndexedDirEntries
+		if err := agent2.RPC("KVS.Get", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Entries) == 0 {
+			return nil
+		}
+		return out.Entries[0]
+	}
+
+	apply(structs.KVSSet, "global/foo", "bar")
+	apply(structs.KVSSet, "local/foo", "bar")
+	testutil.WaitForResult(func() (bool, error) {
+		ent := get("global/foo")
+		return ent != nil && string(ent.Value) == "bar", fmt.Errorf("not replicated: %#v", ent)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if ent := get("local/foo"); ent != nil {
+		t.Fatalf("should not replicate: %#v", ent)
+	}
+
+	// The agent holds the lock and records its progress
+	if ent := get(kvReplicationLockKey); ent == nil || ent.Session == "" {
+		t.Fatalf("bad: %#v", ent)
+	}
+	if ent := get(kvReplicationStatusPrefix + "global/"); ent == nil {
+		t.Fatalf("missing status")
+	}
+
+	// Deletes are replicated
+	apply(structs.KVSDelete, "global/foo", "")
+	testutil.WaitForResult(func() (bool, error) {
+		ent := get("global/foo")
+		return ent == nil, fmt.Errorf("not deleted: %#v", ent)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
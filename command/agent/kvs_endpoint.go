@@ -60,13 +60,30 @@ func (s *HTTPServer) KVSGet(resp http.ResponseWriter, req *http.Request, args *s
 	params := req.URL.Query()
 	if _, ok := params["recurse"]; ok {
 		method = "KVS.List"
+		_, args.Glob = params["glob"]
 	} else if missingKey(resp, args) {
 		return nil, nil
 	}
 
-	// Make the RPC
+	// Make the RPC, reading from the KV history if an index is given
 	var out structs.IndexedDirEntries
-	if err := s.agent.RPC(method, &args, &out); err != nil {
+	if at := params.Get("at"); at != "" && method == "KVS.Get" {
+		index, err := strconv.ParseUint(at, 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid at index"))
+			return nil, nil
+		}
+		atArgs := structs.KeyAtIndexRequest{
+			Datacenter:   args.Datacenter,
+			Key:          args.Key,
+			AtIndex:      index,
+			QueryOptions: args.QueryOptions,
+		}
+		if err := s.agent.RPC("KVS.GetAtIndex", &atArgs, &out); err != nil {
+			return nil, err
+		}
+	} else if err := s.cachedRPC(resp, req, method, args, &args.QueryOptions, &out); err != nil {
 		return nil, err
 	}
 	setMeta(resp, &out.QueryMeta)
@@ -201,6 +218,9 @@ func (s *HTTPServer) KVSPut(resp http.ResponseWriter, req *http.Request, args *s
 	if err := s.agent.RPC("KVS.Apply", &applyReq, &out); err != nil {
 		return nil, err
 	}
+	if err := s.setWriteIndex(resp, req, applyReq.Datacenter); err != nil {
+		return nil, err
+	}
 
 	// Only use the out value if this was a CAS
 	if applyReq.Op == structs.KVSSet {
@@ -247,6 +267,9 @@ func (s *HTTPServer) KVSDelete(resp http.ResponseWriter, req *http.Request, args
 	if err := s.agent.RPC("KVS.Apply", &applyReq, &out); err != nil {
 		return nil, err
 	}
+	if err := s.setWriteIndex(resp, req, applyReq.Datacenter); err != nil {
+		return nil, err
+	}
 
 	// Only use the out value if this was a CAS
 	if applyReq.Op == structs.KVSDeleteCAS {
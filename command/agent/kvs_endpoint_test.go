@@ -88,6 +88,63 @@ func TestKVSEndpoint_PUT_GET_DELETE(t *testing.T) {
 	}
 }
 
+func TestKVSEndpoint_GET_AtIndex(t *testing.T) {
+	dir, srv := makeHTTPServerWithConfig(t, func(c *Config) {
+		c.KVHistoryVersions = 5
+	})
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	var indexes []uint64
+	for _, val := range []string{"one", "two"} {
+		req, err := http.NewRequest("PUT", "/v1/kv/test", bytes.NewBufferString(val))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := srv.KVSEndpoint(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req, err = http.NewRequest("GET", "/v1/kv/test", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		obj, err := srv.KVSEndpoint(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		indexes = append(indexes, obj.(structs.DirEntries)[0].ModifyIndex)
+	}
+
+	url := fmt.Sprintf("/v1/kv/test?at=%d&raw", indexes[0])
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	if _, err := srv.KVSEndpoint(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if body := resp.Body.String(); body != "one" {
+		t.Fatalf("bad: %q", body)
+	}
+
+	// An invalid index is rejected
+	req, err = http.NewRequest("GET", "/v1/kv/test?at=nope", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.KVSEndpoint(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad code: %d", resp.Code)
+	}
+}
+
 func TestKVSEndpoint_Recurse(t *testing.T) {
 	dir, srv := makeHTTPServer(t)
 	defer os.RemoveAll(dir)
@@ -573,3 +630,51 @@ func TestKVSEndpoint_DELETE_ConflictingFlags(t *testing.T) {
 		}
 	})
 }
+
+func TestKVSEndpoint_PUT_Index(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// The index is only returned if requested
+	req, err := http.NewRequest("PUT", "/v1/kv/test", bytes.NewBuffer([]byte("test")))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	if _, err := srv.KVSEndpoint(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx := resp.Header().Get("X-Consul-Index"); idx != "" {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	req, err = http.NewRequest("PUT", "/v1/kv/test?index", bytes.NewBuffer([]byte("test2")))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.KVSEndpoint(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+	idx := resp.Header().Get("X-Consul-Index")
+
+	// A stale read at the index observes the write
+	req, err = http.NewRequest("GET", "/v1/kv/test?stale&applied="+idx, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	obj, err := srv.KVSEndpoint(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res, ok := obj.(structs.DirEntries)
+	if !ok || len(res) != 1 || string(res[0].Value) != "test2" {
+		t.Fatalf("bad: %v", obj)
+	}
+}
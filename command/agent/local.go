@@ -9,6 +9,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul"
 	"github.com/hashicorp/consul/consul/structs"
 )
@@ -58,6 +59,17 @@ type localState struct {
 	// Used to track checks that are being deferred
 	deferCheck map[string]*time.Timer
 
+	// checkStreaks tracks the consecutive outcomes of the checks with
+	// flap thresholds
+	checkStreaks map[string]checkStreak
+
+	// remoteServices and remoteChecks mirror the services and checks of
+	// the node in the catalog as of remoteIndex. They are only updated
+	// by the anti-entropy routine, with the catalog diffs since then.
+	remoteServices map[string]*structs.NodeService
+	remoteChecks   map[string]*structs.HealthCheck
+	remoteIndex    uint64
+
 	// consulCh is used to inform of a change to the known
 	// consul nodes. This may be used to retry a sync run
 	consulCh chan struct{}
@@ -78,6 +90,9 @@ func (l *localState) Init(config *Config, logger *log.Logger) {
 	l.checkStatus = make(map[string]syncStatus)
 	l.checkTokens = make(map[string]string)
 	l.deferCheck = make(map[string]*time.Timer)
+	l.checkStreaks = make(map[string]checkStreak)
+	l.remoteServices = make(map[string]*structs.NodeService)
+	l.remoteChecks = make(map[string]*structs.HealthCheck)
 	l.consulCh = make(chan struct{}, 1)
 	l.triggerCh = make(chan struct{}, 1)
 }
@@ -216,6 +231,7 @@ func (l *localState) AddCheck(check *structs.HealthCheck, token string) {
 	l.checks[check.CheckID] = check
 	l.checkStatus[check.CheckID] = syncStatus{}
 	l.checkTokens[check.CheckID] = token
+	delete(l.checkStreaks, check.CheckID)
 	l.changeMade()
 }
 
@@ -227,10 +243,50 @@ func (l *localState) RemoveCheck(checkID string) {
 
 	delete(l.checks, checkID)
 	delete(l.checkTokens, checkID)
+	delete(l.checkStreaks, checkID)
+	l.stopDeferredCheck(checkID)
 	l.checkStatus[checkID] = syncStatus{remoteDelete: true}
 	l.changeMade()
 }
 
+// checkStreak is a run of consecutive outcomes of a check
+type checkStreak struct {
+	status string
+	count  int
+}
+
+// dampenCheck returns the status to record for an outcome of a check. A
+// check with a SuccessBeforePassing only turns passing after that many
+// consecutive passing outcomes, and one with a FailuresBeforeCritical
+// only turns critical after that many consecutive critical outcomes, so
+// a transient failure doesn't flip the service discovery results. Until
+// then, the check keeps its status. Must be called with the lock held.
+func (l *localState) dampenCheck(check *structs.HealthCheck, status string) string {
+	if check.SuccessBeforePassing <= 0 && check.FailuresBeforeCritical <= 0 {
+		return status
+	}
+
+	streak := l.checkStreaks[check.CheckID]
+	if streak.status == status {
+		streak.count++
+	} else {
+		streak = checkStreak{status: status, count: 1}
+	}
+	l.checkStreaks[check.CheckID] = streak
+
+	var threshold int
+	switch status {
+	case structs.HealthPassing:
+		threshold = check.SuccessBeforePassing
+	case structs.HealthCritical:
+		threshold = check.FailuresBeforeCritical
+	}
+	if streak.count < threshold {
+		return check.Status
+	}
+	return status
+}
+
 // UpdateCheck is used to update the status of a check
 func (l *localState) UpdateCheck(checkID, status, output string) {
 	l.Lock()
@@ -240,6 +296,10 @@ func (l *localState) UpdateCheck(checkID, status, output string) {
 	if !ok {
 		return
 	}
+	metrics.IncrCounter([]string{"consul", "agent", "check", status}, 1)
+
+	// Hold the status until the outcome is steady, if thresholds are set
+	status = l.dampenCheck(check, status)
 
 	// Do nothing if update is idempotent
 	if check.Status == status && check.Output == output {
@@ -268,13 +328,24 @@ func (l *localState) UpdateCheck(checkID, status, output string) {
 		return
 	}
 
-	// Update status and mark out of sync
+	// Update status and mark out of sync. The write carries the latest
+	// output, so a deferred output sync is no longer needed.
 	check.Status = status
 	check.Output = output
 	l.checkStatus[checkID] = syncStatus{inSync: false}
+	l.stopDeferredCheck(checkID)
 	l.changeMade()
 }
 
+// stopDeferredCheck cancels the deferred output sync of a check, if any.
+// Must be called with the lock held.
+func (l *localState) stopDeferredCheck(checkID string) {
+	if deferSync, ok := l.deferCheck[checkID]; ok {
+		deferSync.Stop()
+		delete(l.deferCheck, checkID)
+	}
+}
+
 // Checks returns the locally registered checks that the
 // agent is aware of and are being kept in sync with the server
 func (l *localState) Checks() map[string]*structs.HealthCheck {
@@ -340,9 +411,58 @@ SYNC:
 	}
 }
 
-// setSyncState does a read of the server state, and updates
-// the local syncStatus as appropriate
-func (l *localState) setSyncState() error {
+// updateRemoteState brings the mirror of the services and checks of the
+// node in the catalog up to date. Only the changes since the last update
+// are pulled, unless the servers are too old to support catalog diffs.
+func (l *localState) updateRemoteState() error {
+	req := structs.CatalogDiffRequest{
+		Datacenter:   l.config.Datacenter,
+		Node:         l.config.NodeName,
+		SinceIndex:   l.remoteIndex,
+		QueryOptions: structs.QueryOptions{Token: l.config.ACLToken},
+	}
+	var out structs.IndexedCatalogDiff
+	if err := l.iface.RPC("Catalog.Diff", &req, &out); err != nil {
+		if strings.Contains(err.Error(), "can't find method") {
+			return l.fetchRemoteState()
+		}
+		return err
+	}
+
+	// An index going backwards means the catalog was rebuilt, so the
+	// diff is meaningless
+	if out.Index < l.remoteIndex {
+		l.remoteIndex = 0
+		return l.updateRemoteState()
+	}
+
+	diff := out.Diff
+	if diff == nil {
+		diff = &structs.CatalogDiff{Full: true}
+	}
+	if diff.Full {
+		l.remoteServices = make(map[string]*structs.NodeService)
+		l.remoteChecks = make(map[string]*structs.HealthCheck)
+	}
+	for _, srv := range diff.Services {
+		l.remoteServices[srv.ID] = srv
+	}
+	for _, check := range diff.Checks {
+		l.remoteChecks[check.CheckID] = check
+	}
+	for _, removal := range diff.RemovedServices {
+		delete(l.remoteServices, removal.ID)
+	}
+	for _, removal := range diff.RemovedChecks {
+		delete(l.remoteChecks, removal.ID)
+	}
+	l.remoteIndex = out.Index
+	return nil
+}
+
+// fetchRemoteState reads all the services and checks of the node in the
+// catalog
+func (l *localState) fetchRemoteState() error {
 	req := structs.NodeSpecificRequest{
 		Datacenter:   l.config.Datacenter,
 		Node:         l.config.NodeName,
@@ -356,16 +476,34 @@ func (l *localState) setSyncState() error {
 	if err := l.iface.RPC("Health.NodeChecks", &req, &out2); err != nil {
 		return err
 	}
-	checks := out2.HealthChecks
 
-	l.Lock()
-	defer l.Unlock()
-
-	services := make(map[string]*structs.NodeService)
+	l.remoteServices = make(map[string]*structs.NodeService)
 	if out1.NodeServices != nil {
-		services = out1.NodeServices.Services
+		l.remoteServices = out1.NodeServices.Services
+	}
+	l.remoteChecks = make(map[string]*structs.HealthCheck)
+	for _, check := range out2.HealthChecks {
+		l.remoteChecks[check.CheckID] = check
+	}
+	l.remoteIndex = 0
+	return nil
+}
+
+// setSyncState does a read of the server state, and updates
+// the local syncStatus as appropriate
+func (l *localState) setSyncState() error {
+	if err := l.updateRemoteState(); err != nil {
+		return err
+	}
+	services := l.remoteServices
+	checks := make(structs.HealthChecks, 0, len(l.remoteChecks))
+	for _, check := range l.remoteChecks {
+		checks = append(checks, check)
 	}
 
+	l.Lock()
+	defer l.Unlock()
+
 	for id, _ := range l.services {
 		// If the local service doesn't exist remotely, then sync it
 		if _, ok := services[id]; !ok {
@@ -385,6 +523,9 @@ func (l *localState) setSyncState() error {
 		if existing.EnableTagOverride {
 			existing.Tags = service.Tags
 		}
+
+		// Metadata is only managed through catalog patches
+		existing.Meta = service.Meta
 		equal := reflect.DeepEqual(existing, service)
 		l.serviceStatus[id] = syncStatus{inSync: equal}
 	}
@@ -408,15 +549,18 @@ func (l *localState) setSyncState() error {
 		id := check.CheckID
 		existing, ok := l.checks[id]
 		if !ok {
-			// The Serf check is created automatically, and does not
-			// need to be registered
-			if id == consul.SerfCheckID {
+			// The Serf check and the checks of the maintenance flags
+			// are created by the servers, and must not be deregistered
+			if id == consul.SerfCheckID || consul.IsMaintenanceCheck(id) {
 				continue
 			}
 			l.checkStatus[id] = syncStatus{remoteDelete: true}
 			continue
 		}
 
+		// The indexes are maintained by the servers
+		check.CreateIndex, check.ModifyIndex = 0, 0
+
 		// If our definition is different, we need to update it
 		var equal bool
 		if l.config.CheckUpdateInterval == 0 {
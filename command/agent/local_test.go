@@ -579,8 +579,9 @@ func TestAgentAntiEntropy_Checks(t *testing.T) {
 		t.Fatalf("bad: %v", checks)
 	}
 
-	// All the checks should match
+	// All the checks should match, besides the indexes set by the servers
 	for _, chk := range checks.HealthChecks {
+		chk.CreateIndex, chk.ModifyIndex = 0, 0
 		switch chk.CheckID {
 		case "mysql":
 			if !reflect.DeepEqual(chk, chk1) {
@@ -760,6 +761,79 @@ func TestAgent_checkTokens(t *testing.T) {
 	}
 }
 
+func TestAgent_checkDampening(t *testing.T) {
+	config := nextConfig()
+	l := new(localState)
+	l.Init(config, nil)
+
+	l.AddCheck(&structs.HealthCheck{
+		CheckID:                "web",
+		Status:                 structs.HealthPassing,
+		SuccessBeforePassing:   2,
+		FailuresBeforeCritical: 3,
+	}, "")
+	expect := func(status string) {
+		if check := l.Checks()["web"]; check.Status != status {
+			t.Fatalf("bad: %v", check)
+		}
+	}
+
+	// Takes three consecutive failures to turn critical
+	l.UpdateCheck("web", structs.HealthCritical, "fail 1")
+	l.UpdateCheck("web", structs.HealthCritical, "fail 2")
+	expect(structs.HealthPassing)
+	l.UpdateCheck("web", structs.HealthCritical, "fail 3")
+	expect(structs.HealthCritical)
+
+	// A success breaks the streak, and it takes two to turn passing
+	l.UpdateCheck("web", structs.HealthPassing, "ok 1")
+	expect(structs.HealthCritical)
+	l.UpdateCheck("web", structs.HealthCritical, "fail 4")
+	l.UpdateCheck("web", structs.HealthPassing, "ok 2")
+	expect(structs.HealthCritical)
+	l.UpdateCheck("web", structs.HealthPassing, "ok 3")
+	expect(structs.HealthPassing)
+
+	// Warnings aren't dampened
+	l.UpdateCheck("web", structs.HealthWarning, "slow")
+	expect(structs.HealthWarning)
+}
+
+func TestAgent_checkDeferredOutput(t *testing.T) {
+	config := nextConfig()
+	config.CheckUpdateInterval = time.Hour
+	l := new(localState)
+	l.Init(config, nil)
+
+	l.AddCheck(&structs.HealthCheck{CheckID: "web", Status: structs.HealthPassing}, "")
+	l.checkStatus["web"] = syncStatus{inSync: true}
+
+	// An output change alone is deferred
+	l.UpdateCheck("web", structs.HealthPassing, "ok 1")
+	if !l.checkStatus["web"].inSync {
+		t.Fatalf("should be in sync")
+	}
+	if _, ok := l.deferCheck["web"]; !ok {
+		t.Fatalf("should defer the output")
+	}
+
+	// A status change is synced right away, along with the output
+	l.UpdateCheck("web", structs.HealthCritical, "fail")
+	if l.checkStatus["web"].inSync {
+		t.Fatalf("should be out of sync")
+	}
+	if _, ok := l.deferCheck["web"]; ok {
+		t.Fatalf("should not defer the output")
+	}
+
+	// Removing the check cancels the deferred sync
+	l.UpdateCheck("web", structs.HealthCritical, "still failing")
+	l.RemoveCheck("web")
+	if _, ok := l.deferCheck["web"]; ok {
+		t.Fatalf("should not defer the output")
+	}
+}
+
 func TestAgent_nestedPauseResume(t *testing.T) {
 	l := new(localState)
 	if l.isPaused() != false {
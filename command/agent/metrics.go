@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// metricsPruneInterval is how often the updates look for metrics
+	// past their retention, so unscraped agents don't grow forever
+	metricsPruneInterval = time.Minute
+)
+
+// MetricsSummary is the JSON form of the metrics kept by the agent
+type MetricsSummary struct {
+	Gauges   []GaugeValue
+	Counters []SampledValue
+	Samples  []SampledValue
+}
+
+// GaugeValue is the last value of a gauge
+type GaugeValue struct {
+	Name  string
+	Value float64
+}
+
+// SampledValue aggregates the updates of a counter, or the samples of a
+// timer, since the agent started
+type SampledValue struct {
+	Name  string
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+	Mean  float64
+}
+
+// metricValue is a metric kept by the metricsSink
+type metricValue struct {
+	count    int
+	sum      float64
+	min      float64
+	max      float64
+	updated  time.Time
+	isGauge  bool
+	isSample bool
+}
+
+// metricsSink is a go-metrics sink keeping the metrics in memory, so the
+// agent can expose them to Prometheus. Counters and timers are cumulative
+// like Prometheus expects, and metrics that aren't updated for the
+// retention period are dropped.
+type metricsSink struct {
+	retain time.Duration
+
+	metrics   map[string]*metricValue
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+// newMetricsSink returns a sink keeping the metrics for the retention
+func newMetricsSink(retain time.Duration) *metricsSink {
+	return &metricsSink{
+		retain:    retain,
+		metrics:   make(map[string]*metricValue),
+		lastPrune: time.Now(),
+	}
+}
+
+// metricName flattens the key of a metric into a valid Prometheus name
+func metricName(key []string) string {
+	name := []byte(strings.Join(key, "_"))
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// update records a value of a metric
+func (m *metricsSink) update(key []string, val float32, isGauge, isSample bool) {
+	name := metricName(key)
+	now := time.Now()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if now.Sub(m.lastPrune) > metricsPruneInterval {
+		m.prune(now)
+	}
+
+	v, ok := m.metrics[name]
+	if !ok || v.isGauge != isGauge || v.isSample != isSample {
+		v = &metricValue{isGauge: isGauge, isSample: isSample}
+		m.metrics[name] = v
+	}
+	f := float64(val)
+	if isGauge {
+		v.sum = f
+	} else {
+		v.sum += f
+	}
+	if v.count == 0 || f < v.min {
+		v.min = f
+	}
+	if v.count == 0 || f > v.max {
+		v.max = f
+	}
+	v.count++
+	v.updated = now
+}
+
+// prune drops the metrics past their retention. The lock must be held.
+func (m *metricsSink) prune(now time.Time) {
+	for name, v := range m.metrics {
+		if now.Sub(v.updated) > m.retain {
+			delete(m.metrics, name)
+		}
+	}
+	m.lastPrune = now
+}
+
+// SetGauge is used to set the value of a gauge
+func (m *metricsSink) SetGauge(key []string, val float32) {
+	m.update(key, val, true, false)
+}
+
+// EmitKey is used to emit a key/value pair, which isn't kept
+func (m *metricsSink) EmitKey(key []string, val float32) {
+}
+
+// IncrCounter is used to increment a counter
+func (m *metricsSink) IncrCounter(key []string, val float32) {
+	m.update(key, val, false, false)
+}
+
+// AddSample is used to add a sample, the timers are in milliseconds
+func (m *metricsSink) AddSample(key []string, val float32) {
+	m.update(key, val, false, true)
+}
+
+// sorted returns the names of the retained metrics in order, with a copy
+// of their values
+func (m *metricsSink) sorted() ([]string, map[string]metricValue) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prune(time.Now())
+
+	names := make([]string, 0, len(m.metrics))
+	values := make(map[string]metricValue, len(m.metrics))
+	for name, v := range m.metrics {
+		names = append(names, name)
+		values[name] = *v
+	}
+	sort.Strings(names)
+	return names, values
+}
+
+// Summary returns the retained metrics
+func (m *metricsSink) Summary() *MetricsSummary {
+	names, values := m.sorted()
+	out := &MetricsSummary{
+		Gauges:   []GaugeValue{},
+		Counters: []SampledValue{},
+		Samples:  []SampledValue{},
+	}
+	for _, name := range names {
+		v := values[name]
+		if v.isGauge {
+			out.Gauges = append(out.Gauges, GaugeValue{Name: name, Value: v.sum})
+			continue
+		}
+		s := SampledValue{
+			Name:  name,
+			Count: v.count,
+			Sum:   v.sum,
+			Min:   v.min,
+			Max:   v.max,
+			Mean:  v.sum / float64(v.count),
+		}
+		if v.isSample {
+			out.Samples = append(out.Samples, s)
+		} else {
+			out.Counters = append(out.Counters, s)
+		}
+	}
+	return out
+}
+
+// formatFloat formats a value for the Prometheus text format
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", f)
+}
+
+// Prometheus returns the retained metrics in the Prometheus text
+// exposition format. Timers are summaries without quantiles.
+func (m *metricsSink) Prometheus() []byte {
+	names, values := m.sorted()
+	var buf bytes.Buffer
+	for _, name := range names {
+		v := values[name]
+		switch {
+		case v.isGauge:
+			fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+			fmt.Fprintf(&buf, "%s %s\n", name, formatFloat(v.sum))
+		case v.isSample:
+			fmt.Fprintf(&buf, "# TYPE %s summary\n", name)
+			fmt.Fprintf(&buf, "%s_sum %s\n", name, formatFloat(v.sum))
+			fmt.Fprintf(&buf, "%s_count %d\n", name, v.count)
+		default:
+			fmt.Fprintf(&buf, "# TYPE %s counter\n", name)
+			fmt.Fprintf(&buf, "%s %s\n", name, formatFloat(v.sum))
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+var _ metrics.MetricSink = &metricsSink{}
+
+func TestMetricName(t *testing.T) {
+	cases := map[string][]string{
+		"consul_rpc_query":                  {"consul", "rpc", "query"},
+		"consul_rpc_cross_dc_dc1":           {"consul", "rpc", "cross-dc", "dc1"},
+		"consul_agent_rpc_Catalog_Register": {"consul", "agent", "rpc", "Catalog.Register"},
+		"__a":                               {"1", "a"},
+	}
+	for expect, key := range cases {
+		if name := metricName(key); name != expect {
+			t.Fatalf("bad: %v %s", key, name)
+		}
+	}
+}
+
+func TestMetricsSink(t *testing.T) {
+	m := newMetricsSink(time.Hour)
+	m.SetGauge([]string{"consul", "runtime", "goroutines"}, 10)
+	m.SetGauge([]string{"consul", "runtime", "goroutines"}, 12)
+	m.IncrCounter([]string{"consul", "agent", "check", "passing"}, 1)
+	m.IncrCounter([]string{"consul", "agent", "check", "passing"}, 1)
+	m.AddSample([]string{"consul", "fsm", "register"}, 2)
+	m.AddSample([]string{"consul", "fsm", "register"}, 4)
+	m.EmitKey([]string{"consul", "ignored"}, 1)
+
+	summary := m.Summary()
+	if len(summary.Gauges) != 1 || summary.Gauges[0].Value != 12 {
+		t.Fatalf("bad: %#v", summary.Gauges)
+	}
+	if len(summary.Counters) != 1 || summary.Counters[0].Count != 2 || summary.Counters[0].Sum != 2 {
+		t.Fatalf("bad: %#v", summary.Counters)
+	}
+	s := summary.Samples
+	if len(s) != 1 || s[0].Count != 2 || s[0].Sum != 6 || s[0].Min != 2 || s[0].Max != 4 || s[0].Mean != 3 {
+		t.Fatalf("bad: %#v", s)
+	}
+
+	expect := `# TYPE consul_agent_check_passing counter
+consul_agent_check_passing 2
+# TYPE consul_fsm_register summary
+consul_fsm_register_sum 6
+consul_fsm_register_count 2
+# TYPE consul_runtime_goroutines gauge
+consul_runtime_goroutines 12
+`
+	if out := string(m.Prometheus()); out != expect {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestMetricsSink_Retention(t *testing.T) {
+	m := newMetricsSink(50 * time.Millisecond)
+	m.IncrCounter([]string{"old"}, 1)
+	time.Sleep(100 * time.Millisecond)
+	m.IncrCounter([]string{"new"}, 1)
+
+	// Metrics past their retention are dropped
+	out := string(m.Prometheus())
+	if strings.Contains(out, "old") || !strings.Contains(out, "new 1") {
+		t.Fatalf("bad: %s", out)
+	}
+}
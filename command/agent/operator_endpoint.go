@@ -0,0 +1,424 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// OperatorState is used to get the statistics of the state store of a
+// server, to help with capacity planning
+func (s *HTTPServer) OperatorState(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.StateStats
+	if err := s.agent.RPC("Operator.StateStats", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OperatorStateVerify is used to check the integrity of the state store
+// of a server
+func (s *HTTPServer) OperatorStateVerify(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.StateVerifyReport
+	if err := s.agent.RPC("Operator.StateVerify", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OperatorRaftConfiguration is used to list the servers of the Raft
+// configuration
+func (s *HTTPServer) OperatorRaftConfiguration(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.RaftConfigurationResponse
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Operator.RaftGetConfiguration", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.Servers, nil
+}
+
+// OperatorRaftPeer is used to remove a failed server from the Raft
+// configuration, given its ?address= with a DELETE
+func (s *HTTPServer) OperatorRaftPeer(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "DELETE" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.RaftPeerRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+	args.Address = req.URL.Query().Get("address")
+	if args.Address == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing address"))
+		return nil, nil
+	}
+
+	var out struct{}
+	if err := s.agent.RPC("Operator.RaftRemovePeerByAddress", &args, &out); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// OperatorAutopilotConfiguration is used to get the autopilot
+// configuration with a GET, or set it from the body of a PUT. With
+// ?cas=, the PUT only sets it if the current configuration has the given
+// modify index.
+func (s *HTTPServer) OperatorAutopilotConfiguration(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	switch req.Method {
+	case "GET":
+		args := structs.DCSpecificRequest{}
+		if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+			return nil, nil
+		}
+
+		var out structs.AutopilotConfigResponse
+		defer setMeta(resp, &out.QueryMeta)
+		if err := s.agent.RPC("Operator.AutopilotGetConfiguration", &args, &out); err != nil {
+			return nil, err
+		}
+		return out.Config, nil
+
+	case "PUT":
+		args := structs.AutopilotSetConfigRequest{}
+		s.parseDC(req, &args.Datacenter)
+		s.parseToken(req, &args.Token)
+		if err := decodeBody(req, &args.Config, FixupStabilizationTime); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+			return nil, nil
+		}
+		if cas := req.URL.Query().Get("cas"); cas != "" {
+			index, err := strconv.ParseUint(cas, 10, 64)
+			if err != nil {
+				resp.WriteHeader(400)
+				resp.Write([]byte("Invalid cas index"))
+				return nil, nil
+			}
+			args.Config.ModifyIndex = index
+			args.CAS = true
+		}
+
+		var out bool
+		if err := s.agent.RPC("Operator.AutopilotSetConfiguration", &args, &out); err != nil {
+			return nil, err
+		}
+		return out, nil
+
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+}
+
+// FixupStabilizationTime is used to accept the server stabilization time
+// of the autopilot configuration as a duration string, like "10s"
+func FixupStabilizationTime(raw interface{}) error {
+	rawMap, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for k, v := range rawMap {
+		if strings.ToLower(k) != "serverstabilizationtime" {
+			continue
+		}
+		if vStr, ok := v.(string); ok {
+			dur, err := time.ParseDuration(vStr)
+			if err != nil {
+				return err
+			}
+			rawMap[k] = dur
+		}
+	}
+	return nil
+}
+
+// OperatorAutoEncryptToken creates a one-time auto-encrypt token with a
+// PUT, from a body with the Node the token is for, and an optional
+// Description and TTL such as "1h". The secret is only returned in the
+// response.
+func (s *HTTPServer) OperatorAutoEncryptToken(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "PUT" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.AutoEncryptTokenCreateRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+	if req.ContentLength > 0 {
+		var body struct {
+			Node        string
+			Description string
+			TTL         time.Duration
+		}
+		if err := decodeBody(req, &body, FixupTTL); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+			return nil, nil
+		}
+		args.Node, args.Description, args.TTL = body.Node, body.Description, body.TTL
+	}
+
+	var out structs.AutoEncryptTokenCreateResponse
+	if err := s.agent.RPC("Operator.AutoEncryptTokenCreate", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FixupTTL is used to accept a TTL as a duration string, like "1h"
+func FixupTTL(raw interface{}) error {
+	rawMap, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for k, v := range rawMap {
+		if strings.ToLower(k) != "ttl" {
+			continue
+		}
+		if vStr, ok := v.(string); ok {
+			dur, err := time.ParseDuration(vStr)
+			if err != nil {
+				return err
+			}
+			rawMap[k] = dur
+		}
+	}
+	return nil
+}
+
+// OperatorKeyring manages the gossip encryption keyrings of the LAN and
+// WAN pools of every datacenter. GET lists the keys, and POST installs,
+// PUT uses and DELETE removes the key of the body.
+func (s *HTTPServer) OperatorKeyring(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	var args structs.KeyringRequest
+	if req.Method == "POST" || req.Method == "PUT" || req.Method == "DELETE" {
+		if err := decodeBody(req, &args, nil); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+			return nil, nil
+		}
+		if args.Key == "" {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Missing key"))
+			return nil, nil
+		}
+	}
+	s.parseToken(req, &args.Token)
+
+	var out *structs.KeyringResponses
+	var err error
+	switch req.Method {
+	case "GET":
+		out, err = s.agent.ListKeys(args.Token)
+	case "POST":
+		out, err = s.agent.InstallKey(args.Key, args.Token)
+	case "PUT":
+		out, err = s.agent.UseKey(args.Key, args.Token)
+	case "DELETE":
+		out, err = s.agent.RemoveKey(args.Key, args.Token)
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method == "GET" {
+		return out.Responses, nil
+	}
+	return nil, keyringErrors(out.Responses)
+}
+
+// keyringErrors returns the failures of the nodes of a keyring operation,
+// or nil if every node succeeded
+func keyringErrors(responses []*structs.KeyringResponse) error {
+	var errs []string
+	for _, kr := range responses {
+		if kr.Error == "" {
+			continue
+		}
+		pool := "LAN"
+		if kr.WAN {
+			pool = "WAN"
+		}
+		msg := fmt.Sprintf("%s %s: %s", kr.Datacenter, pool, kr.Error)
+		for node, message := range kr.Messages {
+			msg += fmt.Sprintf("\n  %s: %s", node, message)
+		}
+		errs = append(errs, msg)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Keyring operation failed:\n%s", strings.Join(errs, "\n"))
+}
+
+// InternalWatchStats is used to get the watchers of the state store of a
+// server and how often they fire, to find the keys causing storms of
+// blocking queries. The ?limit query param bounds the number of most
+// notified prefixes returned.
+func (s *HTTPServer) InternalWatchStats(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.WatchStatsRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	if limit := req.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid limit"))
+			return nil, nil
+		}
+		args.Limit = n
+	}
+
+	var out structs.WatchStats
+	if err := s.agent.RPC("Internal.WatchStats", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OperatorAreas lists the network areas with a GET, or creates one from
+// the body of a POST, returning its ID
+func (s *HTTPServer) OperatorAreas(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	switch req.Method {
+	case "GET":
+		args := structs.AreaSpecificRequest{}
+		if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+			return nil, nil
+		}
+
+		var out structs.IndexedAreas
+		defer setMeta(resp, &out.QueryMeta)
+		if err := s.agent.RPC("Operator.AreaList", &args, &out); err != nil {
+			return nil, err
+		}
+		if out.Areas == nil {
+			out.Areas = make(structs.Areas, 0)
+		}
+		return out.Areas, nil
+
+	case "POST":
+		return s.operatorAreaUpsert(resp, req, "")
+
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+}
+
+// OperatorArea gets a network area with a GET, updates it from the body
+// of a PUT or deletes it with a DELETE, given its ID. The servers of its
+// peer datacenter are listed under /members.
+func (s *HTTPServer) OperatorArea(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(req.URL.Path, "/v1/operator/area/")
+	if strings.HasSuffix(id, "/members") {
+		return s.operatorAreaMembers(resp, req, strings.TrimSuffix(id, "/members"))
+	}
+	if id == "" || strings.Contains(id, "/") {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing or invalid area ID"))
+		return nil, nil
+	}
+
+	switch req.Method {
+	case "GET":
+		args := structs.AreaSpecificRequest{AreaID: id}
+		if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+			return nil, nil
+		}
+
+		var out structs.IndexedAreas
+		defer setMeta(resp, &out.QueryMeta)
+		if err := s.agent.RPC("Operator.AreaList", &args, &out); err != nil {
+			return nil, err
+		}
+		if len(out.Areas) == 0 {
+			resp.WriteHeader(404)
+			return nil, nil
+		}
+		return out.Areas, nil
+
+	case "PUT":
+		return s.operatorAreaUpsert(resp, req, id)
+
+	case "DELETE":
+		args := structs.AreaRequest{Area: structs.Area{ID: id}}
+		s.parseDC(req, &args.Datacenter)
+		s.parseToken(req, &args.Token)
+		var out struct{}
+		if err := s.agent.RPC("Operator.AreaDelete", &args, &out); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+}
+
+// operatorAreaUpsert creates a network area, or updates the one of the
+// given ID, from the body of the request
+func (s *HTTPServer) operatorAreaUpsert(resp http.ResponseWriter, req *http.Request, id string) (interface{}, error) {
+	args := structs.AreaRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+	if err := decodeBody(req, &args.Area, nil); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+	args.Area.ID = id
+
+	var out string
+	if err := s.agent.RPC("Operator.AreaUpsert", &args, &out); err != nil {
+		return nil, err
+	}
+	return struct{ ID string }{out}, nil
+}
+
+// operatorAreaMembers lists the servers of the peer datacenter of an
+// area, as seen by the server answering
+func (s *HTTPServer) operatorAreaMembers(resp http.ResponseWriter, req *http.Request, id string) (interface{}, error) {
+	if req.Method != "GET" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.AreaSpecificRequest{AreaID: id}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.AreaServers
+	if err := s.agent.RPC("Operator.AreaServers", &args, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,359 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestOperatorState(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	req, err := http.NewRequest("GET", "/v1/operator/state?stale", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, err := srv.OperatorState(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stats := obj.(structs.StateStats)
+	if stats.Server != srv.agent.config.NodeName || stats.Objects["nodes"] != 1 {
+		t.Fatalf("bad: %#v", stats)
+	}
+	if stats.Bytes["nodes"] == 0 {
+		t.Fatalf("bad: %v", stats.Bytes)
+	}
+}
+
+func TestOperatorStateVerify(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	req, err := http.NewRequest("GET", "/v1/operator/state/verify", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, err := srv.OperatorStateVerify(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	report := obj.(structs.StateVerifyReport)
+	if report.Server != srv.agent.config.NodeName || report.Rows["nodes"] != 1 {
+		t.Fatalf("bad: %#v", report)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("bad: %v", report.Problems)
+	}
+}
+
+func TestOperatorRaftConfiguration(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	req, err := http.NewRequest("GET", "/v1/operator/raft/configuration", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.OperatorRaftConfiguration(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+	servers := obj.([]*structs.RaftServer)
+	if len(servers) != 1 || servers[0].Node != srv.agent.config.NodeName || !servers[0].Leader {
+		t.Fatalf("bad: %v", servers)
+	}
+}
+
+func TestOperatorRaftPeer(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	// The address is required
+	req, err := http.NewRequest("DELETE", "/v1/operator/raft/peer", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	if _, err := srv.OperatorRaftPeer(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+
+	// Unknown peers are rejected
+	req, err = http.NewRequest("DELETE", "/v1/operator/raft/peer?address=127.0.0.1:1", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = srv.OperatorRaftPeer(httptest.NewRecorder(), req)
+	if err == nil || !strings.Contains(err.Error(), "not found in the Raft configuration") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperatorAutopilotConfiguration(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	get := func() structs.AutopilotConfig {
+		req, err := http.NewRequest("GET", "/v1/operator/autopilot/configuration", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.OperatorAutopilotConfiguration(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		assertIndex(t, resp)
+		return obj.(structs.AutopilotConfig)
+	}
+	put := func(query, body string) (interface{}, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest("PUT", "/v1/operator/autopilot/configuration"+query,
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.OperatorAutopilotConfiguration(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return obj, resp
+	}
+
+	if config := get(); !config.CleanupDeadServers {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// The stabilization time may be a duration string
+	obj, _ := put("?cas=0", `{"CleanupDeadServers": false, "ServerStabilizationTime": "30s"}`)
+	if ok := obj.(bool); !ok {
+		t.Fatalf("should set")
+	}
+	config := get()
+	if config.CleanupDeadServers || config.ServerStabilizationTime != 30*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// A stale CAS fails
+	obj, _ = put("?cas=0", `{"ServerStabilizationTime": "1m"}`)
+	if ok := obj.(bool); ok {
+		t.Fatalf("should fail")
+	}
+
+	_, resp := put("", `{"ServerStabilizationTime": "soon"}`)
+	if resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+}
+
+func TestOperatorArea(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	body := strings.NewReader(`{"PeerDatacenter": "dc2", "RetryJoin": ["127.0.0.1:1"]}`)
+	req, err := http.NewRequest("POST", "/v1/operator/area", body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err := srv.OperatorAreas(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id := obj.(struct{ ID string }).ID
+	if id == "" {
+		t.Fatalf("missing ID")
+	}
+
+	req, err = http.NewRequest("GET", "/v1/operator/area", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	obj, err = srv.OperatorAreas(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+	areas := obj.(structs.Areas)
+	if len(areas) != 1 || areas[0].ID != id || areas[0].PeerDatacenter != "dc2" {
+		t.Fatalf("bad: %#v", areas)
+	}
+
+	// The join address can't be reached
+	testutil.WaitForResult(func() (bool, error) {
+		req, err := http.NewRequest("GET", "/v1/operator/area/"+id+"/members", nil)
+		if err != nil {
+			return false, err
+		}
+		obj, err := srv.OperatorArea(httptest.NewRecorder(), req)
+		if err != nil {
+			return false, err
+		}
+		members := obj.(structs.AreaServers)
+		return len(members.Servers) == 1 && !members.Servers[0].Healthy,
+			fmt.Errorf("bad: %#v", members)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	req, err = http.NewRequest("DELETE", "/v1/operator/area/"+id, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, err = srv.OperatorArea(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok := obj.(bool); !ok {
+		t.Fatalf("should delete")
+	}
+
+	req, err = http.NewRequest("GET", "/v1/operator/area/"+id, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.OperatorArea(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 404 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+}
+
+func TestOperatorKeyring(t *testing.T) {
+	key1 := "tbLJg26ZJyJ9pK3qhc9jig=="
+	key2 := "4leC33rgtXKIVUr9Nr0snQ=="
+
+	conf := nextConfig()
+	dir, agent := makeAgentKeyring(t, conf, key1)
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+	servers, err := NewHTTPServers(agent, conf, agent.logOutput)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	srv := servers[0]
+	defer srv.Shutdown()
+
+	testutil.WaitForLeader(t, agent.RPC, "dc1")
+
+	keyring := func(method string, key string) (interface{}, *httptest.ResponseRecorder) {
+		var body io.Reader
+		if method != "GET" {
+			body = encodeReq(map[string]string{"Key": key})
+		}
+		req, err := http.NewRequest(method, "/v1/operator/keyring", body)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.OperatorKeyring(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return obj, resp
+	}
+	keys := func() map[string]int {
+		obj, _ := keyring("GET", "")
+		responses := obj.([]*structs.KeyringResponse)
+		if len(responses) != 2 {
+			t.Fatalf("bad: %v", responses)
+		}
+		return responses[0].Keys
+	}
+
+	if k := keys(); len(k) != 1 || k[key1] != 1 {
+		t.Fatalf("bad: %v", k)
+	}
+
+	// Rotate the key
+	keyring("POST", key2)
+	if k := keys(); len(k) != 2 || k[key2] != 1 {
+		t.Fatalf("bad: %v", k)
+	}
+	keyring("PUT", key2)
+	keyring("DELETE", key1)
+	if k := keys(); len(k) != 1 || k[key2] != 1 {
+		t.Fatalf("bad: %v", k)
+	}
+
+	// The key is required
+	if _, resp := keyring("POST", ""); resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+}
+
+func TestInternalWatchStats(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	req, err := http.NewRequest("GET", "/v1/internal/watches?limit=5", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, err := srv.InternalWatchStats(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stats := obj.(structs.WatchStats)
+	if stats.Server != srv.agent.config.NodeName || stats.Watchers == nil {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	req, err = http.NewRequest("GET", "/v1/internal/watches?limit=nope", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	if _, err := srv.InternalWatchStats(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// peeringTokenBody is the body of the requests generating a peering
+// token or establishing a peering with one
+type peeringTokenBody struct {
+	PeerName     string
+	PeeringToken string
+}
+
+// PeeringGenerateToken creates a pending peering with the peer named in
+// the body of a POST, and returns the token the peer establishes it with
+func (s *HTTPServer) PeeringGenerateToken(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "POST" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.PeeringTokenRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+	var body peeringTokenBody
+	if err := decodeBody(req, &body, nil); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+	args.PeerName = body.PeerName
+
+	var out string
+	if err := s.agent.RPC("Peering.GenerateToken", &args, &out); err != nil {
+		return nil, err
+	}
+	return struct{ PeeringToken string }{out}, nil
+}
+
+// PeeringEstablish establishes a peering from the token in the body of a
+// POST, under the peer name of the body, and returns its ID
+func (s *HTTPServer) PeeringEstablish(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "POST" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.PeeringTokenRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+	var body peeringTokenBody
+	if err := decodeBody(req, &body, nil); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+	args.PeerName = body.PeerName
+	args.PeeringToken = body.PeeringToken
+
+	var out string
+	if err := s.agent.RPC("Peering.Establish", &args, &out); err != nil {
+		return nil, err
+	}
+	return struct{ ID string }{out}, nil
+}
+
+// PeeringList lists the peerings
+func (s *HTTPServer) PeeringList(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "GET" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.DCSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	var out structs.IndexedPeerings
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Peering.List", &args, &out); err != nil {
+		return nil, err
+	}
+	if out.Peerings == nil {
+		out.Peerings = make(structs.Peerings, 0)
+	}
+	return out.Peerings, nil
+}
+
+// PeeringEndpoint gets a peering with a GET, with the names of the
+// services imported from it, or deletes it with a DELETE, given the name
+// of the peer
+func (s *HTTPServer) PeeringEndpoint(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	name := strings.TrimPrefix(req.URL.Path, "/v1/peering/")
+	if name == "" || strings.Contains(name, "/") {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing or invalid peer name"))
+		return nil, nil
+	}
+
+	switch req.Method {
+	case "GET":
+		args := structs.PeeringSpecificRequest{PeerName: name}
+		if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+			return nil, nil
+		}
+
+		var out structs.PeeringResponse
+		defer setMeta(resp, &out.QueryMeta)
+		if err := s.agent.RPC("Peering.Read", &args, &out); err != nil {
+			return nil, err
+		}
+		if out.Peering == nil {
+			resp.WriteHeader(404)
+			return nil, nil
+		}
+		if out.ImportedServices == nil {
+			out.ImportedServices = make([]string, 0)
+		}
+		return struct {
+			*structs.Peering
+			ImportedServices []string
+		}{out.Peering, out.ImportedServices}, nil
+
+	case "DELETE":
+		args := structs.PeeringRequest{Peering: structs.Peering{Name: name}}
+		s.parseDC(req, &args.Datacenter)
+		s.parseToken(req, &args.Token)
+		var out struct{}
+		if err := s.agent.RPC("Peering.Delete", &args, &out); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+}
+
+// ExportedServices gets the services exported to the peers with a GET,
+// or replaces them with the body of a PUT
+func (s *HTTPServer) ExportedServices(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	switch req.Method {
+	case "GET":
+		args := structs.DCSpecificRequest{}
+		if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+			return nil, nil
+		}
+
+		var out structs.ExportedServicesResponse
+		defer setMeta(resp, &out.QueryMeta)
+		if err := s.agent.RPC("Peering.ExportedServices", &args, &out); err != nil {
+			return nil, err
+		}
+		if out.Config.Services == nil {
+			out.Config.Services = make([]structs.ExportedService, 0)
+		}
+		return out.Config, nil
+
+	case "PUT":
+		args := structs.ExportedServicesRequest{}
+		s.parseDC(req, &args.Datacenter)
+		s.parseToken(req, &args.Token)
+		if err := decodeBody(req, &args.Config, nil); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+			return nil, nil
+		}
+
+		var out struct{}
+		if err := s.agent.RPC("Peering.SetExportedServices", &args, &out); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+}
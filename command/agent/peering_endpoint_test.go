@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestPeeringEndpoints(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	body := strings.NewReader(`{"PeerName": "cluster2"}`)
+	req, err := http.NewRequest("POST", "/v1/peering/token", body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	obj, err := srv.PeeringGenerateToken(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token := obj.(struct{ PeeringToken string }).PeeringToken; token == "" {
+		t.Fatalf("missing token")
+	}
+
+	req, err = http.NewRequest("GET", "/v1/peerings", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	obj, err = srv.PeeringList(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+	peerings := obj.(structs.Peerings)
+	if len(peerings) != 1 || peerings[0].Name != "cluster2" || peerings[0].State != structs.PeeringPending {
+		t.Fatalf("bad: %#v", peerings)
+	}
+
+	req, err = http.NewRequest("GET", "/v1/peering/cluster2", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.PeeringEndpoint(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 200 {
+		t.Fatalf("bad code: %d", resp.Code)
+	}
+
+	// Export a service to the peer
+	body = strings.NewReader(`{"Services": [{"Name": "web", "Consumers": ["cluster2"]}]}`)
+	req, err = http.NewRequest("PUT", "/v1/exported-services", body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := srv.ExportedServices(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req, err = http.NewRequest("GET", "/v1/exported-services", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	obj, err = srv.ExportedServices(resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	assertIndex(t, resp)
+	config := obj.(structs.ExportedServicesConfig)
+	if len(config.Services) != 1 || config.Services[0].Name != "web" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	req, err = http.NewRequest("DELETE", "/v1/peering/cluster2", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := srv.PeeringEndpoint(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req, err = http.NewRequest("GET", "/v1/peering/cluster2", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.PeeringEndpoint(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 404 {
+		t.Fatalf("bad code: %d", resp.Code)
+	}
+
+	// An invalid token is rejected
+	body = strings.NewReader(`{"PeerName": "cluster3", "PeeringToken": "nope"}`)
+	req, err = http.NewRequest("POST", "/v1/peering/establish", body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := srv.PeeringEstablish(httptest.NewRecorder(), req); err == nil {
+		t.Fatalf("should fail")
+	}
+}
@@ -88,9 +88,12 @@ func NewRPCClient(addr string) (*RPCClient, error) {
 		addr = envAddr
 	}
 
-	// Try to dial to agent
+	// Try to dial to agent, domain sockets are given either by their
+	// path or as unix:// addresses
 	mode := "tcp"
-	if strings.HasPrefix(addr, "/") {
+	if path, ok := unixSocketAddr(addr); ok {
+		mode, addr = "unix", path
+	} else if strings.HasPrefix(addr, "/") {
 		mode = "unix"
 	}
 	if conn, err = net.Dial(mode, addr); err != nil {
@@ -99,6 +99,16 @@ func TestRPCClient_UnixSocket(t *testing.T) {
 	if len(mem) != 1 {
 		t.Fatalf("bad: %#v", mem)
 	}
+
+	// The socket can also be given as a unix:// address
+	client, err := NewRPCClient("unix://" + socket)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer client.Close()
+	if mem, err := client.LANMembers(); err != nil || len(mem) != 1 {
+		t.Fatalf("bad: %#v %v", mem, err)
+	}
 }
 
 func TestRPCClientForceLeave(t *testing.T) {
@@ -203,6 +203,31 @@ func (s *HTTPServer) SessionList(resp http.ResponseWriter, req *http.Request) (i
 	return out.Sessions, nil
 }
 
+// SessionExpiring is used to list the sessions whose TTL expires within
+// a window unless they are renewed, soonest first
+func (s *HTTPServer) SessionExpiring(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.SessionExpiringRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	if window := req.URL.Query().Get("window"); window != "" {
+		dur, err := time.ParseDuration(window)
+		if err != nil || dur < 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid window: %q", window)))
+			return nil, nil
+		}
+		args.Window = dur
+	}
+
+	var out structs.IndexedSessions
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Session.Expiring", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.Sessions, nil
+}
+
 // SessionsForNode returns all the nodes belonging to a node
 func (s *HTTPServer) SessionsForNode(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	args := structs.NodeSpecificRequest{}
@@ -392,6 +392,36 @@ func TestSessionList(t *testing.T) {
 	})
 }
 
+func TestSessionExpiring(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		id := makeTestSessionTTL(t, srv, "10s")
+		makeTestSession(t, srv)
+
+		req, err := http.NewRequest("GET", "/v1/session/expiring?window=1h", nil)
+		resp := httptest.NewRecorder()
+		obj, err := srv.SessionExpiring(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		respObj, ok := obj.(structs.Sessions)
+		if !ok {
+			t.Fatalf("should work")
+		}
+		if len(respObj) != 1 || respObj[0].ID != id {
+			t.Fatalf("bad: %v", respObj)
+		}
+
+		req, err = http.NewRequest("GET", "/v1/session/expiring?window=soon", nil)
+		resp = httptest.NewRecorder()
+		if _, err := srv.SessionExpiring(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Code != 400 {
+			t.Fatalf("bad: %d", resp.Code)
+		}
+	})
+}
+
 func TestSessionsForNode(t *testing.T) {
 	httpTest(t, func(srv *HTTPServer) {
 		var ids []string
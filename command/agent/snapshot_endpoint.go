@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Snapshot is used to back up the state of the servers. GET returns a
+// snapshot archive of the state, and PUT restores the archive of the
+// body.
+func (s *HTTPServer) Snapshot(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	switch req.Method {
+	case "GET":
+		return s.snapshotSave(resp, req)
+	case "PUT":
+		return s.snapshotRestore(resp, req)
+	default:
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+}
+
+// snapshotSave writes out a point in time snapshot archive of the state,
+// redacted if asked
+func (s *HTTPServer) snapshotSave(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.SnapshotRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+	if _, ok := req.URL.Query()["redact"]; ok {
+		args.Redact = true
+		args.RedactKVPrefixes = req.URL.Query()["redact-prefix"]
+	}
+
+	var out structs.SnapshotResponse
+	if err := s.agent.RPC("Snapshot.Save", &args, &out); err != nil {
+		return nil, err
+	}
+
+	// The headers must be set before the archive is written
+	setMeta(resp, &out.QueryMeta)
+	resp.Header().Set("Content-Type", "application/x-tar")
+	resp.Header().Set("Content-Length", strconv.Itoa(len(out.Data)))
+	resp.Write(out.Data)
+	return nil, nil
+}
+
+// snapshotRestore restores the state from the archive of the body
+func (s *HTTPServer) snapshotRestore(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	args := structs.SnapshotRestoreRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Failed to read the snapshot: %v", err)))
+		return nil, nil
+	}
+	if len(data) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing snapshot archive"))
+		return nil, nil
+	}
+	args.Data = data
+
+	var out struct{}
+	if err := s.agent.RPC("Snapshot.Restore", &args, &out); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	set := func(value string) {
+		args := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt:     structs.DirEntry{Key: "test", Value: []byte(value)},
+		}
+		var out bool
+		if err := srv.agent.RPC("KVS.Apply", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	set("before")
+
+	// Save a snapshot
+	req, err := http.NewRequest("GET", "/v1/snapshot", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	if _, err := srv.Snapshot(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ct := resp.Header().Get("Content-Type"); ct != "application/x-tar" {
+		t.Fatalf("bad: %v", ct)
+	}
+	assertIndex(t, resp)
+	archive := resp.Body.Bytes()
+	meta, _, err := consul.ReadSnapshotArchive(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.Datacenter != "dc1" || meta.Records["kvs"] != 1 {
+		t.Fatalf("bad: %v", meta)
+	}
+
+	// Save a redacted snapshot
+	req, err = http.NewRequest("GET", "/v1/snapshot?redact&redact-prefix=te", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.Snapshot(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	redacted, state, err := consul.ReadSnapshotArchive(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !redacted.Redacted || bytes.Contains(state, []byte("before")) {
+		t.Fatalf("bad: %v", redacted)
+	}
+
+	set("after")
+
+	// Restore it
+	req, err = http.NewRequest("PUT", "/v1/snapshot", bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.Snapshot(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 200 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+
+	args := structs.KeyRequest{Datacenter: "dc1", Key: "test"}
+	var out structs.IndexedDirEntries
+	if err := srv.agent.RPC("KVS.Get", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Entries) != 1 || string(out.Entries[0].Value) != "before" {
+		t.Fatalf("bad: %v", out.Entries)
+	}
+
+	// An empty body is rejected
+	req, err = http.NewRequest("PUT", "/v1/snapshot", bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = httptest.NewRecorder()
+	if _, err := srv.Snapshot(resp, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Code != 400 {
+		t.Fatalf("bad: %d", resp.Code)
+	}
+}
@@ -15,6 +15,12 @@ type ServiceDefinition struct {
 	Checks            CheckTypes
 	Token             string
 	EnableTagOverride bool
+	WeightPassing     int
+	WeightWarning     int
+	Kind              structs.ServiceKind
+	Proxy             structs.ConnectProxyConfig
+	WANAddress        string
+	WANPort           int
 }
 
 func (s *ServiceDefinition) NodeService() *structs.NodeService {
@@ -25,6 +31,12 @@ func (s *ServiceDefinition) NodeService() *structs.NodeService {
 		Address:           s.Address,
 		Port:              s.Port,
 		EnableTagOverride: s.EnableTagOverride,
+		WeightPassing:     s.WeightPassing,
+		WeightWarning:     s.WeightWarning,
+		Kind:              s.Kind,
+		Proxy:             s.Proxy,
+		WANAddress:        s.WANAddress,
+		WANPort:           s.WANPort,
 	}
 	if ns.ID == "" && ns.Service != "" {
 		ns.ID = ns.Service
@@ -68,6 +80,9 @@ func (c *CheckDefinition) HealthCheck(node string) *structs.HealthCheck {
 	if health.CheckID == "" && health.Name != "" {
 		health.CheckID = health.Name
 	}
+	if c.CheckType.Valid() {
+		c.CheckType.describe(health)
+	}
 	return health
 }
 
@@ -15,6 +15,22 @@ func TestAgentStructs_HealthCheck(t *testing.T) {
 	if check.Status != structs.HealthCritical {
 		t.Fatalf("bad: %v", check.Status)
 	}
+	if check.Type != "" {
+		t.Fatalf("bad: %v", check)
+	}
+
+	// The definition of the check is recorded
+	def.CheckType = CheckType{
+		TCP:      "127.0.0.1:443",
+		Interval: 10 * time.Second,
+		Timeout:  time.Second,
+		TLS:      true,
+	}
+	check = def.HealthCheck("node1")
+	if check.Type != structs.CheckTypeTCP || check.Target != "127.0.0.1:443" ||
+		check.Interval != 10*time.Second || check.Timeout != time.Second || !check.TLS {
+		t.Fatalf("bad: %#v", check)
+	}
 }
 
 func TestAgentStructs_CheckTypes(t *testing.T) {
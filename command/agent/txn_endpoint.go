@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Txn handles requests to apply KV and catalog operations atomically.
+// The results are returned with a 200, or the errors that rolled the
+// transaction back with a 409.
+func (s *HTTPServer) Txn(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if req.Method != "PUT" {
+		resp.WriteHeader(405)
+		return nil, nil
+	}
+
+	args := structs.TxnRequest{}
+	s.parseDC(req, &args.Datacenter)
+	s.parseToken(req, &args.Token)
+	// The KV values are base64 encoded, which the standard JSON decoding
+	// handles for byte slices
+	if err := json.NewDecoder(req.Body).Decode(&args.Ops); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Request decode failed: %v", err)))
+		return nil, nil
+	}
+	if len(args.Ops) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Must provide operations"))
+		return nil, nil
+	}
+
+	var out structs.TxnResponse
+	if err := s.agent.RPC("Txn.Apply", &args, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Errors) > 0 {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(409)
+	}
+	return out, nil
+}
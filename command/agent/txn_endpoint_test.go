@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestTxnEndpoint(t *testing.T) {
+	dir, srv := makeHTTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer srv.agent.Shutdown()
+
+	testutil.WaitForLeader(t, srv.agent.RPC, "dc1")
+
+	txn := func(body string) (*httptest.ResponseRecorder, structs.TxnResponse) {
+		req, err := http.NewRequest("PUT", "/v1/txn", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.Txn(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out, _ := obj.(structs.TxnResponse)
+		return resp, out
+	}
+
+	// The values are base64 encoded
+	resp, out := txn(`[
+		{"KV": {"Verb": "set", "DirEnt": {"Key": "foo", "Value": "aGVsbG8="}}},
+		{"KV": {"Verb": "get", "DirEnt": {"Key": "foo"}}}
+	]`)
+	if resp.Code != 200 || len(out.Results) != 2 {
+		t.Fatalf("bad: %d %#v", resp.Code, out)
+	}
+	if string(out.Results[1].KV.Value) != "hello" {
+		t.Fatalf("bad: %v", out.Results[1].KV)
+	}
+
+	// A rolled back transaction is a conflict
+	resp, out = txn(`[
+		{"KV": {"Verb": "delete", "DirEnt": {"Key": "foo"}}},
+		{"KV": {"Verb": "check-index", "DirEnt": {"Key": "foo", "ModifyIndex": 1}}}
+	]`)
+	if resp.Code != 409 || len(out.Errors) != 1 || out.Errors[0].OpIndex != 1 {
+		t.Fatalf("bad: %d %#v", resp.Code, out)
+	}
+
+	resp, _ = txn(`[]`)
+	if resp.Code != 400 || !strings.Contains(resp.Body.String(), "Must provide operations") {
+		t.Fatalf("bad: %d %s", resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,304 @@
+package command
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/logutils"
+	"github.com/mitchellh/cli"
+)
+
+// debugFile is a file of the debug archive
+type debugFile struct {
+	name string
+	data []byte
+}
+
+// debugTarget is an HTTP endpoint captured at every interval
+type debugTarget struct {
+	file   string
+	path   string
+	params url.Values
+}
+
+// debugTargets are the endpoints captured at every interval. The
+// profiles are only served by agents with enable_debug set.
+var debugTargets = []debugTarget{
+	{"metrics.json", "/v1/agent/metrics", nil},
+	{"state.json", "/v1/operator/state", url.Values{"stale": []string{""}}},
+	{"goroutine.prof", "/debug/pprof/goroutine", url.Values{"debug": []string{"2"}}},
+	{"heap.prof", "/debug/pprof/heap", nil},
+}
+
+// DebugCommand is a Command implementation that captures the state of an
+// agent over time into an archive, to help with support escalations.
+type DebugCommand struct {
+	ShutdownCh <-chan struct{}
+	Ui         cli.Ui
+
+	files  []debugFile
+	redact bool
+	lock   sync.Mutex
+}
+
+func (c *DebugCommand) Help() string {
+	helpText := `
+Usage: consul debug [options]
+
+  Captures the configuration and members of an agent once, and its metrics,
+  state store statistics and goroutine and heap profiles at every interval,
+  along with its logs, for the given duration. Everything is written to a
+  gzipped tar archive to attach to a support request. Interrupting the
+  command writes what was captured so far.
+
+  The profiles are only captured from agents with enable_debug set, and
+  the state store statistics from servers with a management token.
+
+  The UUIDs of the captured files other than the profiles, which include
+  the ACL tokens and session IDs, are redacted so the archive can be
+  shared, unless -redact=false is given.
+
+Options:
+
+  -duration=2m               How long to capture for.
+  -interval=30s              How often to capture the metrics, statistics
+                             and profiles.
+  -log-level=DEBUG           Level of the captured logs.
+  -output=""                 Path of the archive. Defaults to
+                             consul-debug-<timestamp>.tar.gz.
+  -redact=true               Redacts the UUIDs of the captured files.
+  -token=""                  ACL token to use. Defaults to that of agent.
+  -http-addr=127.0.0.1:8500  HTTP address of the Consul agent.
+  -rpc-addr=127.0.0.1:8400   RPC address of the Consul agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *DebugCommand) Run(args []string) int {
+	var duration, interval time.Duration
+	var logLevel, output, token string
+	cmdFlags := flag.NewFlagSet("debug", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.DurationVar(&duration, "duration", 2*time.Minute, "")
+	cmdFlags.DurationVar(&interval, "interval", 30*time.Second, "")
+	cmdFlags.StringVar(&logLevel, "log-level", "DEBUG", "")
+	cmdFlags.StringVar(&output, "output", "", "")
+	cmdFlags.BoolVar(&c.redact, "redact", true, "")
+	cmdFlags.StringVar(&token, "token", "", "")
+	httpAddr := HTTPAddrFlag(cmdFlags)
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+	if len(cmdFlags.Args()) != 0 {
+		c.Ui.Error("Unexpected arguments")
+		return 1
+	}
+	if interval <= 0 || duration < interval {
+		c.Ui.Error("Interval must be positive, and no longer than the duration")
+		return 1
+	}
+	if output == "" {
+		output = fmt.Sprintf("consul-debug-%d.tar.gz", time.Now().Unix())
+	}
+
+	conf := consulapi.DefaultConfig()
+	conf.Address = *httpAddr
+	conf.Token = token
+	if _, err := consulapi.NewClient(conf); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Consul agent: %s", err))
+		return 1
+	}
+	client, err := RPCClient(*rpcAddr)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Consul agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	// The configuration and members are captured once. The agent must at
+	// least answer this.
+	self, err := c.get(conf, "/v1/agent/self", nil)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error querying Consul agent: %s", err))
+		return 1
+	}
+	c.add("agent.json", self)
+	if members, err := c.get(conf, "/v1/agent/members", nil); err != nil {
+		c.Ui.Error(fmt.Sprintf("Failed to capture the members: %s", err))
+	} else {
+		c.add("members.json", members)
+	}
+	if stats, err := client.Stats(); err != nil {
+		c.Ui.Error(fmt.Sprintf("Failed to capture the stats: %s", err))
+	} else if buf, err := json.MarshalIndent(stats, "", "    "); err == nil {
+		c.add("stats.json", buf)
+	}
+
+	// The logs are captured for the whole duration
+	var logs bytes.Buffer
+	var logLock sync.Mutex
+	logCh := make(chan string, 1024)
+	monHandle, err := client.Monitor(logutils.LogLevel(logLevel), logCh)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error starting monitor: %s", err))
+		return 1
+	}
+	go func() {
+		for log := range logCh {
+			if log == "" {
+				return
+			}
+			logLock.Lock()
+			logs.WriteString(log + "\n")
+			logLock.Unlock()
+		}
+	}()
+
+	c.Ui.Info(fmt.Sprintf("Capturing for %v, every %v", duration, interval))
+	deadline := time.After(duration)
+	failed := make(map[string]bool)
+	for i := 0; ; i++ {
+		c.capture(conf, i, failed)
+
+		select {
+		case <-time.After(interval):
+			continue
+		case <-deadline:
+		case <-c.ShutdownCh:
+			c.Ui.Info("Interrupted, writing the capture")
+		}
+		break
+	}
+	client.Stop(monHandle)
+
+	logLock.Lock()
+	c.add("consul.log", logs.Bytes())
+	logLock.Unlock()
+	if err := c.write(output); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error writing archive: %s", err))
+		return 1
+	}
+	c.Ui.Output(fmt.Sprintf("Saved debug archive to %s", output))
+	return 0
+}
+
+// capture captures the targets in the directory of an interval. Each
+// failing target is only reported once.
+func (c *DebugCommand) capture(conf *consulapi.Config, interval int, failed map[string]bool) {
+	for _, target := range debugTargets {
+		data, err := c.get(conf, target.path, target.params)
+		if err != nil {
+			if !failed[target.path] {
+				c.Ui.Error(fmt.Sprintf("Failed to capture %s: %s", target.path, err))
+				failed[target.path] = true
+			}
+			continue
+		}
+		c.add(fmt.Sprintf("%d/%s", interval, target.file), data)
+	}
+}
+
+// get returns the body of a GET request to the agent
+func (c *DebugCommand) get(conf *consulapi.Config, path string, params url.Values) ([]byte, error) {
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	if conf.Token != "" {
+		query.Set("token", conf.Token)
+	}
+	u := &url.URL{Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest("GET", u.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Host = conf.Address
+	req.URL.Scheme = conf.Scheme
+	req.Host = conf.Address
+	if conf.HttpAuth != nil {
+		req.SetBasicAuth(conf.HttpAuth.Username, conf.HttpAuth.Password)
+	}
+
+	resp, err := conf.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response code: %d (%s)",
+			resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// add adds a file to the archive, redacted unless it is a profile
+func (c *DebugCommand) add(name string, data []byte) {
+	if c.redact && !strings.HasSuffix(name, ".prof") {
+		data = redactIDs(data)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.files = append(c.files, debugFile{name, data})
+}
+
+// write writes the captured files to a gzipped tar archive
+func (c *DebugCommand) write(path string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	archive := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range c.files {
+		header := &tar.Header{
+			Name:    file.name,
+			Mode:    0600,
+			Size:    int64(len(file.data)),
+			ModTime: now,
+		}
+		if err = archive.WriteHeader(header); err != nil {
+			break
+		}
+		if _, err = archive.Write(file.data); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func (c *DebugCommand) Synopsis() string {
+	return "Captures debugging information from an agent"
+}
@@ -0,0 +1,106 @@
+package command
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/cli"
+)
+
+func TestDebugCommand_implements(t *testing.T) {
+	var _ cli.Command = &DebugCommand{}
+}
+
+func TestDebugCommandRun_BadArgs(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &DebugCommand{Ui: ui}
+
+	for _, args := range [][]string{
+		{"extra"},
+		{"-interval=0"},
+		{"-duration=1s", "-interval=2s"},
+	} {
+		if code := c.Run(args); code != 1 {
+			t.Fatalf("expected return code 1 for %v, got %d", args, code)
+		}
+	}
+}
+
+func TestDebugCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+
+	dir, err := ioutil.TempDir("", "debug")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "debug.tar.gz")
+
+	ui := new(cli.MockUi)
+	c := &DebugCommand{Ui: ui}
+	args := []string{
+		"-http-addr=" + a1.httpAddr,
+		"-rpc-addr=" + a1.addr,
+		"-duration=300ms",
+		"-interval=100ms",
+		"-output=" + output,
+	}
+	if code := c.Run(args); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	// Read back the archive
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	files := make(map[string]int64)
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		files[header.Name] = header.Size
+	}
+
+	// The test agent has no metrics sink nor profiles, the state
+	// statistics are captured at every interval
+	for _, name := range []string{"agent.json", "members.json", "stats.json", "0/state.json"} {
+		if files[name] == 0 {
+			t.Fatalf("missing %s: %v", name, files)
+		}
+	}
+	if _, ok := files["consul.log"]; !ok {
+		t.Fatalf("missing logs: %v", files)
+	}
+	if _, ok := files["0/heap.prof"]; ok {
+		t.Fatalf("bad: %v", files)
+	}
+}
+
+func TestDebugCommand_addRedacted(t *testing.T) {
+	id := "3f1b6c3e-8a2d-4f5e-9c1b-0d2e3f4a5b6c"
+	c := &DebugCommand{redact: true}
+	c.add("consul.log", []byte("Session "+id+" TTL expired"))
+	c.add("0/goroutine.prof", []byte(id))
+	if data := string(c.files[0].data); data != "Session <redacted> TTL expired" {
+		t.Fatalf("bad: %s", data)
+	}
+	if data := string(c.files[1].data); data != id {
+		t.Fatalf("bad: %s", data)
+	}
+}
@@ -0,0 +1,370 @@
+package command
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/command/agent"
+	"github.com/mitchellh/cli"
+)
+
+// kvExportEntry is an entry of the export format of the key/value store.
+// The values are base64 encoded so any data survives the JSON. A redacted
+// entry has no value, and isn't imported.
+type kvExportEntry struct {
+	Key      string `json:"key"`
+	Flags    uint64 `json:"flags"`
+	Value    string `json:"value"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// KVCommand is a Command implementation that reads, writes, exports and
+// imports the entries of the key/value store.
+type KVCommand struct {
+	Ui cli.Ui
+
+	// testStdin replaces the standard input in the tests
+	testStdin io.Reader
+}
+
+func (c *KVCommand) Help() string {
+	helpText := `
+Usage: consul kv <subcommand> [options] [KEY_OR_PREFIX] [DATA]
+
+  Reads, writes, exports and imports the entries of the key/value store.
+
+Subcommands:
+
+  get KEY                    Prints the value of the key. With -recurse,
+                             prints the key and value of every entry of
+                             the prefix.
+  put KEY [DATA]             Sets the value of the key to DATA.
+  delete KEY                 Deletes the key, or with -recurse every entry
+                             of the prefix.
+  export [PREFIX]            Prints the entries of the prefix as JSON,
+                             with base64 encoded values.
+  import [DATA]              Writes the entries of DATA, as printed by
+                             export. Redacted entries are skipped.
+
+  DATA is read from the standard input if it is "-" or, for import, if it
+  is missing, and from a file if it starts with "@".
+
+Options:
+
+  -datacenter=""             Datacenter of the key/value store. Defaults to
+                             that of the agent.
+  -token=""                  ACL token to use. Defaults to that of agent.
+  -stale                     Allows any server to answer the reads.
+  -recurse                   Gets or deletes every entry of the prefix.
+  -detailed                  Prints the indexes, flags and session of the
+                             entries with get.
+  -flags=0                   Flags of the entry written with put.
+  -cas                       Writes or deletes the entry only if its modify
+                             index is -modify-index. An index of 0 only
+                             writes a new entry.
+  -modify-index=0            Modify index of the entry for -cas.
+  -redact-prefix=""          Leaves out the values of the keys under the
+                             prefix from export, so it can be shared. May
+                             be repeated.
+  -http-addr=127.0.0.1:8500  HTTP address of the Consul agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *KVCommand) Run(args []string) int {
+	if len(args) == 0 {
+		c.Ui.Error(c.Help())
+		return 1
+	}
+	subcommand, args := args[0], args[1:]
+
+	var datacenter, token string
+	var stale, recurse, detailed, cas bool
+	var flags, modifyIndex uint64
+	var redactPrefixes []string
+	cmdFlags := flag.NewFlagSet("kv", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&datacenter, "datacenter", "", "")
+	cmdFlags.StringVar(&token, "token", "", "")
+	cmdFlags.BoolVar(&stale, "stale", false, "")
+	cmdFlags.BoolVar(&recurse, "recurse", false, "")
+	cmdFlags.BoolVar(&detailed, "detailed", false, "")
+	cmdFlags.Uint64Var(&flags, "flags", 0, "")
+	cmdFlags.BoolVar(&cas, "cas", false, "")
+	cmdFlags.Uint64Var(&modifyIndex, "modify-index", 0, "")
+	cmdFlags.Var((*agent.AppendSliceValue)(&redactPrefixes), "redact-prefix", "")
+	httpAddr := HTTPAddrFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+	args = cmdFlags.Args()
+
+	// Ensure the arguments match the subcommand
+	minArgs, maxArgs := 1, 1
+	switch subcommand {
+	case "get", "delete":
+	case "put":
+		maxArgs = 2
+	case "export", "import":
+		minArgs = 0
+	default:
+		c.Ui.Error(fmt.Sprintf("Unknown subcommand %q", subcommand))
+		return 1
+	}
+	if len(args) < minArgs || len(args) > maxArgs {
+		c.Ui.Error(fmt.Sprintf("Invalid arguments for %s", subcommand))
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+	if recurse && subcommand != "get" && subcommand != "delete" {
+		c.Ui.Error("Recurse may only be provided with get or delete")
+		return 1
+	}
+	if detailed && subcommand != "get" {
+		c.Ui.Error("Detailed may only be provided with get")
+		return 1
+	}
+	if flags != 0 && subcommand != "put" {
+		c.Ui.Error("Flags may only be provided with put")
+		return 1
+	}
+	if cas && (recurse || (subcommand != "put" && subcommand != "delete")) {
+		c.Ui.Error("CAS may only be provided with put or delete of a single key")
+		return 1
+	}
+	if modifyIndex != 0 && !cas {
+		c.Ui.Error("Modify index may only be provided with -cas")
+		return 1
+	}
+	if len(redactPrefixes) != 0 && subcommand != "export" {
+		c.Ui.Error("Redact prefixes may only be provided with export")
+		return 1
+	}
+
+	client, err := HTTPClientConfig(func(conf *consulapi.Config) {
+		conf.Address = *httpAddr
+		conf.Datacenter = datacenter
+		conf.Token = token
+	})
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Consul agent: %s", err))
+		return 1
+	}
+	kv := client.KV()
+	q := &consulapi.QueryOptions{AllowStale: stale}
+
+	switch subcommand {
+	case "get":
+		if recurse {
+			return c.list(kv, args[0], detailed, q)
+		}
+		return c.get(kv, args[0], detailed, q)
+
+	case "put":
+		var data []byte
+		if len(args) == 2 {
+			if data, err = c.readData(args[1]); err != nil {
+				c.Ui.Error(fmt.Sprintf("Error reading data: %s", err))
+				return 1
+			}
+		}
+		pair := &consulapi.KVPair{Key: args[0], Flags: flags, Value: data}
+		if !cas {
+			_, err = kv.Put(pair, nil)
+			return c.result(err, fmt.Sprintf("Success! Data written to: %s", args[0]))
+		}
+		pair.ModifyIndex = modifyIndex
+		ok, _, err := kv.CAS(pair, nil)
+		if err == nil && !ok {
+			err = fmt.Errorf("CAS failed, the modify index of %s isn't %d", args[0], modifyIndex)
+		}
+		return c.result(err, fmt.Sprintf("Success! Data written to: %s", args[0]))
+
+	case "delete":
+		if recurse {
+			_, err = kv.DeleteTree(args[0], nil)
+			return c.result(err, fmt.Sprintf("Success! Deleted keys with prefix: %s", args[0]))
+		}
+		if !cas {
+			_, err = kv.Delete(args[0], nil)
+			return c.result(err, fmt.Sprintf("Success! Deleted key: %s", args[0]))
+		}
+		ok, _, err := kv.DeleteCAS(&consulapi.KVPair{Key: args[0], ModifyIndex: modifyIndex}, nil)
+		if err == nil && !ok {
+			err = fmt.Errorf("CAS failed, the modify index of %s isn't %d", args[0], modifyIndex)
+		}
+		return c.result(err, fmt.Sprintf("Success! Deleted key: %s", args[0]))
+
+	case "export":
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		return c.export(kv, prefix, redactPrefixes, q)
+
+	default:
+		data := "-"
+		if len(args) == 1 {
+			data = args[0]
+		}
+		return c.importData(kv, data)
+	}
+}
+
+// result reports the outcome of a write
+func (c *KVCommand) result(err error, success string) int {
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error: %s", err))
+		return 1
+	}
+	c.Ui.Info(success)
+	return 0
+}
+
+// readData returns the data given on the command line, read from the
+// standard input for "-" and from a file for "@file"
+func (c *KVCommand) readData(data string) ([]byte, error) {
+	switch {
+	case data == "-":
+		var stdin io.Reader = os.Stdin
+		if c.testStdin != nil {
+			stdin = c.testStdin
+		}
+		return ioutil.ReadAll(stdin)
+	case strings.HasPrefix(data, "@"):
+		return ioutil.ReadFile(data[1:])
+	default:
+		return []byte(data), nil
+	}
+}
+
+// get prints the value of a key
+func (c *KVCommand) get(kv *consulapi.KV, key string, detailed bool, q *consulapi.QueryOptions) int {
+	pair, _, err := kv.Get(key, q)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error querying Consul agent: %s", err))
+		return 1
+	}
+	if pair == nil {
+		c.Ui.Error(fmt.Sprintf("Error! No key exists at: %s", key))
+		return 1
+	}
+	if detailed {
+		c.Ui.Output(c.detailed(pair))
+		return 0
+	}
+	c.Ui.Output(string(pair.Value))
+	return 0
+}
+
+// list prints the entries of a prefix
+func (c *KVCommand) list(kv *consulapi.KV, prefix string, detailed bool, q *consulapi.QueryOptions) int {
+	pairs, _, err := kv.List(prefix, q)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error querying Consul agent: %s", err))
+		return 1
+	}
+	for i, pair := range pairs {
+		if !detailed {
+			c.Ui.Output(fmt.Sprintf("%s:%s", pair.Key, pair.Value))
+			continue
+		}
+		if i > 0 {
+			c.Ui.Output("")
+		}
+		c.Ui.Output(c.detailed(pair))
+	}
+	return 0
+}
+
+// detailed formats an entry with its metadata
+func (c *KVCommand) detailed(pair *consulapi.KVPair) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "CreateIndex      %d\n", pair.CreateIndex)
+	fmt.Fprintf(&buf, "Flags            %d\n", pair.Flags)
+	fmt.Fprintf(&buf, "Key              %s\n", pair.Key)
+	fmt.Fprintf(&buf, "LockIndex        %d\n", pair.LockIndex)
+	fmt.Fprintf(&buf, "ModifyIndex      %d\n", pair.ModifyIndex)
+	fmt.Fprintf(&buf, "Session          %s\n", pair.Session)
+	fmt.Fprintf(&buf, "Value            %s", pair.Value)
+	return buf.String()
+}
+
+// export prints the entries of a prefix in the export format, leaving
+// out the values of the keys under the redacted prefixes
+func (c *KVCommand) export(kv *consulapi.KV, prefix string, redactPrefixes []string,
+	q *consulapi.QueryOptions) int {
+	pairs, _, err := kv.List(prefix, q)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error querying Consul agent: %s", err))
+		return 1
+	}
+
+	entries := make([]*kvExportEntry, 0, len(pairs))
+	for _, pair := range pairs {
+		entry := &kvExportEntry{Key: pair.Key, Flags: pair.Flags}
+		if hasAnyPrefix(pair.Key, redactPrefixes) {
+			entry.Redacted = true
+		} else {
+			entry.Value = base64.StdEncoding.EncodeToString(pair.Value)
+		}
+		entries = append(entries, entry)
+	}
+	out, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error exporting entries: %s", err))
+		return 1
+	}
+	c.Ui.Output(string(out))
+	return 0
+}
+
+// importData writes the entries of an export. Every entry is decoded
+// before the first is written, so malformed data writes nothing.
+func (c *KVCommand) importData(kv *consulapi.KV, data string) int {
+	raw, err := c.readData(data)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error reading data: %s", err))
+		return 1
+	}
+	var entries []*kvExportEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error decoding data: %s", err))
+		return 1
+	}
+	pairs := make([]*consulapi.KVPair, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Redacted {
+			c.Ui.Info(fmt.Sprintf("Skipped redacted: %s", entry.Key))
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(entry.Value)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error decoding the value of %s: %s", entry.Key, err))
+			return 1
+		}
+		pairs = append(pairs, &consulapi.KVPair{Key: entry.Key, Flags: entry.Flags, Value: value})
+	}
+
+	for _, pair := range pairs {
+		if _, err := kv.Put(pair, nil); err != nil {
+			c.Ui.Error(fmt.Sprintf("Error importing %s: %s", pair.Key, err))
+			return 1
+		}
+		c.Ui.Info(fmt.Sprintf("Imported: %s", pair.Key))
+	}
+	return 0
+}
+
+func (c *KVCommand) Synopsis() string {
+	return "Reads, writes, exports and imports key/value entries"
+}
@@ -0,0 +1,128 @@
+package command
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/mitchellh/cli"
+)
+
+func TestKVCommand_implements(t *testing.T) {
+	var _ cli.Command = &KVCommand{}
+}
+
+func TestKVCommandRun_BadArgs(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &KVCommand{Ui: ui}
+
+	for _, args := range [][]string{
+		{},
+		{"bogus", "foo"},
+		{"get"},
+		{"put", "foo", "bar", "baz"},
+		{"put", "-recurse", "foo"},
+		{"get", "-flags=1", "foo"},
+		{"delete", "-recurse", "-cas", "foo"},
+		{"put", "-modify-index=2", "foo"},
+		{"get", "-redact-prefix=app/", "foo"},
+	} {
+		if code := c.Run(args); code != 1 {
+			t.Fatalf("expected return code 1 for %v, got %d", args, code)
+		}
+	}
+}
+
+func TestKVCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+
+	testutil.WaitForLeader(t, a1.agent.RPC, "dc1")
+	addr := "-http-addr=" + a1.httpAddr
+
+	run := func(stdin string, args ...string) string {
+		ui := new(cli.MockUi)
+		c := &KVCommand{Ui: ui, testStdin: strings.NewReader(stdin)}
+		args = append(args[:1], append([]string{addr}, args[1:]...)...)
+		if code := c.Run(args); code != 0 {
+			t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+		}
+		return ui.OutputWriter.String()
+	}
+
+	run("", "put", "-flags=42", "app/foo", "bar")
+	run("binary\x00value", "put", "app/baz", "-")
+	if out := run("", "get", "app/foo"); out != "bar\n" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := run("", "get", "-recurse", "app/"); out != "app/baz:binary\x00value\napp/foo:bar\n" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Export, then import into another prefix
+	export := run("", "export", "app/")
+	var entries []*kvExportEntry
+	if err := json.Unmarshal([]byte(export), &entries); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Key != "app/foo" || entries[1].Flags != 42 ||
+		entries[1].Value != "YmFy" {
+		t.Fatalf("bad: %#v", entries)
+	}
+	for _, entry := range entries {
+		entry.Key = "copy/" + entry.Key
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	run(string(data), "import")
+
+	args := structs.KeyRequest{Datacenter: "dc1", Key: "copy/app/"}
+	var out structs.IndexedDirEntries
+	if err := a1.agent.RPC("KVS.List", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Entries) != 2 {
+		t.Fatalf("bad: %v", out.Entries)
+	}
+	if e := out.Entries[0]; e.Key != "copy/app/baz" || string(e.Value) != "binary\x00value" {
+		t.Fatalf("bad: %v", e)
+	}
+	if e := out.Entries[1]; e.Key != "copy/app/foo" || e.Flags != 42 {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// A redacted export leaves out the values, which aren't imported
+	export = run("", "export", "-redact-prefix=app/f", "app/")
+	entries = nil
+	if err := json.Unmarshal([]byte(export), &entries); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Redacted || !entries[1].Redacted || entries[1].Value != "" {
+		t.Fatalf("bad: %#v", entries)
+	}
+	if out := run(export, "import"); !strings.Contains(out, "Skipped redacted: app/foo") {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Delete
+	run("", "delete", "-recurse", "copy/")
+	run("", "delete", "app/foo")
+	if out := run("", "export"); !strings.Contains(out, "app/baz") || strings.Contains(out, "app/foo") {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestKVCommandRun_ImportInvalid(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &KVCommand{Ui: ui, testStdin: strings.NewReader(`[{"key": "foo", "value": "!!"}]`)}
+	if code := c.Run([]string{"import", "-http-addr=127.0.0.1:1"}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Error decoding the value of foo") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
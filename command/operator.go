@@ -0,0 +1,157 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/consul"
+	"github.com/mitchellh/cli"
+	"github.com/ryanuber/columnize"
+)
+
+// OperatorCommand is a Command implementation that runs the operator
+// tasks on the servers.
+type OperatorCommand struct {
+	Ui cli.Ui
+}
+
+func (c *OperatorCommand) Help() string {
+	helpText := `
+Usage: consul operator <subcommand> [options]
+
+  Runs operator tasks on the Consul servers.
+
+Subcommands:
+
+  state verify               Checks the integrity of the state store of the
+                             leader, or of a snapshot file. It reports the
+                             references to unknown nodes, services, checks
+                             or sessions, and the inconsistent indexes. The
+                             exit code is 2 if problems are found.
+
+Options:
+
+  -snapshot=""               Verifies the snapshot file saved with
+                             "consul snapshot save" rather than a server.
+                             The agent isn't contacted.
+  -datacenter=""             Datacenter of the servers. Defaults to that of
+                             the agent.
+  -stale                     Verifies the state of the server the agent
+                             talks to rather than of the leader.
+  -token=""                  ACL token to use, which must be a management
+                             token. Defaults to that of agent.
+  -http-addr=127.0.0.1:8500  HTTP address of the Consul agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *OperatorCommand) Run(args []string) int {
+	if len(args) < 2 || args[0] != "state" || args[1] != "verify" {
+		c.Ui.Error(c.Help())
+		return 1
+	}
+	args = args[2:]
+
+	var snapshot, datacenter, token string
+	var stale bool
+	cmdFlags := flag.NewFlagSet("operator", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&snapshot, "snapshot", "", "")
+	cmdFlags.StringVar(&datacenter, "datacenter", "", "")
+	cmdFlags.BoolVar(&stale, "stale", false, "")
+	cmdFlags.StringVar(&token, "token", "", "")
+	httpAddr := HTTPAddrFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+	if len(cmdFlags.Args()) != 0 {
+		c.Ui.Error("Unexpected arguments")
+		return 1
+	}
+	if snapshot != "" && (datacenter != "" || stale || token != "") {
+		c.Ui.Error("Snapshot can't be provided with -datacenter, -stale or -token")
+		return 1
+	}
+
+	var report *consulapi.StateVerifyReport
+	if snapshot != "" {
+		f, err := os.Open(snapshot)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error reading snapshot: %s", err))
+			return 1
+		}
+		defer f.Close()
+		out, err := consul.VerifySnapshotArchive(f, "")
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error verifying snapshot: %s", err))
+			return 1
+		}
+
+		// Report the same way as the servers
+		report = &consulapi.StateVerifyReport{
+			Server: out.Server,
+			Index:  out.Index,
+			Rows:   out.Rows,
+		}
+		for _, p := range out.Problems {
+			report.Problems = append(report.Problems, consulapi.StateProblem{
+				Table:   p.Table,
+				Key:     p.Key,
+				Problem: p.Problem,
+			})
+		}
+	} else {
+		client, err := HTTPClientConfig(func(conf *consulapi.Config) {
+			conf.Address = *httpAddr
+			conf.Datacenter = datacenter
+			conf.Token = token
+		})
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error connecting to Consul agent: %s", err))
+			return 1
+		}
+		report, err = client.Operator().StateVerify(&consulapi.QueryOptions{AllowStale: stale})
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error verifying state: %s", err))
+			return 1
+		}
+	}
+	return c.report(report)
+}
+
+// report prints a verification report, returning 2 if it has problems
+func (c *OperatorCommand) report(report *consulapi.StateVerifyReport) int {
+	tables := make([]string, 0, len(report.Rows))
+	for table := range report.Rows {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	rows := []string{"Table|Rows"}
+	for _, table := range tables {
+		rows = append(rows, fmt.Sprintf("%s|%d", table, report.Rows[table]))
+	}
+	c.Ui.Output(fmt.Sprintf("Verified the state of %s at index %d", report.Server, report.Index))
+	c.Ui.Output("")
+	c.Ui.Output(columnize.SimpleFormat(rows))
+	c.Ui.Output("")
+
+	if len(report.Problems) == 0 {
+		c.Ui.Output("No problems found")
+		return 0
+	}
+	problems := []string{"Table|Key|Problem"}
+	for _, p := range report.Problems {
+		problems = append(problems, fmt.Sprintf("%s|%s|%s", p.Table, p.Key, p.Problem))
+	}
+	c.Ui.Output(fmt.Sprintf("Found %d problems:", len(report.Problems)))
+	c.Ui.Output(columnize.SimpleFormat(problems))
+	return 2
+}
+
+func (c *OperatorCommand) Synopsis() string {
+	return "Runs operator tasks on the Consul servers"
+}
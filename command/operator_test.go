@@ -0,0 +1,70 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+	"github.com/mitchellh/cli"
+)
+
+func TestOperatorCommand_implements(t *testing.T) {
+	var _ cli.Command = &OperatorCommand{}
+}
+
+func TestOperatorCommandRun_BadArgs(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &OperatorCommand{Ui: ui}
+
+	for _, args := range [][]string{
+		{},
+		{"state"},
+		{"state", "stats"},
+		{"state", "verify", "extra"},
+		{"state", "verify", "-snapshot=foo", "-stale"},
+	} {
+		if code := c.Run(args); code != 1 {
+			t.Fatalf("expected return code 1 for %v, got %d", args, code)
+		}
+	}
+}
+
+func TestOperatorCommandRun_StateVerify(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+
+	testutil.WaitForLeader(t, a1.agent.RPC, "dc1")
+
+	ui := new(cli.MockUi)
+	c := &OperatorCommand{Ui: ui}
+	if code := c.Run([]string{"state", "verify", "-http-addr=" + a1.httpAddr}); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "No problems found") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// Verify a snapshot of the same state
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "backup.snap")
+	snap := &SnapshotCommand{Ui: new(cli.MockUi)}
+	if code := snap.Run([]string{"save", "-http-addr=" + a1.httpAddr, file}); code != 0 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	ui = new(cli.MockUi)
+	c = &OperatorCommand{Ui: ui}
+	if code := c.Run([]string{"state", "verify", "-snapshot=" + file}); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), a1.config.NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
@@ -0,0 +1,29 @@
+package command
+
+import (
+	"regexp"
+	"strings"
+)
+
+// redactedID replaces the IDs masked in the captured files
+var redactedID = []byte("<redacted>")
+
+// uuidRe matches the UUIDs, which are the ACL tokens and session IDs
+// Consul generates
+var uuidRe = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// redactIDs masks every UUID of data. This also masks the IDs which
+// aren't secrets, since they can't be told apart from the tokens.
+func redactIDs(data []byte) []byte {
+	return uuidRe.ReplaceAllLiteral(data, redactedID)
+}
+
+// hasAnyPrefix returns if key starts with one of the prefixes
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package command
+
+import (
+	"testing"
+)
+
+func TestRedactIDs(t *testing.T) {
+	in := "2015/06/01 [DEBUG] consul.state: Session 3f1b6c3e-8a2d-4f5e-9c1b-0d2e3f4a5b6c TTL expired"
+	out := string(redactIDs([]byte(in)))
+	if out != "2015/06/01 [DEBUG] consul.state: Session <redacted> TTL expired" {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestHasAnyPrefix(t *testing.T) {
+	prefixes := []string{"secret/", "vault"}
+	if !hasAnyPrefix("secret/db", prefixes) || !hasAnyPrefix("vault/core", prefixes) {
+		t.Fatalf("should match")
+	}
+	if hasAnyPrefix("app/secret/db", prefixes) || hasAnyPrefix("anything", nil) {
+		t.Fatalf("should not match")
+	}
+}
@@ -0,0 +1,245 @@
+package command
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/command/agent"
+	"github.com/hashicorp/consul/consul"
+	"github.com/mitchellh/cli"
+	"github.com/ryanuber/columnize"
+)
+
+// SnapshotCommand is a Command implementation that saves, restores and
+// inspects snapshot archives of the state of the servers.
+type SnapshotCommand struct {
+	Ui cli.Ui
+}
+
+func (c *SnapshotCommand) Help() string {
+	helpText := `
+Usage: consul snapshot <subcommand> [options] FILE
+
+  Saves, restores and inspects atomic, point in time snapshots of the
+  state of the servers, which include the catalog, the key/value store,
+  the sessions and the ACLs. A snapshot is taken without interrupting the
+  servers, and restoring it replaces their whole state.
+
+Subcommands:
+
+  save                       Saves a snapshot of the state to FILE.
+  restore                    Restores the state from the snapshot in FILE.
+  inspect                    Shows the metadata of the snapshot in FILE.
+
+Options:
+
+  -datacenter=""             Datacenter of the servers. Defaults to that of
+                             the agent.
+  -stale                     Allows any server to take the snapshot, not
+                             only the leader. Only valid with save.
+  -redact                    Replaces the ACL tokens and session IDs of the
+                             snapshot, so it can be shared. The snapshot
+                             can still be restored, to a test cluster.
+                             Only valid with save.
+  -redact-prefix=""          Masks the values of the keys under the prefix
+                             in a redacted snapshot. May be repeated.
+  -token=""                  ACL token to use, which must be a management
+                             token. Defaults to that of agent.
+  -http-addr=127.0.0.1:8500  HTTP address of the Consul agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *SnapshotCommand) Run(args []string) int {
+	if len(args) == 0 {
+		c.Ui.Error(c.Help())
+		return 1
+	}
+	subcommand, args := args[0], args[1:]
+
+	var datacenter, token string
+	var stale, redact bool
+	var redactPrefixes []string
+	cmdFlags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&datacenter, "datacenter", "", "")
+	cmdFlags.BoolVar(&stale, "stale", false, "")
+	cmdFlags.BoolVar(&redact, "redact", false, "")
+	cmdFlags.Var((*agent.AppendSliceValue)(&redactPrefixes), "redact-prefix", "")
+	cmdFlags.StringVar(&token, "token", "", "")
+	httpAddr := HTTPAddrFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	// Every subcommand works on a single file
+	if len(cmdFlags.Args()) != 1 {
+		c.Ui.Error("A single snapshot file must be given")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+	file := cmdFlags.Args()[0]
+	if stale && subcommand != "save" {
+		c.Ui.Error("Stale may only be provided with save")
+		return 1
+	}
+	if (redact || len(redactPrefixes) != 0) && subcommand != "save" {
+		c.Ui.Error("Redact may only be provided with save")
+		return 1
+	}
+	if len(redactPrefixes) != 0 && !redact {
+		c.Ui.Error("Redact prefixes may only be provided with -redact")
+		return 1
+	}
+
+	if subcommand == "inspect" {
+		return c.inspect(file)
+	}
+	if subcommand != "save" && subcommand != "restore" {
+		c.Ui.Error(fmt.Sprintf("Unknown subcommand %q", subcommand))
+		return 1
+	}
+
+	client, err := HTTPClientConfig(func(conf *consulapi.Config) {
+		conf.Address = *httpAddr
+		conf.Datacenter = datacenter
+		conf.Token = token
+	})
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Consul agent: %s", err))
+		return 1
+	}
+	if subcommand == "save" {
+		return c.save(client, file, stale, redact, redactPrefixes)
+	}
+	return c.restore(client, file)
+}
+
+// save downloads a snapshot to the file, redacted if asked. The archive
+// is verified before it replaces the file, so a failed save never leaves
+// a partial file.
+func (c *SnapshotCommand) save(client *consulapi.Client, file string, stale, redact bool,
+	redactPrefixes []string) int {
+	q := &consulapi.QueryOptions{AllowStale: stale}
+	var rc io.ReadCloser
+	var err error
+	if redact {
+		rc, _, err = client.Snapshot().SaveRedacted(redactPrefixes, q)
+	} else {
+		rc, _, err = client.Snapshot().Save(q)
+	}
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error saving snapshot: %s", err))
+		return 1
+	}
+	archive, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error saving snapshot: %s", err))
+		return 1
+	}
+	meta, _, err := consul.ReadSnapshotArchive(bytes.NewReader(archive))
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error verifying snapshot: %s", err))
+		return 1
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error writing snapshot: %s", err))
+		return 1
+	}
+	_, err = tmp.Write(archive)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		c.Ui.Error(fmt.Sprintf("Error writing snapshot: %s", err))
+		return 1
+	}
+
+	if meta.Redacted {
+		c.Ui.Output(fmt.Sprintf("Saved and verified redacted snapshot to index %d", meta.Index))
+		return 0
+	}
+	c.Ui.Output(fmt.Sprintf("Saved and verified snapshot to index %d", meta.Index))
+	return 0
+}
+
+// restore uploads the snapshot of the file, once it is verified
+func (c *SnapshotCommand) restore(client *consulapi.Client, file string) int {
+	archive, err := ioutil.ReadFile(file)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error reading snapshot: %s", err))
+		return 1
+	}
+	meta, _, err := consul.ReadSnapshotArchive(bytes.NewReader(archive))
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error verifying snapshot: %s", err))
+		return 1
+	}
+
+	if _, err := client.Snapshot().Restore(bytes.NewReader(archive), nil); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error restoring snapshot: %s", err))
+		return 1
+	}
+	c.Ui.Output(fmt.Sprintf("Restored snapshot at index %d", meta.Index))
+	return 0
+}
+
+// inspect shows the metadata of the snapshot of the file, without
+// contacting the agent
+func (c *SnapshotCommand) inspect(file string) int {
+	f, err := os.Open(file)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error reading snapshot: %s", err))
+		return 1
+	}
+	defer f.Close()
+	meta, _, err := consul.ReadSnapshotArchive(f)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error verifying snapshot: %s", err))
+		return 1
+	}
+
+	result := []string{
+		fmt.Sprintf("Index|%d", meta.Index),
+		fmt.Sprintf("Datacenter|%s", meta.Datacenter),
+		fmt.Sprintf("Server|%s", meta.Server),
+		fmt.Sprintf("Created|%s", meta.Created),
+		fmt.Sprintf("Size|%d", meta.Size),
+		fmt.Sprintf("Version|%d", meta.Version),
+		fmt.Sprintf("Redacted|%v", meta.Redacted),
+	}
+	c.Ui.Output(columnize.SimpleFormat(result))
+
+	tables := make([]string, 0, len(meta.Records))
+	for table := range meta.Records {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	records := []string{"Table|Records"}
+	for _, table := range tables {
+		records = append(records, fmt.Sprintf("%s|%d", table, meta.Records[table]))
+	}
+	c.Ui.Output("")
+	c.Ui.Output(columnize.SimpleFormat(records))
+	return 0
+}
+
+func (c *SnapshotCommand) Synopsis() string {
+	return "Saves, restores and inspects snapshots of the server state"
+}
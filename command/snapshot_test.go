@@ -0,0 +1,112 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/mitchellh/cli"
+)
+
+func TestSnapshotCommand_implements(t *testing.T) {
+	var _ cli.Command = &SnapshotCommand{}
+}
+
+func TestSnapshotCommandRun_BadArgs(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &SnapshotCommand{Ui: ui}
+
+	for _, args := range [][]string{
+		{},
+		{"save"},
+		{"save", "a", "b"},
+		{"restore", "-stale", "a"},
+		{"restore", "-redact", "a"},
+		{"save", "-redact-prefix=secret/", "a"},
+		{"bogus", "a"},
+	} {
+		if code := c.Run(args); code != 1 {
+			t.Fatalf("expected return code 1 for %v, got %d", args, code)
+		}
+	}
+}
+
+func TestSnapshotCommandRun(t *testing.T) {
+	a1 := testAgent(t)
+	defer a1.Shutdown()
+
+	testutil.WaitForLeader(t, a1.agent.RPC, "dc1")
+
+	set := func(value string) {
+		args := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt:     structs.DirEntry{Key: "test", Value: []byte(value)},
+		}
+		var out bool
+		if err := a1.agent.RPC("KVS.Apply", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	set("before")
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "backup.snap")
+
+	// Save
+	ui := new(cli.MockUi)
+	c := &SnapshotCommand{Ui: ui}
+	if code := c.Run([]string{"save", "-http-addr=" + a1.httpAddr, file}); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "Saved and verified snapshot") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// Save a redacted snapshot
+	ui = new(cli.MockUi)
+	c = &SnapshotCommand{Ui: ui}
+	redacted := filepath.Join(dir, "redacted.snap")
+	saveArgs := []string{"save", "-http-addr=" + a1.httpAddr, "-redact", "-redact-prefix=te", redacted}
+	if code := c.Run(saveArgs); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "Saved and verified redacted snapshot") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// Inspect
+	ui = new(cli.MockUi)
+	c = &SnapshotCommand{Ui: ui}
+	if code := c.Run([]string{"inspect", file}); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "dc1") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// Restore
+	set("after")
+	ui = new(cli.MockUi)
+	c = &SnapshotCommand{Ui: ui}
+	if code := c.Run([]string{"restore", "-http-addr=" + a1.httpAddr, file}); code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	args := structs.KeyRequest{Datacenter: "dc1", Key: "test"}
+	var out structs.IndexedDirEntries
+	if err := a1.agent.RPC("KVS.Get", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Entries) != 1 || string(out.Entries[0].Value) != "before" {
+		t.Fatalf("bad: %v", out.Entries)
+	}
+}
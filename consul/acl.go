@@ -112,6 +112,9 @@ type aclCache struct {
 
 	// The RPC function used to talk to the client/server
 	rpc rpcFn
+
+	// local resolves a token from the replicated ACLs, if they are
+	local func(id string) (acl.ACL, error)
 }
 
 // newAclCache returns a new cache layer for ACLs and policies
@@ -179,6 +182,18 @@ func (c *aclCache) lookupACL(id, authDC string) (acl.ACL, error) {
 		c.logger.Printf("[ERR] consul.acl: Failed to get policy for '%s': %v", id, err)
 	}
 
+	// Fall back to the replicated ACLs. A token missing from them may
+	// not be replicated yet, so the down policy applies.
+	if c.local != nil {
+		compiled, err := c.local(id)
+		if err == nil {
+			return compiled, nil
+		}
+		if !strings.Contains(err.Error(), aclNotFound) {
+			c.logger.Printf("[ERR] consul.acl: Failed to resolve '%s' from the replicated ACLs: %v", id, err)
+		}
+	}
+
 	// Unable to refresh, apply the down policy
 	switch c.config.ACLDownPolicy {
 	case "allow":
@@ -266,19 +281,27 @@ func (f *aclFilter) filterService(service string) bool {
 }
 
 // filterHealthChecks is used to filter a set of health checks down based on
-// the configured ACL rules for a token.
+// the configured ACL rules for a token. The checks may be shared with the
+// state store's query cache, so a new slice is built if any are dropped.
 func (f *aclFilter) filterHealthChecks(checks *structs.HealthChecks) {
 	hc := *checks
-	for i := 0; i < len(hc); i++ {
-		check := hc[i]
+	var out structs.HealthChecks
+	for i, check := range hc {
 		if f.filterService(check.ServiceName) {
+			if out != nil {
+				out = append(out, check)
+			}
 			continue
 		}
 		f.logger.Printf("[DEBUG] consul: dropping check %q from result due to ACLs", check.CheckID)
-		hc = append(hc[:i], hc[i+1:]...)
-		i--
+		if out == nil {
+			out = make(structs.HealthChecks, i, len(hc))
+			copy(out, hc[:i])
+		}
+	}
+	if out != nil {
+		*checks = out
 	}
-	*checks = hc
 }
 
 // filterServices is used to filter a set of services based on ACLs.
@@ -293,45 +316,123 @@ func (f *aclFilter) filterServices(services structs.Services) {
 }
 
 // filterServiceNodes is used to filter a set of nodes for a given service
-// based on the configured ACL rules.
+// based on the configured ACL rules. Like filterHealthChecks, the nodes
+// are never modified in place.
 func (f *aclFilter) filterServiceNodes(nodes *structs.ServiceNodes) {
 	sn := *nodes
-	for i := 0; i < len(sn); i++ {
-		node := sn[i]
+	var out structs.ServiceNodes
+	for i, node := range sn {
 		if f.filterService(node.ServiceName) {
+			if out != nil {
+				out = append(out, node)
+			}
 			continue
 		}
 		f.logger.Printf("[DEBUG] consul: dropping node %q from result due to ACLs", node.Node)
-		sn = append(sn[:i], sn[i+1:]...)
-		i--
+		if out == nil {
+			out = make(structs.ServiceNodes, i, len(sn))
+			copy(out, sn[:i])
+		}
+	}
+	if out != nil {
+		*nodes = out
 	}
-	*nodes = sn
 }
 
 // filterNodeServices is used to filter services on a given node base on ACLs.
-func (f *aclFilter) filterNodeServices(services *structs.NodeServices) {
-	for svc, _ := range services.Services {
+// The node services may be shared, so they are replaced with a copy if any
+// service is dropped.
+func (f *aclFilter) filterNodeServices(services **structs.NodeServices) {
+	ns := *services
+	var out map[string]*structs.NodeService
+	for svc, _ := range ns.Services {
 		if f.filterService(svc) {
 			continue
 		}
 		f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", svc)
-		delete(services.Services, svc)
+		if out == nil {
+			out = make(map[string]*structs.NodeService, len(ns.Services))
+			for id, srv := range ns.Services {
+				out[id] = srv
+			}
+		}
+		delete(out, svc)
+	}
+	if out != nil {
+		*services = &structs.NodeServices{
+			Node:     ns.Node,
+			Services: out,
+		}
 	}
 }
 
-// filterCheckServiceNodes is used to filter nodes based on ACL rules.
+// filterCheckServiceNodes is used to filter nodes based on ACL rules. Like
+// filterHealthChecks, the nodes are never modified in place.
 func (f *aclFilter) filterCheckServiceNodes(nodes *structs.CheckServiceNodes) {
 	csn := *nodes
-	for i := 0; i < len(csn); i++ {
-		node := csn[i]
+	var out structs.CheckServiceNodes
+	for i, node := range csn {
 		if f.filterService(node.Service.Service) {
+			if out != nil {
+				out = append(out, node)
+			}
 			continue
 		}
 		f.logger.Printf("[DEBUG] consul: dropping node %q from result due to ACLs", node.Node.Node)
-		csn = append(csn[:i], csn[i+1:]...)
+		if out == nil {
+			out = make(structs.CheckServiceNodes, i, len(csn))
+			copy(out, csn[:i])
+		}
+	}
+	if out != nil {
+		*nodes = out
+	}
+}
+
+// filterCatalogDiff is used to filter the services and checks of a
+// catalog diff, and their removals, based on ACL rules. The diffs are
+// built for each query, so they are filtered in place.
+func (f *aclFilter) filterCatalogDiff(diff *structs.CatalogDiff) {
+	services := diff.Services[:0]
+	for _, srv := range diff.Services {
+		if f.filterService(srv.Service) {
+			services = append(services, srv)
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", srv.Service)
+	}
+	diff.Services = services
+	f.filterHealthChecks(&diff.Checks)
+	diff.RemovedServices = f.filterCatalogRemovals(diff.RemovedServices)
+	diff.RemovedChecks = f.filterCatalogRemovals(diff.RemovedChecks)
+}
+
+// filterCatalogRemovals is used to filter removals by the service they
+// belong to
+func (f *aclFilter) filterCatalogRemovals(removals []*structs.CatalogRemoval) []*structs.CatalogRemoval {
+	out := removals[:0]
+	for _, removal := range removals {
+		if f.filterService(removal.ServiceName) {
+			out = append(out, removal)
+		}
+	}
+	return out
+}
+
+// filterHealthSummaries is used to filter the health summaries of the
+// services based on ACL rules. The summaries are built for each query,
+// so they are filtered in place.
+func (f *aclFilter) filterHealthSummaries(summaries *structs.ServiceHealthSummaries) {
+	hs := *summaries
+	for i := 0; i < len(hs); i++ {
+		if f.filterService(hs[i].Service) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", hs[i].Service)
+		hs = append(hs[:i], hs[i+1:]...)
 		i--
 	}
-	*nodes = csn
+	*summaries = hs
 }
 
 // filterNodeDump is used to filter through all parts of a node dump and
@@ -367,8 +468,9 @@ func (f *aclFilter) filterNodeDump(dump *structs.NodeDump) {
 }
 
 // filterACL is used to filter results from our service catalog based on the
-// rules configured for the provided token. The subject is scrubbed and
-// modified in-place, leaving only resources the token can access.
+// rules configured for the provided token. The subject is scrubbed, leaving
+// only resources the token can access. Results that may be shared with the
+// query cache are replaced rather than modified in-place.
 func (s *Server) filterACL(token string, subj interface{}) error {
 	// Get the ACL from the token
 	acl, err := s.resolveToken(token)
@@ -396,7 +498,7 @@ func (s *Server) filterACL(token string, subj interface{}) error {
 
 	case *structs.IndexedNodeServices:
 		if v.NodeServices != nil {
-			filt.filterNodeServices(v.NodeServices)
+			filt.filterNodeServices(&v.NodeServices)
 		}
 
 	case *structs.IndexedCheckServiceNodes:
@@ -405,6 +507,14 @@ func (s *Server) filterACL(token string, subj interface{}) error {
 	case *structs.IndexedNodeDump:
 		filt.filterNodeDump(&v.Dump)
 
+	case *structs.IndexedServiceHealthSummaries:
+		filt.filterHealthSummaries(&v.Summaries)
+
+	case *structs.IndexedCatalogDiff:
+		if v.Diff != nil {
+			filt.filterCatalogDiff(v.Diff)
+		}
+
 	default:
 		panic(fmt.Errorf("Unhandled type passed to ACL filter: %#v", subj))
 	}
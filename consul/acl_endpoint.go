@@ -198,6 +198,88 @@ func (a *ACL) List(args *structs.DCSpecificRequest,
 		func() error {
 			var err error
 			reply.Index, reply.ACLs, err = state.ACLList()
-			return err
+			if err != nil {
+				return err
+			}
+			return sortACLs(reply.ACLs, args.SortBy)
 		})
 }
+
+// Explain is used to check whether a token, or a set of rules, allows an
+// operation, to debug ACL denials. The token is resolved like the
+// requests of the datacenter resolve theirs, so the explanation is the
+// decision they would get, and the rules are compiled like those of a
+// client token. Using a token requires knowing it, so no permission is
+// checked.
+func (a *ACL) Explain(args *structs.ACLExplainRequest, reply *structs.ACLExplanation) error {
+	if done, err := a.srv.forward("ACL.Explain", args, args, reply); done {
+		return err
+	}
+
+	// Verify ACLs are enabled
+	if a.srv.config.ACLDatacenter == "" {
+		return fmt.Errorf(aclDisabled)
+	}
+
+	var compiled acl.ACL
+	if args.Rules != "" {
+		if args.ACL != "" {
+			return fmt.Errorf("Cannot explain both a token and rules")
+		}
+		policy, err := acl.Parse(args.Rules)
+		if err != nil {
+			return err
+		}
+		parent := acl.RootACL(a.srv.config.ACLDefaultPolicy)
+		if parent == nil {
+			return fmt.Errorf("Invalid default policy %q", a.srv.config.ACLDefaultPolicy)
+		}
+		if compiled, err = acl.New(parent, policy); err != nil {
+			return err
+		}
+	} else {
+		id := args.ACL
+		if id == "" {
+			id = args.Token
+		}
+		var err error
+		if compiled, err = a.srv.resolveToken(id); err != nil {
+			return err
+		}
+	}
+
+	explanation, err := acl.Explain(compiled, acl.Operation(args.Operation), args.Name)
+	if err != nil {
+		return err
+	}
+	reply.Allowed = explanation.Allowed
+	if explanation.Matched {
+		reply.Rule = explanation.Rule.String()
+	} else {
+		reply.Root = explanation.Root
+	}
+	a.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// ReplicationStatus is used to report the state of the replication of
+// the ACLs of the ACL datacenter. It is run by the leader, which runs
+// the replication. The status holds no secrets, so no permission is
+// checked.
+func (a *ACL) ReplicationStatus(args *structs.DCSpecificRequest,
+	reply *structs.ACLReplicationStatus) error {
+	// The status is only known by the leader
+	args.AllowStale = false
+	if done, err := a.srv.forward("ACL.ReplicationStatus", args, args, reply); done {
+		return err
+	}
+
+	a.srv.aclReplicationStatusLock.RLock()
+	*reply = a.srv.aclReplicationStatus
+	a.srv.aclReplicationStatusLock.RUnlock()
+	reply.Enabled = a.srv.aclReplicationEnabled()
+	if reply.Enabled {
+		reply.SourceDatacenter = a.srv.config.ACLDatacenter
+	}
+	return nil
+}
@@ -465,3 +465,87 @@ func TestACLEndpoint_List_Denied(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 }
+
+func TestACLEndpoint_Explain(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: `key "foo/" { policy = "read" }`,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	explain := func(args structs.ACLExplainRequest) *structs.ACLExplanation {
+		args.Datacenter = "dc1"
+		var out structs.ACLExplanation
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Explain", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return &out
+	}
+
+	// A token, given explicitly
+	out := explain(structs.ACLExplainRequest{ACL: id, Operation: "key:write", Name: "foo/bar"})
+	if out.Allowed || out.Rule != `key "foo/" { policy = "read" }` {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The token of the request, which falls back to the default policy
+	out = explain(structs.ACLExplainRequest{
+		Operation:    "key:read",
+		Name:         "bar",
+		QueryOptions: structs.QueryOptions{Token: id},
+	})
+	if out.Allowed || out.Rule != "" || out.Root != "deny" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The management token
+	out = explain(structs.ACLExplainRequest{ACL: "root", Operation: "acl:modify"})
+	if !out.Allowed || out.Root != "manage" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Raw rules
+	out = explain(structs.ACLExplainRequest{
+		Rules:     `service "web" { policy = "write" }`,
+		Operation: "service:write",
+		Name:      "web",
+	})
+	if !out.Allowed || out.Rule != `service "web" { policy = "write" }` {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Invalid requests
+	for _, args := range []structs.ACLExplainRequest{
+		{ACL: id, Operation: "key:delete", Name: "foo"},
+		{ACL: id, Rules: `key "" { policy = "read" }`, Operation: "key:read"},
+		{Rules: `key "" { policy = "bogus" }`, Operation: "key:read"},
+		{ACL: "nope", Operation: "key:read"},
+	} {
+		args.Datacenter = "dc1"
+		var out structs.ACLExplanation
+		if err := msgpackrpc.CallWithCodec(codec, "ACL.Explain", &args, &out); err == nil {
+			t.Fatalf("should fail: %v", args)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// aclReplicationMaxBackoff caps the doubling of the retry interval of a
+// failing replication
+const aclReplicationMaxBackoff = 4
+
+// aclReplicationEnabled returns if this server replicates the ACLs of
+// the ACL datacenter
+func (s *Server) aclReplicationEnabled() bool {
+	authDC := s.config.ACLDatacenter
+	return authDC != "" && authDC != s.config.Datacenter && s.config.ACLReplicationToken != ""
+}
+
+// aclLocal resolves a token from the replicated ACLs of the local state,
+// like the ACL datacenter resolves it. The ACL isn't cached, since the
+// replicated ACLs change behind the back of the followers, and it is
+// only used while the ACL datacenter can't be reached.
+func (s *Server) aclLocal(id string) (acl.ACL, error) {
+	parentID, rules, err := s.aclFault(id)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := s.aclAuthCache.GetPolicy(rules)
+	if err != nil {
+		return nil, err
+	}
+	parent := acl.RootACL(parentID)
+	if parent == nil {
+		return nil, fmt.Errorf("Invalid parent policy %q", parentID)
+	}
+	return acl.New(parent, policy)
+}
+
+// updateACLReplicationStatus applies a change to the replication status
+func (s *Server) updateACLReplicationStatus(update func(status *structs.ACLReplicationStatus)) {
+	s.aclReplicationStatusLock.Lock()
+	defer s.aclReplicationStatusLock.Unlock()
+	update(&s.aclReplicationStatus)
+}
+
+// runACLReplication runs while we are the leader of a secondary
+// datacenter, and keeps the local ACLs in sync with those of the ACL
+// datacenter. The ACLs are listed with blocking queries, so a change is
+// replicated as soon as it is committed, and only the ACLs that differ
+// from the local ones are written.
+func (s *Server) runACLReplication(stopCh chan struct{}) {
+	authDC := s.config.ACLDatacenter
+	s.updateACLReplicationStatus(func(status *structs.ACLReplicationStatus) {
+		status.Enabled = true
+		status.Running = true
+		status.SourceDatacenter = authDC
+	})
+	defer s.updateACLReplicationStatus(func(status *structs.ACLReplicationStatus) {
+		status.Running = false
+	})
+	s.logger.Printf("[INFO] consul: ACL replication from %s started", authDC)
+
+	// The replicated index is only known by the leader that replicated
+	// it, so a new leader starts with a full sync
+	var lastRemoteIndex uint64
+	failures := 0
+	for {
+		index, err := s.replicateACLs(lastRemoteIndex, stopCh)
+		if err == nil {
+			lastRemoteIndex = index
+			failures = 0
+			s.updateACLReplicationStatus(func(status *structs.ACLReplicationStatus) {
+				status.ReplicatedIndex = index
+				status.LastSuccess = time.Now().UTC()
+			})
+			select {
+			case <-stopCh:
+				return
+			default:
+				continue
+			}
+		}
+
+		s.logger.Printf("[WARN] consul: ACL replication from %s failed: %v", authDC, err)
+		metrics.IncrCounter([]string{"consul", "acl", "replication", "error"}, 1)
+		s.updateACLReplicationStatus(func(status *structs.ACLReplicationStatus) {
+			status.LastError = time.Now().UTC()
+			status.LastErrorMessage = err.Error()
+		})
+		wait := s.config.ACLReplicationInterval << uint(failures)
+		if failures < aclReplicationMaxBackoff {
+			failures++
+		}
+		select {
+		case <-time.After(wait):
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// replicateACLs waits for the ACLs of the ACL datacenter to change past
+// the given index, and applies them to the local state. It returns the
+// index of the replicated ACLs.
+func (s *Server) replicateACLs(lastRemoteIndex uint64, stopCh chan struct{}) (uint64, error) {
+	args := structs.DCSpecificRequest{
+		Datacenter: s.config.ACLDatacenter,
+		QueryOptions: structs.QueryOptions{
+			Token:         s.config.ACLReplicationToken,
+			MinQueryIndex: lastRemoteIndex,
+			AllowStale:    true,
+		},
+	}
+	var remote structs.IndexedACLs
+	if err := s.RPC("ACL.List", &args, &remote); err != nil {
+		return 0, err
+	}
+
+	// Leadership may be lost while the query blocks
+	select {
+	case <-stopCh:
+		return 0, fmt.Errorf("leadership lost")
+	default:
+	}
+
+	// A stale server can lag behind the replicated index, in which case
+	// its ACLs are older than the local ones
+	if remote.Index < lastRemoteIndex {
+		return lastRemoteIndex, nil
+	}
+
+	_, local, err := s.fsm.State().ACLList()
+	if err != nil {
+		return 0, err
+	}
+	upserts, deletes := diffACLs(local, remote.ACLs)
+	if len(upserts) == 0 && len(deletes) == 0 {
+		return remote.Index, nil
+	}
+	defer metrics.MeasureSince([]string{"consul", "leader", "replicateACLs"}, time.Now())
+
+	for _, acl := range upserts {
+		req := structs.ACLRequest{
+			Datacenter: s.config.Datacenter,
+			Op:         structs.ACLSet,
+			ACL:        *acl,
+		}
+		if _, err := s.raftApply(structs.ACLRequestType, &req); err != nil {
+			return 0, fmt.Errorf("failed to replicate ACL '%s': %v", acl.ID, err)
+		}
+	}
+	for _, id := range deletes {
+		req := structs.ACLRequest{
+			Datacenter: s.config.Datacenter,
+			Op:         structs.ACLDelete,
+			ACL:        structs.ACL{ID: id},
+		}
+		if _, err := s.raftApply(structs.ACLRequestType, &req); err != nil {
+			return 0, fmt.Errorf("failed to delete ACL '%s': %v", id, err)
+		}
+	}
+	s.logger.Printf("[DEBUG] consul: replicated %d ACLs and deleted %d at index %d",
+		len(upserts), len(deletes), remote.Index)
+	return remote.Index, nil
+}
+
+// diffACLs returns the remote ACLs missing or different locally, and the
+// IDs of the local ACLs missing remotely. The indexes aren't compared,
+// since the local ACLs have the indexes of the local state.
+func diffACLs(local, remote structs.ACLs) (structs.ACLs, []string) {
+	existing := make(map[string]*structs.ACL, len(local))
+	for _, acl := range local {
+		existing[acl.ID] = acl
+	}
+
+	var upserts structs.ACLs
+	for _, acl := range remote {
+		l, ok := existing[acl.ID]
+		delete(existing, acl.ID)
+		if ok && l.Name == acl.Name && l.Type == acl.Type && l.Rules == acl.Rules {
+			continue
+		}
+		upserts = append(upserts, acl)
+	}
+
+	deletes := make([]string, 0, len(existing))
+	for id := range existing {
+		deletes = append(deletes, id)
+	}
+	sort.Strings(deletes)
+	return upserts, deletes
+}
@@ -0,0 +1,206 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestACLReplication_diffACLs(t *testing.T) {
+	local := structs.ACLs{
+		&structs.ACL{ID: "same", Name: "same", Rules: "a", ModifyIndex: 10},
+		&structs.ACL{ID: "changed", Name: "changed", Rules: "a"},
+		&structs.ACL{ID: "gone2", Name: "gone"},
+		&structs.ACL{ID: "gone1", Name: "gone"},
+	}
+	remote := structs.ACLs{
+		&structs.ACL{ID: "same", Name: "same", Rules: "a", ModifyIndex: 20},
+		&structs.ACL{ID: "changed", Name: "changed", Rules: "b"},
+		&structs.ACL{ID: "new", Name: "new"},
+	}
+
+	upserts, deletes := diffACLs(local, remote)
+	if len(upserts) != 2 || upserts[0].ID != "changed" || upserts[1].ID != "new" {
+		t.Fatalf("bad: %#v", upserts)
+	}
+	if !reflect.DeepEqual(deletes, []string{"gone1", "gone2"}) {
+		t.Fatalf("bad: %#v", deletes)
+	}
+
+	upserts, deletes = diffACLs(remote, remote)
+	if len(upserts) != 0 || len(deletes) != 0 {
+		t.Fatalf("bad: %#v %#v", upserts, deletes)
+	}
+}
+
+func TestACLReplication(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+		c.ACLDatacenter = "dc1"
+		c.ACLDownPolicy = "deny"
+		c.ACLReplicationToken = "root"
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	// Create a new token
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testACLPolicy,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The token should be replicated
+	testutil.WaitForResult(func() (bool, error) {
+		_, acl, err := s2.fsm.State().ACLGet(id)
+		if err != nil {
+			return false, err
+		}
+		return acl != nil && acl.Rules == testACLPolicy, fmt.Errorf("not replicated: %#v", acl)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Check the status
+	statusArgs := structs.DCSpecificRequest{Datacenter: "dc2"}
+	var status structs.ACLReplicationStatus
+	if err := s1.RPC("ACL.ReplicationStatus", &statusArgs, &status); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !status.Enabled || !status.Running || status.SourceDatacenter != "dc1" {
+		t.Fatalf("bad: %#v", status)
+	}
+	if status.ReplicatedIndex == 0 || status.LastSuccess.IsZero() {
+		t.Fatalf("bad: %#v", status)
+	}
+
+	// The token should still resolve from the replicated ACLs once the
+	// ACL datacenter is gone
+	s1.Shutdown()
+	acl, err := s2.resolveToken(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acl.KeyRead("bar") {
+		t.Fatalf("unexpected read")
+	}
+	if !acl.KeyRead("foo/test") {
+		t.Fatalf("unexpected failed read")
+	}
+
+	// An unknown token gets the down policy
+	acl, err = s2.resolveToken("nope")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acl.KeyRead("foo/test") {
+		t.Fatalf("unexpected read")
+	}
+}
+
+func TestACLReplication_Deletes(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+		c.ACLDatacenter = "dc1"
+		c.ACLReplicationToken = "root"
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name: "User token",
+			Type: structs.ACLTypeClient,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		_, acl, err := s2.fsm.State().ACLGet(id)
+		return acl != nil, err
+	}, func(err error) {
+		t.Fatalf("not replicated: %v", err)
+	})
+
+	// Destroy the token, the replica should go too
+	arg.Op = structs.ACLDelete
+	arg.ACL.ID = id
+	if err := s1.RPC("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		_, acl, err := s2.fsm.State().ACLGet(id)
+		return acl == nil, err
+	}, func(err error) {
+		t.Fatalf("not deleted: %v", err)
+	})
+}
+
+func TestACLReplication_Disabled(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The ACL datacenter never replicates
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var status structs.ACLReplicationStatus
+	if err := s1.RPC("ACL.ReplicationStatus", &args, &status); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if status.Enabled || status.Running {
+		t.Fatalf("bad: %#v", status)
+	}
+}
@@ -760,16 +760,22 @@ func TestACL_filterNodeServices(t *testing.T) {
 	}
 
 	// Try permissive filtering
+	ns := &services
 	filt := newAclFilter(acl.AllowAll(), nil)
-	filt.filterNodeServices(&services)
-	if len(services.Services) != 1 {
-		t.Fatalf("bad: %#v", services.Services)
+	filt.filterNodeServices(&ns)
+	if ns != &services || len(ns.Services) != 1 {
+		t.Fatalf("bad: %#v", ns.Services)
 	}
 
 	// Try restrictive filtering
 	filt = newAclFilter(acl.DenyAll(), nil)
-	filt.filterNodeServices(&services)
-	if len(services.Services) != 0 {
+	filt.filterNodeServices(&ns)
+	if len(ns.Services) != 0 {
+		t.Fatalf("bad: %#v", ns.Services)
+	}
+
+	// The original services are left untouched
+	if len(services.Services) != 1 {
 		t.Fatalf("bad: %#v", services.Services)
 	}
 }
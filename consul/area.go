@@ -0,0 +1,209 @@
+package consul
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// areaServer is a server of the peer datacenter of an area
+type areaServer struct {
+	addr   net.Addr
+	status structs.AreaServer
+}
+
+// areaRoute links the local datacenter to the peer datacenter of an area
+type areaRoute struct {
+	area    *structs.Area
+	servers []*areaServer
+}
+
+// areaRouter routes the RPCs of the peer datacenters of the network
+// areas. The datacenters known from the WAN pool are routed through it
+// first, so an area only adds a path to the datacenters out of the pool.
+type areaRouter struct {
+	l      sync.RWMutex
+	routes map[string]*areaRoute
+}
+
+func newAreaRouter() *areaRouter {
+	return &areaRouter{routes: make(map[string]*areaRoute)}
+}
+
+// pick returns a random healthy server of a peer datacenter, or nil if
+// no area links to it
+func (r *areaRouter) pick(dc string) net.Addr {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	route, ok := r.routes[dc]
+	if !ok {
+		return nil
+	}
+	var healthy []*areaServer
+	for _, server := range route.servers {
+		if server.status.Healthy {
+			healthy = append(healthy, server)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	return healthy[rand.Int31()%int32(len(healthy))].addr
+}
+
+// datacenters returns the peer datacenters of the areas
+func (r *areaRouter) datacenters() []string {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	dcs := make([]string, 0, len(r.routes))
+	for dc := range r.routes {
+		dcs = append(dcs, dc)
+	}
+	return dcs
+}
+
+// servers returns the status of the servers of an area
+func (r *areaRouter) servers(id string) (*structs.AreaServers, bool) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	for dc, route := range r.routes {
+		if route.area.ID != id {
+			continue
+		}
+		out := &structs.AreaServers{Datacenter: dc}
+		for _, server := range route.servers {
+			status := server.status
+			out.Servers = append(out.Servers, &status)
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// runAreas keeps the routes of the areas up to date, until the server
+// shuts down. Every server routes the RPCs it forwards, so it runs on
+// all of them rather than on the leader.
+func (s *Server) runAreas() {
+	for {
+		state := s.fsm.State()
+		notify := make(chan struct{}, 1)
+		tables := state.QueryTables("Areas")
+		state.Watch(tables, notify)
+
+		if err := s.refreshAreas(); err != nil {
+			s.logger.Printf("[ERR] consul: failed to refresh the network areas: %v", err)
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(s.config.AreaRefreshInterval):
+		case <-s.shutdownCh:
+			state.StopWatch(tables, notify)
+			return
+		}
+		state.StopWatch(tables, notify)
+	}
+}
+
+// refreshAreas discovers the servers of the peer datacenter of every
+// area, and replaces the routes with them
+func (s *Server) refreshAreas() error {
+	_, areas, err := s.fsm.State().AreaList()
+	if err != nil {
+		return err
+	}
+
+	routes := make(map[string]*areaRoute, len(areas))
+	for _, area := range areas {
+		routes[area.PeerDatacenter] = &areaRoute{
+			area:    area,
+			servers: s.discoverAreaServers(area),
+		}
+	}
+
+	s.areas.l.Lock()
+	s.areas.routes = routes
+	s.areas.l.Unlock()
+	return nil
+}
+
+// discoverAreaServers lists the Raft peers of the peer datacenter of an
+// area from the first of its join addresses that answers. The join
+// addresses are returned as unhealthy servers if none does, with their
+// errors.
+func (s *Server) discoverAreaServers(area *structs.Area) []*areaServer {
+	defer metrics.MeasureSince([]string{"consul", "area", "refresh"}, time.Now())
+
+	var failed []*areaServer
+	for _, join := range area.RetryJoin {
+		server := &areaServer{status: structs.AreaServer{Address: join}}
+		peers, err := s.areaPeers(area, join)
+		if err != nil {
+			server.status.LastError = err.Error()
+			failed = append(failed, server)
+			continue
+		}
+
+		var servers []*areaServer
+		now := time.Now().UTC()
+		sort.Strings(peers)
+		for _, peer := range peers {
+			addr, err := net.ResolveTCPAddr("tcp", peer)
+			if err != nil {
+				s.logger.Printf("[WARN] consul: invalid server address '%s' in area %s: %v",
+					peer, area.ID, err)
+				continue
+			}
+			servers = append(servers, &areaServer{
+				addr: addr,
+				status: structs.AreaServer{
+					Address:     peer,
+					Healthy:     true,
+					LastContact: now,
+				},
+			})
+		}
+		return servers
+	}
+
+	if len(failed) > 0 {
+		s.logger.Printf("[WARN] consul: no server of datacenter %s reached in area %s",
+			area.PeerDatacenter, area.ID)
+	}
+	return failed
+}
+
+// areaPeers asks the server at a join address of an area for the Raft
+// peers of its datacenter
+func (s *Server) areaPeers(area *structs.Area, join string) ([]string, error) {
+	if area.UseTLS && s.connPool.tlsWrap == nil {
+		return nil, fmt.Errorf("area requires TLS, but the outgoing connections don't use it")
+	}
+	addr, err := net.ResolveTCPAddr("tcp", join)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	if err := s.connPool.RPC(area.PeerDatacenter, addr, int(s.config.ProtocolVersion),
+		"Status.Peers", struct{}{}, &peers); err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("server has no Raft peers")
+	}
+	return peers, nil
+}
+
+// forwardArea is used to forward an RPC call to a datacenter linked by
+// a network area
+func (s *Server) forwardArea(method, dc string, addr net.Addr, args interface{}, reply interface{}) error {
+	metrics.IncrCounter([]string{"consul", "rpc", "cross-dc", "area", dc}, 1)
+	return s.connPool.RPC(dc, addr, int(s.config.ProtocolVersion), method, args, reply)
+}
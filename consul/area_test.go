@@ -0,0 +1,126 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestArea_Forward(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc2")
+
+	// Without a WAN join, dc2 can't be reached
+	args := structs.DCSpecificRequest{Datacenter: "dc2"}
+	var out structs.IndexedNodes
+	if err := s1.RPC("Catalog.ListNodes", &args, &out); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Link the datacenters with an area
+	upsert := structs.AreaRequest{
+		Datacenter: "dc1",
+		Area: structs.Area{
+			PeerDatacenter: "dc2",
+			RetryJoin:      []string{s2.config.RPCAddr.String()},
+		},
+	}
+	var id string
+	if err := s1.RPC("Operator.AreaUpsert", &upsert, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForResult(func() (bool, error) {
+		var dcs []string
+		if err := s1.RPC("Catalog.ListDatacenters", struct{}{}, &dcs); err != nil {
+			return false, err
+		}
+		return reflect.DeepEqual(dcs, []string{"dc1", "dc2"}), fmt.Errorf("bad: %v", dcs)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// The RPCs of dc2 are forwarded through the area
+	if err := s1.RPC("Catalog.ListNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 1 || out.Nodes[0].Node != s2.config.NodeName {
+		t.Fatalf("bad: %#v", out.Nodes)
+	}
+
+	// The servers of dc2 are reported
+	list := structs.AreaSpecificRequest{Datacenter: "dc1", AreaID: id}
+	var servers structs.AreaServers
+	if err := s1.RPC("Operator.AreaServers", &list, &servers); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if servers.Datacenter != "dc2" || len(servers.Servers) != 1 || !servers.Servers[0].Healthy {
+		t.Fatalf("bad: %#v", servers)
+	}
+
+	// Deleting the area removes the route
+	del := structs.AreaRequest{Datacenter: "dc1", Area: structs.Area{ID: id}}
+	if err := s1.RPC("Operator.AreaDelete", &del, &struct{}{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		err := s1.RPC("Catalog.ListNodes", &args, &out)
+		return err != nil, fmt.Errorf("should fail")
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestArea_Unreachable(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	upsert := structs.AreaRequest{
+		Datacenter: "dc1",
+		Area: structs.Area{
+			PeerDatacenter: "dc2",
+			RetryJoin:      []string{"127.0.0.1:1"},
+		},
+	}
+	var id string
+	if err := s1.RPC("Operator.AreaUpsert", &upsert, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The join address is reported with its error
+	testutil.WaitForResult(func() (bool, error) {
+		list := structs.AreaSpecificRequest{Datacenter: "dc1", AreaID: id}
+		var servers structs.AreaServers
+		if err := s1.RPC("Operator.AreaServers", &list, &servers); err != nil {
+			return false, err
+		}
+		if len(servers.Servers) != 1 {
+			return false, fmt.Errorf("bad: %#v", servers)
+		}
+		server := servers.Servers[0]
+		return !server.Healthy && server.LastError != "", fmt.Errorf("bad: %#v", server)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// No RPC is routed to it
+	args := structs.DCSpecificRequest{Datacenter: "dc2"}
+	var out structs.IndexedNodes
+	if err := s1.RPC("Catalog.ListNodes", &args, &out); err == nil {
+		t.Fatalf("should fail")
+	}
+}
@@ -0,0 +1,272 @@
+package consul
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/tlsutil"
+)
+
+// hashAutoEncryptToken returns the hash under which a one-time token is
+// stored
+func hashAutoEncryptToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// AutoEncryptTokenCreate is used to store a new one-time token. The
+// tokens that expired are dropped at the same time.
+func (s *StateStore) AutoEncryptTokenCreate(index uint64, token *structs.AutoEncryptToken, now time.Time) error {
+	tx, err := s.autoEncryptTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.reapAutoEncryptTokensTxn(tx, now); err != nil {
+		return err
+	}
+	token.CreateIndex = index
+	token.ModifyIndex = index
+	if err := s.autoEncryptTable.InsertTxn(tx, token); err != nil {
+		return err
+	}
+	if err := s.autoEncryptTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.autoEncryptTable)
+	return tx.Commit()
+}
+
+// AutoEncryptTokenConsume is used to delete a one-time token as it is
+// used for the certificate of a node. It returns false if the token
+// doesn't exist or expired, or if it is for another node, in which case
+// it is kept for its own node.
+func (s *StateStore) AutoEncryptTokenConsume(index uint64, hash, node string, now time.Time) (bool, error) {
+	tx, err := s.autoEncryptTable.StartTxn(false, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	res, err := s.autoEncryptTable.GetTxn(tx, "id", hash)
+	if err != nil {
+		return false, err
+	}
+	if len(res) == 0 {
+		return false, nil
+	}
+	token := res[0].(*structs.AutoEncryptToken)
+	if token.Node != node {
+		return false, nil
+	}
+	if _, err := s.autoEncryptTable.DeleteTxn(tx, "id", hash); err != nil {
+		return false, err
+	}
+	if err := s.autoEncryptTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	s.notifyTables(tx, s.autoEncryptTable)
+	return !now.After(token.ExpiresAt), tx.Commit()
+}
+
+// reapAutoEncryptTokensTxn deletes the one-time tokens that expired
+func (s *StateStore) reapAutoEncryptTokensTxn(tx *MDBTxn, now time.Time) error {
+	res, err := s.autoEncryptTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	for _, raw := range res {
+		token := raw.(*structs.AutoEncryptToken)
+		if !now.After(token.ExpiresAt) {
+			continue
+		}
+		if _, err := s.autoEncryptTable.DeleteTxn(tx, "id", token.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AutoEncryptTokenRestore is used to restore a one-time token from a
+// snapshot
+func (s *StateStore) AutoEncryptTokenRestore(token *structs.AutoEncryptToken) error {
+	tx, err := s.autoEncryptTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.autoEncryptTable.InsertTxn(tx, token); err != nil {
+		return err
+	}
+	if err := s.autoEncryptTable.SetMaxLastIndexTxn(tx, token.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// caSigner signs the certificates of the agents with the CA of the
+// servers
+type caSigner struct {
+	cert    *x509.Certificate
+	key     crypto.PrivateKey
+	caPEM   []byte
+	certTTL time.Duration
+}
+
+// newCASigner loads the CA certificate, which is the first one of the CA
+// file, and its private key
+func newCASigner(caFile, keyFile string, certTTL time.Duration) (*caSigner, error) {
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file: %v", err)
+	}
+	block, _ := pem.Decode(caPEM)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to parse any CA certificates")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse CA certificate: %v", err)
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA key file: %v", err)
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key must be that of the certificate
+	var pub interface{}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pub = &k.PublicKey
+	case *ecdsa.PrivateKey:
+		pub = &k.PublicKey
+	}
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil || string(certPub) != string(keyPub) {
+		return nil, fmt.Errorf("CA key doesn't match the first certificate of the CA file")
+	}
+
+	return &caSigner{
+		cert:    cert,
+		key:     key,
+		caPEM:   caPEM,
+		certTTL: certTTL,
+	}, nil
+}
+
+// parsePrivateKey parses a PEM encoded RSA or ECDSA private key
+func parsePrivateKey(keyPEM []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to parse CA key")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("Unsupported CA key type %q", block.Type)
+}
+
+// sign returns a PEM encoded client certificate for the public key of a
+// node, along with its expiry
+func (c *caSigner) sign(node string, publicKey []byte) (string, time.Time, error) {
+	pub, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to parse public key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expires := now.Add(c.certTTL)
+	if expires.After(c.cert.NotAfter) {
+		expires = c.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         node,
+			OrganizationalUnit: []string{tlsutil.AutoEncryptOU},
+		},
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    expires,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, pub, c.key)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to sign certificate: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return string(certPEM), expires, nil
+}
+
+// verify returns if a PEM encoded certificate was signed by the CA with
+// auto-encrypt for the node and public key, and is still valid
+func (c *caSigner) verify(certPEM, node string, publicKey []byte) bool {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || cert.Subject.CommonName != node || !isAutoEncryptCert(cert) {
+		return false
+	}
+	pub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil || string(pub) != string(publicKey) {
+		return false
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(c.cert)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// isAutoEncryptCert returns if a certificate was signed with auto-encrypt
+func isAutoEncryptCert(cert *x509.Certificate) bool {
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if ou == tlsutil.AutoEncryptOU {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package consul
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/tlsutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+const (
+	// autoEncryptRetryInterval is the base wait after a failed request
+	// for a certificate
+	autoEncryptRetryInterval = 2 * time.Second
+
+	// autoEncryptMaxBackoff bounds the wait between failed requests
+	autoEncryptMaxBackoff = 2 * time.Minute
+)
+
+// autoEncrypt obtains the TLS certificate of the client from the servers,
+// and renews it once two thirds of its lifetime passed. The RPC
+// connections fail with tlsutil.ErrAutoEncryptPending until the first
+// certificate is obtained.
+func (c *Client) autoEncrypt() {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		c.logger.Printf("[ERR] consul.auto_encrypt: Failed to generate key: %v", err)
+		return
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		c.logger.Printf("[ERR] consul.auto_encrypt: Failed to encode public key: %v", err)
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		c.logger.Printf("[ERR] consul.auto_encrypt: Failed to encode key: %v", err)
+		return
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	var current structs.AutoEncryptSignResponse
+	failures := 0
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-time.After(wait):
+		case <-c.shutdownCh:
+			return
+		}
+
+		args := structs.AutoEncryptSignRequest{
+			Datacenter:  c.config.Datacenter,
+			Node:        c.config.NodeName,
+			PublicKey:   pub,
+			Certificate: current.Certificate,
+		}
+		if current.Certificate == "" {
+			args.OneTimeToken = c.config.AutoEncryptToken
+		}
+		if keyring := c.config.SerfLANConfig.MemberlistConfig.Keyring; keyring != nil {
+			mac := hmac.New(sha256.New, keyring.GetPrimaryKey())
+			mac.Write(args.SignedBytes())
+			args.GossipHMAC = mac.Sum(nil)
+		}
+
+		var reply structs.AutoEncryptSignResponse
+		err := c.autoEncryptSign(&args, &reply, []byte(current.CA))
+		if err == nil {
+			err = c.rpcTLS.SetAutoEncrypt([]byte(reply.Certificate), keyPEM, []byte(reply.CA))
+		}
+		if err == structs.ErrNoServers {
+			// The servers aren't known until the client joins
+			wait = autoEncryptRetryInterval
+			continue
+		}
+		if err != nil {
+			failures++
+			wait = autoEncryptRetryInterval * time.Duration(failures*failures)
+			if wait > autoEncryptMaxBackoff {
+				wait = autoEncryptMaxBackoff
+			}
+			c.logger.Printf("[ERR] consul.auto_encrypt: Failed to obtain TLS certificate, retrying in %v: %v", wait, err)
+			continue
+		}
+
+		failures = 0
+		current = reply
+		wait = 2 * reply.ExpiresAt.Sub(time.Now()) / 3
+		c.logger.Printf("[INFO] consul.auto_encrypt: Obtained TLS certificate, expires %v", reply.ExpiresAt)
+	}
+}
+
+// autoEncryptSign requests a certificate from a known server, over an
+// insecure TLS connection since the client has no certificate yet. The
+// server is verified with the CA certificates from a previous response,
+// or with the CA file if any.
+func (c *Client) autoEncryptSign(args *structs.AutoEncryptSignRequest,
+	reply *structs.AutoEncryptSignResponse, caPEM []byte) error {
+	c.consulLock.RLock()
+	var server *serverParts
+	if len(c.consuls) > 0 {
+		server = c.consuls[rand.Int31()%int32(len(c.consuls))]
+	}
+	c.consulLock.RUnlock()
+	if server == nil {
+		return structs.ErrNoServers
+	}
+
+	tlsConf := &tls.Config{
+		RootCAs:            x509.NewCertPool(),
+		InsecureSkipVerify: true,
+	}
+	tlsConfig := tlsutil.Config{CAFile: c.config.CAFile}
+	if err := tlsConfig.AppendCA(tlsConf.RootCAs); err != nil {
+		return err
+	}
+	verify := c.config.CAFile != ""
+	if len(caPEM) > 0 {
+		verify = tlsConf.RootCAs.AppendCertsFromPEM(caPEM) || verify
+	}
+
+	conn, err := net.DialTimeout("tcp", server.Addr.String(), 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{byte(rpcTLSInsecure)}); err != nil {
+		return err
+	}
+
+	// Without any CA certificate, the first server is trusted
+	if verify {
+		conn, err = tlsutil.WrapTLSClient(conn, tlsConf)
+	} else {
+		conn = tls.Client(conn, tlsConf)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{byte(rpcConsul)}); err != nil {
+		return err
+	}
+
+	codec := newClientCodec(conn)
+	if err := msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, reply); err != nil {
+		return fmt.Errorf("Failed to sign certificate with server %s: %v", server.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package consul
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
+)
+
+// defaultAutoEncryptTokenTTL is how long a one-time token is valid if its
+// TTL isn't given
+const defaultAutoEncryptTokenTTL = 24 * time.Hour
+
+// AutoEncrypt endpoint is used by the agents to obtain their TLS
+// certificates. It can be called on the insecure TLS connections.
+type AutoEncrypt struct {
+	srv *Server
+}
+
+// Sign is used to sign a certificate for the public key of an agent. The
+// request must be authenticated with the gossip encryption key by a LAN
+// member of the node name, a one-time token for the node, or a current
+// certificate of the node. The names of the servers, and the names held
+// by members at another address than the request, are rejected.
+func (a *AutoEncrypt) Sign(args *structs.AutoEncryptSignRequest, reply *structs.AutoEncryptSignResponse) error {
+	if done, err := a.srv.forward("AutoEncrypt.Sign", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "auto_encrypt", "sign"}, time.Now())
+
+	signer := a.srv.caSigner
+	if signer == nil {
+		return fmt.Errorf("Auto-encrypt is not enabled on the servers")
+	}
+	if args.Node == "" || len(args.PublicKey) == 0 {
+		return fmt.Errorf("Must provide node and public key")
+	}
+
+	member, err := a.checkNode(args)
+	if err != nil {
+		a.srv.logger.Printf("[WARN] consul.auto_encrypt: Rejected certificate request from %s: %v", args.Source, err)
+		return err
+	}
+	method, err := a.authenticate(args, member)
+	if err != nil {
+		return err
+	}
+	if method == "" {
+		a.srv.logger.Printf("[WARN] consul.auto_encrypt: Rejected certificate request of node '%s'", args.Node)
+		return permissionDeniedErr
+	}
+
+	cert, expires, err := signer.sign(args.Node, args.PublicKey)
+	if err != nil {
+		return err
+	}
+	a.srv.logger.Printf("[INFO] consul.auto_encrypt: Signed certificate of node '%s' with %s, expires %v",
+		args.Node, method, expires)
+	reply.Certificate = cert
+	reply.CA = string(signer.caPEM)
+	reply.ExpiresAt = expires
+	return nil
+}
+
+// checkNode verifies that the node name of a request isn't that of a
+// server, nor held by a LAN member at another address than the source of
+// the request. It returns if the node is a member at that address. The
+// requests without a source were made by a server, whose address is
+// trusted.
+func (a *AutoEncrypt) checkNode(args *structs.AutoEncryptSignRequest) (bool, error) {
+	source := net.ParseIP(args.Source)
+	for _, m := range a.srv.LANMembers() {
+		if m.Name != args.Node {
+			continue
+		}
+		if valid, _ := isConsulServer(m); valid {
+			return false, fmt.Errorf("Node name '%s' belongs to a server", args.Node)
+		}
+		if m.Status == serf.StatusLeft {
+			return false, nil
+		}
+		if source != nil && !m.Addr.Equal(source) {
+			return false, fmt.Errorf("Node name '%s' is held by the member at %s", args.Node, m.Addr)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// authenticate returns how a request was authenticated, or an empty
+// string if it wasn't. The gossip key is only accepted from a member of
+// the node name. A one-time token is consumed even if the certificate
+// then fails to be signed.
+func (a *AutoEncrypt) authenticate(args *structs.AutoEncryptSignRequest, member bool) (string, error) {
+	if member && len(args.GossipHMAC) > 0 {
+		if keyring := a.srv.config.SerfLANConfig.MemberlistConfig.Keyring; keyring != nil {
+			for _, key := range keyring.GetKeys() {
+				mac := hmac.New(sha256.New, key)
+				mac.Write(args.SignedBytes())
+				if hmac.Equal(mac.Sum(nil), args.GossipHMAC) {
+					return "gossip key", nil
+				}
+			}
+		}
+	}
+
+	if args.Certificate != "" &&
+		a.srv.caSigner.verify(args.Certificate, args.Node, args.PublicKey) {
+		return "certificate", nil
+	}
+
+	if args.OneTimeToken != "" {
+		req := structs.AutoEncryptTokenRequest{
+			Datacenter: args.Datacenter,
+			Op:         structs.AutoEncryptTokenConsume,
+			Token: structs.AutoEncryptToken{
+				Hash: hashAutoEncryptToken(args.OneTimeToken),
+				Node: args.Node,
+			},
+			Now: time.Now(),
+		}
+		resp, err := a.srv.raftApply(structs.AutoEncryptRequestType, &req)
+		if err != nil {
+			a.srv.logger.Printf("[ERR] consul.auto_encrypt: Consume failed: %v", err)
+			return "", err
+		}
+		if respErr, ok := resp.(error); ok {
+			return "", respErr
+		}
+		if ok, _ := resp.(bool); ok {
+			return "one-time token", nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,256 @@
+package consul
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+var testGossipKey = []byte("0123456789abcdef")
+
+func testAutoEncryptServer(t *testing.T) (string, *Server) {
+	return testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.AutoEncryptAllowTLS = true
+		c.CAFile = "../test/ca/root.cer"
+		c.CAKeyFile = "../test/ca/privkey.pem"
+		c.CertFile = "../test/key/ourdomain.cer"
+		c.KeyFile = "../test/key/ourdomain.key"
+		c.SerfLANConfig.MemberlistConfig.Keyring = testGossipKeyring(t)
+	})
+}
+
+// testAutoEncryptClient returns a client which can join the LAN pool of
+// testAutoEncryptServer
+func testAutoEncryptClient(t *testing.T) (string, *Client) {
+	return testClientWithConfig(t, func(c *Config) {
+		c.SerfLANConfig.MemberlistConfig.Keyring = testGossipKeyring(t)
+	})
+}
+
+func testGossipKeyring(t *testing.T) *memberlist.Keyring {
+	keyring, err := memberlist.NewKeyring(nil, testGossipKey)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return keyring
+}
+
+func testAutoEncryptRequest(t *testing.T, node string) *structs.AutoEncryptSignRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return &structs.AutoEncryptSignRequest{
+		Datacenter: "dc1",
+		Node:       node,
+		PublicKey:  pub,
+	}
+}
+
+func TestAutoEncrypt_Sign_GossipKey(t *testing.T) {
+	dir1, s1 := testAutoEncryptServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, c1 := testAutoEncryptClient(t)
+	defer os.RemoveAll(dir2)
+	defer c1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// An unauthenticated request is rejected
+	args := testAutoEncryptRequest(t, c1.config.NodeName)
+	var out structs.AutoEncryptSignResponse
+	err := msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The key is only accepted from a LAN member of the node name
+	mac := hmac.New(sha256.New, testGossipKey)
+	mac.Write(args.SignedBytes())
+	args.GossipHMAC = mac.Sum(nil)
+	err = msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := c1.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		return len(s1.LANMembers()) == 2, nil
+	}, func(err error) {
+		t.Fatalf("bad len")
+	})
+
+	// The HMAC must cover the node name
+	args.Node = "node2"
+	err = msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The name of the member can't be used from another address
+	args.Node = c1.config.NodeName
+	args.Source = "10.1.2.3"
+	err = msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out)
+	if err == nil || !strings.Contains(err.Error(), "is held by the member") {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Source = "127.0.0.1"
+	if err := msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(out.Certificate, "BEGIN CERTIFICATE") || !strings.Contains(out.CA, "BEGIN CERTIFICATE") {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The name of a server is always rejected
+	args = testAutoEncryptRequest(t, s1.config.NodeName)
+	mac = hmac.New(sha256.New, testGossipKey)
+	mac.Write(args.SignedBytes())
+	args.GossipHMAC = mac.Sum(nil)
+	err = msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out)
+	if err == nil || !strings.Contains(err.Error(), "belongs to a server") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAutoEncrypt_Sign_OneTimeToken(t *testing.T) {
+	dir1, s1 := testAutoEncryptServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A management token is required to create a one-time token
+	create := structs.AutoEncryptTokenCreateRequest{Datacenter: "dc1", Node: "node1"}
+	var token structs.AutoEncryptTokenCreateResponse
+	err := msgpackrpc.CallWithCodec(codec, "Operator.AutoEncryptTokenCreate", &create, &token)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	create.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AutoEncryptTokenCreate", &create, &token); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token.Secret == "" || token.ExpiresAt.IsZero() {
+		t.Fatalf("bad: %#v", token)
+	}
+
+	// The token is only accepted for its node, and once
+	args := testAutoEncryptRequest(t, "node2")
+	args.OneTimeToken = token.Secret
+	var out structs.AutoEncryptSignResponse
+	err = msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	args.Node = "node1"
+	if err := msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The certificate renews itself, but not the certificate of another
+	// node
+	renew := *args
+	renew.OneTimeToken = ""
+	renew.Certificate = out.Certificate
+	if err := msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", &renew, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	renew.Node = "node2"
+	err = msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", &renew, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAutoEncrypt_InsecureConn(t *testing.T) {
+	dir1, s1 := testAutoEncryptServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	dir2, c1 := testAutoEncryptClient(t)
+	defer os.RemoveAll(dir2)
+	defer c1.Shutdown()
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := c1.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		return len(s1.LANMembers()) == 2, nil
+	}, func(err error) {
+		t.Fatalf("bad len")
+	})
+
+	conn, err := net.Dial("tcp", s1.config.RPCAddr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{byte(rpcTLSInsecure)})
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	tlsConn.Write([]byte{byte(rpcConsul)})
+	codec := msgpackrpc.NewClientCodec(tlsConn)
+
+	create := structs.AutoEncryptTokenCreateRequest{Datacenter: "dc1", Node: c1.config.NodeName}
+	create.Token = "root"
+	var token structs.AutoEncryptTokenCreateResponse
+	if err := s1.RPC("Operator.AutoEncryptTokenCreate", &create, &token); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The source of the request is set by the server, so the member is
+	// found at the address of the connection
+	args := testAutoEncryptRequest(t, c1.config.NodeName)
+	args.OneTimeToken = token.Secret
+	args.Source = "10.1.2.3"
+	var out structs.AutoEncryptSignResponse
+	if err := msgpackrpc.CallWithCodec(codec, "AutoEncrypt.Sign", args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// No other method can be called
+	var leader string
+	err = msgpackrpc.CallWithCodec(codec, "Status.Leader", struct{}{}, &leader)
+	if err == nil || !strings.Contains(err.Error(), errInsecureRPC.Error()) {
+		t.Fatalf("err: %v", err)
+	}
+}
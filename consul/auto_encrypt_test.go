@@ -0,0 +1,122 @@
+package consul
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestAutoEncryptToken(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	token := &structs.AutoEncryptToken{Hash: "foo", Node: "node1", ExpiresAt: now.Add(time.Hour)}
+	if err := store.AutoEncryptTokenCreate(10, token, now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expired := &structs.AutoEncryptToken{Hash: "bar", Node: "node1", ExpiresAt: now.Add(time.Minute)}
+	if err := store.AutoEncryptTokenCreate(11, expired, now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A token is only accepted for its node, and consumed once
+	ok, err := store.AutoEncryptTokenConsume(12, "foo", "node2", now)
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	ok, err = store.AutoEncryptTokenConsume(12, "foo", "node1", now)
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	ok, err = store.AutoEncryptTokenConsume(13, "foo", "node1", now)
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// An expired token can't be consumed
+	ok, err = store.AutoEncryptTokenConsume(14, "bar", "node1", now.Add(2*time.Minute))
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// The expired tokens are dropped as new ones are created
+	later := now.Add(2 * time.Minute)
+	expired.ExpiresAt = later.Add(-time.Second)
+	if err := store.AutoEncryptTokenCreate(15, expired, now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	token = &structs.AutoEncryptToken{Hash: "baz", ExpiresAt: later.Add(time.Hour)}
+	if err := store.AutoEncryptTokenCreate(16, token, later); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, res, err := store.autoEncryptTable.Get("id")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 1 || res[0].(*structs.AutoEncryptToken).Hash != "baz" {
+		t.Fatalf("bad: %v", res)
+	}
+}
+
+func TestCASigner(t *testing.T) {
+	// The key must match the first certificate of the CA file
+	if _, err := newCASigner("../test/ca/root.cer", "../test/key/ourdomain.key", time.Hour); err == nil {
+		t.Fatalf("expected error")
+	}
+	signer, err := newCASigner("../test/ca/root.cer", "../test/ca/privkey.pem", time.Hour)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	certPEM, _, err := signer.sign("node1", pub)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		t.Fatalf("bad: %s", certPEM)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if cert.Subject.CommonName != "node1" || !isAutoEncryptCert(cert) {
+		t.Fatalf("bad: %v", cert.Subject)
+	}
+	if err := cert.CheckSignatureFrom(signer.cert); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("bad: %v", cert.ExtKeyUsage)
+	}
+
+	// A certificate is only valid for its node and key
+	if !signer.verify(certPEM, "node1", pub) {
+		t.Fatalf("should verify")
+	}
+	if signer.verify(certPEM, "node2", pub) {
+		t.Fatalf("should not verify")
+	}
+	if _, _, err := signer.sign("node1", []byte("nope")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
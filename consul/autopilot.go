@@ -0,0 +1,342 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+// autopilotID is the key of the autopilot configuration, which is the
+// only row of its table
+const autopilotID = "config"
+
+// autopilotFields returns the id index values of the autopilot
+// configuration
+func autopilotFields(obj interface{}) ([]string, error) {
+	if _, ok := obj.(*structs.AutopilotConfig); !ok {
+		return nil, fmt.Errorf("Not an autopilot configuration: %#v", obj)
+	}
+	return []string{autopilotID}, nil
+}
+
+// AutopilotSetConfig is used to set the autopilot configuration. With
+// cas, it is only set if its ModifyIndex matches that of the current
+// configuration, with 0 matching an unset one, and false is returned
+// otherwise.
+func (s *StateStore) AutopilotSetConfig(index uint64, config *structs.AutopilotConfig, cas bool) (bool, error) {
+	tx, err := s.autopilotTable.StartTxn(false, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	res, err := s.autopilotTable.GetTxn(tx, "id", autopilotID)
+	if err != nil {
+		return false, err
+	}
+	var exist *structs.AutopilotConfig
+	if len(res) > 0 {
+		exist = res[0].(*structs.AutopilotConfig)
+	}
+	if cas {
+		var current uint64
+		if exist != nil {
+			current = exist.ModifyIndex
+		}
+		if config.ModifyIndex != current {
+			return false, nil
+		}
+	}
+	config.CreateIndex = index
+	if exist != nil {
+		config.CreateIndex = exist.CreateIndex
+	}
+	config.ModifyIndex = index
+
+	if err := s.autopilotTable.InsertTxn(tx, config); err != nil {
+		return false, err
+	}
+	if err := s.autopilotTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	s.notifyTables(tx, s.autopilotTable)
+	return true, tx.Commit()
+}
+
+// AutopilotConfig is used to get the autopilot configuration, which is
+// nil until an operator sets one
+func (s *StateStore) AutopilotConfig() (uint64, *structs.AutopilotConfig, error) {
+	idx, res, err := s.autopilotTable.Get("id", autopilotID)
+	var config *structs.AutopilotConfig
+	if len(res) > 0 {
+		config = res[0].(*structs.AutopilotConfig)
+	}
+	return idx, config, err
+}
+
+// AutopilotRestore is used to restore the autopilot configuration from a
+// snapshot
+func (s *StateStore) AutopilotRestore(config *structs.AutopilotConfig) error {
+	tx, err := s.autopilotTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.autopilotTable.InsertTxn(tx, config); err != nil {
+		return err
+	}
+	if err := s.autopilotTable.SetMaxLastIndexTxn(tx, config.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// autopilotConfig returns the autopilot configuration set by an
+// operator, or the configuration of the server if none was set
+func (s *Server) autopilotConfig() (uint64, *structs.AutopilotConfig, error) {
+	index, config, err := s.fsm.State().AutopilotConfig()
+	if err != nil {
+		return 0, nil, err
+	}
+	if config == nil {
+		defaults := *s.config.AutopilotConfig
+		config = &defaults
+	}
+	return index, config, nil
+}
+
+// serverStable returns if a server that isn't a Raft peer yet has been
+// healthy long enough to be added to the Raft configuration
+func (s *Server) serverStable(name string) (bool, error) {
+	_, config, err := s.autopilotConfig()
+	if err != nil {
+		return false, err
+	}
+	if config.ServerStabilizationTime == 0 {
+		return true, nil
+	}
+	_, health, err := s.fsm.State().ServerHealthGet(name)
+	if err != nil {
+		return false, err
+	}
+	return health != nil && health.Healthy &&
+		health.StableFor(time.Now()) >= config.ServerStabilizationTime, nil
+}
+
+// runAutopilot runs as long as we are the leader to record the health of
+// the servers, add the new servers to the Raft configuration once they
+// are stable, and remove the failed servers once they are replaced
+func (s *Server) runAutopilot(stopCh chan struct{}) {
+	ticker := time.NewTicker(s.config.AutopilotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.pilotServers(); err != nil {
+				s.logger.Printf("[ERR] consul: Autopilot failed: %v", err)
+			}
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// pilotServers is one round of autopilot
+func (s *Server) pilotServers() error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "autopilot"}, time.Now())
+	_, config, err := s.autopilotConfig()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := s.updateServerHealth(now); err != nil {
+		return err
+	}
+
+	// Add the servers that have been stable long enough. Joining them
+	// again goes through the same checks as the reconciliation.
+	promotable, err := s.fsm.State().PromotableServers(now, config.ServerStabilizationTime)
+	if err != nil {
+		return err
+	}
+	if len(promotable) > 0 {
+		members := make(map[string]serf.Member)
+		for _, member := range s.serfLAN.Members() {
+			members[member.Name] = member
+		}
+		for _, health := range promotable {
+			member, ok := members[health.Name]
+			if !ok {
+				continue
+			}
+			valid, parts := isConsulServer(member)
+			if !valid {
+				continue
+			}
+			s.logger.Printf("[INFO] consul: autopilot adding server '%s' as peer, stable for %v",
+				health.Name, health.StableFor(now))
+			if err := s.joinConsulServer(member, parts); err != nil {
+				return err
+			}
+		}
+	}
+
+	if config.CleanupDeadServers {
+		return s.pruneDeadServers(config, now)
+	}
+	return nil
+}
+
+// updateServerHealth records the health of the servers of the LAN pool,
+// and whether they are Raft peers. Only changes are committed, and the
+// servers that left are forgotten.
+func (s *Server) updateServerHealth(now time.Time) error {
+	peers, err := s.raftPeers.Peers()
+	if err != nil {
+		return err
+	}
+	_, known, err := s.fsm.State().ServerHealthList()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*structs.ServerHealth, len(known))
+	for _, health := range known {
+		existing[health.Name] = health
+	}
+
+	seen := make(map[string]struct{})
+	for _, member := range s.serfLAN.Members() {
+		valid, parts := isConsulServer(member)
+		if !valid || parts.Datacenter != s.config.Datacenter {
+			continue
+		}
+		if member.Status != serf.StatusAlive && member.Status != serf.StatusFailed {
+			continue
+		}
+		seen[member.Name] = struct{}{}
+
+		addr := (&net.TCPAddr{IP: member.Addr, Port: parts.Port}).String()
+		health := structs.ServerHealth{
+			Name:        member.Name,
+			Address:     addr,
+			Healthy:     member.Status == serf.StatusAlive,
+			StableSince: now.UnixNano(),
+			Voter:       raft.PeerContained(peers, addr),
+		}
+		if exist, ok := existing[member.Name]; ok && exist.Address == health.Address &&
+			exist.Healthy == health.Healthy && exist.Voter == health.Voter {
+			continue
+		}
+		if err := s.applyServerHealth(structs.ServerHealthSet, health); err != nil {
+			return err
+		}
+	}
+
+	for name, health := range existing {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		if err := s.applyServerHealth(structs.ServerHealthDelete, *health); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyServerHealth commits the health of a server
+func (s *Server) applyServerHealth(op structs.ServerHealthOp, health structs.ServerHealth) error {
+	req := structs.ServerHealthRequest{
+		Datacenter: s.config.Datacenter,
+		Op:         op,
+		Health:     health,
+	}
+	resp, err := s.raftApply(structs.ServerHealthRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// pruneDeadServers removes the voters that have failed for at least the
+// stabilization time from the Raft configuration, once each is replaced
+// by a healthy voter that became healthy after it failed. Removals are
+// limited to a minority of the voters, so they never cost the quorum.
+func (s *Server) pruneDeadServers(config *structs.AutopilotConfig, now time.Time) error {
+	state := s.fsm.State()
+	_, servers, err := state.ServerHealthList()
+	if err != nil {
+		return err
+	}
+	dead, err := state.DeadServers(now, config.ServerStabilizationTime)
+	if err != nil {
+		return err
+	}
+
+	voters := 0
+	var healthy []*structs.ServerHealth
+	for _, health := range servers {
+		if !health.Voter {
+			continue
+		}
+		voters++
+		if health.Healthy {
+			healthy = append(healthy, health)
+		}
+	}
+
+	// The oldest failures are replaced first
+	sort.Sort(serverHealthByStableSince(dead))
+	removed := 0
+	for _, health := range dead {
+		if !health.Voter {
+			continue
+		}
+		if (removed+1)*2 >= voters {
+			s.logger.Printf("[WARN] consul: autopilot not removing failed server '%s', "+
+				"removing a majority of %d voters could cost the quorum", health.Name, voters)
+			break
+		}
+		replacements := 0
+		for _, r := range healthy {
+			if r.StableSince > health.StableSince {
+				replacements++
+			}
+		}
+		if replacements <= removed {
+			continue
+		}
+
+		future := s.raft.RemovePeer(health.Address)
+		if err := future.Error(); err != nil && err != raft.ErrUnknownPeer {
+			s.logger.Printf("[ERR] consul: autopilot failed to remove raft peer '%v': %v",
+				health.Address, err)
+			return err
+		}
+		s.logger.Printf("[INFO] consul: autopilot removed failed server '%s' as peer, failed for %v",
+			health.Name, health.StableFor(now))
+		removed++
+	}
+	return nil
+}
+
+// serverHealthByStableSince sorts the health of servers by the time
+// their health last changed
+type serverHealthByStableSince []*structs.ServerHealth
+
+func (s serverHealthByStableSince) Len() int      { return len(s) }
+func (s serverHealthByStableSince) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s serverHealthByStableSince) Less(i, j int) bool {
+	return s[i].StableSince < s[j].StableSince
+}
@@ -0,0 +1,163 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/raft"
+)
+
+func TestAutopilotSetConfig(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	idx, config, err := store.AutopilotConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 0 || config != nil {
+		t.Fatalf("bad: %d %v", idx, config)
+	}
+
+	// A CAS of a non-zero index fails until a configuration is set
+	config = &structs.AutopilotConfig{CleanupDeadServers: true, ModifyIndex: 1}
+	if ok, err := store.AutopilotSetConfig(1, config, true); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	config.ModifyIndex = 0
+	if ok, err := store.AutopilotSetConfig(2, config, true); err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// The create index is kept
+	config = &structs.AutopilotConfig{ServerStabilizationTime: time.Second}
+	if ok, err := store.AutopilotSetConfig(3, config, false); err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	idx, config, err = store.AutopilotConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 3 || config.CreateIndex != 2 || config.ModifyIndex != 3 ||
+		config.CleanupDeadServers || config.ServerStabilizationTime != time.Second {
+		t.Fatalf("bad: %d %#v", idx, config)
+	}
+}
+
+func TestAutopilot_StabilizationGating(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.AutopilotInterval = 50 * time.Millisecond
+		c.AutopilotConfig.ServerStabilizationTime = time.Second
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The new server is healthy, but not a peer yet
+	testutil.WaitForResult(func() (bool, error) {
+		_, health, err := s1.fsm.State().ServerHealthGet(s2.config.NodeName)
+		return health != nil && health.Healthy, err
+	}, func(err error) {
+		t.Fatalf("should record the health of s2: %v", err)
+	})
+	peers, _ := s1.raftPeers.Peers()
+	if len(peers) != 1 {
+		t.Fatalf("should not add s2 yet: %v", peers)
+	}
+
+	// It is added once stable
+	testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s1.raftPeers.Peers()
+		return len(peers) == 2, fmt.Errorf("%v", peers)
+	}, func(err error) {
+		t.Fatalf("should have 2 peers: %v", err)
+	})
+	testutil.WaitForResult(func() (bool, error) {
+		_, health, err := s1.fsm.State().ServerHealthGet(s2.config.NodeName)
+		return health != nil && health.Voter, err
+	}, func(err error) {
+		t.Fatalf("should record s2 as voter: %v", err)
+	})
+}
+
+func TestAutopilot_CleanupDeadServers(t *testing.T) {
+	fast := func(c *Config) {
+		c.AutopilotInterval = 50 * time.Millisecond
+	}
+	dir1, s1 := testServerWithConfig(t, fast)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	var servers []*Server
+	for i := 0; i < 3; i++ {
+		dir, s := testServerWithConfig(t, func(c *Config) {
+			fast(c)
+			c.Bootstrap = false
+		})
+		defer os.RemoveAll(dir)
+		defer s.Shutdown()
+		servers = append(servers, s)
+	}
+	s2, s3, s4 := servers[0], servers[1], servers[2]
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range []*Server{s2, s3} {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s1.raftPeers.Peers()
+		return len(peers) == 3, fmt.Errorf("%v", peers)
+	}, func(err error) {
+		t.Fatalf("should have 3 peers: %v", err)
+	})
+
+	// Kill a server, it isn't removed without a replacement
+	s3Addr := s3.raftTransport.LocalAddr()
+	s3.Shutdown()
+	testutil.WaitForResult(func() (bool, error) {
+		_, health, err := s1.fsm.State().ServerHealthGet(s3.config.NodeName)
+		return health != nil && !health.Healthy, err
+	}, func(err error) {
+		t.Fatalf("should record s3 as failed: %v", err)
+	})
+	time.Sleep(200 * time.Millisecond)
+	peers, _ := s1.raftPeers.Peers()
+	if !raft.PeerContained(peers, s3Addr) {
+		t.Fatalf("should not remove s3: %v", peers)
+	}
+
+	// Once a replacement is healthy, it is removed
+	if _, err := s4.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s1.raftPeers.Peers()
+		return len(peers) == 3 && !raft.PeerContained(peers, s3Addr) &&
+			raft.PeerContained(peers, s4.raftTransport.LocalAddr()), fmt.Errorf("%v", peers)
+	}, func(err error) {
+		t.Fatalf("should replace s3: %v", err)
+	})
+}
@@ -0,0 +1,161 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/audit"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// catalogAuditRegister and catalogAuditDeregister are the operations
+	// recorded in the catalog audit table
+	catalogAuditRegister   = "register"
+	catalogAuditDeregister = "deregister"
+)
+
+// catalogAuditScope is the part of a node affected by a catalog change
+type catalogAuditScope struct {
+	node     string
+	services []string
+	checks   []string
+
+	// all includes every service and check of the node
+	all bool
+}
+
+// registerAuditScope returns the scope of a registration
+func registerAuditScope(req *structs.RegisterRequest) *catalogAuditScope {
+	scope := &catalogAuditScope{node: req.Node}
+	if req.Service != nil {
+		scope.services = append(scope.services, req.Service.ID)
+	}
+	if req.Check != nil {
+		scope.checks = append(scope.checks, req.Check.CheckID)
+	}
+	for _, check := range req.Checks {
+		scope.checks = append(scope.checks, check.CheckID)
+	}
+	return scope
+}
+
+// deregisterAuditScope returns the scope of a deregistration
+func deregisterAuditScope(req *structs.DeregisterRequest) *catalogAuditScope {
+	scope := &catalogAuditScope{node: req.Node}
+	switch {
+	case req.ServiceID != "":
+		scope.services = []string{req.ServiceID}
+	case req.CheckID != "":
+		scope.checks = []string{req.CheckID}
+	default:
+		scope.all = true
+	}
+	return scope
+}
+
+// auditAccessor identifies a token in the audit table without
+// revealing it, since the token itself grants access
+func auditAccessor(token string) string {
+	return audit.Accessor(token)
+}
+
+// catalogSummary summarizes the scope of a catalog change from the
+// current state. The summary is empty if the node does not exist.
+func (s *StateStore) catalogSummary(scope *catalogAuditScope) string {
+	_, dump := s.NodeInfo(scope.node)
+	if len(dump) == 0 {
+		return ""
+	}
+	info := dump[0]
+	inScope := func(ids []string, id string) bool {
+		if scope.all {
+			return true
+		}
+		for _, other := range ids {
+			if other == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	parts := []string{fmt.Sprintf("node %s %s", info.Node, info.Address)}
+	for _, srv := range info.Services {
+		if !inScope(scope.services, srv.ID) {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("service %s (%s) %s:%d [%s]", srv.ID,
+			srv.Service, srv.Address, srv.Port, strings.Join(srv.Tags, ",")))
+	}
+	for _, check := range info.Checks {
+		if !inScope(scope.checks, check.CheckID) && !inScope(scope.services, check.ServiceID) {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("check %s %s", check.CheckID, check.Status))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// auditSummary returns the summary of a catalog change if the audit
+// table is enabled
+func (c *consulFSM) auditSummary(scope *catalogAuditScope) string {
+	if c.state.catalogAuditLimit() <= 0 {
+		return ""
+	}
+	return c.state.catalogSummary(scope)
+}
+
+// recordCatalogAudit records a catalog change in the audit table, if it
+// is enabled. Failing to record is logged, and does not fail the change.
+func (c *consulFSM) recordCatalogAudit(index uint64, op, token string,
+	source *structs.AuditSource, scope *catalogAuditScope, before string) {
+	if c.state.catalogAuditLimit() <= 0 {
+		return
+	}
+	audit := &structs.CatalogAudit{
+		Time:       source.Time,
+		Op:         op,
+		Node:       scope.node,
+		Accessor:   auditAccessor(token),
+		SourceAddr: source.SourceAddr,
+		Before:     before,
+		After:      c.state.catalogSummary(scope),
+	}
+	if err := c.state.CatalogAuditRecord(index, audit); err != nil {
+		c.logger.Printf("[ERR] consul.fsm: Failed to record catalog audit: %v", err)
+	}
+}
+
+// trimCatalogAudit is invoked by the leader to trim the oldest records
+// of the audit table beyond the committed limit. Like reapTombstones,
+// the trim goes through Raft so that all the servers retain the same
+// records.
+func (s *Server) trimCatalogAudit() error {
+	state := s.fsm.State()
+	limit := state.catalogAuditLimit()
+	if limit <= 0 {
+		return nil
+	}
+	trimIndex, err := state.CatalogAuditTrimIndex(limit)
+	if err != nil || trimIndex == 0 {
+		return err
+	}
+
+	defer metrics.MeasureSince([]string{"consul", "leader", "trimCatalogAudit"}, time.Now())
+	req := structs.CatalogAuditTrimRequest{
+		Datacenter:   s.config.Datacenter,
+		TrimIndex:    trimIndex,
+		WriteRequest: structs.WriteRequest{Token: s.config.ACLToken},
+	}
+	resp, err := s.raftApply(structs.CatalogAuditTrimRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package consul
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// catalogRemovalsPerNode bounds the removals remembered for each
+	// node. The diffs reaching further back are full.
+	catalogRemovalsPerNode = 256
+)
+
+// catalogRemoval is a service or check removed from a node
+type catalogRemoval struct {
+	index   uint64
+	service bool
+	id      string
+	name    string // Name of the service, used to filter by ACLs
+}
+
+// catalogRemovals remembers the services and checks removed from each
+// node, since the catalog keeps no trace of them, so CatalogDiff can
+// report them. They are only kept in memory: a diff reaching before the
+// creation of the state store, or of the node, is full.
+//
+// A removal is recorded in the write transaction, before it commits, so
+// a diff never misses one. A transaction that aborts leaves a removal of
+// an entry that still exists behind, which the diffs ignore.
+type catalogRemovals struct {
+	l sync.Mutex
+
+	// nodes are the removals of each node, from oldest to newest
+	nodes map[string][]catalogRemoval
+
+	// floors are the indexes of the removals that were dropped from a
+	// node, before which its removals are unknown
+	floors map[string]uint64
+}
+
+// newCatalogRemovals creates an empty set of removals
+func newCatalogRemovals() *catalogRemovals {
+	return &catalogRemovals{
+		nodes:  make(map[string][]catalogRemoval),
+		floors: make(map[string]uint64),
+	}
+}
+
+// record adds a removal from a node. The oldest removal of the node is
+// dropped when it has too many.
+func (c *catalogRemovals) record(node string, removal catalogRemoval) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	removals := append(c.nodes[node], removal)
+	if len(removals) > catalogRemovalsPerNode {
+		c.floors[node] = removals[0].index
+		removals = removals[1:]
+	}
+	c.nodes[node] = removals
+}
+
+// dropNode forgets the removals of a deleted node. Its diffs are full
+// until it is registered again, which sets a new CreateIndex.
+func (c *catalogRemovals) dropNode(index uint64, node string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	delete(c.nodes, node)
+	c.floors[node] = index
+}
+
+// since returns the removals from a node after an index, or false if
+// they are not all known
+func (c *catalogRemovals) since(node string, index uint64) ([]catalogRemoval, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.floors[node] > index {
+		return nil, false
+	}
+	var out []catalogRemoval
+	for _, removal := range c.nodes[node] {
+		if removal.index > index {
+			out = append(out, removal)
+		}
+	}
+	return out, true
+}
+
+// CatalogDiff returns the services and checks of a node that were added
+// or changed after an index, along with the IDs of the ones removed. If
+// the changes can't be tracked back to the index, the diff is full: it
+// holds every service and check of the node, and any other one must be
+// considered removed.
+func (s *StateStore) CatalogDiff(node string, since uint64) (uint64, *structs.CatalogDiff, error) {
+	defer s.measureQuery("CatalogDiff", time.Now(), "node", node)
+	tables := s.queryTables["CatalogDiff"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// A missing node is a full diff without anything
+	diff := &structs.CatalogDiff{}
+	res, err := s.nodeTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(res) == 0 {
+		diff.Full = true
+		return idx, diff, nil
+	}
+
+	// The removals before the creation of the node, which may have been
+	// deleted, or restored from a snapshot, are unknown
+	removals, known := s.catalogRemovals.since(node, since)
+	if res[0].(*structs.Node).CreateIndex > since || !known {
+		diff.Full = true
+		since = 0
+	}
+
+	services, err := s.serviceTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return 0, nil, err
+	}
+	serviceIDs := make(map[string]struct{}, len(services))
+	for _, r := range services {
+		service := r.(*structs.ServiceNode)
+		serviceIDs[service.ServiceID] = struct{}{}
+		if service.ModifyIndex <= since {
+			continue
+		}
+		diff.Services = append(diff.Services, &structs.NodeService{
+			ID:            service.ServiceID,
+			Service:       service.ServiceName,
+			Tags:          service.ServiceTags,
+			Address:       service.ServiceAddress,
+			Port:          service.ServicePort,
+			Meta:          service.ServiceMeta,
+			WeightPassing: service.ServiceWeightPassing,
+			WeightWarning: service.ServiceWeightWarning,
+			Kind:          service.ServiceKind,
+			Proxy:         service.ServiceProxy,
+			WANAddress:    service.ServiceWANAddress,
+			WANPort:       service.ServiceWANPort,
+		})
+	}
+
+	checks, err := s.checkTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return 0, nil, err
+	}
+	checkIDs := make(map[string]struct{}, len(checks))
+	for _, r := range checks {
+		check := r.(*structs.HealthCheck)
+		checkIDs[check.CheckID] = struct{}{}
+		if check.ModifyIndex > since {
+			diff.Checks = append(diff.Checks, check)
+		}
+	}
+
+	// Removals of entries that exist again, or whose transaction was
+	// aborted, are skipped
+	for _, removal := range removals {
+		if diff.Full {
+			break
+		}
+		if removal.service {
+			if _, ok := serviceIDs[removal.id]; !ok {
+				diff.RemovedServices = append(diff.RemovedServices, &structs.CatalogRemoval{
+					ID: removal.id, ServiceName: removal.name})
+				serviceIDs[removal.id] = struct{}{}
+			}
+		} else if _, ok := checkIDs[removal.id]; !ok {
+			diff.RemovedChecks = append(diff.RemovedChecks, &structs.CatalogRemoval{
+				ID: removal.id, ServiceName: removal.name})
+			checkIDs[removal.id] = struct{}{}
+		}
+	}
+	return idx, diff, nil
+}
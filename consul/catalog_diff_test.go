@@ -0,0 +1,139 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestCatalogRemovals(t *testing.T) {
+	c := newCatalogRemovals()
+	for i := 1; i <= catalogRemovalsPerNode+1; i++ {
+		c.record("foo", catalogRemoval{index: uint64(i), id: "check"})
+	}
+
+	// The oldest removal was dropped
+	if _, ok := c.since("foo", 0); ok {
+		t.Fatalf("should not be known")
+	}
+	removals, ok := c.since("foo", catalogRemovalsPerNode)
+	if !ok || len(removals) != 1 {
+		t.Fatalf("bad: %v %v", removals, ok)
+	}
+
+	c.dropNode(500, "foo")
+	if _, ok := c.since("foo", 499); ok {
+		t.Fatalf("should not be known")
+	}
+	if removals, ok := c.since("foo", 500); !ok || len(removals) != 0 {
+		t.Fatalf("bad: %v %v", removals, ok)
+	}
+}
+
+func TestStateStore_CatalogDiff(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// A missing node is a full diff
+	idx, diff, err := store.CatalogDiff("foo", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !diff.Full || len(diff.Services) != 0 || len(diff.Checks) != 0 {
+		t.Fatalf("bad: %v", diff)
+	}
+
+	reg := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{ID: "web1", Service: "web", Port: 80},
+		Checks: structs.HealthChecks{
+			&structs.HealthCheck{Node: "foo", CheckID: "web", ServiceID: "web1", Status: structs.HealthPassing},
+			&structs.HealthCheck{Node: "foo", CheckID: "mem", Status: structs.HealthPassing},
+		},
+	}
+	if err := store.EnsureRegistration(1, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db1", Service: "db", Port: 5432}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Before the creation of the node, the diff is full
+	idx, diff, err = store.CatalogDiff("foo", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 2 || !diff.Full || len(diff.Services) != 2 || len(diff.Checks) != 2 {
+		t.Fatalf("bad: %d %v", idx, diff)
+	}
+
+	// Only the changes are returned, re-registering the same entries
+	// doesn't change them
+	if err := store.EnsureRegistration(3, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureCheck(4, &structs.HealthCheck{Node: "foo", CheckID: "mem", Status: structs.HealthCritical}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNodeService(5, "foo", "web1"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, diff, err = store.CatalogDiff("foo", 2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || diff.Full || len(diff.Services) != 0 {
+		t.Fatalf("bad: %d %v", idx, diff)
+	}
+	if len(diff.Checks) != 1 || diff.Checks[0].CheckID != "mem" {
+		t.Fatalf("bad: %v", diff.Checks)
+	}
+	if len(diff.RemovedServices) != 1 || diff.RemovedServices[0].ID != "web1" {
+		t.Fatalf("bad: %v", diff.RemovedServices)
+	}
+	if len(diff.RemovedChecks) != 1 || diff.RemovedChecks[0].ID != "web" ||
+		diff.RemovedChecks[0].ServiceName != "web" {
+		t.Fatalf("bad: %v", diff.RemovedChecks)
+	}
+
+	// A removed entry that is registered again is only a change
+	if err := store.EnsureService(6, "foo", &structs.NodeService{ID: "web1", Service: "web", Port: 80}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, diff, err = store.CatalogDiff("foo", 2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(diff.Services) != 1 || len(diff.RemovedServices) != 0 {
+		t.Fatalf("bad: %v", diff)
+	}
+
+	// Nothing changed since the last index
+	_, diff, err = store.CatalogDiff("foo", 6)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if diff.Full || len(diff.Services) != 0 || len(diff.Checks) != 0 ||
+		len(diff.RemovedServices) != 0 || len(diff.RemovedChecks) != 0 {
+		t.Fatalf("bad: %v", diff)
+	}
+
+	// A node deleted and registered again is a full diff
+	if err := store.DeleteNode(7, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(8, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, diff, err = store.CatalogDiff("foo", 6)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !diff.Full || len(diff.Services) != 0 || len(diff.Checks) != 0 {
+		t.Fatalf("bad: %v", diff)
+	}
+}
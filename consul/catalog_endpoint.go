@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"time"
+	"unicode/utf8"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
@@ -25,6 +26,10 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 	if args.Node == "" || args.Address == "" {
 		return fmt.Errorf("Must provide node and address")
 	}
+	var err error
+	if args.Address, err = structs.NormalizeAddress(args.Address); err != nil {
+		return err
+	}
 
 	if args.Service != nil {
 		// If no service id, but service name, use default
@@ -37,6 +42,16 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 			return fmt.Errorf("Must provide service name with ID")
 		}
 
+		if args.Service.WeightPassing < 0 || args.Service.WeightWarning < 0 {
+			return fmt.Errorf("Service weights can't be negative")
+		}
+		if err := args.Service.Validate(); err != nil {
+			return err
+		}
+		if args.Service.Address, err = structs.NormalizeAddress(args.Service.Address); err != nil {
+			return err
+		}
+
 		// Apply the ACL policy if any
 		// The 'consul' service is excluded since it is managed
 		// automatically internally.
@@ -63,17 +78,47 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 		if check.Node == "" {
 			check.Node = args.Node
 		}
+		c.srv.truncateCheckOutput(check)
 	}
 
-	_, err := c.srv.raftApply(structs.RegisterRequestType, args)
+	args.Audit.Time = time.Now().UnixNano()
+	resp, err := c.srv.raftApply(structs.RegisterRequestType, args)
 	if err != nil {
 		c.srv.logger.Printf("[ERR] consul.catalog: Register failed: %v", err)
 		return err
 	}
 
+	// A failed check-and-set is reported to the caller
+	if respErr, ok := resp.(error); ok && args.CAS {
+		return respErr
+	}
 	return nil
 }
 
+// truncateCheckOutput bounds the output of a check to the configured
+// size. This is done before the update is committed, so every server
+// stores the same output.
+func (s *Server) truncateCheckOutput(check *structs.HealthCheck) {
+	if max := s.config.CheckOutputMaxSize; max > 0 {
+		check.Output = truncateCheckOutput(check.Output, max)
+	}
+}
+
+// truncateCheckOutput keeps the last max bytes of a check output, the
+// most relevant ones for a script, with a note about the truncation. The
+// cut doesn't split a UTF-8 sequence.
+func truncateCheckOutput(output string, max int) string {
+	if len(output) <= max {
+		return output
+	}
+	start := len(output) - max
+	for start < len(output) && !utf8.RuneStart(output[start]) {
+		start++
+	}
+	return fmt.Sprintf("Captured %d of %d bytes\n...\n%s",
+		len(output)-start, len(output), output[start:])
+}
+
 // Deregister is used to remove a service registration for a given node.
 func (c *Catalog) Deregister(args *structs.DeregisterRequest, reply *struct{}) error {
 	if done, err := c.srv.forward("Catalog.Deregister", args, args, reply); done {
@@ -86,11 +131,138 @@ func (c *Catalog) Deregister(args *structs.DeregisterRequest, reply *struct{}) e
 		return fmt.Errorf("Must provide node")
 	}
 
-	_, err := c.srv.raftApply(structs.DeregisterRequestType, args)
+	args.Audit.Time = time.Now().UnixNano()
+	resp, err := c.srv.raftApply(structs.DeregisterRequestType, args)
 	if err != nil {
 		c.srv.logger.Printf("[ERR] consul.catalog: Deregister failed: %v", err)
 		return err
 	}
+	if respErr, ok := resp.(error); ok && args.CAS {
+		return respErr
+	}
+	return nil
+}
+
+// Patch is used to change the tags or metadata of a node or service
+// without re-registering it.
+func (c *Catalog) Patch(args *structs.CatalogPatchRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("Catalog.Patch", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "patch"}, time.Now())
+
+	// Verify the args
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+	if len(args.Ops) == 0 {
+		return fmt.Errorf("Must provide patch operations")
+	}
+	for _, op := range args.Ops {
+		switch op.Op {
+		case structs.PatchAddTag, structs.PatchRemoveTag:
+			if args.ServiceID == "" {
+				return fmt.Errorf("Must provide service ID to patch tags")
+			}
+		case structs.PatchSetMeta, structs.PatchDeleteMeta:
+		default:
+			return fmt.Errorf("Invalid patch operation '%s'", op.Op)
+		}
+		if op.Key == "" {
+			return fmt.Errorf("Must provide key for '%s' operation", op.Op)
+		}
+	}
+
+	// Apply the ACL policy of the service being patched
+	if args.ServiceID != "" {
+		acl, err := c.srv.resolveToken(args.Token)
+		if err != nil {
+			return err
+		} else if acl != nil {
+			state := c.srv.fsm.State()
+			_, services := state.NodeServices(args.Node)
+			if services == nil || services.Services[args.ServiceID] == nil {
+				return fmt.Errorf("Unknown service '%s' on '%s'", args.ServiceID, args.Node)
+			}
+			service := services.Services[args.ServiceID].Service
+			if !acl.ServiceWrite(service) {
+				c.srv.logger.Printf("[WARN] consul.catalog: Patch of service '%s' on '%s' denied due to ACLs",
+					service, args.Node)
+				return permissionDeniedErr
+			}
+		}
+	}
+
+	resp, err := c.srv.raftApply(structs.CatalogPatchRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: Patch failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// Maintenance is used to put a node, or one of its services, in
+// maintenance mode, or to take it out of it. Returns if the change
+// applied, which a disable with a ModifyIndex may not.
+func (c *Catalog) Maintenance(args *structs.MaintenanceRequest, reply *bool) error {
+	if done, err := c.srv.forward("Catalog.Maintenance", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "maintenance"}, time.Now())
+
+	// Verify the args
+	m := &args.Maintenance
+	if m.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+	switch args.Op {
+	case structs.MaintenanceEnable:
+		if args.TTL < 0 {
+			return fmt.Errorf("Invalid maintenance TTL '%v'", args.TTL)
+		}
+		m.Expires = 0
+		if args.TTL > 0 {
+			m.Expires = time.Now().Add(args.TTL).UnixNano()
+		}
+	case structs.MaintenanceDisable:
+	default:
+		return fmt.Errorf("Invalid maintenance operation '%s'", args.Op)
+	}
+
+	// Apply the ACL policy of the service
+	if m.ServiceID != "" {
+		acl, err := c.srv.resolveToken(args.Token)
+		if err != nil {
+			return err
+		} else if acl != nil {
+			state := c.srv.fsm.State()
+			_, services := state.NodeServices(m.Node)
+			if services == nil || services.Services[m.ServiceID] == nil {
+				return fmt.Errorf("Unknown service '%s' on '%s'", m.ServiceID, m.Node)
+			}
+			service := services.Services[m.ServiceID].Service
+			if !acl.ServiceWrite(service) {
+				c.srv.logger.Printf("[WARN] consul.catalog: Maintenance of service '%s' on '%s' denied due to ACLs",
+					service, m.Node)
+				return permissionDeniedErr
+			}
+		}
+	}
+
+	resp, err := c.srv.raftApply(structs.MaintenanceRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: Maintenance failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	if respBool, ok := resp.(bool); ok {
+		*reply = respBool
+	}
 	return nil
 }
 
@@ -105,6 +277,13 @@ func (c *Catalog) ListDatacenters(args *struct{}, reply *[]string) error {
 		dcs = append(dcs, dc)
 	}
 
+	// Add the DCs linked by a network area only
+	for _, dc := range c.srv.areas.datacenters() {
+		if _, ok := c.srv.remoteConsuls[dc]; !ok {
+			dcs = append(dcs, dc)
+		}
+	}
+
 	// Sort the DCs
 	sort.Strings(dcs)
 
@@ -126,6 +305,28 @@ func (c *Catalog) ListNodes(args *structs.DCSpecificRequest, reply *structs.Inde
 		state.QueryTables("Nodes"),
 		func() error {
 			reply.Index, reply.Nodes = state.Nodes()
+			var err error
+			reply.Nodes, err = c.srv.paginateNodes(&args.QueryOptions, &reply.QueryMeta, reply.Nodes)
+			return err
+		})
+}
+
+// NodesByAddress is used to query the nodes registered with an address
+func (c *Catalog) NodesByAddress(args *structs.AddressSpecificRequest, reply *structs.IndexedNodes) error {
+	if done, err := c.srv.forward("Catalog.NodesByAddress", args, args, reply); done {
+		return err
+	}
+	if args.Address == "" {
+		return fmt.Errorf("Must provide address")
+	}
+
+	// Get the local state
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("NodesByAddress"),
+		func() error {
+			reply.Index, reply.Nodes = state.NodesByAddress(args.Address)
 			return nil
 		})
 }
@@ -157,20 +358,35 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 	if args.ServiceName == "" {
 		return fmt.Errorf("Must provide service name")
 	}
+	if args.Connect && args.TagFilter {
+		return fmt.Errorf("Tag filtering isn't supported for connect-proxies")
+	}
 
 	// Get the nodes
 	state := c.srv.fsm.State()
-	err := c.srv.blockingRPC(&args.QueryOptions,
-		&reply.QueryMeta,
-		state.QueryTables("ServiceNodes"),
-		func() error {
-			if args.TagFilter {
+	opts := blockingRPCOptions{
+		queryOpts: &args.QueryOptions,
+		queryMeta: &reply.QueryMeta,
+		service:   args.ServiceName,
+		run: func() error {
+			switch {
+			case args.Connect:
+				reply.Index, reply.ServiceNodes = state.ConnectServiceNodes(args.ServiceName)
+			case args.TagFilter:
 				reply.Index, reply.ServiceNodes = state.ServiceTagNodes(args.ServiceName, args.ServiceTag)
-			} else {
+			default:
 				reply.Index, reply.ServiceNodes = state.ServiceNodes(args.ServiceName)
 			}
-			return c.srv.filterACL(args.Token, reply)
-		})
+			if err := c.srv.filterACL(args.Token, reply); err != nil {
+				return err
+			}
+			var err error
+			reply.ServiceNodes, err = c.srv.paginateServiceNodes(&args.QueryOptions,
+				&reply.QueryMeta, reply.ServiceNodes)
+			return err
+		},
+	}
+	err := c.srv.blockingRPCOpt(&opts)
 
 	// Provide some metrics
 	if err == nil {
@@ -206,3 +422,73 @@ func (c *Catalog) NodeServices(args *structs.NodeSpecificRequest, reply *structs
 			return c.srv.filterACL(args.Token, reply)
 		})
 }
+
+// Diff returns the services and checks of a node that changed since an
+// index, so the agents can sync their state without pulling all of it
+func (c *Catalog) Diff(args *structs.CatalogDiffRequest, reply *structs.IndexedCatalogDiff) error {
+	if done, err := c.srv.forward("Catalog.Diff", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("CatalogDiff"),
+		func() error {
+			var err error
+			reply.Index, reply.Diff, err = state.CatalogDiff(args.Node, args.SinceIndex)
+			if err != nil {
+				return err
+			}
+			return c.srv.filterACL(args.Token, reply)
+		})
+}
+
+// ListMaintenance is used to list the maintenance flags of the nodes and
+// services
+func (c *Catalog) ListMaintenance(args *structs.DCSpecificRequest, reply *structs.IndexedMaintenances) error {
+	if done, err := c.srv.forward("Catalog.ListMaintenance", args, args, reply); done {
+		return err
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("Maintenance"),
+		func() error {
+			var err error
+			reply.Index, reply.Maintenances, err = state.MaintenanceList()
+			return err
+		})
+}
+
+// Audit is used to list the recorded catalog changes. Since the records
+// identify the tokens and clients that made the changes, this requires
+// a management token.
+func (c *Catalog) Audit(args *structs.CatalogAuditRequest, reply *structs.IndexedCatalogAudits) error {
+	if done, err := c.srv.forward("Catalog.Audit", args, args, reply); done {
+		return err
+	}
+
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("CatalogAudit"),
+		func() error {
+			var err error
+			reply.Index, reply.Audits, err = state.CatalogAuditList(args.Node, args.Start, args.End)
+			return err
+		})
+}
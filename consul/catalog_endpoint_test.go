@@ -46,6 +46,104 @@ func TestCatalogRegister(t *testing.T) {
 	})
 }
 
+func TestCatalogRegister_IPv6(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Bracketed IPv6 addresses are stored without their brackets
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "[2001:db8::1]",
+		Service: &structs.NodeService{
+			Service: "db",
+			Address: "[2001:db8::2]",
+			Port:    8000,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, found, addr := s1.fsm.State().GetNode("foo")
+	if !found || addr != "2001:db8::1" {
+		t.Fatalf("bad: %v %v", found, addr)
+	}
+	_, services := s1.fsm.State().NodeServices("foo")
+	if services == nil || services.Services["db"].Address != "2001:db8::2" {
+		t.Fatalf("bad: %v", services)
+	}
+
+	// Anything else in brackets is rejected
+	arg.Address = "[127.0.0.1]"
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "only IPv6 addresses can be bracketed") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalogRegister_CheckOutputMaxSize(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CheckOutputMaxSize = 8
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Check: &structs.HealthCheck{
+			CheckID: "logs",
+			Name:    "noisy script",
+			Status:  structs.HealthPassing,
+			Output:  "short",
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, checks := s1.fsm.State().NodeChecks("foo")
+	if len(checks) != 1 || checks[0].Output != "short" {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// The end of a longer output is kept
+	arg.Check.Output = "lots of noise, then the error"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, checks = s1.fsm.State().NodeChecks("foo")
+	if len(checks) != 1 || checks[0].Output != "Captured 8 of 29 bytes\n...\nhe error" {
+		t.Fatalf("bad: %v", checks)
+	}
+	modifyIndex := checks[0].ModifyIndex
+
+	// Sending the same output again is idempotent
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, checks = s1.fsm.State().NodeChecks("foo")
+	if len(checks) != 1 || checks[0].ModifyIndex != modifyIndex {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// A multi-byte character is not split
+	if out := truncateCheckOutput("ab\u00e9cd", 3); out != "Captured 2 of 6 bytes\n...\ncd" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
 func TestCatalogRegister_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -209,6 +307,308 @@ func TestCatalogDeregister(t *testing.T) {
 	}
 }
 
+func TestCatalogRegister_CAS(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Port:    8000,
+		},
+		CAS: true,
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The service exists now, so the same request conflicts
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out)
+	if !structs.IsRegistrationConflict(err) {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, nodes := s1.fsm.State().ServiceNodes("db")
+	if len(nodes) != 1 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	dereg := structs.DeregisterRequest{
+		Datacenter:  "dc1",
+		Node:        "foo",
+		ServiceID:   "db",
+		CAS:         true,
+		ModifyIndex: nodes[0].ModifyIndex + 1,
+	}
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &dereg, &out)
+	if !structs.IsRegistrationConflict(err) {
+		t.Fatalf("err: %v", err)
+	}
+	dereg.ModifyIndex = nodes[0].ModifyIndex
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &dereg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalogDiff(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Port:    8000,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.CatalogDiffRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	var reply structs.IndexedCatalogDiff
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Diff", &req, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || !reply.Diff.Full || len(reply.Diff.Services) != 1 {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	dereg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "db",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Deregister", &dereg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req.SinceIndex = reply.Index
+	reply = structs.IndexedCatalogDiff{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Diff", &req, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Diff.Full || len(reply.Diff.Services) != 0 || len(reply.Diff.RemovedServices) != 1 {
+		t.Fatalf("bad: %v", reply.Diff)
+	}
+}
+
+func TestCatalogPatch(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	argR := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Tags:    []string{"master"},
+			Port:    8000,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &argR, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg := structs.CatalogPatchRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "db",
+		Ops: []structs.PatchOp{
+			structs.PatchOp{Op: structs.PatchRemoveTag, Key: "master"},
+			structs.PatchOp{Op: structs.PatchAddTag, Key: "slave"},
+			structs.PatchOp{Op: structs.PatchSetMeta, Key: "lag", Value: "0"},
+		},
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Patch", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, services := s1.fsm.State().NodeServices("foo")
+	db := services.Services["db"]
+	if len(db.Tags) != 1 || db.Tags[0] != "slave" || db.Meta["lag"] != "0" {
+		t.Fatalf("bad: %#v", db)
+	}
+
+	// Tags require a service
+	arg.ServiceID = ""
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Patch", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "service ID") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Errors from the state store are returned
+	arg.ServiceID = "nope"
+	err = msgpackrpc.CallWithCodec(codec, "Catalog.Patch", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Missing service") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalogMaintenance(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	argR := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "db",
+			Port:    8000,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &argR, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Put the service in maintenance for a short while
+	arg := structs.MaintenanceRequest{
+		Datacenter: "dc1",
+		Op:         structs.MaintenanceEnable,
+		Maintenance: structs.Maintenance{
+			Node:      "foo",
+			ServiceID: "db",
+			Reason:    "backup",
+		},
+		TTL: 200 * time.Millisecond,
+	}
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Maintenance", &arg, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("should apply")
+	}
+
+	listArgs := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var list structs.IndexedMaintenances
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListMaintenance", &listArgs, &list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list.Maintenances) != 1 || list.Maintenances[0].Reason != "backup" || list.Maintenances[0].Expires == 0 {
+		t.Fatalf("bad: %v", list.Maintenances)
+	}
+
+	// The service is no longer passing
+	healthArgs := structs.ServiceSpecificRequest{Datacenter: "dc1", ServiceName: "db"}
+	var health structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &healthArgs, &health); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(health.Nodes) != 1 || len(health.Nodes[0].Checks) != 1 ||
+		health.Nodes[0].Checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %v", health.Nodes)
+	}
+
+	// The leader lifts the flag once it expires
+	testutil.WaitForResult(func() (bool, error) {
+		_, flags, err := s1.fsm.State().MaintenanceList()
+		if err != nil {
+			return false, err
+		}
+		_, checks := s1.fsm.State().NodeChecks("foo")
+		return len(flags) == 0 && len(checks) == 0, nil
+	}, func(err error) {
+		t.Fatalf("maintenance should expire: %v", err)
+	})
+
+	// Invalid operations are rejected
+	arg.Op = "nope"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Maintenance", &arg, &ok); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestCatalogPatch_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Create the ACL
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testRegisterRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id := out
+
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db"})
+	s1.fsm.State().EnsureService(3, "foo", &structs.NodeService{ID: "foo", Service: "foo"})
+
+	argP := structs.CatalogPatchRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "db",
+		Ops: []structs.PatchOp{
+			structs.PatchOp{Op: structs.PatchAddTag, Key: "master"},
+		},
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var outP struct{}
+
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.Patch", &argP, &outP)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	argP.ServiceID = "foo"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Patch", &argP, &outP); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestCatalogListDatacenters(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -267,7 +667,7 @@ func TestCatalogListNodes(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 
 	testutil.WaitForResult(func() (bool, error) {
 		msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out)
@@ -288,6 +688,35 @@ func TestCatalogListNodes(t *testing.T) {
 	}
 }
 
+func TestCatalogNodesByAddress(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.42"})
+
+	args := structs.AddressSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var out structs.IndexedNodes
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.NodesByAddress", &args, &out)
+	if err == nil || err.Error() != "Must provide address" {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Address = "127.0.0.42"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.NodesByAddress", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 1 || out.Nodes[0].Node != "foo" {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
 func TestCatalogListNodes_StaleRaad(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -317,12 +746,12 @@ func TestCatalogListNodes_StaleRaad(t *testing.T) {
 		codec = codec1
 
 		// Inject fake data on the follower!
-		s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+		s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	} else {
 		codec = codec2
 
 		// Inject fake data on the follower!
-		s2.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+		s2.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	}
 
 	args := structs.DCSpecificRequest{
@@ -352,6 +781,63 @@ func TestCatalogListNodes_StaleRaad(t *testing.T) {
 	}
 }
 
+func TestCatalogListNodes_BoundedStaleRead(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec1 := rpcClient(t, s1)
+	defer codec1.Close()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	codec2 := rpcClient(t, s2)
+	defer codec2.Close()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc1")
+
+	// Use the follower as the client
+	codec := codec1
+	if s1.IsLeader() {
+		codec = codec2
+	}
+
+	// A follower is always some time behind the leader
+	args := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+		QueryOptions: structs.QueryOptions{
+			AllowStale:       true,
+			MaxStaleDuration: time.Nanosecond,
+		},
+	}
+	var out structs.IndexedNodes
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), structs.ErrStaleRead.Error()) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// But within generous bounds
+	args.MaxStaleDuration = time.Minute
+	args.MaxStaleIndex = 1000
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.QueryMeta.LastContact == 0 || out.QueryMeta.LastContact > time.Minute {
+		t.Fatalf("bad: %v", out.QueryMeta)
+	}
+	if out.QueryMeta.IndexLag > 1000 {
+		t.Fatalf("bad: %v", out.QueryMeta)
+	}
+}
+
 func TestCatalogListNodes_ConsistentRead_Fail(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -458,7 +944,7 @@ func BenchmarkCatalogListNodes(t *testing.B) {
 	defer codec.Close()
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 
 	args := structs.DCSpecificRequest{
 		Datacenter: "dc1",
@@ -490,8 +976,8 @@ func TestCatalogListServices(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000})
 
 	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
 		t.Fatalf("err: %v", err)
@@ -544,8 +1030,8 @@ func TestCatalogListServices_Blocking(t *testing.T) {
 	start := time.Now()
 	go func() {
 		time.Sleep(100 * time.Millisecond)
-		s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-		s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
+		s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+		s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000})
 	}()
 
 	// Re-run the query
@@ -625,8 +1111,8 @@ func TestCatalogListServices_Stale(t *testing.T) {
 	var out structs.IndexedServices
 
 	// Inject a fake service
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000})
 
 	// Run the query, do not wait for leader!
 	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListServices", &args, &out); err != nil {
@@ -666,8 +1152,8 @@ func TestCatalogListServiceNodes(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000})
 
 	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
 		t.Fatalf("err: %v", err)
@@ -689,6 +1175,178 @@ func TestCatalogListServiceNodes(t *testing.T) {
 	}
 }
 
+func TestCatalogListServiceNodes_Order(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register out of order, so the service index doesn't follow the nodes
+	state := s1.fsm.State()
+	for i, node := range []string{"c", "a", "b"} {
+		idx := uint64(10 + 2*i)
+		state.EnsureNode(idx, structs.Node{Node: node, Address: "127.0.0.1"})
+		state.EnsureService(idx+1, node, &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Port: 5000})
+	}
+
+	for _, tagFilter := range []bool{false, true} {
+		args := structs.ServiceSpecificRequest{
+			Datacenter:  "dc1",
+			ServiceName: "db",
+			ServiceTag:  "primary",
+			TagFilter:   tagFilter,
+		}
+		var out structs.IndexedServiceNodes
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.ServiceNodes) != 3 || out.ServiceNodes[0].Node != "a" ||
+			out.ServiceNodes[1].Node != "b" || out.ServiceNodes[2].Node != "c" {
+			t.Fatalf("bad: %v", out.ServiceNodes)
+		}
+	}
+}
+
+func TestCatalogListServiceNodes_Connect(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A proxy needs a destination
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "web-proxy",
+			Port:    21000,
+			Kind:    structs.ServiceKindConnectProxy,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	arg.Service.Proxy.DestinationServiceName = "web"
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Service = &structs.NodeService{Service: "web", Port: 80}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The proxy is found by its destination
+	args := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "web",
+		Connect:     true,
+	}
+	var nodes structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.ServiceNodes) != 1 || nodes.ServiceNodes[0].ServiceName != "web-proxy" {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	var checkNodes structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &args, &checkNodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checkNodes.Nodes) != 1 || checkNodes.Nodes[0].Service.Proxy.DestinationServiceName != "web" {
+		t.Fatalf("bad: %v", checkNodes)
+	}
+
+	// Tags can't filter the proxies
+	args.TagFilter = true
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &nodes); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestCatalogListServiceNodes_Paginate(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.MaxPageSize = 3
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register the instances out of order
+	state := s1.fsm.State()
+	for i, node := range []string{"e", "B", "a", "d", "c"} {
+		state.EnsureNode(uint64(2*i+1), structs.Node{Node: node, Address: "127.0.0.1"})
+		state.EnsureService(uint64(2*i+2), node, &structs.NodeService{ID: "db", Service: "db"})
+	}
+
+	// Walk the pages in order
+	args := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	args.Limit = 2
+	var nodes []string
+	var pages int
+	for {
+		var out structs.IndexedServiceNodes
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.ServiceNodes) > 2 {
+			t.Fatalf("bad: %v", out)
+		}
+		for _, srv := range out.ServiceNodes {
+			nodes = append(nodes, srv.Node)
+		}
+		pages++
+		if out.NextToken == "" {
+			break
+		}
+		args.NextToken = out.NextToken
+	}
+	if pages != 3 || strings.Join(nodes, ",") != "a,B,c,d,e" {
+		t.Fatalf("bad: %d %v", pages, nodes)
+	}
+
+	// The maximum caps a larger limit
+	args.Limit, args.NextToken = 10, ""
+	var out structs.IndexedServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.ServiceNodes) != 3 || out.NextToken == "" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The maximum doesn't apply without a limit
+	args.Limit = 0
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.ServiceNodes) != 5 || out.NextToken != "" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// A bad token is rejected
+	args.NextToken = "nope"
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ServiceNodes", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), "Invalid next token") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestCatalogNodeServices(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -709,9 +1367,9 @@ func TestCatalogNodeServices(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
-	s1.fsm.State().EnsureService(3, "foo", &structs.NodeService{"web", "web", nil, "127.0.0.1", 80, false})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000})
+	s1.fsm.State().EnsureService(3, "foo", &structs.NodeService{ID: "web", Service: "web", Address: "127.0.0.1", Port: 80})
 
 	if err := msgpackrpc.CallWithCodec(codec, "Catalog.NodeServices", &args, &out); err != nil {
 		t.Fatalf("err: %v", err)
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/tlsutil"
 	"github.com/hashicorp/serf/serf"
 )
 
@@ -65,6 +66,10 @@ type Client struct {
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
+
+	// rpcTLS holds the TLS config of the RPC connections, which is
+	// swapped when the certificates are reloaded
+	rpcTLS *tlsutil.Configurator
 }
 
 // NewClient is used to construct a new Consul client from the
@@ -90,11 +95,12 @@ func NewClient(config *Config) (*Client, error) {
 		config.LogOutput = os.Stderr
 	}
 
-	// Create the tls Wrapper
-	tlsWrap, err := config.tlsConfig().OutgoingTLSWrapper()
+	// Create the TLS config of the outgoing connections
+	rpcTLS, err := tlsutil.NewConfigurator(config.tlsConfig())
 	if err != nil {
 		return nil, err
 	}
+	tlsWrap := rpcTLS.OutgoingTLSWrapper()
 
 	// Create a logger
 	logger := log.New(config.LogOutput, "", log.LstdFlags)
@@ -106,11 +112,20 @@ func NewClient(config *Config) (*Client, error) {
 		eventCh:    make(chan serf.Event, 256),
 		logger:     logger,
 		shutdownCh: make(chan struct{}),
+		rpcTLS:     rpcTLS,
 	}
 
 	// Start the Serf listeners to prevent a deadlock
 	go c.lanEventHandler()
 
+	// Reload the TLS certificates when their files change
+	go c.rpcTLS.Watch(tlsWatchInterval, c.shutdownCh, c.logger)
+
+	// Obtain the TLS certificate from the servers once they are known
+	if config.AutoEncryptTLS {
+		go c.autoEncrypt()
+	}
+
 	// Initialize the lan Serf
 	c.serf, err = c.setupSerf(config.SerfLANConfig,
 		c.eventCh, serfLANSnapshot)
@@ -179,6 +194,13 @@ func (c *Client) Leave() error {
 	return nil
 }
 
+// ReloadTLS applies the TLS settings of a new configuration to the RPC
+// connections, reading the certificates again. The current settings are
+// kept if the new ones fail to load.
+func (c *Client) ReloadTLS(config *Config) error {
+	return c.rpcTLS.Update(config.tlsConfig())
+}
+
 // JoinLAN is used to have Consul client join the inner-DC pool
 // The target address should be another node inside the DC
 // listening on the Serf LAN address
@@ -328,6 +350,7 @@ func (c *Client) localEvent(event serf.UserEvent) {
 func (c *Client) RPC(method string, args interface{}, reply interface{}) error {
 	// Check the last rpc time
 	var server *serverParts
+	var retried bool
 	if time.Now().Sub(c.lastRPCTime) < clientRPCCache {
 		server = c.lastServer
 		if server != nil {
@@ -351,6 +374,15 @@ TRY_RPC:
 	if err := c.connPool.RPC(c.config.Datacenter, server.Addr, server.Version, method, args, reply); err != nil {
 		c.lastServer = nil
 		c.lastRPCTime = time.Time{}
+
+		// A leaving server rejects the blocking queries, retry them once
+		// on another server
+		if err.Error() == structs.ErrServerLeaving.Error() && !retried {
+			if other := c.otherServer(server); other != nil {
+				server, retried = other, true
+				goto TRY_RPC
+			}
+		}
 		return err
 	}
 
@@ -360,6 +392,23 @@ TRY_RPC:
 	return nil
 }
 
+// otherServer returns a random known server other than the given one, or
+// nil if there is none
+func (c *Client) otherServer(server *serverParts) *serverParts {
+	c.consulLock.RLock()
+	defer c.consulLock.RUnlock()
+	var others []*serverParts
+	for _, s := range c.consuls {
+		if s.Addr.String() != server.Addr.String() {
+			others = append(others, s)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	return others[rand.Int31()%int32(len(others))]
+}
+
 // Stats is used to return statistics for debugging and insight
 // for various sub-systems
 func (c *Client) Stats() map[string]map[string]string {
@@ -7,6 +7,8 @@ import (
 	"os"
 	"time"
 
+	"github.com/hashicorp/consul/audit"
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/tlsutil"
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
@@ -84,6 +86,15 @@ type Config struct {
 	// leader election.
 	ReconcileInterval time.Duration
 
+	// AutopilotConfig is the autopilot configuration used until an
+	// operator sets one through the Operator endpoint
+	AutopilotConfig *structs.AutopilotConfig
+
+	// AutopilotInterval controls how often the leader records the health
+	// of the servers, adds the stable ones to the Raft configuration and
+	// removes the failed ones
+	AutopilotInterval time.Duration
+
 	// LogOutput is the location to write logs to. If this is not set,
 	// logs will go to stderr.
 	LogOutput io.Writer
@@ -111,6 +122,11 @@ type Config struct {
 	// existing clients.
 	VerifyServerHostname bool
 
+	// TLSMigrate accepts plaintext RPC connections even with
+	// VerifyIncoming set, while TLS connections must present a verified
+	// certificate, so that the clients can be moved to TLS one at a time
+	TLSMigrate bool
+
 	// CAFile is a path to a certificate authority file. This is used with VerifyIncoming
 	// or VerifyOutgoing to verify the TLS connection.
 	CAFile string
@@ -127,6 +143,23 @@ type Config struct {
 	// provide matches the certificate
 	ServerName string
 
+	// AutoEncryptAllowTLS lets the servers sign the TLS certificates of
+	// the clients using auto-encrypt. The CA certificate, the first of the
+	// CAFile, and its key in CAKeyFile sign the certificates, which
+	// expire after AutoEncryptCertTTL.
+	AutoEncryptAllowTLS bool
+	CAKeyFile           string
+	AutoEncryptCertTTL  time.Duration
+
+	// AutoEncryptTLS has a client obtain its TLS certificate from the
+	// servers. It authenticates with the gossip encryption key, or with
+	// the one-time AutoEncryptToken if set.
+	AutoEncryptTLS   bool
+	AutoEncryptToken string
+
+	// AuditLog records the mutating RPC calls made to the server, if set
+	AuditLog *audit.Log
+
 	// RejoinAfterLeave controls our interaction with Serf.
 	// When set to false (default), a leave causes a Consul to not rejoin
 	// the cluster until an explicit join is received. If this is set to
@@ -169,6 +202,27 @@ type Config struct {
 	// "allow" can be used to allow all requests. This is not recommended.
 	ACLDownPolicy string
 
+	// ACLReplicationToken enables the replication of the ACLs of the
+	// ACLDatacenter by the leader of another datacenter. The replicated
+	// ACLs are used when the ACLDatacenter can't be reached, before
+	// applying the ACLDownPolicy. It must be a management token.
+	ACLReplicationToken string
+
+	// ACLReplicationInterval is the delay before retrying a failed
+	// replication. It doubles with each consecutive failure, up to 16
+	// times its value.
+	ACLReplicationInterval time.Duration
+
+	// AreaRefreshInterval is how often the servers of the peer
+	// datacenters of the network areas are refreshed. The areas are
+	// also refreshed as soon as they change.
+	AreaRefreshInterval time.Duration
+
+	// PeeringSyncInterval is how often the leader pulls the services
+	// exported by the peers of the peerings it dialed. The peerings are
+	// also synced as soon as they change.
+	PeeringSyncInterval time.Duration
+
 	// TombstoneTTL is used to control how long KV tombstones are retained.
 	// This provides a window of time where the X-Consul-Index is monotonic.
 	// Outside this window, the index may not be monotonic. This is a result
@@ -192,9 +246,104 @@ type Config struct {
 	// to reduce overhead. It is unlikely a user would ever need to tune this.
 	TombstoneTTLGranularity time.Duration
 
+	// KVSHistoryVersions is the number of prior versions of each KV entry
+	// that are retained so that the entry can be read as of an earlier
+	// index. This is used to inspect what a key held before it was
+	// overwritten. The leader commits its value to all the servers when
+	// it is elected. Setting this to zero disables the history.
+	KVSHistoryVersions int
+
+	// KVSHistoryTTL bounds how long a prior version of a KV entry is
+	// retained. The leader reaps the expired versions through Raft, at
+	// the TombstoneTTLGranularity. A zero value retains versions until
+	// they are displaced.
+	KVSHistoryTTL time.Duration
+
+	// KVSNotifyLimits rate limits the notifications of the blocking
+	// queries watching hot KV keys, by key prefix to the minimum interval
+	// between two notifications. The last change under a prefix is always
+	// delivered at the end of the interval. The longest matching prefix
+	// applies.
+	KVSNotifyLimits map[string]time.Duration
+
+	// SlowQueryThreshold is the duration after which a state store query
+	// is logged as slow, along with its redacted parameters. The most
+	// recent slow queries are retained for inspection. Setting this to
+	// zero disables the slow query log.
+	SlowQueryThreshold time.Duration
+
+	// QueryCacheSize is the number of results of the hot catalog and
+	// health queries cached by the state store. Cached results are
+	// discarded as soon as the tables they were read from change, so
+	// this mostly helps with many agents repeating the same reads.
+	// Zero disables the cache.
+	QueryCacheSize int
+
+	// MaxPageSize caps the number of entries returned by the paginated
+	// catalog and health queries, which then return a token for the next
+	// page. It only applies to requests with a limit, since the internal
+	// callers read the whole result at once. Zero disables the cap.
+	MaxPageSize int
+
+	// RPCReadRate and RPCWriteRate limit the read and write RPC requests
+	// per second made to the server from each source address and with
+	// each ACL token, with bursts of up to RPCReadBurst and RPCWriteBurst
+	// requests. Requests over the limits are rejected with
+	// ErrRPCRateLimited. The requests forwarded by other servers aren't
+	// limited again. Zero rates disable the limits, and the bursts are at
+	// least a second worth of requests.
+	RPCReadRate   float64
+	RPCReadBurst  int
+	RPCWriteRate  float64
+	RPCWriteBurst int
+
+	// StateMaxSize is the maximum size of the state store in bytes. The
+	// state store is kept on disk under the DataDir and paged into memory
+	// as needed, so this may exceed the available memory. Zero uses the
+	// default, which is 32GB on 64-bit platforms and 128MB otherwise.
+	StateMaxSize uint64
+
+	// StateIndexes are additional indexes on the state store tables, for
+	// embedders that query the state store directly. They are not
+	// available from the agent configuration.
+	StateIndexes []*StateIndex
+
+	// StateLogger, if set, receives the events of the state store and the
+	// snapshot restores instead of LogOutput, for embedders with their own
+	// structured logging. It is not available from the agent configuration.
+	StateLogger StateLogger
+
 	// Minimum Session TTL
 	SessionTTLMin time.Duration
 
+	// LeaveDrainTime is how long a leaving server waits for its in-flight
+	// blocking queries to complete before leaving the gossip pools. The
+	// remaining ones then return their current results.
+	LeaveDrainTime time.Duration
+
+	// SessionLimitPerNode caps the number of active sessions a node may
+	// hold, creating more fails with a SessionLimitError. The leader sets
+	// it in the session creations it commits, so only its value applies.
+	// Zero disables the limit.
+	SessionLimitPerNode int
+
+	// CheckOutputMaxSize is the maximum number of bytes of output kept for
+	// a health check. Longer outputs are truncated, keeping their end. The
+	// leader truncates the outputs before committing the updates. Zero
+	// disables the limit.
+	CheckOutputMaxSize int
+
+	// CatalogAuditLimit is the number of catalog registrations and
+	// deregistrations retained in the audit table. The oldest records
+	// are removed first, by the leader on each ReconcileInterval, so the
+	// table can briefly exceed the limit. The leader commits its value to
+	// all the servers when it is elected. Zero disables the audit table.
+	CatalogAuditLimit int
+
+	// SnapshotRestoreChunkSize is the size of the Raft entries the state
+	// of a restored snapshot is applied in
+	SnapshotRestoreChunkSize int
+
 	// ServerUp callback can be used to trigger a notification that
 	// a Consul server is now up and known about.
 	ServerUp func()
@@ -202,6 +351,18 @@ type Config struct {
 	// UserEventHandler callback can be used to handle incoming
 	// user events. This function should not block.
 	UserEventHandler func(serf.UserEvent)
+
+	// EventBridge is a set of rules that convert state changes into
+	// user events. The leader evaluates the rules and fires the events,
+	// allowing agents to react to changes without polling the servers.
+	EventBridge []*EventBridgeRule
+
+	// OutboxSubscriptions route the committed changes of KV entries to
+	// external systems. The leader delivers the changes under each prefix
+	// to the subscription URL until they are acknowledged. A positive
+	// MaxPending caps the undelivered entries, dropping the oldest ones
+	// once it is reached. By default they are not capped.
+	OutboxSubscriptions []*structs.OutboxSubscription
 }
 
 // CheckVersion is used to check if the ProtocolVersion is valid
@@ -234,6 +395,17 @@ func (c *Config) CheckACL() error {
 	return nil
 }
 
+// CheckEventBridge is used to sanity check the event bridge rules
+func (c *Config) CheckEventBridge() error {
+	_, err := compileBridgeRules(c.EventBridge)
+	return err
+}
+
+// CheckOutbox is used to sanity check the outbox subscriptions
+func (c *Config) CheckOutbox() error {
+	return compileOutboxSubscriptions(c.OutboxSubscriptions)
+}
+
 // DefaultConfig is used to return a sane default configuration
 func DefaultConfig() *Config {
 	hostname, err := os.Hostname()
@@ -249,13 +421,21 @@ func DefaultConfig() *Config {
 		SerfLANConfig:           serf.DefaultConfig(),
 		SerfWANConfig:           serf.DefaultConfig(),
 		ReconcileInterval:       60 * time.Second,
+		AutopilotInterval:       10 * time.Second,
 		ProtocolVersion:         ProtocolVersionMax,
 		ACLTTL:                  30 * time.Second,
 		ACLDefaultPolicy:        "allow",
 		ACLDownPolicy:           "extend-cache",
+		ACLReplicationInterval:  30 * time.Second,
+		AreaRefreshInterval:     30 * time.Second,
+		PeeringSyncInterval:     30 * time.Second,
 		TombstoneTTL:            15 * time.Minute,
 		TombstoneTTLGranularity: 30 * time.Second,
 		SessionTTLMin:           10 * time.Second,
+		LeaveDrainTime:          5 * time.Second,
+		AutoEncryptCertTTL:      72 * time.Hour,
+
+		SnapshotRestoreChunkSize: 256 * 1024,
 	}
 
 	// Increase our reap interval to 3 days instead of 24h.
@@ -273,6 +453,12 @@ func DefaultConfig() *Config {
 	// Disable shutdown on removal
 	conf.RaftConfig.ShutdownOnRemove = false
 
+	// Remove the failed servers, and wait for the new ones to be stable
+	conf.AutopilotConfig = &structs.AutopilotConfig{
+		CleanupDeadServers:      true,
+		ServerStabilizationTime: 10 * time.Second,
+	}
+
 	return conf
 }
 
@@ -287,6 +473,8 @@ func (c *Config) tlsConfig() *tlsutil.Config {
 		NodeName:             c.NodeName,
 		ServerName:           c.ServerName,
 		Domain:               c.Domain,
+		AllowPlaintext:       c.TLSMigrate,
+		AutoEncrypt:          c.AutoEncryptTLS,
 	}
 	return tlsConf
 }
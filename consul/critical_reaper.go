@@ -0,0 +1,106 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// criticalReapInterval is how often the critical checks are
+	// re-scanned even when no watch has fired. This covers the state
+	// store being swapped out by a snapshot restore.
+	criticalReapInterval = 30 * time.Second
+
+	// criticalReapCoalesce is how long check changes are coalesced
+	// before re-scanning the critical checks, so a burst of check
+	// updates doesn't cause a scan per update
+	criticalReapCoalesce = time.Second
+)
+
+// criticalCheck identifies a check of a node
+type criticalCheck struct {
+	node    string
+	checkID string
+}
+
+// reapCriticalServices runs while we are the leader, and deregisters the
+// services whose check sets a DeregisterCriticalServiceAfter and has been
+// critical for longer than that. This cleans up the instances of crashed
+// hosts, whose agent will never deregister them. The leader only knows
+// when it first saw a check critical, so the windows start over on a
+// leader change, which can delay but never hasten a deregistration.
+func (s *Server) reapCriticalServices(stopCh chan struct{}) {
+	since := make(map[criticalCheck]time.Time)
+	notify := make(chan struct{}, 1)
+	for {
+		// Register the watch, it is cleared once it fires
+		state := s.fsm.State()
+		tables := state.QueryTables("ChecksInState")
+		state.Watch(tables, notify)
+
+		_, checks := state.ChecksInState(structs.HealthCritical)
+		now := time.Now()
+		critical := make(map[criticalCheck]struct{}, len(checks))
+		wait := criticalReapInterval
+		for _, check := range checks {
+			if check.ServiceID == "" || check.DeregisterCriticalServiceAfter <= 0 {
+				continue
+			}
+			c := criticalCheck{check.Node, check.CheckID}
+			critical[c] = struct{}{}
+			first, ok := since[c]
+			if !ok {
+				first = now
+				since[c] = now
+			}
+
+			deadline := first.Add(check.DeregisterCriticalServiceAfter)
+			if deadline.After(now) {
+				if left := deadline.Sub(now); left < wait {
+					wait = left
+				}
+				continue
+			}
+			if err := s.deregisterCriticalService(check); err != nil {
+				s.logger.Printf("[ERR] consul: Failed to deregister service '%s' of node '%s': %v",
+					check.ServiceID, check.Node, err)
+			}
+		}
+
+		// Forget the checks that are no longer critical
+		for c := range since {
+			if _, ok := critical[c]; !ok {
+				delete(since, c)
+			}
+		}
+
+		select {
+		case <-notify:
+			select {
+			case <-time.After(criticalReapCoalesce):
+			case <-stopCh:
+				return
+			}
+		case <-time.After(wait):
+		case <-stopCh:
+			state.StopWatch(tables, notify)
+			return
+		}
+	}
+}
+
+// deregisterCriticalService deregisters the service of a critical check
+func (s *Server) deregisterCriticalService(check *structs.HealthCheck) error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "deregisterCriticalService"}, time.Now())
+	s.logger.Printf("[INFO] consul: check '%s' of service '%s' on node '%s' critical for over %v, deregistering the service",
+		check.CheckID, check.ServiceID, check.Node, check.DeregisterCriticalServiceAfter)
+	req := structs.DeregisterRequest{
+		Datacenter: s.config.Datacenter,
+		Node:       check.Node,
+		ServiceID:  check.ServiceID,
+	}
+	var out struct{}
+	return s.endpoints.Catalog.Deregister(&req, &out)
+}
@@ -0,0 +1,404 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+const (
+	// EventBridgeServiceCritical fires when an instance of a service
+	// transitions to having a critical health check.
+	EventBridgeServiceCritical = "service-critical"
+
+	// EventBridgeKeyChanged fires when a key under a prefix is
+	// modified or deleted.
+	EventBridgeKeyChanged = "key-changed"
+
+	// eventBridgeInterval is how often the bridge re-evaluates the
+	// rules even when no watch has fired. This covers the state store
+	// being swapped out by a snapshot restore.
+	eventBridgeInterval = 30 * time.Second
+
+	// eventBridgeMaxPending is the number of events a rule holds back
+	// while it is rate limited. Past it, the oldest ones are dropped.
+	eventBridgeMaxPending = 256
+
+	// eventBridgeVersion is the user event protocol version that
+	// the agents understand
+	eventBridgeVersion = 1
+)
+
+// EventBridgeRule configures a state store change that is converted
+// into a user event. The Name and Payload are templates that are
+// rendered with the details of the change.
+type EventBridgeRule struct {
+	// Type is the kind of change, either EventBridgeServiceCritical
+	// or EventBridgeKeyChanged
+	Type string
+
+	// Service is the service to monitor for EventBridgeServiceCritical
+	Service string
+
+	// Prefix is the KV prefix to monitor for EventBridgeKeyChanged
+	Prefix string
+
+	// Name is a template for the name of the fired user event
+	Name string
+
+	// Payload is an optional template for the event payload
+	Payload string
+
+	// RateLimit is the minimum time between events fired by this
+	// rule. Events in excess of the rate are queued, and fired in order
+	// as the rate allows.
+	RateLimit time.Duration
+}
+
+// eventBridgeData is provided to the rule templates
+type eventBridgeData struct {
+	Node      string
+	Service   string
+	ServiceID string
+	Key       string
+	Value     string
+	Index     uint64
+	Deleted   bool
+}
+
+// eventBridgeUserEvent mirrors the envelope agents expect for
+// user events, so bridged events are handled like any other.
+type eventBridgeUserEvent struct {
+	ID      string
+	Name    string `codec:"n"`
+	Payload []byte `codec:"p,omitempty"`
+	Version int    `codec:"v"`
+}
+
+// compiledBridgeRule is a rule along with its parsed templates
+// and evaluation state
+type compiledBridgeRule struct {
+	*EventBridgeRule
+	name    *template.Template
+	payload *template.Template
+
+	critical  map[string]struct{} // Instances that are currently critical
+	lastIndex uint64              // Highest KV index seen under the prefix
+	lastFired time.Time
+	pending   []*eventBridgeData // Events held back by the rate limit
+}
+
+// compileBridgeRules validates the rules and parses their templates
+func compileBridgeRules(rules []*EventBridgeRule) ([]*compiledBridgeRule, error) {
+	var out []*compiledBridgeRule
+	for i, rule := range rules {
+		switch rule.Type {
+		case EventBridgeServiceCritical:
+			if rule.Service == "" {
+				return nil, fmt.Errorf("Event bridge rule %d: missing service", i)
+			}
+		case EventBridgeKeyChanged:
+		default:
+			return nil, fmt.Errorf("Event bridge rule %d: unsupported type '%s'", i, rule.Type)
+		}
+		if rule.Name == "" {
+			return nil, fmt.Errorf("Event bridge rule %d: missing event name", i)
+		}
+		name, err := template.New("name").Parse(rule.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Event bridge rule %d: invalid name: %v", i, err)
+		}
+		payload, err := template.New("payload").Parse(rule.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("Event bridge rule %d: invalid payload: %v", i, err)
+		}
+		out = append(out, &compiledBridgeRule{
+			EventBridgeRule: rule,
+			name:            name,
+			payload:         payload,
+			critical:        make(map[string]struct{}),
+		})
+	}
+	return out, nil
+}
+
+// eventBridge converts state store changes into user events
+type eventBridge struct {
+	rules  []*compiledBridgeRule
+	logger *log.Logger
+
+	// state returns the current state store, which may be replaced
+	// by a snapshot restore
+	state func() *StateStore
+
+	// fire is used to fire a raw serf user event
+	fire func(name string, payload []byte) error
+}
+
+// newEventBridge creates a bridge for the given rules. The current
+// state is used as the baseline, so only subsequent changes fire.
+func newEventBridge(rules []*EventBridgeRule, logger *log.Logger,
+	state func() *StateStore, fire func(string, []byte) error) (*eventBridge, error) {
+	compiled, err := compileBridgeRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	b := &eventBridge{
+		rules:  compiled,
+		logger: logger,
+		state:  state,
+		fire:   fire,
+	}
+	b.evaluate(false)
+	return b, nil
+}
+
+// run watches for changes until the stop channel is closed
+func (b *eventBridge) run(stopCh chan struct{}) {
+	notify := make(chan struct{}, 1)
+	for {
+		// Register the watches, they are cleared once they fire
+		state := b.state()
+		checkTables := state.QueryTables("CheckServiceNodes")
+		state.Watch(checkTables, notify)
+		for _, rule := range b.rules {
+			if rule.Type == EventBridgeKeyChanged {
+				state.WatchKV(rule.Prefix, notify)
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(eventBridgeInterval):
+		case <-b.nextPending():
+		case <-stopCh:
+			state.StopWatch(checkTables, notify)
+			for _, rule := range b.rules {
+				if rule.Type == EventBridgeKeyChanged {
+					state.StopWatchKV(rule.Prefix, notify)
+				}
+				b.dropPending(rule, "leadership was lost")
+			}
+			return
+		}
+		b.evaluate(true)
+		now := time.Now()
+		for _, rule := range b.rules {
+			b.firePending(rule, now)
+		}
+	}
+}
+
+// nextPending returns a channel that fires once the rate limit of a rule
+// with pending events allows it to fire again, or nil if there are none
+func (b *eventBridge) nextPending() <-chan time.Time {
+	var next time.Time
+	for _, rule := range b.rules {
+		if len(rule.pending) == 0 {
+			continue
+		}
+		if due := rule.lastFired.Add(rule.RateLimit); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return time.After(next.Sub(time.Now()))
+}
+
+// evaluate checks each rule for changes, firing events if requested
+func (b *eventBridge) evaluate(fire bool) {
+	state := b.state()
+	for _, rule := range b.rules {
+		switch rule.Type {
+		case EventBridgeServiceCritical:
+			b.evaluateService(state, rule, fire)
+		case EventBridgeKeyChanged:
+			b.evaluateKeys(state, rule, fire)
+		}
+	}
+}
+
+// evaluateService fires for each service instance that has newly
+// transitioned into a critical state
+func (b *eventBridge) evaluateService(state *StateStore, rule *compiledBridgeRule, fire bool) {
+	idx, nodes := state.CheckServiceNodes(rule.Service)
+	critical := make(map[string]struct{})
+	for _, n := range nodes {
+		isCritical := false
+		for _, check := range n.Checks {
+			if check.Status == structs.HealthCritical {
+				isCritical = true
+				break
+			}
+		}
+		if !isCritical {
+			continue
+		}
+
+		instance := n.Node.Node + "/" + n.Service.ID
+		critical[instance] = struct{}{}
+		if _, ok := rule.critical[instance]; ok || !fire {
+			continue
+		}
+		b.fireRule(rule, &eventBridgeData{
+			Node:      n.Node.Node,
+			Service:   n.Service.Service,
+			ServiceID: n.Service.ID,
+			Index:     idx,
+		})
+	}
+	rule.critical = critical
+}
+
+// evaluateKeys fires for each key under the prefix that has been
+// modified or deleted since the last evaluation
+func (b *eventBridge) evaluateKeys(state *StateStore, rule *compiledBridgeRule, fire bool) {
+	_, _, ents, err := state.KVSList(rule.Prefix)
+	if err != nil {
+		b.logger.Printf("[ERR] consul.bridge: Failed to list keys under '%s': %v", rule.Prefix, err)
+		return
+	}
+	_, tombstones, err := state.tombstoneTable.Get("id_prefix", rule.Prefix)
+	if err != nil {
+		b.logger.Printf("[ERR] consul.bridge: Failed to list tombstones under '%s': %v", rule.Prefix, err)
+		return
+	}
+
+	last := rule.lastIndex
+	var changed []*eventBridgeData
+	for _, ent := range ents {
+		if ent.ModifyIndex > rule.lastIndex {
+			rule.lastIndex = ent.ModifyIndex
+		}
+		if ent.ModifyIndex > last {
+			changed = append(changed, &eventBridgeData{
+				Key:   ent.Key,
+				Value: string(ent.Value),
+				Index: ent.ModifyIndex,
+			})
+		}
+	}
+	for _, raw := range tombstones {
+		ent := raw.(*structs.DirEntry)
+		if ent.ModifyIndex > rule.lastIndex {
+			rule.lastIndex = ent.ModifyIndex
+		}
+		if ent.ModifyIndex > last {
+			changed = append(changed, &eventBridgeData{
+				Key:     ent.Key,
+				Index:   ent.ModifyIndex,
+				Deleted: true,
+			})
+		}
+	}
+
+	if !fire {
+		return
+	}
+	for _, data := range changed {
+		b.fireRule(rule, data)
+	}
+}
+
+// fireRule queues an event of a rule, and fires the queued events the
+// rate limit of the rule allows. The oldest events are dropped if too
+// many are held back.
+func (b *eventBridge) fireRule(rule *compiledBridgeRule, data *eventBridgeData) {
+	if len(rule.pending) >= eventBridgeMaxPending {
+		dropped := rule.pending[0]
+		rule.pending[0] = nil
+		rule.pending = rule.pending[1:]
+		metrics.IncrCounter([]string{"consul", "bridge", "dropped"}, 1)
+		b.logger.Printf("[WARN] consul.bridge: Dropping event for rule '%s' at index %d, too many events are rate limited",
+			rule.Name, dropped.Index)
+	}
+	rule.pending = append(rule.pending, data)
+	b.firePending(rule, time.Now())
+	if len(rule.pending) > 0 {
+		metrics.IncrCounter([]string{"consul", "bridge", "rate_limited"}, 1)
+	}
+}
+
+// firePending fires the queued events of a rule, in order, as long as the
+// rate limit of the rule allows
+func (b *eventBridge) firePending(rule *compiledBridgeRule, now time.Time) {
+	for len(rule.pending) > 0 {
+		if rule.RateLimit > 0 && now.Sub(rule.lastFired) < rule.RateLimit {
+			return
+		}
+		data := rule.pending[0]
+		rule.pending[0] = nil
+		rule.pending = rule.pending[1:]
+		rule.lastFired = now
+		b.fireEvent(rule, data)
+	}
+}
+
+// dropPending drops the queued events of a rule, logging and counting
+// each of them
+func (b *eventBridge) dropPending(rule *compiledBridgeRule, reason string) {
+	for _, data := range rule.pending {
+		metrics.IncrCounter([]string{"consul", "bridge", "dropped"}, 1)
+		b.logger.Printf("[WARN] consul.bridge: Dropping event for rule '%s' at index %d, %s",
+			rule.Name, data.Index, reason)
+	}
+	rule.pending = nil
+}
+
+// fireEvent renders the templates of a rule and fires the event
+func (b *eventBridge) fireEvent(rule *compiledBridgeRule, data *eventBridgeData) {
+	var name, payload bytes.Buffer
+	if err := rule.name.Execute(&name, data); err != nil {
+		b.logger.Printf("[ERR] consul.bridge: Failed to render event name: %v", err)
+		return
+	}
+	if err := rule.payload.Execute(&payload, data); err != nil {
+		b.logger.Printf("[ERR] consul.bridge: Failed to render event payload: %v", err)
+		return
+	}
+
+	// Wrap the payload in the envelope used by the agents
+	event := eventBridgeUserEvent{
+		ID:      generateUUID(),
+		Name:    strings.TrimSpace(name.String()),
+		Payload: payload.Bytes(),
+		Version: eventBridgeVersion,
+	}
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, msgpackHandle).Encode(&event); err != nil {
+		b.logger.Printf("[ERR] consul.bridge: Failed to encode event: %v", err)
+		return
+	}
+
+	if err := b.fire(userEventName(event.Name), buf.Bytes()); err != nil {
+		b.logger.Printf("[ERR] consul.bridge: Failed to fire event '%s': %v", event.Name, err)
+		return
+	}
+	metrics.IncrCounter([]string{"consul", "bridge", "fired"}, 1)
+}
+
+// startEventBridge runs the event bridge while we are the leader,
+// so that each change is only fired once for the cluster.
+func (s *Server) startEventBridge(stopCh chan struct{}) {
+	if len(s.config.EventBridge) == 0 {
+		return
+	}
+	fire := func(name string, payload []byte) error {
+		return s.serfLAN.UserEvent(name, payload, false)
+	}
+	bridge, err := newEventBridge(s.config.EventBridge, s.logger, s.fsm.State, fire)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: Failed to start event bridge: %v", err)
+		return
+	}
+	go bridge.run(stopCh)
+}
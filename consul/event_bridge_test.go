@@ -0,0 +1,241 @@
+package consul
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+type bridgeEvents struct {
+	events []*eventBridgeUserEvent
+}
+
+func (b *bridgeEvents) fire(name string, payload []byte) error {
+	var event eventBridgeUserEvent
+	dec := codec.NewDecoder(bytes.NewReader(payload), msgpackHandle)
+	if err := dec.Decode(&event); err != nil {
+		return err
+	}
+	if name != userEventName(event.Name) {
+		panic("name mismatch")
+	}
+	b.events = append(b.events, &event)
+	return nil
+}
+
+func TestConfig_CheckEventBridge(t *testing.T) {
+	config := DefaultConfig()
+	config.EventBridge = []*EventBridgeRule{
+		&EventBridgeRule{Type: EventBridgeKeyChanged, Name: "deploy"},
+	}
+	if err := config.CheckEventBridge(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	bad := []*EventBridgeRule{
+		&EventBridgeRule{Type: "nope", Name: "deploy"},
+		&EventBridgeRule{Type: EventBridgeServiceCritical, Name: "down"},
+		&EventBridgeRule{Type: EventBridgeKeyChanged},
+		&EventBridgeRule{Type: EventBridgeKeyChanged, Name: "{{.Key"},
+	}
+	for _, rule := range bad {
+		config.EventBridge = []*EventBridgeRule{rule}
+		if err := config.CheckEventBridge(); err == nil {
+			t.Fatalf("should fail: %#v", rule)
+		}
+	}
+}
+
+func TestEventBridge_ServiceCritical(t *testing.T) {
+	state, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer state.Close()
+
+	reg := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{ID: "db1", Service: "db"},
+		Check: &structs.HealthCheck{
+			Node:      "foo",
+			CheckID:   "db",
+			Status:    structs.HealthCritical,
+			ServiceID: "db1",
+		},
+	}
+	if err := state.EnsureRegistration(1, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rules := []*EventBridgeRule{
+		&EventBridgeRule{
+			Type:    EventBridgeServiceCritical,
+			Service: "db",
+			Name:    "{{.Service}}-down",
+			Payload: "{{.Node}}/{{.ServiceID}}",
+		},
+	}
+	events := &bridgeEvents{}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	stateFn := func() *StateStore { return state }
+	bridge, err := newEventBridge(rules, logger, stateFn, events.fire)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Already critical instances are the baseline
+	bridge.evaluate(true)
+	if len(events.events) != 0 {
+		t.Fatalf("bad: %v", events.events)
+	}
+
+	// Recover, then fail again
+	reg.Check.Status = structs.HealthPassing
+	if err := state.EnsureRegistration(2, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bridge.evaluate(true)
+	reg.Check.Status = structs.HealthCritical
+	if err := state.EnsureRegistration(3, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bridge.evaluate(true)
+	bridge.evaluate(true)
+
+	if len(events.events) != 1 {
+		t.Fatalf("bad: %v", events.events)
+	}
+	event := events.events[0]
+	if event.Name != "db-down" || string(event.Payload) != "foo/db1" ||
+		event.Version != eventBridgeVersion || event.ID == "" {
+		t.Fatalf("bad: %#v", event)
+	}
+}
+
+func TestEventBridge_KeyChanged(t *testing.T) {
+	state, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer state.Close()
+
+	if err := state.KVSSet(1, &structs.DirEntry{Key: "deploy/web", Value: []byte("v1")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rules := []*EventBridgeRule{
+		&EventBridgeRule{
+			Type:    EventBridgeKeyChanged,
+			Prefix:  "deploy/",
+			Name:    "deploy",
+			Payload: "{{.Key}}={{.Value}} {{.Deleted}}",
+		},
+	}
+	events := &bridgeEvents{}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	stateFn := func() *StateStore { return state }
+	bridge, err := newEventBridge(rules, logger, stateFn, events.fire)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := state.KVSSet(2, &structs.DirEntry{Key: "deploy/web", Value: []byte("v2")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.KVSSet(3, &structs.DirEntry{Key: "other", Value: []byte("x")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bridge.evaluate(true)
+
+	if err := state.KVSDelete(4, "deploy/web"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bridge.evaluate(true)
+	bridge.evaluate(true)
+
+	if len(events.events) != 2 {
+		t.Fatalf("bad: %v", events.events)
+	}
+	if string(events.events[0].Payload) != "deploy/web=v2 false" {
+		t.Fatalf("bad: %s", events.events[0].Payload)
+	}
+	if string(events.events[1].Payload) != "deploy/web= true" {
+		t.Fatalf("bad: %s", events.events[1].Payload)
+	}
+}
+
+func TestEventBridge_RateLimit(t *testing.T) {
+	state, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer state.Close()
+
+	rules := []*EventBridgeRule{
+		&EventBridgeRule{
+			Type:      EventBridgeKeyChanged,
+			Prefix:    "deploy/",
+			Name:      "deploy",
+			RateLimit: 50 * time.Millisecond,
+		},
+	}
+	events := &bridgeEvents{}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	stateFn := func() *StateStore { return state }
+	bridge, err := newEventBridge(rules, logger, stateFn, events.fire)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		if err := state.KVSSet(i, &structs.DirEntry{Key: "deploy/web"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		bridge.evaluate(true)
+	}
+	if len(events.events) != 1 {
+		t.Fatalf("bad: %v", events.events)
+	}
+
+	// The events over the rate are held back, in order
+	rule := bridge.rules[0]
+	if len(rule.pending) != 2 || rule.pending[0].Index != 2 || rule.pending[1].Index != 3 {
+		t.Fatalf("bad: %v", rule.pending)
+	}
+	if bridge.nextPending() == nil {
+		t.Fatalf("should wait for the pending events")
+	}
+
+	// Each is fired once the rate allows
+	<-bridge.nextPending()
+	bridge.firePending(rule, time.Now())
+	if len(events.events) != 2 || len(rule.pending) != 1 {
+		t.Fatalf("bad: %v %v", events.events, rule.pending)
+	}
+	<-bridge.nextPending()
+	bridge.firePending(rule, time.Now())
+	if len(events.events) != 3 || len(rule.pending) != 0 {
+		t.Fatalf("bad: %v %v", events.events, rule.pending)
+	}
+	if bridge.nextPending() != nil {
+		t.Fatalf("should not wait")
+	}
+
+	// Past the maximum, the oldest events are dropped
+	for i := 0; i < eventBridgeMaxPending+2; i++ {
+		bridge.fireRule(rule, &eventBridgeData{Key: "deploy/web", Index: uint64(10 + i)})
+	}
+	if len(rule.pending) != eventBridgeMaxPending || rule.pending[0].Index != 12 {
+		t.Fatalf("bad: %d %v", len(rule.pending), rule.pending[0])
+	}
+	bridge.dropPending(rule, "test")
+	if len(rule.pending) != 0 {
+		t.Fatalf("bad: %v", rule.pending)
+	}
+}
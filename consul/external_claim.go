@@ -0,0 +1,199 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// nodeTarget stands in for the service ID of the entries that target
+	// a node rather than one of its services, such as node claims and
+	// node maintenance flags, in id indexes, which can't hold blanks.
+	// Service IDs never contain a NUL.
+	nodeTarget = "\x00"
+)
+
+// externalClaimFields returns the id index values of a claim
+func externalClaimFields(obj interface{}) ([]string, error) {
+	claim, ok := obj.(*structs.ExternalClaim)
+	if !ok {
+		return nil, fmt.Errorf("Not an external claim: %#v", obj)
+	}
+	return targetID(claim.Node, claim.ServiceID), nil
+}
+
+// targetID returns the id index values of an entry targeting a node, or
+// one of its services
+func targetID(node, serviceID string) []string {
+	if serviceID == "" {
+		serviceID = nodeTarget
+	}
+	return []string{node, serviceID}
+}
+
+// ExternalClaimAcquire is used to claim a node, or one of its services,
+// for an external health checking process. Returns false if it is
+// already claimed by another session: a node claim covers every service
+// of the node, so it conflicts with the service claims of other sessions
+// and the other way around. Acquiring a claim already held by the session
+// updates its owner.
+func (s *StateStore) ExternalClaimAcquire(index uint64, claim *structs.ExternalClaim) (bool, error) {
+	if claim.Session == "" {
+		return false, fmt.Errorf("Missing session")
+	}
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	// Verify the claimed node and service exist
+	if res, err := s.nodeTable.GetTxn(tx, "id", claim.Node); err != nil {
+		return false, err
+	} else if len(res) == 0 {
+		return false, fmt.Errorf("Missing node registration")
+	}
+	if claim.ServiceID != "" {
+		if res, err := s.serviceTable.GetTxn(tx, "id", claim.Node, claim.ServiceID); err != nil {
+			return false, err
+		} else if len(res) == 0 {
+			return false, fmt.Errorf("Missing service registration")
+		}
+	}
+
+	// Verify the session exists
+	if res, err := s.sessionTable.GetTxn(tx, "id", claim.Session); err != nil {
+		return false, err
+	} else if len(res) == 0 {
+		return false, fmt.Errorf("Invalid session")
+	}
+
+	// Bail if another session holds the claim, the claim of the node, or
+	// for a node claim, the claim of any of its services
+	res, err := s.claimTable.GetTxn(tx, "node", claim.Node)
+	if err != nil {
+		return false, err
+	}
+	var exist *structs.ExternalClaim
+	for _, r := range res {
+		other := r.(*structs.ExternalClaim)
+		if other.ServiceID == claim.ServiceID {
+			exist = other
+		} else if claim.ServiceID != "" && other.ServiceID != "" {
+			continue
+		}
+		if other.Session != claim.Session {
+			return false, nil
+		}
+	}
+
+	if exist == nil {
+		claim.CreateIndex = index
+	} else {
+		claim.CreateIndex = exist.CreateIndex
+	}
+	claim.ModifyIndex = index
+	if err := s.claimTable.InsertTxn(tx, claim); err != nil {
+		return false, err
+	}
+	if err := s.claimTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	s.notifyTables(tx, s.claimTable)
+	return true, tx.Commit()
+}
+
+// ExternalClaimRelease is used to release a claim. Returns false if the
+// claim is not held by the session of the request.
+func (s *StateStore) ExternalClaimRelease(index uint64, claim *structs.ExternalClaim) (bool, error) {
+	tx, err := s.claimTable.StartTxn(false, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	id := targetID(claim.Node, claim.ServiceID)
+	res, err := s.claimTable.GetTxn(tx, "id", id...)
+	if err != nil {
+		return false, err
+	}
+	if len(res) == 0 || res[0].(*structs.ExternalClaim).Session != claim.Session {
+		return false, nil
+	}
+	if _, err := s.claimTable.DeleteTxn(tx, "id", id...); err != nil {
+		return false, err
+	}
+	if err := s.claimTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	s.notifyTables(tx, s.claimTable)
+	return true, tx.Commit()
+}
+
+// releaseClaimsTxn deletes the claims matching an index of the claims
+// table within a given txn
+func (s *StateStore) releaseClaimsTxn(index uint64, tx *MDBTxn, idx string, parts ...string) error {
+	if n, err := s.claimTable.DeleteTxn(tx, idx, parts...); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.claimTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		s.notifyTables(tx, s.claimTable)
+	}
+	return nil
+}
+
+// ExternalClaimGet is used to get the claim of a node, or of one of its
+// services. The claim of a service is not inherited from its node.
+func (s *StateStore) ExternalClaimGet(node, serviceID string) (uint64, *structs.ExternalClaim, error) {
+	id := targetID(node, serviceID)
+	idx, res, err := s.claimTable.Get("id", id...)
+	var claim *structs.ExternalClaim
+	if len(res) > 0 {
+		claim = res[0].(*structs.ExternalClaim)
+	}
+	return idx, claim, err
+}
+
+// ExternalClaimList is used to list all the claims
+func (s *StateStore) ExternalClaimList() (uint64, structs.ExternalClaims, error) {
+	defer s.measureQuery("ExternalClaimList", time.Now())
+	idx, res, err := s.claimTable.Get("id")
+	return idx, toExternalClaims(res), err
+}
+
+// ExternalClaimListByOwner is used to list the claims of an owner
+func (s *StateStore) ExternalClaimListByOwner(owner string) (uint64, structs.ExternalClaims, error) {
+	defer s.measureQuery("ExternalClaimListByOwner", time.Now(), "owner", owner)
+	idx, res, err := s.claimTable.Get("owner", owner)
+	return idx, toExternalClaims(res), err
+}
+
+// toExternalClaims converts the rows of the claims table
+func toExternalClaims(res []interface{}) structs.ExternalClaims {
+	out := make(structs.ExternalClaims, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ExternalClaim)
+	}
+	return out
+}
+
+// ExternalClaimRestore is used to restore a claim from a snapshot
+func (s *StateStore) ExternalClaimRestore(claim *structs.ExternalClaim) error {
+	tx, err := s.claimTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.claimTable.InsertTxn(tx, claim); err != nil {
+		return err
+	}
+	if err := s.claimTable.SetMaxLastIndexTxn(tx, claim.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
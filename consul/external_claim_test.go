@@ -0,0 +1,137 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_ExternalClaims(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i, id := range []string{"db", "web"} {
+		if err := store.EnsureService(uint64(2+i), "foo", &structs.NodeService{ID: id, Service: id}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	s1 := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(4, s1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s2 := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(5, s2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Claims need a session, and a registered node and service
+	if _, err := store.ExternalClaimAcquire(6, &structs.ExternalClaim{Node: "foo"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, err := store.ExternalClaimAcquire(6, &structs.ExternalClaim{Node: "bar", Session: s1.ID}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, err := store.ExternalClaimAcquire(6, &structs.ExternalClaim{Node: "foo", ServiceID: "nope", Session: s1.ID}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Claim a service, and re-acquire it with a new owner
+	ok, err := store.ExternalClaimAcquire(6, &structs.ExternalClaim{Node: "foo", ServiceID: "db", Owner: "esm1", Session: s1.ID})
+	if err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	ok, err = store.ExternalClaimAcquire(7, &structs.ExternalClaim{Node: "foo", ServiceID: "db", Owner: "esm2", Session: s1.ID})
+	if err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	idx, claim, err := store.ExternalClaimGet("foo", "db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 7 || claim == nil || claim.Owner != "esm2" || claim.CreateIndex != 6 || claim.ModifyIndex != 7 {
+		t.Fatalf("bad: %d %v", idx, claim)
+	}
+
+	// Another session may claim another service, but not the same one,
+	// nor the node
+	ok, err = store.ExternalClaimAcquire(8, &structs.ExternalClaim{Node: "foo", ServiceID: "db", Session: s2.ID})
+	if err != nil || ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	ok, err = store.ExternalClaimAcquire(8, &structs.ExternalClaim{Node: "foo", Session: s2.ID})
+	if err != nil || ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	ok, err = store.ExternalClaimAcquire(8, &structs.ExternalClaim{Node: "foo", ServiceID: "web", Owner: "esm3", Session: s2.ID})
+	if err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	_, claims, err := store.ExternalClaimListByOwner("esm3")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(claims) != 1 || claims[0].ServiceID != "web" {
+		t.Fatalf("bad: %v", claims)
+	}
+
+	// Only the holder may release a claim
+	ok, err = store.ExternalClaimRelease(9, &structs.ExternalClaim{Node: "foo", ServiceID: "db", Session: s2.ID})
+	if err != nil || ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	ok, err = store.ExternalClaimRelease(9, &structs.ExternalClaim{Node: "foo", ServiceID: "db", Session: s1.ID})
+	if err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+
+	// Invalidating the session releases its claims
+	if err := store.SessionDestroy(10, s2.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, claims, err = store.ExternalClaimList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 10 || len(claims) != 0 {
+		t.Fatalf("bad: %d %v", idx, claims)
+	}
+
+	// The node can now be claimed, and deregistering a service only
+	// releases the claim of the service
+	ok, err = store.ExternalClaimAcquire(11, &structs.ExternalClaim{Node: "foo", Session: s1.ID})
+	if err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	ok, err = store.ExternalClaimAcquire(12, &structs.ExternalClaim{Node: "foo", ServiceID: "web", Session: s1.ID})
+	if err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	if err := store.DeleteNodeService(13, "foo", "web"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, claims, err = store.ExternalClaimList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(claims) != 1 || claims[0].ServiceID != "" {
+		t.Fatalf("bad: %v", claims)
+	}
+
+	// Deleting the node releases its claims
+	if err := store.DeleteNode(14, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, claims, err = store.ExternalClaimList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 14 || len(claims) != 0 {
+		t.Fatalf("bad: %d %v", idx, claims)
+	}
+}
@@ -1,11 +1,15 @@
 package consul
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-metrics"
@@ -26,6 +30,46 @@ type consulFSM struct {
 	path      string
 	state     *StateStore
 	gc        *TombstoneGC
+
+	// events logs the restore milestones. stateLogger, if set, replaces
+	// the logger of the state store, and is re-applied when the state is
+	// restored.
+	events      StateLogger
+	stateLogger StateLogger
+
+	// kvsHistoryGC is applied to the state store, and re-applied when
+	// the state is restored.
+	kvsHistoryGC *TombstoneGC
+
+	// queryCacheSize is applied to the state store, and re-applied when
+	// the state is restored
+	queryCacheSize int
+
+	// kvsNotifyLimits are applied to the state store, and re-applied
+	// when the state is restored
+	kvsNotifyLimits map[string]time.Duration
+
+	// stateMaxSize is the maximum size of the state store, re-applied
+	// when the state is restored
+	stateMaxSize uint64
+
+	// queryLog is shared by the state stores, so slow queries are
+	// retained across a restore
+	queryLog *slowQueryLog
+
+	// hooks are shared by the state stores, so registered hooks are
+	// retained across a restore
+	hooks *stateHooks
+
+	// appliedIndex is the index of the last applied entry, and must be
+	// accessed atomically. appliedNotify is notified on every apply.
+	appliedIndex  uint64
+	appliedNotify NotifyGroup
+
+	// restoreChunks are the chunks of the snapshot restore being
+	// applied. They are persisted in the snapshots of the FSM, so a
+	// server restoring one mid-restore can still complete it.
+	restoreChunks []*structs.SnapshotRestore
 }
 
 // consulSnapshot is used to provide a snapshot of the current
@@ -33,17 +77,83 @@ type consulFSM struct {
 // that may modify the live state.
 type consulSnapshot struct {
 	state *StateSnapshot
+
+	// restoreChunks are the chunks of the pending snapshot restore
+	restoreChunks []*structs.SnapshotRestore
+
+	// redactor masks the secrets of the records, if set
+	redactor *snapshotRedactor
 }
 
+// snapshotStreamBuffer is the number of rows of a table that are
+// buffered while persisting a snapshot
+const snapshotStreamBuffer = 256
+
+// snapshotRestoreChunks names the chunks of a pending snapshot restore
+// in the record counts and checksums of a snapshot
+const snapshotRestoreChunks = "snapshot_restore"
+
 // snapshotHeader is the first entry in our snapshot
 type snapshotHeader struct {
 	// LastIndex is the last index that affects the data.
 	// This is used when we do the restore for watchers.
 	LastIndex uint64
+
+	// Counts is the number of records of each table in the snapshot,
+	// keyed by table name. It is used to detect a truncated snapshot,
+	// and is missing from snapshots taken by older versions.
+	Counts map[string]uint64
+
+	// SchemaVersion is the layout of the records, used to migrate the
+	// records of older snapshots. It is 0 for snapshots taken by older
+	// versions.
+	SchemaVersion int
+}
+
+// snapshotChecksum follows the records of each table in a snapshot. It
+// is the sha256 of the records, so a corrupted table is detected before
+// the restore continues. The "catalog" table covers the nodes, services
+// and checks, which are persisted together.
+type snapshotChecksum struct {
+	Table  string
+	SHA256 []byte
+}
+
+// snapshotWriter hashes the records written to a snapshot until the
+// checksum of the table is written
+type snapshotWriter struct {
+	sink raft.SnapshotSink
+	hash hash.Hash
+}
+
+func (w *snapshotWriter) Write(p []byte) (int, error) {
+	w.hash.Write(p)
+	return w.sink.Write(p)
+}
+
+// writeChecksum writes the checksum of the records since the previous
+// checksum, which are the records of the given table
+func (w *snapshotWriter) writeChecksum(table string) error {
+	sum := snapshotChecksum{
+		Table:  table,
+		SHA256: w.hash.Sum(nil),
+	}
+	w.hash.Reset()
+	if _, err := w.sink.Write([]byte{byte(structs.SnapshotChecksumType)}); err != nil {
+		return err
+	}
+	return codec.NewEncoder(w.sink, msgpackHandle).Encode(&sum)
 }
 
 // NewFSMPath is used to construct a new FSM with a blank state
 func NewFSM(gc *TombstoneGC, path string, logOutput io.Writer) (*consulFSM, error) {
+	return newFSMIndexes(gc, path, logOutput, nil)
+}
+
+// newFSMIndexes is like NewFSM, but adds the given indexes to the state
+// store. The indexes are added again when the state is restored.
+func newFSMIndexes(gc *TombstoneGC, path string, logOutput io.Writer,
+	indexes []*StateIndex) (*consulFSM, error) {
 	// Create a temporary path for the state store
 	tmpPath, err := ioutil.TempDir(path, "state")
 	if err != nil {
@@ -51,7 +161,7 @@ func NewFSM(gc *TombstoneGC, path string, logOutput io.Writer) (*consulFSM, erro
 	}
 
 	// Create a state store
-	state, err := NewStateStorePath(gc, tmpPath, logOutput)
+	state, err := NewStateStoreIndexes(gc, tmpPath, logOutput, indexes)
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +172,11 @@ func NewFSM(gc *TombstoneGC, path string, logOutput io.Writer) (*consulFSM, erro
 		path:      path,
 		state:     state,
 		gc:        gc,
+		events:    NewStdStateLogger(logOutput, "consul.fsm"),
+		queryLog:  newSlowQueryLog(slowQueryLogSize),
+		hooks:     state.hooks,
 	}
+	state.setSlowQueryLog(fsm.queryLog)
 	return fsm, nil
 }
 
@@ -71,12 +185,84 @@ func (c *consulFSM) Close() error {
 	return c.state.Close()
 }
 
+// SetKVSHistoryGC sets the GC hinted with the versions recorded in the
+// KV history of the state store. It survives a restore from a snapshot.
+func (c *consulFSM) SetKVSHistoryGC(gc *TombstoneGC) {
+	c.kvsHistoryGC = gc
+	c.state.SetKVSHistoryGC(gc)
+}
+
+// SetQueryCacheSize sets the number of query results cached by the
+// state store. Zero disables the cache.
+func (c *consulFSM) SetQueryCacheSize(size int) {
+	c.queryCacheSize = size
+	c.state.SetQueryCache(size)
+}
+
+// SetKVSNotifyLimits rate limits the notifications of the KV watches
+// under some prefixes. The limits survive a restore from a snapshot.
+func (c *consulFSM) SetKVSNotifyLimits(limits map[string]time.Duration) {
+	c.kvsNotifyLimits = limits
+	c.state.SetKVSNotifyLimits(limits)
+}
+
+// SetLogger routes the events of the state store and the restore
+// milestones to a logger. The logger survives a restore from a snapshot.
+func (c *consulFSM) SetLogger(logger StateLogger) {
+	c.events = logger
+	c.stateLogger = logger
+	c.state.SetLogger(logger)
+}
+
+// SetStateMaxSize sets the maximum size of the state store. The size
+// survives a restore from a snapshot.
+func (c *consulFSM) SetStateMaxSize(size uint64) error {
+	c.stateMaxSize = size
+	return c.state.SetMaxSize(size)
+}
+
+// SetSlowQueryThreshold sets the duration after which a state store
+// query is logged as slow. A zero threshold disables the log.
+func (c *consulFSM) SetSlowQueryThreshold(threshold time.Duration) {
+	c.queryLog.SetThreshold(threshold)
+}
+
 // State is used to return a handle to the current state
 func (c *consulFSM) State() *StateStore {
 	return c.state
 }
 
+// AppliedIndex returns the index of the last applied entry
+func (c *consulFSM) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&c.appliedIndex)
+}
+
+// setAppliedIndex updates the applied index and wakes any waiters
+func (c *consulFSM) setAppliedIndex(index uint64) {
+	atomic.StoreUint64(&c.appliedIndex, index)
+	c.appliedNotify.Notify()
+}
+
+// WaitForIndex blocks until an entry at or after the index has been
+// applied, returning false if the timeout fires first
+func (c *consulFSM) WaitForIndex(index uint64, timeout <-chan time.Time) bool {
+	for {
+		ch := c.appliedNotify.WaitCh()
+		if c.AppliedIndex() >= index {
+			c.appliedNotify.Clear(ch)
+			return true
+		}
+		select {
+		case <-ch:
+		case <-timeout:
+			c.appliedNotify.Clear(ch)
+			return false
+		}
+	}
+}
+
 func (c *consulFSM) Apply(log *raft.Log) interface{} {
+	defer c.setAppliedIndex(log.Index)
 	buf := log.Data
 	msgType := structs.MessageType(buf[0])
 
@@ -88,6 +274,7 @@ func (c *consulFSM) Apply(log *raft.Log) interface{} {
 		msgType &= ^structs.IgnoreUnknownTypeFlag
 		ignoreUnknown = true
 	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "apply", messageTypeName(msgType)}, time.Now())
 
 	switch msgType {
 	case structs.RegisterRequestType:
@@ -102,6 +289,40 @@ func (c *consulFSM) Apply(log *raft.Log) interface{} {
 		return c.applyACLOperation(buf[1:], log.Index)
 	case structs.TombstoneRequestType:
 		return c.applyTombstoneOperation(buf[1:], log.Index)
+	case structs.CatalogPatchRequestType:
+		return c.applyCatalogPatch(buf[1:], log.Index)
+	case structs.LockDelayRequestType:
+		return c.applyLockDelayOperation(buf[1:], log.Index)
+	case structs.OutboxRequestType:
+		return c.applyOutboxOperation(buf[1:], log.Index)
+	case structs.ServerHealthRequestType:
+		return c.applyServerHealthOperation(buf[1:], log.Index)
+	case structs.ExternalClaimRequestType:
+		return c.applyExternalClaimOperation(buf[1:], log.Index)
+	case structs.MaintenanceRequestType:
+		return c.applyMaintenanceOperation(buf[1:], log.Index)
+	case structs.SnapshotRestoreRequestType:
+		return c.applySnapshotRestore(buf[1:], log.Index)
+	case structs.AutopilotRequestType:
+		return c.applyAutopilotOperation(buf[1:], log.Index)
+	case structs.TxnRequestType:
+		return c.applyTxn(buf[1:], log.Index)
+	case structs.AutoEncryptRequestType:
+		return c.applyAutoEncryptOperation(buf[1:], log.Index)
+	case structs.AreaRequestType:
+		return c.applyAreaOperation(buf[1:], log.Index)
+	case structs.PeeringRequestType:
+		return c.applyPeeringOperation(buf[1:], log.Index)
+	case structs.ExportedServicesRequestType:
+		return c.applyExportedServices(buf[1:], log.Index)
+	case structs.ImportedServicesRequestType:
+		return c.applyImportedServices(buf[1:], log.Index)
+	case structs.KVSHistoryRequestType:
+		return c.applyKVSHistoryOperation(buf[1:], log.Index)
+	case structs.RetentionRequestType:
+		return c.applyRetention(buf[1:], log.Index)
+	case structs.CatalogAuditTrimRequestType:
+		return c.applyCatalogAuditTrim(buf[1:], log.Index)
 	default:
 		if ignoreUnknown {
 			c.logger.Printf("[WARN] consul.fsm: ignoring unknown message type (%d), upgrade to newer version", msgType)
@@ -122,11 +343,20 @@ func (c *consulFSM) decodeRegister(buf []byte, index uint64) interface{} {
 
 func (c *consulFSM) applyRegister(req *structs.RegisterRequest, index uint64) interface{} {
 	defer metrics.MeasureSince([]string{"consul", "fsm", "register"}, time.Now())
+	scope := registerAuditScope(req)
+	before := c.auditSummary(scope)
+
 	// Apply all updates in a single transaction
-	if err := c.state.EnsureRegistration(index, req); err != nil {
+	if req.CAS {
+		if err := c.state.EnsureRegistrationCAS(index, req); err != nil {
+			c.logger.Printf("[INFO] consul.fsm: EnsureRegistrationCAS failed: %v", err)
+			return err
+		}
+	} else if err := c.state.EnsureRegistration(index, req); err != nil {
 		c.logger.Printf("[INFO] consul.fsm: EnsureRegistration failed: %v", err)
 		return err
 	}
+	c.recordCatalogAudit(index, catalogAuditRegister, req.Token, &req.Audit, scope, before)
 	return nil
 }
 
@@ -137,8 +367,16 @@ func (c *consulFSM) applyDeregister(buf []byte, index uint64) interface{} {
 		panic(fmt.Errorf("failed to decode request: %v", err))
 	}
 
+	scope := deregisterAuditScope(&req)
+	before := c.auditSummary(scope)
+
 	// Either remove the service entry or the whole node
-	if req.ServiceID != "" {
+	if req.CAS {
+		if err := c.state.DeleteRegistrationCAS(index, &req); err != nil {
+			c.logger.Printf("[INFO] consul.fsm: DeleteRegistrationCAS failed: %v", err)
+			return err
+		}
+	} else if req.ServiceID != "" {
 		if err := c.state.DeleteNodeService(index, req.Node, req.ServiceID); err != nil {
 			c.logger.Printf("[INFO] consul.fsm: DeleteNodeService failed: %v", err)
 			return err
@@ -154,6 +392,21 @@ func (c *consulFSM) applyDeregister(buf []byte, index uint64) interface{} {
 			return err
 		}
 	}
+	c.recordCatalogAudit(index, catalogAuditDeregister, req.Token, &req.Audit, scope, before)
+	return nil
+}
+
+func (c *consulFSM) applyCatalogPatch(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "patch"}, time.Now())
+	var req structs.CatalogPatchRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	if err := c.state.CatalogPatch(index, &req); err != nil {
+		c.logger.Printf("[INFO] consul.fsm: CatalogPatch failed: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -213,7 +466,7 @@ func (c *consulFSM) applySessionOperation(buf []byte, index uint64) interface{}
 	defer metrics.MeasureSince([]string{"consul", "fsm", "session", string(req.Op)}, time.Now())
 	switch req.Op {
 	case structs.SessionCreate:
-		if err := c.state.SessionCreate(index, &req.Session); err != nil {
+		if err := c.state.SessionCreateWithLimit(index, &req.Session, req.SessionLimit); err != nil {
 			return err
 		} else {
 			return req.Session.ID
@@ -247,6 +500,208 @@ func (c *consulFSM) applyACLOperation(buf []byte, index uint64) interface{} {
 	}
 }
 
+func (c *consulFSM) applyLockDelayOperation(buf []byte, index uint64) interface{} {
+	var req structs.LockDelayRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "lock_delay", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.LockDelayExpire:
+		return c.state.LockDelayExpire(index, req.Key, req.Session)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid LockDelay operation '%s'", req.Op)
+		return fmt.Errorf("Invalid LockDelay operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyOutboxOperation(buf []byte, index uint64) interface{} {
+	var req structs.OutboxRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "outbox", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.OutboxSubscribe:
+		return c.state.OutboxSubscribe(index, &req.Subscription)
+	case structs.OutboxUnsubscribe:
+		return c.state.OutboxUnsubscribe(index, req.Subscription.Name)
+	case structs.OutboxAck:
+		return c.state.OutboxAck(index, req.Subscription.Name, req.Acks)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid Outbox operation '%s'", req.Op)
+		return fmt.Errorf("Invalid Outbox operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyServerHealthOperation(buf []byte, index uint64) interface{} {
+	var req structs.ServerHealthRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "server_health", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.ServerHealthSet:
+		return c.state.ServerHealthSet(index, &req.Health)
+	case structs.ServerHealthDelete:
+		return c.state.ServerHealthDelete(index, req.Health.Name)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid ServerHealth operation '%s'", req.Op)
+		return fmt.Errorf("Invalid ServerHealth operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyExternalClaimOperation(buf []byte, index uint64) interface{} {
+	var req structs.ExternalClaimRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "external_claim", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.ExternalClaimAcquire:
+		act, err := c.state.ExternalClaimAcquire(index, &req.Claim)
+		if err != nil {
+			return err
+		}
+		return act
+	case structs.ExternalClaimRelease:
+		act, err := c.state.ExternalClaimRelease(index, &req.Claim)
+		if err != nil {
+			return err
+		}
+		return act
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid ExternalClaim operation '%s'", req.Op)
+		return fmt.Errorf("Invalid ExternalClaim operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyMaintenanceOperation(buf []byte, index uint64) interface{} {
+	var req structs.MaintenanceRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "maintenance", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.MaintenanceEnable:
+		if err := c.state.MaintenanceEnable(index, &req.Maintenance); err != nil {
+			return err
+		}
+		return true
+	case structs.MaintenanceDisable:
+		act, err := c.state.MaintenanceDisable(index, &req.Maintenance)
+		if err != nil {
+			return err
+		}
+		return act
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid Maintenance operation '%s'", req.Op)
+		return fmt.Errorf("Invalid Maintenance operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyAutopilotOperation(buf []byte, index uint64) interface{} {
+	var req structs.AutopilotSetConfigRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "autopilot"}, time.Now())
+	act, err := c.state.AutopilotSetConfig(index, &req.Config, req.CAS)
+	if err != nil {
+		return err
+	}
+	return act
+}
+
+func (c *consulFSM) applyTxn(buf []byte, index uint64) interface{} {
+	var req structs.TxnRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "txn"}, time.Now())
+	results, errs := c.state.TxnRW(index, req.Ops)
+	return structs.TxnResponse{Results: results, Errors: errs}
+}
+
+func (c *consulFSM) applyAutoEncryptOperation(buf []byte, index uint64) interface{} {
+	var req structs.AutoEncryptTokenRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "auto_encrypt", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.AutoEncryptTokenCreate:
+		return c.state.AutoEncryptTokenCreate(index, &req.Token, req.Now)
+	case structs.AutoEncryptTokenConsume:
+		ok, err := c.state.AutoEncryptTokenConsume(index, req.Token.Hash, req.Token.Node, req.Now)
+		if err != nil {
+			return err
+		}
+		return ok
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid AutoEncrypt operation '%s'", req.Op)
+		return fmt.Errorf("Invalid AutoEncrypt operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyAreaOperation(buf []byte, index uint64) interface{} {
+	var req structs.AreaRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "area", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.AreaUpsert:
+		if err := c.state.AreaSet(index, &req.Area); err != nil {
+			return err
+		}
+		return req.Area.ID
+	case structs.AreaDelete:
+		return c.state.AreaDelete(index, req.Area.ID)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid Area operation '%s'", req.Op)
+		return fmt.Errorf("Invalid Area operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyPeeringOperation(buf []byte, index uint64) interface{} {
+	var req structs.PeeringRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "peering", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.PeeringUpsert:
+		if err := c.state.PeeringSet(index, &req.Peering); err != nil {
+			return err
+		}
+		return req.Peering.ID
+	case structs.PeeringDelete:
+		return c.state.PeeringDelete(index, req.Peering.Name)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid Peering operation '%s'", req.Op)
+		return fmt.Errorf("Invalid Peering operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyExportedServices(buf []byte, index uint64) interface{} {
+	var req structs.ExportedServicesRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "exported_services"}, time.Now())
+	return c.state.ExportedServicesSet(index, &req.Config)
+}
+
+func (c *consulFSM) applyImportedServices(buf []byte, index uint64) interface{} {
+	var req structs.ImportedServicesRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "imported_services"}, time.Now())
+	return c.state.ImportedServicesReplace(index, req.Peer, req.Services)
+}
+
 func (c *consulFSM) applyTombstoneOperation(buf []byte, index uint64) interface{} {
 	var req structs.TombstoneRequest
 	if err := structs.Decode(buf, &req); err != nil {
@@ -262,6 +717,88 @@ func (c *consulFSM) applyTombstoneOperation(buf []byte, index uint64) interface{
 	}
 }
 
+func (c *consulFSM) applyKVSHistoryOperation(buf []byte, index uint64) interface{} {
+	var req structs.KVSHistoryRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "kvs_history", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.KVSHistoryReap:
+		return c.state.KVSHistoryReap(req.ReapIndex)
+	default:
+		c.logger.Printf("[WARN] consul.fsm: Invalid KV history operation '%s'", req.Op)
+		return fmt.Errorf("Invalid KV history operation '%s'", req.Op)
+	}
+}
+
+func (c *consulFSM) applyRetention(buf []byte, index uint64) interface{} {
+	var req structs.RetentionRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "retention"}, time.Now())
+	return c.state.RetentionSet(index, &req.Config)
+}
+
+func (c *consulFSM) applyCatalogAuditTrim(buf []byte, index uint64) interface{} {
+	var req structs.CatalogAuditTrimRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "catalog_audit_trim"}, time.Now())
+	return c.state.CatalogAuditTrim(index, req.TrimIndex)
+}
+
+// applySnapshotRestore replaces the state with the state of a snapshot
+// archive, once its last chunk is applied. A snapshot that fails to
+// restore leaves the state unchanged.
+func (c *consulFSM) applySnapshotRestore(buf []byte, index uint64) interface{} {
+	req := new(structs.SnapshotRestore)
+	if err := structs.Decode(buf, req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	// The first chunk of a restore drops the chunks of any restore that
+	// was interrupted, such as by a leader election
+	if req.Seq == 0 {
+		c.restoreChunks = nil
+	} else if n := len(c.restoreChunks); n == 0 || c.restoreChunks[0].ID != req.ID || n != req.Seq {
+		c.restoreChunks = nil
+		return fmt.Errorf("Snapshot restore chunk %d of %s is out of order", req.Seq, req.ID)
+	}
+	c.restoreChunks = append(c.restoreChunks, req)
+	if req.More {
+		return nil
+	}
+	chunks := c.restoreChunks
+	c.restoreChunks = nil
+
+	var size int64
+	readers := make([]io.Reader, len(chunks))
+	for i, chunk := range chunks {
+		readers[i] = bytes.NewReader(chunk.State)
+		size += int64(len(chunk.State))
+	}
+	if size != req.Meta.Size {
+		return fmt.Errorf("Snapshot restore is %d bytes, expected %d", size, req.Meta.Size)
+	}
+	c.logger.Printf("[WARN] consul.fsm: restoring snapshot of %s taken at index %d",
+		req.Meta.Datacenter, req.Meta.Index)
+	if err := c.Restore(ioutil.NopCloser(io.MultiReader(readers...))); err != nil {
+		c.logger.Printf("[ERR] consul.fsm: failed to restore snapshot: %v", err)
+		return err
+	}
+
+	// The tables are at the indexes of the snapshot, behind the entries
+	// already applied, so the blocking queries would not see the change
+	if err := c.state.RaiseIndexes(index); err != nil {
+		c.logger.Printf("[ERR] consul.fsm: failed to raise the restored indexes: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (c *consulFSM) Snapshot() (raft.FSMSnapshot, error) {
 	defer func(start time.Time) {
 		c.logger.Printf("[INFO] consul.fsm: snapshot created in %v", time.Now().Sub(start))
@@ -272,11 +809,12 @@ func (c *consulFSM) Snapshot() (raft.FSMSnapshot, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &consulSnapshot{snap}, nil
+	return &consulSnapshot{state: snap, restoreChunks: c.restoreChunks}, nil
 }
 
 func (c *consulFSM) Restore(old io.ReadCloser) error {
 	defer old.Close()
+	start := time.Now()
 
 	// Create a temporary path for the state store
 	tmpPath, err := ioutil.TempDir(c.path, "state")
@@ -284,24 +822,63 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 		return err
 	}
 
-	// Create a new state store
-	state, err := NewStateStorePath(c.gc, tmpPath, c.logOutput)
+	// Create a new state store, with the same indexes
+	state, err := NewStateStoreIndexes(c.gc, tmpPath, c.logOutput, c.state.indexes)
 	if err != nil {
 		return err
 	}
-	c.state.Close()
+	if err := state.SetMaxSize(c.stateMaxSize); err != nil {
+		state.Close()
+		return err
+	}
+	if c.stateLogger != nil {
+		state.SetLogger(c.stateLogger)
+	}
+	state.SetKVSHistoryGC(c.kvsHistoryGC)
+	state.SetQueryCache(c.queryCacheSize)
+	state.SetKVSNotifyLimits(c.kvsNotifyLimits)
+	state.setSlowQueryLog(c.queryLog)
+
+	// Keep the previous state until the restore succeeds, so a bad
+	// snapshot doesn't leave a partial state behind
+	prev := c.state
 	c.state = state
+	if err := c.restoreState(state, old, start); err != nil {
+		c.state = prev
+		state.Close()
+		return err
+	}
+	prev.Close()
+	return nil
+}
 
-	// Create a decoder
-	dec := codec.NewDecoder(old, msgpackHandle)
+// restoreState populates a new state from the records of a snapshot
+func (c *consulFSM) restoreState(state *StateStore, old io.Reader, start time.Time) error {
+	// Create a decoder. The records are hashed as they are decoded,
+	// so they can be verified against the checksum of each table.
+	recordHash := sha256.New()
+	dec := codec.NewDecoder(io.TeeReader(old, recordHash), msgpackHandle)
+	checksumDec := codec.NewDecoder(old, msgpackHandle)
 
 	// Read in the header
 	var header snapshotHeader
 	if err := dec.Decode(&header); err != nil {
 		return err
 	}
+	recordHash.Reset()
+	c.events.Info("Restoring snapshot", "index", header.LastIndex,
+		"schema", header.SchemaVersion)
+
+	// Records of older schema versions are migrated as they are decoded
+	records, err := newRecordDecoder(dec, header.SchemaVersion, schemaVersion, schemaMigrations)
+	if err != nil {
+		return err
+	}
 
 	// Populate the new state
+	var restored, unverified uint64
+	var restoreChunks []*structs.SnapshotRestore
+	verified := false
 	msgType := make([]byte, 1)
 	for {
 		// Read the message type
@@ -312,18 +889,38 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 			return err
 		}
 
+		// Verify the records of the table that was just restored
+		if structs.MessageType(msgType[0]) == structs.SnapshotChecksumType {
+			var sum snapshotChecksum
+			if err := checksumDec.Decode(&sum); err != nil {
+				return err
+			}
+			if !bytes.Equal(recordHash.Sum(nil), sum.SHA256) {
+				return fmt.Errorf("Snapshot checksum mismatch for table '%s'", sum.Table)
+			}
+			recordHash.Reset()
+			c.events.Debug("Verified snapshot table", "table", sum.Table)
+			verified = true
+			unverified = 0
+			continue
+		}
+		recordHash.Write(msgType)
+		restored++
+		unverified++
+
 		// Decode
-		switch structs.MessageType(msgType[0]) {
+		t := structs.MessageType(msgType[0])
+		switch t {
 		case structs.RegisterRequestType:
 			var req structs.RegisterRequest
-			if err := dec.Decode(&req); err != nil {
+			if err := records.Decode(t, &req); err != nil {
 				return err
 			}
 			c.applyRegister(&req, header.LastIndex)
 
 		case structs.KVSRequestType:
 			var req structs.DirEntry
-			if err := dec.Decode(&req); err != nil {
+			if err := records.Decode(t, &req); err != nil {
 				return err
 			}
 			if err := c.state.KVSRestore(&req); err != nil {
@@ -332,7 +929,7 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 
 		case structs.SessionRequestType:
 			var req structs.Session
-			if err := dec.Decode(&req); err != nil {
+			if err := records.Decode(t, &req); err != nil {
 				return err
 			}
 			if err := c.state.SessionRestore(&req); err != nil {
@@ -341,7 +938,7 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 
 		case structs.ACLRequestType:
 			var req structs.ACL
-			if err := dec.Decode(&req); err != nil {
+			if err := records.Decode(t, &req); err != nil {
 				return err
 			}
 			if err := c.state.ACLRestore(&req); err != nil {
@@ -350,189 +947,449 @@ func (c *consulFSM) Restore(old io.ReadCloser) error {
 
 		case structs.TombstoneRequestType:
 			var req structs.DirEntry
-			if err := dec.Decode(&req); err != nil {
+			if err := records.Decode(t, &req); err != nil {
 				return err
 			}
 			if err := c.state.TombstoneRestore(&req); err != nil {
 				return err
 			}
 
+		case structs.LockDelayRequestType:
+			var req structs.LockDelay
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.LockDelayRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.OutboxRequestType:
+			var req structs.OutboxSubscription
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.OutboxSubscriptionRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.OutboxEntryType:
+			var req structs.OutboxEntry
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.OutboxEntryRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.ServerHealthRequestType:
+			var req structs.ServerHealth
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.ServerHealthRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.CatalogAuditType:
+			var req structs.CatalogAudit
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.CatalogAuditRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.ExternalClaimRequestType:
+			var req structs.ExternalClaim
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.ExternalClaimRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.MaintenanceRequestType:
+			var req structs.Maintenance
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.MaintenanceRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.AutopilotRequestType:
+			var req structs.AutopilotConfig
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.AutopilotRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.AutoEncryptRequestType:
+			var req structs.AutoEncryptToken
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.AutoEncryptTokenRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.AreaRequestType:
+			var req structs.Area
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.AreaRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.PeeringRequestType:
+			var req structs.Peering
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.PeeringRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.ExportedServicesRequestType:
+			var req structs.ExportedServicesConfig
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.ExportedServicesRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.ImportedServicesRequestType:
+			var req structs.ImportedService
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.ImportedServiceRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.KVSHistoryRequestType:
+			var req kvsVersion
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.KVSHistoryRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.RetentionRequestType:
+			var req structs.RetentionConfig
+			if err := records.Decode(t, &req); err != nil {
+				return err
+			}
+			if err := c.state.RetentionRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.SnapshotRestoreRequestType:
+			req := new(structs.SnapshotRestore)
+			if err := records.Decode(t, req); err != nil {
+				return err
+			}
+			restoreChunks = append(restoreChunks, req)
+
 		default:
 			return fmt.Errorf("Unrecognized msg type: %v", msgType)
 		}
 	}
 
+	// Verify every record was restored
+	if verified && unverified > 0 {
+		return fmt.Errorf("Snapshot is missing the checksum for %d records", unverified)
+	}
+	if header.Counts != nil {
+		var expected uint64
+		for _, count := range header.Counts {
+			expected += count
+		}
+		if restored != expected {
+			return fmt.Errorf("Snapshot is truncated, restored %d of %d records",
+				restored, expected)
+		}
+	}
+
+	// Hooks are only attached once the state is restored, along with
+	// the chunks of the snapshot restore that was pending
+	state.setStateHooks(c.hooks)
+	c.restoreChunks = restoreChunks
+	c.setAppliedIndex(header.LastIndex)
+	c.events.Info("Restored snapshot", "index", header.LastIndex, "records", restored,
+		"duration", time.Now().Sub(start))
 	return nil
 }
 
 func (s *consulSnapshot) Persist(sink raft.SnapshotSink) error {
 	defer metrics.MeasureSince([]string{"consul", "fsm", "persist"}, time.Now())
 	// Register the nodes
-	encoder := codec.NewEncoder(sink, msgpackHandle)
+	w := &snapshotWriter{sink: sink, hash: sha256.New()}
+	encoder := codec.NewEncoder(w, msgpackHandle)
 
-	// Write the header
-	header := snapshotHeader{
-		LastIndex: s.state.LastIndex(),
-	}
-	if err := encoder.Encode(&header); err != nil {
+	// Count the records so a truncated snapshot can be detected
+	counts, err := s.state.RecordCounts()
+	if err != nil {
 		sink.Cancel()
 		return err
 	}
-
-	if err := s.persistNodes(sink, encoder); err != nil {
-		sink.Cancel()
-		return err
+	if len(s.restoreChunks) > 0 {
+		counts[snapshotRestoreChunks] = uint64(len(s.restoreChunks))
 	}
 
-	if err := s.persistSessions(sink, encoder); err != nil {
-		sink.Cancel()
-		return err
+	// Write the header
+	header := snapshotHeader{
+		LastIndex:     s.state.LastIndex(),
+		Counts:        counts,
+		SchemaVersion: schemaVersion,
 	}
-
-	if err := s.persistACLs(sink, encoder); err != nil {
+	if err := encoder.Encode(&header); err != nil {
 		sink.Cancel()
 		return err
 	}
+	w.hash.Reset()
 
-	if err := s.persistKV(sink, encoder); err != nil {
-		sink.Cancel()
-		return err
+	// Persist each table followed by its checksum
+	tables := []struct {
+		name    string
+		persist func(io.Writer, *codec.Encoder) error
+	}{
+		{"catalog", s.persistNodes},
+		{dbSessions, s.persistSessions},
+		{dbACLs, s.persistACLs},
+		{dbKVS, s.persistKV},
+		{dbKVSHistory, s.persistKVSHistory},
+		{dbTombstone, s.persistTombstones},
+		{dbLockDelays, s.persistLockDelays},
+		{dbOutboxSubs, s.persistOutboxSubscriptions},
+		{dbOutbox, s.persistOutbox},
+		{dbServerHealth, s.persistServerHealth},
+		{dbCatalogAudit, s.persistCatalogAudit},
+		{dbExternalClaims, s.persistExternalClaims},
+		{dbMaintenance, s.persistMaintenance},
+		{dbAutopilot, s.persistAutopilot},
+		{dbAutoEncrypt, s.persistAutoEncryptTokens},
+		{dbAreas, s.persistAreas},
+		{dbPeerings, s.persistPeerings},
+		{dbExported, s.persistExportedServices},
+		{dbImported, s.persistImportedServices},
+		{dbRetention, s.persistRetention},
+		{snapshotRestoreChunks, s.persistRestoreChunks},
 	}
-
-	if err := s.persistTombstones(sink, encoder); err != nil {
-		sink.Cancel()
-		return err
+	for _, table := range tables {
+		if err := table.persist(w, encoder); err != nil {
+			sink.Cancel()
+			return err
+		}
+		if err := w.writeChecksum(table.name); err != nil {
+			sink.Cancel()
+			return err
+		}
 	}
 	return nil
 }
 
-func (s *consulSnapshot) persistNodes(sink raft.SnapshotSink,
-	encoder *codec.Encoder) error {
-	// Get all the nodes
-	nodes := s.state.Nodes()
+// streamTable invokes persist with each row produced by dump, redacted
+// if the snapshot is. The rows are passed through a bounded buffer, so a
+// table is never materialized in memory.
+func (s *consulSnapshot) streamTable(dump func(chan<- interface{}) error,
+	persist func(interface{}) error) error {
+	streamCh := make(chan interface{}, snapshotStreamBuffer)
+	errorCh := make(chan error, 1)
+	go func() {
+		errorCh <- dump(streamCh)
+	}()
 
-	// Register each node
-	var req structs.RegisterRequest
-	for i := 0; i < len(nodes); i++ {
-		req = structs.RegisterRequest{
-			Node:    nodes[i].Node,
-			Address: nodes[i].Address,
+	for raw := range streamCh {
+		if err := persist(s.redactor.redact(raw)); err != nil {
+			// Drain the stream so the dump can finish
+			go func() {
+				for range streamCh {
+				}
+			}()
+			return err
 		}
+	}
+	return <-errorCh
+}
 
-		// Register the node itself
-		sink.Write([]byte{byte(structs.RegisterRequestType)})
-		if err := encoder.Encode(&req); err != nil {
+// persistEncoded writes each row produced by dump with the given type
+func (s *consulSnapshot) persistEncoded(sink io.Writer, encoder *codec.Encoder,
+	msgType structs.MessageType, dump func(chan<- interface{}) error) error {
+	return s.streamTable(dump, func(raw interface{}) error {
+		if _, err := sink.Write([]byte{byte(msgType)}); err != nil {
 			return err
 		}
+		return encoder.Encode(raw)
+	})
+}
+
+func (s *consulSnapshot) persistNodes(sink io.Writer,
+	encoder *codec.Encoder) error {
+	var buf []byte
+	return s.streamTable(s.state.NodeDump, func(raw interface{}) error {
+		// Use the generated encoders to avoid reflection
+		node := raw.(*structs.Node)
+
+		// Register the node itself
+		buf = append(buf[:0], byte(structs.RegisterRequestType))
+		buf = structs.MarshalRegisterMsgpack(buf, node, nil, nil)
 
 		// Register each service this node has
-		services := s.state.NodeServices(nodes[i].Node)
+		services := s.state.NodeServices(node.Node)
 		for _, srv := range services.Services {
-			req.Service = srv
-			sink.Write([]byte{byte(structs.RegisterRequestType)})
-			if err := encoder.Encode(&req); err != nil {
-				return err
-			}
+			buf = append(buf, byte(structs.RegisterRequestType))
+			buf = structs.MarshalRegisterMsgpack(buf, node, srv, nil)
 		}
 
 		// Register each check this node has
-		req.Service = nil
-		checks := s.state.NodeChecks(nodes[i].Node)
+		checks := s.state.NodeChecks(node.Node)
 		for _, check := range checks {
-			req.Check = check
-			sink.Write([]byte{byte(structs.RegisterRequestType)})
-			if err := encoder.Encode(&req); err != nil {
-				return err
-			}
+			buf = append(buf, byte(structs.RegisterRequestType))
+			buf = structs.MarshalRegisterMsgpack(buf, node, nil, check)
 		}
-	}
-	return nil
+		_, err := sink.Write(buf)
+		return err
+	})
 }
 
-func (s *consulSnapshot) persistSessions(sink raft.SnapshotSink,
+func (s *consulSnapshot) persistSessions(sink io.Writer,
 	encoder *codec.Encoder) error {
-	sessions, err := s.state.SessionList()
-	if err != nil {
+	return s.persistEncoded(sink, encoder, structs.SessionRequestType, s.state.SessionDump)
+}
+
+func (s *consulSnapshot) persistACLs(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.ACLRequestType, s.state.ACLDump)
+}
+
+func (s *consulSnapshot) persistLockDelays(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.LockDelayRequestType, s.state.LockDelayDump)
+}
+
+func (s *consulSnapshot) persistKV(sink io.Writer,
+	encoder *codec.Encoder) error {
+	var buf []byte
+	return s.streamTable(s.state.KVSDump, func(raw interface{}) error {
+		// Use the generated encoder to avoid reflection
+		buf = append(buf[:0], byte(structs.KVSRequestType))
+		buf = raw.(*structs.DirEntry).MarshalMsgpack(buf)
+		_, err := sink.Write(buf)
 		return err
-	}
+	})
+}
 
-	for _, s := range sessions {
-		sink.Write([]byte{byte(structs.SessionRequestType)})
-		if err := encoder.Encode(s); err != nil {
-			return err
-		}
-	}
-	return nil
+func (s *consulSnapshot) persistKVSHistory(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.KVSHistoryRequestType, s.state.KVSHistoryDump)
 }
 
-func (s *consulSnapshot) persistACLs(sink raft.SnapshotSink,
+func (s *consulSnapshot) persistTombstones(sink io.Writer,
 	encoder *codec.Encoder) error {
-	acls, err := s.state.ACLList()
-	if err != nil {
+	var buf []byte
+	return s.streamTable(s.state.TombstoneDump, func(raw interface{}) error {
+		// Use the generated encoder to avoid reflection
+		buf = append(buf[:0], byte(structs.TombstoneRequestType))
+		buf = raw.(*structs.DirEntry).MarshalMsgpack(buf)
+		_, err := sink.Write(buf)
 		return err
-	}
+	})
+}
 
-	for _, s := range acls {
-		sink.Write([]byte{byte(structs.ACLRequestType)})
-		if err := encoder.Encode(s); err != nil {
-			return err
-		}
-	}
-	return nil
+func (s *consulSnapshot) persistOutboxSubscriptions(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.OutboxRequestType,
+		s.state.OutboxSubscriptionDump)
 }
 
-func (s *consulSnapshot) persistKV(sink raft.SnapshotSink,
+func (s *consulSnapshot) persistOutbox(sink io.Writer,
 	encoder *codec.Encoder) error {
-	streamCh := make(chan interface{}, 256)
-	errorCh := make(chan error)
-	go func() {
-		if err := s.state.KVSDump(streamCh); err != nil {
-			errorCh <- err
-		}
-	}()
+	return s.persistEncoded(sink, encoder, structs.OutboxEntryType, s.state.OutboxDump)
+}
 
-	for {
-		select {
-		case raw := <-streamCh:
-			if raw == nil {
-				return nil
-			}
-			sink.Write([]byte{byte(structs.KVSRequestType)})
-			if err := encoder.Encode(raw); err != nil {
-				return err
-			}
+func (s *consulSnapshot) persistServerHealth(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.ServerHealthRequestType,
+		s.state.ServerHealthDump)
+}
 
-		case err := <-errorCh:
-			return err
-		}
-	}
+func (s *consulSnapshot) persistCatalogAudit(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.CatalogAuditType, s.state.CatalogAuditDump)
 }
 
-func (s *consulSnapshot) persistTombstones(sink raft.SnapshotSink,
+func (s *consulSnapshot) persistExternalClaims(sink io.Writer,
 	encoder *codec.Encoder) error {
-	streamCh := make(chan interface{}, 256)
-	errorCh := make(chan error)
-	go func() {
-		if err := s.state.TombstoneDump(streamCh); err != nil {
-			errorCh <- err
-		}
-	}()
+	return s.persistEncoded(sink, encoder, structs.ExternalClaimRequestType,
+		s.state.ExternalClaimDump)
+}
 
-	for {
-		select {
-		case raw := <-streamCh:
-			if raw == nil {
-				return nil
-			}
-			sink.Write([]byte{byte(structs.TombstoneRequestType)})
-			if err := encoder.Encode(raw); err != nil {
-				return err
-			}
+func (s *consulSnapshot) persistMaintenance(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.MaintenanceRequestType,
+		s.state.MaintenanceDump)
+}
+
+func (s *consulSnapshot) persistAutopilot(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.AutopilotRequestType,
+		s.state.AutopilotDump)
+}
+
+func (s *consulSnapshot) persistAutoEncryptTokens(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.AutoEncryptRequestType,
+		s.state.AutoEncryptTokenDump)
+}
+
+func (s *consulSnapshot) persistAreas(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.AreaRequestType,
+		s.state.AreaDump)
+}
+
+func (s *consulSnapshot) persistPeerings(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.PeeringRequestType,
+		s.state.PeeringDump)
+}
 
-		case err := <-errorCh:
+func (s *consulSnapshot) persistExportedServices(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.ExportedServicesRequestType,
+		s.state.ExportedServicesDump)
+}
+
+func (s *consulSnapshot) persistImportedServices(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.ImportedServicesRequestType,
+		s.state.ImportedServiceDump)
+}
+
+func (s *consulSnapshot) persistRetention(sink io.Writer,
+	encoder *codec.Encoder) error {
+	return s.persistEncoded(sink, encoder, structs.RetentionRequestType,
+		s.state.RetentionDump)
+}
+
+// persistRestoreChunks writes the chunks of the pending snapshot restore
+func (s *consulSnapshot) persistRestoreChunks(sink io.Writer,
+	encoder *codec.Encoder) error {
+	for _, chunk := range s.restoreChunks {
+		if _, err := sink.Write([]byte{byte(structs.SnapshotRestoreRequestType)}); err != nil {
+			return err
+		}
+		if err := encoder.Encode(chunk); err != nil {
 			return err
 		}
 	}
+	return nil
 }
 
 func (s *consulSnapshot) Release() {
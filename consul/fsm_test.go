@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/raft"
@@ -196,6 +198,43 @@ func TestFSM_DeregisterService(t *testing.T) {
 	}
 }
 
+func TestFSM_CatalogPatch(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+
+	req := structs.CatalogPatchRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Ops: []structs.PatchOp{
+			structs.PatchOp{Op: structs.PatchSetMeta, Key: "rack", Value: "r1"},
+		},
+	}
+	buf, err := structs.Encode(structs.CatalogPatchRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify the metadata is set
+	_, nodes := fsm.state.Nodes()
+	if len(nodes) != 1 || nodes[0].Meta["rack"] != "r1" {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestFSM_DeregisterCheck(t *testing.T) {
 	path, err := ioutil.TempDir("", "fsm")
 	if err != nil {
@@ -339,14 +378,15 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 	defer fsm.Close()
+	fsm.state.RetentionSet(1, &structs.RetentionConfig{KVSHistoryVersions: 5})
 
 	// Add some state
-	fsm.state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	fsm.state.EnsureNode(2, structs.Node{"baz", "127.0.0.2"})
-	fsm.state.EnsureService(3, "foo", &structs.NodeService{"web", "web", nil, "127.0.0.1", 80, false})
-	fsm.state.EnsureService(4, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
-	fsm.state.EnsureService(5, "baz", &structs.NodeService{"web", "web", nil, "127.0.0.2", 80, false})
-	fsm.state.EnsureService(6, "baz", &structs.NodeService{"db", "db", []string{"secondary"}, "127.0.0.2", 5000, false})
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.EnsureNode(2, structs.Node{Node: "baz", Address: "127.0.0.2", Meta: map[string]string{"rack": "r1"}})
+	fsm.state.EnsureService(3, "foo", &structs.NodeService{ID: "web", Service: "web", Address: "127.0.0.1", Port: 80})
+	fsm.state.EnsureService(4, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"primary"}, Address: "127.0.0.1", Port: 5000, Meta: map[string]string{"lag": "0"}})
+	fsm.state.EnsureService(5, "baz", &structs.NodeService{ID: "web", Service: "web", Address: "127.0.0.2", Port: 80})
+	fsm.state.EnsureService(6, "baz", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"secondary"}, Address: "127.0.0.2", Port: 5000})
 	fsm.state.EnsureCheck(7, &structs.HealthCheck{
 		Node:      "foo",
 		CheckID:   "web",
@@ -369,6 +409,51 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	})
 	fsm.state.KVSDelete(12, "/remove")
 
+	// Open a lock delay window
+	delayed := &structs.Session{ID: generateUUID(), Node: "foo", LockDelay: time.Minute}
+	fsm.state.SessionCreate(13, delayed)
+	fsm.state.KVSLock(14, &structs.DirEntry{Key: "/delayed", Session: delayed.ID})
+	fsm.state.SessionDestroy(15, delayed.ID)
+
+	// Record an undelivered outbox entry
+	fsm.state.OutboxSubscribe(16, &structs.OutboxSubscription{Name: "deploy", Prefix: "/deploy/", URL: "http://127.0.0.1/hook"})
+	fsm.state.KVSSet(17, &structs.DirEntry{Key: "/deploy/web", Value: []byte("v1")})
+
+	// Record the health of a server
+	fsm.state.ServerHealthSet(18, &structs.ServerHealth{Name: "s1", Healthy: true, StableSince: 100})
+
+	// Claim the node for an external health checker
+	fsm.state.ExternalClaimAcquire(19, &structs.ExternalClaim{Node: "foo", Owner: "esm", Session: session.ID})
+
+	// Put a service in maintenance mode
+	fsm.state.MaintenanceEnable(20, &structs.Maintenance{Node: "baz", ServiceID: "web", Reason: "upgrade", Expires: 100})
+
+	// Configure autopilot
+	fsm.state.AutopilotSetConfig(21, &structs.AutopilotConfig{ServerStabilizationTime: time.Minute}, false)
+
+	// Create a one-time auto-encrypt token
+	fsm.state.AutoEncryptTokenCreate(22, &structs.AutoEncryptToken{Hash: "abcd", Node: "foo", ExpiresAt: time.Now().Add(time.Hour)}, time.Now())
+
+	// Link a network area
+	fsm.state.AreaSet(23, &structs.Area{ID: "area1", PeerDatacenter: "dc2", RetryJoin: []string{"10.0.0.1:8300"}})
+
+	// Peer with another cluster, sharing and importing a service
+	fsm.state.PeeringSet(24, &structs.Peering{ID: "peering1", Name: "cluster2", State: structs.PeeringActive, SecretHash: "abcd"})
+	fsm.state.ExportedServicesSet(25, &structs.ExportedServicesConfig{
+		Services: []structs.ExportedService{{Name: "web", Consumers: []string{"cluster2"}}},
+	})
+	fsm.state.ImportedServicesReplace(26, "cluster2", structs.ImportedServices{
+		&structs.ImportedService{
+			Service: "api",
+			Nodes: structs.CheckServiceNodes{
+				structs.CheckServiceNode{
+					Node:    structs.Node{Node: "remote", Address: "10.1.0.1"},
+					Service: structs.NodeService{ID: "api", Service: "api", Port: 80},
+				},
+			},
+		},
+	})
+
 	// Snapshot
 	snap, err := fsm.Snapshot()
 	if err != nil {
@@ -400,11 +485,19 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	if len(nodes) != 2 {
 		t.Fatalf("Bad: %v", nodes)
 	}
+	for _, node := range nodes {
+		if node.Node == "baz" && node.Meta["rack"] != "r1" {
+			t.Fatalf("Bad: %v", node)
+		}
+	}
 
 	_, fooSrv := fsm2.state.NodeServices("foo")
 	if len(fooSrv.Services) != 2 {
 		t.Fatalf("Bad: %v", fooSrv)
 	}
+	if fooSrv.Services["db"].Meta["lag"] != "0" {
+		t.Fatalf("Bad: %v", fooSrv)
+	}
 	if !strContains(fooSrv.Services["db"].Tags, "primary") {
 		t.Fatalf("Bad: %v", fooSrv)
 	}
@@ -417,6 +510,111 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		t.Fatalf("Bad: %v", checks)
 	}
 
+	// Verify the lock delay window is restored
+	_, delays, err := fsm2.state.LockDelays()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(delays) != 1 || delays[0].Key != "/delayed" || delays[0].Session != delayed.ID {
+		t.Fatalf("bad: %v", delays)
+	}
+	if fsm2.state.KVSLockDelay("/delayed").IsZero() {
+		t.Fatalf("should have expiration")
+	}
+
+	// Verify the outbox is restored
+	_, subs, err := fsm2.state.OutboxSubscriptions()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(subs) != 1 || subs[0].Prefix != "/deploy/" || subs[0].CreateIndex != 16 {
+		t.Fatalf("bad: %v", subs)
+	}
+	_, pending, err := fsm2.state.OutboxPending("deploy", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Entry.Key != "/deploy/web" || string(pending[0].Entry.Value) != "v1" {
+		t.Fatalf("bad: %v", pending)
+	}
+
+	// Verify the server health is restored
+	_, health, err := fsm2.state.ServerHealthGet("s1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if health == nil || !health.Healthy || health.StableSince != 100 || health.ModifyIndex != 18 {
+		t.Fatalf("bad: %v", health)
+	}
+
+	// Verify the external claim is restored
+	_, claim, err := fsm2.state.ExternalClaimGet("foo", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if claim == nil || claim.Owner != "esm" || claim.Session != session.ID || claim.CreateIndex != 19 {
+		t.Fatalf("bad: %v", claim)
+	}
+
+	// Verify the maintenance flag and its check are restored
+	_, maint, err := fsm2.state.MaintenanceGet("baz", "web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if maint == nil || maint.Reason != "upgrade" || maint.Expires != 100 || maint.CreateIndex != 20 {
+		t.Fatalf("bad: %v", maint)
+	}
+	_, checks = fsm2.state.NodeChecks("baz")
+	if len(checks) != 1 || checks[0].CheckID != maintenanceCheckID("web") || checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// Verify the autopilot configuration is restored
+	_, autopilot, err := fsm2.state.AutopilotConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if autopilot == nil || autopilot.ServerStabilizationTime != time.Minute || autopilot.ModifyIndex != 21 {
+		t.Fatalf("bad: %v", autopilot)
+	}
+
+	// Verify the one-time token is restored
+	if ok, err := fsm2.state.AutoEncryptTokenConsume(23, "abcd", "foo", time.Now()); err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// Verify the area is restored
+	_, area, err := fsm2.state.AreaGet("area1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if area == nil || area.PeerDatacenter != "dc2" || area.ModifyIndex != 23 {
+		t.Fatalf("bad: %v", area)
+	}
+
+	// Verify the peering, exported and imported services are restored
+	_, peering, err := fsm2.state.PeeringGet("cluster2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if peering == nil || peering.ID != "peering1" || peering.SecretHash != "abcd" || peering.ModifyIndex != 24 {
+		t.Fatalf("bad: %v", peering)
+	}
+	_, exported, err := fsm2.state.ExportedServices()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if exported == nil || len(exported.Services) != 1 || exported.Services[0].Consumers[0] != "cluster2" {
+		t.Fatalf("bad: %v", exported)
+	}
+	_, imported, err := fsm2.state.ImportedServiceNodes("cluster2", "api")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(imported) != 1 || imported[0].Node.Address != "10.1.0.1" {
+		t.Fatalf("bad: %v", imported)
+	}
+
 	// Verify key is set
 	_, d, err := fsm2.state.KVSGet("/test")
 	if err != nil {
@@ -467,6 +665,207 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	if len(res) != 1 {
 		t.Fatalf("bad: %v", res)
 	}
+
+	// Verify the retention and the KV history are restored
+	_, retention, err := fsm2.state.Retention()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if retention == nil || retention.KVSHistoryVersions != 5 {
+		t.Fatalf("bad: %#v", retention)
+	}
+	_, d, err = fsm2.state.KVSGetAtIndex("/remove", 11)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "foo" {
+		t.Fatalf("bad: %#v", d)
+	}
+}
+
+func TestFSM_SnapshotRestore_Corrupt(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.KVSSet(2, &structs.DirEntry{Key: "/a", Value: []byte("foo")})
+	fsm.state.KVSSet(3, &structs.DirEntry{Key: "/b", Value: []byte("foo")})
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Find the last KV entry
+	var kv []byte
+	kv = append(kv, byte(structs.KVSRequestType))
+	kv = (&structs.DirEntry{Key: "/b", Value: []byte("foo"), CreateIndex: 3, ModifyIndex: 3}).MarshalMsgpack(kv)
+	full := buf.Bytes()
+	offset := bytes.Index(full, kv)
+	if offset < 0 {
+		t.Fatalf("bad: %v", full)
+	}
+
+	// Corrupt the value of the entry
+	corrupt := make([]byte, len(full))
+	copy(corrupt, full)
+	valueOffset := offset + bytes.Index(kv, []byte("foo"))
+	corrupt[valueOffset] = 'g'
+
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	fsm2.state.KVSSet(1, &structs.DirEntry{Key: "/keep", Value: []byte("bar")})
+	err = fsm2.Restore(&MockSink{bytes.NewBuffer(corrupt), false})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch for table 'kvs'") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The failed restore keeps the previous state
+	if _, d, err := fsm2.state.KVSGet("/keep"); err != nil || d == nil {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	// Truncate the snapshot before the entry
+	truncated := bytes.NewBuffer(full[:offset])
+	fsm3, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm3.Close()
+	err = fsm3.Restore(&MockSink{truncated, false})
+	if err == nil || !strings.Contains(err.Error(), "missing the checksum for 1 records") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFSM_SnapshotRestore_Chunked(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Take the snapshot to restore
+	source, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer source.Close()
+	source.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	source.state.KVSSet(2, &structs.DirEntry{Key: "/test", Value: []byte("before")})
+	snap, err := source.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	if err := snap.Persist(&MockSink{buf, false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := buf.Bytes()
+
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+	fsm.state.KVSSet(10, &structs.DirEntry{Key: "/test", Value: []byte("after")})
+
+	chunk := func(seq int, more bool, data []byte) []byte {
+		req := structs.SnapshotRestore{
+			ID:    "restore",
+			Seq:   seq,
+			More:  more,
+			Meta:  structs.SnapshotMeta{Index: 2, Size: int64(len(state))},
+			State: data,
+		}
+		buf, err := structs.Encode(structs.SnapshotRestoreRequestType, &req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return buf
+	}
+	third := len(state) / 3
+	apply := func(f *consulFSM, index uint64, buf []byte) interface{} {
+		log := makeLog(buf)
+		log.Index = index
+		return f.Apply(log)
+	}
+
+	// A chunk out of order is rejected
+	if resp := apply(fsm, 11, chunk(1, true, state[:third])); resp == nil {
+		t.Fatalf("should fail")
+	}
+
+	// The state is unchanged until the last chunk
+	if resp := apply(fsm, 12, chunk(0, true, state[:third])); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	if resp := apply(fsm, 13, chunk(1, true, state[third:2*third])); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	if _, d, err := fsm.state.KVSGet("/test"); err != nil || string(d.Value) != "after" {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	// A server that restores a snapshot of the FSM taken mid-restore
+	// gets the pending chunks
+	pending, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer pending.Release()
+	buf = bytes.NewBuffer(nil)
+	if err := pending.Persist(&MockSink{buf, false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(&MockSink{buf, false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The last chunk restores the snapshot, with the indexes raised to
+	// the index of the restore
+	for _, f := range []*consulFSM{fsm, fsm2} {
+		if resp := apply(f, 14, chunk(2, false, state[2*third:])); resp != nil {
+			t.Fatalf("resp: %v", resp)
+		}
+		idx, d, err := f.state.KVSGet("/test")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if idx != 14 || d == nil || string(d.Value) != "before" {
+			t.Fatalf("bad: %d %v", idx, d)
+		}
+		if idx, _ := f.state.Nodes(); idx != 14 {
+			t.Fatalf("bad: %d", idx)
+		}
+		if len(f.restoreChunks) != 0 {
+			t.Fatalf("bad: %v", f.restoreChunks)
+		}
+	}
 }
 
 func TestFSM_KVSSet(t *testing.T) {
@@ -747,7 +1146,7 @@ func TestFSM_SessionCreate_Destroy(t *testing.T) {
 	}
 	defer fsm.Close()
 
-	fsm.state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	fsm.state.EnsureCheck(2, &structs.HealthCheck{
 		Node:    "foo",
 		CheckID: "web",
@@ -832,7 +1231,7 @@ func TestFSM_KVSLock(t *testing.T) {
 	}
 	defer fsm.Close()
 
-	fsm.state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
 	fsm.state.SessionCreate(2, session)
 
@@ -882,7 +1281,7 @@ func TestFSM_KVSUnlock(t *testing.T) {
 	}
 	defer fsm.Close()
 
-	fsm.state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
 	fsm.state.SessionCreate(2, session)
 
@@ -1060,6 +1459,47 @@ func TestFSM_TombstoneReap(t *testing.T) {
 	}
 }
 
+func TestFSM_KVSHistoryReap(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+	fsm.state.RetentionSet(1, &structs.RetentionConfig{KVSHistoryVersions: 5})
+
+	fsm.state.KVSSet(11, &structs.DirEntry{Key: "/foo", Value: []byte("one")})
+	fsm.state.KVSSet(12, &structs.DirEntry{Key: "/foo", Value: []byte("two")})
+
+	// Reap the first version
+	req := structs.KVSHistoryRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSHistoryReap,
+		ReapIndex:  11,
+	}
+	buf, err := structs.Encode(structs.KVSHistoryRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if err, ok := resp.(error); ok {
+		t.Fatalf("resp: %v", err)
+	}
+
+	// Verify only the later version is left
+	_, res, err := fsm.state.kvsHistoryTable.Get("id")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 1 || kvsVersionIndex(res[0].(*kvsVersion).Version) != 12 {
+		t.Fatalf("bad: %v", res)
+	}
+}
+
 func TestFSM_IgnoreUnknown(t *testing.T) {
 	path, err := ioutil.TempDir("", "fsm")
 	if err != nil {
@@ -1089,3 +1529,376 @@ func TestFSM_IgnoreUnknown(t *testing.T) {
 		t.Fatalf("resp: %v", err)
 	}
 }
+
+func TestFSM_LockDelayExpire(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Open a lock delay window
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	session := &structs.Session{ID: generateUUID(), Node: "foo", LockDelay: time.Minute}
+	fsm.state.SessionCreate(2, session)
+	fsm.state.KVSLock(3, &structs.DirEntry{Key: "/test", Session: session.ID})
+	fsm.state.SessionDestroy(4, session.ID)
+
+	req := structs.LockDelayRequest{
+		Datacenter: "dc1",
+		Op:         structs.LockDelayExpire,
+		Key:        "/test",
+		Session:    session.ID,
+	}
+	buf, err := structs.Encode(structs.LockDelayRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify the window is closed
+	idx, delays, err := fsm.state.LockDelays()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1 || len(delays) != 0 {
+		t.Fatalf("bad: %v %v", idx, delays)
+	}
+}
+
+func TestFSM_Outbox(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	req := structs.OutboxRequest{
+		Datacenter: "dc1",
+		Op:         structs.OutboxSubscribe,
+		Subscription: structs.OutboxSubscription{
+			Name:   "deploy",
+			Prefix: "/deploy/",
+			URL:    "http://127.0.0.1/hook",
+		},
+	}
+	buf, err := structs.Encode(structs.OutboxRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Record a change
+	fsm.state.KVSSet(2, &structs.DirEntry{Key: "/deploy/web", Value: []byte("v1")})
+	_, pending, err := fsm.state.OutboxPending("deploy", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("bad: %v", pending)
+	}
+
+	// Acknowledge it
+	req.Op = structs.OutboxAck
+	req.Acks = []string{pending[0].ID}
+	buf, err = structs.Encode(structs.OutboxRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	_, pending, err = fsm.state.OutboxPending("deploy", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("bad: %v", pending)
+	}
+
+	// Unsubscribe
+	req.Op = structs.OutboxUnsubscribe
+	buf, err = structs.Encode(structs.OutboxRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	_, subs, err := fsm.state.OutboxSubscriptions()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(subs) != 0 {
+		t.Fatalf("bad: %v", subs)
+	}
+}
+
+func TestFSM_ServerHealth(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	req := structs.ServerHealthRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServerHealthSet,
+		Health: structs.ServerHealth{
+			Name:        "s1",
+			Address:     "127.0.0.1:8300",
+			Healthy:     true,
+			StableSince: 100,
+			Voter:       true,
+		},
+	}
+	buf, err := structs.Encode(structs.ServerHealthRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	_, health, err := fsm.state.ServerHealthGet("s1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if health == nil || !health.Voter || health.Address != "127.0.0.1:8300" {
+		t.Fatalf("bad: %v", health)
+	}
+
+	// Remove the server
+	req.Op = structs.ServerHealthDelete
+	buf, err = structs.Encode(structs.ServerHealthRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	_, health, err = fsm.state.ServerHealthGet("s1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if health != nil {
+		t.Fatalf("bad: %v", health)
+	}
+}
+
+func TestFSM_ExternalClaim(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	fsm.state.SessionCreate(2, session)
+
+	req := structs.ExternalClaimRequest{
+		Datacenter: "dc1",
+		Op:         structs.ExternalClaimAcquire,
+		Claim: structs.ExternalClaim{
+			Node:    "foo",
+			Owner:   "esm",
+			Session: session.ID,
+		},
+	}
+	buf, err := structs.Encode(structs.ExternalClaimRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != true {
+		t.Fatalf("resp: %v", resp)
+	}
+	_, claim, err := fsm.state.ExternalClaimGet("foo", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if claim == nil || claim.Owner != "esm" {
+		t.Fatalf("bad: %v", claim)
+	}
+
+	// Release the claim
+	req.Op = structs.ExternalClaimRelease
+	buf, err = structs.Encode(structs.ExternalClaimRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != true {
+		t.Fatalf("resp: %v", resp)
+	}
+	_, claim, err = fsm.state.ExternalClaimGet("foo", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if claim != nil {
+		t.Fatalf("bad: %v", claim)
+	}
+}
+
+func TestFSM_CatalogAudit(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+	fsm.state.RetentionSet(1, &structs.RetentionConfig{CatalogAuditLimit: 10})
+
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+			Tags:    []string{"master"},
+			Port:    8000,
+		},
+		Audit:        structs.AuditSource{Time: 100, SourceAddr: "10.0.0.1"},
+		WriteRequest: structs.WriteRequest{Token: "secret"},
+	}
+	buf, err := structs.Encode(structs.RegisterRequestType, reg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: buf}); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	dereg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "db",
+		Audit:      structs.AuditSource{Time: 200},
+	}
+	buf, err = structs.Encode(structs.DeregisterRequestType, dereg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(&raft.Log{Index: 2, Type: raft.LogCommand, Data: buf}); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, audits, err := fsm.state.CatalogAuditList("foo", 0, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(audits) != 2 {
+		t.Fatalf("bad: %v", audits)
+	}
+
+	// The token is hashed, and the summaries cover the service
+	service := "node foo 127.0.0.1, service db (db) :8000 [master]"
+	first := audits[0]
+	if first.Op != catalogAuditRegister || first.Time != 100 || first.SourceAddr != "10.0.0.1" ||
+		first.Accessor != auditAccessor("secret") || first.Accessor == "secret" ||
+		first.Before != "" || first.After != service {
+		t.Fatalf("bad: %#v", first)
+	}
+	second := audits[1]
+	if second.Op != catalogAuditDeregister || second.Time != 200 || second.Accessor != anonymousToken ||
+		second.Before != service || second.After != "node foo 127.0.0.1" {
+		t.Fatalf("bad: %#v", second)
+	}
+
+	// The leader trims the oldest records
+	trim := structs.CatalogAuditTrimRequest{
+		Datacenter: "dc1",
+		TrimIndex:  1,
+	}
+	buf, err = structs.Encode(structs.CatalogAuditTrimRequestType, trim)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(&raft.Log{Index: 3, Type: raft.LogCommand, Data: buf}); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	idx, audits, err := fsm.state.CatalogAuditList("", 0, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 3 || len(audits) != 1 || audits[0].CreateIndex != 2 {
+		t.Fatalf("bad: %d %v", idx, audits)
+	}
+}
+
+func TestFSM_WaitForIndex(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Nothing has been applied
+	if fsm.WaitForIndex(1, time.After(10*time.Millisecond)) {
+		t.Fatalf("should time out")
+	}
+
+	req := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt:     structs.DirEntry{Key: "/test", Value: []byte("test")},
+	}
+	buf, err := structs.Encode(structs.KVSRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wake a waiter with the apply
+	doneCh := make(chan bool, 1)
+	go func() {
+		doneCh <- fsm.WaitForIndex(1, time.After(time.Second))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	fsm.Apply(makeLog(buf))
+	if !<-doneCh {
+		t.Fatalf("should be applied")
+	}
+	if fsm.AppliedIndex() != 1 {
+		t.Fatalf("bad: %d", fsm.AppliedIndex())
+	}
+}
@@ -2,6 +2,8 @@ package consul
 
 import (
 	"fmt"
+	"strings"
+
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
 )
@@ -62,13 +64,16 @@ func (h *Health) ServiceChecks(args *structs.ServiceSpecificRequest,
 
 	// Get the service checks
 	state := h.srv.fsm.State()
-	return h.srv.blockingRPC(&args.QueryOptions,
-		&reply.QueryMeta,
-		state.QueryTables("ServiceChecks"),
-		func() error {
+	opts := blockingRPCOptions{
+		queryOpts: &args.QueryOptions,
+		queryMeta: &reply.QueryMeta,
+		service:   args.ServiceName,
+		run: func() error {
 			reply.Index, reply.HealthChecks = state.ServiceChecks(args.ServiceName)
 			return h.srv.filterACL(args.Token, reply)
-		})
+		},
+	}
+	return h.srv.blockingRPCOpt(&opts)
 }
 
 // ServiceNodes returns all the nodes registered as part of a service including health info
@@ -81,20 +86,55 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 	if args.ServiceName == "" {
 		return fmt.Errorf("Must provide service name")
 	}
+	if args.Connect && args.TagFilter {
+		return fmt.Errorf("Tag filtering isn't supported for connect-proxies")
+	}
+	if args.PeerName != "" && args.Connect {
+		return fmt.Errorf("Connect-proxies aren't imported from peers")
+	}
 
 	// Get the nodes
 	state := h.srv.fsm.State()
-	err := h.srv.blockingRPC(&args.QueryOptions,
-		&reply.QueryMeta,
-		state.QueryTables("CheckServiceNodes"),
-		func() error {
-			if args.TagFilter {
+	opts := blockingRPCOptions{
+		queryOpts: &args.QueryOptions,
+		queryMeta: &reply.QueryMeta,
+		service:   args.ServiceName,
+		run: func() error {
+			switch {
+			case args.PeerName != "":
+				var err error
+				reply.Index, reply.Nodes, err = state.ImportedServiceNodes(args.PeerName, args.ServiceName)
+				if err != nil {
+					return err
+				}
+				if args.TagFilter {
+					reply.Nodes = filterServiceTag(reply.Nodes, args.ServiceTag)
+				}
+			case args.Connect:
+				reply.Index, reply.Nodes = state.CheckConnectServiceNodes(args.ServiceName)
+			case args.TagFilter:
 				reply.Index, reply.Nodes = state.CheckServiceTagNodes(args.ServiceName, args.ServiceTag)
-			} else {
+			default:
 				reply.Index, reply.Nodes = state.CheckServiceNodes(args.ServiceName)
 			}
-			return h.srv.filterACL(args.Token, reply)
-		})
+			if len(args.NodeMetaFilters) > 0 {
+				reply.Nodes = filterNodeMeta(reply.Nodes, args.NodeMetaFilters)
+			}
+			if err := h.srv.filterACL(args.Token, reply); err != nil {
+				return err
+			}
+			var err error
+			reply.Nodes, err = h.srv.paginateCheckServiceNodes(&args.QueryOptions,
+				&reply.QueryMeta, reply.Nodes)
+			return err
+		},
+	}
+	if args.PeerName != "" {
+		// The imported services change with the exchanges with the peer
+		opts.service = ""
+		opts.tables = state.QueryTables("ImportedServices")
+	}
+	err := h.srv.blockingRPCOpt(&opts)
 
 	// Provide some metrics
 	if err == nil {
@@ -108,3 +148,182 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 	}
 	return err
 }
+
+// Summary returns the number of passing, warning and critical instances
+// of each service, which is much lighter to poll than the instances
+func (h *Health) Summary(args *structs.DCSpecificRequest,
+	reply *structs.IndexedServiceHealthSummaries) error {
+	if done, err := h.srv.forward("Health.Summary", args, args, reply); done {
+		return err
+	}
+
+	state := h.srv.fsm.State()
+	return h.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("HealthSummary"),
+		func() error {
+			var err error
+			reply.Index, reply.Summaries, err = state.HealthSummary()
+			if err != nil {
+				return err
+			}
+			return h.srv.filterACL(args.Token, reply)
+		})
+}
+
+// MeshGateways returns the mesh gateways of a datacenter, with their
+// checks
+func (h *Health) MeshGateways(args *structs.DCSpecificRequest,
+	reply *structs.IndexedCheckServiceNodes) error {
+	if done, err := h.srv.forward("Health.MeshGateways", args, args, reply); done {
+		return err
+	}
+
+	state := h.srv.fsm.State()
+	return h.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("CheckServiceNodes"),
+		func() error {
+			reply.Index, reply.Nodes = state.CheckServiceKindNodes(structs.ServiceKindMeshGateway)
+			return h.srv.filterACL(args.Token, reply)
+		})
+}
+
+// ResolveService resolves a service of a target datacenter to the
+// endpoints the proxies of this datacenter dial to reach it. Another
+// datacenter is reached through the mesh gateways of both datacenters,
+// so the networks of the datacenters don't need to be routable to each
+// other. The query doesn't block, since it spans the datacenters.
+func (h *Health) ResolveService(args *structs.ServiceResolveRequest,
+	reply *structs.ServiceResolution) error {
+	if done, err := h.srv.forward("Health.ResolveService", args, args, reply); done {
+		return err
+	}
+
+	if args.ServiceName == "" {
+		return fmt.Errorf("Must provide service name")
+	}
+	target := args.TargetDatacenter
+	if target == "" {
+		target = h.srv.config.Datacenter
+	}
+	reply.Datacenter, reply.ServiceName = target, args.ServiceName
+	defer h.srv.setQueryMeta(&reply.QueryMeta)
+
+	// Within the datacenter, the proxies of the service are dialed
+	state := h.srv.fsm.State()
+	if target == h.srv.config.Datacenter {
+		var proxies structs.IndexedCheckServiceNodes
+		reply.Index, proxies.Nodes = state.CheckConnectServiceNodes(args.ServiceName)
+		if err := h.srv.filterACL(args.Token, &proxies); err != nil {
+			return err
+		}
+		reply.Endpoints = serviceEndpoints(filterPassing(proxies.Nodes), false)
+		return nil
+	}
+
+	// The service must have healthy proxies in the target datacenter,
+	// reachable through its mesh gateways
+	opts := structs.QueryOptions{Token: args.Token, AllowStale: args.AllowStale}
+	remoteArgs := structs.ServiceSpecificRequest{
+		Datacenter:   target,
+		ServiceName:  args.ServiceName,
+		Connect:      true,
+		QueryOptions: opts,
+	}
+	var remote structs.IndexedCheckServiceNodes
+	if err := h.srv.RPC("Health.ServiceNodes", &remoteArgs, &remote); err != nil {
+		return err
+	}
+	if len(filterPassing(remote.Nodes)) == 0 {
+		return nil
+	}
+
+	gatewayArgs := structs.DCSpecificRequest{Datacenter: target, QueryOptions: opts}
+	var remoteGateways structs.IndexedCheckServiceNodes
+	if err := h.srv.RPC("Health.MeshGateways", &gatewayArgs, &remoteGateways); err != nil {
+		return err
+	}
+	reply.Gateways = serviceEndpoints(filterPassing(remoteGateways.Nodes), true)
+	if len(reply.Gateways) == 0 {
+		return nil
+	}
+
+	var gateways structs.IndexedCheckServiceNodes
+	reply.Index, gateways.Nodes = state.CheckServiceKindNodes(structs.ServiceKindMeshGateway)
+	if err := h.srv.filterACL(args.Token, &gateways); err != nil {
+		return err
+	}
+	reply.Endpoints = serviceEndpoints(filterPassing(gateways.Nodes), false)
+	return nil
+}
+
+// serviceEndpoints returns the addresses to dial to reach services. The
+// WAN addresses are used for the mesh gateways of another datacenter.
+func serviceEndpoints(nodes structs.CheckServiceNodes, wan bool) []structs.ServiceEndpoint {
+	out := make([]structs.ServiceEndpoint, 0, len(nodes))
+	for _, node := range nodes {
+		endpoint := structs.ServiceEndpoint{
+			Node:    node.Node.Node,
+			Address: node.Service.Address,
+			Port:    node.Service.Port,
+		}
+		if endpoint.Address == "" {
+			endpoint.Address = node.Node.Address
+		}
+		if wan && node.Service.WANAddress != "" {
+			endpoint.Address = node.Service.WANAddress
+		}
+		if wan && node.Service.WANPort != 0 {
+			endpoint.Port = node.Service.WANPort
+		}
+		out = append(out, endpoint)
+	}
+	return out
+}
+
+// filterPassing returns the service nodes whose checks are all passing.
+// The nodes are copied into a new slice, since they may be shared with
+// the query cache.
+func filterPassing(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+	out := make(structs.CheckServiceNodes, 0, len(nodes))
+OUTER:
+	for _, node := range nodes {
+		for _, check := range node.Checks {
+			if check.Status != structs.HealthPassing {
+				continue OUTER
+			}
+		}
+		out = append(out, node)
+	}
+	return out
+}
+
+// filterNodeMeta returns the service nodes whose node has all the given
+// metadata. The nodes are copied into a new slice, since they may be
+// shared with the query cache.
+func filterNodeMeta(nodes structs.CheckServiceNodes, filters map[string]string) structs.CheckServiceNodes {
+	out := make(structs.CheckServiceNodes, 0, len(nodes))
+OUTER:
+	for _, node := range nodes {
+		for k, v := range filters {
+			if value, ok := node.Node.Meta[k]; !ok || value != v {
+				continue OUTER
+			}
+		}
+		out = append(out, node)
+	}
+	return out
+}
+
+// filterServiceTag returns the service nodes whose service has the given
+// tag, compared case-insensitively like the tag index of the state store
+func filterServiceTag(nodes structs.CheckServiceNodes, tag string) structs.CheckServiceNodes {
+	out := make(structs.CheckServiceNodes, 0, len(nodes))
+	for _, node := range nodes {
+		if strContains(ToLowerList(node.Service.Tags), strings.ToLower(tag)) {
+			out = append(out, node)
+		}
+	}
+	return out
+}
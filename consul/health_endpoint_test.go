@@ -1,8 +1,11 @@
 package consul
 
 import (
+	"fmt"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
@@ -46,11 +49,12 @@ func TestHealth_ChecksInState(t *testing.T) {
 		t.Fatalf("Bad: %v", checks)
 	}
 
-	// First check is automatically added for the server node
-	if checks[0].CheckID != SerfCheckID {
+	// The check of the server node is automatically added, and the
+	// checks are ordered by node name
+	if checks[0].Name != "memory utilization" {
 		t.Fatalf("Bad: %v", checks[0])
 	}
-	if checks[1].Name != "memory utilization" {
+	if checks[1].CheckID != SerfCheckID {
 		t.Fatalf("Bad: %v", checks[1])
 	}
 }
@@ -205,26 +209,241 @@ func TestHealth_ServiceNodes(t *testing.T) {
 	if len(nodes) != 2 {
 		t.Fatalf("Bad: %v", nodes)
 	}
-	if nodes[0].Node.Node != "foo" {
+	if nodes[0].Node.Node != "bar" {
 		t.Fatalf("Bad: %v", nodes[0])
 	}
-	if nodes[1].Node.Node != "bar" {
+	if nodes[1].Node.Node != "foo" {
 		t.Fatalf("Bad: %v", nodes[1])
 	}
-	if !strContains(nodes[0].Service.Tags, "master") {
+	if !strContains(nodes[0].Service.Tags, "slave") {
 		t.Fatalf("Bad: %v", nodes[0])
 	}
-	if !strContains(nodes[1].Service.Tags, "slave") {
+	if !strContains(nodes[1].Service.Tags, "master") {
 		t.Fatalf("Bad: %v", nodes[1])
 	}
-	if nodes[0].Checks[0].Status != structs.HealthPassing {
+	if nodes[0].Checks[0].Status != structs.HealthWarning {
 		t.Fatalf("Bad: %v", nodes[0])
 	}
-	if nodes[1].Checks[0].Status != structs.HealthWarning {
+	if nodes[1].Checks[0].Status != structs.HealthPassing {
 		t.Fatalf("Bad: %v", nodes[1])
 	}
 }
 
+func TestHealth_ServiceNodes_NodeMetaFilter(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for node, zone := range map[string]string{"foo": "us-east-1a", "bar": "us-east-1b"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			NodeMeta:   map[string]string{"zone": zone, "rack": "r1"},
+			Service: &structs.NodeService{
+				Service: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req := structs.ServiceSpecificRequest{
+		Datacenter:      "dc1",
+		ServiceName:     "db",
+		NodeMetaFilters: map[string]string{"zone": "us-east-1a", "rack": "r1"},
+	}
+	var out structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 1 || out.Nodes[0].Node.Node != "foo" {
+		t.Fatalf("Bad: %v", out.Nodes)
+	}
+
+	// Every pair must match
+	req.NodeMetaFilters["rack"] = "r2"
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 0 {
+		t.Fatalf("Bad: %v", out.Nodes)
+	}
+
+	// The unfiltered query isn't affected by the filtered ones
+	req.NodeMetaFilters = nil
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 2 {
+		t.Fatalf("Bad: %v", out.Nodes)
+	}
+}
+
+func TestHealth_ServiceNodes_Paginate(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	state := s1.fsm.State()
+	for i, node := range []string{"foo", "bar"} {
+		state.EnsureNode(uint64(3*i+1), structs.Node{Node: node, Address: "127.0.0.1"})
+		state.EnsureService(uint64(3*i+2), node, &structs.NodeService{ID: "db", Service: "db"})
+		state.EnsureCheck(uint64(3*i+3), &structs.HealthCheck{
+			Node:      node,
+			CheckID:   "db",
+			Name:      "db",
+			Status:    structs.HealthPassing,
+			ServiceID: "db",
+		})
+	}
+
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	req.Limit = 1
+	var out structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 1 || out.Nodes[0].Node.Node != "bar" || len(out.Nodes[0].Checks) != 1 {
+		t.Fatalf("bad: %v", out)
+	}
+	if out.NextToken == "" {
+		t.Fatalf("missing next token")
+	}
+
+	req.NextToken = out.NextToken
+	out = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 1 || out.Nodes[0].Node.Node != "foo" || out.NextToken != "" {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestHealth_Summary(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	for i, status := range []string{structs.HealthPassing, structs.HealthCritical} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("node%d", i),
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+			},
+			Check: &structs.HealthCheck{
+				Name:      "db connect",
+				Status:    status,
+				ServiceID: "db",
+			},
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	req := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var out structs.IndexedServiceHealthSummaries
+	if err := msgpackrpc.CallWithCodec(codec, "Health.Summary", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index == 0 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The server registers the consul service too
+	var db *structs.ServiceHealthSummary
+	for _, summary := range out.Summaries {
+		if summary.Service == "db" {
+			db = summary
+		}
+	}
+	if db == nil || db.Passing != 1 || db.Warning != 0 || db.Critical != 1 {
+		t.Fatalf("bad: %v", out.Summaries)
+	}
+}
+
+func TestHealth_ServiceNodes_Blocking(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	var out2 structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Changes to another service don't wake the query, a check of the
+	// node of an instance does
+	state := s1.fsm.State()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		state.EnsureService(1000, "foo", &structs.NodeService{ID: "web", Service: "web"})
+		time.Sleep(200 * time.Millisecond)
+		state.EnsureCheck(1001, &structs.HealthCheck{Node: "foo", CheckID: "mem", Status: structs.HealthCritical})
+	}()
+
+	req.MinQueryIndex = out2.Index
+	req.MaxQueryTime = time.Second
+	start := time.Now()
+	out2 = structs.IndexedCheckServiceNodes{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ServiceNodes", &req, &out2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Now().Sub(start) < 300*time.Millisecond {
+		t.Fatalf("too fast")
+	}
+	if out2.Index != 1001 {
+		t.Fatalf("bad: %v", out2)
+	}
+	if len(out2.Nodes) != 1 || len(out2.Nodes[0].Checks) != 1 {
+		t.Fatalf("bad: %v", out2.Nodes)
+	}
+}
+
 func TestHealth_NodeChecks_FilterACL(t *testing.T) {
 	dir, token, srv, codec := testACLFilterServer(t)
 	defer os.RemoveAll(dir)
@@ -319,6 +538,34 @@ func TestHealth_ServiceNodes_FilterACL(t *testing.T) {
 	}
 }
 
+func TestHealth_Summary_FilterACL(t *testing.T) {
+	dir, token, srv, codec := testACLFilterServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+	defer codec.Close()
+
+	opt := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	reply := structs.IndexedServiceHealthSummaries{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.Summary", &opt, &reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	found := false
+	for _, summary := range reply.Summaries {
+		switch summary.Service {
+		case "foo":
+			found = true
+		case "bar":
+			t.Fatalf("bad: %#v", reply.Summaries)
+		}
+	}
+	if !found {
+		t.Fatalf("bad: %#v", reply.Summaries)
+	}
+}
+
 func TestHealth_ChecksInState_FilterACL(t *testing.T) {
 	dir, token, srv, codec := testACLFilterServer(t)
 	defer os.RemoveAll(dir)
@@ -348,3 +595,110 @@ func TestHealth_ChecksInState_FilterACL(t *testing.T) {
 		t.Fatalf("missing service 'foo': %#v", reply.HealthChecks)
 	}
 }
+
+func TestHealth_ResolveService(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDC(t, "dc2")
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s1.RPC, "dc2")
+
+	register := func(dc, node, address string, service *structs.NodeService) {
+		arg := structs.RegisterRequest{
+			Datacenter: dc,
+			Node:       node,
+			Address:    address,
+			Service:    service,
+		}
+		var out struct{}
+		if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	gateway := func(wanAddress string) *structs.NodeService {
+		return &structs.NodeService{
+			Service:    "mesh-gateway",
+			Port:       8443,
+			Kind:       structs.ServiceKindMeshGateway,
+			WANAddress: wanAddress,
+		}
+	}
+	proxy := &structs.NodeService{
+		Service: "db-proxy",
+		Port:    21000,
+		Kind:    structs.ServiceKindConnectProxy,
+		Proxy:   structs.ConnectProxyConfig{DestinationServiceName: "db"},
+	}
+	register("dc1", "gw1", "10.0.1.1", gateway(""))
+	register("dc1", "db1", "10.0.1.2", proxy)
+	register("dc2", "db2", "10.0.2.2", proxy)
+
+	// The mesh gateways are listed by kind
+	gwArgs := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var gateways structs.IndexedCheckServiceNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Health.MeshGateways", &gwArgs, &gateways); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(gateways.Nodes) != 1 || gateways.Nodes[0].Node.Node != "gw1" {
+		t.Fatalf("bad: %v", gateways)
+	}
+
+	// Within the datacenter, the proxies are dialed
+	args := structs.ServiceResolveRequest{Datacenter: "dc1", ServiceName: "db"}
+	var out structs.ServiceResolution
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ResolveService", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []structs.ServiceEndpoint{{Node: "db1", Address: "10.0.1.2", Port: 21000}}
+	if out.Datacenter != "dc1" || !reflect.DeepEqual(out.Endpoints, expected) || len(out.Gateways) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Without a gateway in dc2, the service can't be reached
+	args.TargetDatacenter = "dc2"
+	out = structs.ServiceResolution{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ResolveService", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Datacenter != "dc2" || len(out.Endpoints) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Through the gateways, the local ones are dialed, and forward to
+	// the WAN addresses of the remote ones
+	register("dc2", "gw2", "10.0.2.1", gateway("198.51.100.2"))
+	out = structs.ServiceResolution{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ResolveService", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected = []structs.ServiceEndpoint{{Node: "gw1", Address: "10.0.1.1", Port: 8443}}
+	if !reflect.DeepEqual(out.Endpoints, expected) {
+		t.Fatalf("bad: %#v", out.Endpoints)
+	}
+	expected = []structs.ServiceEndpoint{{Node: "gw2", Address: "198.51.100.2", Port: 8443}}
+	if !reflect.DeepEqual(out.Gateways, expected) {
+		t.Fatalf("bad: %#v", out.Gateways)
+	}
+
+	// An unknown service can't be reached
+	args.ServiceName = "web"
+	out = structs.ServiceResolution{}
+	if err := msgpackrpc.CallWithCodec(codec, "Health.ResolveService", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Endpoints) != 0 || len(out.Gateways) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
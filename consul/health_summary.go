@@ -0,0 +1,246 @@
+package consul
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// instanceHealth is the health of a service instance
+type instanceHealth struct {
+	service string
+	status  string
+}
+
+// healthSummary counts the instances of each service by health, so
+// dashboards can poll the health of every service without pulling the
+// instance lists. It is built by the first query, and then maintained
+// incrementally: a write only recomputes the instances of the nodes it
+// touched, which is cheap since a node has few services and checks.
+type healthSummary struct {
+	l     sync.Mutex
+	built bool
+
+	// index is the index of the tables the summary reflects. The
+	// summary is updated once a write has committed, so the index of
+	// the tables may briefly be ahead of it.
+	index uint64
+
+	nodes    map[string]map[string]instanceHealth // Node to service ID
+	services map[string]*structs.ServiceHealthSummary
+}
+
+// newHealthSummary creates a summary that is built by the first query
+func newHealthSummary() *healthSummary {
+	return &healthSummary{}
+}
+
+// reset empties the summary. Must be called with the lock held.
+func (h *healthSummary) reset() {
+	h.built = false
+	h.index = 0
+	h.nodes = make(map[string]map[string]instanceHealth)
+	h.services = make(map[string]*structs.ServiceHealthSummary)
+}
+
+// setNode replaces the instances of a node. Must be called with the lock
+// held.
+func (h *healthSummary) setNode(node string, instances map[string]instanceHealth) {
+	for _, inst := range h.nodes[node] {
+		h.count(inst, -1)
+	}
+	for _, inst := range instances {
+		h.count(inst, 1)
+	}
+	if len(instances) == 0 {
+		delete(h.nodes, node)
+	} else {
+		h.nodes[node] = instances
+	}
+}
+
+// count adds delta instances of a service in a state. A service without
+// any instance left is removed.
+func (h *healthSummary) count(inst instanceHealth, delta int) {
+	summary, ok := h.services[inst.service]
+	if !ok {
+		summary = &structs.ServiceHealthSummary{Service: inst.service}
+		h.services[inst.service] = summary
+	}
+	switch inst.status {
+	case structs.HealthPassing:
+		summary.Passing += delta
+	case structs.HealthWarning:
+		summary.Warning += delta
+	default:
+		summary.Critical += delta
+	}
+	if summary.Passing+summary.Warning+summary.Critical == 0 {
+		delete(h.services, inst.service)
+	}
+}
+
+// worseHealth returns the worse of two check states. An unknown state,
+// from a check that hasn't run yet, is treated as a warning.
+func worseHealth(a, b string) string {
+	rank := func(status string) int {
+		switch status {
+		case "", structs.HealthPassing:
+			return 0
+		case structs.HealthCritical:
+			return 2
+		default:
+			return 1
+		}
+	}
+	worst := a
+	if rank(b) > rank(a) {
+		worst = b
+	}
+	switch rank(worst) {
+	case 0:
+		return structs.HealthPassing
+	case 1:
+		return structs.HealthWarning
+	default:
+		return structs.HealthCritical
+	}
+}
+
+// nodeHealthTxn computes the health of the service instances of a node.
+// An instance is as healthy as the worst of its checks and of the checks
+// of its node.
+func (s *StateStore) nodeHealthTxn(tx *MDBTxn, node string) (map[string]instanceHealth, error) {
+	services, err := s.serviceTable.GetTxn(tx, "id", node)
+	if err != nil || len(services) == 0 {
+		return nil, err
+	}
+	checks, err := s.checkTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeStatus := structs.HealthPassing
+	serviceStatus := make(map[string]string)
+	for _, r := range checks {
+		check := r.(*structs.HealthCheck)
+		if check.ServiceID == "" {
+			nodeStatus = worseHealth(nodeStatus, check.Status)
+		} else {
+			serviceStatus[check.ServiceID] = worseHealth(serviceStatus[check.ServiceID], check.Status)
+		}
+	}
+
+	instances := make(map[string]instanceHealth, len(services))
+	for _, r := range services {
+		srv := r.(*structs.ServiceNode)
+		instances[srv.ServiceID] = instanceHealth{
+			service: srv.ServiceName,
+			status:  worseHealth(nodeStatus, serviceStatus[srv.ServiceID]),
+		}
+	}
+	return instances, nil
+}
+
+// buildHealthSummaryTxn computes the summary of every node. Must be
+// called with the lock of the summary held.
+func (s *StateStore) buildHealthSummaryTxn(tx *MDBTxn) error {
+	h := s.healthSummary
+	h.reset()
+	res, err := s.serviceTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	nodes := make(map[string]struct{})
+	for _, r := range res {
+		nodes[r.(*structs.ServiceNode).Node] = struct{}{}
+	}
+	for node := range nodes {
+		instances, err := s.nodeHealthTxn(tx, node)
+		if err != nil {
+			return err
+		}
+		h.setNode(node, instances)
+	}
+	h.built = true
+	return nil
+}
+
+// updateHealthSummary recomputes the instances of the nodes changed by
+// committed writes. Nothing is done until the summary is built. On
+// failure, the summary is dropped, and rebuilt by the next query.
+func (s *StateStore) updateHealthSummary(nodes map[string]struct{}) {
+	h := s.healthSummary
+	h.l.Lock()
+	defer h.l.Unlock()
+	if !h.built {
+		return
+	}
+
+	tables := s.queryTables["HealthSummary"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		s.logger.Error("Failed to update the health summary", "error", err)
+		h.reset()
+		return
+	}
+	defer tx.Abort()
+
+	for node := range nodes {
+		instances, err := s.nodeHealthTxn(tx, node)
+		if err != nil {
+			s.logger.Error("Failed to update the health summary", "node", node, "error", err)
+			h.reset()
+			return
+		}
+		h.setNode(node, instances)
+	}
+	if idx, err := tables.LastIndexTxn(tx); err == nil {
+		h.index = idx
+	}
+}
+
+// HealthSummary returns the number of passing, warning and critical
+// instances of each service, sorted by service name. Instances in an
+// unknown state are counted as warning.
+func (s *StateStore) HealthSummary() (uint64, structs.ServiceHealthSummaries, error) {
+	defer s.measureQuery("HealthSummary", time.Now())
+	h := s.healthSummary
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if !h.built {
+		tables := s.queryTables["HealthSummary"]
+		tx, err := tables.StartTxn(true)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer tx.Abort()
+
+		if err := s.buildHealthSummaryTxn(tx); err != nil {
+			h.reset()
+			return 0, nil, err
+		}
+		if h.index, err = tables.LastIndexTxn(tx); err != nil {
+			h.reset()
+			return 0, nil, err
+		}
+	}
+
+	// Copy the counts, which keep changing
+	out := make(structs.ServiceHealthSummaries, 0, len(h.services))
+	for _, summary := range h.services {
+		entry := *summary
+		out = append(out, &entry)
+	}
+	sort.Sort(healthSummariesByService(out))
+	return h.index, out, nil
+}
+
+type healthSummariesByService structs.ServiceHealthSummaries
+
+func (h healthSummariesByService) Len() int           { return len(h) }
+func (h healthSummariesByService) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h healthSummariesByService) Less(i, j int) bool { return h[i].Service < h[j].Service }
@@ -0,0 +1,96 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestWorseHealth(t *testing.T) {
+	cases := []struct {
+		a, b, expect string
+	}{
+		{"", structs.HealthPassing, structs.HealthPassing},
+		{structs.HealthPassing, structs.HealthUnknown, structs.HealthWarning},
+		{structs.HealthCritical, structs.HealthWarning, structs.HealthCritical},
+		{structs.HealthWarning, structs.HealthPassing, structs.HealthWarning},
+	}
+	for _, c := range cases {
+		if out := worseHealth(c.a, c.b); out != c.expect {
+			t.Fatalf("bad: %s %s: %s", c.a, c.b, out)
+		}
+	}
+}
+
+func TestStateStore_HealthSummary(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	expect := func(idx uint64, summaries ...structs.ServiceHealthSummary) {
+		i, out, err := store.HealthSummary()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if i != idx {
+			t.Fatalf("bad: %d", i)
+		}
+		var got []structs.ServiceHealthSummary
+		for _, s := range out {
+			got = append(got, *s)
+		}
+		if !reflect.DeepEqual(got, summaries) {
+			t.Fatalf("bad: %v", got)
+		}
+	}
+
+	// Built on the first query
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "web1", Service: "web", Port: 80}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect(2, structs.ServiceHealthSummary{Service: "web", Passing: 1})
+
+	// Then maintained by the writes
+	if err := store.EnsureService(3, "foo", &structs.NodeService{ID: "db1", Service: "db", Port: 5432}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureCheck(4, &structs.HealthCheck{Node: "foo", CheckID: "db", ServiceID: "db1", Status: structs.HealthWarning}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect(4,
+		structs.ServiceHealthSummary{Service: "db", Warning: 1},
+		structs.ServiceHealthSummary{Service: "web", Passing: 1})
+
+	// A node check affects every instance of the node
+	if err := store.EnsureCheck(5, &structs.HealthCheck{Node: "foo", CheckID: "mem", Status: structs.HealthCritical}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(6, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(7, "bar", &structs.NodeService{ID: "web1", Service: "web", Port: 80}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect(7,
+		structs.ServiceHealthSummary{Service: "db", Critical: 1},
+		structs.ServiceHealthSummary{Service: "web", Passing: 1, Critical: 1})
+
+	if err := store.DeleteNodeCheck(8, "foo", "mem"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNodeService(9, "foo", "db1"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect(9, structs.ServiceHealthSummary{Service: "web", Passing: 2})
+
+	if err := store.DeleteNode(10, "bar"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect(10, structs.ServiceHealthSummary{Service: "web", Passing: 1})
+}
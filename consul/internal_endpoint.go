@@ -164,3 +164,25 @@ func (m *Internal) executeKeyringOp(
 		Error:      errStr,
 	})
 }
+
+// WatchStats is used to get the watchers of the tables and KV prefixes
+// of a server, and how often they were woken up, to find the keys that
+// cause storms of blocking queries. The leader answers, unless a stale
+// read is allowed. It requires a management token.
+func (m *Internal) WatchStats(args *structs.WatchStatsRequest,
+	reply *structs.WatchStats) error {
+	if done, err := m.srv.forward("Internal.WatchStats", args, args, reply); done {
+		return err
+	}
+
+	acl, err := m.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	*reply = *m.srv.fsm.State().WatchStats(args.Limit)
+	reply.Server = m.srv.config.NodeName
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/consul/consul/structs"
@@ -361,3 +362,36 @@ func TestInternal_EventFire_Token(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 }
+
+func TestInternal_WatchStats(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A management token is required
+	args := structs.WatchStatsRequest{Datacenter: "dc1"}
+	var stats structs.WatchStats
+	err := msgpackrpc.CallWithCodec(codec, "Internal.WatchStats", &args, &stats)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Internal.WatchStats", &args, &stats); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.Server != s1.config.NodeName {
+		t.Fatalf("bad: %v", stats.Server)
+	}
+	if _, ok := stats.Watchers[dbKVS]; !ok {
+		t.Fatalf("bad: %v", stats.Watchers)
+	}
+}
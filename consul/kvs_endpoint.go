@@ -43,12 +43,10 @@ func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 		}
 	}
 
-	// If this is a lock, we must check for a lock-delay. Since lock-delay
-	// is based on wall-time, each peer expire the lock-delay at a slightly
-	// different time. This means the enforcement of lock-delay cannot be done
-	// after the raft log is committed as it would lead to inconsistent FSMs.
-	// Instead, the lock-delay must be enforced before commit. This means that
-	// only the wall-time of the leader node is used, preventing any inconsistencies.
+	// If this is a lock, check for a lock-delay to avoid a pointless commit.
+	// The FSM rejects locks until the leader has expired the lock-delay window,
+	// so only the wall-time of the leader node is used, preventing any
+	// inconsistencies.
 	if args.Op == structs.KVSLock {
 		state := k.srv.fsm.State()
 		expires := state.KVSLockDelay(args.DirEnt.Key)
@@ -122,12 +120,50 @@ func (k *KVS) Get(args *structs.KeyRequest, reply *structs.IndexedDirEntries) er
 	return k.srv.blockingRPCOpt(&opts)
 }
 
-// List is used to list all keys with a given prefix
+// GetAtIndex is used to look up a key as it existed at a Raft index,
+// from the KV history. It does not block, since the answer for a past
+// index doesn't change, except when the history is reaped.
+func (k *KVS) GetAtIndex(args *structs.KeyAtIndexRequest, reply *structs.IndexedDirEntries) error {
+	if done, err := k.srv.forward("KVS.GetAtIndex", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	index, ent, err := k.srv.fsm.State().KVSGetAtIndex(args.Key, args.AtIndex)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.KeyRead(args.Key) {
+		ent = nil
+	}
+	if ent != nil {
+		reply.Entries = structs.DirEntries{ent}
+	}
+	reply.Index = index
+	k.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// List is used to list all keys with a given prefix, or matching a
+// glob pattern
 func (k *KVS) List(args *structs.KeyRequest, reply *structs.IndexedDirEntries) error {
 	if done, err := k.srv.forward("KVS.List", args, args, reply); done {
 		return err
 	}
 
+	// A pattern is listed from its literal prefix
+	prefix := args.Key
+	if args.Glob {
+		if !validGlob(args.Key) {
+			return fmt.Errorf("Invalid glob pattern '%s'", args.Key)
+		}
+		prefix = globPrefix(args.Key)
+	}
+
 	acl, err := k.srv.resolveToken(args.Token)
 	if err != nil {
 		return err
@@ -140,14 +176,27 @@ func (k *KVS) List(args *structs.KeyRequest, reply *structs.IndexedDirEntries) e
 		queryMeta: &reply.QueryMeta,
 		kvWatch:   true,
 		kvPrefix:  args.Key,
+		kvGlob:    args.Glob,
 		run: func() error {
-			tombIndex, index, ent, err := state.KVSList(args.Key)
+			tombIndex, index, ent, err := state.KVSList(prefix)
 			if err != nil {
 				return err
 			}
+			if args.Glob {
+				var matched structs.DirEntries
+				for _, e := range ent {
+					if globMatch(args.Key, e.Key) {
+						matched = append(matched, e)
+					}
+				}
+				ent = matched
+			}
 			if acl != nil {
 				ent = FilterDirEnt(acl, ent)
 			}
+			if err := sortDirEntries(ent, args.SortBy); err != nil {
+				return err
+			}
 
 			if len(ent) == 0 {
 				// Must provide non-zero index to prevent blocking
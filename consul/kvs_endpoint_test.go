@@ -176,6 +176,138 @@ func TestKVS_Get(t *testing.T) {
 	}
 }
 
+func TestKVS_GetAtIndex(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSHistoryVersions = 5
+		c.KVSHistoryTTL = 100 * time.Millisecond
+		c.TombstoneTTLGranularity = 10 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The leader commits the retention of its configuration
+	testutil.WaitForResult(func() (bool, error) {
+		_, retention, err := s1.fsm.State().Retention()
+		return retention != nil && retention.KVSHistoryVersions == 5, err
+	}, func(err error) {
+		t.Fatalf("should commit the retention: %v", err)
+	})
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("one"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err := s1.fsm.State().KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first := d.ModifyIndex
+	arg.DirEnt.Value = []byte("two")
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	getR := structs.KeyAtIndexRequest{
+		Datacenter: "dc1",
+		Key:        "test",
+		AtIndex:    first,
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.GetAtIndex", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 1 || string(dirent.Entries[0].Value) != "one" {
+		t.Fatalf("bad: %v", dirent)
+	}
+
+	// The leader reaps the version once the TTL passes
+	testutil.WaitForResult(func() (bool, error) {
+		var dirent structs.IndexedDirEntries
+		err := msgpackrpc.CallWithCodec(codec, "KVS.GetAtIndex", &getR, &dirent)
+		return err != nil && strings.Contains(err.Error(), "not retained"), err
+	}, func(err error) {
+		t.Fatalf("should be reaped: %v", err)
+	})
+}
+
+func TestKVS_Get_MinAppliedIndex(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("test"),
+		},
+	}
+	var out bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The applied index covers the write
+	var applied uint64
+	statusArgs := structs.DCSpecificRequest{Datacenter: "dc1"}
+	if err := msgpackrpc.CallWithCodec(codec, "Status.AppliedIndex", &statusArgs, &applied); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err := s1.fsm.State().KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if applied < d.ModifyIndex {
+		t.Fatalf("bad: %d %d", applied, d.ModifyIndex)
+	}
+
+	// A stale read at the applied index observes the write
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "test",
+		QueryOptions: structs.QueryOptions{
+			AllowStale:      true,
+			MinAppliedIndex: applied,
+		},
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Get", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 1 || string(dirent.Entries[0].Value) != "test" {
+		t.Fatalf("bad: %v", dirent)
+	}
+
+	// A read waiting for a future index times out
+	getR.MinAppliedIndex = applied + 1000
+	getR.MaxQueryTime = 50 * time.Millisecond
+	start := time.Now()
+	err = msgpackrpc.CallWithCodec(codec, "KVS.Get", &getR, &dirent)
+	if err == nil || !strings.Contains(err.Error(), "Timed out waiting for index") {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Now().Sub(start) < 50*time.Millisecond {
+		t.Fatalf("should wait")
+	}
+}
+
 func TestKVS_Get_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -375,6 +507,96 @@ func TestKVSEndpoint_List_Blocking(t *testing.T) {
 	}
 }
 
+func TestKVSEndpoint_List_Glob(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	keys := []string{
+		"config/api/database",
+		"config/api/database/host",
+		"config/web/cache",
+		"config/web/database",
+	}
+	for _, key := range keys {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key: key,
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "config/*/database",
+		Glob:       true,
+	}
+	var dirent structs.IndexedDirEntries
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var got []string
+	for _, d := range dirent.Entries {
+		got = append(got, d.Key)
+	}
+	expected := []string{"config/api/database", "config/api/database/host", "config/web/database"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// A blocking query wakes up on a matching change
+	getR.MinQueryIndex = dirent.Index
+	getR.MaxQueryTime = time.Second
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		codec := rpcClient(t, s1)
+		defer codec.Close()
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key: "config/db/database",
+			},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}()
+	dirent = structs.IndexedDirEntries{}
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 100*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if len(dirent.Entries) != 4 {
+		t.Fatalf("bad: %v", dirent.Entries)
+	}
+
+	// A malformed pattern is rejected
+	getR = structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "config/[",
+		Glob:       true,
+	}
+	err := msgpackrpc.CallWithCodec(codec, "KVS.List", &getR, &dirent)
+	if err == nil || !strings.Contains(err.Error(), "Invalid glob pattern") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestKVSEndpoint_List_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -605,7 +827,7 @@ func TestKVS_Apply_LockDelay(t *testing.T) {
 
 	// Create and invalidate a session with a lock
 	state := s1.fsm.State()
-	if err := state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{
@@ -654,13 +876,15 @@ func TestKVS_Apply_LockDelay(t *testing.T) {
 	// Wait for lock-delay
 	time.Sleep(50 * time.Millisecond)
 
-	// Should acquire
-	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	if out != true {
-		t.Fatalf("should acquire")
-	}
+	// Should acquire once the leader commits the expiration
+	testutil.WaitForResult(func() (bool, error) {
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			return false, err
+		}
+		return out, nil
+	}, func(err error) {
+		t.Fatalf("should acquire: %v", err)
+	})
 }
 
 var testListRules = `
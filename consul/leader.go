@@ -86,6 +86,37 @@ RECONCILE:
 			goto WAIT
 		}
 		establishedLeader = true
+
+		// Start bridging state changes to user events
+		s.startEventBridge(stopCh)
+
+		// Start expiring lock delay windows
+		go s.expireLockDelays(stopCh)
+
+		// Start delivering the outbox
+		go s.dispatchOutbox(stopCh)
+
+		// Start deregistering the services left critical too long
+		go s.reapCriticalServices(stopCh)
+
+		// Start lifting the maintenance flags once they expire
+		go s.expireMaintenance(stopCh)
+
+		// Start managing the servers
+		go s.runAutopilot(stopCh)
+
+		// Start replicating the ACLs of the ACL datacenter
+		if s.aclReplicationEnabled() {
+			go s.runACLReplication(stopCh)
+		}
+
+		// Start pulling the services exported by the peers
+		go s.runPeering(stopCh)
+	}
+
+	// Trim the catalog audit table to the committed limit
+	if err := s.trimCatalogAudit(); err != nil {
+		s.logger.Printf("[ERR] consul: failed to trim the catalog audit: %v", err)
 	}
 
 	// Reconcile any missing data
@@ -99,6 +130,12 @@ RECONCILE:
 	reconcileCh = s.reconcileCh
 
 WAIT:
+	// The KV history is only reaped if a history TTL is set
+	var historyExpireCh <-chan uint64
+	if s.kvsHistoryGC != nil {
+		historyExpireCh = s.kvsHistoryGC.ExpireCh()
+	}
+
 	// Periodically reconcile as long as we are the leader,
 	// or when Serf events arrive
 	for {
@@ -113,6 +150,8 @@ WAIT:
 			s.reconcileMember(member)
 		case index := <-s.tombstoneGC.ExpireCh():
 			go s.reapTombstones(index)
+		case index := <-historyExpireCh:
+			go s.reapKVSHistory(index)
 		}
 	}
 }
@@ -130,6 +169,13 @@ func (s *Server) establishLeadership() error {
 	s.tombstoneGC.Hint(lastIndex)
 	s.logger.Printf("[DEBUG] consul: reset tombstone GC to index %d", lastIndex)
 
+	// The KV history versions recorded before we became leader are
+	// reaped a TTL from now, since the previous leader's clock is lost
+	if s.kvsHistoryGC != nil {
+		s.kvsHistoryGC.SetEnabled(true)
+		s.kvsHistoryGC.Hint(lastIndex)
+	}
+
 	// Setup ACLs if we are the leader and need to
 	if err := s.initializeACL(); err != nil {
 		s.logger.Printf("[ERR] consul: ACL initialization failed: %v", err)
@@ -150,6 +196,19 @@ func (s *Server) establishLeadership() error {
 			err)
 		return err
 	}
+
+	// Commit the retention of our configuration, so that all the
+	// servers retain the same history
+	if err := s.syncRetention(); err != nil {
+		s.logger.Printf("[ERR] consul: Retention sync failed: %v", err)
+		return err
+	}
+
+	// Commit the configured outbox subscriptions
+	if err := s.syncOutboxSubscriptions(); err != nil {
+		s.logger.Printf("[ERR] consul: Outbox subscription sync failed: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -158,6 +217,9 @@ func (s *Server) establishLeadership() error {
 func (s *Server) revokeLeadership() error {
 	// Disable the tombstone GC, since it is only useful as a leader
 	s.tombstoneGC.SetEnabled(false)
+	if s.kvsHistoryGC != nil {
+		s.kvsHistoryGC.SetEnabled(false)
+	}
 
 	// Clear the session timers on either shutdown or step down, since we
 	// are no longer responsible for session expirations.
@@ -519,8 +581,24 @@ func (s *Server) joinConsulServer(m serf.Member, parts *serverParts) error {
 		}
 	}
 
-	// Attempt to add as a peer
+	// New servers are only added once autopilot finds them stable
 	var addr net.Addr = &net.TCPAddr{IP: m.Addr, Port: parts.Port}
+	peers, err := s.raftPeers.Peers()
+	if err != nil {
+		return err
+	}
+	if !raft.PeerContained(peers, addr.String()) {
+		stable, err := s.serverStable(m.Name)
+		if err != nil {
+			return err
+		}
+		if !stable {
+			s.logger.Printf("[DEBUG] consul: waiting for server '%s' to be stable before adding it as peer", m.Name)
+			return nil
+		}
+	}
+
+	// Attempt to add as a peer
 	future := s.raft.AddPeer(addr.String())
 	if err := future.Error(); err != nil && err != raft.ErrKnownPeer {
 		s.logger.Printf("[ERR] consul: failed to add raft peer: %v", err)
@@ -544,6 +622,25 @@ func (s *Server) removeConsulServer(m serf.Member, port int) error {
 	return nil
 }
 
+// reapKVSHistory is invoked by the current leader to reap the versions
+// of the KV history recorded at or before the index, once they are older
+// than the history TTL. Like reapTombstones, the reap goes through Raft
+// so that all the servers retain the same versions.
+func (s *Server) reapKVSHistory(index uint64) {
+	defer metrics.MeasureSince([]string{"consul", "leader", "reapKVSHistory"}, time.Now())
+	req := structs.KVSHistoryRequest{
+		Datacenter:   s.config.Datacenter,
+		Op:           structs.KVSHistoryReap,
+		ReapIndex:    index,
+		WriteRequest: structs.WriteRequest{Token: s.config.ACLToken},
+	}
+	_, err := s.raftApply(structs.KVSHistoryRequestType, &req)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to reap KV history up to %d: %v",
+			index, err)
+	}
+}
+
 // reapTombstones is invoked by the current leader to manage garbage
 // collection of tombstones. When a key is deleted, we trigger a tombstone
 // GC clock. Once the expiration is reached, this routine is invoked
@@ -559,3 +559,122 @@ func TestLeader_ReapTombstones(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	})
 }
+
+func TestLeader_ReapCriticalServices(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Register a service with a critical check, and one that is kept
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+		},
+		Check: &structs.HealthCheck{
+			CheckID:                        "db",
+			Name:                           "db",
+			Status:                         structs.HealthCritical,
+			ServiceID:                      "db",
+			DeregisterCriticalServiceAfter: 100 * time.Millisecond,
+		},
+	}
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Service = &structs.NodeService{
+		ID:      "web",
+		Service: "web",
+	}
+	arg.Check = &structs.HealthCheck{
+		CheckID:   "web",
+		Name:      "web",
+		Status:    structs.HealthCritical,
+		ServiceID: "web",
+	}
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The critical service should be deregistered
+	state := s1.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, services := state.NodeServices("foo")
+		_, ok := services.Services["db"]
+		return !ok, nil
+	}, func(err error) {
+		t.Fatalf("service should be deregistered")
+	})
+
+	_, services := state.NodeServices("foo")
+	if _, ok := services.Services["web"]; !ok {
+		t.Fatalf("bad: %#v", services)
+	}
+	_, checks := state.NodeChecks("foo")
+	if len(checks) != 1 || checks[0].CheckID != "web" {
+		t.Fatalf("bad: %#v", checks)
+	}
+}
+
+func TestLeader_TrimCatalogAudit(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CatalogAuditLimit = 2
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		_, retention, err := s1.fsm.State().Retention()
+		return retention != nil && retention.CatalogAuditLimit == 2, err
+	}, func(err error) {
+		t.Fatalf("should commit the retention: %v", err)
+	})
+
+	// Wait for the leader to register itself, which is audited too
+	testutil.WaitForResult(func() (bool, error) {
+		_, found, _ := s1.fsm.State().GetNode(s1.config.NodeName)
+		return found, nil
+	}, func(err error) {
+		t.Fatalf("should register the leader")
+	})
+
+	for i := 0; i < 4; i++ {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       fmt.Sprintf("node%d", i),
+			Address:    "127.0.0.1",
+		}
+		var out struct{}
+		if err := s1.RPC("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The records beyond the limit are kept until the leader trims them
+	state := s1.fsm.State()
+	_, audits, err := state.CatalogAuditList("", 0, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(audits) < 4 {
+		t.Fatalf("bad: %v", audits)
+	}
+	if err := s1.trimCatalogAudit(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, audits, err = state.CatalogAuditList("", 0, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(audits) != 2 || audits[1].Node != "node3" {
+		t.Fatalf("bad: %v", audits)
+	}
+}
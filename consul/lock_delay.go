@@ -0,0 +1,115 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// lockDelayInterval is how often the open lock delay windows are
+	// re-scanned even when no watch has fired. This covers the state
+	// store being swapped out by a snapshot restore.
+	lockDelayInterval = 30 * time.Second
+
+	// lockDelayRetry is how long to wait before retrying a failed
+	// expiration of a lock delay window
+	lockDelayRetry = time.Second
+)
+
+// lockDelayWindow identifies a lock delay window
+type lockDelayWindow struct {
+	key     string
+	session string
+}
+
+// expireLockDelays runs while we are the leader, and schedules the
+// expiration of each open lock delay window. Windows are only closed by
+// committing a LockDelayExpire, so that every server agrees on when a
+// key can be locked again. On a leader change, the new leader uses its
+// own view of when each window expires.
+func (s *Server) expireLockDelays(stopCh chan struct{}) {
+	timers := make(map[lockDelayWindow]*time.Timer)
+	defer func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}()
+
+	expireCh := make(chan lockDelayWindow, 128)
+	schedule := func(w lockDelayWindow, wait time.Duration) *time.Timer {
+		return time.AfterFunc(wait, func() {
+			select {
+			case expireCh <- w:
+			case <-stopCh:
+			}
+		})
+	}
+
+	notify := make(chan struct{}, 1)
+	for {
+		// Register the watch, it is cleared once it fires
+		state := s.fsm.State()
+		tables := state.QueryTables("LockDelays")
+		state.Watch(tables, notify)
+
+		_, delays, err := state.LockDelays()
+		if err != nil {
+			s.logger.Printf("[ERR] consul: Failed to list lock delays: %v", err)
+		}
+		open := make(map[lockDelayWindow]struct{}, len(delays))
+		for _, d := range delays {
+			w := lockDelayWindow{d.Key, d.Session}
+			open[w] = struct{}{}
+			if _, ok := timers[w]; ok {
+				continue
+			}
+			wait := d.Delay
+			if expires := state.LockDelayExpires(d.Key, d.Session); !expires.IsZero() {
+				wait = expires.Sub(time.Now())
+			}
+			timers[w] = schedule(w, wait)
+		}
+
+		// Stop tracking windows that have been closed
+		for w, t := range timers {
+			if _, ok := open[w]; !ok {
+				t.Stop()
+				delete(timers, w)
+			}
+		}
+
+		select {
+		case <-notify:
+		case w := <-expireCh:
+			if err := s.expireLockDelay(w); err != nil {
+				s.logger.Printf("[ERR] consul: Failed to expire lock delay on '%s': %v", w.key, err)
+				timers[w] = schedule(w, lockDelayRetry)
+			}
+		case <-time.After(lockDelayInterval):
+		case <-stopCh:
+			state.StopWatch(tables, notify)
+			return
+		}
+	}
+}
+
+// expireLockDelay commits the expiration of a lock delay window
+func (s *Server) expireLockDelay(w lockDelayWindow) error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "expireLockDelay"}, time.Now())
+	args := structs.LockDelayRequest{
+		Datacenter: s.config.Datacenter,
+		Op:         structs.LockDelayExpire,
+		Key:        w.key,
+		Session:    w.session,
+	}
+	resp, err := s.raftApply(structs.LockDelayRequestType, &args)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
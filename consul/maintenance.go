@@ -0,0 +1,248 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// maintenanceExpireInterval is how often the maintenance flags are
+	// re-scanned for expiry even when none is due. This covers the state
+	// store being swapped out by a snapshot restore.
+	maintenanceExpireInterval = 30 * time.Second
+
+	// MaintenanceCheckID is the ID of the critical check kept for the
+	// maintenance flag of a node. The checks of the flags of services
+	// append the service ID after a colon. They differ from the IDs of
+	// the agent's own maintenance checks, so both can coexist.
+	MaintenanceCheckID = "_maintenance"
+
+	defaultNodeMaintenanceReason = "Maintenance mode is enabled for this node, " +
+		"but no reason was provided."
+	defaultServiceMaintenanceReason = "Maintenance mode is enabled for this " +
+		"service, but no reason was provided."
+)
+
+// maintenanceCheckID returns the ID of the check of the maintenance flag
+// of a node, or of one of its services
+func maintenanceCheckID(serviceID string) string {
+	if serviceID == "" {
+		return MaintenanceCheckID
+	}
+	return MaintenanceCheckID + ":" + serviceID
+}
+
+// IsMaintenanceCheck returns if a check is kept for a maintenance flag.
+// Agents must leave these checks alone during anti-entropy.
+func IsMaintenanceCheck(checkID string) bool {
+	return checkID == MaintenanceCheckID ||
+		strings.HasPrefix(checkID, MaintenanceCheckID+":")
+}
+
+// maintenanceFields returns the id index values of a maintenance flag
+func maintenanceFields(obj interface{}) ([]string, error) {
+	m, ok := obj.(*structs.Maintenance)
+	if !ok {
+		return nil, fmt.Errorf("Not a maintenance flag: %#v", obj)
+	}
+	return targetID(m.Node, m.ServiceID), nil
+}
+
+// MaintenanceEnable is used to put a node, or one of its services, in
+// maintenance mode, along with its critical check. Enabling it again
+// updates the reason and the expiry.
+func (s *StateStore) MaintenanceEnable(index uint64, m *structs.Maintenance) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.maintTable.GetTxn(tx, "id", targetID(m.Node, m.ServiceID)...)
+	if err != nil {
+		return err
+	}
+	m.CreateIndex = index
+	if len(res) > 0 {
+		m.CreateIndex = res[0].(*structs.Maintenance).CreateIndex
+	}
+	m.ModifyIndex = index
+
+	// The check verifies the node and service exist
+	check := &structs.HealthCheck{
+		Node:      m.Node,
+		CheckID:   maintenanceCheckID(m.ServiceID),
+		Name:      "Maintenance Mode",
+		Status:    structs.HealthCritical,
+		Notes:     m.Reason,
+		ServiceID: m.ServiceID,
+	}
+	if check.Notes == "" {
+		if m.ServiceID == "" {
+			check.Notes = defaultNodeMaintenanceReason
+		} else {
+			check.Notes = defaultServiceMaintenanceReason
+		}
+	}
+	if err := s.ensureCheckTxn(index, check, tx); err != nil {
+		return err
+	}
+
+	if err := s.maintTable.InsertTxn(tx, m); err != nil {
+		return err
+	}
+	if err := s.maintTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.maintTable)
+	return tx.Commit()
+}
+
+// MaintenanceDisable is used to take a node, or one of its services, out
+// of maintenance mode. If the ModifyIndex of the flag is set, it is only
+// disabled if unchanged since, otherwise false is returned.
+func (s *StateStore) MaintenanceDisable(index uint64, m *structs.Maintenance) (bool, error) {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	if m.ModifyIndex != 0 {
+		res, err := s.maintTable.GetTxn(tx, "id", targetID(m.Node, m.ServiceID)...)
+		if err != nil {
+			return false, err
+		}
+		if len(res) == 0 || res[0].(*structs.Maintenance).ModifyIndex != m.ModifyIndex {
+			return false, nil
+		}
+	}
+
+	if err := s.deleteNodeCheckTxn(index, tx, m.Node, maintenanceCheckID(m.ServiceID)); err != nil {
+		return false, err
+	}
+	if err := s.deleteMaintenanceTxn(index, tx, "id", targetID(m.Node, m.ServiceID)...); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// deleteMaintenanceTxn deletes the maintenance flags matching an index of
+// the maintenance table within a given txn. Their checks are left to the
+// caller.
+func (s *StateStore) deleteMaintenanceTxn(index uint64, tx *MDBTxn, idx string, parts ...string) error {
+	if n, err := s.maintTable.DeleteTxn(tx, idx, parts...); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.maintTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		s.notifyTables(tx, s.maintTable)
+	}
+	return nil
+}
+
+// MaintenanceGet is used to get the maintenance flag of a node, or of one
+// of its services
+func (s *StateStore) MaintenanceGet(node, serviceID string) (uint64, *structs.Maintenance, error) {
+	idx, res, err := s.maintTable.Get("id", targetID(node, serviceID)...)
+	var m *structs.Maintenance
+	if len(res) > 0 {
+		m = res[0].(*structs.Maintenance)
+	}
+	return idx, m, err
+}
+
+// MaintenanceList is used to list all the maintenance flags
+func (s *StateStore) MaintenanceList() (uint64, structs.Maintenances, error) {
+	defer s.measureQuery("MaintenanceList", time.Now())
+	idx, res, err := s.maintTable.Get("id")
+	out := make(structs.Maintenances, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.Maintenance)
+	}
+	return idx, out, err
+}
+
+// MaintenanceRestore is used to restore a maintenance flag from a
+// snapshot. Its check is restored with the other checks.
+func (s *StateStore) MaintenanceRestore(m *structs.Maintenance) error {
+	tx, err := s.maintTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.maintTable.InsertTxn(tx, m); err != nil {
+		return err
+	}
+	if err := s.maintTable.SetMaxLastIndexTxn(tx, m.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// expireMaintenance runs while we are the leader, and lifts the
+// maintenance flags once they expire
+func (s *Server) expireMaintenance(stopCh chan struct{}) {
+	notify := make(chan struct{}, 1)
+	for {
+		// Register the watch, it is cleared once it fires
+		state := s.fsm.State()
+		tables := state.QueryTables("Maintenance")
+		state.Watch(tables, notify)
+
+		wait := maintenanceExpireInterval
+		_, flags, err := state.MaintenanceList()
+		if err != nil {
+			s.logger.Printf("[ERR] consul: Failed to list maintenance flags: %v", err)
+		}
+		now := time.Now().UnixNano()
+		for _, m := range flags {
+			if m.Expires == 0 {
+				continue
+			}
+			if left := time.Duration(m.Expires - now); left > 0 {
+				if left < wait {
+					wait = left
+				}
+				continue
+			}
+			if err := s.liftMaintenance(m); err != nil {
+				s.logger.Printf("[ERR] consul: Failed to lift expired maintenance of node '%s' service '%s': %v",
+					m.Node, m.ServiceID, err)
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(wait):
+		case <-stopCh:
+			state.StopWatch(tables, notify)
+			return
+		}
+	}
+}
+
+// liftMaintenance disables an expired maintenance flag, unless it was
+// enabled again since
+func (s *Server) liftMaintenance(m *structs.Maintenance) error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "liftMaintenance"}, time.Now())
+	req := structs.MaintenanceRequest{
+		Datacenter:  s.config.Datacenter,
+		Op:          structs.MaintenanceDisable,
+		Maintenance: *m,
+	}
+	resp, err := s.raftApply(structs.MaintenanceRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
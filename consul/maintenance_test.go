@@ -0,0 +1,122 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_Maintenance(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i, id := range []string{"db", "web"} {
+		if err := store.EnsureService(uint64(2+i), "foo", &structs.NodeService{ID: id, Service: id}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The node and service must be registered
+	if err := store.MaintenanceEnable(4, &structs.Maintenance{Node: "bar"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := store.MaintenanceEnable(4, &structs.Maintenance{Node: "foo", ServiceID: "nope"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Put the db service in maintenance, which fails its health
+	if err := store.MaintenanceEnable(4, &structs.Maintenance{Node: "foo", ServiceID: "db", Reason: "backup"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes := store.CheckServiceNodes("db")
+	if len(nodes) != 1 || len(nodes[0].Checks) != 1 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	check := nodes[0].Checks[0]
+	if check.CheckID != "_maintenance:db" || check.Status != structs.HealthCritical || check.Notes != "backup" {
+		t.Fatalf("bad: %v", check)
+	}
+	_, nodes = store.CheckServiceNodes("web")
+	if len(nodes) != 1 || len(nodes[0].Checks) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Enabling it again keeps the create index
+	if err := store.MaintenanceEnable(5, &structs.Maintenance{Node: "foo", ServiceID: "db", Reason: "restore"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, m, err := store.MaintenanceGet("foo", "db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || m == nil || m.Reason != "restore" || m.CreateIndex != 4 || m.ModifyIndex != 5 {
+		t.Fatalf("bad: %d %v", idx, m)
+	}
+
+	// A disable with a stale index doesn't apply
+	ok, err := store.MaintenanceDisable(6, &structs.Maintenance{Node: "foo", ServiceID: "db", ModifyIndex: 4})
+	if err != nil || ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	ok, err = store.MaintenanceDisable(6, &structs.Maintenance{Node: "foo", ServiceID: "db", ModifyIndex: 5})
+	if err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	_, checks := store.NodeChecks("foo")
+	if len(checks) != 0 {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// Node maintenance fails every service of the node, and gets a
+	// default reason
+	if err := store.MaintenanceEnable(7, &structs.Maintenance{Node: "foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes = store.CheckServiceNodes("web")
+	if len(nodes) != 1 || len(nodes[0].Checks) != 1 || nodes[0].Checks[0].CheckID != MaintenanceCheckID {
+		t.Fatalf("bad: %v", nodes)
+	}
+	if nodes[0].Checks[0].Notes != defaultNodeMaintenanceReason {
+		t.Fatalf("bad: %v", nodes[0].Checks[0])
+	}
+
+	// Deregistering a service lifts its flag, and deregistering the
+	// check of a flag lifts it too
+	if err := store.MaintenanceEnable(8, &structs.Maintenance{Node: "foo", ServiceID: "web"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNodeService(9, "foo", "web"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNodeCheck(10, "foo", MaintenanceCheckID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, flags, err := store.MaintenanceList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 10 || len(flags) != 0 {
+		t.Fatalf("bad: %d %v", idx, flags)
+	}
+
+	// Deleting the node lifts its flags
+	if err := store.MaintenanceEnable(11, &structs.Maintenance{Node: "foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNode(12, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, flags, err = store.MaintenanceList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 12 || len(flags) != 0 {
+		t.Fatalf("bad: %d %v", idx, flags)
+	}
+}
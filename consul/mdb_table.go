@@ -40,11 +40,27 @@ type MDBTable struct {
 	// Last used rowID. Must be first to avoid 64bit alignment issues.
 	lastRowID uint64
 
+	// tracking is set while the changes to the table are tracked, and
+	// must be accessed atomically
+	tracking uint32
+
 	Env     *mdb.Env
 	Name    string // This is the name of the table, must be unique
 	Indexes map[string]*MDBIndex
 	Encoder func(interface{}) []byte
 	Decoder func([]byte) interface{}
+
+	// OnChange is invoked after a commit with the changes made to the
+	// table, while tracking is enabled. It runs outside the transaction.
+	OnChange func(*MDBChanges)
+}
+
+// MDBChanges are the rows of a table changed by a transaction
+type MDBChanges struct {
+	Table   string
+	Index   uint64        // Last index set by the transaction, if any
+	Updated []interface{} // Rows that were inserted or replaced
+	Deleted []interface{} // Rows that were deleted
 }
 
 // MDBTables is used for when we have a collection of tables
@@ -57,6 +73,7 @@ type MDBIndex struct {
 	Unique          bool      // Controls if values are unique
 	Fields          []string  // Fields are used to build the index
 	IdxFunc         IndexFunc // Can be used to provide custom indexing
+	FieldFunc       FieldFunc // Can be used to provide the values of the fields
 	Virtual         bool      // Virtual index does not exist, but can be used for queries
 	RealIndex       string    // Virtual indexes use a RealIndex for iteration
 	CaseInsensitive bool      // Controls if values are case-insensitive
@@ -73,6 +90,12 @@ type MDBTxn struct {
 	tx       *mdb.Txn
 	dbis     map[string]mdb.DBI
 	after    []func()
+	changes  map[*MDBTable]*MDBChanges
+
+	// notify collects the watches fired by the transaction, which are
+	// handed to dispatch after the commit
+	notify   *notifyBatch
+	dispatch func(*notifyBatch)
 }
 
 // Abort is used to close the transaction
@@ -91,9 +114,36 @@ func (t *MDBTxn) Commit() error {
 		f()
 	}
 	t.after = nil
+	for table, changes := range t.changes {
+		if table.OnChange != nil {
+			table.OnChange(changes)
+		}
+	}
+	t.changes = nil
+	if t.notify != nil {
+		t.dispatch(t.notify)
+		t.notify = nil
+	}
 	return nil
 }
 
+// changesFor returns the changes to a table, or nil if the table
+// is not tracked
+func (t *MDBTxn) changesFor(table *MDBTable) *MDBChanges {
+	if !table.Tracking() {
+		return nil
+	}
+	if t.changes == nil {
+		t.changes = make(map[*MDBTable]*MDBChanges)
+	}
+	changes, ok := t.changes[table]
+	if !ok {
+		changes = &MDBChanges{Table: table.Name}
+		t.changes[table] = changes
+	}
+	return changes
+}
+
 // Defer is used to defer a function call until a successful commit
 func (t *MDBTxn) Defer(f func()) {
 	t.after = append(t.after, f)
@@ -101,6 +151,11 @@ func (t *MDBTxn) Defer(f func()) {
 
 type IndexFunc func(*MDBIndex, []string) string
 
+// FieldFunc returns the values of the fields of an index for an object.
+// It can be used to index values that are not plain string fields, in
+// which case the Fields of the index only name the values.
+type FieldFunc func(obj interface{}) ([]string, error)
+
 // DefaultIndexFunc is used if no IdxFunc is provided. It joins
 // the columns using '||' which is reasonably unlikely to occur.
 // We also prefix with a byte to ensure we never have a zero length
@@ -124,6 +179,21 @@ func DefaultIndexPrefixFunc(idx *MDBIndex, parts []string) string {
 	return prefix
 }
 
+// Track is used to enable or disable the tracking of changes, which
+// are passed to OnChange
+func (t *MDBTable) Track(enable bool) {
+	var v uint32
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&t.tracking, v)
+}
+
+// Tracking returns if changes to the table are tracked
+func (t *MDBTable) Tracking() bool {
+	return atomic.LoadUint32(&t.tracking) == 1
+}
+
 // Init is used to initialize the MDBTable and ensure it's ready
 func (t *MDBTable) Init() error {
 	if t.Env == nil {
@@ -326,8 +396,8 @@ func (t *MDBTable) InsertTxn(tx *MDBTxn, obj interface{}) error {
 		goto AFTER_DELETE
 	}
 
-	// Delete the existing row
-	n, err = t.deleteWithIndex(tx, t.Indexes["id"], indexes["id"])
+	// Delete the existing row, this is tracked as an update
+	n, err = t.deleteWithIndex(tx, t.Indexes["id"], indexes["id"], false)
 	if err != nil {
 		return err
 	}
@@ -354,6 +424,11 @@ AFTER_DELETE:
 			return err
 		}
 	}
+
+	// Track a copy, since the caller may reuse the object
+	if changes := tx.changesFor(t); changes != nil {
+		changes.Updated = append(changes.Updated, t.Decoder(raw))
+	}
 	return nil
 }
 
@@ -420,6 +495,54 @@ func (t *MDBTable) GetTxnLimit(tx *MDBTxn, limit int, index string, parts ...str
 	return results, err
 }
 
+// CountTxn is like GetTxn but it only counts the matching rows,
+// without decoding them
+func (t *MDBTable) CountTxn(tx *MDBTxn, index string, parts ...string) (int, error) {
+	// Get the associated index
+	idx, key, err := t.getIndex(index, parts)
+	if err != nil {
+		return 0, err
+	}
+
+	num := 0
+	err = idx.iterate(tx, key, func(encRowId, res []byte) (bool, bool) {
+		num++
+		return false, false
+	})
+	return num, err
+}
+
+// SizeTxn returns the bytes used by the rows of the table and by its
+// indexes. This counts the pages of the underlying databases, so it
+// includes the overhead of the B-trees and any unused space in them.
+func (t *MDBTable) SizeTxn(tx *MDBTxn) (data uint64, indexes uint64, err error) {
+	data, err = dbiSize(tx, t.Name)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, index := range t.Indexes {
+		if index.Virtual {
+			continue
+		}
+		size, err := dbiSize(tx, index.dbiName)
+		if err != nil {
+			return 0, 0, err
+		}
+		indexes += size
+	}
+	return data, indexes, nil
+}
+
+// dbiSize returns the bytes used by the pages of a database
+func dbiSize(tx *MDBTxn, name string) (uint64, error) {
+	stat, err := tx.tx.Stat(tx.dbis[name])
+	if err != nil {
+		return 0, err
+	}
+	pages := stat.BranchPages + stat.LeafPages + stat.OverflowPages
+	return uint64(stat.PSize) * pages, nil
+}
+
 // StreamTxn is like GetTxn but it streams the results over a channel.
 // This can be used if the expected data set is very large. The stream
 // is always closed on return.
@@ -494,20 +617,21 @@ func (t *MDBTable) DeleteTxn(tx *MDBTxn, index string, parts ...string) (int, er
 	}
 
 	// Delete with the index
-	return t.deleteWithIndex(tx, idx, key)
+	return t.deleteWithIndex(tx, idx, key, true)
 }
 
 // deleteWithIndex deletes all associated rows while scanning
 // a given index for a key prefix. May perform multiple index traversals.
 // This is a hack around a bug in LMDB which can cause a partial delete to
 // take place. To fix this, we invoke the innerDelete until all rows are
-// removed. This hack can be removed once the LMDB bug is resolved.
-func (t *MDBTable) deleteWithIndex(tx *MDBTxn, idx *MDBIndex, key []byte) (int, error) {
+// removed. This hack can be removed once the LMDB bug is resolved. The
+// deleted rows are tracked if track is set.
+func (t *MDBTable) deleteWithIndex(tx *MDBTxn, idx *MDBIndex, key []byte, track bool) (int, error) {
 	var total int
 	var num int
 	var err error
 DELETE:
-	num, err = t.innerDeleteWithIndex(tx, idx, key)
+	num, err = t.innerDeleteWithIndex(tx, idx, key, track)
 	total += num
 	if err != nil {
 		return total, err
@@ -520,7 +644,12 @@ DELETE:
 
 // innerDeleteWithIndex deletes all associated rows while scanning
 // a given index for a key prefix. It only traverses the index a single time.
-func (t *MDBTable) innerDeleteWithIndex(tx *MDBTxn, idx *MDBIndex, key []byte) (num int, err error) {
+func (t *MDBTable) innerDeleteWithIndex(tx *MDBTxn, idx *MDBIndex, key []byte, track bool) (num int, err error) {
+	var changes *MDBChanges
+	if track {
+		changes = tx.changesFor(t)
+	}
+
 	// Handle an error while deleting
 	defer func() {
 		if r := recover(); r != nil {
@@ -564,6 +693,9 @@ func (t *MDBTable) innerDeleteWithIndex(tx *MDBTxn, idx *MDBIndex, key []byte) (
 
 		// Delete the object
 		num++
+		if changes != nil {
+			changes.Deleted = append(changes.Deleted, obj)
+		}
 		return true, false
 	})
 	if err != nil {
@@ -636,15 +768,32 @@ func (i *MDBIndex) arity() int {
 
 // keyFromObject constructs the index key from the object
 func (i *MDBIndex) keyFromObject(obj interface{}) ([]byte, error) {
+	var values []string
+	if i.FieldFunc != nil {
+		var err error
+		values, err = i.FieldFunc(obj)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != i.arity() {
+			return nil, fmt.Errorf("Index '%s' got %d values for %#v", i.name, len(values), obj)
+		}
+	}
+
 	v := reflect.ValueOf(obj)
 	v = reflect.Indirect(v) // Derefence the pointer if any
 	parts := make([]string, 0, i.arity())
-	for _, field := range i.Fields {
-		fv := v.FieldByName(field)
-		if !fv.IsValid() {
-			return nil, fmt.Errorf("Field '%s' for %#v is invalid", field, obj)
+	for n, field := range i.Fields {
+		var val string
+		if values != nil {
+			val = values[n]
+		} else {
+			fv := v.FieldByName(field)
+			if !fv.IsValid() {
+				return nil, fmt.Errorf("Field '%s' for %#v is invalid", field, obj)
+			}
+			val = fv.String()
 		}
-		val := fv.String()
 		if !i.AllowBlank && val == "" {
 			return nil, fmt.Errorf("Field '%s' must be set: %#v", field, obj)
 		}
@@ -784,7 +933,13 @@ func (t *MDBTable) SetLastIndex(index uint64) error {
 func (t *MDBTable) SetLastIndexTxn(tx *MDBTxn, index uint64) error {
 	encRowId := uint64ToBytes(lastIndexRowID)
 	encIndex := uint64ToBytes(index)
-	return tx.tx.Put(tx.dbis[t.Name], encRowId, encIndex, 0)
+	if err := tx.tx.Put(tx.dbis[t.Name], encRowId, encIndex, 0); err != nil {
+		return err
+	}
+	if changes := tx.changesFor(t); changes != nil {
+		changes.Index = index
+	}
+	return nil
 }
 
 // SetMaxLastIndexTxn is used to set the last index within a transaction
@@ -1,16 +1,19 @@
 package consul
 
 import (
+	"reflect"
 	"sync"
+	"time"
 )
 
 // NotifyGroup is used to allow a simple notification mechanism.
 // Channels can be marked as waiting, and when notify is invoked,
 // all the waiting channels get a message and are cleared from the
-// notify list.
+// notify list. The time each channel started waiting is kept, so
+// channels that were never cleared can be reaped.
 type NotifyGroup struct {
 	l      sync.Mutex
-	notify map[chan struct{}]struct{}
+	notify map[chan struct{}]time.Time
 }
 
 // Notify will do a non-blocking send to all waiting channels, and
@@ -27,14 +30,25 @@ func (n *NotifyGroup) Notify() {
 	n.notify = nil
 }
 
+// drain moves the waiting channels into a set without notifying them,
+// so that channels waiting on several groups can be notified once
+func (n *NotifyGroup) drain(into map[chan struct{}]struct{}) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	for ch := range n.notify {
+		into[ch] = struct{}{}
+	}
+	n.notify = nil
+}
+
 // Wait adds a channel to the notify group
 func (n *NotifyGroup) Wait(ch chan struct{}) {
 	n.l.Lock()
 	defer n.l.Unlock()
 	if n.notify == nil {
-		n.notify = make(map[chan struct{}]struct{})
+		n.notify = make(map[chan struct{}]time.Time)
 	}
-	n.notify[ch] = struct{}{}
+	n.notify[ch] = time.Now()
 }
 
 // Clear removes a channel from the notify group
@@ -47,9 +61,103 @@ func (n *NotifyGroup) Clear(ch chan struct{}) {
 	delete(n.notify, ch)
 }
 
+// Reap removes the channels that started waiting before a time, and
+// returns how many were removed. The owners of the channels are expected
+// to clear them, so these have leaked.
+func (n *NotifyGroup) Reap(before time.Time) int {
+	n.l.Lock()
+	defer n.l.Unlock()
+	reaped := 0
+	for ch, since := range n.notify {
+		if since.Before(before) {
+			delete(n.notify, ch)
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// Count returns the number of waiting channels
+func (n *NotifyGroup) Count() int {
+	n.l.Lock()
+	defer n.l.Unlock()
+	return len(n.notify)
+}
+
 // WaitCh allocates a channel that is subscribed to notifications
 func (n *NotifyGroup) WaitCh() chan struct{} {
 	ch := make(chan struct{}, 1)
 	n.Wait(ch)
 	return ch
 }
+
+// notifyShards is the number of shards of a ShardedNotifyGroup
+const notifyShards = 16
+
+// ShardedNotifyGroup is a NotifyGroup that spreads the waiting channels
+// over several locks. Waiting and clearing only contend with the
+// channels of the same shard, which matters when a large number of
+// blocking queries watch the same table. Notify visits every shard.
+type ShardedNotifyGroup struct {
+	shards [notifyShards]NotifyGroup
+}
+
+// shard returns the shard of a channel, based on its address
+func (n *ShardedNotifyGroup) shard(ch chan struct{}) *NotifyGroup {
+	ptr := uint64(reflect.ValueOf(ch).Pointer())
+
+	// Spread the addresses, which are aligned, with a multiplicative
+	// hash. The top 4 bits select one of the 16 shards.
+	return &n.shards[(ptr*0x9E3779B97F4A7C15)>>60]
+}
+
+// Notify will do a non-blocking send to all waiting channels, and
+// clear the notify list
+func (n *ShardedNotifyGroup) Notify() {
+	for i := range n.shards {
+		n.shards[i].Notify()
+	}
+}
+
+// drain moves the waiting channels into a set without notifying them
+func (n *ShardedNotifyGroup) drain(into map[chan struct{}]struct{}) {
+	for i := range n.shards {
+		n.shards[i].drain(into)
+	}
+}
+
+// Wait adds a channel to the notify group
+func (n *ShardedNotifyGroup) Wait(ch chan struct{}) {
+	n.shard(ch).Wait(ch)
+}
+
+// Clear removes a channel from the notify group
+func (n *ShardedNotifyGroup) Clear(ch chan struct{}) {
+	n.shard(ch).Clear(ch)
+}
+
+// Reap removes the channels that started waiting before a time, and
+// returns how many were removed
+func (n *ShardedNotifyGroup) Reap(before time.Time) int {
+	reaped := 0
+	for i := range n.shards {
+		reaped += n.shards[i].Reap(before)
+	}
+	return reaped
+}
+
+// Count returns the number of waiting channels
+func (n *ShardedNotifyGroup) Count() int {
+	num := 0
+	for i := range n.shards {
+		num += n.shards[i].Count()
+	}
+	return num
+}
+
+// WaitCh allocates a channel that is subscribed to notifications
+func (n *ShardedNotifyGroup) WaitCh() chan struct{} {
+	ch := make(chan struct{}, 1)
+	n.Wait(ch)
+	return ch
+}
@@ -0,0 +1,211 @@
+package consul
+
+import (
+	"strings"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// notifyQueueSize is the number of committed batches that may wait
+	// for the dispatcher
+	notifyQueueSize = 64
+
+	// notifyBatchMax bounds how many queued batches are merged into a
+	// single dispatch
+	notifyBatchMax = 16
+)
+
+// notifyBatch collects the watches fired by a write transaction, so they
+// are dispatched once the transaction has committed, and only once even
+// if the transaction touched a table or key several times
+type notifyBatch struct {
+	tables map[*MDBTable]struct{}
+	kv     map[string]bool // Path to whether the entire prefix is affected
+
+	// services are the services whose entries, instance nodes or checks
+	// were changed
+	services map[string]struct{}
+
+	// nodes are the nodes whose service instances may have changed
+	// health, see HealthSummary
+	nodes map[string]struct{}
+
+	// done is closed once the batch has been dispatched
+	done chan struct{}
+}
+
+// newNotifyBatch creates an empty batch
+func newNotifyBatch() *notifyBatch {
+	return &notifyBatch{
+		tables:   make(map[*MDBTable]struct{}),
+		kv:       make(map[string]bool),
+		services: make(map[string]struct{}),
+		nodes:    make(map[string]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// merge adds the watches of another batch
+func (b *notifyBatch) merge(other *notifyBatch) {
+	for table := range other.tables {
+		b.tables[table] = struct{}{}
+	}
+	for path, prefix := range other.kv {
+		b.kv[path] = b.kv[path] || prefix
+	}
+	for service := range other.services {
+		b.services[service] = struct{}{}
+	}
+	for node := range other.nodes {
+		b.nodes[node] = struct{}{}
+	}
+}
+
+// batchFor returns the notification batch of a transaction
+func (s *StateStore) batchFor(tx *MDBTxn) *notifyBatch {
+	if tx.notify == nil {
+		tx.notify = newNotifyBatch()
+		tx.dispatch = s.queueNotify
+	}
+	return tx.notify
+}
+
+// notifyTables fires the watches of the tables once the transaction
+// commits
+func (s *StateStore) notifyTables(tx *MDBTxn, tables ...*MDBTable) {
+	b := s.batchFor(tx)
+	for _, table := range tables {
+		b.tables[table] = struct{}{}
+	}
+}
+
+// notifyKV fires the watches of any prefix of a KV path once the
+// transaction commits. If the entire prefix may be affected (e.g. delete
+// tree), the watches of any prefix under the path are fired too.
+func (s *StateStore) notifyKV(tx *MDBTxn, path string, prefix bool) {
+	b := s.batchFor(tx)
+	b.kv[path] = b.kv[path] || prefix
+}
+
+// notifyServices fires the service watches of the services once the
+// transaction commits
+func (s *StateStore) notifyServices(tx *MDBTxn, services ...string) {
+	b := s.batchFor(tx)
+	for _, service := range services {
+		b.services[strings.ToLower(service)] = struct{}{}
+	}
+}
+
+// notifyNodeServices fires the service watches of every service of a
+// node, which is needed when the node or one of its node-level checks
+// changes. The services are read in the transaction, so it must be
+// done before they are deleted.
+func (s *StateStore) notifyNodeServices(tx *MDBTxn, node string) error {
+	res, err := s.serviceTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		s.notifyServices(tx, r.(*structs.ServiceNode).ServiceName)
+	}
+	return nil
+}
+
+// notifyHealth updates the health summary of the service instances of a
+// node once the transaction commits
+func (s *StateStore) notifyHealth(tx *MDBTxn, node string) {
+	s.batchFor(tx).nodes[node] = struct{}{}
+}
+
+// queueNotify hands a committed batch to the dispatcher, and waits for
+// it to be dispatched. Writers wait so that the watchers of a write are
+// always notified by the time it returns, which blocking queries and
+// the tests rely on. Batches queued by concurrent writers are merged.
+func (s *StateStore) queueNotify(b *notifyBatch) {
+	select {
+	case s.notifyCh <- b:
+	case <-s.notifyShutdownCh:
+		s.dispatchNotify(b)
+		return
+	}
+	select {
+	case <-b.done:
+	case <-s.notifyShutdownCh:
+	}
+}
+
+// runNotify is a long running routine that dispatches the committed
+// batches until the state store is closed
+func (s *StateStore) runNotify() {
+	for {
+		var b *notifyBatch
+		select {
+		case b = <-s.notifyCh:
+		case <-s.notifyShutdownCh:
+			return
+		}
+
+		// Merge any other queued batches, up to a bound so a steady
+		// stream of writes can't delay the notifications
+		merged := []*notifyBatch{b}
+	MERGE:
+		for len(merged) < notifyBatchMax {
+			select {
+			case other := <-s.notifyCh:
+				b.merge(other)
+				merged = append(merged, other)
+			default:
+				break MERGE
+			}
+		}
+		metrics.AddSample([]string{"consul", "state", "notify", "batch"}, float32(len(merged)))
+
+		s.dispatchNotify(b)
+		for _, done := range merged {
+			close(done.done)
+		}
+	}
+}
+
+// dispatchNotify fires the watches of a batch. A channel watching
+// several of the changed tables, prefixes or services is only sent to
+// once.
+func (s *StateStore) dispatchNotify(b *notifyBatch) {
+	// The health summary is updated first, so the watchers of the
+	// tables see it
+	if len(b.nodes) > 0 {
+		s.updateHealthSummary(b.nodes)
+	}
+
+	chs := make(map[chan struct{}]struct{})
+	for table := range b.tables {
+		group := s.watch[table]
+		if n := group.Count(); n > 0 {
+			s.watchStats.tableFired(table.Name, n)
+		}
+		group.drain(chs)
+	}
+	for path, prefix := range b.kv {
+		// Changes under a rate limited prefix may be held, see
+		// SetKVSNotifyLimits
+		if s.notifyLimiter.admit(path, prefix, s.flushNotifyKV) {
+			s.kvWatch.drain(path, prefix, chs, s.watchStats.prefixFired)
+		}
+	}
+	for service := range b.services {
+		s.serviceWatch.drain(service, chs)
+	}
+	sendNotify(chs)
+}
+
+// sendNotify does a non-blocking send to each channel
+func sendNotify(chs map[chan struct{}]struct{}) {
+	for ch := range chs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_NotifyBatch(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Watch all the tables touched by a registration, and a KV prefix
+	notify := make(chan struct{}, 2)
+	tables := store.QueryTables("CheckServiceNodes")
+	store.Watch(tables, notify)
+	kvNotify := make(chan struct{}, 2)
+	store.WatchKV("foo/", kvNotify)
+	store.WatchKV("foo/bar", kvNotify)
+
+	req := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{ID: "db", Service: "db", Port: 8000},
+		Check: &structs.HealthCheck{
+			Node:      "foo",
+			CheckID:   "db",
+			Name:      "Can connect",
+			Status:    structs.HealthPassing,
+			ServiceID: "db",
+		},
+	}
+	if err := store.EnsureRegistration(1, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The channel is notified once, and is no longer waiting on any of
+	// the tables
+	if len(notify) != 1 {
+		t.Fatalf("bad: %d", len(notify))
+	}
+	for _, table := range tables {
+		if num := store.watch[table].Count(); num != 0 {
+			t.Fatalf("bad: %s %d", table.Name, num)
+		}
+	}
+
+	// The same goes for a KV write matching several prefixes
+	if err := store.KVSSet(2, &structs.DirEntry{Key: "foo/bar", Value: []byte("test")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(kvNotify) != 1 || store.kvWatch.Count() != 0 {
+		t.Fatalf("bad: %d %d", len(kvNotify), store.kvWatch.Count())
+	}
+
+	// An aborted transaction does not notify
+	<-notify
+	store.Watch(tables, notify)
+	tx, err := store.tables.StartTxn(false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.notifyTables(tx, store.nodeTable)
+	tx.Abort()
+	if len(notify) != 0 {
+		t.Fatalf("should not be notified")
+	}
+}
+
+func TestNotifyBatch_Merge(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	b1 := newNotifyBatch()
+	b1.tables[store.nodeTable] = struct{}{}
+	b1.kv["foo/"] = false
+	b2 := newNotifyBatch()
+	b2.tables[store.checkTable] = struct{}{}
+	b2.kv["foo/"] = true
+	b2.kv["bar"] = false
+
+	b1.merge(b2)
+	if len(b1.tables) != 2 || len(b1.kv) != 2 || !b1.kv["foo/"] || b1.kv["bar"] {
+		t.Fatalf("bad: %v %v", b1.tables, b1.kv)
+	}
+}
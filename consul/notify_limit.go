@@ -0,0 +1,130 @@
+package consul
+
+import (
+	"sync"
+	"time"
+
+	"github.com/armon/go-radix"
+)
+
+// notifyLimiter rate limits the notifications of the KV watches under
+// the configured prefixes. A key updated many times per second would
+// otherwise wake its blocking queries, and have them requery, at the
+// same rate. Within a prefix, a change fires at most once per interval.
+// The changes that can't fire yet are held, and fired together at the
+// end of the interval, so the final state is always delivered.
+type notifyLimiter struct {
+	l      sync.Mutex
+	limits *radix.Tree // Prefix to *notifyLimit
+}
+
+// notifyLimit is the rate limit of a prefix
+type notifyLimit struct {
+	interval time.Duration
+
+	// last is when the prefix last fired
+	last time.Time
+
+	// pending are the held changes, by path to whether the entire
+	// prefix is affected, and timer fires them
+	pending map[string]bool
+	timer   *time.Timer
+}
+
+// newNotifyLimiter creates a limiter without any limits
+func newNotifyLimiter() *notifyLimiter {
+	return &notifyLimiter{
+		limits: radix.New(),
+	}
+}
+
+// set replaces the limits, by prefix to the minimum interval between two
+// fires. The changes held by the previous limits are returned, so they
+// can be fired right away.
+func (n *notifyLimiter) set(limits map[string]time.Duration) map[string]bool {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	held := make(map[string]bool)
+	n.limits.Walk(func(prefix string, raw interface{}) bool {
+		limit := raw.(*notifyLimit)
+		if limit.timer != nil {
+			limit.timer.Stop()
+		}
+		for path, prefix := range limit.pending {
+			held[path] = held[path] || prefix
+		}
+		return false
+	})
+
+	n.limits = radix.New()
+	for prefix, interval := range limits {
+		if interval > 0 {
+			n.limits.Insert(prefix, &notifyLimit{interval: interval})
+		}
+	}
+	return held
+}
+
+// admit returns if a change of a path may fire now. Otherwise, the
+// change is held, and flush is invoked with the held changes at the end
+// of the interval of the prefix.
+func (n *notifyLimiter) admit(path string, prefix bool, flush func(map[string]bool)) bool {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	_, raw, ok := n.limits.LongestPrefix(path)
+	if !ok {
+		return true
+	}
+	limit := raw.(*notifyLimit)
+
+	// Fire if the interval went by since the last fire, and nothing is
+	// held, which would otherwise be fired out of order
+	now := time.Now()
+	wait := limit.last.Add(limit.interval).Sub(now)
+	if wait <= 0 && limit.timer == nil {
+		limit.last = now
+		return true
+	}
+
+	// Hold the change, and fire the held changes at the end of the
+	// interval
+	if limit.pending == nil {
+		limit.pending = make(map[string]bool)
+	}
+	limit.pending[path] = limit.pending[path] || prefix
+	if limit.timer == nil {
+		limit.timer = time.AfterFunc(wait, func() {
+			n.l.Lock()
+			held := limit.pending
+			limit.pending = nil
+			limit.timer = nil
+			limit.last = time.Now()
+			n.l.Unlock()
+			flush(held)
+		})
+	}
+	return false
+}
+
+// SetKVSNotifyLimits rate limits the notifications of the KV watches
+// under some prefixes, by prefix to the minimum interval between two
+// notifications. A key under the longest matching prefix wakes its
+// watchers at most once per interval, and the last change is always
+// delivered at the end of an interval. This keeps hot keys from waking
+// their blocking queries on every update.
+func (s *StateStore) SetKVSNotifyLimits(limits map[string]time.Duration) {
+	if held := s.notifyLimiter.set(limits); len(held) > 0 {
+		s.flushNotifyKV(held)
+	}
+}
+
+// flushNotifyKV fires the held notifications of KV paths
+func (s *StateStore) flushNotifyKV(held map[string]bool) {
+	chs := make(map[chan struct{}]struct{})
+	for path, prefix := range held {
+		s.kvWatch.drain(path, prefix, chs, s.watchStats.prefixFired)
+	}
+	sendNotify(chs)
+}
@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_KVSNotifyLimits(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	interval := 200 * time.Millisecond
+	store.SetKVSNotifyLimits(map[string]time.Duration{"hot/": interval})
+
+	notified := func(ch chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// The first change fires right away
+	ch := make(chan struct{}, 1)
+	store.WatchKV("hot/", ch)
+	if err := store.KVSSet(1, &structs.DirEntry{Key: "hot/foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !notified(ch) {
+		t.Fatalf("should be notified")
+	}
+
+	// The next changes are held until the end of the interval
+	start := time.Now()
+	store.WatchKV("hot/", ch)
+	for i := uint64(2); i < 10; i++ {
+		if err := store.KVSSet(i, &structs.DirEntry{Key: "hot/foo"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if notified(ch) {
+		t.Fatalf("should not be notified")
+	}
+
+	// Other prefixes are not limited
+	other := make(chan struct{}, 1)
+	store.WatchKV("cold/", other)
+	if err := store.KVSSet(10, &structs.DirEntry{Key: "cold/foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !notified(other) {
+		t.Fatalf("should be notified")
+	}
+
+	// The held changes are delivered
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("should be notified")
+	}
+	if time.Now().Sub(start) < interval/2 {
+		t.Fatalf("too fast")
+	}
+
+	// Changing the limits fires the held changes right away
+	store.WatchKV("hot/", ch)
+	if err := store.KVSSet(11, &structs.DirEntry{Key: "hot/foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if notified(ch) {
+		t.Fatalf("should not be notified")
+	}
+	store.SetKVSNotifyLimits(nil)
+	if !notified(ch) {
+		t.Fatalf("should be notified")
+	}
+}
@@ -2,6 +2,7 @@ package consul
 
 import (
 	"testing"
+	"time"
 )
 
 func TestNotifyGroup(t *testing.T) {
@@ -70,3 +71,98 @@ func TestNotifyGroup_Clear(t *testing.T) {
 	default:
 	}
 }
+
+func TestNotifyGroup_Reap(t *testing.T) {
+	grp := &ShardedNotifyGroup{}
+
+	old := grp.WaitCh()
+	cutoff := time.Now().Add(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	fresh := grp.WaitCh()
+
+	// Only the channel waiting since before the cutoff is reaped
+	if n := grp.Reap(cutoff); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if grp.Count() != 1 {
+		t.Fatalf("bad: %d", grp.Count())
+	}
+
+	grp.Notify()
+	select {
+	case <-old:
+		t.Fatalf("should not get message")
+	default:
+	}
+	select {
+	case <-fresh:
+	default:
+		t.Fatalf("should not block")
+	}
+}
+
+func TestShardedNotifyGroup(t *testing.T) {
+	grp := &ShardedNotifyGroup{}
+
+	var chs []chan struct{}
+	for i := 0; i < 100; i++ {
+		chs = append(chs, grp.WaitCh())
+	}
+	if grp.Count() != 100 {
+		t.Fatalf("bad: %d", grp.Count())
+	}
+	grp.Clear(chs[0])
+	if grp.Count() != 99 {
+		t.Fatalf("bad: %d", grp.Count())
+	}
+
+	grp.Notify()
+	select {
+	case <-chs[0]:
+		t.Fatalf("should not get message")
+	default:
+	}
+	for _, ch := range chs[1:] {
+		select {
+		case <-ch:
+		default:
+			t.Fatalf("should not block")
+		}
+	}
+
+	// Should be unregistered
+	if grp.Count() != 0 {
+		t.Fatalf("bad: %d", grp.Count())
+	}
+}
+
+// notifyWaiter is the part of a notify group used by blocking queries
+type notifyWaiter interface {
+	Wait(chan struct{})
+	Clear(chan struct{})
+}
+
+// benchmarkNotifyWait registers and clears channels concurrently, as
+// blocking queries do, with 50k queries already waiting
+func benchmarkNotifyWait(b *testing.B, grp notifyWaiter) {
+	for i := 0; i < 50000; i++ {
+		grp.Wait(make(chan struct{}, 1))
+	}
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ch := make(chan struct{}, 1)
+			grp.Wait(ch)
+			grp.Clear(ch)
+		}
+	})
+}
+
+func BenchmarkNotifyGroup_Wait(b *testing.B) {
+	benchmarkNotifyWait(b, &NotifyGroup{})
+}
+
+func BenchmarkShardedNotifyGroup_Wait(b *testing.B) {
+	benchmarkNotifyWait(b, &ShardedNotifyGroup{})
+}
@@ -0,0 +1,435 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+// Operator endpoint is used to inspect the servers, for capacity
+// planning and debugging
+type Operator struct {
+	srv *Server
+}
+
+// StateStats is used to get the statistics of the state store. The
+// leader answers, unless a stale read is allowed. Since this reveals
+// the size of every table, it requires a management token.
+func (o *Operator) StateStats(args *structs.DCSpecificRequest, reply *structs.StateStats) error {
+	if done, err := o.srv.forward("Operator.StateStats", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	stats, err := o.srv.fsm.State().Stats()
+	if err != nil {
+		return err
+	}
+	*reply = *stats
+	reply.Server = o.srv.config.NodeName
+	return nil
+}
+
+// StateVerify is used to check the integrity of the state store, after
+// a suspected corruption. The leader answers, unless a stale read is
+// allowed, so each server can be verified. It requires a management
+// token.
+func (o *Operator) StateVerify(args *structs.DCSpecificRequest, reply *structs.StateVerifyReport) error {
+	if done, err := o.srv.forward("Operator.StateVerify", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	report, err := o.srv.fsm.State().Verify()
+	if err != nil {
+		return err
+	}
+	*reply = *report
+	reply.Server = o.srv.config.NodeName
+	return nil
+}
+
+// SlowQueries is used to get the slow query log of a server. The leader
+// answers, unless a stale read is allowed, so the log of each server can
+// be read. Since the logged parameters reveal keys and names, it
+// requires a management token.
+func (o *Operator) SlowQueries(args *structs.DCSpecificRequest, reply *structs.SlowQueryReport) error {
+	if done, err := o.srv.forward("Operator.SlowQueries", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	reply.Server = o.srv.config.NodeName
+	reply.Threshold = o.srv.fsm.queryLog.Threshold()
+	reply.Queries = o.srv.fsm.State().SlowQueries()
+	return nil
+}
+
+// RaftGetConfiguration is used to list the servers of the Raft
+// configuration, with their names and status in the LAN pool. The
+// leader answers, unless a stale read is allowed. It requires a
+// management token.
+func (o *Operator) RaftGetConfiguration(args *structs.DCSpecificRequest, reply *structs.RaftConfigurationResponse) error {
+	if done, err := o.srv.forward("Operator.RaftGetConfiguration", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	peers, err := o.srv.raftPeers.Peers()
+	if err != nil {
+		return err
+	}
+	sort.Strings(peers)
+
+	// Match the peers with the servers of the LAN pool by address
+	members := make(map[string]*structs.RaftServer)
+	for _, member := range o.srv.serfLAN.Members() {
+		valid, parts := isConsulServer(member)
+		if !valid {
+			continue
+		}
+		addr := (&net.TCPAddr{IP: member.Addr, Port: parts.Port}).String()
+		members[addr] = &structs.RaftServer{
+			Node:   member.Name,
+			Status: member.Status.String(),
+		}
+	}
+
+	leader := o.srv.raft.Leader()
+	reply.Servers = make([]*structs.RaftServer, 0, len(peers))
+	for _, peer := range peers {
+		server, ok := members[peer]
+		if !ok {
+			server = &structs.RaftServer{Status: "unknown"}
+		}
+		server.Address = peer
+		server.Leader = peer == leader
+		reply.Servers = append(reply.Servers, server)
+	}
+	reply.Index = o.srv.raft.LastIndex()
+	o.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// RaftRemovePeerByAddress is used to remove a failed server from the
+// Raft configuration, so the quorum no longer counts it. A server that
+// is still alive in the LAN pool is added back by the leader. It
+// requires a management token.
+func (o *Operator) RaftRemovePeerByAddress(args *structs.RaftPeerRequest, reply *struct{}) error {
+	if done, err := o.srv.forward("Operator.RaftRemovePeerByAddress", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	// Only remove known peers, a typo shouldn't look like a success
+	peers, err := o.srv.raftPeers.Peers()
+	if err != nil {
+		return err
+	}
+	if !raft.PeerContained(peers, args.Address) {
+		return fmt.Errorf("Address %q was not found in the Raft configuration", args.Address)
+	}
+
+	future := o.srv.raft.RemovePeer(args.Address)
+	if err := future.Error(); err != nil {
+		o.srv.logger.Printf("[WARN] consul.operator: failed to remove raft peer '%s': %v",
+			args.Address, err)
+		return err
+	}
+	o.srv.logger.Printf("[WARN] consul.operator: removed raft peer '%s'", args.Address)
+	return nil
+}
+
+// AutopilotGetConfiguration is used to get the autopilot configuration,
+// which is that of the servers until an operator sets one. The leader
+// answers, unless a stale read is allowed. It requires a management
+// token.
+func (o *Operator) AutopilotGetConfiguration(args *structs.DCSpecificRequest, reply *structs.AutopilotConfigResponse) error {
+	if done, err := o.srv.forward("Operator.AutopilotGetConfiguration", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	state := o.srv.fsm.State()
+	return o.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("Autopilot"),
+		func() error {
+			index, config, err := o.srv.autopilotConfig()
+			if err != nil {
+				return err
+			}
+			reply.Index, reply.Config = index, *config
+			return nil
+		})
+}
+
+// AutopilotSetConfiguration is used to set the autopilot configuration,
+// which the leader applies from its next round. The reply is false if a
+// CAS failed. It requires a management token.
+func (o *Operator) AutopilotSetConfiguration(args *structs.AutopilotSetConfigRequest, reply *bool) error {
+	if done, err := o.srv.forward("Operator.AutopilotSetConfiguration", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	if args.Config.ServerStabilizationTime < 0 {
+		return fmt.Errorf("Server stabilization time can't be negative")
+	}
+
+	resp, err := o.srv.raftApply(structs.AutopilotRequestType, args)
+	if err != nil {
+		o.srv.logger.Printf("[ERR] consul.operator: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	if respBool, ok := resp.(bool); ok {
+		*reply = respBool
+	}
+	return nil
+}
+
+// AutoEncryptTokenCreate is used to create a one-time token, with which
+// the named node obtains its TLS certificate once. The secret is only
+// returned here. It requires a management token.
+func (o *Operator) AutoEncryptTokenCreate(args *structs.AutoEncryptTokenCreateRequest, reply *structs.AutoEncryptTokenCreateResponse) error {
+	if done, err := o.srv.forward("Operator.AutoEncryptTokenCreate", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	if args.Node == "" {
+		return fmt.Errorf("Must provide the node the token is for")
+	}
+	ttl := args.TTL
+	if ttl < 0 {
+		return fmt.Errorf("Token TTL can't be negative")
+	} else if ttl == 0 {
+		ttl = defaultAutoEncryptTokenTTL
+	}
+
+	now := time.Now()
+	secret := generateUUID()
+	req := structs.AutoEncryptTokenRequest{
+		Datacenter: args.Datacenter,
+		Op:         structs.AutoEncryptTokenCreate,
+		Token: structs.AutoEncryptToken{
+			Hash:        hashAutoEncryptToken(secret),
+			Node:        args.Node,
+			Description: args.Description,
+			ExpiresAt:   now.Add(ttl),
+		},
+		Now: now,
+	}
+	resp, err := o.srv.raftApply(structs.AutoEncryptRequestType, &req)
+	if err != nil {
+		o.srv.logger.Printf("[ERR] consul.operator: AutoEncrypt token create failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	reply.Secret = secret
+	reply.ExpiresAt = req.Token.ExpiresAt
+	return nil
+}
+
+// AreaUpsert is used to create or update a network area, linking the
+// datacenter to a peer datacenter. The area is created if it has no ID,
+// and its ID is returned. It requires a management token.
+func (o *Operator) AreaUpsert(args *structs.AreaRequest, reply *string) error {
+	if done, err := o.srv.forward("Operator.AreaUpsert", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	area := &args.Area
+	if area.PeerDatacenter == "" {
+		return fmt.Errorf("Missing peer datacenter")
+	}
+	if area.PeerDatacenter == o.srv.config.Datacenter {
+		return fmt.Errorf("An area can't link a datacenter to itself")
+	}
+	if len(area.RetryJoin) == 0 {
+		return fmt.Errorf("Missing addresses of the peer servers to join")
+	}
+	for _, join := range area.RetryJoin {
+		if _, _, err := net.SplitHostPort(join); err != nil {
+			return fmt.Errorf("Invalid server address %q: %v", join, err)
+		}
+	}
+	if area.UseTLS && o.srv.connPool.tlsWrap == nil {
+		return fmt.Errorf("Area requires TLS, but the servers don't use TLS for their outgoing connections")
+	}
+
+	if area.ID == "" {
+		area.ID = generateUUID()
+	} else {
+		_, existing, err := o.srv.fsm.State().AreaGet(area.ID)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return fmt.Errorf("Unknown area %q", area.ID)
+		}
+	}
+
+	args.Op = structs.AreaUpsert
+	resp, err := o.srv.raftApply(structs.AreaRequestType, args)
+	if err != nil {
+		o.srv.logger.Printf("[ERR] consul.operator: Area upsert failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	*reply = area.ID
+	return nil
+}
+
+// AreaDelete is used to delete a network area. It requires a management
+// token.
+func (o *Operator) AreaDelete(args *structs.AreaRequest, reply *struct{}) error {
+	if done, err := o.srv.forward("Operator.AreaDelete", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	if args.Area.ID == "" {
+		return fmt.Errorf("Missing area ID")
+	}
+	args.Op = structs.AreaDelete
+	resp, err := o.srv.raftApply(structs.AreaRequestType, args)
+	if err != nil {
+		o.srv.logger.Printf("[ERR] consul.operator: Area delete failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// AreaList is used to list the network areas, or the one of AreaID. It
+// requires a management token.
+func (o *Operator) AreaList(args *structs.AreaSpecificRequest, reply *structs.IndexedAreas) error {
+	if done, err := o.srv.forward("Operator.AreaList", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	state := o.srv.fsm.State()
+	return o.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("Areas"),
+		func() error {
+			if args.AreaID == "" {
+				var err error
+				reply.Index, reply.Areas, err = state.AreaList()
+				return err
+			}
+			index, area, err := state.AreaGet(args.AreaID)
+			reply.Index, reply.Areas = index, nil
+			if area != nil {
+				reply.Areas = structs.Areas{area}
+			}
+			return err
+		})
+}
+
+// AreaServers is used to get the servers of the peer datacenter of an
+// area, as discovered by the server answering. Every server discovers
+// them on its own, so any server answers. It requires a management
+// token.
+func (o *Operator) AreaServers(args *structs.AreaSpecificRequest, reply *structs.AreaServers) error {
+	args.AllowStale = true
+	if done, err := o.srv.forward("Operator.AreaServers", args, args, reply); done {
+		return err
+	}
+
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	servers, ok := o.srv.areas.servers(args.AreaID)
+	if !ok {
+		return fmt.Errorf("Unknown area %q", args.AreaID)
+	}
+	*reply = *servers
+	return nil
+}
@@ -0,0 +1,428 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestOperator_StateStats(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A management token is required
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var stats structs.StateStats
+	err := msgpackrpc.CallWithCodec(codec, "Operator.StateStats", &args, &stats)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.StateStats", &args, &stats); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.Server != s1.config.NodeName {
+		t.Fatalf("bad: %v", stats.Server)
+	}
+
+	// The leader registers itself, and the master token is an ACL
+	if stats.Objects[dbNodes] != 1 || stats.Objects[dbACLs] == 0 {
+		t.Fatalf("bad: %v", stats.Objects)
+	}
+	if stats.Bytes[dbNodes] == 0 || stats.IndexBytes[dbNodes] == 0 {
+		t.Fatalf("bad: %v %v", stats.Bytes, stats.IndexBytes)
+	}
+}
+
+func TestOperator_SlowQueries(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.SlowQueryThreshold = time.Nanosecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A management token is required
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var report structs.SlowQueryReport
+	err := msgpackrpc.CallWithCodec(codec, "Operator.SlowQueries", &args, &report)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every query is slow, and the token lookups are redacted
+	args.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.SlowQueries", &args, &report); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Server != s1.config.NodeName || report.Threshold != time.Nanosecond {
+		t.Fatalf("bad: %#v", report)
+	}
+	if len(report.Queries) == 0 {
+		t.Fatalf("bad: %#v", report)
+	}
+	for _, q := range report.Queries {
+		for _, param := range q.Params {
+			if strings.Contains(param, "root") {
+				t.Fatalf("bad: %#v", q)
+			}
+		}
+	}
+}
+
+func TestOperator_StateVerify(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A management token is required
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var report structs.StateVerifyReport
+	err := msgpackrpc.CallWithCodec(codec, "Operator.StateVerify", &args, &report)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.StateVerify", &args, &report); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Server != s1.config.NodeName || report.Index == 0 {
+		t.Fatalf("bad: %#v", report)
+	}
+	if report.Rows[dbNodes] != 1 || len(report.Problems) != 0 {
+		t.Fatalf("bad: %#v", report)
+	}
+}
+
+func TestOperator_RaftGetConfiguration(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A management token is required
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var out structs.RaftConfigurationResponse
+	err := msgpackrpc.CallWithCodec(codec, "Operator.RaftGetConfiguration", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RaftGetConfiguration", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Servers) != 1 {
+		t.Fatalf("bad: %v", out.Servers)
+	}
+	server := out.Servers[0]
+	if server.Node != s1.config.NodeName || server.Address != s1.raftTransport.LocalAddr() ||
+		server.Status != "alive" || !server.Leader {
+		t.Fatalf("bad: %#v", server)
+	}
+	if out.Index == 0 || !out.KnownLeader {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestOperator_RaftRemovePeerByAddress(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	dir3, s3 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir3)
+	defer s3.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	for _, s := range []*Server{s2, s3} {
+		if _, err := s.JoinLAN([]string{addr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s1.raftPeers.Peers()
+		return len(peers) == 3, nil
+	}, func(err error) {
+		t.Fatalf("should have 3 peers")
+	})
+
+	// Kill a server without leaving
+	s3.Shutdown()
+
+	// A management token is required
+	args := structs.RaftPeerRequest{Datacenter: "dc1", Address: s3.raftTransport.LocalAddr()}
+	var out struct{}
+	err := msgpackrpc.CallWithCodec(codec, "Operator.RaftRemovePeerByAddress", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Unknown peers are rejected
+	args.Token = "root"
+	args.Address = "127.0.0.1:1"
+	err = msgpackrpc.CallWithCodec(codec, "Operator.RaftRemovePeerByAddress", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), "not found in the Raft configuration") {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Address = s3.raftTransport.LocalAddr()
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.RaftRemovePeerByAddress", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, s := range []*Server{s1, s2} {
+		testutil.WaitForResult(func() (bool, error) {
+			peers, _ := s.raftPeers.Peers()
+			return len(peers) == 2, nil
+		}, func(err error) {
+			t.Fatalf("should have 2 peers")
+		})
+	}
+}
+
+func TestOperator_AutopilotConfiguration(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A management token is required
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var out structs.AutopilotConfigResponse
+	err := msgpackrpc.CallWithCodec(codec, "Operator.AutopilotGetConfiguration", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The configuration of the server is the default
+	args.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AutopilotGetConfiguration", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Config.CleanupDeadServers || out.Config.ModifyIndex != 0 {
+		t.Fatalf("bad: %#v", out.Config)
+	}
+
+	set := structs.AutopilotSetConfigRequest{
+		Datacenter: "dc1",
+		Config: structs.AutopilotConfig{
+			ServerStabilizationTime: 30 * time.Second,
+		},
+		CAS: true,
+	}
+	var ok bool
+	err = msgpackrpc.CallWithCodec(codec, "Operator.AutopilotSetConfiguration", &set, &ok)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	set.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AutopilotSetConfiguration", &set, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("should set")
+	}
+
+	// A stale CAS fails
+	set.Config.ServerStabilizationTime = time.Minute
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AutopilotSetConfiguration", &set, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("should fail")
+	}
+
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AutopilotGetConfiguration", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Config.CleanupDeadServers || out.Config.ServerStabilizationTime != 30*time.Second ||
+		out.Config.ModifyIndex == 0 || out.Index != out.Config.ModifyIndex {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Negative times are rejected
+	set.CAS = false
+	set.Config.ServerStabilizationTime = -time.Second
+	err = msgpackrpc.CallWithCodec(codec, "Operator.AutopilotSetConfiguration", &set, &ok)
+	if err == nil || !strings.Contains(err.Error(), "can't be negative") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_Area(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// A management token is required
+	args := structs.AreaRequest{
+		Datacenter: "dc1",
+		Area: structs.Area{
+			PeerDatacenter: "dc2",
+			RetryJoin:      []string{"127.0.0.1:8300"},
+		},
+	}
+	var id string
+	err := msgpackrpc.CallWithCodec(codec, "Operator.AreaUpsert", &args, &id)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	args.Token = "root"
+
+	// The area is validated
+	bad := []structs.Area{
+		{RetryJoin: []string{"127.0.0.1:8300"}},
+		{PeerDatacenter: "dc1", RetryJoin: []string{"127.0.0.1:8300"}},
+		{PeerDatacenter: "dc2"},
+		{PeerDatacenter: "dc2", RetryJoin: []string{"127.0.0.1"}},
+		{PeerDatacenter: "dc2", RetryJoin: []string{"127.0.0.1:8300"}, UseTLS: true},
+		{ID: "nope", PeerDatacenter: "dc2", RetryJoin: []string{"127.0.0.1:8300"}},
+	}
+	for _, area := range bad {
+		req := structs.AreaRequest{Datacenter: "dc1", Area: area}
+		req.Token = "root"
+		if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaUpsert", &req, &id); err == nil {
+			t.Fatalf("should fail: %#v", area)
+		}
+	}
+
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaUpsert", &args, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id == "" {
+		t.Fatalf("missing ID")
+	}
+
+	// Another area can't link the same datacenter
+	args.Area.ID = ""
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaUpsert", &args, &id); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Update the area
+	args.Area.ID = id
+	args.Area.RetryJoin = []string{"127.0.0.1:8300", "127.0.0.2:8300"}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaUpsert", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != id {
+		t.Fatalf("bad: %v", out)
+	}
+
+	list := structs.AreaSpecificRequest{Datacenter: "dc1"}
+	var areas structs.IndexedAreas
+	err = msgpackrpc.CallWithCodec(codec, "Operator.AreaList", &list, &areas)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	list.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaList", &list, &areas); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(areas.Areas) != 1 || areas.Index == 0 {
+		t.Fatalf("bad: %#v", areas)
+	}
+	area := areas.Areas[0]
+	if area.ID != id || area.PeerDatacenter != "dc2" || len(area.RetryJoin) != 2 {
+		t.Fatalf("bad: %#v", area)
+	}
+
+	// Get a single area
+	list.AreaID = "nope"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaList", &list, &areas); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(areas.Areas) != 0 {
+		t.Fatalf("bad: %#v", areas)
+	}
+	list.AreaID = id
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaList", &list, &areas); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(areas.Areas) != 1 || areas.Areas[0].ID != id {
+		t.Fatalf("bad: %#v", areas)
+	}
+
+	// Delete the area
+	del := structs.AreaRequest{Datacenter: "dc1", Area: structs.Area{ID: id}}
+	err = msgpackrpc.CallWithCodec(codec, "Operator.AreaDelete", &del, &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	del.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaDelete", &del, &struct{}{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	list.AreaID = ""
+	if err := msgpackrpc.CallWithCodec(codec, "Operator.AreaList", &list, &areas); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(areas.Areas) != 0 {
+		t.Fatalf("bad: %#v", areas)
+	}
+}
@@ -0,0 +1,277 @@
+package consul
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// outboxBatchSize is the maximum number of entries delivered to a
+	// subscription in a single request
+	outboxBatchSize = 64
+
+	// outboxTimeout bounds how long a delivery may take
+	outboxTimeout = 10 * time.Second
+
+	// outboxInterval is how often the outbox is re-scanned even when no
+	// watch has fired. This covers the state store being swapped out by
+	// a snapshot restore.
+	outboxInterval = 30 * time.Second
+
+	// outboxRetryMin and outboxRetryMax bound the backoff between failed
+	// deliveries to a subscription
+	outboxRetryMin = time.Second
+	outboxRetryMax = 5 * time.Minute
+
+	// outboxSubscriptionHeader names the subscription of a delivery
+	outboxSubscriptionHeader = "X-Consul-Outbox-Subscription"
+)
+
+// outboxBackoff tracks the failed deliveries to a subscription
+type outboxBackoff struct {
+	wait time.Duration
+	next time.Time
+}
+
+// compileOutboxSubscriptions validates the configured subscriptions
+func compileOutboxSubscriptions(subs []*structs.OutboxSubscription) error {
+	seen := make(map[string]struct{}, len(subs))
+	for _, sub := range subs {
+		if sub.Name == "" {
+			return fmt.Errorf("Outbox subscription is missing a name")
+		}
+		if _, ok := seen[sub.Name]; ok {
+			return fmt.Errorf("Duplicate outbox subscription '%s'", sub.Name)
+		}
+		seen[sub.Name] = struct{}{}
+		if sub.MaxPending < 0 {
+			return fmt.Errorf("Invalid max pending for outbox subscription '%s': %d", sub.Name, sub.MaxPending)
+		}
+
+		u, err := url.Parse(sub.URL)
+		if err != nil {
+			return fmt.Errorf("Invalid URL for outbox subscription '%s': %v", sub.Name, err)
+		}
+		outboxSinksLock.RLock()
+		_, ok := outboxSinks[u.Scheme]
+		outboxSinksLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("Unsupported sink '%s' for outbox subscription '%s'", u.Scheme, sub.Name)
+		}
+	}
+	return nil
+}
+
+// syncOutboxSubscriptions is used when we become the leader to commit
+// the configured subscriptions, and to remove any that are no longer
+// configured along with their undelivered entries.
+func (s *Server) syncOutboxSubscriptions() error {
+	state := s.fsm.State()
+	_, existing, err := state.OutboxSubscriptions()
+	if err != nil {
+		return err
+	}
+	current := make(map[string]*structs.OutboxSubscription, len(existing))
+	for _, sub := range existing {
+		current[sub.Name] = sub
+	}
+
+	for _, sub := range s.config.OutboxSubscriptions {
+		if exist, ok := current[sub.Name]; ok {
+			delete(current, sub.Name)
+			if exist.Prefix == sub.Prefix && exist.URL == sub.URL &&
+				exist.MaxPending == sub.MaxPending {
+				continue
+			}
+		}
+		args := structs.OutboxRequest{
+			Datacenter: s.config.Datacenter,
+			Op:         structs.OutboxSubscribe,
+			Subscription: structs.OutboxSubscription{
+				Name:       sub.Name,
+				Prefix:     sub.Prefix,
+				URL:        sub.URL,
+				MaxPending: sub.MaxPending,
+			},
+		}
+		if err := s.applyOutboxRequest(&args); err != nil {
+			return err
+		}
+	}
+
+	for name := range current {
+		args := structs.OutboxRequest{
+			Datacenter:   s.config.Datacenter,
+			Op:           structs.OutboxUnsubscribe,
+			Subscription: structs.OutboxSubscription{Name: name},
+		}
+		if err := s.applyOutboxRequest(&args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outboxSinkState is a sink along with the URL it was created from
+type outboxSinkState struct {
+	url  string
+	sink OutboxSink
+}
+
+// outboxSinkFor returns the sink of a subscription, creating it if needed
+// and replacing it if the URL of the subscription has changed
+func outboxSinkFor(sinks map[string]*outboxSinkState, sub *structs.OutboxSubscription) (OutboxSink, error) {
+	if st, ok := sinks[sub.Name]; ok {
+		if st.url == sub.URL {
+			return st.sink, nil
+		}
+		st.sink.Close()
+		delete(sinks, sub.Name)
+	}
+	sink, err := newOutboxSink(sub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create sink: %v", err)
+	}
+	sinks[sub.Name] = &outboxSinkState{url: sub.URL, sink: sink}
+	return sink, nil
+}
+
+// dispatchOutbox runs while we are the leader, and publishes the entries
+// of each subscription to its sink in the order they were committed.
+// Entries are only removed once their delivery is acknowledged, so they
+// are retried across failures and leader changes. This gives at-least-once
+// delivery, consumers should use the message ID to discard duplicates.
+func (s *Server) dispatchOutbox(stopCh chan struct{}) {
+	backoff := make(map[string]*outboxBackoff)
+	sinks := make(map[string]*outboxSinkState)
+	defer func() {
+		for _, st := range sinks {
+			st.sink.Close()
+		}
+	}()
+
+	notify := make(chan struct{}, 1)
+	for {
+		// Register the watch, it is cleared once it fires
+		state := s.fsm.State()
+		var tables MDBTables
+		tables = append(tables, state.QueryTables("OutboxSubs")...)
+		tables = append(tables, state.QueryTables("OutboxPending")...)
+		state.Watch(tables, notify)
+
+		_, subs, err := state.OutboxSubscriptions()
+		if err != nil {
+			s.logger.Printf("[ERR] consul.outbox: Failed to list subscriptions: %v", err)
+		}
+
+		wait := outboxInterval
+		now := time.Now()
+		active := make(map[string]struct{}, len(subs))
+		for _, sub := range subs {
+			active[sub.Name] = struct{}{}
+			if b, ok := backoff[sub.Name]; ok && now.Before(b.next) {
+				if until := b.next.Sub(now); until < wait {
+					wait = until
+				}
+				continue
+			}
+
+			sink, err := outboxSinkFor(sinks, sub)
+			if err == nil {
+				err = s.deliverOutbox(sink, sub)
+			}
+			if err != nil {
+				s.logger.Printf("[ERR] consul.outbox: Failed to deliver to '%s': %v", sub.Name, err)
+				metrics.IncrCounter([]string{"consul", "outbox", "failed"}, 1)
+				b, ok := backoff[sub.Name]
+				if !ok {
+					b = &outboxBackoff{wait: outboxRetryMin}
+					backoff[sub.Name] = b
+				} else {
+					b.wait *= 2
+					if b.wait > outboxRetryMax {
+						b.wait = outboxRetryMax
+					}
+				}
+				b.next = time.Now().Add(b.wait)
+				if b.wait < wait {
+					wait = b.wait
+				}
+				continue
+			}
+			delete(backoff, sub.Name)
+		}
+
+		// Forget the backoff and sinks of removed subscriptions
+		for name := range backoff {
+			if _, ok := active[name]; !ok {
+				delete(backoff, name)
+			}
+		}
+		for name, st := range sinks {
+			if _, ok := active[name]; !ok {
+				st.sink.Close()
+				delete(sinks, name)
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(wait):
+		case <-stopCh:
+			state.StopWatch(tables, notify)
+			return
+		}
+	}
+}
+
+// deliverOutbox publishes the next batch of pending entries of a
+// subscription, and commits their acknowledgment
+func (s *Server) deliverOutbox(sink OutboxSink, sub *structs.OutboxSubscription) error {
+	_, entries, err := s.fsm.State().OutboxPending(sub.Name, outboxBatchSize)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	defer metrics.MeasureSince([]string{"consul", "outbox", "deliver"}, time.Now())
+
+	msgs := make([]*OutboxMessage, len(entries))
+	acks := make([]string, len(entries))
+	for i, e := range entries {
+		msgs[i] = newOutboxMessage(e)
+		acks[i] = e.ID
+	}
+	if err := sink.Publish(msgs); err != nil {
+		return err
+	}
+
+	args := structs.OutboxRequest{
+		Datacenter:   s.config.Datacenter,
+		Op:           structs.OutboxAck,
+		Subscription: structs.OutboxSubscription{Name: sub.Name},
+		Acks:         acks,
+	}
+	if err := s.applyOutboxRequest(&args); err != nil {
+		return err
+	}
+	metrics.IncrCounter([]string{"consul", "outbox", "delivered"}, float32(len(entries)))
+	return nil
+}
+
+// applyOutboxRequest commits an outbox request
+func (s *Server) applyOutboxRequest(args *structs.OutboxRequest) error {
+	resp, err := s.raftApply(structs.OutboxRequestType, args)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package consul
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/armon/go-radix"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// outboxIndex indexes the outbox subscriptions by prefix, so recording
+// a KV change only visits the subscriptions whose prefix matches the key
+// instead of scanning all of them.
+type outboxIndex struct {
+	l    sync.RWMutex
+	tree *radix.Tree // Prefix to the set of subscription names
+}
+
+// newOutboxIndex creates an index without any subscriptions
+func newOutboxIndex() *outboxIndex {
+	return &outboxIndex{
+		tree: radix.New(),
+	}
+}
+
+// set replaces the indexed subscriptions
+func (o *outboxIndex) set(subs []*structs.OutboxSubscription) {
+	tree := radix.New()
+	for _, sub := range subs {
+		var names map[string]struct{}
+		if raw, ok := tree.Get(sub.Prefix); ok {
+			names = raw.(map[string]struct{})
+		} else {
+			names = make(map[string]struct{})
+			tree.Insert(sub.Prefix, names)
+		}
+		names[sub.Name] = struct{}{}
+	}
+
+	o.l.Lock()
+	defer o.l.Unlock()
+	o.tree = tree
+}
+
+// match returns the names of the subscriptions whose prefix matches the
+// key, sorted so the changes are recorded in a deterministic order
+func (o *outboxIndex) match(key string) []string {
+	o.l.RLock()
+	defer o.l.RUnlock()
+
+	var out []string
+	o.tree.WalkPath(key, func(prefix string, raw interface{}) bool {
+		for name := range raw.(map[string]struct{}) {
+			out = append(out, name)
+		}
+		return false
+	})
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,138 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// OutboxSchemaVersion is the version of the OutboxMessage format. It
+	// is bumped on any incompatible change so consumers can detect it.
+	OutboxSchemaVersion = 1
+)
+
+// OutboxMessage is the typed state change that is published to a sink.
+// Consumers should use the ID to discard duplicates, since delivery is
+// at-least-once.
+type OutboxMessage struct {
+	Version      int
+	Subscription string
+	ID           string
+	Op           structs.KVSOp
+	Key          string
+	Value        []byte
+	Flags        uint64
+	Session      string
+	Index        uint64
+}
+
+// newOutboxMessage converts an outbox entry into a message
+func newOutboxMessage(e *structs.OutboxEntry) *OutboxMessage {
+	return &OutboxMessage{
+		Version:      OutboxSchemaVersion,
+		Subscription: e.Subscription,
+		ID:           e.ID,
+		Op:           e.Op,
+		Key:          e.Entry.Key,
+		Value:        e.Entry.Value,
+		Flags:        e.Entry.Flags,
+		Session:      e.Entry.Session,
+		Index:        e.CreateIndex,
+	}
+}
+
+// OutboxSink publishes the messages of a subscription to an external
+// system. Publish must only return nil once every message has been
+// accepted, since the messages are then acknowledged and discarded.
+type OutboxSink interface {
+	Publish(msgs []*OutboxMessage) error
+	Close() error
+}
+
+// OutboxSinkFactory creates a sink from the URL of a subscription
+type OutboxSinkFactory func(name string, u *url.URL) (OutboxSink, error)
+
+var (
+	outboxSinks     = make(map[string]OutboxSinkFactory)
+	outboxSinksLock sync.RWMutex
+)
+
+func init() {
+	RegisterOutboxSink("http", newWebhookSink)
+	RegisterOutboxSink("https", newWebhookSink)
+}
+
+// RegisterOutboxSink makes a sink available to the subscriptions whose
+// URL uses the given scheme. Only webhooks are built in: the Kafka and
+// NATS clients are not vendored in this tree, so a sink for a message
+// broker is built outside of it and registers its own scheme from an
+// init func.
+func RegisterOutboxSink(scheme string, factory OutboxSinkFactory) {
+	outboxSinksLock.Lock()
+	defer outboxSinksLock.Unlock()
+	outboxSinks[scheme] = factory
+}
+
+// newOutboxSink creates the sink for a subscription
+func newOutboxSink(sub *structs.OutboxSubscription) (OutboxSink, error) {
+	u, err := url.Parse(sub.URL)
+	if err != nil {
+		return nil, err
+	}
+	outboxSinksLock.RLock()
+	factory, ok := outboxSinks[u.Scheme]
+	outboxSinksLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unsupported outbox sink '%s'", u.Scheme)
+	}
+	return factory(sub.Name, u)
+}
+
+// webhookSink POSTs each batch of messages as a JSON array
+type webhookSink struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(name string, u *url.URL) (OutboxSink, error) {
+	sink := &webhookSink{
+		name:   name,
+		url:    u.String(),
+		client: &http.Client{Timeout: outboxTimeout},
+	}
+	return sink, nil
+}
+
+func (w *webhookSink) Publish(msgs []*OutboxMessage) error {
+	body, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(outboxSubscriptionHeader, w.name)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *webhookSink) Close() error {
+	return nil
+}
@@ -0,0 +1,209 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestConfig_CheckOutbox(t *testing.T) {
+	config := DefaultConfig()
+	config.OutboxSubscriptions = []*structs.OutboxSubscription{
+		&structs.OutboxSubscription{Name: "deploy", Prefix: "deploy/", URL: "http://127.0.0.1/hook"},
+	}
+	if err := config.CheckOutbox(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	bad := [][]*structs.OutboxSubscription{
+		{&structs.OutboxSubscription{URL: "http://127.0.0.1/hook"}},
+		{&structs.OutboxSubscription{Name: "deploy", URL: "ftp://127.0.0.1/"}},
+		{&structs.OutboxSubscription{Name: "deploy", URL: "http://127.0.0.1/hook", MaxPending: -1}},
+		{
+			&structs.OutboxSubscription{Name: "deploy", URL: "http://127.0.0.1/a"},
+			&structs.OutboxSubscription{Name: "deploy", URL: "http://127.0.0.1/b"},
+		},
+	}
+	for _, subs := range bad {
+		config.OutboxSubscriptions = subs
+		if err := config.CheckOutbox(); err == nil {
+			t.Fatalf("should fail: %#v", subs)
+		}
+	}
+}
+
+type testOutboxSink struct {
+	msgs []*OutboxMessage
+}
+
+func (t *testOutboxSink) Publish(msgs []*OutboxMessage) error {
+	t.msgs = append(t.msgs, msgs...)
+	return nil
+}
+
+func (t *testOutboxSink) Close() error {
+	return nil
+}
+
+func TestOutboxSink_Register(t *testing.T) {
+	sink := &testOutboxSink{}
+	RegisterOutboxSink("test", func(name string, u *url.URL) (OutboxSink, error) {
+		if name != "deploy" || u.Host != "bus" {
+			return nil, fmt.Errorf("bad: %s %v", name, u)
+		}
+		return sink, nil
+	})
+
+	sub := &structs.OutboxSubscription{Name: "deploy", URL: "test://bus"}
+	config := DefaultConfig()
+	config.OutboxSubscriptions = []*structs.OutboxSubscription{sub}
+	if err := config.CheckOutbox(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := newOutboxSink(sub)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	entry := &structs.OutboxEntry{
+		Subscription: "deploy",
+		ID:           outboxEntryID(5, "deploy/web"),
+		Op:           structs.KVSDelete,
+		Entry:        structs.DirEntry{Key: "deploy/web", Flags: 42},
+		CreateIndex:  5,
+	}
+	if err := out.Publish([]*OutboxMessage{newOutboxMessage(entry)}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sink.msgs) != 1 {
+		t.Fatalf("bad: %v", sink.msgs)
+	}
+	msg := sink.msgs[0]
+	if msg.Version != OutboxSchemaVersion || msg.ID != entry.ID || msg.Op != structs.KVSDelete ||
+		msg.Key != "deploy/web" || msg.Flags != 42 || msg.Index != 5 {
+		t.Fatalf("bad: %#v", msg)
+	}
+}
+
+func TestOutbox_Dispatch(t *testing.T) {
+	var l sync.Mutex
+	var received []*OutboxMessage
+	fail := true
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		defer l.Unlock()
+
+		// Reject the first delivery to exercise the retry
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get(outboxSubscriptionHeader) != "deploy" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var msgs []*OutboxMessage
+		if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, msgs...)
+	}))
+	defer hook.Close()
+
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.OutboxSubscriptions = []*structs.OutboxSubscription{
+			&structs.OutboxSubscription{Name: "deploy", Prefix: "deploy/", URL: hook.URL},
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The configured subscription should be committed
+	state := s1.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, subs, err := state.OutboxSubscriptions()
+		return err == nil && len(subs) == 1, err
+	}, func(err error) {
+		t.Fatalf("subscription not committed: %v", err)
+	})
+
+	// Write keys both in and out of the prefix
+	for _, key := range []string{"deploy/web", "other", "deploy/db"} {
+		args := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Value: []byte("v1"),
+			},
+		}
+		if _, err := s1.raftApply(structs.KVSRequestType, &args); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The matching changes should be delivered and acknowledged
+	testutil.WaitForResult(func() (bool, error) {
+		_, pending, err := state.OutboxPending("deploy", 0)
+		if err != nil {
+			return false, err
+		}
+		l.Lock()
+		defer l.Unlock()
+		if len(pending) != 0 || len(received) != 2 {
+			return false, fmt.Errorf("pending: %d, received: %d", len(pending), len(received))
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("entries not delivered: %v", err)
+	})
+
+	l.Lock()
+	defer l.Unlock()
+	if received[0].Key != "deploy/web" || received[1].Key != "deploy/db" {
+		t.Fatalf("bad: %v %v", received[0], received[1])
+	}
+	if received[0].Version != OutboxSchemaVersion || received[0].Op != structs.KVSSet || string(received[0].Value) != "v1" {
+		t.Fatalf("bad: %#v", received[0])
+	}
+}
+
+func TestOutboxIndex(t *testing.T) {
+	idx := newOutboxIndex()
+	idx.set([]*structs.OutboxSubscription{
+		&structs.OutboxSubscription{Name: "web", Prefix: "deploy/web"},
+		&structs.OutboxSubscription{Name: "deploy", Prefix: "deploy/"},
+		&structs.OutboxSubscription{Name: "audit", Prefix: "deploy/"},
+		&structs.OutboxSubscription{Name: "all", Prefix: ""},
+	})
+
+	cases := map[string][]string{
+		"deploy/web/v1": {"all", "audit", "deploy", "web"},
+		"deploy/db":     {"all", "audit", "deploy"},
+		"other":         {"all"},
+	}
+	for key, expect := range cases {
+		if out := idx.match(key); !reflect.DeepEqual(out, expect) {
+			t.Fatalf("bad: %s %v", key, out)
+		}
+	}
+
+	// Replacing the subscriptions drops the previous ones
+	idx.set(nil)
+	if out := idx.match("deploy/web"); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+}
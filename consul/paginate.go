@@ -0,0 +1,126 @@
+package consul
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// pageToken is the position of the last entry of a page, which the next
+// page starts after. The paginated results are sorted by node name, then
+// service ID, so the position stays meaningful while the catalog changes:
+// the entries added or removed before it don't shift the next pages.
+type pageToken struct {
+	node      string
+	serviceID string
+}
+
+// encodePageToken returns the opaque token of a position
+func encodePageToken(node, serviceID string) string {
+	return base64.URLEncoding.EncodeToString([]byte(node + "\x00" + serviceID))
+}
+
+// decodePageToken parses a token returned by encodePageToken
+func decodePageToken(token string) (*pageToken, error) {
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid next token")
+	}
+	parts := strings.SplitN(string(raw), "\x00", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid next token")
+	}
+	return &pageToken{node: parts[0], serviceID: parts[1]}, nil
+}
+
+// before returns if the position sorts before an entry
+func (p *pageToken) before(node, serviceID string) bool {
+	if p.node != node {
+		return lessNode(p.node, node)
+	}
+	return p.serviceID < serviceID
+}
+
+// pageLimit returns the maximum number of entries of a page of a query,
+// the requested limit capped by the configured maximum, or zero if the
+// query is not paginated. The maximum only applies to queries asking for
+// a limit, as the callers that don't, such as DNS, never follow the next
+// token.
+func (s *Server) pageLimit(q *structs.QueryOptions) int {
+	limit, max := q.Limit, s.config.MaxPageSize
+	if limit <= 0 {
+		return 0
+	}
+	if max > 0 && limit > max {
+		limit = max
+	}
+	return limit
+}
+
+// paginate returns the bounds of the requested page of n sorted entries,
+// whose positions are given by key, and the token of the next page, if
+// there are more entries
+func (s *Server) paginate(q *structs.QueryOptions, n int,
+	key func(i int) (string, string)) (int, int, string, error) {
+	start := 0
+	if q.NextToken != "" {
+		token, err := decodePageToken(q.NextToken)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		for start < n && !token.before(key(start)) {
+			start++
+		}
+	}
+
+	end := n
+	limit := s.pageLimit(q)
+	if limit == 0 || end-start <= limit {
+		return start, end, "", nil
+	}
+	end = start + limit
+	return start, end, encodePageToken(key(end - 1)), nil
+}
+
+// paginateNodes keeps the requested page of the nodes of a reply
+func (s *Server) paginateNodes(q *structs.QueryOptions, m *structs.QueryMeta,
+	nodes structs.Nodes) (structs.Nodes, error) {
+	start, end, next, err := s.paginate(q, len(nodes), func(i int) (string, string) {
+		return nodes[i].Node, ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.NextToken = next
+	return nodes[start:end], nil
+}
+
+// paginateServiceNodes keeps the requested page of the service nodes of a
+// reply
+func (s *Server) paginateServiceNodes(q *structs.QueryOptions, m *structs.QueryMeta,
+	nodes structs.ServiceNodes) (structs.ServiceNodes, error) {
+	start, end, next, err := s.paginate(q, len(nodes), func(i int) (string, string) {
+		return nodes[i].Node, nodes[i].ServiceID
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.NextToken = next
+	return nodes[start:end], nil
+}
+
+// paginateCheckServiceNodes keeps the requested page of the check service
+// nodes of a reply
+func (s *Server) paginateCheckServiceNodes(q *structs.QueryOptions, m *structs.QueryMeta,
+	nodes structs.CheckServiceNodes) (structs.CheckServiceNodes, error) {
+	start, end, next, err := s.paginate(q, len(nodes), func(i int) (string, string) {
+		return nodes[i].Node.Node, nodes[i].Service.ID
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.NextToken = next
+	return nodes[start:end], nil
+}
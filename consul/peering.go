@@ -0,0 +1,524 @@
+package consul
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// exportedServicesID is the key of the exported services configuration,
+// which is the only row of its table
+const exportedServicesID = "config"
+
+// exportedServicesFields returns the id index values of the exported
+// services configuration
+func exportedServicesFields(obj interface{}) ([]string, error) {
+	if _, ok := obj.(*structs.ExportedServicesConfig); !ok {
+		return nil, fmt.Errorf("Not an exported services configuration: %#v", obj)
+	}
+	return []string{exportedServicesID}, nil
+}
+
+// PeeringSet is used to create or update a peering. The name of a
+// peering is unique in the datacenter.
+func (s *StateStore) PeeringSet(index uint64, peering *structs.Peering) error {
+	if peering.ID == "" {
+		return fmt.Errorf("Missing peering ID")
+	}
+	if peering.Name == "" {
+		return fmt.Errorf("Missing peer name")
+	}
+
+	tx, err := s.peeringTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.peeringTable.GetTxn(tx, "name", peering.Name)
+	if err != nil {
+		return err
+	}
+	if len(res) > 0 && res[0].(*structs.Peering).ID != peering.ID {
+		return fmt.Errorf("A peering named '%s' already exists", peering.Name)
+	}
+
+	res, err = s.peeringTable.GetTxn(tx, "id", peering.ID)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		peering.CreateIndex = index
+	} else {
+		existing := res[0].(*structs.Peering)
+		if existing.Name != peering.Name {
+			return fmt.Errorf("A peering can't be renamed")
+		}
+		peering.CreateIndex = existing.CreateIndex
+		if _, err := s.peeringTable.DeleteTxn(tx, "id", peering.ID); err != nil {
+			return err
+		}
+	}
+	peering.ModifyIndex = index
+
+	if err := s.peeringTable.InsertTxn(tx, peering); err != nil {
+		return err
+	}
+	if err := s.peeringTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.peeringTable)
+	return tx.Commit()
+}
+
+// PeeringRestore is used to restore a peering. It should only be used
+// when doing a restore, otherwise PeeringSet should be used.
+func (s *StateStore) PeeringRestore(peering *structs.Peering) error {
+	tx, err := s.peeringTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.peeringTable.InsertTxn(tx, peering); err != nil {
+		return err
+	}
+	if err := s.peeringTable.SetMaxLastIndexTxn(tx, peering.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PeeringGet is used to get a peering by the name of the peer
+func (s *StateStore) PeeringGet(name string) (uint64, *structs.Peering, error) {
+	defer s.measureQuery("PeeringGet", time.Now())
+	return s.peeringGet("name", name)
+}
+
+// PeeringGetByID is used to get a peering by ID
+func (s *StateStore) PeeringGetByID(id string) (uint64, *structs.Peering, error) {
+	defer s.measureQuery("PeeringGetByID", time.Now())
+	return s.peeringGet("id", id)
+}
+
+func (s *StateStore) peeringGet(index, value string) (uint64, *structs.Peering, error) {
+	idx, res, err := s.peeringTable.Get(index, value)
+	var peering *structs.Peering
+	if len(res) > 0 {
+		peering = res[0].(*structs.Peering)
+	}
+	return idx, peering, err
+}
+
+// PeeringList is used to list the peerings
+func (s *StateStore) PeeringList() (uint64, structs.Peerings, error) {
+	defer s.measureQuery("PeeringList", time.Now())
+	idx, res, err := s.peeringTable.Get("name")
+	out := make(structs.Peerings, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.Peering)
+	}
+	return idx, out, err
+}
+
+// PeeringDelete is used to delete a peering by the name of the peer,
+// along with the services imported from it
+func (s *StateStore) PeeringDelete(index uint64, name string) error {
+	tables := MDBTables{s.peeringTable, s.importedTable}
+	tx, err := tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	n, err := s.peeringTable.DeleteTxn(tx, "name", name)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		if err := s.peeringTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		s.notifyTables(tx, s.peeringTable)
+	}
+
+	if n, err := s.importedTable.DeleteTxn(tx, "peer", name); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.importedTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		s.notifyTables(tx, s.importedTable)
+	}
+	return tx.Commit()
+}
+
+// ExportedServicesSet is used to set the exported services configuration
+func (s *StateStore) ExportedServicesSet(index uint64, config *structs.ExportedServicesConfig) error {
+	tx, err := s.exportedTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.exportedTable.GetTxn(tx, "id", exportedServicesID)
+	if err != nil {
+		return err
+	}
+	config.CreateIndex = index
+	if len(res) > 0 {
+		config.CreateIndex = res[0].(*structs.ExportedServicesConfig).CreateIndex
+	}
+	config.ModifyIndex = index
+
+	if err := s.exportedTable.InsertTxn(tx, config); err != nil {
+		return err
+	}
+	if err := s.exportedTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.exportedTable)
+	return tx.Commit()
+}
+
+// ExportedServices is used to get the exported services configuration,
+// which is nil until one is set
+func (s *StateStore) ExportedServices() (uint64, *structs.ExportedServicesConfig, error) {
+	idx, res, err := s.exportedTable.Get("id", exportedServicesID)
+	var config *structs.ExportedServicesConfig
+	if len(res) > 0 {
+		config = res[0].(*structs.ExportedServicesConfig)
+	}
+	return idx, config, err
+}
+
+// ExportedServicesRestore is used to restore the exported services
+// configuration from a snapshot
+func (s *StateStore) ExportedServicesRestore(config *structs.ExportedServicesConfig) error {
+	tx, err := s.exportedTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.exportedTable.InsertTxn(tx, config); err != nil {
+		return err
+	}
+	if err := s.exportedTable.SetMaxLastIndexTxn(tx, config.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportedServicesReplace is used to replace the services imported from
+// a peer. The services that are still imported keep their CreateIndex.
+func (s *StateStore) ImportedServicesReplace(index uint64, peer string, services structs.ImportedServices) error {
+	if peer == "" {
+		return fmt.Errorf("Missing peer name")
+	}
+
+	tx, err := s.importedTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.importedTable.GetTxn(tx, "peer", peer)
+	if err != nil {
+		return err
+	}
+	created := make(map[string]uint64, len(res))
+	for _, raw := range res {
+		existing := raw.(*structs.ImportedService)
+		created[existing.Service] = existing.CreateIndex
+	}
+	if _, err := s.importedTable.DeleteTxn(tx, "peer", peer); err != nil {
+		return err
+	}
+
+	for _, service := range services {
+		service.Peer = peer
+		service.CreateIndex = index
+		if idx, ok := created[service.Service]; ok {
+			service.CreateIndex = idx
+		}
+		service.ModifyIndex = index
+		if err := s.importedTable.InsertTxn(tx, service); err != nil {
+			return err
+		}
+	}
+	if err := s.importedTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.importedTable)
+	return tx.Commit()
+}
+
+// ImportedServiceRestore is used to restore a service imported from a
+// peer. It should only be used when doing a restore.
+func (s *StateStore) ImportedServiceRestore(service *structs.ImportedService) error {
+	tx, err := s.importedTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.importedTable.InsertTxn(tx, service); err != nil {
+		return err
+	}
+	if err := s.importedTable.SetMaxLastIndexTxn(tx, service.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportedServices is used to list the services imported from a peer
+func (s *StateStore) ImportedServices(peer string) (uint64, structs.ImportedServices, error) {
+	defer s.measureQuery("ImportedServices", time.Now(), "peer", peer)
+	idx, res, err := s.importedTable.Get("peer", peer)
+	out := make(structs.ImportedServices, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ImportedService)
+	}
+	return idx, out, err
+}
+
+// ImportedServiceNodes returns the nodes of a service imported from a
+// peer, with their health checks, as of the last exchange with the peer
+func (s *StateStore) ImportedServiceNodes(peer, service string) (uint64, structs.CheckServiceNodes, error) {
+	defer s.measureQuery("ImportedServiceNodes", time.Now(), "service", service)
+	idx, res, err := s.importedTable.Get("id", peer, service)
+	if err != nil || len(res) == 0 {
+		return idx, nil, err
+	}
+	return idx, res[0].(*structs.ImportedService).Nodes, nil
+}
+
+// encodePeeringToken encodes a peering token to hand over to the peer
+func encodePeeringToken(token *structs.PeeringToken) (string, error) {
+	buf, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// decodePeeringToken decodes a peering token generated by the peer
+func decodePeeringToken(encoded string) (*structs.PeeringToken, error) {
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid peering token: %v", err)
+	}
+	var token structs.PeeringToken
+	if err := json.Unmarshal(buf, &token); err != nil {
+		return nil, fmt.Errorf("Invalid peering token: %v", err)
+	}
+	if token.PeerID == "" || token.Secret == "" || len(token.ServerAddresses) == 0 {
+		return nil, fmt.Errorf("Invalid peering token: missing peering ID, secret or server addresses")
+	}
+	return &token, nil
+}
+
+// exportedServices returns the services the exported services
+// configuration shares with a peer, with all of their nodes. The consul
+// service is never exported.
+func (s *Server) exportedServices(peer string) (structs.ImportedServices, error) {
+	state := s.fsm.State()
+	_, config, err := state.ExportedServices()
+	if err != nil || config == nil {
+		return nil, err
+	}
+
+	names := make(map[string]struct{})
+	for _, exported := range config.Services {
+		if !strContains(exported.Consumers, peer) {
+			continue
+		}
+		if exported.Name != "*" {
+			names[exported.Name] = struct{}{}
+			continue
+		}
+		_, services := state.Services()
+		for name := range services {
+			names[name] = struct{}{}
+		}
+	}
+	delete(names, ConsulServiceName)
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var out structs.ImportedServices
+	for _, name := range sorted {
+		_, nodes := state.CheckServiceNodes(name)
+		if len(nodes) == 0 {
+			continue
+		}
+		out = append(out, &structs.ImportedService{Service: name, Nodes: nodes})
+	}
+	return out, nil
+}
+
+// runPeering runs while we are the leader, and pulls the services
+// exported by the peers of the peerings established from a token. The
+// peerings are synced periodically, and as soon as they change.
+func (s *Server) runPeering(stopCh chan struct{}) {
+	for {
+		state := s.fsm.State()
+		notify := make(chan struct{}, 1)
+		tables := state.QueryTables("Peerings")
+		state.Watch(tables, notify)
+
+		if err := s.syncPeerings(); err != nil {
+			s.logger.Printf("[ERR] consul: failed to sync the peerings: %v", err)
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(s.config.PeeringSyncInterval):
+		case <-stopCh:
+			state.StopWatch(tables, notify)
+			return
+		}
+		state.StopWatch(tables, notify)
+	}
+}
+
+// syncPeerings syncs the peerings this datacenter dialed
+func (s *Server) syncPeerings() error {
+	_, peerings, err := s.fsm.State().PeeringList()
+	if err != nil {
+		return err
+	}
+	for _, peering := range peerings {
+		if peering.PeerID == "" {
+			continue
+		}
+		if err := s.syncPeering(peering); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncPeering replaces the services imported from the peer of a peering
+// with those it exports, and records the state of the peering as it
+// changes. A peer that can't be reached keeps its imported services.
+func (s *Server) syncPeering(peering *structs.Peering) error {
+	defer metrics.MeasureSince([]string{"consul", "peering", "sync"}, time.Now())
+
+	update := *peering
+	exchange, err := s.exchangePeering(peering)
+	if err != nil {
+		s.logger.Printf("[WARN] consul: failed to sync peering '%s': %v", peering.Name, err)
+		update.State = structs.PeeringFailing
+		update.LastError = err.Error()
+	} else {
+		if err := s.importServices(peering.Name, exchange.Services); err != nil {
+			return err
+		}
+		update.State = structs.PeeringActive
+		update.LastError = ""
+		update.PeerDatacenter = exchange.Datacenter
+	}
+	if update.State == peering.State && update.LastError == peering.LastError &&
+		update.PeerDatacenter == peering.PeerDatacenter {
+		return nil
+	}
+
+	req := structs.PeeringRequest{
+		Datacenter: s.config.Datacenter,
+		Op:         structs.PeeringUpsert,
+		Peering:    update,
+	}
+	resp, err := s.raftApply(structs.PeeringRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// exchangePeering fetches the services exported to a peering from the
+// first server of the peer that answers
+func (s *Server) exchangePeering(peering *structs.Peering) (*structs.PeeringExchangeResponse, error) {
+	args := structs.PeeringExchangeRequest{
+		Datacenter: peering.PeerDatacenter,
+		PeerID:     peering.PeerID,
+		Secret:     peering.Secret,
+	}
+	lastErr := fmt.Errorf("no server address to dial")
+	for _, server := range peering.PeerServerAddresses {
+		addr, err := net.ResolveTCPAddr("tcp", server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var reply structs.PeeringExchangeResponse
+		if err := s.connPool.RPC(peering.PeerDatacenter, addr, int(s.config.ProtocolVersion),
+			"Peering.Exchange", &args, &reply); err != nil {
+			lastErr = err
+			continue
+		}
+		return &reply, nil
+	}
+	return nil, lastErr
+}
+
+// importServices replaces the services imported from a peer, unless they
+// didn't change
+func (s *Server) importServices(peer string, services structs.ImportedServices) error {
+	_, existing, err := s.fsm.State().ImportedServices(peer)
+	if err != nil {
+		return err
+	}
+	if sameImportedServices(existing, services) {
+		return nil
+	}
+
+	req := structs.ImportedServicesRequest{
+		Datacenter: s.config.Datacenter,
+		Peer:       peer,
+		Services:   services,
+	}
+	resp, err := s.raftApply(structs.ImportedServicesRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// sameImportedServices returns if the imported services and the exported
+// ones have the same nodes. The indexes aren't compared, since the
+// imported services have the indexes of the local state.
+func sameImportedServices(imported, exported structs.ImportedServices) bool {
+	if len(imported) != len(exported) {
+		return false
+	}
+	nodes := make(map[string]structs.CheckServiceNodes, len(imported))
+	for _, service := range imported {
+		nodes[service.Service] = service.Nodes
+	}
+	for _, service := range exported {
+		existing, ok := nodes[service.Service]
+		if !ok || !reflect.DeepEqual(existing, service.Nodes) {
+			return false
+		}
+	}
+	return true
+}
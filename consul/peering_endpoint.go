@@ -0,0 +1,368 @@
+package consul
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Peering endpoint is used to manage the peerings with other clusters,
+// and the services exported to them
+type Peering struct {
+	srv *Server
+}
+
+// GenerateToken is used to create a pending peering, and returns the
+// token the peer establishes it with. Generating a token for an existing
+// peering replaces its secret, so its previous token stops working. It
+// requires a management token.
+func (p *Peering) GenerateToken(args *structs.PeeringTokenRequest, reply *string) error {
+	if done, err := p.srv.forward("Peering.GenerateToken", args, args, reply); done {
+		return err
+	}
+
+	acl, err := p.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	if args.PeerName == "" {
+		return fmt.Errorf("Missing peer name")
+	}
+	_, existing, err := p.srv.fsm.State().PeeringGet(args.PeerName)
+	if err != nil {
+		return err
+	}
+	peering := structs.Peering{
+		ID:    generateUUID(),
+		Name:  args.PeerName,
+		State: structs.PeeringPending,
+	}
+	if existing != nil {
+		if existing.PeerID != "" {
+			return fmt.Errorf("Peering '%s' was established from a token of the peer", args.PeerName)
+		}
+		peering.ID = existing.ID
+	}
+	secret := generateUUID()
+	peering.SecretHash = hashAutoEncryptToken(secret)
+
+	servers, err := p.srv.raftPeers.Peers()
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("No server address to hand over to the peer")
+	}
+	token, err := encodePeeringToken(&structs.PeeringToken{
+		Datacenter:      p.srv.config.Datacenter,
+		ServerAddresses: servers,
+		PeerID:          peering.ID,
+		Secret:          secret,
+	})
+	if err != nil {
+		return err
+	}
+
+	req := structs.PeeringRequest{
+		Datacenter: args.Datacenter,
+		Op:         structs.PeeringUpsert,
+		Peering:    peering,
+	}
+	resp, err := p.srv.raftApply(structs.PeeringRequestType, &req)
+	if err != nil {
+		p.srv.logger.Printf("[ERR] consul.peering: Token generation failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	*reply = token
+	return nil
+}
+
+// Establish is used to establish a peering from a token generated by the
+// peer, and returns the ID of the peering. The services exported by the
+// peer are imported once the leader first reaches it. It requires a
+// management token.
+func (p *Peering) Establish(args *structs.PeeringTokenRequest, reply *string) error {
+	if done, err := p.srv.forward("Peering.Establish", args, args, reply); done {
+		return err
+	}
+
+	acl, err := p.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	if args.PeerName == "" {
+		return fmt.Errorf("Missing peer name")
+	}
+	token, err := decodePeeringToken(args.PeeringToken)
+	if err != nil {
+		return err
+	}
+	_, existing, err := p.srv.fsm.State().PeeringGet(args.PeerName)
+	if err != nil {
+		return err
+	}
+	peering := structs.Peering{
+		ID:                  generateUUID(),
+		Name:                args.PeerName,
+		State:               structs.PeeringEstablishing,
+		PeerID:              token.PeerID,
+		PeerDatacenter:      token.Datacenter,
+		PeerServerAddresses: token.ServerAddresses,
+		Secret:              token.Secret,
+	}
+	if existing != nil {
+		if existing.PeerID == "" {
+			return fmt.Errorf("Peering '%s' generated a token for the peer", args.PeerName)
+		}
+		peering.ID = existing.ID
+	}
+
+	req := structs.PeeringRequest{
+		Datacenter: args.Datacenter,
+		Op:         structs.PeeringUpsert,
+		Peering:    peering,
+	}
+	resp, err := p.srv.raftApply(structs.PeeringRequestType, &req)
+	if err != nil {
+		p.srv.logger.Printf("[ERR] consul.peering: Establish failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	*reply = peering.ID
+	return nil
+}
+
+// Delete is used to delete a peering by the name of the peer, along with
+// the services imported from it. It requires a management token.
+func (p *Peering) Delete(args *structs.PeeringRequest, reply *struct{}) error {
+	if done, err := p.srv.forward("Peering.Delete", args, args, reply); done {
+		return err
+	}
+
+	acl, err := p.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	if args.Peering.Name == "" {
+		return fmt.Errorf("Missing peer name")
+	}
+	args.Op = structs.PeeringDelete
+	resp, err := p.srv.raftApply(structs.PeeringRequestType, args)
+	if err != nil {
+		p.srv.logger.Printf("[ERR] consul.peering: Delete failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// List is used to list the peerings. It requires a management token.
+func (p *Peering) List(args *structs.DCSpecificRequest, reply *structs.IndexedPeerings) error {
+	if done, err := p.srv.forward("Peering.List", args, args, reply); done {
+		return err
+	}
+
+	acl, err := p.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	state := p.srv.fsm.State()
+	return p.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("Peerings"),
+		func() error {
+			index, peerings, err := state.PeeringList()
+			if err != nil {
+				return err
+			}
+			reply.Index, reply.Peerings = index, make(structs.Peerings, len(peerings))
+			for i, peering := range peerings {
+				reply.Peerings[i] = redactPeering(peering)
+			}
+			return nil
+		})
+}
+
+// Read is used to get a peering by the name of the peer, with the names
+// of the services imported from it. It requires a management token.
+func (p *Peering) Read(args *structs.PeeringSpecificRequest, reply *structs.PeeringResponse) error {
+	if done, err := p.srv.forward("Peering.Read", args, args, reply); done {
+		return err
+	}
+
+	acl, err := p.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	state := p.srv.fsm.State()
+	return p.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("PeeringGet"),
+		func() error {
+			index, peering, err := state.PeeringGet(args.PeerName)
+			if err != nil {
+				return err
+			}
+			importIndex, imported, err := state.ImportedServices(args.PeerName)
+			if err != nil {
+				return err
+			}
+			if importIndex > index {
+				index = importIndex
+			}
+			reply.Index, reply.Peering, reply.ImportedServices = index, nil, nil
+			if peering == nil {
+				return nil
+			}
+			reply.Peering = redactPeering(peering)
+			for _, service := range imported {
+				reply.ImportedServices = append(reply.ImportedServices, service.Service)
+			}
+			return nil
+		})
+}
+
+// redactPeering returns a copy of a peering without its secret
+func redactPeering(peering *structs.Peering) *structs.Peering {
+	out := *peering
+	out.Secret = ""
+	out.SecretHash = ""
+	return &out
+}
+
+// SetExportedServices is used to set the services exported to the peers.
+// It requires a management token.
+func (p *Peering) SetExportedServices(args *structs.ExportedServicesRequest, reply *struct{}) error {
+	if done, err := p.srv.forward("Peering.SetExportedServices", args, args, reply); done {
+		return err
+	}
+
+	acl, err := p.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	for _, exported := range args.Config.Services {
+		if exported.Name == "" {
+			return fmt.Errorf("Missing exported service name")
+		}
+		if len(exported.Consumers) == 0 {
+			return fmt.Errorf("Service '%s' isn't exported to any peer", exported.Name)
+		}
+	}
+
+	resp, err := p.srv.raftApply(structs.ExportedServicesRequestType, args)
+	if err != nil {
+		p.srv.logger.Printf("[ERR] consul.peering: Exported services update failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// ExportedServices is used to get the services exported to the peers. It
+// requires a management token.
+func (p *Peering) ExportedServices(args *structs.DCSpecificRequest, reply *structs.ExportedServicesResponse) error {
+	if done, err := p.srv.forward("Peering.ExportedServices", args, args, reply); done {
+		return err
+	}
+
+	acl, err := p.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+
+	state := p.srv.fsm.State()
+	return p.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("ExportedServices"),
+		func() error {
+			index, config, err := state.ExportedServices()
+			if err != nil {
+				return err
+			}
+			reply.Index, reply.Config = index, structs.ExportedServicesConfig{}
+			if config != nil {
+				reply.Config = *config
+			}
+			return nil
+		})
+}
+
+// Exchange is called by the leader of the peer that established a
+// peering, to fetch the services exported to it. It is authenticated by
+// the secret of the token of the peering rather than by an ACL token, and
+// activates the peering on its first call.
+func (p *Peering) Exchange(args *structs.PeeringExchangeRequest, reply *structs.PeeringExchangeResponse) error {
+	if done, err := p.srv.forward("Peering.Exchange", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "peering", "exchange"}, time.Now())
+
+	_, peering, err := p.srv.fsm.State().PeeringGetByID(args.PeerID)
+	if err != nil {
+		return err
+	}
+	if peering == nil || peering.PeerID != "" ||
+		subtle.ConstantTimeCompare([]byte(hashAutoEncryptToken(args.Secret)), []byte(peering.SecretHash)) != 1 {
+		p.srv.logger.Printf("[WARN] consul.peering: Rejected exchange of peering '%s'", args.PeerID)
+		return permissionDeniedErr
+	}
+
+	if peering.State != structs.PeeringActive {
+		req := structs.PeeringRequest{
+			Datacenter: args.Datacenter,
+			Op:         structs.PeeringUpsert,
+			Peering:    *peering,
+		}
+		req.Peering.State = structs.PeeringActive
+		resp, err := p.srv.raftApply(structs.PeeringRequestType, &req)
+		if err != nil {
+			p.srv.logger.Printf("[ERR] consul.peering: Activation failed: %v", err)
+			return err
+		}
+		if respErr, ok := resp.(error); ok {
+			return respErr
+		}
+		p.srv.logger.Printf("[INFO] consul.peering: Peering '%s' is active", peering.Name)
+	}
+
+	services, err := p.srv.exportedServices(peering.Name)
+	if err != nil {
+		return err
+	}
+	reply.Datacenter = p.srv.config.Datacenter
+	reply.Services = services
+	return nil
+}
@@ -0,0 +1,185 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestPeering_EstablishAndImport(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+		c.PeeringSyncInterval = 100 * time.Millisecond
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+	testutil.WaitForLeader(t, s2.RPC, "dc2")
+
+	// Register a service in dc1 and export it to the peer
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service:    &structs.NodeService{ID: "web", Service: "web", Port: 80},
+	}
+	if err := s1.RPC("Catalog.Register", &reg, &struct{}{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reg.Service = &structs.NodeService{ID: "db", Service: "db", Port: 5432}
+	if err := s1.RPC("Catalog.Register", &reg, &struct{}{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	export := structs.ExportedServicesRequest{
+		Datacenter: "dc1",
+		Config: structs.ExportedServicesConfig{
+			Services: []structs.ExportedService{{Name: "web", Consumers: []string{"cluster2"}}},
+		},
+	}
+	if err := s1.RPC("Peering.SetExportedServices", &export, &struct{}{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// dc1 accepts the peering, and dc2 establishes it with the token
+	gen := structs.PeeringTokenRequest{Datacenter: "dc1", PeerName: "cluster2"}
+	var token string
+	if err := s1.RPC("Peering.GenerateToken", &gen, &token); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	establish := structs.PeeringTokenRequest{Datacenter: "dc2", PeerName: "cluster1", PeeringToken: token}
+	var id string
+	if err := s2.RPC("Peering.Establish", &establish, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The exported service is imported, and the peering is active on
+	// both sides
+	testutil.WaitForResult(func() (bool, error) {
+		args := structs.PeeringSpecificRequest{Datacenter: "dc2", PeerName: "cluster1"}
+		var out structs.PeeringResponse
+		if err := s2.RPC("Peering.Read", &args, &out); err != nil {
+			return false, err
+		}
+		if out.Peering == nil || out.Peering.State != structs.PeeringActive {
+			return false, fmt.Errorf("bad: %#v", out.Peering)
+		}
+		return reflect.DeepEqual(out.ImportedServices, []string{"web"}), fmt.Errorf("bad: %v", out.ImportedServices)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	list := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var peerings structs.IndexedPeerings
+	if err := s1.RPC("Peering.List", &list, &peerings); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(peerings.Peerings) != 1 || peerings.Peerings[0].Name != "cluster2" ||
+		peerings.Peerings[0].State != structs.PeeringActive || peerings.Peerings[0].SecretHash != "" {
+		t.Fatalf("bad: %#v", peerings.Peerings)
+	}
+
+	// The imported service resolves to the nodes of dc1
+	args := structs.ServiceSpecificRequest{Datacenter: "dc2", ServiceName: "web", PeerName: "cluster1"}
+	var nodes structs.IndexedCheckServiceNodes
+	if err := s2.RPC("Health.ServiceNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.Nodes) != 1 || nodes.Nodes[0].Node.Node != "foo" || nodes.Nodes[0].Service.Port != 80 {
+		t.Fatalf("bad: %#v", nodes.Nodes)
+	}
+	args.ServiceName = "db"
+	if err := s2.RPC("Health.ServiceNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.Nodes) != 0 {
+		t.Fatalf("bad: %#v", nodes.Nodes)
+	}
+
+	// Once dc1 deletes the peering, the exchanges fail
+	del := structs.PeeringRequest{Datacenter: "dc1", Peering: structs.Peering{Name: "cluster2"}}
+	if err := s1.RPC("Peering.Delete", &del, &struct{}{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		args := structs.PeeringSpecificRequest{Datacenter: "dc2", PeerName: "cluster1"}
+		var out structs.PeeringResponse
+		if err := s2.RPC("Peering.Read", &args, &out); err != nil {
+			return false, err
+		}
+		return out.Peering.State == structs.PeeringFailing &&
+			strings.Contains(out.Peering.LastError, permissionDenied), fmt.Errorf("bad: %#v", out.Peering)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestPeering_Exchange(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	gen := structs.PeeringTokenRequest{Datacenter: "dc1", PeerName: "cluster2"}
+	var encoded string
+	if err := s1.RPC("Peering.GenerateToken", &gen, &encoded); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	token, err := decodePeeringToken(encoded)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token.Datacenter != "dc1" || !reflect.DeepEqual(token.ServerAddresses, []string{s1.config.RPCAddr.String()}) {
+		t.Fatalf("bad: %#v", token)
+	}
+
+	// A wrong secret is rejected
+	args := structs.PeeringExchangeRequest{Datacenter: "dc1", PeerID: token.PeerID, Secret: "nope"}
+	var out structs.PeeringExchangeResponse
+	err = s1.RPC("Peering.Exchange", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The secret of the token activates the peering
+	args.Secret = token.Secret
+	if err := s1.RPC("Peering.Exchange", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Datacenter != "dc1" || len(out.Services) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+	_, peering, err := s1.fsm.State().PeeringGet("cluster2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if peering.State != structs.PeeringActive {
+		t.Fatalf("bad: %#v", peering)
+	}
+
+	// A new token replaces the secret
+	if err := s1.RPC("Peering.GenerateToken", &gen, &encoded); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = s1.RPC("Peering.Exchange", &args, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The token of the peer can't be used to establish the peering with
+	// the same name as the accepting side
+	establish := structs.PeeringTokenRequest{Datacenter: "dc1", PeerName: "cluster2", PeeringToken: encoded}
+	var id string
+	if err := s1.RPC("Peering.Establish", &establish, &id); err == nil {
+		t.Fatalf("should fail")
+	}
+}
@@ -0,0 +1,239 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_Peerings(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// The ID and name are required
+	if err := store.PeeringSet(1, &structs.Peering{Name: "cluster2"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := store.PeeringSet(1, &structs.Peering{ID: "p1"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	p1 := &structs.Peering{ID: "p1", Name: "cluster2", State: structs.PeeringPending, SecretHash: "abcd"}
+	if err := store.PeeringSet(1, p1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	p2 := &structs.Peering{
+		ID:                  "p2",
+		Name:                "cluster3",
+		State:               structs.PeeringEstablishing,
+		PeerID:              "remote",
+		PeerServerAddresses: []string{"10.0.0.1:8300"},
+		Secret:              "secret",
+	}
+	if err := store.PeeringSet(2, p2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The names are unique, and a peering can't be renamed
+	if err := store.PeeringSet(3, &structs.Peering{ID: "p3", Name: "cluster2"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := store.PeeringSet(3, &structs.Peering{ID: "p1", Name: "cluster4"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Updating keeps the create index
+	update := &structs.Peering{ID: "p1", Name: "cluster2", State: structs.PeeringActive, SecretHash: "abcd"}
+	if err := store.PeeringSet(4, update); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if update.CreateIndex != 1 || update.ModifyIndex != 4 {
+		t.Fatalf("bad: %#v", update)
+	}
+
+	idx, peering, err := store.PeeringGet("cluster2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 4 || !reflect.DeepEqual(peering, update) {
+		t.Fatalf("bad: %d %#v", idx, peering)
+	}
+	_, peering, err = store.PeeringGetByID("p2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(peering, p2) {
+		t.Fatalf("bad: %#v", peering)
+	}
+
+	idx, peerings, err := store.PeeringList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 4 || len(peerings) != 2 || peerings[0].Name != "cluster2" || peerings[1].Name != "cluster3" {
+		t.Fatalf("bad: %d %#v", idx, peerings)
+	}
+
+	// Deleting a peering deletes the services imported from it
+	imported := structs.ImportedServices{&structs.ImportedService{Service: "web"}}
+	if err := store.ImportedServicesReplace(5, "cluster3", imported); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.PeeringDelete(6, "cluster3"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, peering, err = store.PeeringGet("cluster3")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 6 || peering != nil {
+		t.Fatalf("bad: %d %#v", idx, peering)
+	}
+	idx, imported, err = store.ImportedServices("cluster3")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 6 || len(imported) != 0 {
+		t.Fatalf("bad: %d %#v", idx, imported)
+	}
+}
+
+func TestStateStore_ExportedServices(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	idx, config, err := store.ExportedServices()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 0 || config != nil {
+		t.Fatalf("bad: %d %v", idx, config)
+	}
+
+	config = &structs.ExportedServicesConfig{
+		Services: []structs.ExportedService{{Name: "web", Consumers: []string{"cluster2"}}},
+	}
+	if err := store.ExportedServicesSet(1, config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The create index is kept
+	config = &structs.ExportedServicesConfig{
+		Services: []structs.ExportedService{{Name: "*", Consumers: []string{"cluster2", "cluster3"}}},
+	}
+	if err := store.ExportedServicesSet(2, config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, out, err := store.ExportedServices()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 2 || out.CreateIndex != 1 || out.ModifyIndex != 2 || !reflect.DeepEqual(out.Services, config.Services) {
+		t.Fatalf("bad: %d %#v", idx, out)
+	}
+}
+
+func TestStateStore_ImportedServices(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.ImportedServicesReplace(1, "", nil); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	web := structs.CheckServiceNodes{
+		structs.CheckServiceNode{
+			Node:    structs.Node{Node: "remote1", Address: "10.1.0.1"},
+			Service: structs.NodeService{ID: "web", Service: "web", Port: 80},
+		},
+	}
+	services := structs.ImportedServices{
+		&structs.ImportedService{Service: "web", Nodes: web},
+		&structs.ImportedService{Service: "db"},
+	}
+	if err := store.ImportedServicesReplace(1, "cluster2", services); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	other := structs.ImportedServices{&structs.ImportedService{Service: "web"}}
+	if err := store.ImportedServicesReplace(2, "cluster3", other); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, nodes, err := store.ImportedServiceNodes("cluster2", "web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 2 || !reflect.DeepEqual(nodes, web) {
+		t.Fatalf("bad: %d %#v", idx, nodes)
+	}
+	_, nodes, err = store.ImportedServiceNodes("cluster2", "api")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %#v", nodes)
+	}
+
+	// Replacing drops the services no longer exported, and keeps the
+	// create index of the others
+	services = structs.ImportedServices{&structs.ImportedService{Service: "web"}}
+	if err := store.ImportedServicesReplace(3, "cluster2", services); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, imported, err := store.ImportedServices("cluster2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 3 || len(imported) != 1 || imported[0].Peer != "cluster2" ||
+		imported[0].CreateIndex != 1 || imported[0].ModifyIndex != 3 {
+		t.Fatalf("bad: %d %#v", idx, imported)
+	}
+	_, imported, err = store.ImportedServices("cluster3")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(imported) != 1 || imported[0].CreateIndex != 2 {
+		t.Fatalf("bad: %#v", imported)
+	}
+}
+
+func TestPeeringToken(t *testing.T) {
+	token := &structs.PeeringToken{
+		Datacenter:      "dc1",
+		ServerAddresses: []string{"10.0.0.1:8300"},
+		PeerID:          "p1",
+		Secret:          "secret",
+	}
+	encoded, err := encodePeeringToken(token)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := decodePeeringToken(encoded)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(out, token) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if _, err := decodePeeringToken("not base64!"); err == nil {
+		t.Fatalf("should fail")
+	}
+	encoded, err = encodePeeringToken(&structs.PeeringToken{Datacenter: "dc1", PeerID: "p1"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := decodePeeringToken(encoded); err == nil {
+		t.Fatalf("should fail")
+	}
+}
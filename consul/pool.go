@@ -85,7 +85,7 @@ func (c *Conn) getClient() (*StreamClient, error) {
 	}
 
 	// Create the RPC client
-	codec := msgpackrpc.NewClientCodec(stream)
+	codec := newClientCodec(stream)
 
 	// Return a new stream client
 	sc := &StreamClient{
@@ -0,0 +1,363 @@
+package consul
+
+import (
+	"hash/fnv"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-radix"
+)
+
+// prefixWatchShards is the number of shards of a prefixWatch
+const prefixWatchShards = 16
+
+// prefixWatch is used to watch for changes under KV prefixes. Instead of
+// using a NotifyGroup for the entire KV table, a watcher is registered
+// on a given prefix, and only the watchers of the prefixes of a changed
+// key are woken up.
+//
+// A watcher can also register a glob pattern, such as "config/*/database",
+// see globMatch. The patterns are kept in a second tree, under the
+// literal prefix before their first wildcard, and are matched against the
+// changed key when notifying.
+//
+// The prefixes are sharded by hash, so that the many blocking queries
+// registering watches mostly take different locks. A change walks every
+// shard, since any of them may hold a prefix of the key.
+type prefixWatch struct {
+	shards [prefixWatchShards]prefixWatchShard
+}
+
+// prefixWatchShard holds a notify group for each watched prefix, and
+// for each watched pattern, grouped by literal prefix
+type prefixWatchShard struct {
+	l     sync.Mutex
+	tree  *radix.Tree
+	globs *radix.Tree
+}
+
+// globGroups are the notify groups of the patterns sharing a literal
+// prefix, by pattern
+type globGroups map[string]*NotifyGroup
+
+// newPrefixWatch creates an empty prefix watch
+func newPrefixWatch() *prefixWatch {
+	p := &prefixWatch{}
+	for i := range p.shards {
+		p.shards[i].tree = radix.New()
+		p.shards[i].globs = radix.New()
+	}
+	return p
+}
+
+// validGlob checks that a glob pattern is well formed
+func validGlob(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// globPrefix returns the literal part of a glob pattern, before its
+// first wildcard
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch checks if a key, or one of its parents, matches a glob
+// pattern. The wildcards are those of path.Match, and don't match a '/',
+// so the pattern is matched against as many segments of the key as it
+// has. A pattern ending with a '/' only matches the keys under the
+// matching parents.
+func globMatch(pattern, key string) bool {
+	dir := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	n := strings.Count(pattern, "/") + 1
+	parts := strings.SplitN(key, "/", n+1)
+	if len(parts) < n || (dir && len(parts) == n) {
+		return false
+	}
+	ok, _ := path.Match(pattern, strings.Join(parts[:n], "/"))
+	return ok
+}
+
+// shard returns the shard of a prefix
+func (p *prefixWatch) shard(prefix string) *prefixWatchShard {
+	h := fnv.New32a()
+	h.Write([]byte(prefix))
+	return &p.shards[h.Sum32()%prefixWatchShards]
+}
+
+// Wait subscribes a channel to changes under a prefix
+func (p *prefixWatch) Wait(prefix string, notify chan struct{}) {
+	shard := p.shard(prefix)
+	shard.l.Lock()
+	defer shard.l.Unlock()
+
+	// Check for an existing notify group
+	if raw, ok := shard.tree.Get(prefix); ok {
+		grp := raw.(*NotifyGroup)
+		grp.Wait(notify)
+		return
+	}
+
+	// Create new notify group
+	grp := &NotifyGroup{}
+	grp.Wait(notify)
+	shard.tree.Insert(prefix, grp)
+}
+
+// Clear unsubscribes a channel from changes under a prefix
+func (p *prefixWatch) Clear(prefix string, notify chan struct{}) {
+	shard := p.shard(prefix)
+	shard.l.Lock()
+	defer shard.l.Unlock()
+
+	// Check for an existing notify group
+	if raw, ok := shard.tree.Get(prefix); ok {
+		grp := raw.(*NotifyGroup)
+		grp.Clear(notify)
+	}
+}
+
+// WaitGlob subscribes a channel to changes of the keys matching a glob
+// pattern, or under the keys matching it
+func (p *prefixWatch) WaitGlob(pattern string, notify chan struct{}) {
+	shard := p.shard(pattern)
+	shard.l.Lock()
+	defer shard.l.Unlock()
+
+	literal := globPrefix(pattern)
+	var groups globGroups
+	if raw, ok := shard.globs.Get(literal); ok {
+		groups = raw.(globGroups)
+	} else {
+		groups = make(globGroups)
+		shard.globs.Insert(literal, groups)
+	}
+	grp, ok := groups[pattern]
+	if !ok {
+		grp = &NotifyGroup{}
+		groups[pattern] = grp
+	}
+	grp.Wait(notify)
+}
+
+// ClearGlob unsubscribes a channel from changes matching a glob pattern
+func (p *prefixWatch) ClearGlob(pattern string, notify chan struct{}) {
+	shard := p.shard(pattern)
+	shard.l.Lock()
+	defer shard.l.Unlock()
+
+	if raw, ok := shard.globs.Get(globPrefix(pattern)); ok {
+		if grp, ok := raw.(globGroups)[pattern]; ok {
+			grp.Clear(notify)
+		}
+	}
+}
+
+// Notify wakes up the watchers of any prefix of the path. If the entire
+// prefix may be affected (e.g. delete tree), the watchers of any prefix
+// under the path are woken up too.
+func (p *prefixWatch) Notify(path string, prefix bool) {
+	chs := make(map[chan struct{}]struct{})
+	p.drain(path, prefix, chs, nil)
+	for ch := range chs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// drain moves the channels that Notify would wake up into a set,
+// without notifying them. If fired is given, it is called with each
+// drained prefix or pattern that had waiting channels, and their number.
+func (p *prefixWatch) drain(path string, prefix bool, into map[chan struct{}]struct{},
+	fired func(prefix string, woken int)) {
+	for i := range p.shards {
+		p.shards[i].drain(path, prefix, into, fired)
+	}
+}
+
+// drain moves the channels of the affected prefixes of the shard into
+// a set, and removes their groups
+func (s *prefixWatchShard) drain(path string, prefix bool, into map[chan struct{}]struct{},
+	fired func(prefix string, woken int)) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	var toDelete []string
+	fn := func(s string, v interface{}) bool {
+		group := v.(*NotifyGroup)
+		if n := group.Count(); n > 0 && fired != nil {
+			fired(s, n)
+		}
+		group.drain(into)
+		if s != "" {
+			toDelete = append(toDelete, s)
+		}
+		return false
+	}
+
+	// Invoke any watcher on the path downward to the key.
+	s.tree.WalkPath(path, fn)
+
+	// If the entire prefix may be affected (e.g. delete tree),
+	// invoke the entire prefix
+	if prefix {
+		s.tree.WalkPrefix(path, fn)
+	}
+
+	// Delete the old watch groups
+	for i := len(toDelete) - 1; i >= 0; i-- {
+		s.tree.Delete(toDelete[i])
+	}
+
+	// The patterns whose literal prefix is a prefix of the path may
+	// match the key. If the entire prefix may be affected, the patterns
+	// under the path may match one of the keys too, and all of them are
+	// woken up without matching, since the keys are unknown.
+	var emptied []string
+	globFn := func(literal string, v interface{}) bool {
+		groups := v.(globGroups)
+		for pattern, group := range groups {
+			if prefix || globMatch(pattern, path) {
+				if n := group.Count(); n > 0 && fired != nil {
+					fired(pattern, n)
+				}
+				group.drain(into)
+				delete(groups, pattern)
+			}
+		}
+		if len(groups) == 0 && literal != "" {
+			emptied = append(emptied, literal)
+		}
+		return false
+	}
+	s.globs.WalkPath(path, globFn)
+	if prefix {
+		s.globs.WalkPrefix(path, globFn)
+	}
+	for _, literal := range emptied {
+		s.globs.Delete(literal)
+	}
+}
+
+// Reap removes the channels that started waiting before a time, and the
+// groups of the prefixes that are no longer watched. Clearing a channel
+// leaves its group behind, so without this the groups of every prefix
+// ever watched would accumulate. Returns the number of removed channels.
+func (p *prefixWatch) Reap(before time.Time) int {
+	reaped := 0
+	for i := range p.shards {
+		reaped += p.shards[i].reap(before)
+	}
+	return reaped
+}
+
+// reap removes the leaked channels and idle groups of the shard
+func (s *prefixWatchShard) reap(before time.Time) int {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	reaped := 0
+	var idle []string
+	s.tree.Walk(func(prefix string, raw interface{}) bool {
+		group := raw.(*NotifyGroup)
+		reaped += group.Reap(before)
+		if group.Count() == 0 && prefix != "" {
+			idle = append(idle, prefix)
+		}
+		return false
+	})
+	for _, prefix := range idle {
+		s.tree.Delete(prefix)
+	}
+
+	idle = nil
+	s.globs.Walk(func(literal string, raw interface{}) bool {
+		groups := raw.(globGroups)
+		for pattern, group := range groups {
+			reaped += group.Reap(before)
+			if group.Count() == 0 {
+				delete(groups, pattern)
+			}
+		}
+		if len(groups) == 0 && literal != "" {
+			idle = append(idle, literal)
+		}
+		return false
+	})
+	for _, literal := range idle {
+		s.globs.Delete(literal)
+	}
+	return reaped
+}
+
+// Groups returns the number of watched prefixes and patterns, including
+// those whose channels have all been cleared
+func (p *prefixWatch) Groups() int {
+	num := 0
+	for i := range p.shards {
+		shard := &p.shards[i]
+		shard.l.Lock()
+		num += shard.tree.Len()
+		shard.globs.Walk(func(literal string, raw interface{}) bool {
+			num += len(raw.(globGroups))
+			return false
+		})
+		shard.l.Unlock()
+	}
+	return num
+}
+
+// Watchers returns the number of waiting channels of each watched
+// prefix and pattern that has any
+func (p *prefixWatch) Watchers() map[string]int {
+	out := make(map[string]int)
+	for i := range p.shards {
+		shard := &p.shards[i]
+		shard.l.Lock()
+		shard.tree.Walk(func(prefix string, raw interface{}) bool {
+			if n := raw.(*NotifyGroup).Count(); n > 0 {
+				out[prefix] += n
+			}
+			return false
+		})
+		shard.globs.Walk(func(literal string, raw interface{}) bool {
+			for pattern, group := range raw.(globGroups) {
+				if n := group.Count(); n > 0 {
+					out[pattern] += n
+				}
+			}
+			return false
+		})
+		shard.l.Unlock()
+	}
+	return out
+}
+
+// Count returns the number of waiting channels
+func (p *prefixWatch) Count() int {
+	num := 0
+	for i := range p.shards {
+		shard := &p.shards[i]
+		shard.l.Lock()
+		shard.tree.Walk(func(prefix string, raw interface{}) bool {
+			num += raw.(*NotifyGroup).Count()
+			return false
+		})
+		shard.globs.Walk(func(literal string, raw interface{}) bool {
+			for _, group := range raw.(globGroups) {
+				num += group.Count()
+			}
+			return false
+		})
+		shard.l.Unlock()
+	}
+	return num
+}
@@ -0,0 +1,189 @@
+package consul
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPrefixWatch(t *testing.T) {
+	p := newPrefixWatch()
+
+	// Watch a key, a parent, a sibling and a child
+	key, parent, sibling, child := make(chan struct{}, 1), make(chan struct{}, 1),
+		make(chan struct{}, 1), make(chan struct{}, 1)
+	p.Wait("foo/bar", key)
+	p.Wait("foo/", parent)
+	p.Wait("foo/baz", sibling)
+	p.Wait("foo/bar/zip", child)
+	if p.Count() != 4 {
+		t.Fatalf("bad: %d", p.Count())
+	}
+
+	// Only the watchers on the path are notified
+	p.Notify("foo/bar", false)
+	for _, ch := range []chan struct{}{key, parent} {
+		select {
+		case <-ch:
+		default:
+			t.Fatalf("should be notified")
+		}
+	}
+	for _, ch := range []chan struct{}{sibling, child} {
+		select {
+		case <-ch:
+			t.Fatalf("should not be notified")
+		default:
+		}
+	}
+	if p.Count() != 2 {
+		t.Fatalf("bad: %d", p.Count())
+	}
+
+	// A cleared watch is not notified
+	p.Clear("foo/baz", sibling)
+	p.Notify("foo/", true)
+	select {
+	case <-sibling:
+		t.Fatalf("should not be notified")
+	default:
+	}
+	select {
+	case <-child:
+	default:
+		t.Fatalf("should be notified")
+	}
+	if p.Count() != 0 {
+		t.Fatalf("bad: %d", p.Count())
+	}
+}
+
+func TestPrefixWatch_Reap(t *testing.T) {
+	p := newPrefixWatch()
+
+	leaked, cleared := make(chan struct{}, 1), make(chan struct{}, 1)
+	p.Wait("foo/", leaked)
+	p.Wait("bar/", cleared)
+	p.Clear("bar/", cleared)
+	cutoff := time.Now().Add(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	fresh := make(chan struct{}, 1)
+	p.Wait("baz/", fresh)
+
+	// The cleared prefix is still around until reaped
+	if p.Groups() != 3 {
+		t.Fatalf("bad: %d", p.Groups())
+	}
+
+	// The leaked channel is reaped, along with the idle groups
+	if n := p.Reap(cutoff); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if p.Groups() != 1 || p.Count() != 1 {
+		t.Fatalf("bad: %d %d", p.Groups(), p.Count())
+	}
+
+	p.Notify("baz/qux", false)
+	select {
+	case <-fresh:
+	default:
+		t.Fatalf("should be notified")
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"config/*/database", "config/web/database", true},
+		{"config/*/database", "config/web/database/host", true},
+		{"config/*/database", "config/web/databases", false},
+		{"config/*/database", "config/web/cache", false},
+		{"config/*/database", "config/web", false},
+		{"config/*/database", "config/a/b/database", false},
+		{"config/*/", "config/web/cache", true},
+		{"config/*/", "config/web", false},
+		{"*", "foo/bar", true},
+		{"config/we?/database", "config/web/database", true},
+	}
+	for _, c := range cases {
+		if globMatch(c.pattern, c.key) != c.match {
+			t.Fatalf("bad: %v", c)
+		}
+	}
+
+	if globPrefix("config/*/database") != "config/" || globPrefix("config/") != "config/" {
+		t.Fatalf("bad")
+	}
+	if validGlob("config/[") || !validGlob("config/*") {
+		t.Fatalf("bad")
+	}
+}
+
+func TestPrefixWatch_Glob(t *testing.T) {
+	p := newPrefixWatch()
+
+	glob, other := make(chan struct{}, 1), make(chan struct{}, 1)
+	p.WaitGlob("config/*/database", glob)
+	p.WaitGlob("other/*", other)
+	if p.Count() != 2 || p.Groups() != 2 {
+		t.Fatalf("bad: %d %d", p.Count(), p.Groups())
+	}
+
+	// A key that doesn't match doesn't notify
+	p.Notify("config/web/cache", false)
+	select {
+	case <-glob:
+		t.Fatalf("should not be notified")
+	default:
+	}
+
+	// A matching key does
+	p.Notify("config/web/database", false)
+	select {
+	case <-glob:
+	default:
+		t.Fatalf("should be notified")
+	}
+	if p.Count() != 1 {
+		t.Fatalf("bad: %d", p.Count())
+	}
+
+	// Deleting a tree that may hold matching keys notifies too
+	p.WaitGlob("config/*/database", glob)
+	p.Notify("config/", true)
+	select {
+	case <-glob:
+	default:
+		t.Fatalf("should be notified")
+	}
+
+	// A cleared pattern is not notified
+	p.ClearGlob("other/*", other)
+	p.Notify("other/foo", false)
+	select {
+	case <-other:
+		t.Fatalf("should not be notified")
+	default:
+	}
+}
+
+func BenchmarkPrefixWatch_Wait(b *testing.B) {
+	p := newPrefixWatch()
+	for i := 0; i < 50000; i++ {
+		p.Wait(fmt.Sprintf("service/%d/", i%1000), make(chan struct{}, 1))
+	}
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			prefix := fmt.Sprintf("service/%d/", i%1000)
+			ch := make(chan struct{}, 1)
+			p.Wait(prefix, ch)
+			p.Clear(prefix, ch)
+			i++
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package consul
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/armon/go-metrics"
+)
+
+// queryCache is a read-through cache of the results of hot queries,
+// used to absorb repeated identical reads. Each entry watches the tables
+// it was read from, and is discarded as soon as any of them change, so
+// a cached result is never older than the tables.
+type queryCache struct {
+	size int
+
+	entries map[string]*queryCacheEntry
+	l       sync.Mutex
+}
+
+// queryCacheEntry is a cached query result
+type queryCacheEntry struct {
+	index  uint64
+	result interface{}
+
+	// notifyCh is fired by the watches of the tables
+	tables   MDBTables
+	notifyCh chan struct{}
+}
+
+// valid checks if none of the tables of the entry have changed
+func (e *queryCacheEntry) valid() bool {
+	select {
+	case <-e.notifyCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// newQueryCache creates a cache that holds up to size results
+func newQueryCache(size int) *queryCache {
+	return &queryCache{
+		size:    size,
+		entries: make(map[string]*queryCacheEntry, size),
+	}
+}
+
+// queryCacheKey builds the cache key of a query and its parameters
+func queryCacheKey(method string, params ...string) string {
+	return method + "\x00" + strings.Join(params, "\x00")
+}
+
+// SetQueryCache enables caching the results of the hot catalog and
+// health queries, holding up to size results. Zero disables the cache.
+func (s *StateStore) SetQueryCache(size int) {
+	if size <= 0 {
+		s.queryCache = nil
+		return
+	}
+	s.queryCache = newQueryCache(size)
+}
+
+// cachedQuery returns the result of a query from the cache, or runs the
+// query and caches its result. The result is shared with other callers,
+// and must never be modified in place: filters build a new slice or map
+// when they drop anything, as the ACL filters do.
+func (s *StateStore) cachedQuery(key string, tables MDBTables,
+	query func() (uint64, interface{})) (uint64, interface{}) {
+	c := s.queryCache
+	if c == nil {
+		return query()
+	}
+
+	c.l.Lock()
+	entry, ok := c.entries[key]
+	if ok && !entry.valid() {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.l.Unlock()
+	if ok {
+		metrics.IncrCounter([]string{"consul", "state", "query_cache", "hit"}, 1)
+		return entry.index, entry.result
+	}
+	metrics.IncrCounter([]string{"consul", "state", "query_cache", "miss"}, 1)
+
+	// Watch the tables before running the query, so that a change made
+	// while the query runs invalidates the result
+	entry = &queryCacheEntry{
+		tables:   tables,
+		notifyCh: make(chan struct{}, 1),
+	}
+	s.Watch(tables, entry.notifyCh)
+	entry.index, entry.result = query()
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	if old, ok := c.entries[key]; ok {
+		s.StopWatch(old.tables, old.notifyCh)
+		delete(c.entries, key)
+	}
+
+	// Make room by discarding arbitrary entries, preferring the ones
+	// that are no longer valid
+	for k, e := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		if !e.valid() {
+			delete(c.entries, k)
+		}
+	}
+	for k, e := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		s.StopWatch(e.tables, e.notifyCh)
+		delete(c.entries, k)
+	}
+	c.entries[key] = entry
+	return entry.index, entry.result
+}
@@ -0,0 +1,133 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_QueryCache(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	store.SetQueryCache(2)
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Port: 8000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, nodes := store.ServiceNodes("db")
+	if idx != 2 || len(nodes) != 1 {
+		t.Fatalf("bad: %v %v", idx, nodes)
+	}
+	key := queryCacheKey("ServiceNodes", "db")
+	if _, ok := store.queryCache.entries[key]; !ok {
+		t.Fatalf("should be cached")
+	}
+
+	// The cached result is shared, not copied
+	_, again := store.ServiceNodes("db")
+	if &again[0] != &nodes[0] {
+		t.Fatalf("should be shared")
+	}
+
+	// A change to the tables invalidates the result
+	if err := store.EnsureNode(3, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(4, "bar", &structs.NodeService{ID: "db", Service: "db", Port: 8000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if store.queryCache.entries[key].valid() {
+		t.Fatalf("should be invalid")
+	}
+	idx, nodes = store.ServiceNodes("db")
+	if idx != 4 || len(nodes) != 2 {
+		t.Fatalf("bad: %v %v", idx, nodes)
+	}
+
+	// The cache is bounded
+	store.NodeServices("foo")
+	store.CheckServiceNodes("db")
+	if len(store.queryCache.entries) != 2 {
+		t.Fatalf("bad: %v", store.queryCache.entries)
+	}
+
+	// Missing nodes are cached too
+	if _, ns := store.NodeServices("nope"); ns != nil {
+		t.Fatalf("bad: %v", ns)
+	}
+	if _, ns := store.NodeServices("nope"); ns != nil {
+		t.Fatalf("bad: %v", ns)
+	}
+}
+
+func TestStateStore_QueryCache_Filter(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	store.SetQueryCache(16)
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Port: 8000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(3, "foo", &structs.NodeService{ID: "db2", Service: "db", Port: 8001}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:      "foo",
+		CheckID:   "db",
+		Name:      "db",
+		Status:    structs.HealthPassing,
+		ServiceID: "db",
+	}
+	if err := store.EnsureCheck(4, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Filtering a cached result with a restrictive ACL must leave the
+	// cached result untouched
+	filt := newAclFilter(acl.DenyAll(), nil)
+
+	_, nodes := store.ServiceNodes("db")
+	filt.filterServiceNodes(&nodes)
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, nodes = store.ServiceNodes("db")
+	if _, expect := store.serviceNodes("db"); !reflect.DeepEqual(nodes, expect) {
+		t.Fatalf("bad: %v %v", nodes, expect)
+	}
+
+	_, csn := store.CheckServiceNodes("db")
+	filt.filterCheckServiceNodes(&csn)
+	if len(csn) != 0 {
+		t.Fatalf("bad: %v", csn)
+	}
+	_, csn = store.CheckServiceNodes("db")
+	if _, expect := store.checkServiceNodes("db"); !reflect.DeepEqual(csn, expect) {
+		t.Fatalf("bad: %v %v", csn, expect)
+	}
+
+	_, ns := store.NodeServices("foo")
+	filt.filterNodeServices(&ns)
+	if len(ns.Services) != 0 {
+		t.Fatalf("bad: %v", ns)
+	}
+	_, ns = store.NodeServices("foo")
+	if _, expect := store.nodeServices("foo"); !reflect.DeepEqual(ns, expect) {
+		t.Fatalf("bad: %v %v", ns, expect)
+	}
+}
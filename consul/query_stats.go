@@ -0,0 +1,146 @@
+package consul
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// slowQueryLogSize is the number of slow queries that are retained
+	slowQueryLogSize = 64
+
+	// slowQueryMaxParam is the longest parameter value that is logged,
+	// longer values are truncated
+	slowQueryMaxParam = 128
+
+	// redactedParam replaces the value of sensitive parameters
+	redactedParam = "<redacted>"
+)
+
+// redactedQueryParams are the parameters whose values are never logged.
+// Besides these, any parameter whose name mentions a token is redacted.
+var redactedQueryParams = map[string]struct{}{
+	"acl": struct{}{},
+}
+
+// slowQueryLog is a ring buffer of the most recent slow queries. It
+// is shared by the state stores of an FSM so that it survives a restore.
+type slowQueryLog struct {
+	threshold time.Duration
+	queries   []*structs.SlowQuery
+	next      int
+	l         sync.RWMutex
+}
+
+// newSlowQueryLog creates a log that retains up to size queries. Queries
+// are not logged until a threshold is set.
+func newSlowQueryLog(size int) *slowQueryLog {
+	return &slowQueryLog{
+		queries: make([]*structs.SlowQuery, 0, size),
+	}
+}
+
+// SetThreshold sets the duration after which a query is considered
+// slow. A zero threshold disables the log.
+func (l *slowQueryLog) SetThreshold(threshold time.Duration) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.threshold = threshold
+}
+
+// Threshold returns the current slow query threshold
+func (l *slowQueryLog) Threshold() time.Duration {
+	l.l.RLock()
+	defer l.l.RUnlock()
+	return l.threshold
+}
+
+// add records a slow query, displacing the oldest one if full
+func (l *slowQueryLog) add(q *structs.SlowQuery) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if len(l.queries) < cap(l.queries) {
+		l.queries = append(l.queries, q)
+		return
+	}
+	l.queries[l.next] = q
+	l.next = (l.next + 1) % len(l.queries)
+}
+
+// Queries returns the retained slow queries, oldest first
+func (l *slowQueryLog) Queries() []*structs.SlowQuery {
+	l.l.RLock()
+	defer l.l.RUnlock()
+	out := make([]*structs.SlowQuery, 0, len(l.queries))
+	out = append(out, l.queries[l.next:]...)
+	out = append(out, l.queries[:l.next]...)
+	return out
+}
+
+// redactQueryParam returns if the value of a parameter must not be
+// logged, matching the names case insensitively so that "token" and
+// "X-Consul-Token" are both caught
+func redactQueryParam(name string) bool {
+	name = strings.ToLower(name)
+	if _, ok := redactedQueryParams[name]; ok {
+		return true
+	}
+	return strings.Contains(name, "token")
+}
+
+// redactQueryParams converts alternating parameter names and values
+// into name=value pairs that are safe to log
+func redactQueryParams(params []string) []string {
+	out := make([]string, 0, len(params)/2)
+	for i := 0; i+1 < len(params); i += 2 {
+		name, value := params[i], params[i+1]
+		if redactQueryParam(name) {
+			value = redactedParam
+		} else if len(value) > slowQueryMaxParam {
+			value = value[:slowQueryMaxParam] + "..."
+		}
+		out = append(out, name+"="+value)
+	}
+	return out
+}
+
+// measureQuery is deferred by the state store queries. It records the
+// latency into a per-method histogram, and logs the query if it took
+// longer than the slow query threshold. The params alternate between
+// names and values.
+func (s *StateStore) measureQuery(method string, start time.Time, params ...string) {
+	metrics.MeasureSince([]string{"consul", "state", "query", method}, start)
+
+	elapsed := time.Now().Sub(start)
+	threshold := s.queryLog.Threshold()
+	if threshold == 0 || elapsed < threshold {
+		return
+	}
+
+	metrics.IncrCounter([]string{"consul", "state", "slow_query"}, 1)
+	redacted := redactQueryParams(params)
+	s.logger.Warn("Slow query", "method", method, "params", strings.Join(redacted, ", "),
+		"duration", elapsed)
+	s.queryLog.add(&structs.SlowQuery{
+		Method:   method,
+		Params:   redacted,
+		Duration: elapsed,
+		Time:     start,
+	})
+}
+
+// SlowQueries returns the most recent queries that exceeded the slow
+// query threshold, oldest first
+func (s *StateStore) SlowQueries() []*structs.SlowQuery {
+	return s.queryLog.Queries()
+}
+
+// setSlowQueryLog replaces the slow query log, this is used to share
+// a log across state stores
+func (s *StateStore) setSlowQueryLog(l *slowQueryLog) {
+	s.queryLog = l
+}
@@ -0,0 +1,95 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestSlowQueryLog_Ring(t *testing.T) {
+	l := newSlowQueryLog(3)
+	if out := l.Queries(); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	for _, method := range []string{"a", "b", "c", "d", "e"} {
+		l.add(&structs.SlowQuery{Method: method})
+	}
+	out := l.Queries()
+	if len(out) != 3 {
+		t.Fatalf("bad: %v", out)
+	}
+	for i, method := range []string{"c", "d", "e"} {
+		if out[i].Method != method {
+			t.Fatalf("bad: %d %v", i, out[i])
+		}
+	}
+}
+
+func TestRedactQueryParams(t *testing.T) {
+	long := strings.Repeat("x", slowQueryMaxParam+10)
+	out := redactQueryParams([]string{"key", "foo", "acl", "secret", "prefix", long})
+	if len(out) != 3 {
+		t.Fatalf("bad: %v", out)
+	}
+	if out[0] != "key=foo" {
+		t.Fatalf("bad: %v", out[0])
+	}
+	if out[1] != "acl="+redactedParam {
+		t.Fatalf("bad: %v", out[1])
+	}
+	if out[2] != "prefix="+long[:slowQueryMaxParam]+"..." {
+		t.Fatalf("bad: %v", out[2])
+	}
+}
+
+func TestRedactQueryParams_Tokens(t *testing.T) {
+	out := redactQueryParams([]string{"token", "secret", "X-Consul-Token", "secret",
+		"auto_encrypt_token", "secret", "node", "foo"})
+	expect := []string{"token=" + redactedParam, "X-Consul-Token=" + redactedParam,
+		"auto_encrypt_token=" + redactedParam, "node=foo"}
+	if strings.Join(out, ",") != strings.Join(expect, ",") {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestStateStore_SlowQueries(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Nothing is logged while disabled
+	if _, _, err := store.KVSGet("foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := store.SlowQueries(); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Every query is slow with a tiny threshold
+	store.queryLog.SetThreshold(time.Nanosecond)
+	if _, _, err := store.KVSGet("foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := store.ACLGet("root"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := store.SlowQueries()
+	if len(out) != 2 {
+		t.Fatalf("bad: %v", out)
+	}
+	if out[0].Method != "KVSGet" || len(out[0].Params) != 1 || out[0].Params[0] != "key=foo" {
+		t.Fatalf("bad: %#v", out[0])
+	}
+	if out[0].Duration <= 0 || out[0].Time.IsZero() {
+		t.Fatalf("bad: %#v", out[0])
+	}
+	if out[1].Method != "ACLGet" || out[1].Params[0] != "acl="+redactedParam {
+		t.Fatalf("bad: %#v", out[1])
+	}
+}
@@ -0,0 +1,228 @@
+package consul
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+// ReplayConfig configures a Replayer
+type ReplayConfig struct {
+	// LogOutput receives the logs of the FSM
+	LogOutput io.Writer
+
+	// Breakpoints are the log indexes after which Run stops, so the
+	// state can be inspected before the replay is resumed
+	Breakpoints []uint64
+
+	// HashState computes a hash of the state after every apply. This
+	// is expensive, but allows the apply that introduced a divergence
+	// to be found by comparing replays.
+	HashState bool
+}
+
+// ReplayStep is the result of applying a single log entry
+type ReplayStep struct {
+	Index    uint64
+	Type     structs.MessageType
+	Response interface{}
+
+	// Hash is the state hash after the apply, if enabled
+	Hash *StateHash
+}
+
+// StateHash is a digest of the replicated state
+type StateHash struct {
+	// Tables is the hex encoded sha256 of each table, by table name
+	Tables map[string]string
+
+	// Sum is the hex encoded sha256 of all the tables
+	Sum string
+}
+
+// Diff returns the names of the tables whose hashes differ
+func (h *StateHash) Diff(other *StateHash) []string {
+	var diff []string
+	for name, sum := range h.Tables {
+		if other.Tables[name] != sum {
+			diff = append(diff, name)
+		}
+	}
+	for name := range other.Tables {
+		if _, ok := h.Tables[name]; !ok {
+			diff = append(diff, name)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// Replayer applies a sequence of decoded Raft log entries to a fresh
+// state store. It is used to debug the FSM, by reproducing the state a
+// server had at any index and finding which apply corrupted it.
+type Replayer struct {
+	config      *ReplayConfig
+	dir         string
+	fsm         *consulFSM
+	breakpoints map[uint64]struct{}
+	lastIndex   uint64
+}
+
+// NewReplayer creates a replayer with an empty state store
+func NewReplayer(config *ReplayConfig) (*Replayer, error) {
+	if config.LogOutput == nil {
+		config.LogOutput = os.Stderr
+	}
+	dir, err := ioutil.TempDir("", "consul-replay")
+	if err != nil {
+		return nil, err
+	}
+	fsm, err := NewFSM(nil, dir, config.LogOutput)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	r := &Replayer{
+		config:      config,
+		dir:         dir,
+		fsm:         fsm,
+		breakpoints: make(map[uint64]struct{}, len(config.Breakpoints)),
+	}
+	for _, idx := range config.Breakpoints {
+		r.breakpoints[idx] = struct{}{}
+	}
+	return r, nil
+}
+
+// Close discards the replayed state
+func (r *Replayer) Close() error {
+	err := r.fsm.Close()
+	os.RemoveAll(r.dir)
+	return err
+}
+
+// State returns the replayed state store
+func (r *Replayer) State() *StateStore {
+	return r.fsm.State()
+}
+
+// LastIndex returns the index of the last applied entry
+func (r *Replayer) LastIndex() uint64 {
+	return r.lastIndex
+}
+
+// Apply applies a single log entry. Entries must be applied in index
+// order. Entries that are not commands are skipped, and a nil step is
+// returned. A panic in the FSM is returned as an error.
+func (r *Replayer) Apply(log *raft.Log) (step *ReplayStep, err error) {
+	if log.Index <= r.lastIndex {
+		return nil, fmt.Errorf("Entry %d is at or before the last applied index %d",
+			log.Index, r.lastIndex)
+	}
+	if log.Type != raft.LogCommand {
+		r.lastIndex = log.Index
+		return nil, nil
+	}
+	if len(log.Data) == 0 {
+		return nil, fmt.Errorf("Entry %d has no data", log.Index)
+	}
+
+	step = &ReplayStep{
+		Index: log.Index,
+		Type:  structs.MessageType(log.Data[0]),
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			step = nil
+			err = fmt.Errorf("Failed to apply entry %d: %v", log.Index, p)
+		}
+	}()
+	step.Response = r.fsm.Apply(log)
+	r.lastIndex = log.Index
+
+	if r.config.HashState {
+		if step.Hash, err = r.State().Hash(); err != nil {
+			return nil, err
+		}
+	}
+	return step, nil
+}
+
+// Run applies the entries in order, skipping any that were already
+// applied so that a replay can be resumed with the same entries. The
+// visit function is invoked with each step and may return false to
+// stop. Run also stops after an entry with a breakpoint. The last
+// applied step is returned.
+func (r *Replayer) Run(logs []*raft.Log, visit func(*ReplayStep) bool) (*ReplayStep, error) {
+	var last *ReplayStep
+	for _, log := range logs {
+		if log.Index <= r.lastIndex {
+			continue
+		}
+		step, err := r.Apply(log)
+		if err != nil {
+			return last, err
+		}
+		if step != nil {
+			last = step
+			if visit != nil && !visit(step) {
+				break
+			}
+		}
+		if _, ok := r.breakpoints[log.Index]; ok {
+			break
+		}
+	}
+	return last, nil
+}
+
+// Hash returns a digest of the replicated state. Rows are hashed in
+// index order using a canonical encoding, so identical states have
+// identical hashes.
+func (s *StateStore) Hash() (*StateHash, error) {
+	tables := MDBTables{s.nodeTable, s.serviceTable, s.checkTable,
+		s.kvsTable, s.kvsHistoryTable, s.tombstoneTable, s.sessionTable,
+		s.sessionCheckTable,
+		s.aclTable, s.lockDelayTable, s.outboxSubTable, s.outboxTable,
+		s.serverHealthTable, s.catalogAuditTable, s.claimTable, s.maintTable,
+		s.autopilotTable, s.autoEncryptTable, s.areaTable, s.peeringTable,
+		s.exportedTable, s.importedTable, s.retentionTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Abort()
+
+	out := &StateHash{Tables: make(map[string]string, len(tables))}
+	sum := sha256.New()
+	for _, table := range tables {
+		h := sha256.New()
+		res, err := table.GetTxn(tx, "id")
+		if err != nil {
+			return nil, err
+		}
+		for _, raw := range res {
+			// JSON sorts map keys, making the encoding canonical
+			buf, err := json.Marshal(raw)
+			if err != nil {
+				return nil, err
+			}
+			h.Write(buf)
+		}
+		digest := h.Sum(nil)
+		out.Tables[table.Name] = hex.EncodeToString(digest)
+		sum.Write([]byte(table.Name))
+		sum.Write(digest)
+	}
+	out.Sum = hex.EncodeToString(sum.Sum(nil))
+	return out, nil
+}
@@ -0,0 +1,129 @@
+package consul
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+func testReplayLogs(t *testing.T, value string) []*raft.Log {
+	var logs []*raft.Log
+	add := func(msgType structs.MessageType, req interface{}) {
+		buf, err := structs.Encode(msgType, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		logs = append(logs, &raft.Log{
+			Index: uint64(len(logs) + 1),
+			Term:  1,
+			Type:  raft.LogCommand,
+			Data:  buf,
+		})
+	}
+	add(structs.RegisterRequestType, &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	})
+	add(structs.KVSRequestType, &structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt:     structs.DirEntry{Key: "/test", Value: []byte(value)},
+	})
+	add(structs.KVSRequestType, &structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt:     structs.DirEntry{Key: "/other", Value: []byte("bar")},
+	})
+	return logs
+}
+
+func TestReplayer_Run(t *testing.T) {
+	r1, err := NewReplayer(&ReplayConfig{LogOutput: os.Stderr, HashState: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r1.Close()
+	r2, err := NewReplayer(&ReplayConfig{LogOutput: os.Stderr, HashState: true, Breakpoints: []uint64{2}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r2.Close()
+
+	// Replay the same entries, except for the value of one key
+	var steps []*ReplayStep
+	last, err := r1.Run(testReplayLogs(t, "foo"), func(step *ReplayStep) bool {
+		steps = append(steps, step)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(steps) != 3 || last.Index != 3 || r1.LastIndex() != 3 {
+		t.Fatalf("bad: %v %v", steps, last)
+	}
+
+	// The second replay stops at the breakpoint
+	logs := testReplayLogs(t, "nope")
+	last, err = r2.Run(logs, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if last.Index != 2 || last.Type != structs.KVSRequestType {
+		t.Fatalf("bad: %v", last)
+	}
+
+	// The divergence is found at the second entry
+	if diff := steps[0].Hash.Diff(last.Hash); len(diff) == 0 {
+		t.Fatalf("should differ")
+	}
+	diff := steps[1].Hash.Diff(last.Hash)
+	if len(diff) != 1 || diff[0] != dbKVS {
+		t.Fatalf("bad: %v", diff)
+	}
+	if steps[1].Hash.Sum == last.Hash.Sum {
+		t.Fatalf("should differ")
+	}
+
+	// Resume the replay with the same entries
+	last, err = r2.Run(logs, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if last.Index != 3 {
+		t.Fatalf("bad: %v", last)
+	}
+	_, d, err := r2.State().KVSGet("/other")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "bar" {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestReplayer_Apply(t *testing.T) {
+	r, err := NewReplayer(&ReplayConfig{LogOutput: os.Stderr})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	// Non-command entries are skipped
+	step, err := r.Apply(&raft.Log{Index: 1, Type: raft.LogNoop})
+	if err != nil || step != nil {
+		t.Fatalf("bad: %v %v", step, err)
+	}
+
+	// Entries must be in order
+	if _, err := r.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: []byte{0}}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// A panic in the FSM is returned as an error
+	if _, err := r.Apply(&raft.Log{Index: 2, Type: raft.LogCommand, Data: []byte{100}}); err == nil {
+		t.Fatalf("should fail")
+	}
+}
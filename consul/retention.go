@@ -0,0 +1,179 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// retentionID is the key of the retention, which is the only row of its
+// table
+const retentionID = "config"
+
+// retentionFields returns the id index values of the retention
+func retentionFields(obj interface{}) ([]string, error) {
+	if _, ok := obj.(*structs.RetentionConfig); !ok {
+		return nil, fmt.Errorf("Not a retention configuration: %#v", obj)
+	}
+	return []string{retentionID}, nil
+}
+
+// RetentionSet is used to set the retention committed by the leader.
+// Lowering the number of KV history versions prunes the oldest versions
+// of each key in the same transaction, so every server retains the same
+// versions.
+func (s *StateStore) RetentionSet(index uint64, config *structs.RetentionConfig) error {
+	tables := MDBTables{s.retentionTable, s.kvsHistoryTable}
+	tx, err := tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.retentionTable.GetTxn(tx, "id", retentionID)
+	if err != nil {
+		return err
+	}
+	config.CreateIndex = index
+	previous := 0
+	if len(res) > 0 {
+		exist := res[0].(*structs.RetentionConfig)
+		config.CreateIndex = exist.CreateIndex
+		previous = exist.KVSHistoryVersions
+	}
+	config.ModifyIndex = index
+
+	if err := s.retentionTable.InsertTxn(tx, config); err != nil {
+		return err
+	}
+	if err := s.retentionTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if config.KVSHistoryVersions < previous {
+		if err := s.kvsHistoryPruneTxn(tx, config.KVSHistoryVersions); err != nil {
+			return err
+		}
+	}
+	retention := *config
+	tx.Defer(func() { s.setRetention(retention) })
+	s.notifyTables(tx, s.retentionTable)
+	return tx.Commit()
+}
+
+// kvsHistoryPruneTxn is used to delete the oldest versions of each key
+// beyond the given number of versions within a given txn
+func (s *StateStore) kvsHistoryPruneTxn(tx *MDBTxn, versions int) error {
+	// Versions are streamed by key, oldest first
+	var toDelete []*kvsVersion
+	streamCh := make(chan interface{}, 128)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		var existing []*kvsVersion
+		flush := func() {
+			for i := 0; len(existing)-i > versions; i++ {
+				toDelete = append(toDelete, existing[i])
+			}
+			existing = existing[:0]
+		}
+		for raw := range streamCh {
+			ver := raw.(*kvsVersion)
+			if len(existing) > 0 && existing[0].Key != ver.Key {
+				flush()
+			}
+			existing = append(existing, ver)
+		}
+		flush()
+	}()
+	if err := s.kvsHistoryTable.StreamTxn(streamCh, tx, "id"); err != nil {
+		return fmt.Errorf("failed to scan KV history: %v", err)
+	}
+	<-doneCh
+
+	for _, ver := range toDelete {
+		if _, err := s.kvsHistoryTable.DeleteTxn(tx, "id", ver.Key, ver.Version); err != nil {
+			return fmt.Errorf("failed to delete KV version: %v", err)
+		}
+	}
+	return nil
+}
+
+// Retention is used to get the retention, which is nil until a leader
+// commits one
+func (s *StateStore) Retention() (uint64, *structs.RetentionConfig, error) {
+	idx, res, err := s.retentionTable.Get("id", retentionID)
+	var config *structs.RetentionConfig
+	if len(res) > 0 {
+		config = res[0].(*structs.RetentionConfig)
+	}
+	return idx, config, err
+}
+
+// RetentionRestore is used to restore the retention from a snapshot
+func (s *StateStore) RetentionRestore(config *structs.RetentionConfig) error {
+	tx, err := s.retentionTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.retentionTable.InsertTxn(tx, config); err != nil {
+		return err
+	}
+	if err := s.retentionTable.SetMaxLastIndexTxn(tx, config.ModifyIndex); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.setRetention(*config)
+	return nil
+}
+
+// setRetention caches the committed retention, which is read by every
+// KV write and catalog change
+func (s *StateStore) setRetention(retention structs.RetentionConfig) {
+	s.retentionLock.Lock()
+	defer s.retentionLock.Unlock()
+	s.retention = retention
+}
+
+// catalogAuditLimit returns the number of catalog changes retained in
+// the audit table, zero if it is disabled
+func (s *StateStore) catalogAuditLimit() int {
+	s.retentionLock.RLock()
+	defer s.retentionLock.RUnlock()
+	return s.retention.CatalogAuditLimit
+}
+
+// syncRetention is used when we become the leader to commit the
+// retention of our configuration, if it differs from the committed one
+func (s *Server) syncRetention() error {
+	_, current, err := s.fsm.State().Retention()
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		current = &structs.RetentionConfig{}
+	}
+	if current.KVSHistoryVersions == s.config.KVSHistoryVersions &&
+		current.CatalogAuditLimit == s.config.CatalogAuditLimit {
+		return nil
+	}
+
+	req := structs.RetentionRequest{
+		Datacenter: s.config.Datacenter,
+		Config: structs.RetentionConfig{
+			KVSHistoryVersions: s.config.KVSHistoryVersions,
+			CatalogAuditLimit:  s.config.CatalogAuditLimit,
+		},
+	}
+	resp, err := s.raftApply(structs.RetentionRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestRetentionSet(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	idx, retention, err := store.Retention()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 0 || retention != nil {
+		t.Fatalf("bad: %d %v", idx, retention)
+	}
+
+	if err := store.RetentionSet(1, &structs.RetentionConfig{KVSHistoryVersions: 5}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		for _, key := range []string{"/bar", "/foo"} {
+			d := &structs.DirEntry{Key: key, Value: []byte(fmt.Sprintf("%d", i))}
+			if err := store.KVSSet(uint64(10+10*i), d); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+
+	// Lowering the versions prunes the oldest of each key
+	if err := store.RetentionSet(50, &structs.RetentionConfig{KVSHistoryVersions: 2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, retention, err = store.Retention()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 50 || retention.CreateIndex != 1 || retention.ModifyIndex != 50 ||
+		retention.KVSHistoryVersions != 2 {
+		t.Fatalf("bad: %d %#v", idx, retention)
+	}
+	for _, key := range []string{"/bar", "/foo"} {
+		if _, _, err := store.KVSGetAtIndex(key, 25); err == nil {
+			t.Fatalf("should fail for pruned version of %s", key)
+		}
+		_, d, err := store.KVSGetAtIndex(key, 35)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if d == nil || string(d.Value) != "2" {
+			t.Fatalf("bad: %#v", d)
+		}
+	}
+
+	// Disabling the history prunes it all
+	if err := store.RetentionSet(60, &structs.RetentionConfig{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := store.KVSGetAtIndex("/foo", 35); err == nil {
+		t.Fatalf("should fail with history disabled")
+	}
+	_, res, err := store.kvsHistoryTable.Get("id")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %v", res)
+	}
+}
+
+func TestLeader_SyncRetention(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVSHistoryVersions = 3
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	testutil.WaitForResult(func() (bool, error) {
+		_, retention, err := s1.fsm.State().Retention()
+		return retention != nil && retention.KVSHistoryVersions == 3, err
+	}, func(err error) {
+		t.Fatalf("should commit the retention: %v", err)
+	})
+
+	// A matching retention is not committed again
+	idx, _, err := s1.fsm.State().Retention()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.syncRetention(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if after, _, _ := s1.fsm.State().Retention(); after != idx {
+		t.Fatalf("bad: %d %d", idx, after)
+	}
+}
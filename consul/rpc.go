@@ -6,12 +6,14 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"net/rpc"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
-	"github.com/hashicorp/net-rpc-msgpackrpc"
 	"github.com/hashicorp/yamux"
 	"github.com/inconshreveable/muxado"
 )
@@ -24,6 +26,7 @@ const (
 	rpcMultiplex
 	rpcTLS
 	rpcMultiplexV2
+	rpcTLSInsecure
 )
 
 const (
@@ -81,15 +84,20 @@ func (s *Server) handleConn(conn net.Conn, isTLS bool) {
 		return
 	}
 
-	// Enforce TLS if VerifyIncoming is set
-	if s.config.VerifyIncoming && !isTLS && RPCType(buf[0]) != rpcTLS {
-		s.logger.Printf("[WARN] consul.rpc: Non-TLS connection attempted with VerifyIncoming set")
-		conn.Close()
-		return
+	// Enforce TLS if VerifyIncoming is set, unless the clients are being
+	// moved to TLS
+	typ := RPCType(buf[0])
+	if s.rpcTLS.VerifyIncoming() && !isTLS && typ != rpcTLS && typ != rpcTLSInsecure {
+		if !s.rpcTLS.AllowPlaintext() {
+			s.logger.Printf("[WARN] consul.rpc: Non-TLS connection attempted with VerifyIncoming set")
+			conn.Close()
+			return
+		}
+		metrics.IncrCounter([]string{"consul", "rpc", "plaintext_conn"}, 1)
 	}
 
 	// Switch on the byte
-	switch RPCType(buf[0]) {
+	switch typ {
 	case rpcConsul:
 		s.handleConsulConn(conn)
 
@@ -101,17 +109,27 @@ func (s *Server) handleConn(conn net.Conn, isTLS bool) {
 		s.handleMultiplex(conn)
 
 	case rpcTLS:
-		if s.rpcTLS == nil {
+		tlsConf := s.rpcTLS.IncomingTLSConfig()
+		if tlsConf == nil {
 			s.logger.Printf("[WARN] consul.rpc: TLS connection attempted, server not configured for TLS")
 			conn.Close()
 			return
 		}
-		conn = tls.Server(conn, s.rpcTLS)
+		conn = tls.Server(conn, tlsConf)
 		s.handleConn(conn, true)
 
 	case rpcMultiplexV2:
 		s.handleMultiplexV2(conn)
 
+	case rpcTLSInsecure:
+		tlsConf := s.rpcTLS.InsecureIncomingTLSConfig()
+		if !s.config.AutoEncryptAllowTLS || isTLS || tlsConf == nil {
+			s.logger.Printf("[WARN] consul.rpc: Insecure TLS connection attempted, server not configured for auto-encrypt")
+			conn.Close()
+			return
+		}
+		s.handleInsecureConn(tls.Server(conn, tlsConf))
+
 	default:
 		s.logger.Printf("[ERR] consul.rpc: unrecognized RPC byte: %v", buf[0])
 		conn.Close()
@@ -158,7 +176,14 @@ func (s *Server) handleMultiplexV2(conn net.Conn) {
 // handleConsulConn is used to service a single Consul RPC connection
 func (s *Server) handleConsulConn(conn net.Conn) {
 	defer conn.Close()
-	rpcCodec := msgpackrpc.NewServerCodec(conn)
+	rpcCodec := s.auditConn(newServerCodec(conn), conn)
+	if !s.isServerAddr(conn.RemoteAddr()) {
+		source := remoteHost(conn)
+		if s.rpcLimiter != nil {
+			rpcCodec = &rateLimitCodec{rpcCodec, s.rpcLimiter, source}
+		}
+		rpcCodec = &signSourceCodec{rpcCodec, source}
+	}
 	for {
 		select {
 		case <-s.shutdownCh:
@@ -167,6 +192,10 @@ func (s *Server) handleConsulConn(conn net.Conn) {
 		}
 
 		if err := s.rpcServer.ServeRequest(rpcCodec); err != nil {
+			// The rejected request got the error as its response
+			if err == structs.ErrRPCRateLimited {
+				continue
+			}
 			if err != io.EOF && !strings.Contains(err.Error(), "closed") {
 				s.logger.Printf("[ERR] consul.rpc: RPC error: %v (%v)", err, conn)
 				metrics.IncrCounter([]string{"consul", "rpc", "request_error"}, 1)
@@ -177,6 +206,99 @@ func (s *Server) handleConsulConn(conn net.Conn) {
 	}
 }
 
+// handleInsecureConn is used to service a TLS connection whose client
+// isn't verified, for the agents obtaining their certificates with
+// auto-encrypt. Only AutoEncrypt.Sign can be called.
+func (s *Server) handleInsecureConn(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		if err != io.EOF {
+			s.logger.Printf("[ERR] consul.rpc: failed to read byte: %v", err)
+		}
+		return
+	}
+	if RPCType(buf[0]) != rpcConsul {
+		s.logger.Printf("[WARN] consul.rpc: unsupported RPC byte on insecure TLS conn: %v", buf[0])
+		return
+	}
+
+	rpcCodec := &insecureCodec{ServerCodec: &signSourceCodec{
+		s.auditConn(newServerCodec(conn), conn), remoteHost(conn)}}
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		default:
+		}
+
+		if err := s.rpcServer.ServeRequest(rpcCodec); err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "closed") &&
+				err != errInsecureRPC {
+				s.logger.Printf("[ERR] consul.rpc: RPC error: %v (%v)", err, conn)
+				metrics.IncrCounter([]string{"consul", "rpc", "request_error"}, 1)
+			}
+			return
+		}
+		metrics.IncrCounter([]string{"consul", "rpc", "request"}, 1)
+	}
+}
+
+// errInsecureRPC is returned for the methods that can't be called on an
+// insecure TLS connection
+var errInsecureRPC = fmt.Errorf("RPC method not allowed on insecure TLS connection")
+
+// insecureCodec rejects every method but AutoEncrypt.Sign. The rejected
+// request gets the error as its response.
+type insecureCodec struct {
+	rpc.ServerCodec
+	method string
+}
+
+func (c *insecureCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.method = r.ServiceMethod
+	return err
+}
+
+func (c *insecureCodec) ReadRequestBody(body interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil {
+		return err
+	}
+	if body != nil && c.method != "AutoEncrypt.Sign" {
+		return errInsecureRPC
+	}
+	return nil
+}
+
+// remoteHost returns the host of the remote address of a connection
+func remoteHost(conn net.Conn) string {
+	source := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	return source
+}
+
+// signSourceCodec sets the Source of the AutoEncrypt.Sign requests to
+// the address they came from, which binds the node name to the LAN
+// member at that address. It isn't used on the connections of the
+// servers, so the requests they forward keep their Source.
+type signSourceCodec struct {
+	rpc.ServerCodec
+	source string
+}
+
+func (c *signSourceCodec) ReadRequestBody(body interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil {
+		return err
+	}
+	if args, ok := body.(*structs.AutoEncryptSignRequest); ok {
+		args.Source = c.source
+	}
+	return nil
+}
+
 // forward is used to forward to a remote DC or to forward to the local leader
 // Returns a bool of if forwarding was performed, as well as any error
 func (s *Server) forward(method string, info structs.RPCInfo, args interface{}, reply interface{}) (bool, error) {
@@ -227,6 +349,11 @@ func (s *Server) forwardDC(method, dc string, args interface{}, reply interface{
 	servers := s.remoteConsuls[dc]
 	if len(servers) == 0 {
 		s.remoteLock.RUnlock()
+
+		// Fall back to the network areas
+		if addr := s.areas.pick(dc); addr != nil {
+			return s.forwardArea(method, dc, addr, args, reply)
+		}
 		s.logger.Printf("[WARN] consul.rpc: RPC request for DC '%s', no path found", dc)
 		return structs.ErrNoDCPath
 	}
@@ -317,6 +444,8 @@ type blockingRPCOptions struct {
 	tables    MDBTables
 	kvWatch   bool
 	kvPrefix  string
+	kvGlob    bool
+	service   string
 	run       func() error
 }
 
@@ -326,16 +455,33 @@ func (s *Server) blockingRPCOpt(opts *blockingRPCOptions) error {
 	var timeout *time.Timer
 	var notifyCh chan struct{}
 	var state *StateStore
+	var woken bool
+
+	// Wait until the writes the client has observed are applied
+	if opts.queryOpts.MinAppliedIndex > 0 {
+		if err := s.waitForApplied(opts.queryOpts); err != nil {
+			return err
+		}
+	}
 
 	// Fast path non-blocking
 	if opts.queryOpts.MinQueryIndex == 0 {
 		goto RUN_QUERY
 	}
 
+	// Track the blocking queries for a graceful leave, and reject them once
+	// it started
+	atomic.AddInt32(&s.blockingQueries, 1)
+	defer atomic.AddInt32(&s.blockingQueries, -1)
+	if atomic.LoadInt32(&s.leaving) == 1 {
+		return structs.ErrServerLeaving
+	}
+
 	// Sanity check that we have tables to block on
-	if len(opts.tables) == 0 && !opts.kvWatch {
+	if len(opts.tables) == 0 && !opts.kvWatch && opts.service == "" {
 		panic("no tables to block on")
 	}
+	metrics.IncrCounter([]string{"consul", "rpc", "query", "blocking"}, 1)
 
 	// Restrict the max query time, and ensure there is always one
 	if opts.queryOpts.MaxQueryTime > maxQueryTime {
@@ -358,23 +504,40 @@ func (s *Server) blockingRPCOpt(opts *blockingRPCOptions) error {
 	defer func() {
 		timeout.Stop()
 		state.StopWatch(opts.tables, notifyCh)
-		if opts.kvWatch {
+		if opts.kvWatch && opts.kvGlob {
+			state.StopWatchKVGlob(opts.kvPrefix, notifyCh)
+		} else if opts.kvWatch {
 			state.StopWatchKV(opts.kvPrefix, notifyCh)
 		}
+		if opts.service != "" {
+			state.StopWatchService(opts.service, notifyCh)
+		}
 	}()
 
 REGISTER_NOTIFY:
 	// Register the notification channel. This may be done
 	// multiple times if we have not reached the target wait index.
 	state.Watch(opts.tables, notifyCh)
-	if opts.kvWatch {
+	if opts.kvWatch && opts.kvGlob {
+		state.WatchKVGlob(opts.kvPrefix, notifyCh)
+	} else if opts.kvWatch {
 		state.WatchKV(opts.kvPrefix, notifyCh)
 	}
+	if opts.service != "" {
+		state.WatchService(opts.service, notifyCh)
+	}
 
 RUN_QUERY:
 	// Update the query meta data
 	s.setQueryMeta(opts.queryMeta)
 
+	// Check if a stale read is within its staleness bounds
+	if opts.queryOpts.AllowStale {
+		if err := s.boundedStaleRead(opts.queryOpts, opts.queryMeta); err != nil {
+			return err
+		}
+	}
+
 	// Check if query must be consistent
 	if opts.queryOpts.RequireConsistent {
 		if err := s.consistentRead(); err != nil {
@@ -388,15 +551,45 @@ RUN_QUERY:
 
 	// Check for minimum query time
 	if err == nil && opts.queryMeta.Index > 0 && opts.queryMeta.Index <= opts.queryOpts.MinQueryIndex {
+		// A wakeup that did not advance the index is churn, which
+		// happens when a watched table changes outside of the results
+		if woken {
+			metrics.IncrCounter([]string{"consul", "rpc", "query", "spurious_wakeup"}, 1)
+		}
 		select {
 		case <-notifyCh:
+			metrics.IncrCounter([]string{"consul", "rpc", "query", "wakeup"}, 1)
+			woken = true
 			goto REGISTER_NOTIFY
 		case <-timeout.C:
+		case <-s.drainCh:
 		}
 	}
 	return err
 }
 
+// waitForApplied blocks until the minimum applied index of a query has
+// been applied locally, bounded by the max query time
+func (s *Server) waitForApplied(q *structs.QueryOptions) error {
+	if s.fsm.AppliedIndex() >= q.MinAppliedIndex {
+		return nil
+	}
+	defer metrics.MeasureSince([]string{"consul", "rpc", "query", "wait_applied"}, time.Now())
+
+	wait := q.MaxQueryTime
+	if wait > maxQueryTime {
+		wait = maxQueryTime
+	} else if wait <= 0 {
+		wait = defaultQueryTime
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	if !s.fsm.WaitForIndex(q.MinAppliedIndex, timeout.C) {
+		return fmt.Errorf("Timed out waiting for index %d to be applied", q.MinAppliedIndex)
+	}
+	return nil
+}
+
 // setQueryMeta is used to populate the QueryMeta data for an RPC call
 func (s *Server) setQueryMeta(m *structs.QueryMeta) {
 	if s.IsLeader() {
@@ -408,6 +601,34 @@ func (s *Server) setQueryMeta(m *structs.QueryMeta) {
 	}
 }
 
+// boundedStaleRead is used to reject a stale read by a follower that is
+// further behind the leader than the query allows. The index lag is the
+// leader's commit index, as last heard from the leader, less our applied
+// index. It is only computed when bounded, as the raft stats are costly.
+func (s *Server) boundedStaleRead(q *structs.QueryOptions, m *structs.QueryMeta) error {
+	if s.IsLeader() {
+		return nil
+	}
+	if q.MaxStaleDuration > 0 && m.LastContact > q.MaxStaleDuration {
+		metrics.IncrCounter([]string{"consul", "rpc", "query", "stale_rejected"}, 1)
+		return fmt.Errorf("%v: last contact with the leader %v ago", structs.ErrStaleRead, m.LastContact)
+	}
+	if q.MaxStaleIndex > 0 {
+		commit, err := strconv.ParseUint(s.raft.Stats()["commit_index"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Failed to get the commit index: %v", err)
+		}
+		if applied := s.fsm.AppliedIndex(); commit > applied {
+			m.IndexLag = commit - applied
+		}
+		if m.IndexLag > q.MaxStaleIndex {
+			metrics.IncrCounter([]string{"consul", "rpc", "query", "stale_rejected"}, 1)
+			return fmt.Errorf("%v: %d entries behind the leader", structs.ErrStaleRead, m.IndexLag)
+		}
+	}
+	return nil
+}
+
 // consistentRead is used to ensure we do not perform a stale
 // read. This is done by verifying leadership before the read.
 func (s *Server) consistentRead() error {
@@ -0,0 +1,88 @@
+package consul
+
+import (
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+
+	"github.com/hashicorp/consul/audit"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// auditCodec records the mutating RPC calls read from a connection in
+// the audit log, along with their result once the response is written.
+// The calls are those whose arguments are a write request. It wraps the
+// connection codec directly, so the calls rejected by the other codecs
+// are recorded too.
+type auditCodec struct {
+	rpc.ServerCodec
+	log    *audit.Log
+	logger *log.Logger
+	source string
+
+	// seq and method are those of the request being read
+	seq    uint64
+	method string
+
+	pending map[uint64]*audit.Event
+	l       sync.Mutex
+}
+
+func (c *auditCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.seq, c.method = r.Seq, r.ServiceMethod
+	return err
+}
+
+func (c *auditCodec) ReadRequestBody(body interface{}) error {
+	err := c.ServerCodec.ReadRequestBody(body)
+	info, ok := body.(structs.RPCInfo)
+	if err != nil || !ok || info.IsRead() {
+		return err
+	}
+
+	c.l.Lock()
+	c.pending[c.seq] = &audit.Event{
+		Type:       "rpc",
+		Source:     c.source,
+		Accessor:   audit.Accessor(info.ACLToken()),
+		Operation:  c.method,
+		Datacenter: info.RequestDatacenter(),
+	}
+	c.l.Unlock()
+	return nil
+}
+
+func (c *auditCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.l.Lock()
+	event, ok := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.l.Unlock()
+	if ok {
+		event.Result = "ok"
+		if r.Error != "" {
+			event.Result, event.Error = "error", r.Error
+		}
+		if err := c.log.Log(event); err != nil {
+			c.logger.Printf("[ERR] consul.rpc: Failed to write audit event: %v", err)
+		}
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// auditConn wraps the codec of a connection to record its calls in the
+// audit log, if enabled. The calls forwarded by other servers were
+// recorded by the server they were made to.
+func (s *Server) auditConn(codec rpc.ServerCodec, conn net.Conn) rpc.ServerCodec {
+	if s.config.AuditLog == nil || s.isServerAddr(conn.RemoteAddr()) {
+		return codec
+	}
+	return &auditCodec{
+		ServerCodec: codec,
+		log:         s.config.AuditLog,
+		logger:      s.logger,
+		source:      conn.RemoteAddr().String(),
+		pending:     make(map[uint64]*audit.Event),
+	}
+}
@@ -0,0 +1,85 @@
+package consul
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul/audit"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestRPC_Audit(t *testing.T) {
+	var path string
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		path = filepath.Join(c.DataDir, "audit.log")
+		log, err := audit.New(&audit.Config{Path: path})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		c.AuditLog = log
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The test clients connect from the address of the server, so a pipe
+	// is used instead
+	conn, serverConn := net.Pipe()
+	go s1.handleConsulConn(serverConn)
+	codec := msgpackrpc.NewClientCodec(conn)
+	defer codec.Close()
+
+	// The reads aren't recorded
+	list := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var nodes structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &list, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	args := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt:     structs.DirEntry{Key: "foo", Value: []byte("bar")},
+	}
+	args.Token = "secret"
+	var ok bool
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &args, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	args.Op = "bogus"
+	if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &args, &ok); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+	var events []*audit.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e audit.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		events = append(events, &e)
+	}
+	if len(events) != 2 {
+		t.Fatalf("bad: %v", events)
+	}
+	first, second := events[0], events[1]
+	if first.Type != "rpc" || first.Operation != "KVS.Apply" || first.Result != "ok" ||
+		first.Datacenter != "dc1" || first.Accessor != audit.Accessor("secret") {
+		t.Fatalf("bad: %#v", first)
+	}
+	if second.Result != "error" || second.Error == "" {
+		t.Fatalf("bad: %#v", second)
+	}
+}
@@ -0,0 +1,132 @@
+package consul
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/rpc"
+	"sync"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+const (
+	// maxRetainedBuffer is the size above which the encoding buffer of
+	// a codec is released after a write rather than kept for the next
+	maxRetainedBuffer = 64 * 1024
+)
+
+// msgpackCodec is the net/rpc codec of the Consul RPC connections. It
+// speaks the same protocol as the codec of net-rpc-msgpackrpc, but the
+// request and response bodies with a generated msgpack encoder or
+// decoder bypass the reflection based codec.
+type msgpackCodec struct {
+	conn   io.ReadWriteCloser
+	bufR   *bufio.Reader
+	bufW   *bufio.Writer
+	enc    *codec.Encoder
+	closed bool
+
+	// in holds the value being read, out the body being written
+	in        bytes.Buffer
+	out       []byte
+	writeLock sync.Mutex
+}
+
+func newMsgpackCodec(conn io.ReadWriteCloser) *msgpackCodec {
+	c := &msgpackCodec{
+		conn: conn,
+		bufR: bufio.NewReader(conn),
+		bufW: bufio.NewWriter(conn),
+	}
+	c.enc = codec.NewEncoder(c.bufW, msgpackHandle)
+	return c
+}
+
+// newClientCodec returns the codec of an outgoing RPC connection
+func newClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return newMsgpackCodec(conn)
+}
+
+// newServerCodec returns the codec of an incoming RPC connection
+func newServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return newMsgpackCodec(conn)
+}
+
+func (c *msgpackCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.read(r)
+}
+
+func (c *msgpackCodec) ReadRequestBody(out interface{}) error {
+	return c.read(out)
+}
+
+func (c *msgpackCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.read(r)
+}
+
+func (c *msgpackCodec) ReadResponseBody(out interface{}) error {
+	return c.read(out)
+}
+
+func (c *msgpackCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.write(r, body)
+}
+
+func (c *msgpackCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	return c.write(r, body)
+}
+
+func (c *msgpackCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+// read is used to read the next value. The value is read whole before
+// it is decoded, as the generated decoders work on a buffer.
+func (c *msgpackCodec) read(out interface{}) error {
+	if c.closed {
+		return io.EOF
+	}
+	c.in.Reset()
+	if err := structs.ReadMsgpack(c.bufR, &c.in); err != nil {
+		return err
+	}
+
+	// A nil out discards the value, such as the body of a request
+	// that is rejected
+	if out == nil {
+		return nil
+	}
+	return structs.Decode(c.in.Bytes(), out)
+}
+
+// write is used to write a header and its body
+func (c *msgpackCodec) write(header, body interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closed {
+		return io.EOF
+	}
+
+	if err := c.enc.Encode(header); err != nil {
+		return err
+	}
+	if m, ok := body.(structs.MsgpackMarshaler); ok {
+		c.out = m.MarshalMsgpack(c.out[:0])
+		_, err := c.bufW.Write(c.out)
+		if cap(c.out) > maxRetainedBuffer {
+			c.out = nil
+		}
+		if err != nil {
+			return err
+		}
+	} else if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.bufW.Flush()
+}
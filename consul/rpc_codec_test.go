@@ -0,0 +1,131 @@
+package consul
+
+import (
+	"net"
+	"net/rpc"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestRPCCodec_RoundTrip(t *testing.T) {
+	req := &structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+			Tags:    []string{"master"},
+			Port:    8000,
+		},
+		Checks: structs.HealthChecks{
+			{Node: "foo", CheckID: "db", Status: structs.HealthPassing, ServiceID: "db"},
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	resp := &structs.IndexedServiceNodes{
+		ServiceNodes: structs.ServiceNodes{
+			{Node: "foo", Address: "127.0.0.1", ServiceID: "db", ServiceName: "db", ServicePort: 8000},
+		},
+		QueryMeta: structs.QueryMeta{Index: 10, LastContact: time.Second, KnownLeader: true},
+	}
+
+	// The generated and the reflection based codecs must interoperate
+	type codecs struct {
+		client func(net.Conn) rpc.ClientCodec
+		server func(net.Conn) rpc.ServerCodec
+	}
+	generated := func(conn net.Conn) rpc.ClientCodec { return newClientCodec(conn) }
+	reflected := func(conn net.Conn) rpc.ClientCodec { return msgpackrpc.NewClientCodec(conn) }
+	cases := []codecs{
+		{generated, func(conn net.Conn) rpc.ServerCodec { return newServerCodec(conn) }},
+		{reflected, func(conn net.Conn) rpc.ServerCodec { return newServerCodec(conn) }},
+		{generated, func(conn net.Conn) rpc.ServerCodec { return msgpackrpc.NewServerCodec(conn) }},
+	}
+	for _, c := range cases {
+		clientConn, serverConn := net.Pipe()
+		client, server := c.client(clientConn), c.server(serverConn)
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- client.WriteRequest(&rpc.Request{ServiceMethod: "Catalog.Register", Seq: 1}, req)
+		}()
+		var reqHeader rpc.Request
+		if err := server.ReadRequestHeader(&reqHeader); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if reqHeader.ServiceMethod != "Catalog.Register" || reqHeader.Seq != 1 {
+			t.Fatalf("bad: %#v", reqHeader)
+		}
+		var reqBody structs.RegisterRequest
+		if err := server.ReadRequestBody(&reqBody); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(req, &reqBody) {
+			t.Fatalf("bad: %#v %#v", req, reqBody)
+		}
+
+		go func() {
+			errCh <- server.WriteResponse(&rpc.Response{ServiceMethod: "Catalog.Register", Seq: 1}, resp)
+		}()
+		var respHeader rpc.Response
+		if err := client.ReadResponseHeader(&respHeader); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if respHeader.Seq != 1 || respHeader.Error != "" {
+			t.Fatalf("bad: %#v", respHeader)
+		}
+		var respBody structs.IndexedServiceNodes
+		if err := client.ReadResponseBody(&respBody); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(resp, &respBody) {
+			t.Fatalf("bad: %#v %#v", resp, respBody)
+		}
+
+		// A body without generated code, and one that is discarded
+		go func() {
+			errCh <- client.WriteRequest(&rpc.Request{ServiceMethod: "Status.Peers", Seq: 2},
+				&structs.IndexedServices{Services: structs.Services{"db": []string{"master"}}})
+		}()
+		if err := server.ReadRequestHeader(&reqHeader); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := server.ReadRequestBody(nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		go func() {
+			errCh <- server.WriteResponse(&rpc.Response{ServiceMethod: "Status.Peers", Seq: 2},
+				&structs.IndexedServices{Services: structs.Services{"web": nil}})
+		}()
+		if err := client.ReadResponseHeader(&respHeader); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var services structs.IndexedServices
+		if err := client.ReadResponseBody(&services); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, ok := services.Services["web"]; !ok || respHeader.Seq != 2 {
+			t.Fatalf("bad: %#v %#v", respHeader, services)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
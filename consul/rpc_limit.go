@@ -0,0 +1,227 @@
+package consul
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// rpcLimitReapInterval is how often the idle buckets are dropped
+	rpcLimitReapInterval = time.Minute
+)
+
+// tokenBucket is a token bucket of the RPC rate limits
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+
+	// scope and id identify the bucket in the logs
+	scope string
+	id    string
+
+	// throttled is set while the bucket rejects requests, so that only
+	// the first rejection is logged
+	throttled bool
+}
+
+// refill refills the bucket at the rate, up to the burst, and returns
+// if it has a token
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) bool {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	return b.tokens >= 1
+}
+
+// take refills the bucket and takes a token if there is one
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	if !b.refill(now, rate, burst) {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rpcLimiter enforces the RPC rate limits of a server. The reads and
+// the writes each have a token bucket per source address and per ACL
+// token, and a request is rejected with ErrRPCRateLimited if either of
+// its buckets is empty. The requests without a token only have a source
+// bucket, as they would otherwise all share the same token bucket.
+type rpcLimiter struct {
+	readRate   float64
+	readBurst  int
+	writeRate  float64
+	writeBurst int
+
+	logger   *log.Logger
+	buckets  map[string]*tokenBucket
+	lastReap time.Time
+	l        sync.Mutex
+}
+
+// newRPCLimiter returns a limiter of the rates of the config, or nil if
+// neither reads nor writes are limited
+func newRPCLimiter(config *Config, logger *log.Logger) *rpcLimiter {
+	if config.RPCReadRate <= 0 && config.RPCWriteRate <= 0 {
+		return nil
+	}
+	return &rpcLimiter{
+		readRate:   config.RPCReadRate,
+		readBurst:  rpcBurst(config.RPCReadRate, config.RPCReadBurst),
+		writeRate:  config.RPCWriteRate,
+		writeBurst: rpcBurst(config.RPCWriteRate, config.RPCWriteBurst),
+		logger:     logger,
+		buckets:    make(map[string]*tokenBucket),
+		lastReap:   time.Now(),
+	}
+}
+
+// rpcBurst returns the burst of a rate, which is at least a second
+// worth of requests
+func rpcBurst(rate float64, burst int) int {
+	if min := int(math.Ceil(rate)); burst < min {
+		return min
+	}
+	return burst
+}
+
+// allow takes a token from the buckets of a request, or returns
+// ErrRPCRateLimited. A token is only taken once all the buckets have
+// one, so a rejected request doesn't drain the others. Requests without
+// an RPCInfo aren't limited.
+func (l *rpcLimiter) allow(source string, args interface{}) error {
+	info, ok := args.(structs.RPCInfo)
+	if !ok {
+		return nil
+	}
+	kind, rate, burst := "write", l.writeRate, l.writeBurst
+	if info.IsRead() {
+		kind, rate, burst = "read", l.readRate, l.readBurst
+	}
+	if rate <= 0 {
+		return nil
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	now := time.Now()
+	l.reap(now)
+	buckets := []*tokenBucket{l.bucket(now, kind, "source", source, rate, burst)}
+	if token := info.ACLToken(); token != "" {
+		buckets = append(buckets, l.bucket(now, kind, "token", token, rate, burst))
+	}
+	for _, b := range buckets {
+		if !b.refill(now, rate, burst) {
+			l.throttle(b, kind, rate)
+			return structs.ErrRPCRateLimited
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+		b.throttled = false
+	}
+	return nil
+}
+
+// bucket returns a bucket, creating it full if needed
+func (l *rpcLimiter) bucket(now time.Time, kind, scope, id string, rate float64, burst int) *tokenBucket {
+	key := kind + "/" + scope + "/" + id
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now, scope: scope, id: id}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// throttle counts a rejection by a bucket. The first rejection of a
+// bucket is logged, without the value of a token.
+func (l *rpcLimiter) throttle(b *tokenBucket, kind string, rate float64) {
+	metrics.IncrCounter([]string{"consul", "rpc", "rate_limit", kind, b.scope}, 1)
+	if b.throttled {
+		return
+	}
+	b.throttled = true
+	who := b.id
+	if b.scope == "token" {
+		who = "an ACL token"
+	}
+	l.logger.Printf("[WARN] consul.rpc: %s rate limit of %v/s exceeded by %s", kind, rate, who)
+}
+
+// reap drops the buckets that refilled completely, which are the same
+// as new ones
+func (l *rpcLimiter) reap(now time.Time) {
+	if now.Sub(l.lastReap) < rpcLimitReapInterval {
+		return
+	}
+	l.lastReap = now
+	for key, b := range l.buckets {
+		kind := key[:len("read")]
+		rate, burst := l.readRate, l.readBurst
+		if kind != "read" {
+			rate, burst = l.writeRate, l.writeBurst
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitCodec applies the RPC rate limits to the requests read from a
+// connection. A rejected request gets the error as its response, and the
+// connection is kept.
+type rateLimitCodec struct {
+	rpc.ServerCodec
+	limiter *rpcLimiter
+	source  string
+}
+
+func (c *rateLimitCodec) ReadRequestBody(body interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	return c.limiter.allow(c.source, body)
+}
+
+// isServerAddr returns if an address is that of a known server, whose
+// forwarded requests were limited by the server they were made to
+func (s *Server) isServerAddr(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	match := func(parts *serverParts) bool {
+		other, ok := parts.Addr.(*net.TCPAddr)
+		return ok && other.IP.Equal(tcp.IP)
+	}
+
+	s.localLock.RLock()
+	for _, parts := range s.localConsuls {
+		if match(parts) {
+			s.localLock.RUnlock()
+			return true
+		}
+	}
+	s.localLock.RUnlock()
+
+	s.remoteLock.RLock()
+	defer s.remoteLock.RUnlock()
+	for _, servers := range s.remoteConsuls {
+		for _, parts := range servers {
+			if match(parts) {
+				return true
+			}
+		}
+	}
+	return false
+}
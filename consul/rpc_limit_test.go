@@ -0,0 +1,144 @@
+package consul
+
+import (
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, last: now}
+	if !b.take(now, 1, 2) || !b.take(now, 1, 2) {
+		t.Fatalf("should take the burst")
+	}
+	if b.take(now, 1, 2) {
+		t.Fatalf("should be empty")
+	}
+	if !b.take(now.Add(time.Second), 1, 2) {
+		t.Fatalf("should refill")
+	}
+
+	// The refill is capped by the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.take(later, 1, 2) {
+			t.Fatalf("should take the burst")
+		}
+	}
+	if b.take(later, 1, 2) {
+		t.Fatalf("should be empty")
+	}
+}
+
+func TestRPCLimiter(t *testing.T) {
+	if newRPCLimiter(DefaultConfig(), nil) != nil {
+		t.Fatalf("should be disabled")
+	}
+
+	conf := DefaultConfig()
+	conf.RPCReadRate = 0.001
+	conf.RPCReadBurst = 2
+	l := newRPCLimiter(conf, log.New(os.Stderr, "", log.LstdFlags))
+
+	read := &structs.DCSpecificRequest{Datacenter: "dc1"}
+	read.Token = "foo"
+	for i := 0; i < 2; i++ {
+		if err := l.allow("10.0.0.1", read); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := l.allow("10.0.0.1", read); err != structs.ErrRPCRateLimited {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Another source has its own bucket, but not another token, and the
+	// rejection doesn't drain the source bucket
+	if err := l.allow("10.0.0.2", read); err != structs.ErrRPCRateLimited {
+		t.Fatalf("err: %v", err)
+	}
+	other := &structs.DCSpecificRequest{Datacenter: "dc1"}
+	other.Token = "bar"
+	for i := 0; i < 2; i++ {
+		if err := l.allow("10.0.0.2", other); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The requests without a token are only limited by source
+	anon := &structs.DCSpecificRequest{Datacenter: "dc1"}
+	for i := 0; i < 2; i++ {
+		if err := l.allow("10.0.0.3", anon); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := l.allow("10.0.0.3", anon); err != structs.ErrRPCRateLimited {
+		t.Fatalf("err: %v", err)
+	}
+	if err := l.allow("10.0.0.4", anon); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Writes aren't limited, nor requests without an RPCInfo
+	write := &structs.RegisterRequest{Datacenter: "dc1"}
+	for i := 0; i < 10; i++ {
+		if err := l.allow("10.0.0.1", write); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := l.allow("10.0.0.1", &struct{}{}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The buckets that refilled are reaped
+	l.reap(time.Now().Add(time.Hour))
+	if len(l.buckets) != 0 {
+		t.Fatalf("bad: %v", l.buckets)
+	}
+}
+
+func TestRPC_RateLimit(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RPCReadRate = 0.001
+		c.RPCReadBurst = 1
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// The test clients connect from the address of the server, so a pipe
+	// is used instead
+	conn, serverConn := net.Pipe()
+	go s1.handleConsulConn(serverConn)
+	codec := msgpackrpc.NewClientCodec(conn)
+	defer codec.Close()
+
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var out structs.IndexedNodes
+	if err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := msgpackrpc.CallWithCodec(codec, "Catalog.ListNodes", &args, &out)
+	if err == nil || err.Error() != structs.ErrRPCRateLimited.Error() {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The connection is kept
+	var pong struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Status.Ping", struct{}{}, &pong); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The servers aren't limited
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.isServerAddr(s1.config.RPCAddr), nil
+	}, func(err error) {
+		t.Fatalf("should be a server")
+	})
+}
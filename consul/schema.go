@@ -0,0 +1,110 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// schemaVersion is the version of the layout of the snapshot records. It
+// is recorded in the header of each snapshot. A change to a record that
+// older snapshots can't be decoded into as-is, such as a renamed field,
+// must increment it and register a migration for the affected records.
+// New indexes don't need a migration, since the tables are re-indexed as
+// the records are restored. Snapshots taken before versioning are
+// version 0, which has the same layout as version 1.
+const schemaVersion = 1
+
+// schemaMigration upgrades the records of one type to a schema version
+// from the previous version. The record is migrated in its generic form,
+// as decoded into a map, so fields that no longer exist can be read.
+type schemaMigration struct {
+	Version int
+	Type    structs.MessageType
+	Migrate func(rec map[string]interface{}) error
+}
+
+// schemaMigrations are the registered migrations, in version order
+var schemaMigrations []*schemaMigration
+
+// registerMigration registers a migration of the records of a type to a
+// schema version. It is meant to be called from init, and the migrations
+// must be registered in version order so that restores are deterministic.
+func registerMigration(version int, msgType structs.MessageType,
+	migrate func(rec map[string]interface{}) error) {
+	if version < 2 || version > schemaVersion {
+		panic(fmt.Errorf("Invalid migration version %d", version))
+	}
+	if n := len(schemaMigrations); n > 0 && schemaMigrations[n-1].Version > version {
+		panic(fmt.Errorf("Migration to version %d registered out of order", version))
+	}
+	schemaMigrations = append(schemaMigrations, &schemaMigration{
+		Version: version,
+		Type:    msgType,
+		Migrate: migrate,
+	})
+}
+
+// renameField returns a migration that renames a field of a record
+func renameField(from, to string) func(map[string]interface{}) error {
+	return func(rec map[string]interface{}) error {
+		if v, ok := rec[from]; ok {
+			rec[to] = v
+			delete(rec, from)
+		}
+		return nil
+	}
+}
+
+// recordDecoder decodes the records of a snapshot, migrating the ones
+// that were written with an older schema version
+type recordDecoder struct {
+	dec        *codec.Decoder
+	migrations map[structs.MessageType][]*schemaMigration
+}
+
+// newRecordDecoder creates a decoder for the records of a snapshot taken
+// with the given schema version, upgrading them to the target version
+func newRecordDecoder(dec *codec.Decoder, from, to int,
+	migrations []*schemaMigration) (*recordDecoder, error) {
+	if from > to {
+		return nil, fmt.Errorf("Snapshot schema version %d is newer than the supported version %d",
+			from, to)
+	}
+	d := &recordDecoder{
+		dec:        dec,
+		migrations: make(map[structs.MessageType][]*schemaMigration),
+	}
+	for _, m := range migrations {
+		if m.Version > from && m.Version <= to {
+			d.migrations[m.Type] = append(d.migrations[m.Type], m)
+		}
+	}
+	return d, nil
+}
+
+// Decode decodes the next record, of the given type, into out
+func (d *recordDecoder) Decode(msgType structs.MessageType, out interface{}) error {
+	migrations := d.migrations[msgType]
+	if len(migrations) == 0 {
+		return d.dec.Decode(out)
+	}
+
+	// Migrate the generic form of the record, then decode it again
+	var rec map[string]interface{}
+	if err := d.dec.Decode(&rec); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if err := m.Migrate(rec); err != nil {
+			return fmt.Errorf("Failed to migrate %v record to schema version %d: %v",
+				msgType, m.Version, err)
+		}
+	}
+	var buf []byte
+	if err := codec.NewEncoderBytes(&buf, msgpackHandle).Encode(rec); err != nil {
+		return err
+	}
+	return codec.NewDecoderBytes(buf, msgpackHandle).Decode(out)
+}
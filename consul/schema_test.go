@@ -0,0 +1,122 @@
+package consul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+func TestRecordDecoder_Migrate(t *testing.T) {
+	// A node record from a schema where the address was named Addr
+	old := map[string]interface{}{
+		"Node": "foo",
+		"Addr": "127.0.0.1",
+	}
+	var buf []byte
+	if err := codec.NewEncoderBytes(&buf, msgpackHandle).Encode(old); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	migrations := []*schemaMigration{
+		&schemaMigration{
+			Version: 2,
+			Type:    structs.RegisterRequestType,
+			Migrate: renameField("Addr", "Address"),
+		},
+	}
+
+	// Records of the old version are migrated
+	dec := codec.NewDecoder(bytes.NewReader(buf), msgpackHandle)
+	records, err := newRecordDecoder(dec, 1, 2, migrations)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var req structs.RegisterRequest
+	if err := records.Decode(structs.RegisterRequestType, &req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Node != "foo" || req.Address != "127.0.0.1" {
+		t.Fatalf("bad: %#v", req)
+	}
+
+	// Records of the current version are not
+	dec = codec.NewDecoder(bytes.NewReader(buf), msgpackHandle)
+	records, err = newRecordDecoder(dec, 2, 2, migrations)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req = structs.RegisterRequest{}
+	if err := records.Decode(structs.RegisterRequestType, &req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Node != "foo" || req.Address != "" {
+		t.Fatalf("bad: %#v", req)
+	}
+
+	// Nor are records of other types
+	dec = codec.NewDecoder(bytes.NewReader(buf), msgpackHandle)
+	records, err = newRecordDecoder(dec, 1, 2, migrations)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var node structs.Node
+	if err := records.Decode(structs.ServerHealthRequestType, &node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node.Node != "foo" || node.Address != "" {
+		t.Fatalf("bad: %#v", node)
+	}
+
+	// Snapshots from a newer schema are rejected
+	if _, err := newRecordDecoder(dec, 3, 2, migrations); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestFSM_SnapshotRestore_SchemaVersion(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// The schema version is recorded in the snapshot
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var header snapshotHeader
+	if err := codec.NewDecoder(bytes.NewReader(buf.Bytes()), msgpackHandle).Decode(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header.SchemaVersion != schemaVersion {
+		t.Fatalf("bad: %#v", header)
+	}
+
+	// A snapshot from a newer schema can't be restored
+	newer := bytes.NewBuffer(nil)
+	header = snapshotHeader{LastIndex: 1, SchemaVersion: schemaVersion + 1}
+	if err := codec.NewEncoder(newer, msgpackHandle).Encode(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = fsm.Restore(&MockSink{newer, false})
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("err: %v", err)
+	}
+}
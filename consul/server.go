@@ -1,7 +1,6 @@
 package consul
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
@@ -12,9 +11,12 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/armon/go-radix"
 	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/tlsutil"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/raft-boltdb"
@@ -51,6 +53,10 @@ const (
 	// raftRemoveGracePeriod is how long we wait to allow a RemovePeer
 	// to replicate to gracefully leave the cluster.
 	raftRemoveGracePeriod = 5 * time.Second
+
+	// tlsWatchInterval is how often the TLS certificate files are
+	// checked for changes
+	tlsWatchInterval = 10 * time.Second
 )
 
 // Server is Consul server which manages the service discovery,
@@ -62,6 +68,11 @@ type Server struct {
 	// aclCache is the non-authoritative ACL cache.
 	aclCache *aclCache
 
+	// aclReplicationStatus is the state of the replication of the ACLs,
+	// updated by the leader
+	aclReplicationStatus     structs.ACLReplicationStatus
+	aclReplicationStatusLock sync.RWMutex
+
 	// Consul configuration
 	config *Config
 
@@ -86,6 +97,13 @@ type Server struct {
 	// Have we attempted to leave the cluster
 	left bool
 
+	// leaving is set once a graceful leave starts, new blocking queries
+	// are then rejected. blockingQueries counts the ones in flight, and
+	// drainCh is closed to return them once the drain time is up.
+	leaving         int32
+	blockingQueries int32
+	drainCh         chan struct{}
+
 	// localConsuls is used to track the known consuls
 	// in the local datacenter. Used to do leader forwarding.
 	localConsuls map[string]*serverParts
@@ -112,12 +130,24 @@ type Server struct {
 	remoteConsuls map[string][]*serverParts
 	remoteLock    sync.RWMutex
 
+	// areas routes the RPCs of the datacenters linked by a network area
+	// rather than the WAN pool
+	areas *areaRouter
+
 	// rpcListener is used to listen for incoming connections
 	rpcListener net.Listener
 	rpcServer   *rpc.Server
 
-	// rpcTLS is the TLS config for incoming TLS requests
-	rpcTLS *tls.Config
+	// rpcLimiter enforces the RPC rate limits, if any
+	rpcLimiter *rpcLimiter
+
+	// rpcTLS holds the TLS configs of the RPC connections, which are
+	// swapped when the certificates are reloaded
+	rpcTLS *tlsutil.Configurator
+
+	// caSigner signs the certificates of the auto-encrypt clients, if
+	// the server allows it
+	caSigner *caSigner
 
 	// serfLAN is the Serf cluster maintained inside the DC
 	// which contains all the DC nodes
@@ -133,10 +163,21 @@ type Server struct {
 	sessionTimers     map[string]*time.Timer
 	sessionTimersLock sync.Mutex
 
+	// sessionExpires holds the deadline of each session timer, and
+	// sessionExpiresIndex orders the sessions by it, so the sessions
+	// expiring soon are listed without a scan. They are guarded by the
+	// sessionTimersLock.
+	sessionExpires      map[string]time.Time
+	sessionExpiresIndex *radix.Tree
+
 	// tombstoneGC is used to track the pending GC invocations
 	// for the KV tombstones
 	tombstoneGC *TombstoneGC
 
+	// kvsHistoryGC is used to track the pending GC invocations for the
+	// versions of the KV history. It is nil unless a history TTL is set.
+	kvsHistoryGC *TombstoneGC
+
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
@@ -151,6 +192,12 @@ type endpoints struct {
 	Session  *Session
 	Internal *Internal
 	ACL      *ACL
+	Operator *Operator
+	Snapshot *Snapshot
+	Txn      *Txn
+	Peering  *Peering
+
+	AutoEncrypt *AutoEncrypt
 }
 
 // NewServer is used to construct a new Consul server from the
@@ -171,22 +218,37 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, err
 	}
 
+	// Sanity check the event bridge
+	if err := config.CheckEventBridge(); err != nil {
+		return nil, err
+	}
+
+	// Sanity check the outbox subscriptions
+	if err := config.CheckOutbox(); err != nil {
+		return nil, err
+	}
+
 	// Ensure we have a log output
 	if config.LogOutput == nil {
 		config.LogOutput = os.Stderr
 	}
 
-	// Create the tls wrapper for outgoing connections
-	tlsConf := config.tlsConfig()
-	tlsWrap, err := tlsConf.OutgoingTLSWrapper()
+	// Create the TLS configs of the incoming and outgoing connections
+	rpcTLS, err := tlsutil.NewConfigurator(config.tlsConfig())
 	if err != nil {
 		return nil, err
 	}
+	tlsWrap := rpcTLS.OutgoingTLSWrapper()
 
-	// Get the incoming tls config
-	incomingTLS, err := tlsConf.IncomingTLSConfig()
-	if err != nil {
-		return nil, err
+	// Load the CA that signs the certificates of the auto-encrypt clients
+	var signer *caSigner
+	if config.AutoEncryptAllowTLS {
+		if config.CAFile == "" || config.CAKeyFile == "" || config.CertFile == "" {
+			return nil, fmt.Errorf("AutoEncryptAllowTLS requires a CA file, CA key file and certificate")
+		}
+		if signer, err = newCASigner(config.CAFile, config.CAKeyFile, config.AutoEncryptCertTTL); err != nil {
+			return nil, err
+		}
 	}
 
 	// Create a logger
@@ -208,10 +270,23 @@ func NewServer(config *Config) (*Server, error) {
 		logger:        logger,
 		reconcileCh:   make(chan serf.Member, 32),
 		remoteConsuls: make(map[string][]*serverParts),
+		areas:         newAreaRouter(),
 		rpcServer:     rpc.NewServer(),
-		rpcTLS:        incomingTLS,
+		rpcLimiter:    newRPCLimiter(config, logger),
+		rpcTLS:        rpcTLS,
+		caSigner:      signer,
 		tombstoneGC:   gc,
 		shutdownCh:    make(chan struct{}),
+		drainCh:       make(chan struct{}),
+	}
+
+	// Create the KV history GC, which reaps the versions older than the
+	// history TTL through Raft, so all the servers retain the same ones
+	if config.KVSHistoryVersions > 0 && config.KVSHistoryTTL > 0 {
+		s.kvsHistoryGC, err = NewTombstoneGC(config.KVSHistoryTTL, config.TombstoneTTLGranularity)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Initialize the authoritative ACL cache
@@ -227,6 +302,12 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, err
 	}
 
+	// Resolve the tokens from the replicated ACLs when the ACL datacenter
+	// can't be reached
+	if s.aclReplicationEnabled() {
+		s.aclCache.local = s.aclLocal
+	}
+
 	// Initialize the RPC layer
 	if err := s.setupRPC(tlsWrap); err != nil {
 		s.Shutdown()
@@ -262,6 +343,14 @@ func NewServer(config *Config) (*Server, error) {
 
 	// Start the metrics handlers
 	go s.sessionStats()
+	go s.stateStats()
+	go s.reapWatches()
+
+	// Route the RPCs of the peer datacenters of the network areas
+	go s.runAreas()
+
+	// Reload the TLS certificates when their files change
+	go s.rpcTLS.Watch(tlsWatchInterval, s.shutdownCh, s.logger)
 	return s, nil
 }
 
@@ -327,10 +416,20 @@ func (s *Server) setupRaft() error {
 
 	// Create the FSM
 	var err error
-	s.fsm, err = NewFSM(s.tombstoneGC, statePath, s.config.LogOutput)
+	s.fsm, err = newFSMIndexes(s.tombstoneGC, statePath, s.config.LogOutput, s.config.StateIndexes)
 	if err != nil {
 		return err
 	}
+	if err := s.fsm.SetStateMaxSize(s.config.StateMaxSize); err != nil {
+		return err
+	}
+	if s.config.StateLogger != nil {
+		s.fsm.SetLogger(s.config.StateLogger)
+	}
+	s.fsm.SetKVSHistoryGC(s.kvsHistoryGC)
+	s.fsm.SetSlowQueryThreshold(s.config.SlowQueryThreshold)
+	s.fsm.SetQueryCacheSize(s.config.QueryCacheSize)
+	s.fsm.SetKVSNotifyLimits(s.config.KVSNotifyLimits)
 
 	// Create the base raft path
 	path := filepath.Join(s.config.DataDir, raftState)
@@ -405,6 +504,11 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	s.endpoints.Session = &Session{s}
 	s.endpoints.Internal = &Internal{s}
 	s.endpoints.ACL = &ACL{s}
+	s.endpoints.Operator = &Operator{s}
+	s.endpoints.Snapshot = &Snapshot{s}
+	s.endpoints.Txn = &Txn{s}
+	s.endpoints.Peering = &Peering{s}
+	s.endpoints.AutoEncrypt = &AutoEncrypt{s}
 
 	// Register the handlers
 	s.rpcServer.Register(s.endpoints.Status)
@@ -414,6 +518,11 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	s.rpcServer.Register(s.endpoints.Session)
 	s.rpcServer.Register(s.endpoints.Internal)
 	s.rpcServer.Register(s.endpoints.ACL)
+	s.rpcServer.Register(s.endpoints.Operator)
+	s.rpcServer.Register(s.endpoints.Snapshot)
+	s.rpcServer.Register(s.endpoints.Txn)
+	s.rpcServer.Register(s.endpoints.Peering)
+	s.rpcServer.Register(s.endpoints.AutoEncrypt)
 
 	list, err := net.ListenTCP("tcp", s.config.RPCAddr)
 	if err != nil {
@@ -503,6 +612,9 @@ func (s *Server) Leave() error {
 	s.logger.Printf("[INFO] consul: server starting leave")
 	s.left = true
 
+	// Stop accepting blocking queries, the clients retry them elsewhere
+	atomic.StoreInt32(&s.leaving, 1)
+
 	// Check the number of known peers
 	numPeers, err := s.numOtherPeers()
 	if err != nil {
@@ -514,6 +626,8 @@ func (s *Server) Leave() error {
 	// servers), we should do a RemovePeer to safely reduce the quorum size. If we are
 	// not the leader, then we should issue our leave intention and wait to be removed
 	// for some sane period of time.
+	// Removing ourself also steps down, so the other servers elect a new
+	// leader.
 	isLeader := s.IsLeader()
 	if isLeader && numPeers > 0 {
 		future := s.raft.RemovePeer(s.raftTransport.LocalAddr())
@@ -522,6 +636,10 @@ func (s *Server) Leave() error {
 		}
 	}
 
+	// Let the blocking queries in flight complete before leaving gossip,
+	// so the clients don't see errors
+	s.drainQueries()
+
 	// Leave the WAN pool
 	if s.serfWAN != nil {
 		if err := s.serfWAN.Leave(); err != nil {
@@ -565,6 +683,19 @@ func (s *Server) Leave() error {
 	return nil
 }
 
+// drainQueries waits for the blocking queries in flight to complete, up to
+// the drain time, and then returns the remaining ones
+func (s *Server) drainQueries() {
+	limit := time.Now().Add(s.config.LeaveDrainTime)
+	for atomic.LoadInt32(&s.blockingQueries) > 0 && time.Now().Before(limit) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&s.blockingQueries); n > 0 {
+		s.logger.Printf("[WARN] consul: returning %d blocking queries early to leave", n)
+	}
+	close(s.drainCh)
+}
+
 // numOtherPeers is used to check on the number of known peers
 // excluding the local node
 func (s *Server) numOtherPeers() (int, error) {
@@ -621,6 +752,14 @@ func (s *Server) IsLeader() bool {
 	return s.raft.State() == raft.Leader
 }
 
+// ReloadTLS applies the TLS settings of a new configuration to the RPC
+// connections, reading the certificates again. New connections use them
+// while the existing ones are kept. The current settings are kept if
+// the new ones fail to load.
+func (s *Server) ReloadTLS(config *Config) error {
+	return s.rpcTLS.Update(config.tlsConfig())
+}
+
 // KeyManagerLAN returns the LAN Serf keyring manager
 func (s *Server) KeyManagerLAN() *serf.KeyManager {
 	return s.serfLAN.KeyManager()
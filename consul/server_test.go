@@ -7,9 +7,11 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
 )
 
@@ -66,6 +68,9 @@ func testServerConfig(t *testing.T, NodeName string) (string, *Config) {
 	config.RaftConfig.ElectionTimeout = 40 * time.Millisecond
 
 	config.ReconcileInterval = 100 * time.Millisecond
+
+	// Add the new servers as soon as they join
+	config.AutopilotConfig.ServerStabilizationTime = 0
 	return dir, config
 }
 
@@ -371,6 +376,66 @@ func TestServer_LeaveLeader(t *testing.T) {
 	}
 }
 
+func TestServer_Leave_DrainQueries(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.LeaveDrainTime = 200 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	args := structs.DCSpecificRequest{Datacenter: "dc1"}
+	var out structs.IndexedServices
+	if err := s1.RPC("Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	args.MinQueryIndex = out.Index
+	args.MaxQueryTime = 10 * time.Second
+
+	// Start a blocking query
+	errCh := make(chan error, 1)
+	go func() {
+		args := args
+		var out structs.IndexedServices
+		errCh <- s1.RPC("Catalog.ListServices", &args, &out)
+	}()
+	testutil.WaitForResult(func() (bool, error) {
+		return atomic.LoadInt32(&s1.blockingQueries) == 1, nil
+	}, func(err error) {
+		t.Fatalf("query not blocking")
+	})
+
+	// The leave returns it once the drain time is up
+	start := time.Now()
+	if err := s1.Leave(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("query not returned")
+	}
+	if d := time.Now().Sub(start); d < 200*time.Millisecond {
+		t.Fatalf("too fast: %v", d)
+	}
+
+	// New blocking queries are rejected
+	err := s1.RPC("Catalog.ListServices", &args, &out)
+	if err == nil || err.Error() != structs.ErrServerLeaving.Error() {
+		t.Fatalf("err: %v", err)
+	}
+
+	// But not the others
+	args.MinQueryIndex = 0
+	if err := s1.RPC("Catalog.ListServices", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestServer_Leave(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -689,3 +754,44 @@ func TestServer_Encrypted(t *testing.T) {
 		t.Fatalf("should be encrypted")
 	}
 }
+
+func TestServer_TLSMigrate(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.VerifyIncoming = true
+		c.TLSMigrate = true
+		configureTLS(c)
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	// Plaintext connections are accepted while migrating
+	codec := rpcClient(t, s1)
+	var out struct{}
+	if err := msgpackrpc.CallWithCodec(codec, "Status.Ping", struct{}{}, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	codec.Close()
+
+	// And rejected once the migration is over
+	conf := DefaultConfig()
+	conf.NodeName = s1.config.NodeName
+	conf.VerifyIncoming = true
+	configureTLS(conf)
+	if err := s1.ReloadTLS(conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	codec = rpcClient(t, s1)
+	defer codec.Close()
+	if err := msgpackrpc.CallWithCodec(codec, "Status.Ping", struct{}{}, &out); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// A reload that fails keeps the current config
+	conf.CAFile = "../test/ca/missing.cer"
+	if err := s1.ReloadTLS(conf); err == nil {
+		t.Fatalf("should fail")
+	}
+	if !s1.rpcTLS.VerifyIncoming() {
+		t.Fatalf("should keep the config")
+	}
+}
@@ -0,0 +1,104 @@
+package consul
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceWatch is used to watch a service as a whole: its service
+// entries, the nodes of its instances, and their checks, including the
+// checks of the nodes. Watching the tables behind a service query wakes
+// its watchers on any catalog change, and arming the right set of tables
+// is easy to get wrong per endpoint, so the catalog writes fire the
+// watches of the services they affect instead. Service names are
+// compared case-insensitively, like the service index.
+type serviceWatch struct {
+	l      sync.Mutex
+	groups map[string]*NotifyGroup
+}
+
+// newServiceWatch creates an empty service watch
+func newServiceWatch() *serviceWatch {
+	return &serviceWatch{
+		groups: make(map[string]*NotifyGroup),
+	}
+}
+
+// Wait adds a channel to the watchers of a service
+func (w *serviceWatch) Wait(service string, ch chan struct{}) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	service = strings.ToLower(service)
+	group, ok := w.groups[service]
+	if !ok {
+		group = &NotifyGroup{}
+		w.groups[service] = group
+	}
+	group.Wait(ch)
+}
+
+// Clear removes a channel from the watchers of a service
+func (w *serviceWatch) Clear(service string, ch chan struct{}) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	service = strings.ToLower(service)
+	group, ok := w.groups[service]
+	if !ok {
+		return
+	}
+	group.Clear(ch)
+	if group.Count() == 0 {
+		delete(w.groups, service)
+	}
+}
+
+// drain moves the watchers of a service into a set without notifying
+// them. The group is removed, since draining leaves it empty.
+func (w *serviceWatch) drain(service string, into map[chan struct{}]struct{}) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	service = strings.ToLower(service)
+	if group, ok := w.groups[service]; ok {
+		group.drain(into)
+		delete(w.groups, service)
+	}
+}
+
+// Notify wakes the watchers of a service
+func (w *serviceWatch) Notify(service string) {
+	chs := make(map[chan struct{}]struct{})
+	w.drain(service, chs)
+	for ch := range chs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Reap removes the channels that started waiting before a time, and
+// returns how many were removed
+func (w *serviceWatch) Reap(before time.Time) int {
+	w.l.Lock()
+	defer w.l.Unlock()
+	reaped := 0
+	for service, group := range w.groups {
+		reaped += group.Reap(before)
+		if group.Count() == 0 {
+			delete(w.groups, service)
+		}
+	}
+	return reaped
+}
+
+// Count returns the number of waiting channels
+func (w *serviceWatch) Count() int {
+	w.l.Lock()
+	defer w.l.Unlock()
+	num := 0
+	for _, group := range w.groups {
+		num += group.Count()
+	}
+	return num
+}
@@ -0,0 +1,121 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestServiceWatch(t *testing.T) {
+	w := newServiceWatch()
+
+	ch, other := make(chan struct{}, 1), make(chan struct{}, 1)
+	w.Wait("Web", ch)
+	w.Wait("db", other)
+
+	// Service names are case-insensitive
+	w.Notify("web")
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("should be notified")
+	}
+	select {
+	case <-other:
+		t.Fatalf("should not be notified")
+	default:
+	}
+
+	// Clearing the last channel removes the group
+	w.Clear("db", other)
+	if len(w.groups) != 0 || w.Count() != 0 {
+		t.Fatalf("bad: %v", w.groups)
+	}
+
+	w.Wait("db", other)
+	if n := w.Reap(time.Now().Add(time.Second)); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if len(w.groups) != 0 {
+		t.Fatalf("bad: %v", w.groups)
+	}
+}
+
+func TestStateStore_WatchService(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	idx := uint64(1)
+	expect := func(desc string, fired bool, fn func() error) {
+		ch := make(chan struct{}, 1)
+		store.WatchService("web", ch)
+		defer store.StopWatchService("web", ch)
+		if err := fn(); err != nil {
+			t.Fatalf("%s err: %v", desc, err)
+		}
+		idx++
+		select {
+		case <-ch:
+			if !fired {
+				t.Fatalf("%s: should not fire", desc)
+			}
+		default:
+			if fired {
+				t.Fatalf("%s: should fire", desc)
+			}
+		}
+	}
+
+	expect("register node", false, func() error {
+		return store.EnsureNode(idx, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	})
+	expect("register service", true, func() error {
+		return store.EnsureService(idx, "foo", &structs.NodeService{ID: "web1", Service: "web", Port: 80})
+	})
+	expect("register other service", false, func() error {
+		return store.EnsureService(idx, "foo", &structs.NodeService{ID: "db1", Service: "db", Port: 5432})
+	})
+	expect("other service check", false, func() error {
+		return store.EnsureCheck(idx, &structs.HealthCheck{Node: "foo", CheckID: "db", ServiceID: "db1"})
+	})
+	expect("service check", true, func() error {
+		return store.EnsureCheck(idx, &structs.HealthCheck{Node: "foo", CheckID: "web", ServiceID: "web1"})
+	})
+	expect("node check", true, func() error {
+		return store.EnsureCheck(idx, &structs.HealthCheck{Node: "foo", CheckID: "mem"})
+	})
+	expect("update node", true, func() error {
+		return store.EnsureNode(idx, structs.Node{Node: "foo", Address: "127.0.0.2"})
+	})
+	expect("patch node", true, func() error {
+		return store.CatalogPatch(idx, &structs.CatalogPatchRequest{
+			Node: "foo",
+			Ops:  []structs.PatchOp{{Op: structs.PatchSetMeta, Key: "rack", Value: "r1"}},
+		})
+	})
+	expect("delete node check", true, func() error {
+		return store.DeleteNodeCheck(idx, "foo", "mem")
+	})
+	expect("rename service", true, func() error {
+		return store.EnsureService(idx, "foo", &structs.NodeService{ID: "web1", Service: "api", Port: 80})
+	})
+	expect("register service again", true, func() error {
+		return store.EnsureService(idx, "foo", &structs.NodeService{ID: "web2", Service: "web", Port: 80})
+	})
+	expect("delete service", true, func() error {
+		return store.DeleteNodeService(idx, "foo", "web2")
+	})
+	expect("register other node", false, func() error {
+		return store.EnsureNode(idx, structs.Node{Node: "bar", Address: "127.0.0.3"})
+	})
+	expect("register service on other node", true, func() error {
+		return store.EnsureService(idx, "bar", &structs.NodeService{ID: "web", Service: "WEB", Port: 80})
+	})
+	expect("delete node", true, func() error {
+		return store.DeleteNode(idx, "bar")
+	})
+}
@@ -58,6 +58,10 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 	// deterministic. Once the entry is in the log, the state update MUST
 	// be deterministic or the followers will not converge.
 	if args.Op == structs.SessionCreate {
+		// The limit is carried in the request, so all the servers
+		// enforce the one of the leader
+		args.SessionLimit = s.srv.config.SessionLimitPerNode
+
 		// Generate a new session ID, verify uniqueness
 		state := s.srv.fsm.State()
 		for {
@@ -139,7 +143,10 @@ func (s *Session) List(args *structs.DCSpecificRequest,
 		func() error {
 			var err error
 			reply.Index, reply.Sessions, err = state.SessionList()
-			return err
+			if err != nil {
+				return err
+			}
+			return sortSessions(reply.Sessions, args.SortBy)
 		})
 }
 
@@ -158,7 +165,10 @@ func (s *Session) NodeSessions(args *structs.NodeSpecificRequest,
 		func() error {
 			var err error
 			reply.Index, reply.Sessions, err = state.NodeSessions(args.Node)
-			return err
+			if err != nil {
+				return err
+			}
+			return sortSessions(reply.Sessions, args.SortBy)
 		})
 }
 
@@ -188,3 +198,28 @@ func (s *Session) Renew(args *structs.SessionSpecificRequest,
 	}
 	return nil
 }
+
+// Expiring is used to list the sessions whose TTL expires within a
+// window unless they are renewed, from the session timers of the
+// leader, in order of expiration. The renewals don't go through Raft,
+// so only the leader knows when the sessions expire.
+func (s *Session) Expiring(args *structs.SessionExpiringRequest,
+	reply *structs.IndexedSessions) error {
+	args.AllowStale = false
+	if done, err := s.srv.forward("Session.Expiring", args, args, reply); done {
+		return err
+	}
+	if args.Window < 0 {
+		return fmt.Errorf("Window can't be negative")
+	}
+
+	// Only the expiring sessions are read, in the order of the index
+	ids := s.srv.sessionsExpiringBefore(time.Now().Add(args.Window))
+	index, sessions, err := s.srv.fsm.State().SessionsByID(ids)
+	if err != nil {
+		return err
+	}
+	reply.Index, reply.Sessions = index, sessions
+	s.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
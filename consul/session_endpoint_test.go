@@ -2,6 +2,7 @@ package consul
 
 import (
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,7 +21,7 @@ func TestSessionEndpoint_Apply(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 
 	arg := structs.SessionRequest{
 		Datacenter: "dc1",
@@ -69,6 +70,40 @@ func TestSessionEndpoint_Apply(t *testing.T) {
 	}
 }
 
+func TestSessionEndpoint_Apply_Limit(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.SessionLimitPerNode = 1
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	// Just add a node
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Node: "foo",
+		},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The limit of the leader is enforced, whatever the request says
+	arg.SessionLimit = 0
+	err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "limit of 1 sessions") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestSessionEndpoint_DeleteApply(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -79,7 +114,7 @@ func TestSessionEndpoint_DeleteApply(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 
 	arg := structs.SessionRequest{
 		Datacenter: "dc1",
@@ -141,7 +176,7 @@ func TestSessionEndpoint_Get(t *testing.T) {
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	arg := structs.SessionRequest{
 		Datacenter: "dc1",
 		Op:         structs.SessionCreate,
@@ -184,7 +219,7 @@ func TestSessionEndpoint_List(t *testing.T) {
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	ids := []string{}
 	for i := 0; i < 5; i++ {
 		arg := structs.SessionRequest{
@@ -226,6 +261,67 @@ func TestSessionEndpoint_List(t *testing.T) {
 	}
 }
 
+func TestSessionEndpoint_List_Sort(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	for _, name := range []string{"c", "a", "b"} {
+		arg := structs.SessionRequest{
+			Datacenter: "dc1",
+			Op:         structs.SessionCreate,
+			Session: structs.Session{
+				Node: "foo",
+				Name: name,
+			},
+		}
+		var out string
+		if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	getR := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{SortBy: structs.SortByName},
+	}
+	var sessions structs.IndexedSessions
+	if err := msgpackrpc.CallWithCodec(codec, "Session.List", &getR, &sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var names string
+	for _, s := range sessions.Sessions {
+		names += s.Name
+	}
+	if names != "abc" {
+		t.Fatalf("bad: %v", sessions.Sessions)
+	}
+
+	// Sorting by creation gives the order of the writes
+	getR.SortBy = structs.SortByCreateIndex
+	if err := msgpackrpc.CallWithCodec(codec, "Session.List", &getR, &sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	names = ""
+	for _, s := range sessions.Sessions {
+		names += s.Name
+	}
+	if names != "cab" {
+		t.Fatalf("bad: %v", sessions.Sessions)
+	}
+
+	getR.SortBy = "nope"
+	err := msgpackrpc.CallWithCodec(codec, "Session.List", &getR, &sessions)
+	if err == nil || !strings.Contains(err.Error(), "Invalid sort key") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestSessionEndpoint_ApplyTimers(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -235,7 +331,7 @@ func TestSessionEndpoint_ApplyTimers(t *testing.T) {
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	arg := structs.SessionRequest{
 		Datacenter: "dc1",
 		Op:         structs.SessionCreate,
@@ -278,7 +374,7 @@ func TestSessionEndpoint_Renew(t *testing.T) {
 	TTL := "10s" // the minimum allowed ttl
 	ttl := 10 * time.Second
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	ids := []string{}
 	for i := 0; i < 5; i++ {
 		arg := structs.SessionRequest{
@@ -436,8 +532,8 @@ func TestSessionEndpoint_NodeSessions(t *testing.T) {
 
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureNode(1, structs.Node{"bar", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "bar", Address: "127.0.0.1"})
 	ids := []string{}
 	for i := 0; i < 10; i++ {
 		arg := structs.SessionRequest{
@@ -537,3 +633,80 @@ func TestSessionEndpoint_Apply_BadTTL(t *testing.T) {
 		t.Fatalf("incorrect error message: %s", err.Error())
 	}
 }
+
+func TestSessionEndpoint_Expiring(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	ids := make(map[string]string)
+	for _, ttl := range []string{"30s", "10s", ""} {
+		arg := structs.SessionRequest{
+			Datacenter: "dc1",
+			Op:         structs.SessionCreate,
+			Session: structs.Session{
+				Node: "foo",
+				TTL:  ttl,
+			},
+		}
+		var out string
+		if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ids[ttl] = out
+	}
+
+	// The sessions are ordered by expiration, and those without a TTL
+	// never expire
+	args := structs.SessionExpiringRequest{Datacenter: "dc1", Window: time.Hour}
+	var sessions structs.IndexedSessions
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Expiring", &args, &sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sessions.Sessions) != 2 || sessions.Sessions[0].ID != ids["10s"] ||
+		sessions.Sessions[1].ID != ids["30s"] {
+		t.Fatalf("bad: %v", sessions.Sessions)
+	}
+	index := sessions.Index
+
+	// The timers are doubled by the TTL multiplier
+	args.Window = 30 * time.Second
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Expiring", &args, &sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].ID != ids["10s"] {
+		t.Fatalf("bad: %v", sessions.Sessions)
+	}
+
+	// Renewing only resets the timer of the leader, without a write
+	renew := structs.SessionSpecificRequest{Datacenter: "dc1", Session: ids["30s"]}
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Renew", &renew, &sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sessions.Index != index {
+		t.Fatalf("bad: %v", sessions.Index)
+	}
+
+	// Destroyed sessions no longer expire
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionDestroy,
+		Session:    structs.Session{ID: ids["10s"]},
+	}
+	var out string
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	args.Window = time.Hour
+	if err := msgpackrpc.CallWithCodec(codec, "Session.Expiring", &args, &sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].ID != ids["30s"] {
+		t.Fatalf("bad: %v", sessions.Sessions)
+	}
+}
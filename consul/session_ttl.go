@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/armon/go-metrics"
+	"github.com/armon/go-radix"
 	"github.com/hashicorp/consul/consul/structs"
 )
 
@@ -71,6 +72,8 @@ func (s *Server) resetSessionTimerLocked(id string, ttl time.Duration) {
 	// Ensure a timer map exists
 	if s.sessionTimers == nil {
 		s.sessionTimers = make(map[string]*time.Timer)
+		s.sessionExpires = make(map[string]time.Time)
+		s.sessionExpiresIndex = radix.New()
 	}
 
 	// Adjust the given TTL by the TTL multiplier. This is done
@@ -79,6 +82,7 @@ func (s *Server) resetSessionTimerLocked(id string, ttl time.Duration) {
 	// before the TTL, but there is no explicit promise about the upper
 	// bound so this is allowable.
 	ttl = ttl * structs.SessionTTLMultiplier
+	s.setSessionExpiresLocked(id, time.Now().Add(ttl))
 
 	// Renew the session timer if it exists
 	if timer, ok := s.sessionTimers[id]; ok {
@@ -100,6 +104,7 @@ func (s *Server) invalidateSession(id string) {
 	// Clear the session timer
 	s.sessionTimersLock.Lock()
 	delete(s.sessionTimers, id)
+	s.clearSessionExpiresLocked(id)
 	s.sessionTimersLock.Unlock()
 
 	// Create a session destroy request
@@ -128,6 +133,7 @@ func (s *Server) clearSessionTimer(id string) error {
 	if timer, ok := s.sessionTimers[id]; ok {
 		timer.Stop()
 		delete(s.sessionTimers, id)
+		s.clearSessionExpiresLocked(id)
 	}
 	return nil
 }
@@ -142,9 +148,57 @@ func (s *Server) clearAllSessionTimers() error {
 		t.Stop()
 	}
 	s.sessionTimers = nil
+	s.sessionExpires = nil
+	s.sessionExpiresIndex = nil
 	return nil
 }
 
+// setSessionExpiresLocked records the deadline of a session timer,
+// assuming the sessionTimersLock is already held
+func (s *Server) setSessionExpiresLocked(id string, expires time.Time) {
+	s.clearSessionExpiresLocked(id)
+	s.sessionExpires[id] = expires
+	s.sessionExpiresIndex.Insert(sessionExpiresKey(expires, id), id)
+}
+
+// clearSessionExpiresLocked forgets the deadline of a session timer,
+// assuming the sessionTimersLock is already held
+func (s *Server) clearSessionExpiresLocked(id string) {
+	if old, ok := s.sessionExpires[id]; ok {
+		s.sessionExpiresIndex.Delete(sessionExpiresKey(old, id))
+		delete(s.sessionExpires, id)
+	}
+}
+
+// sessionsExpiringBefore returns the IDs of the sessions whose timer
+// fires before the given time unless they are renewed, in order of
+// expiration. Only the leader runs the timers, so it returns nothing on
+// the other servers.
+func (s *Server) sessionsExpiringBefore(t time.Time) []string {
+	s.sessionTimersLock.Lock()
+	defer s.sessionTimersLock.Unlock()
+	if s.sessionExpiresIndex == nil {
+		return nil
+	}
+
+	bound := sessionExpiresKey(t, "")
+	var ids []string
+	s.sessionExpiresIndex.Walk(func(k string, v interface{}) bool {
+		if k >= bound {
+			return true
+		}
+		ids = append(ids, v.(string))
+		return false
+	})
+	return ids
+}
+
+// sessionExpiresKey is the key of a session in the expiration index,
+// which sorts by the expiration time
+func sessionExpiresKey(expires time.Time, id string) string {
+	return fmt.Sprintf("%016x%s", expires.UnixNano(), id)
+}
+
 // sessionStats is a long running routine used to capture
 // the number of active sessions being tracked
 func (s *Server) sessionStats() {
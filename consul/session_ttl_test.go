@@ -20,7 +20,7 @@ func TestInitializeSessionTimers(t *testing.T) {
 	testutil.WaitForLeader(t, s1.RPC, "dc1")
 
 	state := s1.fsm.State()
-	state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	session := &structs.Session{
 		ID:   generateUUID(),
 		Node: "foo",
@@ -58,7 +58,7 @@ func TestResetSessionTimer_Fault(t *testing.T) {
 
 	// Create a session
 	state := s1.fsm.State()
-	state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	session := &structs.Session{
 		ID:   generateUUID(),
 		Node: "foo",
@@ -90,7 +90,7 @@ func TestResetSessionTimer_NoTTL(t *testing.T) {
 
 	// Create a session
 	state := s1.fsm.State()
-	state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	session := &structs.Session{
 		ID:   generateUUID(),
 		Node: "foo",
@@ -152,6 +152,46 @@ func TestResetSessionTimerLocked(t *testing.T) {
 	}
 }
 
+func TestSessionsExpiringBefore(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	s1.sessionTimersLock.Lock()
+	s1.resetSessionTimerLocked("foo", time.Minute)
+	s1.resetSessionTimerLocked("bar", 10*time.Second)
+	s1.sessionTimersLock.Unlock()
+
+	ids := s1.sessionsExpiringBefore(time.Now().Add(time.Hour))
+	if len(ids) != 2 || ids[0] != "bar" || ids[1] != "foo" {
+		t.Fatalf("bad: %v", ids)
+	}
+
+	// Renewing moves a session later in the order
+	s1.sessionTimersLock.Lock()
+	s1.resetSessionTimerLocked("bar", 2*time.Minute)
+	s1.sessionTimersLock.Unlock()
+	ids = s1.sessionsExpiringBefore(time.Now().Add(time.Hour))
+	if len(ids) != 2 || ids[0] != "foo" || ids[1] != "bar" {
+		t.Fatalf("bad: %v", ids)
+	}
+	ids = s1.sessionsExpiringBefore(time.Now().Add(3 * time.Minute))
+	if len(ids) != 1 || ids[0] != "foo" {
+		t.Fatalf("bad: %v", ids)
+	}
+
+	s1.clearSessionTimer("foo")
+	ids = s1.sessionsExpiringBefore(time.Now().Add(time.Hour))
+	if len(ids) != 1 || ids[0] != "bar" {
+		t.Fatalf("bad: %v", ids)
+	}
+
+	s1.clearAllSessionTimers()
+	if ids := s1.sessionsExpiringBefore(time.Now().Add(time.Hour)); len(ids) != 0 {
+		t.Fatalf("bad: %v", ids)
+	}
+}
+
 func TestResetSessionTimerLocked_Renew(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -201,7 +241,7 @@ func TestInvalidateSession(t *testing.T) {
 
 	// Create a session
 	state := s1.fsm.State()
-	state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	session := &structs.Session{
 		ID:   generateUUID(),
 		Node: "foo",
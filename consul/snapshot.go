@@ -0,0 +1,311 @@
+package consul
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// SnapshotArchiveVersion is the format of the snapshot archives
+	// written by this version
+	SnapshotArchiveVersion = 1
+
+	// The files of a snapshot archive. The state is the snapshot the
+	// FSM persists for Raft, and the checksums cover the other files.
+	snapshotMetaFile  = "meta.json"
+	snapshotStateFile = "state.bin"
+	snapshotSumsFile  = "SHA256SUMS"
+)
+
+// bufferSink is a raft.SnapshotSink keeping the snapshot in memory
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (b *bufferSink) ID() string {
+	return "buffer"
+}
+
+func (b *bufferSink) Cancel() error {
+	return nil
+}
+
+func (b *bufferSink) Close() error {
+	return nil
+}
+
+// WriteSnapshotArchive writes a snapshot archive of the given state.
+// The archive is a tar file with the metadata, the state and the sha256
+// sums of both.
+func WriteSnapshotArchive(w io.Writer, meta *structs.SnapshotMeta, state []byte) error {
+	metaBuf, err := json.MarshalIndent(meta, "", "    ")
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{snapshotMetaFile, metaBuf},
+		{snapshotStateFile, state},
+	}
+
+	var sums bytes.Buffer
+	for _, file := range files {
+		sum := sha256.Sum256(file.data)
+		fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(sum[:]), file.name)
+	}
+	files = append(files, struct {
+		name string
+		data []byte
+	}{snapshotSumsFile, sums.Bytes()})
+
+	archive := tar.NewWriter(w)
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.name,
+			Mode:    0600,
+			Size:    int64(len(file.data)),
+			ModTime: meta.Created,
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := archive.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// ReadSnapshotArchive reads a snapshot archive, returning its metadata
+// and state once their checksums are verified
+func ReadSnapshotArchive(r io.Reader) (*structs.SnapshotMeta, []byte, error) {
+	files := make(map[string][]byte)
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read snapshot archive: %v", err)
+		}
+		switch header.Name {
+		case snapshotMetaFile, snapshotStateFile, snapshotSumsFile:
+		default:
+			return nil, nil, fmt.Errorf("Unexpected file %q in snapshot archive", header.Name)
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read snapshot archive: %v", err)
+		}
+		files[header.Name] = data
+	}
+	for _, name := range []string{snapshotMetaFile, snapshotStateFile, snapshotSumsFile} {
+		if _, ok := files[name]; !ok {
+			return nil, nil, fmt.Errorf("Snapshot archive is missing %s", name)
+		}
+	}
+
+	// Verify the checksums
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(files[snapshotSumsFile]))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("Invalid checksum line %q", scanner.Text())
+		}
+		sums[fields[1]] = fields[0]
+	}
+	for _, name := range []string{snapshotMetaFile, snapshotStateFile} {
+		sum := sha256.Sum256(files[name])
+		if sums[name] != hex.EncodeToString(sum[:]) {
+			return nil, nil, fmt.Errorf("Snapshot checksum mismatch for %s", name)
+		}
+	}
+
+	var meta structs.SnapshotMeta
+	if err := json.Unmarshal(files[snapshotMetaFile], &meta); err != nil {
+		return nil, nil, fmt.Errorf("Failed to decode snapshot metadata: %v", err)
+	}
+	if meta.Version < 1 || meta.Version > SnapshotArchiveVersion {
+		return nil, nil, fmt.Errorf("Unsupported snapshot archive version %d", meta.Version)
+	}
+	state := files[snapshotStateFile]
+	if int64(len(state)) != meta.Size {
+		return nil, nil, fmt.Errorf("Snapshot state is %d bytes, expected %d",
+			len(state), meta.Size)
+	}
+	return &meta, state, nil
+}
+
+// VerifySnapshotArchive checks the integrity of the state of a snapshot
+// archive, like the servers check their state store. The state is
+// restored to a temporary state store in dir, which is removed after.
+func VerifySnapshotArchive(r io.Reader, dir string) (*structs.StateVerifyReport, error) {
+	meta, state, err := ReadSnapshotArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := ioutil.TempDir(dir, "verify")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+	defer fsm.Close()
+	if err := fsm.Restore(ioutil.NopCloser(bytes.NewReader(state))); err != nil {
+		return nil, fmt.Errorf("Failed to restore snapshot: %v", err)
+	}
+
+	report, err := fsm.State().Verify()
+	if err != nil {
+		return nil, err
+	}
+	report.Server = meta.Server
+	return report, nil
+}
+
+// Snapshot endpoint is used to save and restore archives of the state,
+// to back up a datacenter
+type Snapshot struct {
+	srv *Server
+}
+
+// Save is used to take a point in time snapshot of the state. The leader
+// answers, unless a stale read is allowed. Since the snapshot contains
+// the ACL tokens, it requires a management token, even when redacted.
+func (s *Snapshot) Save(args *structs.SnapshotRequest, reply *structs.SnapshotResponse) error {
+	if done, err := s.srv.forward("Snapshot.Save", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "snapshot", "save"}, time.Now())
+
+	acl, err := s.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	// The snapshot is taken in a single read transaction, so it is
+	// consistent without blocking the writes
+	snap, err := s.srv.fsm.State().Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	records, err := snap.RecordCounts()
+	if err != nil {
+		return err
+	}
+	persist := &consulSnapshot{state: snap}
+	if args.Redact {
+		if persist.redactor, err = newSnapshotRedactor(args.RedactKVPrefixes); err != nil {
+			return err
+		}
+	}
+	sink := &bufferSink{}
+	if err := persist.Persist(sink); err != nil {
+		return err
+	}
+
+	meta := &structs.SnapshotMeta{
+		Version:    SnapshotArchiveVersion,
+		Index:      snap.LastIndex(),
+		Datacenter: s.srv.config.Datacenter,
+		Server:     s.srv.config.NodeName,
+		Created:    time.Now().UTC(),
+		Records:    records,
+		Size:       int64(sink.Len()),
+		Redacted:   args.Redact,
+	}
+	var archive bytes.Buffer
+	if err := WriteSnapshotArchive(&archive, meta, sink.Bytes()); err != nil {
+		return err
+	}
+	reply.Data = archive.Bytes()
+	reply.Index = meta.Index
+	s.srv.setQueryMeta(&reply.QueryMeta)
+	s.srv.logger.Printf("[INFO] consul: saved snapshot at index %d (%d bytes, redacted: %v)",
+		meta.Index, archive.Len(), meta.Redacted)
+	return nil
+}
+
+// Restore is used to replace the state of every server with the state of
+// a snapshot archive. It requires a management token.
+func (s *Snapshot) Restore(args *structs.SnapshotRestoreRequest, reply *struct{}) error {
+	if done, err := s.srv.forward("Snapshot.Restore", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "snapshot", "restore"}, time.Now())
+
+	acl, err := s.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ACLModify() {
+		return permissionDeniedErr
+	}
+
+	meta, state, err := ReadSnapshotArchive(bytes.NewReader(args.Data))
+	if err != nil {
+		return err
+	}
+	s.srv.logger.Printf("[WARN] consul: restoring snapshot of %s taken at index %d",
+		meta.Datacenter, meta.Index)
+
+	// The state is applied in chunks, so no Raft entry is larger than
+	// the chunk size. The servers restore it once the last one applies.
+	id := generateUUID()
+	chunkSize := s.srv.config.SnapshotRestoreChunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(state)
+	}
+	for seq, offset := 0, 0; ; seq++ {
+		end := offset + chunkSize
+		if end > len(state) {
+			end = len(state)
+		}
+		req := structs.SnapshotRestore{
+			ID:    id,
+			Seq:   seq,
+			More:  end < len(state),
+			Meta:  *meta,
+			State: state[offset:end],
+		}
+		resp, err := s.srv.raftApply(structs.SnapshotRestoreRequestType, &req)
+		if err != nil {
+			return err
+		}
+		if respErr, ok := resp.(error); ok {
+			return respErr
+		}
+		if !req.More {
+			break
+		}
+		offset = end
+	}
+
+	// The sessions of the snapshot need their timers
+	if err := s.srv.clearAllSessionTimers(); err != nil {
+		return err
+	}
+	return s.srv.initializeSessionTimers()
+}
@@ -0,0 +1,97 @@
+package consul
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// snapshotRedactedValue replaces the values masked in a redacted snapshot
+var snapshotRedactedValue = []byte("<redacted>")
+
+// snapshotRedactor masks the secrets of the records of a snapshot, so it
+// can be shared. The ACL tokens and session IDs are replaced with IDs
+// derived from them with a random key, so the records still refer to
+// each other, and the values of the keys under the prefixes are masked.
+type snapshotRedactor struct {
+	key      []byte
+	prefixes []string
+}
+
+// newSnapshotRedactor creates a redactor masking the values of the keys
+// under the given prefixes. The key deriving the IDs is discarded with
+// the redactor, so the original IDs can't be recovered.
+func newSnapshotRedactor(prefixes []string) (*snapshotRedactor, error) {
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %v", err)
+	}
+	return &snapshotRedactor{key: key, prefixes: prefixes}, nil
+}
+
+// id returns the ID replacing the given ACL token or session ID
+func (r *snapshotRedactor) id(id string) string {
+	if id == "" || id == anonymousToken {
+		return id
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(id))
+	buf := mac.Sum(nil)
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%12x",
+		buf[0:4],
+		buf[4:6],
+		buf[6:8],
+		buf[8:10],
+		buf[10:16])
+}
+
+// entry returns a copy of a KV entry with its session replaced, and its
+// value masked if it is under one of the prefixes
+func (r *snapshotRedactor) entry(d structs.DirEntry) structs.DirEntry {
+	d.Session = r.id(d.Session)
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(d.Key, prefix) && d.Value != nil {
+			d.Value = snapshotRedactedValue
+			break
+		}
+	}
+	return d
+}
+
+// redact returns the record to persist in place of raw. The records are
+// copied, as they may be shared with the readers of the state store.
+func (r *snapshotRedactor) redact(raw interface{}) interface{} {
+	if r == nil {
+		return raw
+	}
+	switch v := raw.(type) {
+	case *structs.DirEntry:
+		d := r.entry(*v)
+		return &d
+	case *structs.Session:
+		session := *v
+		session.ID = r.id(session.ID)
+		return &session
+	case *structs.ACL:
+		acl := *v
+		acl.ID = r.id(acl.ID)
+		return &acl
+	case *structs.LockDelay:
+		delay := *v
+		delay.Session = r.id(delay.Session)
+		return &delay
+	case *structs.ExternalClaim:
+		claim := *v
+		claim.Session = r.id(claim.Session)
+		return &claim
+	case *structs.OutboxEntry:
+		entry := *v
+		entry.Entry = r.entry(entry.Entry)
+		return &entry
+	}
+	return raw
+}
@@ -0,0 +1,104 @@
+package consul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestSnapshotRedactor(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	fsm.state.SessionCreate(2, session)
+	acl := &structs.ACL{ID: generateUUID(), Name: "User Token"}
+	fsm.state.ACLSet(3, acl)
+	fsm.state.ACLSet(4, &structs.ACL{ID: anonymousToken, Name: "Anonymous Token"})
+	fsm.state.KVSSet(5, &structs.DirEntry{Key: "app/config", Value: []byte("public")})
+	fsm.state.KVSSet(6, &structs.DirEntry{Key: "secret/db", Value: []byte("hunter2")})
+	fsm.state.KVSLock(7, &structs.DirEntry{Key: "secret/lock", Value: []byte("hunter2"), Session: session.ID})
+
+	snap, err := fsm.state.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Close()
+	redactor, err := newSnapshotRedactor([]string{"secret/"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink := &bufferSink{}
+	if err := (&consulSnapshot{state: snap, redactor: redactor}).Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bytes.Contains(sink.Bytes(), []byte("hunter2")) ||
+		bytes.Contains(sink.Bytes(), []byte(session.ID)) ||
+		bytes.Contains(sink.Bytes(), []byte(acl.ID)) {
+		t.Fatalf("secrets in the redacted snapshot")
+	}
+
+	// The redacted snapshot restores consistently
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(ioutil.NopCloser(sink)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, sessions, err := fsm2.state.SessionList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != redactor.id(session.ID) {
+		t.Fatalf("bad: %v", sessions)
+	}
+	_, d, err := fsm2.state.KVSGet("secret/lock")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.Session != sessions[0].ID || string(d.Value) != "<redacted>" {
+		t.Fatalf("bad: %v", d)
+	}
+	_, d, err = fsm2.state.KVSGet("app/config")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "public" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	_, acls, err := fsm2.state.ACLList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ids := make(map[string]bool)
+	for _, acl := range acls {
+		ids[acl.ID] = true
+	}
+	if len(ids) != 2 || !ids[anonymousToken] || !ids[redactor.id(acl.ID)] {
+		t.Fatalf("bad: %v", ids)
+	}
+
+	report, err := fsm2.state.Verify()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("bad: %v", report)
+	}
+}
@@ -0,0 +1,206 @@
+package consul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestSnapshotArchive(t *testing.T) {
+	meta := &structs.SnapshotMeta{
+		Version:    SnapshotArchiveVersion,
+		Index:      42,
+		Datacenter: "dc1",
+		Created:    time.Now().UTC(),
+		Records:    map[string]uint64{"kvs": 2},
+		Size:       5,
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshotArchive(&buf, meta, []byte("state")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	archive := buf.Bytes()
+
+	out, state, err := ReadSnapshotArchive(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(state) != "state" {
+		t.Fatalf("bad: %q", state)
+	}
+	if out.Index != 42 || out.Datacenter != "dc1" || out.Records["kvs"] != 2 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// A corrupted state is detected
+	corrupt := bytes.Replace(archive, []byte("state"), []byte("stale"), 1)
+	_, _, err = ReadSnapshotArchive(bytes.NewReader(corrupt))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch for state.bin") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So is a truncated archive
+	_, _, err = ReadSnapshotArchive(bytes.NewReader(archive[:1024]))
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestSnapshot_SaveRestore(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+
+		// Apply the restore in several chunks
+		c.SnapshotRestoreChunkSize = 256
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	set := func(value string) {
+		arg := structs.KVSRequest{
+			Datacenter:   "dc1",
+			Op:           structs.KVSSet,
+			DirEnt:       structs.DirEntry{Key: "test", Value: []byte(value)},
+			WriteRequest: structs.WriteRequest{Token: "root"},
+		}
+		var out bool
+		if err := msgpackrpc.CallWithCodec(codec, "KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	set("before")
+
+	// A management token is required
+	args := structs.SnapshotRequest{Datacenter: "dc1"}
+	var snap structs.SnapshotResponse
+	err := msgpackrpc.CallWithCodec(codec, "Snapshot.Save", &args, &snap)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	args.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Snapshot.Save", &args, &snap); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta, _, err := ReadSnapshotArchive(bytes.NewReader(snap.Data))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.Index != snap.Index || meta.Datacenter != "dc1" || meta.Records[dbKVS] != 1 {
+		t.Fatalf("bad: %v", meta)
+	}
+
+	// A redacted snapshot masks the values under the prefixes
+	redacted := args
+	redacted.Redact = true
+	redacted.RedactKVPrefixes = []string{"te"}
+	var redactedSnap structs.SnapshotResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Snapshot.Save", &redacted, &redactedSnap); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	redactedMeta, state, err := ReadSnapshotArchive(bytes.NewReader(redactedSnap.Data))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !redactedMeta.Redacted || meta.Redacted || bytes.Contains(state, []byte("before")) {
+		t.Fatalf("bad: %v", redactedMeta)
+	}
+
+	set("after")
+	idx, _, err := s1.fsm.State().KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Restoring brings back the saved state, at a later index
+	restore := structs.SnapshotRestoreRequest{Datacenter: "dc1", Data: snap.Data}
+	var out struct{}
+	err = msgpackrpc.CallWithCodec(codec, "Snapshot.Restore", &restore, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	restore.Token = "root"
+	if err := msgpackrpc.CallWithCodec(codec, "Snapshot.Restore", &restore, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	restoredIdx, d, err := s1.fsm.State().KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if restoredIdx <= idx || d == nil || string(d.Value) != "before" {
+		t.Fatalf("bad: %d %d %v", idx, restoredIdx, d)
+	}
+	if len(snap.Data) <= 256 {
+		t.Fatalf("should restore in chunks: %d", len(snap.Data))
+	}
+
+	// A corrupted archive isn't applied
+	restore.Data = bytes.Replace(snap.Data, []byte("before"), []byte("broken"), 1)
+	err = msgpackrpc.CallWithCodec(codec, "Snapshot.Restore", &restore, &out)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestVerifySnapshotArchive(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Lock a key with an unknown session behind the back of the store
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	orphan := &structs.DirEntry{Key: "orphan", CreateIndex: 1, ModifyIndex: 1, Session: "nope"}
+	if err := fsm.state.kvsTable.Insert(orphan); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	sink := &bufferSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta := &structs.SnapshotMeta{
+		Version: SnapshotArchiveVersion,
+		Server:  "foo",
+		Size:    int64(sink.Len()),
+	}
+	var archive bytes.Buffer
+	if err := WriteSnapshotArchive(&archive, meta, sink.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	report, err := VerifySnapshotArchive(&archive, path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Server != "foo" || report.Rows[dbNodes] != 1 || report.Rows[dbKVS] != 1 {
+		t.Fatalf("bad: %#v", report)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Key != "orphan" {
+		t.Fatalf("bad: %v", report.Problems)
+	}
+}
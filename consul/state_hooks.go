@@ -0,0 +1,119 @@
+package consul
+
+import (
+	"fmt"
+	"sync"
+)
+
+// StateHook is invoked after a commit that changed a table, with the
+// rows that were updated or deleted. Hooks run synchronously in commit
+// order, but outside of the write transaction. They must not modify the
+// state store, and should return quickly since they delay applies.
+type StateHook func(changes *MDBChanges)
+
+// namedHook is a hook along with the name it was registered with
+type namedHook struct {
+	name string
+	hook StateHook
+}
+
+// stateHooks are the hooks registered for each table, by table name. It
+// is shared by the state stores of an FSM so that hooks survive a
+// restore. A restore replaces the state without invoking the hooks.
+// The slices are copied on write, so they can be run without the lock.
+type stateHooks struct {
+	l     sync.RWMutex
+	hooks map[string][]*namedHook
+}
+
+// newStateHooks creates an empty set of hooks
+func newStateHooks() *stateHooks {
+	return &stateHooks{
+		hooks: make(map[string][]*namedHook),
+	}
+}
+
+// RegisterHook is used to register a hook for the changes to a table.
+// Registering a hook with the name of an existing hook replaces it, and
+// moves it to the end of the order the hooks are run in.
+func (s *StateStore) RegisterHook(table, name string, hook StateHook) error {
+	t := s.tableByName(table)
+	if t == nil {
+		return fmt.Errorf("Unknown table '%s'", table)
+	}
+
+	h := s.hooks
+	h.l.Lock()
+	defer h.l.Unlock()
+	var hooks []*namedHook
+	for _, existing := range h.hooks[table] {
+		if existing.name != name {
+			hooks = append(hooks, existing)
+		}
+	}
+	h.hooks[table] = append(hooks, &namedHook{name: name, hook: hook})
+	t.Track(true)
+	return nil
+}
+
+// DeregisterHook is used to remove a hook from a table
+func (s *StateStore) DeregisterHook(table, name string) {
+	h := s.hooks
+	h.l.Lock()
+	defer h.l.Unlock()
+	var hooks []*namedHook
+	for _, existing := range h.hooks[table] {
+		if existing.name != name {
+			hooks = append(hooks, existing)
+		}
+	}
+	if len(hooks) > 0 {
+		h.hooks[table] = hooks
+		return
+	}
+	delete(h.hooks, table)
+	if t := s.tableByName(table); t != nil {
+		t.Track(false)
+	}
+}
+
+// runHooks invokes the hooks of a changed table. A panic in a hook is
+// logged, and does not fail the write.
+func (s *StateStore) runHooks(changes *MDBChanges) {
+	h := s.hooks
+	h.l.RLock()
+	hooks := h.hooks[changes.Table]
+	h.l.RUnlock()
+
+	for _, named := range hooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					s.logger.Error("Hook panicked", "hook", named.name, "table", changes.Table, "panic", r)
+				}
+			}()
+			named.hook(changes)
+		}()
+	}
+}
+
+// setStateHooks replaces the hooks, this is used to share the hooks
+// across state stores
+func (s *StateStore) setStateHooks(h *stateHooks) {
+	h.l.RLock()
+	defer h.l.RUnlock()
+	s.hooks = h
+	for _, table := range s.tables {
+		table.Track(len(h.hooks[table.Name]) > 0)
+	}
+}
+
+// tableByName returns the table with the given name, or nil
+func (s *StateStore) tableByName(name string) *MDBTable {
+	for _, table := range s.tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_Hooks(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.RegisterHook("nope", "audit", nil); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	var changes []*MDBChanges
+	hook := func(c *MDBChanges) {
+		changes = append(changes, c)
+	}
+	if err := store.RegisterHook(dbKVS, "audit", hook); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A panicking hook does not fail the write
+	if err := store.RegisterHook(dbKVS, "broken", func(*MDBChanges) { panic("broken") }); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Untracked tables are not reported
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Set then replace a key
+	if err := store.KVSSet(2, &structs.DirEntry{Key: "/foo", Value: []byte("v1")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSSet(3, &structs.DirEntry{Key: "/foo", Value: []byte("v2")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("bad: %v", changes)
+	}
+	c := changes[1]
+	if c.Table != dbKVS || c.Index != 3 || len(c.Updated) != 1 || len(c.Deleted) != 0 {
+		t.Fatalf("bad: %#v", c)
+	}
+	if d := c.Updated[0].(*structs.DirEntry); string(d.Value) != "v2" || d.CreateIndex != 2 {
+		t.Fatalf("bad: %#v", d)
+	}
+
+	// Delete the key
+	if err := store.KVSDelete(4, "/foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("bad: %v", changes)
+	}
+	c = changes[2]
+	if c.Index != 4 || len(c.Updated) != 0 || len(c.Deleted) != 1 {
+		t.Fatalf("bad: %#v", c)
+	}
+	if d := c.Deleted[0].(*structs.DirEntry); d.Key != "/foo" {
+		t.Fatalf("bad: %#v", d)
+	}
+
+	// Deregistered hooks are not invoked
+	store.DeregisterHook(dbKVS, "audit")
+	store.DeregisterHook(dbKVS, "broken")
+	if store.kvsTable.Tracking() {
+		t.Fatalf("should not track")
+	}
+	if err := store.KVSSet(5, &structs.DirEntry{Key: "/foo", Value: []byte("v3")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("bad: %v", changes)
+	}
+}
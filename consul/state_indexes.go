@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// StateIndex is an additional index on a table of the state store. It is
+// used by embedders to query the state by values Consul itself doesn't
+// index, such as a service metadata key, without forking the schema.
+// The indexes are registered when the state store is created, and can be
+// queried by name with Query and the ...ByIndex helpers. They can't be
+// unique, since that would reject writes Consul expects to succeed.
+type StateIndex struct {
+	Table string // Name of the table, e.g. "services"
+	Name  string // Name of the index, which must not already exist
+
+	// Index is the definition of the index. It is copied for each state
+	// store, so the same definition can be shared by several stores.
+	Index *MDBIndex
+}
+
+// addIndexes adds additional indexes to the tables, before they are
+// initialized
+func (s *StateStore) addIndexes(indexes []*StateIndex) error {
+	for _, si := range indexes {
+		if si.Index == nil {
+			return fmt.Errorf("Missing definition of index '%s'", si.Name)
+		}
+		table := s.tableByName(si.Table)
+		if table == nil {
+			return fmt.Errorf("Unknown table '%s' for index '%s'", si.Table, si.Name)
+		}
+		if _, ok := table.Indexes[si.Name]; ok {
+			return fmt.Errorf("Index '%s' already exists on table '%s'", si.Name, si.Table)
+		}
+		if si.Index.Unique {
+			return fmt.Errorf("Index '%s' can't be unique", si.Name)
+		}
+
+		// Only copy the definition, the rest is set by the table
+		table.Indexes[si.Name] = &MDBIndex{
+			AllowBlank:      si.Index.AllowBlank,
+			Fields:          si.Index.Fields,
+			IdxFunc:         si.Index.IdxFunc,
+			FieldFunc:       si.Index.FieldFunc,
+			Virtual:         si.Index.Virtual,
+			RealIndex:       si.Index.RealIndex,
+			CaseInsensitive: si.Index.CaseInsensitive,
+		}
+	}
+	return nil
+}
+
+// MapFieldFunc returns a FieldFunc that indexes the value of a key in a
+// map[string]string field, e.g. MapFieldFunc("ServiceMeta", "env"). A
+// missing key is indexed as blank.
+func MapFieldFunc(field, key string) FieldFunc {
+	return func(obj interface{}) ([]string, error) {
+		v := reflect.Indirect(reflect.ValueOf(obj))
+		fv := v.FieldByName(field)
+		if !fv.IsValid() || fv.Kind() != reflect.Map {
+			return nil, fmt.Errorf("Field '%s' for %#v is not a map", field, obj)
+		}
+		m, ok := fv.Interface().(map[string]string)
+		if !ok {
+			return nil, fmt.Errorf("Field '%s' for %#v is not a map[string]string", field, obj)
+		}
+		return []string{m[key]}, nil
+	}
+}
+
+// Query returns the rows of a table matching an index lookup, along with
+// the last index of the table. Any index of the table can be used,
+// including the ones registered by an embedder.
+func (s *StateStore) Query(table, index string, parts ...string) (uint64, []interface{}, error) {
+	defer s.measureQuery("Query", time.Now(), "table", table, "index", index)
+	t := s.tableByName(table)
+	if t == nil {
+		return 0, nil, fmt.Errorf("Unknown table '%s'", table)
+	}
+	return t.Get(index, parts...)
+}
+
+// NodesByIndex returns the nodes matching a lookup of an index of the
+// nodes table
+func (s *StateStore) NodesByIndex(index string, parts ...string) (uint64, structs.Nodes, error) {
+	defer s.measureQuery("NodesByIndex", time.Now(), "index", index)
+	idx, res, err := s.nodeTable.Get(index, parts...)
+	if err != nil {
+		return 0, nil, err
+	}
+	results := make(structs.Nodes, len(res))
+	for i, r := range res {
+		results[i] = *r.(*structs.Node)
+	}
+	return idx, results, nil
+}
+
+// ServiceNodesByIndex returns the service nodes matching a lookup of an
+// index of the services table, joined with the address of their node
+// like ServiceNodes
+func (s *StateStore) ServiceNodesByIndex(index string, parts ...string) (uint64, structs.ServiceNodes, error) {
+	defer s.measureQuery("ServiceNodesByIndex", time.Now(), "index", index)
+	tables := s.queryTables["ServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, index, parts...)
+	if err != nil {
+		return 0, nil, err
+	}
+	return idx, s.parseServiceNodes(tx, s.nodeTable, res, nil), nil
+}
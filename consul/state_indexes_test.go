@@ -0,0 +1,176 @@
+package consul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// testMetaIndex indexes the services by the "env" metadata key
+func testMetaIndex() *StateIndex {
+	return &StateIndex{
+		Table: dbServices,
+		Name:  "meta_env",
+		Index: &MDBIndex{
+			AllowBlank: true,
+			Fields:     []string{"ServiceMeta.env"},
+			FieldFunc:  MapFieldFunc("ServiceMeta", "env"),
+		},
+	}
+}
+
+func TestStateStore_Indexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	index := testMetaIndex()
+	store, err := NewStateStoreIndexes(nil, dir, os.Stderr, []*StateIndex{index})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Port: 8000,
+		Meta: map[string]string{"env": "prod"}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(3, "foo", &structs.NodeService{ID: "db2", Service: "db", Port: 8001,
+		Meta: map[string]string{"env": "staging"}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(4, "foo", &structs.NodeService{ID: "web", Service: "web", Port: 80}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, nodes, err := store.ServiceNodesByIndex("meta_env", "prod")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 4 || len(nodes) != 1 {
+		t.Fatalf("bad: %v %v", idx, nodes)
+	}
+	if nodes[0].ServiceID != "db" || nodes[0].Address != "127.0.0.1" {
+		t.Fatalf("bad: %v", nodes[0])
+	}
+
+	// Services without the key are indexed as blank
+	_, res, err := store.Query(dbServices, "meta_env", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 1 || res[0].(*structs.ServiceNode).ServiceID != "web" {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// Updates move the service in the index
+	if err := store.EnsureService(5, "foo", &structs.NodeService{ID: "db2", Service: "db", Port: 8001,
+		Meta: map[string]string{"env": "prod"}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes, err = store.ServiceNodesByIndex("meta_env", "prod")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Deletes remove the service from the index
+	if err := store.DeleteNode(6, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes, err = store.ServiceNodesByIndex("meta_env", "prod")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// The definition is not modified, so it can be reused
+	if index.Index.dbiName != "" {
+		t.Fatalf("bad: %#v", index.Index)
+	}
+
+	// Unknown indexes and tables are errors
+	if _, _, err := store.NodesByIndex("meta_env", "prod"); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, _, err := store.Query("nope", "id"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestStateStore_Indexes_Invalid(t *testing.T) {
+	cases := []*StateIndex{
+		&StateIndex{Table: "nope", Name: "foo", Index: &MDBIndex{Fields: []string{"Node"}}},
+		&StateIndex{Table: dbNodes, Name: "id", Index: &MDBIndex{Fields: []string{"Node"}}},
+		&StateIndex{Table: dbNodes, Name: "foo", Index: &MDBIndex{Unique: true, Fields: []string{"Node"}}},
+		&StateIndex{Table: dbNodes, Name: "foo"},
+	}
+	for _, index := range cases {
+		dir, err := ioutil.TempDir("", "consul")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		store, err := NewStateStoreIndexes(nil, dir, os.Stderr, []*StateIndex{index})
+		if err == nil {
+			store.Close()
+			t.Fatalf("should fail: %#v", index)
+		}
+	}
+}
+
+func TestFSM_Indexes_Restore(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	indexes := []*StateIndex{testMetaIndex()}
+	fsm, err := newFSMIndexes(nil, path, os.Stderr, indexes)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Port: 8000,
+		Meta: map[string]string{"env": "prod"}})
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fsm2, err := newFSMIndexes(nil, path, os.Stderr, indexes)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The restored state keeps the index
+	_, nodes, err := fsm2.state.ServiceNodesByIndex("meta_env", "prod")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].ServiceID != "db" {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
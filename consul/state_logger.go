@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// StateLogger is a leveled logger with structured fields, which the state
+// store and the FSM log their events to. The fields alternate between
+// names and values, e.g. Info("Reaped tombstones", "count", 3). Embedders
+// can provide their own implementation to route the events into their
+// logging stack.
+type StateLogger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// stdStateLogger is a StateLogger that writes the events to a standard
+// logger, in the same format as the rest of Consul's logs, e.g.
+// "[INFO] consul.state: Reaped tombstones count=3"
+type stdStateLogger struct {
+	logger    *log.Logger
+	component string
+}
+
+// NewStdStateLogger returns a StateLogger that writes to a writer in the
+// format of Consul's logs, tagging each event with the component, such
+// as "consul.state"
+func NewStdStateLogger(w io.Writer, component string) StateLogger {
+	return &stdStateLogger{
+		logger:    log.New(w, "", log.LstdFlags),
+		component: component,
+	}
+}
+
+func (l *stdStateLogger) Debug(msg string, fields ...interface{}) {
+	l.log("DEBUG", msg, fields)
+}
+
+func (l *stdStateLogger) Info(msg string, fields ...interface{}) {
+	l.log("INFO", msg, fields)
+}
+
+func (l *stdStateLogger) Warn(msg string, fields ...interface{}) {
+	l.log("WARN", msg, fields)
+}
+
+func (l *stdStateLogger) Error(msg string, fields ...interface{}) {
+	l.log("ERR", msg, fields)
+}
+
+// log formats an event, quoting the values that contain spaces
+func (l *stdStateLogger) log(level, msg string, fields []interface{}) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%s] %s: %s", level, l.component, msg)
+	for i := 0; i < len(fields); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		str := fmt.Sprintf("%v", value)
+		if str == "" || strings.ContainsAny(str, " \t\n\"=") {
+			str = fmt.Sprintf("%q", str)
+		}
+		fmt.Fprintf(&buf, " %v=%s", fields[i], str)
+	}
+	l.logger.Print(buf.String())
+}
@@ -0,0 +1,140 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// recordingLogger is a StateLogger that records the events
+type recordingLogger struct {
+	sync.Mutex
+	events []string
+}
+
+func (r *recordingLogger) record(level, msg string, fields []interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, fmt.Sprintf("%s %s %v", level, msg, fields))
+}
+
+func (r *recordingLogger) Debug(msg string, fields ...interface{}) { r.record("debug", msg, fields) }
+func (r *recordingLogger) Info(msg string, fields ...interface{})  { r.record("info", msg, fields) }
+func (r *recordingLogger) Warn(msg string, fields ...interface{})  { r.record("warn", msg, fields) }
+func (r *recordingLogger) Error(msg string, fields ...interface{}) { r.record("error", msg, fields) }
+
+// find returns the first event containing a string
+func (r *recordingLogger) find(s string) string {
+	r.Lock()
+	defer r.Unlock()
+	for _, event := range r.events {
+		if strings.Contains(event, s) {
+			return event
+		}
+	}
+	return ""
+}
+
+func TestStdStateLogger(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	logger := NewStdStateLogger(buf, "consul.state")
+
+	logger.Warn("Slow query", "method", "KVSGet", "params", "foo bar", "empty", "", "odd")
+	out := buf.String()
+	expect := `[WARN] consul.state: Slow query method=KVSGet params="foo bar" empty="" odd=(missing)`
+	if !strings.Contains(out, expect) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	buf.Reset()
+	logger.Error("Failed", "err", fmt.Errorf("boom"))
+	if !strings.Contains(buf.String(), "[ERR] consul.state: Failed err=boom") {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
+
+func TestStateStore_SetLogger(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	logger := &recordingLogger{}
+	store.SetLogger(logger)
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.SessionDestroy(3, session.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	event := logger.find("Invalidating session")
+	if !strings.Contains(event, session.ID) || !strings.Contains(event, "destroy") {
+		t.Fatalf("bad: %v", logger.events)
+	}
+}
+
+func TestFSM_SetLogger_Restore(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	fsm.state.SessionCreate(2, session)
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	logger := &recordingLogger{}
+	fsm2.SetLogger(logger)
+	if err := fsm2.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The milestones of the restore are logged
+	for _, msg := range []string{"Restoring snapshot", "Verified snapshot table", "Restored snapshot"} {
+		if logger.find(msg) == "" {
+			t.Fatalf("missing %s: %v", msg, logger.events)
+		}
+	}
+
+	// The restored state keeps the logger
+	if err := fsm2.state.SessionDestroy(3, session.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if logger.find("Invalidating session") == "" {
+		t.Fatalf("bad: %v", logger.events)
+	}
+}
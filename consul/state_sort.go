@@ -0,0 +1,170 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// The list queries of the state store return their results in a stable
+// order, so callers don't have to sort them again:
+//
+//   - nodes by name
+//   - services, service nodes and check service nodes by node name, then
+//     service ID
+//   - checks by node name, then check ID
+//   - the checks of a check service node or node dump by check ID, the
+//     checks of the service before the checks of the node
+//   - KV entries and keys by key
+//   - sessions and ACLs by ID
+//   - server health by server name
+//   - catalog audit records oldest first
+//
+// Node names are compared case-insensitively, like the node index. The
+// session, ACL and KV list endpoints can order their results by another
+// key with the SortBy query option.
+
+// lessNode compares node names case-insensitively, falling back to an
+// exact comparison so the order is total
+func lessNode(a, b string) bool {
+	la, lb := strings.ToLower(a), strings.ToLower(b)
+	if la != lb {
+		return la < lb
+	}
+	return a < b
+}
+
+type serviceNodesByNode structs.ServiceNodes
+
+func (s serviceNodesByNode) Len() int      { return len(s) }
+func (s serviceNodesByNode) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s serviceNodesByNode) Less(i, j int) bool {
+	if s[i].Node != s[j].Node {
+		return lessNode(s[i].Node, s[j].Node)
+	}
+	return s[i].ServiceID < s[j].ServiceID
+}
+
+type checkServiceNodesByNode structs.CheckServiceNodes
+
+func (c checkServiceNodesByNode) Len() int      { return len(c) }
+func (c checkServiceNodesByNode) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c checkServiceNodesByNode) Less(i, j int) bool {
+	if c[i].Node.Node != c[j].Node.Node {
+		return lessNode(c[i].Node.Node, c[j].Node.Node)
+	}
+	return c[i].Service.ID < c[j].Service.ID
+}
+
+type healthChecksByNode structs.HealthChecks
+
+func (h healthChecksByNode) Len() int      { return len(h) }
+func (h healthChecksByNode) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h healthChecksByNode) Less(i, j int) bool {
+	if h[i].Node != h[j].Node {
+		return lessNode(h[i].Node, h[j].Node)
+	}
+	return h[i].CheckID < h[j].CheckID
+}
+
+type healthChecksByID structs.HealthChecks
+
+func (h healthChecksByID) Len() int           { return len(h) }
+func (h healthChecksByID) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h healthChecksByID) Less(i, j int) bool { return h[i].CheckID < h[j].CheckID }
+
+type sessionsByID []*structs.Session
+
+func (s sessionsByID) Len() int           { return len(s) }
+func (s sessionsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sessionsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+type sessionsByName []*structs.Session
+
+func (s sessionsByName) Len() int      { return len(s) }
+func (s sessionsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sessionsByName) Less(i, j int) bool {
+	if s[i].Name != s[j].Name {
+		return s[i].Name < s[j].Name
+	}
+	return s[i].ID < s[j].ID
+}
+
+type sessionsByCreateIndex []*structs.Session
+
+func (s sessionsByCreateIndex) Len() int           { return len(s) }
+func (s sessionsByCreateIndex) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sessionsByCreateIndex) Less(i, j int) bool { return s[i].CreateIndex < s[j].CreateIndex }
+
+type aclsByName []*structs.ACL
+
+func (a aclsByName) Len() int      { return len(a) }
+func (a aclsByName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a aclsByName) Less(i, j int) bool {
+	if a[i].Name != a[j].Name {
+		return a[i].Name < a[j].Name
+	}
+	return a[i].ID < a[j].ID
+}
+
+type aclsByCreateIndex []*structs.ACL
+
+func (a aclsByCreateIndex) Len() int           { return len(a) }
+func (a aclsByCreateIndex) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a aclsByCreateIndex) Less(i, j int) bool { return a[i].CreateIndex < a[j].CreateIndex }
+
+type dirEntriesByCreateIndex structs.DirEntries
+
+func (d dirEntriesByCreateIndex) Len() int           { return len(d) }
+func (d dirEntriesByCreateIndex) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d dirEntriesByCreateIndex) Less(i, j int) bool { return d[i].CreateIndex < d[j].CreateIndex }
+
+// errInvalidSortBy is returned for an unknown sort key
+func errInvalidSortBy(by string) error {
+	return fmt.Errorf("Invalid sort key '%s'", by)
+}
+
+// sortSessions orders sessions, which are sorted by ID by default. Ties
+// keep their default order.
+func sortSessions(sessions []*structs.Session, by string) error {
+	switch by {
+	case structs.SortByDefault:
+	case structs.SortByName:
+		sort.Stable(sessionsByName(sessions))
+	case structs.SortByCreateIndex:
+		sort.Stable(sessionsByCreateIndex(sessions))
+	default:
+		return errInvalidSortBy(by)
+	}
+	return nil
+}
+
+// sortACLs orders ACLs, which are sorted by ID by default. Ties keep
+// their default order.
+func sortACLs(acls []*structs.ACL, by string) error {
+	switch by {
+	case structs.SortByDefault:
+	case structs.SortByName:
+		sort.Stable(aclsByName(acls))
+	case structs.SortByCreateIndex:
+		sort.Stable(aclsByCreateIndex(acls))
+	default:
+		return errInvalidSortBy(by)
+	}
+	return nil
+}
+
+// sortDirEntries orders KV entries, which are sorted by key by default.
+// The key is the name of an entry. Ties keep their default order.
+func sortDirEntries(ents structs.DirEntries, by string) error {
+	switch by {
+	case structs.SortByDefault, structs.SortByName:
+	case structs.SortByCreateIndex:
+		sort.Stable(dirEntriesByCreateIndex(ents))
+	default:
+		return errInvalidSortBy(by)
+	}
+	return nil
+}
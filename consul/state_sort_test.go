@@ -0,0 +1,195 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_ListOrder(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Register everything in reverse order, so the order of the results
+	// can't come from the order of the rows
+	idx := uint64(1)
+	for _, node := range []string{"zip", "Foo", "bar"} {
+		if err := store.EnsureNode(idx, structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		idx++
+		for _, id := range []string{"db2", "db1"} {
+			srv := &structs.NodeService{ID: id, Service: "db", Port: 8000}
+			if err := store.EnsureService(idx, node, srv); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			idx++
+		}
+		for _, check := range []string{"mem", "db2", "db1", "cpu"} {
+			chk := &structs.HealthCheck{Node: node, CheckID: check, Name: check, Status: structs.HealthPassing}
+			if check == "db1" || check == "db2" {
+				chk.ServiceID = check
+			}
+			if err := store.EnsureCheck(idx, chk); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			idx++
+		}
+	}
+
+	_, nodes := store.Nodes()
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Node)
+	}
+	if !reflect.DeepEqual(names, []string{"bar", "Foo", "zip"}) {
+		t.Fatalf("bad: %v", names)
+	}
+
+	expected := []string{"bar/db1", "bar/db2", "Foo/db1", "Foo/db2", "zip/db1", "zip/db2"}
+	_, srvs := store.ServiceNodes("db")
+	var got []string
+	for _, srv := range srvs {
+		got = append(got, srv.Node+"/"+srv.ServiceID)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	_, csns := store.CheckServiceNodes("db")
+	got = nil
+	for _, csn := range csns {
+		got = append(got, csn.Node.Node+"/"+csn.Service.ID)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// The checks of the service come first, then those of the node
+	got = nil
+	for _, check := range csns[0].Checks {
+		got = append(got, check.CheckID)
+	}
+	if !reflect.DeepEqual(got, []string{"db1", "cpu", "mem"}) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	_, checks := store.ChecksInState(structs.HealthPassing)
+	if len(checks) != 12 {
+		t.Fatalf("bad: %v", checks)
+	}
+	got = nil
+	for _, check := range checks[:4] {
+		got = append(got, check.Node+"/"+check.CheckID)
+	}
+	if !reflect.DeepEqual(got, []string{"bar/cpu", "bar/db1", "bar/db2", "bar/mem"}) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	_, dump := store.NodeDump()
+	got = nil
+	for _, check := range dump[0].Checks {
+		got = append(got, check.CheckID)
+	}
+	if !reflect.DeepEqual(got, []string{"cpu", "db1", "db2", "mem"}) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// Sessions of a node are ordered by ID
+	var ids []string
+	for i := 0; i < 5; i++ {
+		session := &structs.Session{ID: generateUUID(), Node: "bar"}
+		if err := store.SessionCreate(idx, session); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ids = append(ids, session.ID)
+		idx++
+	}
+	_, sessions, err := store.NodeSessions("bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 1; i < len(sessions); i++ {
+		if sessions[i-1].ID >= sessions[i].ID {
+			t.Fatalf("bad: %v", sessions)
+		}
+	}
+}
+
+func TestSortSessions(t *testing.T) {
+	sessions := []*structs.Session{
+		&structs.Session{ID: "a", Name: "web", CreateIndex: 3},
+		&structs.Session{ID: "b", Name: "db", CreateIndex: 2},
+		&structs.Session{ID: "c", Name: "web", CreateIndex: 1},
+	}
+	ids := func() string {
+		var out string
+		for _, s := range sessions {
+			out += s.ID
+		}
+		return out
+	}
+
+	if err := sortSessions(sessions, structs.SortByName); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ids() != "bac" {
+		t.Fatalf("bad: %s", ids())
+	}
+	if err := sortSessions(sessions, structs.SortByCreateIndex); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ids() != "cba" {
+		t.Fatalf("bad: %s", ids())
+	}
+	if err := sortSessions(sessions, "nope"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestSortACLs(t *testing.T) {
+	acls := []*structs.ACL{
+		&structs.ACL{ID: "a", Name: "ops", CreateIndex: 2},
+		&structs.ACL{ID: "b", Name: "dev", CreateIndex: 1},
+	}
+	if err := sortACLs(acls, structs.SortByName); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acls[0].ID != "b" {
+		t.Fatalf("bad: %v", acls)
+	}
+	if err := sortACLs(acls, "nope"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestSortDirEntries(t *testing.T) {
+	ents := structs.DirEntries{
+		&structs.DirEntry{Key: "a", CreateIndex: 5},
+		&structs.DirEntry{Key: "b", CreateIndex: 1},
+		&structs.DirEntry{Key: "c", CreateIndex: 5},
+	}
+
+	// Sorting by name keeps the key order
+	if err := sortDirEntries(ents, structs.SortByName); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ents[0].Key != "a" {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	// Ties keep the key order
+	if err := sortDirEntries(ents, structs.SortByCreateIndex); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ents[0].Key != "b" || ents[1].Key != "a" || ents[2].Key != "c" {
+		t.Fatalf("bad: %v", ents)
+	}
+	if err := sortDirEntries(ents, "nope"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
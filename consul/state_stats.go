@@ -0,0 +1,146 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// stateStatsInterval is how often the state store gauges are emitted
+	stateStatsInterval = 10 * time.Second
+
+	// watchReapInterval is how often the leaked watches are reaped
+	watchReapInterval = time.Minute
+
+	// watchLeakAge is how long a channel can watch the state store
+	// before it is considered leaked. Blocking queries are bounded by
+	// maxQueryTime plus some jitter, and stop watching when they return.
+	watchLeakAge = 2 * maxQueryTime
+)
+
+// messageTypeNames are used to label the apply metrics of the FSM
+var messageTypeNames = map[structs.MessageType]string{
+	structs.RegisterRequestType:         "register",
+	structs.DeregisterRequestType:       "deregister",
+	structs.KVSRequestType:              "kvs",
+	structs.SessionRequestType:          "session",
+	structs.ACLRequestType:              "acl",
+	structs.TombstoneRequestType:        "tombstone",
+	structs.CatalogPatchRequestType:     "catalog_patch",
+	structs.LockDelayRequestType:        "lock_delay",
+	structs.OutboxRequestType:           "outbox",
+	structs.ServerHealthRequestType:     "server_health",
+	structs.ExternalClaimRequestType:    "external_claim",
+	structs.MaintenanceRequestType:      "maintenance",
+	structs.SnapshotRestoreRequestType:  "snapshot_restore",
+	structs.AutopilotRequestType:        "autopilot",
+	structs.TxnRequestType:              "txn",
+	structs.AutoEncryptRequestType:      "auto_encrypt",
+	structs.AreaRequestType:             "area",
+	structs.PeeringRequestType:          "peering",
+	structs.ExportedServicesRequestType: "exported_services",
+	structs.ImportedServicesRequestType: "imported_services",
+	structs.KVSHistoryRequestType:       "kvs_history",
+	structs.RetentionRequestType:        "retention",
+	structs.CatalogAuditTrimRequestType: "catalog_audit_trim",
+}
+
+// messageTypeName returns the metrics label of a message type
+func messageTypeName(t structs.MessageType) string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Stats returns the current statistics of the state store. The sizes
+// are estimated from the pages used by each table and its indexes.
+func (s *StateStore) Stats() (*structs.StateStats, error) {
+	tx, err := s.tables.StartTxn(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Abort()
+
+	stats := &structs.StateStats{
+		Objects:    make(map[string]int, len(s.tables)),
+		Bytes:      make(map[string]uint64, len(s.tables)),
+		IndexBytes: make(map[string]uint64, len(s.tables)),
+		Watches:    make(map[string]int, len(s.tables)),
+	}
+	for _, table := range s.tables {
+		num, err := table.CountTxn(tx, "id")
+		if err != nil {
+			return nil, err
+		}
+		data, indexes, err := table.SizeTxn(tx)
+		if err != nil {
+			return nil, err
+		}
+		stats.Objects[table.Name] = num
+		stats.Bytes[table.Name] = data
+		stats.IndexBytes[table.Name] = indexes
+		stats.Watches[table.Name] = s.watch[table].Count()
+	}
+
+	stats.KVSWatches = s.kvWatch.Count()
+	stats.KVSWatchGroups = s.kvWatch.Groups()
+	return stats, nil
+}
+
+// emitStateStats sets the state store gauges
+func emitStateStats(stats *structs.StateStats) {
+	for name, num := range stats.Objects {
+		metrics.SetGauge([]string{"consul", "state", "objects", name}, float32(num))
+	}
+	for name, size := range stats.Bytes {
+		metrics.SetGauge([]string{"consul", "state", "bytes", name}, float32(size))
+	}
+	for name, size := range stats.IndexBytes {
+		metrics.SetGauge([]string{"consul", "state", "index_bytes", name}, float32(size))
+	}
+	for name, num := range stats.Watches {
+		metrics.SetGauge([]string{"consul", "state", "watches", name}, float32(num))
+	}
+	metrics.SetGauge([]string{"consul", "state", "watches", "kvs_prefix"}, float32(stats.KVSWatches))
+	metrics.SetGauge([]string{"consul", "state", "watches", "kvs_prefix_groups"}, float32(stats.KVSWatchGroups))
+}
+
+// stateStats periodically emits the state store gauges, so operators
+// can see what the blocking queries are waiting on
+func (s *Server) stateStats() {
+	for {
+		select {
+		case <-time.After(stateStatsInterval):
+			stats, err := s.fsm.State().Stats()
+			if err != nil {
+				s.logger.Printf("[ERR] consul: failed to get state store stats: %v", err)
+				continue
+			}
+			emitStateStats(stats)
+
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// reapWatches periodically removes the watches of the state store that
+// were never cleared, and the KV prefixes that are no longer watched
+func (s *Server) reapWatches() {
+	for {
+		select {
+		case <-time.After(watchReapInterval):
+			leaked := s.fsm.State().ReapWatches(watchLeakAge)
+			if leaked > 0 {
+				s.logger.Printf("[WARN] consul: reaped %d leaked state store watches", leaked)
+				metrics.IncrCounter([]string{"consul", "state", "watches", "leaked"}, float32(leaked))
+			}
+
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/armon/go-radix"
+	"github.com/armon/go-metrics"
 	"github.com/armon/gomdb"
 	"github.com/hashicorp/consul/consul/structs"
 )
@@ -21,10 +24,25 @@ const (
 	dbServices               = "services"
 	dbChecks                 = "checks"
 	dbKVS                    = "kvs"
+	dbKVSHistory             = "kvsHistory"
 	dbTombstone              = "tombstones"
 	dbSessions               = "sessions"
 	dbSessionChecks          = "sessionChecks"
 	dbACLs                   = "acls"
+	dbLockDelays             = "lockDelays"
+	dbOutboxSubs             = "outboxSubs"
+	dbOutbox                 = "outbox"
+	dbServerHealth           = "serverHealth"
+	dbCatalogAudit           = "catalogAudit"
+	dbExternalClaims         = "externalClaims"
+	dbMaintenance            = "maintenance"
+	dbAutopilot              = "autopilot"
+	dbAutoEncrypt            = "autoEncryptTokens"
+	dbAreas                  = "areas"
+	dbPeerings               = "peerings"
+	dbExported               = "exportedServices"
+	dbImported               = "importedServices"
+	dbRetention              = "retention"
 	dbMaxMapSize32bit uint64 = 128 * 1024 * 1024       // 128MB maximum size
 	dbMaxMapSize64bit uint64 = 32 * 1024 * 1024 * 1024 // 32GB maximum size
 	dbMaxReaders      uint   = 4096                    // 4K, default is 126
@@ -49,19 +67,34 @@ const (
 // implementation uses the Lightning Memory-Mapped Database (MDB).
 // This gives us Multi-Version Concurrency Control for "free"
 type StateStore struct {
-	logger            *log.Logger
+	logger            StateLogger
 	path              string
 	env               *mdb.Env
 	nodeTable         *MDBTable
 	serviceTable      *MDBTable
 	checkTable        *MDBTable
 	kvsTable          *MDBTable
+	kvsHistoryTable   *MDBTable
 	tombstoneTable    *MDBTable
 	sessionTable      *MDBTable
 	sessionCheckTable *MDBTable
 	aclTable          *MDBTable
+	lockDelayTable    *MDBTable
+	outboxSubTable    *MDBTable
+	outboxTable       *MDBTable
+	serverHealthTable *MDBTable
+	catalogAuditTable *MDBTable
+	claimTable        *MDBTable
+	maintTable        *MDBTable
+	autopilotTable    *MDBTable
+	autoEncryptTable  *MDBTable
+	areaTable         *MDBTable
+	peeringTable      *MDBTable
+	exportedTable     *MDBTable
+	importedTable     *MDBTable
+	retentionTable    *MDBTable
 	tables            MDBTables
-	watch             map[*MDBTable]*NotifyGroup
+	watch             map[*MDBTable]*ShardedNotifyGroup
 	queryTables       map[string]MDBTables
 
 	// kvWatch is a more optimized way of watching for KV changes.
@@ -69,28 +102,101 @@ type StateStore struct {
 	// a watcher is instantiated on a given prefix. When a change happens,
 	// only the relevant watchers are woken up. This reduces the cost of
 	// watching for KV changes.
-	kvWatch     *radix.Tree
-	kvWatchLock sync.Mutex
+	kvWatch *prefixWatch
 
-	// lockDelay is used to mark certain locks as unacquirable.
-	// When a lock is forcefully released (failing health
-	// check, destroyed session, etc), it is subject to the LockDelay
-	// imposed by the session. This prevents another session from
+	// serviceWatch fires when a service, its instances or their checks
+	// change, see WatchService
+	serviceWatch *serviceWatch
+
+	// watchStats counts how often the watches fire, see WatchStats
+	watchStats *watchStats
+
+	// notifyLimiter rate limits the KV notifications of hot prefixes,
+	// see SetKVSNotifyLimits
+	notifyLimiter *notifyLimiter
+
+	// healthSummary counts the instances of each service by health,
+	// see HealthSummary
+	healthSummary *healthSummary
+
+	// catalogRemovals remembers the services and checks removed from
+	// each node, see CatalogDiff
+	catalogRemovals *catalogRemovals
+
+	// notifyCh feeds the committed watch notifications to the
+	// dispatcher, which runs until notifyShutdownCh is closed
+	notifyCh         chan *notifyBatch
+	notifyShutdownCh chan struct{}
+	notifyShutdown   sync.Once
+
+	// lockDelay tracks when each lock delay window is expected to expire,
+	// keyed by key and then session. When a lock is forcefully released
+	// (failing health check, destroyed session, etc), it is subject to the
+	// LockDelay imposed by the session. This prevents another session from
 	// acquiring the lock for some period of time as a protection against
 	// split-brains. This is inspired by the lock-delay in Chubby.
-	// Because this relies on wall-time, we cannot assume all peers
-	// perceive time as flowing uniformly. This means KVSLock MUST ignore
-	// lockDelay, since the lockDelay may have expired on the leader,
-	// but not on the follower. Rejecting the lock could result in
-	// inconsistencies in the FSMs due to the rate time progresses. Instead,
-	// only the opinion of the leader is respected, and the Raft log
-	// is never questioned.
-	lockDelay     map[string]time.Time
+	// The windows themselves live in the lockDelayTable, so they survive
+	// leader changes and snapshots, and KVSLock rejects locks while one is
+	// open. Because expiration relies on wall-time, we cannot assume all
+	// peers perceive time as flowing uniformly, so a window is only closed
+	// when the leader commits a LockDelayExpire. This map is the opinion
+	// of this server, which the leader uses to schedule the expiration.
+	lockDelay     map[string]map[string]time.Time
 	lockDelayLock sync.RWMutex
 
 	// GC is when we create tombstones to track their time-to-live.
 	// The GC is consumed upstream to manage clearing of tombstones.
 	gc *TombstoneGC
+
+	// retention caches the retention committed in the retention table,
+	// which bounds the version history kept for each KV entry and the
+	// catalog audit table. kvsHistoryGC, if set, is hinted with the
+	// index of each version, so the leader can reap the versions once
+	// they are older than its TTL.
+	retention     structs.RetentionConfig
+	kvsHistoryGC  *TombstoneGC
+	retentionLock sync.RWMutex
+
+	// queryLog retains the queries that exceeded the slow query threshold
+	queryLog *slowQueryLog
+
+	// queryCache caches the results of hot queries, if enabled
+	queryCache *queryCache
+
+	// outboxIndex indexes the outbox subscriptions by prefix. It is
+	// replaced when a subscription is committed or removed.
+	outboxIndex *outboxIndex
+
+	// hooks are invoked with the changes to the tables after a commit
+	hooks *stateHooks
+
+	// indexes are the additional indexes registered by an embedder
+	indexes []*StateIndex
+}
+
+// SessionLimitError is returned when creating a session would exceed
+// the number of active sessions a node may hold
+type SessionLimitError struct {
+	Node  string
+	Limit int
+}
+
+func (e *SessionLimitError) Error() string {
+	return fmt.Sprintf("Node '%s' has reached the limit of %d sessions", e.Node, e.Limit)
+}
+
+// RegistrationConflictError is returned when the ModifyIndex
+// precondition of a registration or deregistration fails
+type RegistrationConflictError struct {
+	Kind     string // "node", "service" or "check"
+	ID       string // The node, or the node and service or check ID
+	Expected uint64
+	Actual   uint64 // Zero if the entry does not exist
+}
+
+func (e *RegistrationConflictError) Error() string {
+	return fmt.Sprintf("%s: %s '%s' has ModifyIndex %d, expected %d",
+		structs.RegistrationConflict, e.Kind, e.ID, e.Actual, e.Expected)
 }
 
 // StateSnapshot is used to provide a point-in-time snapshot
@@ -110,6 +216,31 @@ type sessionCheck struct {
 	Session string
 }
 
+// kvsVersion is used to retain a prior version of a KV entry so
+// that the entry can be read as of an older Raft index. The Version
+// is the modify index encoded as fixed width hex, so that versions
+// of a key sort in index order.
+type kvsVersion struct {
+	Key     string
+	Version string
+	Deleted bool
+	Entry   structs.DirEntry
+}
+
+// kvsVersionID encodes an index as a lexically sortable version string
+func kvsVersionID(index uint64) string {
+	return fmt.Sprintf("%016x", index)
+}
+
+// kvsVersionIndex decodes a version string back to the index
+func kvsVersionIndex(version string) uint64 {
+	index, err := strconv.ParseUint(version, 16, 64)
+	if err != nil {
+		panic(fmt.Errorf("Invalid KV version '%s': %v", version, err))
+	}
+	return index
+}
+
 // Close is used to abort the transaction and allow for cleanup
 func (s *StateSnapshot) Close() error {
 	s.tx.Abort()
@@ -129,6 +260,13 @@ func NewStateStore(gc *TombstoneGC, logOutput io.Writer) (*StateStore, error) {
 // NewStateStorePath is used to create a new state store at a given path
 // The path is cleared on closing.
 func NewStateStorePath(gc *TombstoneGC, path string, logOutput io.Writer) (*StateStore, error) {
+	return NewStateStoreIndexes(gc, path, logOutput, nil)
+}
+
+// NewStateStoreIndexes is like NewStateStorePath, but adds the given
+// indexes to the tables of the state store
+func NewStateStoreIndexes(gc *TombstoneGC, path string, logOutput io.Writer,
+	indexes []*StateIndex) (*StateStore, error) {
 	// Open the env
 	env, err := mdb.NewEnv()
 	if err != nil {
@@ -136,13 +274,24 @@ func NewStateStorePath(gc *TombstoneGC, path string, logOutput io.Writer) (*Stat
 	}
 
 	s := &StateStore{
-		logger:    log.New(logOutput, "", log.LstdFlags),
-		path:      path,
-		env:       env,
-		watch:     make(map[*MDBTable]*NotifyGroup),
-		kvWatch:   radix.New(),
-		lockDelay: make(map[string]time.Time),
-		gc:        gc,
+		logger:           NewStdStateLogger(logOutput, "consul.state"),
+		path:             path,
+		env:              env,
+		watch:            make(map[*MDBTable]*ShardedNotifyGroup),
+		kvWatch:          newPrefixWatch(),
+		serviceWatch:     newServiceWatch(),
+		watchStats:       newWatchStats(),
+		notifyLimiter:    newNotifyLimiter(),
+		healthSummary:    newHealthSummary(),
+		catalogRemovals:  newCatalogRemovals(),
+		notifyCh:         make(chan *notifyBatch, notifyQueueSize),
+		notifyShutdownCh: make(chan struct{}),
+		lockDelay:        make(map[string]map[string]time.Time),
+		queryLog:         newSlowQueryLog(slowQueryLogSize),
+		outboxIndex:      newOutboxIndex(),
+		hooks:            newStateHooks(),
+		gc:               gc,
+		indexes:          indexes,
 	}
 
 	// Ensure we can initialize
@@ -151,11 +300,13 @@ func NewStateStorePath(gc *TombstoneGC, path string, logOutput io.Writer) (*Stat
 		os.RemoveAll(path)
 		return nil, err
 	}
+	go s.runNotify()
 	return s, nil
 }
 
 // Close is used to safely shutdown the state store
 func (s *StateStore) Close() error {
+	s.notifyShutdown.Do(func() { close(s.notifyShutdownCh) })
 	s.env.Close()
 	os.RemoveAll(s.path)
 	return nil
@@ -164,7 +315,7 @@ func (s *StateStore) Close() error {
 // initialize is used to setup the store for use
 func (s *StateStore) initialize() error {
 	// Setup the Env first
-	if err := s.env.SetMaxDBs(mdb.DBI(32)); err != nil {
+	if err := s.env.SetMaxDBs(mdb.DBI(64)); err != nil {
 		return err
 	}
 
@@ -195,7 +346,8 @@ func (s *StateStore) initialize() error {
 		return err
 	}
 
-	// Tables use a generic struct encoder
+	// Tables use a generic struct encoder. Hot structs have generated
+	// encoders which structs.Encode uses to avoid reflection.
 	encoder := func(obj interface{}) []byte {
 		buf, err := structs.Encode(255, obj)
 		if err != nil {
@@ -213,6 +365,11 @@ func (s *StateStore) initialize() error {
 				Fields:          []string{"Node"},
 				CaseInsensitive: true,
 			},
+			"address": &MDBIndex{
+				AllowBlank: true,
+				Fields:     []string{"Address"},
+				FieldFunc:  nodeAddressFields,
+			},
 		},
 		Decoder: func(buf []byte) interface{} {
 			out := new(structs.Node)
@@ -235,6 +392,16 @@ func (s *StateStore) initialize() error {
 				Fields:          []string{"ServiceName"},
 				CaseInsensitive: true,
 			},
+			"connect": &MDBIndex{
+				AllowBlank:      true,
+				Fields:          []string{"ConnectDestination"},
+				FieldFunc:       serviceConnectFields,
+				CaseInsensitive: true,
+			},
+			"kind": &MDBIndex{
+				AllowBlank: true,
+				Fields:     []string{"ServiceKind"},
+			},
 		},
 		Decoder: func(buf []byte) interface{} {
 			out := new(structs.ServiceNode)
@@ -300,6 +467,23 @@ func (s *StateStore) initialize() error {
 		},
 	}
 
+	s.kvsHistoryTable = &MDBTable{
+		Name: dbKVSHistory,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Key", "Version"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(kvsVersion)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
 	s.tombstoneTable = &MDBTable{
 		Name: dbTombstone,
 		Indexes: map[string]*MDBIndex{
@@ -378,24 +562,302 @@ func (s *StateStore) initialize() error {
 		},
 	}
 
+	s.lockDelayTable = &MDBTable{
+		Name: dbLockDelays,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Key", "Session"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.LockDelay)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.outboxSubTable = &MDBTable{
+		Name: dbOutboxSubs,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Name"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.OutboxSubscription)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.outboxTable = &MDBTable{
+		Name: dbOutbox,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Subscription", "ID"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.OutboxEntry)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.serverHealthTable = &MDBTable{
+		Name: dbServerHealth,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Name"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.ServerHealth)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.catalogAuditTable = &MDBTable{
+		Name: dbCatalogAudit,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"ID"},
+			},
+			"node": &MDBIndex{
+				Fields: []string{"Node"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.CatalogAudit)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.claimTable = &MDBTable{
+		Name: dbExternalClaims,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:    true,
+				Fields:    []string{"Node", "ServiceID"},
+				FieldFunc: externalClaimFields,
+			},
+			"node": &MDBIndex{
+				Fields: []string{"Node"},
+			},
+			"session": &MDBIndex{
+				Fields: []string{"Session"},
+			},
+			"owner": &MDBIndex{
+				AllowBlank: true,
+				Fields:     []string{"Owner"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.ExternalClaim)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.maintTable = &MDBTable{
+		Name: dbMaintenance,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:    true,
+				Fields:    []string{"Node", "ServiceID"},
+				FieldFunc: maintenanceFields,
+			},
+			"node": &MDBIndex{
+				Fields: []string{"Node"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.Maintenance)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.autopilotTable = &MDBTable{
+		Name: dbAutopilot,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:    true,
+				Fields:    []string{"ID"},
+				FieldFunc: autopilotFields,
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.AutopilotConfig)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.autoEncryptTable = &MDBTable{
+		Name: dbAutoEncrypt,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Hash"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.AutoEncryptToken)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.areaTable = &MDBTable{
+		Name: dbAreas,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"ID"},
+			},
+			"peer": &MDBIndex{
+				Unique: true,
+				Fields: []string{"PeerDatacenter"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.Area)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.peeringTable = &MDBTable{
+		Name: dbPeerings,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"ID"},
+			},
+			"name": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Name"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.Peering)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.exportedTable = &MDBTable{
+		Name: dbExported,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:    true,
+				Fields:    []string{"ID"},
+				FieldFunc: exportedServicesFields,
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.ExportedServicesConfig)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.importedTable = &MDBTable{
+		Name: dbImported,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Peer", "Service"},
+			},
+			"peer": &MDBIndex{
+				Fields: []string{"Peer"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.ImportedService)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.retentionTable = &MDBTable{
+		Name: dbRetention,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:    true,
+				Fields:    []string{"ID"},
+				FieldFunc: retentionFields,
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.RetentionConfig)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
 	// Store the set of tables
 	s.tables = []*MDBTable{s.nodeTable, s.serviceTable, s.checkTable,
-		s.kvsTable, s.tombstoneTable, s.sessionTable, s.sessionCheckTable,
-		s.aclTable}
+		s.kvsTable, s.kvsHistoryTable, s.tombstoneTable, s.sessionTable,
+		s.sessionCheckTable, s.aclTable, s.lockDelayTable, s.outboxSubTable,
+		s.outboxTable, s.serverHealthTable, s.catalogAuditTable, s.claimTable,
+		s.maintTable, s.autopilotTable, s.autoEncryptTable, s.areaTable,
+		s.peeringTable, s.exportedTable, s.importedTable, s.retentionTable}
+	if err := s.addIndexes(s.indexes); err != nil {
+		return err
+	}
 	for _, table := range s.tables {
 		table.Env = s.env
 		table.Encoder = encoder
+		table.OnChange = s.runHooks
 		if err := table.Init(); err != nil {
 			return err
 		}
 
 		// Setup a notification group per table
-		s.watch[table] = &NotifyGroup{}
+		s.watch[table] = &ShardedNotifyGroup{}
 	}
 
 	// Setup the query tables
 	s.queryTables = map[string]MDBTables{
 		"Nodes":             MDBTables{s.nodeTable},
+		"NodesByAddress":    MDBTables{s.nodeTable},
 		"Services":          MDBTables{s.serviceTable},
 		"ServiceNodes":      MDBTables{s.nodeTable, s.serviceTable},
 		"NodeServices":      MDBTables{s.nodeTable, s.serviceTable},
@@ -405,11 +867,26 @@ func (s *StateStore) initialize() error {
 		"CheckServiceNodes": MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
 		"NodeInfo":          MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
 		"NodeDump":          MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
+		"HealthSummary":     MDBTables{s.serviceTable, s.checkTable},
+		"CatalogDiff":       MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
 		"SessionGet":        MDBTables{s.sessionTable},
 		"SessionList":       MDBTables{s.sessionTable},
 		"NodeSessions":      MDBTables{s.sessionTable},
 		"ACLGet":            MDBTables{s.aclTable},
 		"ACLList":           MDBTables{s.aclTable},
+		"LockDelays":        MDBTables{s.lockDelayTable},
+		"OutboxSubs":        MDBTables{s.outboxSubTable},
+		"OutboxPending":     MDBTables{s.outboxTable},
+		"ServerHealth":      MDBTables{s.serverHealthTable},
+		"CatalogAudit":      MDBTables{s.catalogAuditTable},
+		"ExternalClaims":    MDBTables{s.claimTable},
+		"Maintenance":       MDBTables{s.maintTable},
+		"Autopilot":         MDBTables{s.autopilotTable},
+		"Areas":             MDBTables{s.areaTable},
+		"Peerings":          MDBTables{s.peeringTable},
+		"PeeringGet":        MDBTables{s.peeringTable, s.importedTable},
+		"ExportedServices":  MDBTables{s.exportedTable},
+		"ImportedServices":  MDBTables{s.importedTable},
 	}
 	return nil
 }
@@ -430,63 +907,53 @@ func (s *StateStore) StopWatch(tables MDBTables, notify chan struct{}) {
 
 // WatchKV is used to subscribe a channel to changes in KV data
 func (s *StateStore) WatchKV(prefix string, notify chan struct{}) {
-	s.kvWatchLock.Lock()
-	defer s.kvWatchLock.Unlock()
-
-	// Check for an existing notify group
-	if raw, ok := s.kvWatch.Get(prefix); ok {
-		grp := raw.(*NotifyGroup)
-		grp.Wait(notify)
-		return
-	}
-
-	// Create new notify group
-	grp := &NotifyGroup{}
-	grp.Wait(notify)
-	s.kvWatch.Insert(prefix, grp)
+	s.kvWatch.Wait(prefix, notify)
 }
 
 // StopWatchKV is used to unsubscribe a channel from changes in KV data
 func (s *StateStore) StopWatchKV(prefix string, notify chan struct{}) {
-	s.kvWatchLock.Lock()
-	defer s.kvWatchLock.Unlock()
+	s.kvWatch.Clear(prefix, notify)
+}
 
-	// Check for an existing notify group
-	if raw, ok := s.kvWatch.Get(prefix); ok {
-		grp := raw.(*NotifyGroup)
-		grp.Clear(notify)
-	}
+// WatchKVGlob is used to subscribe a channel to changes in KV data
+// matching a glob pattern, such as "config/*/database"
+func (s *StateStore) WatchKVGlob(pattern string, notify chan struct{}) {
+	s.kvWatch.WaitGlob(pattern, notify)
 }
 
-// notifyKV is used to notify any KV listeners of a change
-// on a prefix
-func (s *StateStore) notifyKV(path string, prefix bool) {
-	s.kvWatchLock.Lock()
-	defer s.kvWatchLock.Unlock()
+// StopWatchKVGlob is used to unsubscribe a channel from changes in KV
+// data matching a glob pattern
+func (s *StateStore) StopWatchKVGlob(pattern string, notify chan struct{}) {
+	s.kvWatch.ClearGlob(pattern, notify)
+}
 
-	var toDelete []string
-	fn := func(s string, v interface{}) bool {
-		group := v.(*NotifyGroup)
-		group.Notify()
-		if s != "" {
-			toDelete = append(toDelete, s)
-		}
-		return false
-	}
-
-	// Invoke any watcher on the path downward to the key.
-	s.kvWatch.WalkPath(path, fn)
+// WatchService is used to subscribe a channel to changes of a service:
+// its service entries, the nodes of its instances, and all their checks,
+// including those of the nodes. Endpoints returning a service along with
+// its nodes or health should prefer it over watching the tables.
+func (s *StateStore) WatchService(service string, notify chan struct{}) {
+	s.serviceWatch.Wait(service, notify)
+}
 
-	// If the entire prefix may be affected (e.g. delete tree),
-	// invoke the entire prefix
-	if prefix {
-		s.kvWatch.WalkPrefix(path, fn)
-	}
+// StopWatchService is used to unsubscribe a channel from changes of a
+// service
+func (s *StateStore) StopWatchService(service string, notify chan struct{}) {
+	s.serviceWatch.Clear(service, notify)
+}
 
-	// Delete the old watch groups
-	for i := len(toDelete) - 1; i >= 0; i-- {
-		s.kvWatch.Delete(toDelete[i])
+// ReapWatches removes the channels that have been watching the tables,
+// services or KV prefixes for longer than maxAge, along with the KV prefixes that
+// are no longer watched. Blocking queries stop watching when they return,
+// so these channels have leaked. Returns the number of leaked channels.
+func (s *StateStore) ReapWatches(maxAge time.Duration) int {
+	before := time.Now().Add(-maxAge)
+	leaked := 0
+	for _, table := range s.tables {
+		leaked += s.watch[table].Reap(before)
 	}
+	leaked += s.kvWatch.Reap(before)
+	leaked += s.serviceWatch.Reap(before)
+	return leaked
 }
 
 // QueryTables returns the Tables that are queried for a given query
@@ -494,6 +961,24 @@ func (s *StateStore) QueryTables(q string) MDBTables {
 	return s.queryTables[q]
 }
 
+// RaiseIndexes is used to raise the index of every table to at least the
+// given index, notifying the watches of all of them
+func (s *StateStore) RaiseIndexes(index uint64) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	for _, table := range s.tables {
+		if err := table.SetMaxLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+	}
+	s.notifyTables(tx, s.tables...)
+	return tx.Commit()
+}
+
 // EnsureRegistration is used to make sure a node, service, and check registration
 // is performed within a single transaction to avoid race conditions on state updates.
 func (s *StateStore) EnsureRegistration(index uint64, req *structs.RegisterRequest) error {
@@ -502,9 +987,84 @@ func (s *StateStore) EnsureRegistration(index uint64, req *structs.RegisterReque
 		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
 	defer tx.Abort()
+	if err := s.ensureRegistrationTxn(index, req, tx); err != nil {
+		return err
+	}
+
+	// Commit as one unit
+	return tx.Commit()
+}
+
+// EnsureRegistrationCAS is like EnsureRegistration, but only applies the
+// registration if the ModifyIndex of the registered entry matches the
+// request: the service if one is provided, otherwise the check if a
+// single one is provided, otherwise the node. A zero ModifyIndex requires
+// that the entry does not exist. Returns a *RegistrationConflictError if
+// the precondition fails.
+func (s *StateStore) EnsureRegistrationCAS(index uint64, req *structs.RegisterRequest) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	var serviceID, checkID string
+	if req.Service != nil {
+		serviceID = req.Service.ID
+	} else if req.Check != nil && len(req.Checks) == 0 {
+		checkID = req.Check.CheckID
+	}
+	if err := s.checkModifyIndexTxn(tx, req.Node, serviceID, checkID, req.ModifyIndex); err != nil {
+		return err
+	}
+	if err := s.ensureRegistrationTxn(index, req, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkModifyIndexTxn checks the ModifyIndex of a service if an ID is
+// given, otherwise of a check if an ID is given, otherwise of a node
+func (s *StateStore) checkModifyIndexTxn(tx *MDBTxn, node, serviceID, checkID string, expected uint64) error {
+	var kind, id string
+	var res []interface{}
+	var err error
+	switch {
+	case serviceID != "":
+		kind, id = "service", node+"/"+serviceID
+		res, err = s.serviceTable.GetTxn(tx, "id", node, serviceID)
+	case checkID != "":
+		kind, id = "check", node+"/"+checkID
+		res, err = s.checkTable.GetTxn(tx, "id", node, checkID)
+	default:
+		kind, id = "node", node
+		res, err = s.nodeTable.GetTxn(tx, "id", node)
+	}
+	if err != nil {
+		return err
+	}
+
+	var actual uint64
+	if len(res) > 0 {
+		switch entry := res[0].(type) {
+		case *structs.ServiceNode:
+			actual = entry.ModifyIndex
+		case *structs.HealthCheck:
+			actual = entry.ModifyIndex
+		case *structs.Node:
+			actual = entry.ModifyIndex
+		}
+	}
+	if actual != expected || (expected == 0 && len(res) > 0) {
+		return &RegistrationConflictError{Kind: kind, ID: id, Expected: expected, Actual: actual}
+	}
+	return nil
+}
 
+// ensureRegistrationTxn applies a registration within a given txn
+func (s *StateStore) ensureRegistrationTxn(index uint64, req *structs.RegisterRequest, tx *MDBTxn) error {
 	// Ensure the node
-	node := structs.Node{req.Node, req.Address}
+	node := structs.Node{Node: req.Node, Address: req.Address, Meta: req.NodeMeta}
 	if err := s.ensureNodeTxn(index, node, tx); err != nil {
 		return err
 	}
@@ -527,14 +1087,13 @@ func (s *StateStore) EnsureRegistration(index uint64, req *structs.RegisterReque
 			return err
 		}
 	}
-
-	// Commit as one unit
-	return tx.Commit()
+	return nil
 }
 
 // EnsureNode is used to ensure a given node exists, with the provided address
 func (s *StateStore) EnsureNode(index uint64, node structs.Node) error {
-	tx, err := s.nodeTable.StartTxn(false, nil)
+	// The services of the node are read to notify their watchers
+	tx, err := MDBTables{s.nodeTable, s.serviceTable}.StartTxn(false)
 	if err != nil {
 		return err
 	}
@@ -548,21 +1107,39 @@ func (s *StateStore) EnsureNode(index uint64, node structs.Node) error {
 // ensureNodeTxn is used to ensure a given node exists, with the provided address
 // within a given txn
 func (s *StateStore) ensureNodeTxn(index uint64, node structs.Node, tx *MDBTxn) error {
-	if err := s.nodeTable.InsertTxn(tx, node); err != nil {
+	// Preserve any existing metadata if none is provided, and the
+	// ModifyIndex if nothing changed
+	res, err := s.nodeTable.GetTxn(tx, "id", node.Node)
+	if err != nil {
+		return err
+	}
+	node.CreateIndex, node.ModifyIndex = index, index
+	if len(res) > 0 {
+		existing := res[0].(*structs.Node)
+		if node.Meta == nil {
+			node.Meta = existing.Meta
+		}
+		node.CreateIndex, node.ModifyIndex = existing.CreateIndex, existing.ModifyIndex
+		if !reflect.DeepEqual(&node, existing) {
+			node.ModifyIndex = index
+		}
+	}
+	if err := s.nodeTable.InsertTxn(tx, &node); err != nil {
 		return err
 	}
 	if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.nodeTable].Notify() })
-	return nil
+	s.notifyTables(tx, s.nodeTable)
+	return s.notifyNodeServices(tx, node.Node)
 }
 
 // GetNode returns all the address of the known and if it was found
 func (s *StateStore) GetNode(name string) (uint64, bool, string) {
+	defer s.measureQuery("GetNode", time.Now(), "node", name)
 	idx, res, err := s.nodeTable.Get("id", name)
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Error during node lookup: %v", err)
+		s.logger.Error("Failed to look up node", "node", name, "error", err)
 		return 0, false, ""
 	}
 	if len(res) == 0 {
@@ -574,9 +1151,25 @@ func (s *StateStore) GetNode(name string) (uint64, bool, string) {
 // GetNodes returns all the known nodes, the slice alternates between
 // the node name and address
 func (s *StateStore) Nodes() (uint64, structs.Nodes) {
+	defer s.measureQuery("Nodes", time.Now())
 	idx, res, err := s.nodeTable.Get("id")
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Error getting nodes: %v", err)
+		s.logger.Error("Failed to get nodes", "error", err)
+	}
+	results := make([]structs.Node, len(res))
+	for i, r := range res {
+		results[i] = *r.(*structs.Node)
+	}
+	return idx, results
+}
+
+// NodesByAddress returns the nodes registered with an address, for the
+// reverse DNS lookups
+func (s *StateStore) NodesByAddress(address string) (uint64, structs.Nodes) {
+	defer s.measureQuery("NodesByAddress", time.Now())
+	idx, res, err := s.nodeTable.Get("address", canonicalAddress(address))
+	if err != nil {
+		s.logger.Error("Failed to get nodes by address", "address", address, "error", err)
 	}
 	results := make([]structs.Node, len(res))
 	for i, r := range res {
@@ -585,6 +1178,38 @@ func (s *StateStore) Nodes() (uint64, structs.Nodes) {
 	return idx, results
 }
 
+// nodeAddressFields returns the address index value of a node
+func nodeAddressFields(obj interface{}) ([]string, error) {
+	node, ok := obj.(*structs.Node)
+	if !ok {
+		return nil, fmt.Errorf("Not a node: %#v", obj)
+	}
+	return []string{canonicalAddress(node.Address)}, nil
+}
+
+// serviceConnectFields returns the connect index value of a service, the
+// name of the destination of a connect-proxy, so the proxies of a service
+// are found without scanning the others
+func serviceConnectFields(obj interface{}) ([]string, error) {
+	srv, ok := obj.(*structs.ServiceNode)
+	if !ok {
+		return nil, fmt.Errorf("Not a service: %#v", obj)
+	}
+	if srv.ServiceKind != structs.ServiceKindConnectProxy {
+		return []string{""}, nil
+	}
+	return []string{srv.ServiceProxy.DestinationServiceName}, nil
+}
+
+// canonicalAddress returns the canonical form of an address, so an IPv6
+// address matches however it was written. Host names are only lowered.
+func canonicalAddress(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(address)
+}
+
 // EnsureService is used to ensure a given node exposes a service
 func (s *StateStore) EnsureService(index uint64, node string, ns *structs.NodeService) error {
 	tx, err := s.tables.StartTxn(false)
@@ -617,6 +1242,36 @@ func (s *StateStore) ensureServiceTxn(index uint64, node string, ns *structs.Nod
 		ServiceTags:    ns.Tags,
 		ServiceAddress: ns.Address,
 		ServicePort:    ns.Port,
+		ServiceMeta:    ns.Meta,
+
+		ServiceWeightPassing: ns.WeightPassing,
+		ServiceWeightWarning: ns.WeightWarning,
+
+		ServiceKind:  ns.Kind,
+		ServiceProxy: ns.Proxy,
+
+		ServiceWANAddress: ns.WANAddress,
+		ServiceWANPort:    ns.WANPort,
+	}
+
+	// Preserve any existing metadata if none is provided, and the
+	// ModifyIndex if nothing changed. If the entry is renamed, the
+	// watchers of the previous service are notified too.
+	res, err = s.serviceTable.GetTxn(tx, "id", node, ns.ID)
+	if err != nil {
+		return err
+	}
+	entry.CreateIndex, entry.ModifyIndex = index, index
+	if len(res) > 0 {
+		existing := res[0].(*structs.ServiceNode)
+		if entry.ServiceMeta == nil {
+			entry.ServiceMeta = existing.ServiceMeta
+		}
+		entry.CreateIndex, entry.ModifyIndex = existing.CreateIndex, existing.ModifyIndex
+		if !reflect.DeepEqual(&entry, existing) {
+			entry.ModifyIndex = index
+		}
+		s.notifyServices(tx, existing.ServiceName)
 	}
 
 	// Ensure the service entry is set
@@ -626,12 +1281,25 @@ func (s *StateStore) ensureServiceTxn(index uint64, node string, ns *structs.Nod
 	if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+	s.notifyTables(tx, s.serviceTable)
+	s.notifyServices(tx, ns.Service)
+	s.notifyHealth(tx, node)
 	return nil
 }
 
 // NodeServices is used to return all the services of a given node
 func (s *StateStore) NodeServices(name string) (uint64, *structs.NodeServices) {
+	defer s.measureQuery("NodeServices", time.Now(), "node", name)
+	idx, res := s.cachedQuery(queryCacheKey("NodeServices", name), s.queryTables["NodeServices"],
+		func() (uint64, interface{}) {
+			return s.nodeServices(name)
+		})
+
+	return idx, res.(*structs.NodeServices)
+}
+
+// nodeServices is the uncached query of NodeServices
+func (s *StateStore) nodeServices(name string) (uint64, *structs.NodeServices) {
 	tables := s.queryTables["NodeServices"]
 	tx, err := tables.StartTxn(true)
 	if err != nil {
@@ -657,7 +1325,7 @@ func (s *StateStore) parseNodeServices(tables MDBTables, tx *MDBTxn, name string
 	// Get the node first
 	res, err := s.nodeTable.GetTxn(tx, "id", name)
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get node: %v", err)
+		s.logger.Error("Failed to get node", "node", name, "error", err)
 	}
 	if len(res) == 0 {
 		return index, nil
@@ -670,18 +1338,25 @@ func (s *StateStore) parseNodeServices(tables MDBTables, tx *MDBTxn, name string
 	// Get the services
 	res, err = s.serviceTable.GetTxn(tx, "id", name)
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get node '%s' services: %v", name, err)
+		s.logger.Error("Failed to get node services", "node", name, "error", err)
 	}
 
 	// Add each service
 	for _, r := range res {
 		service := r.(*structs.ServiceNode)
 		srv := &structs.NodeService{
-			ID:      service.ServiceID,
-			Service: service.ServiceName,
-			Tags:    service.ServiceTags,
-			Address: service.ServiceAddress,
-			Port:    service.ServicePort,
+			ID:            service.ServiceID,
+			Service:       service.ServiceName,
+			Tags:          service.ServiceTags,
+			Address:       service.ServiceAddress,
+			Port:          service.ServicePort,
+			Meta:          service.ServiceMeta,
+			WeightPassing: service.ServiceWeightPassing,
+			WeightWarning: service.ServiceWeightWarning,
+			Kind:          service.ServiceKind,
+			Proxy:         service.ServiceProxy,
+			WANAddress:    service.ServiceWANAddress,
+			WANPort:       service.ServiceWANPort,
 		}
 		ns.Services[srv.ID] = srv
 	}
@@ -695,14 +1370,40 @@ func (s *StateStore) DeleteNodeService(index uint64, node, id string) error {
 		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
 	defer tx.Abort()
+	if err := s.deleteNodeServiceTxn(index, tx, node, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// deleteNodeServiceTxn deletes a node service and its checks within a
+// given txn
+func (s *StateStore) deleteNodeServiceTxn(index uint64, tx *MDBTxn, node, id string) error {
+	res, err := s.serviceTable.GetTxn(tx, "id", node, id)
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		srv := r.(*structs.ServiceNode)
+		s.notifyServices(tx, srv.ServiceName)
+		s.catalogRemovals.record(node, catalogRemoval{
+			index: index, service: true, id: srv.ServiceID, name: srv.ServiceName})
+	}
+	s.notifyHealth(tx, node)
+
+	if err := s.releaseClaimsTxn(index, tx, "id", targetID(node, id)...); err != nil {
+		return err
+	}
+	if err := s.deleteMaintenanceTxn(index, tx, "id", targetID(node, id)...); err != nil {
+		return err
+	}
 	if n, err := s.serviceTable.DeleteTxn(tx, "id", node, id); err != nil {
 		return err
 	} else if n > 0 {
 		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+		s.notifyTables(tx, s.serviceTable)
 	}
 
 	// Invalidate any sessions using these checks
@@ -715,6 +1416,8 @@ func (s *StateStore) DeleteNodeService(index uint64, node, id string) error {
 		if err := s.invalidateCheck(index, tx, node, check.CheckID); err != nil {
 			return err
 		}
+		s.catalogRemovals.record(node, catalogRemoval{
+			index: index, id: check.CheckID, name: check.ServiceName})
 	}
 
 	if n, err := s.checkTable.DeleteTxn(tx, "node", node, id); err != nil {
@@ -723,9 +1426,9 @@ func (s *StateStore) DeleteNodeService(index uint64, node, id string) error {
 		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+		s.notifyTables(tx, s.checkTable)
 	}
-	return tx.Commit()
+	return nil
 }
 
 // DeleteNode is used to delete a node and all it's services
@@ -735,19 +1438,38 @@ func (s *StateStore) DeleteNode(index uint64, node string) error {
 		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
 	defer tx.Abort()
+	if err := s.deleteNodeTxn(index, tx, node); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// deleteNodeTxn deletes a node, its services and its checks within a
+// given txn
+func (s *StateStore) deleteNodeTxn(index uint64, tx *MDBTxn, node string) error {
 	// Invalidate any sessions held by the node
 	if err := s.invalidateNode(index, tx, node); err != nil {
 		return err
 	}
 
+	if err := s.notifyNodeServices(tx, node); err != nil {
+		return err
+	}
+	s.notifyHealth(tx, node)
+	s.catalogRemovals.dropNode(index, node)
+	if err := s.releaseClaimsTxn(index, tx, "node", node); err != nil {
+		return err
+	}
+	if err := s.deleteMaintenanceTxn(index, tx, "node", node); err != nil {
+		return err
+	}
 	if n, err := s.serviceTable.DeleteTxn(tx, "id", node); err != nil {
 		return err
 	} else if n > 0 {
 		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+		s.notifyTables(tx, s.serviceTable)
 	}
 	if n, err := s.checkTable.DeleteTxn(tx, "id", node); err != nil {
 		return err
@@ -755,7 +1477,7 @@ func (s *StateStore) DeleteNode(index uint64, node string) error {
 		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+		s.notifyTables(tx, s.checkTable)
 	}
 	if n, err := s.nodeTable.DeleteTxn(tx, "id", node); err != nil {
 		return err
@@ -763,17 +1485,171 @@ func (s *StateStore) DeleteNode(index uint64, node string) error {
 		if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.nodeTable].Notify() })
+		s.notifyTables(tx, s.nodeTable)
+	}
+	return nil
+}
+
+// DeleteRegistrationCAS applies a deregistration only if the ModifyIndex
+// of the deregistered service, check or node matches the request.
+// Returns a *RegistrationConflictError if the precondition fails.
+func (s *StateStore) DeleteRegistrationCAS(index uint64, req *structs.DeregisterRequest) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	if err := s.checkModifyIndexTxn(tx, req.Node, req.ServiceID, req.CheckID, req.ModifyIndex); err != nil {
+		return err
+	}
+	if req.ServiceID != "" {
+		err = s.deleteNodeServiceTxn(index, tx, req.Node, req.ServiceID)
+	} else if req.CheckID != "" {
+		err = s.deleteNodeCheckTxn(index, tx, req.Node, req.CheckID)
+	} else {
+		err = s.deleteNodeTxn(index, tx, req.Node)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CatalogPatch is used to apply tag and metadata changes to a node or to
+// one of its services. Only the patched table has its index bumped, and
+// nothing is written if the changes are already in place.
+func (s *StateStore) CatalogPatch(index uint64, req *structs.CatalogPatchRequest) error {
+	table := s.nodeTable
+	if req.ServiceID != "" {
+		table = s.serviceTable
+	}
+
+	// Node patches read the services of the node to notify their watchers
+	tx, err := MDBTables{s.nodeTable, s.serviceTable}.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	var obj interface{}
+	var changed bool
+	if req.ServiceID == "" {
+		res, err := s.nodeTable.GetTxn(tx, "id", req.Node)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return fmt.Errorf("Missing node registration")
+		}
+		node := res[0].(*structs.Node)
+		for _, op := range req.Ops {
+			if op.Op == structs.PatchAddTag || op.Op == structs.PatchRemoveTag {
+				return fmt.Errorf("Tags can only be patched on a service")
+			}
+		}
+		_, node.Meta, changed, err = applyPatchOps(nil, node.Meta, req.Ops)
+		if err != nil {
+			return err
+		}
+		node.ModifyIndex = index
+		obj = node
+	} else {
+		res, err := s.serviceTable.GetTxn(tx, "id", req.Node, req.ServiceID)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return fmt.Errorf("Missing service registration")
+		}
+		srv := res[0].(*structs.ServiceNode)
+		srv.ServiceTags, srv.ServiceMeta, changed, err = applyPatchOps(srv.ServiceTags, srv.ServiceMeta, req.Ops)
+		if err != nil {
+			return err
+		}
+		srv.ModifyIndex = index
+		obj = srv
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := table.InsertTxn(tx, obj); err != nil {
+		return err
+	}
+	if err := table.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, table)
+	if srv, ok := obj.(*structs.ServiceNode); ok {
+		s.notifyServices(tx, srv.ServiceName)
+	} else if err := s.notifyNodeServices(tx, req.Node); err != nil {
+		return err
 	}
 	return tx.Commit()
 }
 
+// applyPatchOps applies the operations to copies of the tags and metadata,
+// and returns if anything was changed
+func applyPatchOps(tags []string, meta map[string]string,
+	ops []structs.PatchOp) ([]string, map[string]string, bool, error) {
+	outTags := make([]string, 0, len(tags)+len(ops))
+	outTags = append(outTags, tags...)
+	outMeta := make(map[string]string, len(meta))
+	for k, v := range meta {
+		outMeta[k] = v
+	}
+
+	changed := false
+	for _, op := range ops {
+		switch op.Op {
+		case structs.PatchAddTag:
+			if !strContains(outTags, op.Key) {
+				outTags = append(outTags, op.Key)
+				changed = true
+			}
+		case structs.PatchRemoveTag:
+			n := 0
+			for _, tag := range outTags {
+				if tag != op.Key {
+					outTags[n] = tag
+					n++
+				}
+			}
+			changed = changed || n != len(outTags)
+			outTags = outTags[:n]
+		case structs.PatchSetMeta:
+			if v, ok := outMeta[op.Key]; !ok || v != op.Value {
+				outMeta[op.Key] = op.Value
+				changed = true
+			}
+		case structs.PatchDeleteMeta:
+			if _, ok := outMeta[op.Key]; ok {
+				delete(outMeta, op.Key)
+				changed = true
+			}
+		default:
+			return nil, nil, false, fmt.Errorf("Invalid patch operation '%s'", op.Op)
+		}
+	}
+
+	// Avoid storing empty values that were nil before
+	if len(outTags) == 0 && tags == nil {
+		outTags = nil
+	}
+	if len(outMeta) == 0 {
+		outMeta = nil
+	}
+	return outTags, outMeta, changed, nil
+}
+
 // Services is used to return all the services with a list of associated tags
 func (s *StateStore) Services() (uint64, map[string][]string) {
+	defer s.measureQuery("Services", time.Now())
 	services := make(map[string][]string)
 	idx, res, err := s.serviceTable.Get("id")
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get services: %v", err)
+		s.logger.Error("Failed to get services", "error", err)
 		return idx, services
 	}
 	for _, r := range res {
@@ -795,6 +1671,16 @@ func (s *StateStore) Services() (uint64, map[string][]string) {
 
 // ServiceNodes returns the nodes associated with a given service
 func (s *StateStore) ServiceNodes(service string) (uint64, structs.ServiceNodes) {
+	defer s.measureQuery("ServiceNodes", time.Now(), "service", service)
+	idx, res := s.cachedQuery(queryCacheKey("ServiceNodes", service), s.queryTables["ServiceNodes"],
+		func() (uint64, interface{}) {
+			return s.serviceNodes(service)
+		})
+	return idx, res.(structs.ServiceNodes)
+}
+
+// serviceNodes is the uncached query of ServiceNodes
+func (s *StateStore) serviceNodes(service string) (uint64, structs.ServiceNodes) {
 	tables := s.queryTables["ServiceNodes"]
 	tx, err := tables.StartTxn(true)
 	if err != nil {
@@ -813,6 +1699,16 @@ func (s *StateStore) ServiceNodes(service string) (uint64, structs.ServiceNodes)
 
 // ServiceTagNodes returns the nodes associated with a given service matching a tag
 func (s *StateStore) ServiceTagNodes(service, tag string) (uint64, structs.ServiceNodes) {
+	defer s.measureQuery("ServiceTagNodes", time.Now(), "service", service, "tag", tag)
+	idx, res := s.cachedQuery(queryCacheKey("ServiceTagNodes", service, strings.ToLower(tag)),
+		s.queryTables["ServiceNodes"], func() (uint64, interface{}) {
+			return s.serviceTagNodes(service, tag)
+		})
+	return idx, res.(structs.ServiceNodes)
+}
+
+// serviceTagNodes is the uncached query of ServiceTagNodes
+func (s *StateStore) serviceTagNodes(service, tag string) (uint64, structs.ServiceNodes) {
 	tables := s.queryTables["ServiceNodes"]
 	tx, err := tables.StartTxn(true)
 	if err != nil {
@@ -830,6 +1726,39 @@ func (s *StateStore) ServiceTagNodes(service, tag string) (uint64, structs.Servi
 	return idx, s.parseServiceNodes(tx, s.nodeTable, res, err)
 }
 
+// ConnectServiceNodes returns the connect-proxies of a given service
+func (s *StateStore) ConnectServiceNodes(service string) (uint64, structs.ServiceNodes) {
+	defer s.measureQuery("ConnectServiceNodes", time.Now(), "service", service)
+	idx, res := s.cachedQuery(queryCacheKey("ConnectServiceNodes", service), s.queryTables["ServiceNodes"],
+		func() (uint64, interface{}) {
+			return s.connectServiceNodes(service)
+		})
+	return idx, res.(structs.ServiceNodes)
+}
+
+// connectServiceNodes is the uncached query of ConnectServiceNodes
+func (s *StateStore) connectServiceNodes(service string) (uint64, structs.ServiceNodes) {
+	tables := s.queryTables["ServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	// The services that aren't proxies share the blank key
+	if service == "" {
+		return idx, make(structs.ServiceNodes, 0)
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "connect", service)
+	return idx, s.parseServiceNodes(tx, s.nodeTable, res, err)
+}
+
 // serviceTagFilter is used to filter a list of *structs.ServiceNode which do
 // not have the specified tag
 func serviceTagFilter(l []interface{}, tag string) []interface{} {
@@ -849,7 +1778,7 @@ func serviceTagFilter(l []interface{}, tag string) []interface{} {
 func (s *StateStore) parseServiceNodes(tx *MDBTxn, table *MDBTable, res []interface{}, err error) structs.ServiceNodes {
 	nodes := make(structs.ServiceNodes, len(res))
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get service nodes: %v", err)
+		s.logger.Error("Failed to get service nodes", "error", err)
 		return nodes
 	}
 
@@ -859,14 +1788,14 @@ func (s *StateStore) parseServiceNodes(tx *MDBTxn, table *MDBTable, res []interf
 		// Get the address of the node
 		nodeRes, err := table.GetTxn(tx, "id", srv.Node)
 		if err != nil || len(nodeRes) != 1 {
-			s.logger.Printf("[ERR] consul.state: Failed to join service node %#v with node: %v", *srv, err)
+			s.logger.Error("Failed to join service node with node", "node", srv.Node, "service", srv.ServiceID, "error", err)
 			continue
 		}
 		srv.Address = nodeRes[0].(*structs.Node).Address
 
 		nodes[i] = *srv
 	}
-
+	sort.Sort(serviceNodesByNode(nodes))
 	return nodes
 }
 
@@ -921,6 +1850,20 @@ func (s *StateStore) ensureCheckTxn(index uint64, check *structs.HealthCheck, tx
 		}
 	}
 
+	// Preserve the ModifyIndex if nothing changed
+	res, err = s.checkTable.GetTxn(tx, "id", check.Node, check.CheckID)
+	if err != nil {
+		return err
+	}
+	check.CreateIndex, check.ModifyIndex = index, index
+	if len(res) > 0 {
+		existing := res[0].(*structs.HealthCheck)
+		check.CreateIndex, check.ModifyIndex = existing.CreateIndex, existing.ModifyIndex
+		if !reflect.DeepEqual(check, existing) {
+			check.ModifyIndex = index
+		}
+	}
+
 	// Ensure the check is set
 	if err := s.checkTable.InsertTxn(tx, check); err != nil {
 		return err
@@ -928,8 +1871,20 @@ func (s *StateStore) ensureCheckTxn(index uint64, check *structs.HealthCheck, tx
 	if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.checkTable].Notify() })
-	return nil
+	s.notifyTables(tx, s.checkTable)
+	s.notifyHealth(tx, check.Node)
+	return s.notifyCheckServices(tx, check)
+}
+
+// notifyCheckServices fires the service watches affected by a check. A
+// check of a service affects that service, and a check of the node
+// affects every service of the node.
+func (s *StateStore) notifyCheckServices(tx *MDBTxn, check *structs.HealthCheck) error {
+	if check.ServiceID != "" {
+		s.notifyServices(tx, check.ServiceName)
+		return nil
+	}
+	return s.notifyNodeServices(tx, check.Node)
 }
 
 // DeleteNodeCheck is used to delete a node health check
@@ -939,35 +1894,66 @@ func (s *StateStore) DeleteNodeCheck(index uint64, node, id string) error {
 		return err
 	}
 	defer tx.Abort()
+	if err := s.deleteNodeCheckTxn(index, tx, node, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// deleteNodeCheckTxn deletes a node health check within a given txn
+func (s *StateStore) deleteNodeCheckTxn(index uint64, tx *MDBTxn, node, id string) error {
 	// Invalidate any sessions held by this check
 	if err := s.invalidateCheck(index, tx, node, id); err != nil {
 		return err
 	}
 
+	res, err := s.checkTable.GetTxn(tx, "id", node, id)
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		check := r.(*structs.HealthCheck)
+		if err := s.notifyCheckServices(tx, check); err != nil {
+			return err
+		}
+		s.catalogRemovals.record(node, catalogRemoval{
+			index: index, id: check.CheckID, name: check.ServiceName})
+
+		// Deregistering the check of a maintenance flag lifts the flag
+		if IsMaintenanceCheck(check.CheckID) {
+			if err := s.deleteMaintenanceTxn(index, tx, "id", targetID(node, check.ServiceID)...); err != nil {
+				return err
+			}
+		}
+	}
+	s.notifyHealth(tx, node)
+
 	if n, err := s.checkTable.DeleteTxn(tx, "id", node, id); err != nil {
 		return err
 	} else if n > 0 {
 		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+		s.notifyTables(tx, s.checkTable)
 	}
-	return tx.Commit()
+	return nil
 }
 
 // NodeChecks is used to get all the checks for a node
 func (s *StateStore) NodeChecks(node string) (uint64, structs.HealthChecks) {
+	defer s.measureQuery("NodeChecks", time.Now(), "node", node)
 	return s.parseHealthChecks(s.checkTable.Get("id", node))
 }
 
 // ServiceChecks is used to get all the checks for a service
 func (s *StateStore) ServiceChecks(service string) (uint64, structs.HealthChecks) {
+	defer s.measureQuery("ServiceChecks", time.Now(), "service", service)
 	return s.parseHealthChecks(s.checkTable.Get("service", service))
 }
 
 // CheckInState is used to get all the checks for a service in a given state
 func (s *StateStore) ChecksInState(state string) (uint64, structs.HealthChecks) {
+	defer s.measureQuery("ChecksInState", time.Now(), "state", state)
 	var idx uint64
 	var res []interface{}
 	var err error
@@ -984,20 +1970,31 @@ func (s *StateStore) ChecksInState(state string) (uint64, structs.HealthChecks)
 func (s *StateStore) parseHealthChecks(idx uint64, res []interface{}, err error) (uint64, structs.HealthChecks) {
 	results := make([]*structs.HealthCheck, len(res))
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get health checks: %v", err)
+		s.logger.Error("Failed to get health checks", "error", err)
 		return idx, results
 	}
 	for i, r := range res {
 		results[i] = r.(*structs.HealthCheck)
 	}
+	sort.Sort(healthChecksByNode(results))
 	return idx, results
 }
 
 // CheckServiceNodes returns the nodes associated with a given service, along
 // with any associated check
 func (s *StateStore) CheckServiceNodes(service string) (uint64, structs.CheckServiceNodes) {
-	tables := s.queryTables["CheckServiceNodes"]
-	tx, err := tables.StartTxn(true)
+	defer s.measureQuery("CheckServiceNodes", time.Now(), "service", service)
+	idx, res := s.cachedQuery(queryCacheKey("CheckServiceNodes", service), s.queryTables["CheckServiceNodes"],
+		func() (uint64, interface{}) {
+			return s.checkServiceNodes(service)
+		})
+	return idx, res.(structs.CheckServiceNodes)
+}
+
+// checkServiceNodes is the uncached query of CheckServiceNodes
+func (s *StateStore) checkServiceNodes(service string) (uint64, structs.CheckServiceNodes) {
+	tables := s.queryTables["CheckServiceNodes"]
+	tx, err := tables.StartTxn(true)
 	if err != nil {
 		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
@@ -1015,6 +2012,16 @@ func (s *StateStore) CheckServiceNodes(service string) (uint64, structs.CheckSer
 // CheckServiceNodes returns the nodes associated with a given service, along
 // with any associated checks
 func (s *StateStore) CheckServiceTagNodes(service, tag string) (uint64, structs.CheckServiceNodes) {
+	defer s.measureQuery("CheckServiceTagNodes", time.Now(), "service", service, "tag", tag)
+	idx, res := s.cachedQuery(queryCacheKey("CheckServiceTagNodes", service, strings.ToLower(tag)),
+		s.queryTables["CheckServiceNodes"], func() (uint64, interface{}) {
+			return s.checkServiceTagNodes(service, tag)
+		})
+	return idx, res.(structs.CheckServiceNodes)
+}
+
+// checkServiceTagNodes is the uncached query of CheckServiceTagNodes
+func (s *StateStore) checkServiceTagNodes(service, tag string) (uint64, structs.CheckServiceNodes) {
 	tables := s.queryTables["CheckServiceNodes"]
 	tx, err := tables.StartTxn(true)
 	if err != nil {
@@ -1032,11 +2039,74 @@ func (s *StateStore) CheckServiceTagNodes(service, tag string) (uint64, structs.
 	return idx, s.parseCheckServiceNodes(tx, res, err)
 }
 
+// CheckConnectServiceNodes returns the connect-proxies of a given service,
+// along with any associated checks
+func (s *StateStore) CheckConnectServiceNodes(service string) (uint64, structs.CheckServiceNodes) {
+	defer s.measureQuery("CheckConnectServiceNodes", time.Now(), "service", service)
+	idx, res := s.cachedQuery(queryCacheKey("CheckConnectServiceNodes", service), s.queryTables["CheckServiceNodes"],
+		func() (uint64, interface{}) {
+			return s.checkConnectServiceNodes(service)
+		})
+	return idx, res.(structs.CheckServiceNodes)
+}
+
+// checkConnectServiceNodes is the uncached query of CheckConnectServiceNodes
+func (s *StateStore) checkConnectServiceNodes(service string) (uint64, structs.CheckServiceNodes) {
+	tables := s.queryTables["CheckServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	// The services that aren't proxies share the blank key
+	if service == "" {
+		return idx, make(structs.CheckServiceNodes, 0)
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "connect", service)
+	return idx, s.parseCheckServiceNodes(tx, res, err)
+}
+
+// CheckServiceKindNodes returns the services of a given kind, like the
+// mesh gateways, along with any associated checks
+func (s *StateStore) CheckServiceKindNodes(kind structs.ServiceKind) (uint64, structs.CheckServiceNodes) {
+	defer s.measureQuery("CheckServiceKindNodes", time.Now(), "kind", string(kind))
+	idx, res := s.cachedQuery(queryCacheKey("CheckServiceKindNodes", string(kind)), s.queryTables["CheckServiceNodes"],
+		func() (uint64, interface{}) {
+			return s.checkServiceKindNodes(kind)
+		})
+	return idx, res.(structs.CheckServiceNodes)
+}
+
+// checkServiceKindNodes is the uncached query of CheckServiceKindNodes
+func (s *StateStore) checkServiceKindNodes(kind structs.ServiceKind) (uint64, structs.CheckServiceNodes) {
+	tables := s.queryTables["CheckServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "kind", string(kind))
+	return idx, s.parseCheckServiceNodes(tx, res, err)
+}
+
 // parseCheckServiceNodes parses results CheckServiceNodes and CheckServiceTagNodes
 func (s *StateStore) parseCheckServiceNodes(tx *MDBTxn, res []interface{}, err error) structs.CheckServiceNodes {
 	nodes := make(structs.CheckServiceNodes, len(res))
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get service nodes: %v", err)
+		s.logger.Error("Failed to get service nodes", "error", err)
 		return nodes
 	}
 
@@ -1046,7 +2116,7 @@ func (s *StateStore) parseCheckServiceNodes(tx *MDBTxn, res []interface{}, err e
 		// Get the node
 		nodeRes, err := s.nodeTable.GetTxn(tx, "id", srv.Node)
 		if err != nil || len(nodeRes) != 1 {
-			s.logger.Printf("[ERR] consul.state: Failed to join service node %#v with node: %v", *srv, err)
+			s.logger.Error("Failed to join service node with node", "node", srv.Node, "service", srv.ServiceID, "error", err)
 			continue
 		}
 
@@ -1062,20 +2132,28 @@ func (s *StateStore) parseCheckServiceNodes(tx *MDBTxn, res []interface{}, err e
 		// Setup the node
 		nodes[i].Node = *nodeRes[0].(*structs.Node)
 		nodes[i].Service = structs.NodeService{
-			ID:      srv.ServiceID,
-			Service: srv.ServiceName,
-			Tags:    srv.ServiceTags,
-			Address: srv.ServiceAddress,
-			Port:    srv.ServicePort,
+			ID:            srv.ServiceID,
+			Service:       srv.ServiceName,
+			Tags:          srv.ServiceTags,
+			Address:       srv.ServiceAddress,
+			Port:          srv.ServicePort,
+			Meta:          srv.ServiceMeta,
+			WeightPassing: srv.ServiceWeightPassing,
+			WeightWarning: srv.ServiceWeightWarning,
+			Kind:          srv.ServiceKind,
+			Proxy:         srv.ServiceProxy,
+			WANAddress:    srv.ServiceWANAddress,
+			WANPort:       srv.ServiceWANPort,
 		}
 		nodes[i].Checks = checks
 	}
-
+	sort.Sort(checkServiceNodesByNode(nodes))
 	return nodes
 }
 
 // NodeInfo is used to generate the full info about a node.
 func (s *StateStore) NodeInfo(node string) (uint64, structs.NodeDump) {
+	defer s.measureQuery("NodeInfo", time.Now(), "node", node)
 	tables := s.queryTables["NodeInfo"]
 	tx, err := tables.StartTxn(true)
 	if err != nil {
@@ -1095,6 +2173,7 @@ func (s *StateStore) NodeInfo(node string) (uint64, structs.NodeDump) {
 // NodeDump is used to generate the NodeInfo for all nodes. This is very expensive,
 // and should generally be avoided for programmatic access.
 func (s *StateStore) NodeDump() (uint64, structs.NodeDump) {
+	defer s.measureQuery("NodeDump", time.Now())
 	tables := s.queryTables["NodeDump"]
 	tx, err := tables.StartTxn(true)
 	if err != nil {
@@ -1116,7 +2195,7 @@ func (s *StateStore) NodeDump() (uint64, structs.NodeDump) {
 func (s *StateStore) parseNodeInfo(tx *MDBTxn, res []interface{}, err error) structs.NodeDump {
 	dump := make(structs.NodeDump, 0, len(res))
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get nodes: %v", err)
+		s.logger.Error("Failed to get nodes", "error", err)
 		return dump
 	}
 
@@ -1131,17 +2210,24 @@ func (s *StateStore) parseNodeInfo(tx *MDBTxn, res []interface{}, err error) str
 		// Get any services of the node
 		res, err = s.serviceTable.GetTxn(tx, "id", node.Node)
 		if err != nil {
-			s.logger.Printf("[ERR] consul.state: Failed to get node services: %v", err)
+			s.logger.Error("Failed to get node services", "node", node.Node, "error", err)
 		}
 		info.Services = make([]*structs.NodeService, 0, len(res))
 		for _, r := range res {
 			service := r.(*structs.ServiceNode)
 			srv := &structs.NodeService{
-				ID:      service.ServiceID,
-				Service: service.ServiceName,
-				Tags:    service.ServiceTags,
-				Address: service.ServiceAddress,
-				Port:    service.ServicePort,
+				ID:            service.ServiceID,
+				Service:       service.ServiceName,
+				Tags:          service.ServiceTags,
+				Address:       service.ServiceAddress,
+				Port:          service.ServicePort,
+				Meta:          service.ServiceMeta,
+				WeightPassing: service.ServiceWeightPassing,
+				WeightWarning: service.ServiceWeightWarning,
+				Kind:          service.ServiceKind,
+				Proxy:         service.ServiceProxy,
+				WANAddress:    service.ServiceWANAddress,
+				WANPort:       service.ServiceWANPort,
 			}
 			info.Services = append(info.Services, srv)
 		}
@@ -1149,13 +2235,14 @@ func (s *StateStore) parseNodeInfo(tx *MDBTxn, res []interface{}, err error) str
 		// Get any checks of the node
 		res, err = s.checkTable.GetTxn(tx, "node", node.Node)
 		if err != nil {
-			s.logger.Printf("[ERR] consul.state: Failed to get node checks: %v", err)
+			s.logger.Error("Failed to get node checks", "node", node.Node, "error", err)
 		}
 		info.Checks = make([]*structs.HealthCheck, 0, len(res))
 		for _, r := range res {
 			chk := r.(*structs.HealthCheck)
 			info.Checks = append(info.Checks, chk)
 		}
+		sort.Sort(healthChecksByID(info.Checks))
 
 		// Add the node info
 		dump = append(dump, info)
@@ -1190,6 +2277,7 @@ func (s *StateStore) KVSRestore(d *structs.DirEntry) error {
 
 // KVSGet is used to get a KV entry
 func (s *StateStore) KVSGet(key string) (uint64, *structs.DirEntry, error) {
+	defer s.measureQuery("KVSGet", time.Now(), "key", key)
 	idx, res, err := s.kvsTable.Get("id", key)
 	var d *structs.DirEntry
 	if len(res) > 0 {
@@ -1198,8 +2286,181 @@ func (s *StateStore) KVSGet(key string) (uint64, *structs.DirEntry, error) {
 	return idx, d, err
 }
 
+// SetKVSHistoryGC sets the GC that is hinted with the index of each
+// recorded version of the KV history, so that the leader can reap the
+// versions older than its TTL through Raft. The number of versions
+// retained is set through RetentionSet.
+func (s *StateStore) SetKVSHistoryGC(gc *TombstoneGC) {
+	s.retentionLock.Lock()
+	defer s.retentionLock.Unlock()
+	s.kvsHistoryGC = gc
+}
+
+// kvsHistoryLimits returns the current history retention settings
+func (s *StateStore) kvsHistoryLimits() (int, *TombstoneGC) {
+	s.retentionLock.RLock()
+	defer s.retentionLock.RUnlock()
+	return s.retention.KVSHistoryVersions, s.kvsHistoryGC
+}
+
+// KVSGetAtIndex is used to get a KV entry as it existed at a given
+// Raft index. A nil entry is returned if the key was deleted as of
+// the index. An error is returned if the history needed to answer
+// the query has not been retained.
+func (s *StateStore) KVSGetAtIndex(key string, index uint64) (uint64, *structs.DirEntry, error) {
+	defer s.measureQuery("KVSGetAtIndex", time.Now(), "key", key, "index", strconv.FormatUint(index, 10))
+	tables := MDBTables{s.kvsTable, s.kvsHistoryTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.kvsTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// If the current entry has not been modified since the index,
+	// it is the answer and no history is required
+	res, err := s.kvsTable.GetTxn(tx, "id", key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(res) > 0 {
+		if d := res[0].(*structs.DirEntry); d.ModifyIndex <= index {
+			return idx, d, nil
+		}
+	}
+
+	if versions, _ := s.kvsHistoryLimits(); versions == 0 {
+		return idx, nil, fmt.Errorf("KV history is disabled")
+	}
+
+	// Find the newest retained version at or before the index
+	res, err = s.kvsHistoryTable.GetTxn(tx, "id", key)
+	if err != nil {
+		return 0, nil, err
+	}
+	var match *kvsVersion
+	for _, r := range res {
+		ver := r.(*kvsVersion)
+		if ver.Key != key || kvsVersionIndex(ver.Version) > index {
+			continue
+		}
+		match = ver
+	}
+	if match == nil {
+		return idx, nil, fmt.Errorf("KV history for '%s' not retained at index %d", key, index)
+	}
+	if match.Deleted {
+		return idx, nil, nil
+	}
+	return idx, &match.Entry, nil
+}
+
+// kvsRecordVersionTxn is used to add a version of a KV entry to the
+// history within a given txn, and to prune the oldest versions of the
+// key beyond the retention limit.
+func (s *StateStore) kvsRecordVersionTxn(index uint64, tx *MDBTxn, d *structs.DirEntry, deleted bool) error {
+	versions, gc := s.kvsHistoryLimits()
+	if versions == 0 {
+		return nil
+	}
+
+	ver := &kvsVersion{
+		Key:     d.Key,
+		Version: kvsVersionID(index),
+		Deleted: deleted,
+		Entry:   *d,
+	}
+	if err := s.kvsHistoryTable.InsertTxn(tx, ver); err != nil {
+		return err
+	}
+	if gc != nil {
+		tx.Defer(func() { gc.Hint(index) })
+	}
+
+	// Versions are returned oldest first, so prune from the front
+	res, err := s.kvsHistoryTable.GetTxn(tx, "id", d.Key)
+	if err != nil {
+		return err
+	}
+	var existing []*kvsVersion
+	for _, r := range res {
+		if v := r.(*kvsVersion); v.Key == d.Key {
+			existing = append(existing, v)
+		}
+	}
+	for i := 0; len(existing)-i > versions; i++ {
+		v := existing[i]
+		if _, err := s.kvsHistoryTable.DeleteTxn(tx, "id", v.Key, v.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KVSHistoryReap is used to delete the versions of the KV history that
+// were recorded at or before the reap index. The leader applies this
+// once the versions are older than the history TTL, so that all the
+// servers retain the same versions.
+func (s *StateStore) KVSHistoryReap(index uint64) error {
+	tx, err := s.kvsHistoryTable.StartTxn(false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start txn: %v", err)
+	}
+	defer tx.Abort()
+
+	// Scan the history for the versions that are eligible, like
+	// ReapTombstones does, since there is no numeric index
+	var toDelete []*kvsVersion
+	streamCh := make(chan interface{}, 128)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for raw := range streamCh {
+			ver := raw.(*kvsVersion)
+			if kvsVersionIndex(ver.Version) <= index {
+				toDelete = append(toDelete, ver)
+			}
+		}
+	}()
+	if err := s.kvsHistoryTable.StreamTxn(streamCh, tx, "id"); err != nil {
+		return fmt.Errorf("failed to scan KV history: %v", err)
+	}
+	<-doneCh
+
+	if len(toDelete) == 0 {
+		return nil
+	}
+	s.logger.Debug("Reaping KV history", "count", len(toDelete), "index", index)
+	for _, ver := range toDelete {
+		if _, err := s.kvsHistoryTable.DeleteTxn(tx, "id", ver.Key, ver.Version); err != nil {
+			return fmt.Errorf("failed to delete KV version: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// KVSHistoryRestore is used to restore a version of the KV history. It
+// should only be used when doing a restore.
+func (s *StateStore) KVSHistoryRestore(ver *kvsVersion) error {
+	tx, err := s.kvsHistoryTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.kvsHistoryTable.InsertTxn(tx, ver); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // KVSList is used to list all KV entries with a prefix
 func (s *StateStore) KVSList(prefix string) (uint64, uint64, structs.DirEntries, error) {
+	defer s.measureQuery("KVSList", time.Now(), "prefix", prefix)
 	tables := MDBTables{s.kvsTable, s.tombstoneTable}
 	tx, err := tables.StartTxn(true)
 	if err != nil {
@@ -1236,6 +2497,7 @@ func (s *StateStore) KVSList(prefix string) (uint64, uint64, structs.DirEntries,
 
 // KVSListKeys is used to list keys with a prefix, and up to a given separator
 func (s *StateStore) KVSListKeys(prefix, seperator string) (uint64, []string, error) {
+	defer s.measureQuery("KVSListKeys", time.Now(), "prefix", prefix, "separator", seperator)
 	tables := MDBTables{s.kvsTable, s.tombstoneTable}
 	tx, err := tables.StartTxn(true)
 	if err != nil {
@@ -1331,6 +2593,15 @@ func (s *StateStore) KVSDeleteCheckAndSet(index uint64, key string, casIndex uin
 	}
 	defer tx.Abort()
 
+	if ok, err := s.kvsDeleteCASTxn(index, tx, key, casIndex); !ok || err != nil {
+		return ok, err
+	}
+	return true, tx.Commit()
+}
+
+// kvsDeleteCASTxn is a delete check-and-set within an existing
+// transaction
+func (s *StateStore) kvsDeleteCASTxn(index uint64, tx *MDBTxn, key string, casIndex uint64) (bool, error) {
 	// Get the existing node
 	res, err := s.kvsTable.GetTxn(tx, "id", key)
 	if err != nil {
@@ -1356,7 +2627,7 @@ func (s *StateStore) KVSDeleteCheckAndSet(index uint64, key string, casIndex uin
 	if err := s.kvsDeleteWithIndexTxn(index, tx, "id", key); err != nil {
 		return false, err
 	}
-	return true, tx.Commit()
+	return true, nil
 }
 
 // KVSDeleteTree is used to delete all keys with a given prefix
@@ -1399,6 +2670,12 @@ func (s *StateStore) kvsDeleteWithIndexTxn(index uint64, tx *MDBTxn, tableIndex
 			if err := s.tombstoneTable.InsertTxn(tx, ent); err != nil {
 				return err
 			}
+			if err := s.kvsRecordVersionTxn(index, tx, ent, true); err != nil {
+				return err
+			}
+			if err := s.outboxRecordTxn(index, tx, structs.KVSDelete, ent); err != nil {
+				return err
+			}
 			if num, err := s.kvsTable.DeleteTxn(tx, "id", ent.Key); err != nil {
 				return err
 			} else if num != 1 {
@@ -1421,13 +2698,13 @@ func (s *StateStore) kvsDeleteWithIndexTxn(index uint64, tx *MDBTxn, tableIndex
 			// Trigger the most fine grained notifications if possible
 			switch {
 			case len(parts) == 0:
-				s.notifyKV("", true)
+				s.notifyKV(tx, "", true)
 			case tableIndex == "id":
-				s.notifyKV(parts[0], false)
+				s.notifyKV(tx, parts[0], false)
 			case tableIndex == "id_prefix":
-				s.notifyKV(parts[0], true)
+				s.notifyKV(tx, parts[0], true)
 			default:
-				s.notifyKV("", true)
+				s.notifyKV(tx, "", true)
 			}
 			if s.gc != nil {
 				// If GC is configured, then we hint that this index
@@ -1455,109 +2732,555 @@ func (s *StateStore) KVSUnlock(index uint64, d *structs.DirEntry) (bool, error)
 }
 
 // KVSLockDelay returns the expiration time of a key lock delay. A key may
-// have a lock delay if it was unlocked due to a session invalidation instead
-// of a graceful unlock. This must be checked on the leader node, and not in
-// KVSLock due to the variability of clocks.
+// have a lock delay if it was previously acquired but the session was
+// invalidated. The time is as perceived by this server, the key remains
+// delayed until the leader expires the window.
 func (s *StateStore) KVSLockDelay(key string) time.Time {
 	s.lockDelayLock.RLock()
-	expires := s.lockDelay[key]
-	s.lockDelayLock.RUnlock()
+	defer s.lockDelayLock.RUnlock()
+	var expires time.Time
+	for _, t := range s.lockDelay[key] {
+		if t.After(expires) {
+			expires = t
+		}
+	}
 	return expires
 }
 
-// kvsSet is the internal setter
-func (s *StateStore) kvsSet(
-	index uint64,
-	d *structs.DirEntry,
-	mode kvMode) (bool, error) {
-	// Start a new txn
-	tx, err := s.tables.StartTxn(false)
-	if err != nil {
-		return false, err
+// LockDelays returns all the open lock delay windows
+func (s *StateStore) LockDelays() (uint64, []*structs.LockDelay, error) {
+	idx, res, err := s.lockDelayTable.Get("id")
+	out := make([]*structs.LockDelay, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.LockDelay)
 	}
-	defer tx.Abort()
+	return idx, out, err
+}
 
-	// Get the existing node
-	res, err := s.kvsTable.GetTxn(tx, "id", d.Key)
-	if err != nil {
-		return false, err
-	}
+// LockDelayExpires returns when a lock delay window is expected to
+// expire, as perceived by this server
+func (s *StateStore) LockDelayExpires(key, session string) time.Time {
+	s.lockDelayLock.RLock()
+	defer s.lockDelayLock.RUnlock()
+	return s.lockDelay[key][session]
+}
 
-	// Get the existing node if any
-	var exist *structs.DirEntry
-	if len(res) > 0 {
-		exist = res[0].(*structs.DirEntry)
+// LockDelayExpire is used to close a lock delay window, allowing the
+// key to be locked again
+func (s *StateStore) LockDelayExpire(index uint64, key, session string) error {
+	tx, err := s.lockDelayTable.StartTxn(false, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Abort()
 
-	// Use the ModifyIndex as the constraint. A modify of time of 0
-	// means we are doing a set-if-not-exists, while any other value
-	// means we expect that modify time.
-	if mode == kvCAS {
-		if d.ModifyIndex == 0 && exist != nil {
-			return false, nil
-		} else if d.ModifyIndex > 0 && (exist == nil || exist.ModifyIndex != d.ModifyIndex) {
-			return false, nil
+	if n, err := s.lockDelayTable.DeleteTxn(tx, "id", key, session); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.lockDelayTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
 		}
+		tx.Defer(func() {
+			s.clearLockDelayExpires(key, session)
+			s.notifyTables(tx, s.lockDelayTable)
+		})
 	}
+	return tx.Commit()
+}
 
-	// If attempting to lock, check this is possible
-	if mode == kvLock {
-		// Verify we have a session
-		if d.Session == "" {
-			return false, fmt.Errorf("Missing session")
-		}
-
-		// Bail if it is already locked
-		if exist != nil && exist.Session != "" {
-			return false, nil
-		}
-
-		// Verify the session exists
-		res, err := s.sessionTable.GetTxn(tx, "id", d.Session)
-		if err != nil {
-			return false, err
-		}
-		if len(res) == 0 {
-			return false, fmt.Errorf("Invalid session")
-		}
-
-		// Update the lock index
-		if exist != nil {
-			exist.LockIndex++
-			exist.Session = d.Session
-		} else {
-			d.LockIndex = 1
-		}
+// LockDelayRestore is used to restore a lock delay window from a
+// snapshot. The window is assumed to have just started.
+func (s *StateStore) LockDelayRestore(d *structs.LockDelay) error {
+	tx, err := s.lockDelayTable.StartTxn(false, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Abort()
 
-	// If attempting to unlock, verify the key exists and is held
-	if mode == kvUnlock {
-		if exist == nil || exist.Session != d.Session {
-			return false, nil
-		}
-		// Clear the session to unlock
-		exist.Session = ""
+	if err := s.lockDelayTable.InsertTxn(tx, d); err != nil {
+		return err
 	}
+	if err := s.lockDelayTable.SetMaxLastIndexTxn(tx, d.CreateIndex); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.setLockDelayExpires(d.Key, d.Session, time.Now().Add(d.Delay))
+	return nil
+}
 
-	// Set the create and modify times
-	if exist == nil {
-		d.CreateIndex = index
-	} else {
-		d.CreateIndex = exist.CreateIndex
-		d.LockIndex = exist.LockIndex
-		d.Session = exist.Session
-
+// lockDelayTxn is used to open a lock delay window on a key that
+// was held by the given session. All tables should be locked in the tx.
+func (s *StateStore) lockDelayTxn(index uint64, tx *MDBTxn,
+	key, session string, delay time.Duration) error {
+	d := &structs.LockDelay{
+		Key:         key,
+		Session:     session,
+		Delay:       delay,
+		CreateIndex: index,
+	}
+	if err := s.lockDelayTable.InsertTxn(tx, d); err != nil {
+		return err
 	}
-	d.ModifyIndex = index
+	if err := s.lockDelayTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	tx.Defer(func() {
+		s.setLockDelayExpires(key, session, time.Now().Add(delay))
+		s.notifyTables(tx, s.lockDelayTable)
+	})
+	return nil
+}
 
-	if err := s.kvsTable.InsertTxn(tx, d); err != nil {
-		return false, err
+// setLockDelayExpires records the local expiration of a window
+func (s *StateStore) setLockDelayExpires(key, session string, expires time.Time) {
+	s.lockDelayLock.Lock()
+	defer s.lockDelayLock.Unlock()
+	sessions, ok := s.lockDelay[key]
+	if !ok {
+		sessions = make(map[string]time.Time)
+		s.lockDelay[key] = sessions
 	}
-	if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
-		return false, err
+	sessions[session] = expires
+}
+
+// clearLockDelayExpires removes the local expiration of a window
+func (s *StateStore) clearLockDelayExpires(key, session string) {
+	s.lockDelayLock.Lock()
+	defer s.lockDelayLock.Unlock()
+	delete(s.lockDelay[key], session)
+	if len(s.lockDelay[key]) == 0 {
+		delete(s.lockDelay, key)
 	}
-	tx.Defer(func() { s.notifyKV(d.Key, false) })
-	return true, tx.Commit()
+}
+
+// OutboxSubscribe is used to create or update an outbox subscription.
+// Only changes committed after the subscription are delivered.
+func (s *StateStore) OutboxSubscribe(index uint64, sub *structs.OutboxSubscription) error {
+	if sub.Name == "" {
+		return fmt.Errorf("Missing subscription name")
+	}
+	tx, err := s.outboxSubTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.outboxSubTable.GetTxn(tx, "id", sub.Name)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		sub.CreateIndex = index
+		sub.Pending = 0
+		sub.Dropped = 0
+	} else {
+		exist := res[0].(*structs.OutboxSubscription)
+		sub.CreateIndex = exist.CreateIndex
+		sub.Pending = exist.Pending
+		sub.Dropped = exist.Dropped
+	}
+	sub.ModifyIndex = index
+
+	if err := s.outboxSubTable.InsertTxn(tx, sub); err != nil {
+		return err
+	}
+	if err := s.outboxSubTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if err := s.outboxReindexTxn(tx); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.outboxSubTable)
+	return tx.Commit()
+}
+
+// OutboxUnsubscribe is used to remove an outbox subscription, along
+// with any of its entries that have not been delivered
+func (s *StateStore) OutboxUnsubscribe(index uint64, name string) error {
+	tables := MDBTables{s.outboxSubTable, s.outboxTable}
+	tx, err := tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if n, err := s.outboxSubTable.DeleteTxn(tx, "id", name); err != nil {
+		return err
+	} else if n == 0 {
+		return nil
+	}
+	if err := s.outboxSubTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if n, err := s.outboxTable.DeleteTxn(tx, "id", name); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.outboxTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+	}
+	if err := s.outboxReindexTxn(tx); err != nil {
+		return err
+	}
+	tx.Defer(func() {
+		s.notifyTables(tx, s.outboxSubTable, s.outboxTable)
+	})
+	return tx.Commit()
+}
+
+// outboxReindexTxn is used to replace the prefix index of the outbox
+// subscriptions with the subscriptions of a txn, once it commits
+func (s *StateStore) outboxReindexTxn(tx *MDBTxn) error {
+	res, err := s.outboxSubTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	subs := make([]*structs.OutboxSubscription, len(res))
+	for i, raw := range res {
+		subs[i] = raw.(*structs.OutboxSubscription)
+	}
+	tx.Defer(func() { s.outboxIndex.set(subs) })
+	return nil
+}
+
+// OutboxSubscriptions is used to list the outbox subscriptions
+func (s *StateStore) OutboxSubscriptions() (uint64, []*structs.OutboxSubscription, error) {
+	defer s.measureQuery("OutboxSubscriptions", time.Now())
+	idx, res, err := s.outboxSubTable.Get("id")
+	out := make([]*structs.OutboxSubscription, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.OutboxSubscription)
+	}
+	return idx, out, err
+}
+
+// OutboxPending returns up to limit of the undelivered entries of a
+// subscription, in the order they were committed. A zero limit returns
+// all of the entries.
+func (s *StateStore) OutboxPending(name string, limit int) (uint64, []*structs.OutboxEntry, error) {
+	defer s.measureQuery("OutboxPending", time.Now(), "subscription", name)
+	tx, err := s.outboxTable.StartTxn(true, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.outboxTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	res, err := s.outboxTable.GetTxnLimit(tx, limit, "id", name)
+	out := make([]*structs.OutboxEntry, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.OutboxEntry)
+	}
+	return idx, out, err
+}
+
+// OutboxAck is used to remove the entries of a subscription that
+// have been delivered. Unknown IDs are ignored, since an entry may be
+// acknowledged more than once.
+func (s *StateStore) OutboxAck(index uint64, name string, ids []string) error {
+	tables := MDBTables{s.outboxSubTable, s.outboxTable}
+	tx, err := tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	deleted := 0
+	for _, id := range ids {
+		n, err := s.outboxTable.DeleteTxn(tx, "id", name, id)
+		if err != nil {
+			return err
+		}
+		deleted += n
+	}
+	if deleted == 0 {
+		return nil
+	}
+	if err := s.outboxTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+
+	// Update the count of the undelivered entries. A snapshot of an older
+	// version has no count, so it is kept from going negative.
+	res, err := s.outboxSubTable.GetTxn(tx, "id", name)
+	if err != nil {
+		return err
+	}
+	if len(res) > 0 {
+		sub := res[0].(*structs.OutboxSubscription)
+		sub.Pending -= deleted
+		if sub.Pending < 0 {
+			sub.Pending = 0
+		}
+		if err := s.outboxSubTable.InsertTxn(tx, sub); err != nil {
+			return err
+		}
+	}
+	s.notifyTables(tx, s.outboxTable)
+	return tx.Commit()
+}
+
+// OutboxSubscriptionRestore is used to restore a subscription from a snapshot
+func (s *StateStore) OutboxSubscriptionRestore(sub *structs.OutboxSubscription) error {
+	tx, err := s.outboxSubTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.outboxSubTable.InsertTxn(tx, sub); err != nil {
+		return err
+	}
+	if err := s.outboxSubTable.SetMaxLastIndexTxn(tx, sub.ModifyIndex); err != nil {
+		return err
+	}
+	if err := s.outboxReindexTxn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// OutboxEntryRestore is used to restore an undelivered entry from a snapshot
+func (s *StateStore) OutboxEntryRestore(e *structs.OutboxEntry) error {
+	tx, err := s.outboxTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.outboxTable.InsertTxn(tx, e); err != nil {
+		return err
+	}
+	if err := s.outboxTable.SetMaxLastIndexTxn(tx, e.CreateIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// outboxRecordTxn is used to record a KV change in the outbox of every
+// subscription whose prefix matches the key. Since this happens in the
+// same txn as the change, a committed change is never lost, unless the
+// subscription is at its cap, in which case its oldest entry is dropped.
+func (s *StateStore) outboxRecordTxn(index uint64, tx *MDBTxn, op structs.KVSOp, d *structs.DirEntry) error {
+	names := s.outboxIndex.match(d.Key)
+	if len(names) == 0 {
+		return nil
+	}
+
+	recorded := false
+	for _, name := range names {
+		res, err := s.outboxSubTable.GetTxn(tx, "id", name)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			continue
+		}
+		sub := res[0].(*structs.OutboxSubscription)
+
+		// A key changed more than once in a txn replaces its entry
+		id := outboxEntryID(index, d.Key)
+		exist, err := s.outboxTable.GetTxn(tx, "id", sub.Name, id)
+		if err != nil {
+			return err
+		}
+		if len(exist) == 0 {
+			if err := s.outboxDropTxn(tx, sub); err != nil {
+				return err
+			}
+			sub.Pending++
+		}
+
+		e := &structs.OutboxEntry{
+			Subscription: sub.Name,
+			ID:           id,
+			Op:           op,
+			Entry:        *d,
+			CreateIndex:  index,
+		}
+		if err := s.outboxTable.InsertTxn(tx, e); err != nil {
+			return err
+		}
+		if err := s.outboxSubTable.InsertTxn(tx, sub); err != nil {
+			return err
+		}
+		recorded = true
+	}
+	if !recorded {
+		return nil
+	}
+	if err := s.outboxTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.outboxTable)
+	return nil
+}
+
+// outboxDropTxn is used to drop the oldest entries of a subscription
+// until there is room for a new one under its cap
+func (s *StateStore) outboxDropTxn(tx *MDBTxn, sub *structs.OutboxSubscription) error {
+	for sub.MaxPending > 0 && sub.Pending >= sub.MaxPending {
+		res, err := s.outboxTable.GetTxnLimit(tx, 1, "id", sub.Name)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			// The count is off, such as after restoring a snapshot of
+			// an older version, so start over from the actual entries
+			sub.Pending = 0
+			return nil
+		}
+		oldest := res[0].(*structs.OutboxEntry)
+		if _, err := s.outboxTable.DeleteTxn(tx, "id", sub.Name, oldest.ID); err != nil {
+			return err
+		}
+		sub.Pending--
+		sub.Dropped++
+
+		// Each drop is reported once the txn commits, since the
+		// consumer of the subscription misses the change
+		name, id, maxPending := sub.Name, oldest.ID, sub.MaxPending
+		tx.Defer(func() {
+			s.logger.Warn("Dropped outbox entry of lagging subscription",
+				"subscription", name, "entry", id, "max_pending", maxPending)
+			metrics.IncrCounter([]string{"consul", "outbox", "dropped"}, 1)
+		})
+	}
+	return nil
+}
+
+// outboxEntryID orders the entries of a subscription by index. The key
+// is included since a single index can change many keys.
+func outboxEntryID(index uint64, key string) string {
+	return fmt.Sprintf("%016x/%s", index, key)
+}
+
+// kvsSet is the internal setter
+func (s *StateStore) kvsSet(
+	index uint64,
+	d *structs.DirEntry,
+	mode kvMode) (bool, error) {
+	// Start a new txn
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	if ok, err := s.kvsSetTxn(index, tx, d, mode); !ok || err != nil {
+		return ok, err
+	}
+	return true, tx.Commit()
+}
+
+// kvsSetTxn is the internal setter within an existing transaction. It
+// returns false if the check-and-set, lock or unlock didn't apply.
+func (s *StateStore) kvsSetTxn(index uint64, tx *MDBTxn, d *structs.DirEntry, mode kvMode) (bool, error) {
+	// Get the existing node
+	res, err := s.kvsTable.GetTxn(tx, "id", d.Key)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the existing node if any
+	var exist *structs.DirEntry
+	if len(res) > 0 {
+		exist = res[0].(*structs.DirEntry)
+	}
+
+	// Use the ModifyIndex as the constraint. A modify of time of 0
+	// means we are doing a set-if-not-exists, while any other value
+	// means we expect that modify time.
+	if mode == kvCAS {
+		if d.ModifyIndex == 0 && exist != nil {
+			return false, nil
+		} else if d.ModifyIndex > 0 && (exist == nil || exist.ModifyIndex != d.ModifyIndex) {
+			return false, nil
+		}
+	}
+
+	// If attempting to lock, check this is possible
+	if mode == kvLock {
+		// Verify we have a session
+		if d.Session == "" {
+			return false, fmt.Errorf("Missing session")
+		}
+
+		// Bail if it is already locked
+		if exist != nil && exist.Session != "" {
+			return false, nil
+		}
+
+		// Bail if the key is within a lock delay window. The lookup by
+		// key is a prefix scan, which also returns the windows of the
+		// keys that start with the key and the index separator.
+		delays, err := s.lockDelayTable.GetTxn(tx, "id", d.Key)
+		if err != nil {
+			return false, err
+		}
+		for _, raw := range delays {
+			if raw.(*structs.LockDelay).Key == d.Key {
+				return false, nil
+			}
+		}
+
+		// Verify the session exists
+		res, err := s.sessionTable.GetTxn(tx, "id", d.Session)
+		if err != nil {
+			return false, err
+		}
+		if len(res) == 0 {
+			return false, fmt.Errorf("Invalid session")
+		}
+
+		// Update the lock index
+		if exist != nil {
+			exist.LockIndex++
+			exist.Session = d.Session
+		} else {
+			d.LockIndex = 1
+		}
+	}
+
+	// If attempting to unlock, verify the key exists and is held
+	if mode == kvUnlock {
+		if exist == nil || exist.Session != d.Session {
+			return false, nil
+		}
+		// Clear the session to unlock
+		exist.Session = ""
+	}
+
+	// Set the create and modify times
+	if exist == nil {
+		d.CreateIndex = index
+	} else {
+		d.CreateIndex = exist.CreateIndex
+		d.LockIndex = exist.LockIndex
+		d.Session = exist.Session
+
+	}
+	d.ModifyIndex = index
+
+	if err := s.kvsTable.InsertTxn(tx, d); err != nil {
+		return false, err
+	}
+	if err := s.kvsRecordVersionTxn(index, tx, d, false); err != nil {
+		return false, err
+	}
+	if err := s.outboxRecordTxn(index, tx, structs.KVSSet, d); err != nil {
+		return false, err
+	}
+	if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	s.notifyKV(tx, d.Key, false)
+	return true, nil
 }
 
 // ReapTombstones is used to delete all the tombstones with a ModifyTime
@@ -1588,19 +3311,19 @@ func (s *StateStore) ReapTombstones(index uint64) error {
 		}
 	}()
 	if err := s.tombstoneTable.StreamTxn(streamCh, tx, "id"); err != nil {
-		s.logger.Printf("[ERR] consul.state: failed to scan tombstones: %v", err)
+		s.logger.Error("Failed to scan tombstones", "error", err)
 		return fmt.Errorf("failed to scan tombstones: %v", err)
 	}
 	<-doneCh
 
 	// Delete each tombstone
 	if len(toDelete) > 0 {
-		s.logger.Printf("[DEBUG] consul.state: reaping %d tombstones up to %d", len(toDelete), index)
+		s.logger.Debug("Reaping tombstones", "count", len(toDelete), "index", index)
 	}
 	for _, key := range toDelete {
 		num, err := s.tombstoneTable.DeleteTxn(tx, "id", key)
 		if err != nil {
-			s.logger.Printf("[ERR] consul.state: failed to delete tombstone: %v", err)
+			s.logger.Error("Failed to delete tombstone", "key", key, "error", err)
 			return fmt.Errorf("failed to delete tombstone: %v", err)
 		}
 		if num != 1 {
@@ -1626,9 +3349,36 @@ func (s *StateStore) TombstoneRestore(d *structs.DirEntry) error {
 	return tx.Commit()
 }
 
+// SetLogger replaces the logger of the state store, which defaults to
+// writing to the log output the store was created with. It must be set
+// before the state store is in use.
+func (s *StateStore) SetLogger(logger StateLogger) {
+	s.logger = logger
+}
+
+// SetMaxSize sets the maximum size of the state store, which bounds the
+// memory map of the underlying LMDB environment. The state is paged from
+// disk, so it may grow past the available memory up to this size. Zero
+// keeps the default for the platform. It must be set before the state
+// store is in use, since the map can't be resized during a transaction.
+func (s *StateStore) SetMaxSize(size uint64) error {
+	if size == 0 {
+		return nil
+	}
+	return s.env.SetMapSize(size)
+}
+
 // SessionCreate is used to create a new session. The
 // ID will be populated on a successful return
 func (s *StateStore) SessionCreate(index uint64, session *structs.Session) error {
+	return s.SessionCreateWithLimit(index, session, 0)
+}
+
+// SessionCreateWithLimit is like SessionCreate, but fails with a
+// SessionLimitError if the node already holds limit sessions. The limit
+// comes from the replicated request, so that every server applies the
+// same one. Zero disables the limit.
+func (s *StateStore) SessionCreateWithLimit(index uint64, session *structs.Session, limit int) error {
 	// Verify a Session ID is generated
 	if session.ID == "" {
 		return fmt.Errorf("Missing Session ID")
@@ -1644,8 +3394,9 @@ func (s *StateStore) SessionCreate(index uint64, session *structs.Session) error
 		return fmt.Errorf("Invalid Session Behavior setting '%s'", session.Behavior)
 	}
 
-	// Assign the create index
+	// Assign the create and modify indexes
 	session.CreateIndex = index
+	session.ModifyIndex = index
 
 	// Start the transaction
 	tx, err := s.tables.StartTxn(false)
@@ -1663,6 +3414,17 @@ func (s *StateStore) SessionCreate(index uint64, session *structs.Session) error
 		return fmt.Errorf("Missing node registration")
 	}
 
+	// Verify that the node is within its session limit
+	if limit > 0 {
+		res, err := s.sessionTable.GetTxn(tx, "node", session.Node)
+		if err != nil {
+			return err
+		}
+		if len(res) >= limit {
+			return &SessionLimitError{Node: session.Node, Limit: limit}
+		}
+	}
+
 	// Verify that the checks exist and are not critical
 	for _, checkId := range session.Checks {
 		res, err := s.checkTable.GetTxn(tx, "id", session.Node, checkId)
@@ -1696,7 +3458,41 @@ func (s *StateStore) SessionCreate(index uint64, session *structs.Session) error
 	if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.sessionTable].Notify() })
+	s.notifyTables(tx, s.sessionTable)
+	return tx.Commit()
+}
+
+// SessionRenew is used to record the renewal of a session. Only the
+// ModifyIndex of the session itself is updated, so a renewal doesn't
+// disturb the indexes of any other table. The TTL timers are run by
+// the leader, which resets them on Session.Renew.
+func (s *StateStore) SessionRenew(index uint64, id string) error {
+	tx, err := s.sessionTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.sessionTable.GetTxn(tx, "id", id)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return fmt.Errorf("Session '%s' not found", id)
+	}
+	session := res[0].(*structs.Session)
+
+	// Update the modify index
+	session.ModifyIndex = index
+	if err := s.sessionTable.InsertTxn(tx, session); err != nil {
+		return err
+	}
+
+	// Trigger the update notifications
+	if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.sessionTable)
 	return tx.Commit()
 }
 
@@ -1726,15 +3522,19 @@ func (s *StateStore) SessionRestore(session *structs.Session) error {
 
 	// Trigger the update notifications
 	index := session.CreateIndex
+	if session.ModifyIndex > index {
+		index = session.ModifyIndex
+	}
 	if err := s.sessionTable.SetMaxLastIndexTxn(tx, index); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.sessionTable].Notify() })
+	s.notifyTables(tx, s.sessionTable)
 	return tx.Commit()
 }
 
 // SessionGet is used to get a session entry
 func (s *StateStore) SessionGet(id string) (uint64, *structs.Session, error) {
+	defer s.measureQuery("SessionGet", time.Now(), "session", id)
 	idx, res, err := s.sessionTable.Get("id", id)
 	var d *structs.Session
 	if len(res) > 0 {
@@ -1743,8 +3543,36 @@ func (s *StateStore) SessionGet(id string) (uint64, *structs.Session, error) {
 	return idx, d, err
 }
 
+// SessionsByID is used to get a set of sessions in the order of their
+// IDs. The sessions that don't exist are skipped.
+func (s *StateStore) SessionsByID(ids []string) (uint64, []*structs.Session, error) {
+	defer s.measureQuery("SessionsByID", time.Now())
+	tx, err := s.sessionTable.StartTxn(true, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.sessionTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	out := make([]*structs.Session, 0, len(ids))
+	for _, id := range ids {
+		res, err := s.sessionTable.GetTxn(tx, "id", id)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(res) > 0 {
+			out = append(out, res[0].(*structs.Session))
+		}
+	}
+	return idx, out, nil
+}
+
 // SessionList is used to list all the open sessions
 func (s *StateStore) SessionList() (uint64, []*structs.Session, error) {
+	defer s.measureQuery("SessionList", time.Now())
 	idx, res, err := s.sessionTable.Get("id")
 	out := make([]*structs.Session, len(res))
 	for i, raw := range res {
@@ -1755,11 +3583,19 @@ func (s *StateStore) SessionList() (uint64, []*structs.Session, error) {
 
 // NodeSessions is used to list all the open sessions for a node
 func (s *StateStore) NodeSessions(node string) (uint64, []*structs.Session, error) {
+	return s.SessionListByNode(node)
+}
+
+// SessionListByNode is used to list the open sessions of a node,
+// using the node index of the session table
+func (s *StateStore) SessionListByNode(node string) (uint64, []*structs.Session, error) {
+	defer s.measureQuery("SessionListByNode", time.Now(), "node", node)
 	idx, res, err := s.sessionTable.Get("node", node)
 	out := make([]*structs.Session, len(res))
 	for i, raw := range res {
 		out[i] = raw.(*structs.Session)
 	}
+	sort.Sort(sessionsByID(out))
 	return idx, out, err
 }
 
@@ -1771,8 +3607,7 @@ func (s *StateStore) SessionDestroy(index uint64, id string) error {
 	}
 	defer tx.Abort()
 
-	s.logger.Printf("[DEBUG] consul.state: Invalidating session %s due to session destroy",
-		id)
+	s.logger.Debug("Invalidating session", "session", id, "reason", "destroy")
 	if err := s.invalidateSession(index, tx, id); err != nil {
 		return err
 	}
@@ -1788,8 +3623,7 @@ func (s *StateStore) invalidateNode(index uint64, tx *MDBTxn, node string) error
 	}
 	for _, sess := range sessions {
 		session := sess.(*structs.Session).ID
-		s.logger.Printf("[DEBUG] consul.state: Invalidating session %s due to node '%s' invalidation",
-			session, node)
+		s.logger.Debug("Invalidating session", "session", session, "reason", "node", "node", node)
 		if err := s.invalidateSession(index, tx, session); err != nil {
 			return err
 		}
@@ -1806,8 +3640,7 @@ func (s *StateStore) invalidateCheck(index uint64, tx *MDBTxn, node, check strin
 	}
 	for _, sc := range sessionChecks {
 		session := sc.(*sessionCheck).Session
-		s.logger.Printf("[DEBUG] consul.state: Invalidating session %s due to check '%s' invalidation",
-			session, check)
+		s.logger.Debug("Invalidating session", "session", session, "reason", "check", "node", node, "check", check)
 		if err := s.invalidateSession(index, tx, session); err != nil {
 			return err
 		}
@@ -1845,6 +3678,11 @@ func (s *StateStore) invalidateSession(index uint64, tx *MDBTxn, id string) erro
 		return err
 	}
 
+	// Release any external claims
+	if err := s.releaseClaimsTxn(index, tx, "session", id); err != nil {
+		return err
+	}
+
 	// Nuke the session
 	if _, err := s.sessionTable.DeleteTxn(tx, "id", id); err != nil {
 		return err
@@ -1862,7 +3700,7 @@ func (s *StateStore) invalidateSession(index uint64, tx *MDBTxn, id string) erro
 	if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.sessionTable].Notify() })
+	s.notifyTables(tx, s.sessionTable)
 	return nil
 }
 
@@ -1875,13 +3713,6 @@ func (s *StateStore) invalidateLocks(index uint64, tx *MDBTxn,
 		return err
 	}
 
-	var expires time.Time
-	if lockDelay > 0 {
-		s.lockDelayLock.Lock()
-		defer s.lockDelayLock.Unlock()
-		expires = time.Now().Add(lockDelay)
-	}
-
 	for _, pair := range pairs {
 		kv := pair.(*structs.DirEntry)
 		kv.Session = ""        // Clear the lock
@@ -1889,17 +3720,20 @@ func (s *StateStore) invalidateLocks(index uint64, tx *MDBTxn,
 		if err := s.kvsTable.InsertTxn(tx, kv); err != nil {
 			return err
 		}
+		if err := s.kvsRecordVersionTxn(index, tx, kv, false); err != nil {
+			return err
+		}
+		if err := s.outboxRecordTxn(index, tx, structs.KVSSet, kv); err != nil {
+			return err
+		}
 		// If there is a lock delay, prevent acquisition
 		// for at least lockDelay period
 		if lockDelay > 0 {
-			s.lockDelay[kv.Key] = expires
-			time.AfterFunc(lockDelay, func() {
-				s.lockDelayLock.Lock()
-				delete(s.lockDelay, kv.Key)
-				s.lockDelayLock.Unlock()
-			})
+			if err := s.lockDelayTxn(index, tx, kv.Key, id, lockDelay); err != nil {
+				return err
+			}
 		}
-		tx.Defer(func() { s.notifyKV(kv.Key, false) })
+		s.notifyKV(tx, kv.Key, false)
 	}
 	if len(pairs) > 0 {
 		if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
@@ -1918,13 +3752,6 @@ func (s *StateStore) deleteLocks(index uint64, tx *MDBTxn,
 		return err
 	}
 
-	var expires time.Time
-	if lockDelay > 0 {
-		s.lockDelayLock.Lock()
-		defer s.lockDelayLock.Unlock()
-		expires = time.Now().Add(lockDelay)
-	}
-
 	for _, pair := range pairs {
 		kv := pair.(*structs.DirEntry)
 		if err := s.kvsDeleteWithIndexTxn(index, tx, "id", kv.Key); err != nil {
@@ -1934,12 +3761,9 @@ func (s *StateStore) deleteLocks(index uint64, tx *MDBTxn,
 		// If there is a lock delay, prevent acquisition
 		// for at least lockDelay period
 		if lockDelay > 0 {
-			s.lockDelay[kv.Key] = expires
-			time.AfterFunc(lockDelay, func() {
-				s.lockDelayLock.Lock()
-				delete(s.lockDelay, kv.Key)
-				s.lockDelayLock.Unlock()
-			})
+			if err := s.lockDelayTxn(index, tx, kv.Key, id, lockDelay); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -1986,7 +3810,7 @@ func (s *StateStore) ACLSet(index uint64, acl *structs.ACL) error {
 	if err := s.aclTable.SetLastIndexTxn(tx, index); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.aclTable].Notify() })
+	s.notifyTables(tx, s.aclTable)
 	return tx.Commit()
 }
 
@@ -2011,6 +3835,7 @@ func (s *StateStore) ACLRestore(acl *structs.ACL) error {
 
 // ACLGet is used to get an ACL by ID
 func (s *StateStore) ACLGet(id string) (uint64, *structs.ACL, error) {
+	defer s.measureQuery("ACLGet", time.Now(), "acl", id)
 	idx, res, err := s.aclTable.Get("id", id)
 	var d *structs.ACL
 	if len(res) > 0 {
@@ -2021,6 +3846,7 @@ func (s *StateStore) ACLGet(id string) (uint64, *structs.ACL, error) {
 
 // ACLList is used to list all the acls
 func (s *StateStore) ACLList() (uint64, []*structs.ACL, error) {
+	defer s.measureQuery("ACLList", time.Now())
 	idx, res, err := s.aclTable.Get("id")
 	out := make([]*structs.ACL, len(res))
 	for i, raw := range res {
@@ -2043,7 +3869,376 @@ func (s *StateStore) ACLDelete(index uint64, id string) error {
 		if err := s.aclTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.aclTable].Notify() })
+		s.notifyTables(tx, s.aclTable)
+	}
+	return tx.Commit()
+}
+
+// AreaSet is used to create or update a network area. There is at most
+// one area per peer datacenter.
+func (s *StateStore) AreaSet(index uint64, area *structs.Area) error {
+	if area.ID == "" {
+		return fmt.Errorf("Missing area ID")
+	}
+	if area.PeerDatacenter == "" {
+		return fmt.Errorf("Missing peer datacenter")
+	}
+
+	tx, err := s.areaTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.areaTable.GetTxn(tx, "peer", area.PeerDatacenter)
+	if err != nil {
+		return err
+	}
+	if len(res) > 0 && res[0].(*structs.Area).ID != area.ID {
+		return fmt.Errorf("An area already links to datacenter '%s'", area.PeerDatacenter)
+	}
+
+	res, err = s.areaTable.GetTxn(tx, "id", area.ID)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		area.CreateIndex = index
+	} else {
+		// Replace the existing area, which may have another peer
+		area.CreateIndex = res[0].(*structs.Area).CreateIndex
+		if _, err := s.areaTable.DeleteTxn(tx, "id", area.ID); err != nil {
+			return err
+		}
+	}
+	area.ModifyIndex = index
+
+	if err := s.areaTable.InsertTxn(tx, area); err != nil {
+		return err
+	}
+	if err := s.areaTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.areaTable)
+	return tx.Commit()
+}
+
+// AreaRestore is used to restore a network area. It should only be used
+// when doing a restore, otherwise AreaSet should be used.
+func (s *StateStore) AreaRestore(area *structs.Area) error {
+	tx, err := s.areaTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.areaTable.InsertTxn(tx, area); err != nil {
+		return err
+	}
+	if err := s.areaTable.SetMaxLastIndexTxn(tx, area.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AreaGet is used to get a network area by ID
+func (s *StateStore) AreaGet(id string) (uint64, *structs.Area, error) {
+	defer s.measureQuery("AreaGet", time.Now())
+	idx, res, err := s.areaTable.Get("id", id)
+	var area *structs.Area
+	if len(res) > 0 {
+		area = res[0].(*structs.Area)
+	}
+	return idx, area, err
+}
+
+// AreaList is used to list the network areas
+func (s *StateStore) AreaList() (uint64, structs.Areas, error) {
+	defer s.measureQuery("AreaList", time.Now())
+	idx, res, err := s.areaTable.Get("id")
+	out := make(structs.Areas, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.Area)
+	}
+	return idx, out, err
+}
+
+// AreaDelete is used to delete a network area
+func (s *StateStore) AreaDelete(index uint64, id string) error {
+	tx, err := s.areaTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if n, err := s.areaTable.DeleteTxn(tx, "id", id); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.areaTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		s.notifyTables(tx, s.areaTable)
+	}
+	return tx.Commit()
+}
+
+// ServerHealthSet is used to record the health of a server. The time
+// the server became stable is kept while its health is unchanged, so
+// the leader may always provide the current time.
+func (s *StateStore) ServerHealthSet(index uint64, health *structs.ServerHealth) error {
+	if health.Name == "" {
+		return fmt.Errorf("Missing server name")
+	}
+	tx, err := s.serverHealthTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.serverHealthTable.GetTxn(tx, "id", health.Name)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		health.CreateIndex = index
+	} else {
+		exist := res[0].(*structs.ServerHealth)
+		health.CreateIndex = exist.CreateIndex
+		if exist.Healthy == health.Healthy && exist.StableSince != 0 {
+			health.StableSince = exist.StableSince
+		}
+	}
+	health.ModifyIndex = index
+
+	if err := s.serverHealthTable.InsertTxn(tx, health); err != nil {
+		return err
+	}
+	if err := s.serverHealthTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.serverHealthTable)
+	return tx.Commit()
+}
+
+// ServerHealthDelete is used to remove the health of a server that
+// has left the cluster
+func (s *StateStore) ServerHealthDelete(index uint64, name string) error {
+	tx, err := s.serverHealthTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if n, err := s.serverHealthTable.DeleteTxn(tx, "id", name); err != nil {
+		return err
+	} else if n == 0 {
+		return nil
+	}
+	if err := s.serverHealthTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.serverHealthTable)
+	return tx.Commit()
+}
+
+// ServerHealthGet is used to get the health of a server
+func (s *StateStore) ServerHealthGet(name string) (uint64, *structs.ServerHealth, error) {
+	idx, res, err := s.serverHealthTable.Get("id", name)
+	var h *structs.ServerHealth
+	if len(res) > 0 {
+		h = res[0].(*structs.ServerHealth)
+	}
+	return idx, h, err
+}
+
+// ServerHealthList is used to list the health of all the servers
+func (s *StateStore) ServerHealthList() (uint64, []*structs.ServerHealth, error) {
+	defer s.measureQuery("ServerHealthList", time.Now())
+	idx, res, err := s.serverHealthTable.Get("id")
+	out := make([]*structs.ServerHealth, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ServerHealth)
+	}
+	return idx, out, err
+}
+
+// DeadServers returns the servers that have been unhealthy for at
+// least the given threshold, and can be removed by the leader
+func (s *StateStore) DeadServers(now time.Time, threshold time.Duration) ([]*structs.ServerHealth, error) {
+	_, servers, err := s.ServerHealthList()
+	if err != nil {
+		return nil, err
+	}
+	var out []*structs.ServerHealth
+	for _, h := range servers {
+		if !h.Healthy && h.StableFor(now) >= threshold {
+			out = append(out, h)
+		}
+	}
+	return out, nil
+}
+
+// PromotableServers returns the non-voting servers that have been
+// healthy for at least the given threshold, and can safely be promoted
+// to voters by the leader
+func (s *StateStore) PromotableServers(now time.Time, threshold time.Duration) ([]*structs.ServerHealth, error) {
+	_, servers, err := s.ServerHealthList()
+	if err != nil {
+		return nil, err
+	}
+	var out []*structs.ServerHealth
+	for _, h := range servers {
+		if !h.Voter && h.Healthy && h.StableFor(now) >= threshold {
+			out = append(out, h)
+		}
+	}
+	return out, nil
+}
+
+// ServerHealthRestore is used to restore the health of a server from
+// a snapshot
+func (s *StateStore) ServerHealthRestore(health *structs.ServerHealth) error {
+	tx, err := s.serverHealthTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.serverHealthTable.InsertTxn(tx, health); err != nil {
+		return err
+	}
+	if err := s.serverHealthTable.SetMaxLastIndexTxn(tx, health.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// catalogAuditID orders the audit records by the index of the change
+func catalogAuditID(index uint64) string {
+	return fmt.Sprintf("%016x", index)
+}
+
+// CatalogAuditRecord is used to record a catalog change. The leader
+// trims the oldest records with CatalogAuditTrim.
+func (s *StateStore) CatalogAuditRecord(index uint64, audit *structs.CatalogAudit) error {
+	tx, err := s.catalogAuditTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	audit.ID = catalogAuditID(index)
+	audit.CreateIndex = index
+	if err := s.catalogAuditTable.InsertTxn(tx, audit); err != nil {
+		return err
+	}
+	if err := s.catalogAuditTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.catalogAuditTable)
+	return tx.Commit()
+}
+
+// CatalogAuditTrimIndex returns the index of the newest record that
+// must be trimmed to retain at most limit records, or zero if there
+// are no more records than that
+func (s *StateStore) CatalogAuditTrimIndex(limit int) (uint64, error) {
+	tx, err := s.catalogAuditTable.StartTxn(true, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Abort()
+
+	num, err := s.catalogAuditTable.CountTxn(tx, "id")
+	if err != nil {
+		return 0, err
+	}
+	excess := num - limit
+	if excess <= 0 {
+		return 0, nil
+	}
+	oldest, err := s.catalogAuditTable.GetTxnLimit(tx, excess, "id")
+	if err != nil {
+		return 0, err
+	}
+	if len(oldest) == 0 {
+		return 0, nil
+	}
+	return oldest[len(oldest)-1].(*structs.CatalogAudit).CreateIndex, nil
+}
+
+// CatalogAuditTrim is used to delete the catalog audit records created
+// at or before the trim index. The leader applies this to bound the
+// table, so that all the servers retain the same records.
+func (s *StateStore) CatalogAuditTrim(index, trimIndex uint64) error {
+	tx, err := s.catalogAuditTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	// Records are ordered by their index, oldest first
+	res, err := s.catalogAuditTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	for _, raw := range res {
+		audit := raw.(*structs.CatalogAudit)
+		if audit.CreateIndex > trimIndex {
+			break
+		}
+		if _, err := s.catalogAuditTable.DeleteTxn(tx, "id", audit.ID); err != nil {
+			return err
+		}
+	}
+	if err := s.catalogAuditTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	s.notifyTables(tx, s.catalogAuditTable)
+	return tx.Commit()
+}
+
+// CatalogAuditList is used to list the catalog audit records within a
+// time range, oldest first. The records can be limited to a node, and a
+// zero time leaves that end of the range open.
+func (s *StateStore) CatalogAuditList(node string, start, end int64) (uint64, structs.CatalogAudits, error) {
+	defer s.measureQuery("CatalogAuditList", time.Now(), "node", node)
+	var idx uint64
+	var res []interface{}
+	var err error
+	if node == "" {
+		idx, res, err = s.catalogAuditTable.Get("id")
+	} else {
+		idx, res, err = s.catalogAuditTable.Get("node", node)
+	}
+	var out structs.CatalogAudits
+	for _, raw := range res {
+		audit := raw.(*structs.CatalogAudit)
+		if start != 0 && audit.Time < start {
+			continue
+		}
+		if end != 0 && audit.Time > end {
+			continue
+		}
+		out = append(out, audit)
+	}
+	return idx, out, err
+}
+
+// CatalogAuditRestore is used to restore a catalog audit record from
+// a snapshot
+func (s *StateStore) CatalogAuditRestore(audit *structs.CatalogAudit) error {
+	tx, err := s.catalogAuditTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.catalogAuditTable.InsertTxn(tx, audit); err != nil {
+		return err
+	}
+	if err := s.catalogAuditTable.SetMaxLastIndexTxn(tx, audit.CreateIndex); err != nil {
+		return err
 	}
 	return tx.Commit()
 }
@@ -2077,12 +4272,41 @@ func (s *StateSnapshot) LastIndex() uint64 {
 	return s.lastIndex
 }
 
+// RecordCounts returns the number of rows in each table that is
+// persisted in a snapshot, keyed by table name
+func (s *StateSnapshot) RecordCounts() (map[string]uint64, error) {
+	tables := []*MDBTable{s.store.nodeTable, s.store.serviceTable,
+		s.store.checkTable, s.store.kvsTable, s.store.kvsHistoryTable,
+		s.store.tombstoneTable, s.store.sessionTable, s.store.aclTable, s.store.lockDelayTable,
+		s.store.outboxSubTable, s.store.outboxTable, s.store.serverHealthTable,
+		s.store.catalogAuditTable, s.store.claimTable, s.store.maintTable,
+		s.store.autopilotTable, s.store.autoEncryptTable, s.store.areaTable,
+		s.store.peeringTable, s.store.exportedTable, s.store.importedTable,
+		s.store.retentionTable}
+	counts := make(map[string]uint64, len(tables))
+	for _, table := range tables {
+		num, err := table.CountTxn(s.tx, "id")
+		if err != nil {
+			return nil, err
+		}
+		counts[table.Name] = uint64(num)
+	}
+	return counts, nil
+}
+
+// NodeDump is used to dump all the nodes. It takes a channel and streams
+// back *struct.Node objects. This will block and should be invoked
+// in a goroutine.
+func (s *StateSnapshot) NodeDump(stream chan<- interface{}) error {
+	return s.store.nodeTable.StreamTxn(stream, s.tx, "id")
+}
+
 // Nodes returns all the known nodes, the slice alternates between
 // the node name and address
 func (s *StateSnapshot) Nodes() structs.Nodes {
 	res, err := s.store.nodeTable.GetTxn(s.tx, "id")
 	if err != nil {
-		s.store.logger.Printf("[ERR] consul.state: Failed to get nodes: %v", err)
+		s.store.logger.Error("Failed to get nodes", "error", err)
 		return nil
 	}
 	results := make([]structs.Node, len(res))
@@ -2119,6 +4343,19 @@ func (s *StateSnapshot) TombstoneDump(stream chan<- interface{}) error {
 	return s.store.tombstoneTable.StreamTxn(stream, s.tx, "id")
 }
 
+// KVSHistoryDump is used to dump the versions of the KV history. It takes
+// a channel and streams back *kvsVersion objects. This will block and
+// should be invoked in a goroutine.
+func (s *StateSnapshot) KVSHistoryDump(stream chan<- interface{}) error {
+	return s.store.kvsHistoryTable.StreamTxn(stream, s.tx, "id")
+}
+
+// RetentionDump is used to dump the retention. This should be invoked
+// in a goroutine.
+func (s *StateSnapshot) RetentionDump(stream chan<- interface{}) error {
+	return s.store.retentionTable.StreamTxn(stream, s.tx, "id")
+}
+
 // SessionList is used to list all the open sessions
 func (s *StateSnapshot) SessionList() ([]*structs.Session, error) {
 	res, err := s.store.sessionTable.GetTxn(s.tx, "id")
@@ -2129,6 +4366,116 @@ func (s *StateSnapshot) SessionList() ([]*structs.Session, error) {
 	return out, err
 }
 
+// SessionDump is used to dump all the open sessions. This should be
+// done in a goroutine.
+func (s *StateSnapshot) SessionDump(stream chan<- interface{}) error {
+	return s.store.sessionTable.StreamTxn(stream, s.tx, "id")
+}
+
+// LockDelayDump is used to dump all the open lock delay windows. This
+// should be done in a goroutine.
+func (s *StateSnapshot) LockDelayDump(stream chan<- interface{}) error {
+	return s.store.lockDelayTable.StreamTxn(stream, s.tx, "id")
+}
+
+// OutboxSubscriptionDump is used to dump all the outbox subscriptions.
+// This should be done in a goroutine.
+func (s *StateSnapshot) OutboxSubscriptionDump(stream chan<- interface{}) error {
+	return s.store.outboxSubTable.StreamTxn(stream, s.tx, "id")
+}
+
+// LockDelays is used to list all the open lock delay windows
+func (s *StateSnapshot) LockDelays() ([]*structs.LockDelay, error) {
+	res, err := s.store.lockDelayTable.GetTxn(s.tx, "id")
+	out := make([]*structs.LockDelay, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.LockDelay)
+	}
+	return out, err
+}
+
+// OutboxSubscriptions is used to list all the outbox subscriptions
+func (s *StateSnapshot) OutboxSubscriptions() ([]*structs.OutboxSubscription, error) {
+	res, err := s.store.outboxSubTable.GetTxn(s.tx, "id")
+	out := make([]*structs.OutboxSubscription, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.OutboxSubscription)
+	}
+	return out, err
+}
+
+// OutboxDump is used to dump all the undelivered outbox entries. This
+// should be done in a goroutine.
+func (s *StateSnapshot) OutboxDump(stream chan<- interface{}) error {
+	return s.store.outboxTable.StreamTxn(stream, s.tx, "id")
+}
+
+// ServerHealthDump is used to dump the health of the servers. This
+// should be done in a goroutine.
+func (s *StateSnapshot) ServerHealthDump(stream chan<- interface{}) error {
+	return s.store.serverHealthTable.StreamTxn(stream, s.tx, "id")
+}
+
+// CatalogAuditDump is used to dump the catalog audit records. This
+// should be done in a goroutine.
+func (s *StateSnapshot) CatalogAuditDump(stream chan<- interface{}) error {
+	return s.store.catalogAuditTable.StreamTxn(stream, s.tx, "id")
+}
+
+// ExternalClaimDump is used to dump the external claims. This should be
+// done in a goroutine.
+func (s *StateSnapshot) ExternalClaimDump(stream chan<- interface{}) error {
+	return s.store.claimTable.StreamTxn(stream, s.tx, "id")
+}
+
+// MaintenanceDump is used to dump the maintenance flags. This should be
+// invoked in a goroutine.
+func (s *StateSnapshot) MaintenanceDump(stream chan<- interface{}) error {
+	return s.store.maintTable.StreamTxn(stream, s.tx, "id")
+}
+
+// AutopilotDump is used to dump the autopilot configuration. This should
+// be invoked in a goroutine.
+func (s *StateSnapshot) AutopilotDump(stream chan<- interface{}) error {
+	return s.store.autopilotTable.StreamTxn(stream, s.tx, "id")
+}
+
+// AutoEncryptTokenDump is used to dump the one-time tokens. This should
+// be invoked in a goroutine.
+func (s *StateSnapshot) AutoEncryptTokenDump(stream chan<- interface{}) error {
+	return s.store.autoEncryptTable.StreamTxn(stream, s.tx, "id")
+}
+
+// AreaDump is used to dump the network areas. This should be invoked in
+// a goroutine.
+func (s *StateSnapshot) AreaDump(stream chan<- interface{}) error {
+	return s.store.areaTable.StreamTxn(stream, s.tx, "id")
+}
+
+// PeeringDump is used to dump the peerings. This should be invoked in a
+// goroutine.
+func (s *StateSnapshot) PeeringDump(stream chan<- interface{}) error {
+	return s.store.peeringTable.StreamTxn(stream, s.tx, "id")
+}
+
+// ExportedServicesDump is used to dump the exported services
+// configuration. This should be invoked in a goroutine.
+func (s *StateSnapshot) ExportedServicesDump(stream chan<- interface{}) error {
+	return s.store.exportedTable.StreamTxn(stream, s.tx, "id")
+}
+
+// ImportedServiceDump is used to dump the services imported from the
+// peers. This should be invoked in a goroutine.
+func (s *StateSnapshot) ImportedServiceDump(stream chan<- interface{}) error {
+	return s.store.importedTable.StreamTxn(stream, s.tx, "id")
+}
+
+// ACLDump is used to dump all of the ACLs. This should be done in
+// a goroutine.
+func (s *StateSnapshot) ACLDump(stream chan<- interface{}) error {
+	return s.store.aclTable.StreamTxn(stream, s.tx, "id")
+}
+
 // ACLList is used to list all of the ACLs
 func (s *StateSnapshot) ACLList() ([]*structs.ACL, error) {
 	res, err := s.store.aclTable.GetTxn(s.tx, "id")
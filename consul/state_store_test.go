@@ -4,6 +4,7 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -24,7 +25,7 @@ func TestEnsureRegistration(t *testing.T) {
 	reg := &structs.RegisterRequest{
 		Node:    "foo",
 		Address: "127.0.0.1",
-		Service: &structs.NodeService{"api", "api", nil, "", 5000, false},
+		Service: &structs.NodeService{ID: "api", Service: "api", Port: 5000},
 		Check: &structs.HealthCheck{
 			Node:      "foo",
 			CheckID:   "api",
@@ -74,6 +75,89 @@ func TestEnsureRegistration(t *testing.T) {
 	}
 }
 
+func TestEnsureRegistrationCAS(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	reg := &structs.RegisterRequest{
+		Node:        "foo",
+		Address:     "127.0.0.1",
+		Service:     &structs.NodeService{ID: "api", Service: "api", Port: 5000},
+		CAS:         true,
+		ModifyIndex: 0,
+	}
+	if err := store.EnsureRegistrationCAS(10, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The service must not exist anymore
+	err = store.EnsureRegistrationCAS(11, reg)
+	conflict, ok := err.(*RegistrationConflictError)
+	if !ok || conflict.Kind != "service" || conflict.Actual != 10 {
+		t.Fatalf("err: %v", err)
+	}
+	if !structs.IsRegistrationConflict(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Registering the same entry keeps the ModifyIndex
+	reg.CAS = false
+	if err := store.EnsureRegistration(12, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes := store.ServiceNodes("api")
+	if len(nodes) != 1 || nodes[0].CreateIndex != 10 || nodes[0].ModifyIndex != 10 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// A change applies with the current index
+	reg.CAS, reg.ModifyIndex = true, 10
+	reg.Service.Port = 6000
+	if err := store.EnsureRegistrationCAS(13, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes = store.ServiceNodes("api")
+	if len(nodes) != 1 || nodes[0].CreateIndex != 10 || nodes[0].ModifyIndex != 13 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	if err := store.EnsureRegistrationCAS(14, reg); !structs.IsRegistrationConflict(err) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without a service, the node is the target
+	nodeReg := &structs.RegisterRequest{Node: "foo", Address: "127.0.0.2", CAS: true, ModifyIndex: 10}
+	if err := store.EnsureRegistrationCAS(15, nodeReg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, all := store.Nodes()
+	if len(all) != 1 || all[0].CreateIndex != 10 || all[0].ModifyIndex != 15 {
+		t.Fatalf("bad: %v", all)
+	}
+
+	// Deregistrations are checked against their target
+	dereg := &structs.DeregisterRequest{Node: "foo", ServiceID: "api", CAS: true, ModifyIndex: 10}
+	if err := store.DeleteRegistrationCAS(16, dereg); !structs.IsRegistrationConflict(err) {
+		t.Fatalf("err: %v", err)
+	}
+	dereg.ModifyIndex = 13
+	if err := store.DeleteRegistrationCAS(16, dereg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, nodes = store.ServiceNodes("api"); len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	dereg = &structs.DeregisterRequest{Node: "foo", CAS: true, ModifyIndex: 15}
+	if err := store.DeleteRegistrationCAS(17, dereg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, all = store.Nodes(); len(all) != 0 {
+		t.Fatalf("bad: %v", all)
+	}
+}
+
 func TestEnsureNode(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -81,7 +165,7 @@ func TestEnsureNode(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -90,7 +174,7 @@ func TestEnsureNode(t *testing.T) {
 		t.Fatalf("Bad: %v %v %v", idx, found, addr)
 	}
 
-	if err := store.EnsureNode(4, structs.Node{"foo", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(4, structs.Node{Node: "foo", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -100,6 +184,44 @@ func TestEnsureNode(t *testing.T) {
 	}
 }
 
+func TestNodesByAddress(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(40, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(41, structs.Node{Node: "bar", Address: "0:0::4242:4242"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(42, structs.Node{Node: "baz", Address: "::4242:4242"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, nodes := store.NodesByAddress("127.0.0.1")
+	if idx != 42 || len(nodes) != 1 || nodes[0].Node != "foo" {
+		t.Fatalf("bad: %v %v", idx, nodes)
+	}
+	_, nodes = store.NodesByAddress("::4242:4242")
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// The index follows the address changes
+	if err := store.EnsureNode(43, structs.Node{Node: "foo", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, nodes = store.NodesByAddress("127.0.0.1"); len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	if _, nodes = store.NodesByAddress("127.0.0.2"); len(nodes) != 1 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestGetNodes(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -107,11 +229,11 @@ func TestGetNodes(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(40, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(40, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(41, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(41, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -141,7 +263,7 @@ func TestGetNodes_Watch_StopWatch(t *testing.T) {
 	store.Watch(store.QueryTables("Nodes"), notify2)
 	store.StopWatch(store.QueryTables("Nodes"), notify2)
 
-	if err := store.EnsureNode(40, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(40, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -165,11 +287,11 @@ func BenchmarkGetNodes(b *testing.B) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(100, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(100, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		b.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(101, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(101, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		b.Fatalf("err: %v", err)
 	}
 
@@ -185,19 +307,19 @@ func TestEnsureService(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(10, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(11, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(11, "foo", &structs.NodeService{ID: "api", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5001, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{ID: "api", Service: "api", Port: 5001}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(13, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(13, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -230,19 +352,19 @@ func TestEnsureService_DuplicateNode(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(10, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(11, "foo", &structs.NodeService{"api1", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(11, "foo", &structs.NodeService{ID: "api1", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api2", "api", nil, "", 5001, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{ID: "api2", Service: "api", Port: 5001}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(13, "foo", &structs.NodeService{"api3", "api", nil, "", 5002, false}); err != nil {
+	if err := store.EnsureService(13, "foo", &structs.NodeService{ID: "api3", Service: "api", Port: 5002}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -283,11 +405,11 @@ func TestDeleteNodeService(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(11, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(11, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{ID: "api", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -331,15 +453,15 @@ func TestDeleteNodeService_One(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(11, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(11, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{ID: "api", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(13, "foo", &structs.NodeService{"api2", "api", nil, "", 5001, false}); err != nil {
+	if err := store.EnsureService(13, "foo", &structs.NodeService{ID: "api2", Service: "api", Port: 5001}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -368,11 +490,11 @@ func TestDeleteNode(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(20, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(20, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(21, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(21, "foo", &structs.NodeService{ID: "api", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -416,6 +538,136 @@ func TestDeleteNode(t *testing.T) {
 	}
 }
 
+func TestCatalogPatch_Service(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	srv := &structs.NodeService{ID: "db", Service: "db", Tags: []string{"master", "v1"}, Port: 8000}
+	if err := store.EnsureService(2, "foo", srv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	notify := make(chan struct{}, 1)
+	store.Watch(store.QueryTables("Nodes"), notify)
+
+	req := &structs.CatalogPatchRequest{
+		Node:      "foo",
+		ServiceID: "db",
+		Ops: []structs.PatchOp{
+			structs.PatchOp{Op: structs.PatchRemoveTag, Key: "v1"},
+			structs.PatchOp{Op: structs.PatchAddTag, Key: "v2"},
+			structs.PatchOp{Op: structs.PatchSetMeta, Key: "version", Value: "2"},
+		},
+	}
+	if err := store.CatalogPatch(3, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, services := store.NodeServices("foo")
+	if idx != 3 {
+		t.Fatalf("bad: %v", idx)
+	}
+	db := services.Services["db"]
+	if !reflect.DeepEqual(db.Tags, []string{"master", "v2"}) {
+		t.Fatalf("bad: %v", db.Tags)
+	}
+	if !reflect.DeepEqual(db.Meta, map[string]string{"version": "2"}) {
+		t.Fatalf("bad: %v", db.Meta)
+	}
+
+	// Only the services table should be touched
+	if idx, _ := store.Nodes(); idx != 1 {
+		t.Fatalf("bad: %v", idx)
+	}
+	select {
+	case <-notify:
+		t.Fatalf("should not notify")
+	default:
+	}
+
+	// Re-applying is a no-op
+	if err := store.CatalogPatch(4, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx, _ := store.NodeServices("foo"); idx != 3 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if _, nodes := store.ServiceNodes("db"); len(nodes) != 1 || nodes[0].ModifyIndex != 3 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Re-registration without metadata keeps it
+	if err := store.EnsureService(5, "foo", srv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, services = store.NodeServices("foo")
+	if !reflect.DeepEqual(services.Services["db"].Meta, map[string]string{"version": "2"}) {
+		t.Fatalf("bad: %v", services.Services["db"].Meta)
+	}
+
+	// Unknown services are rejected
+	req.ServiceID = "nope"
+	if err := store.CatalogPatch(6, req); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestCatalogPatch_Node(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := &structs.CatalogPatchRequest{
+		Node: "foo",
+		Ops: []structs.PatchOp{
+			structs.PatchOp{Op: structs.PatchSetMeta, Key: "rack", Value: "r1"},
+			structs.PatchOp{Op: structs.PatchSetMeta, Key: "zone", Value: "a"},
+		},
+	}
+	if err := store.CatalogPatch(2, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req.Ops = []structs.PatchOp{
+		structs.PatchOp{Op: structs.PatchDeleteMeta, Key: "zone"},
+	}
+	if err := store.CatalogPatch(3, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, nodes := store.Nodes()
+	if idx != 3 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 1 || !reflect.DeepEqual(nodes[0].Meta, map[string]string{"rack": "r1"}) {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Tags cannot be applied to a node, and nothing is applied
+	req.Ops = []structs.PatchOp{
+		structs.PatchOp{Op: structs.PatchDeleteMeta, Key: "rack"},
+		structs.PatchOp{Op: structs.PatchAddTag, Key: "v1"},
+	}
+	if err := store.CatalogPatch(4, req); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, nodes := store.Nodes(); nodes[0].Meta["rack"] != "r1" {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestGetServices(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -423,23 +675,23 @@ func TestGetServices(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(30, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(30, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(31, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(31, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(32, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(32, "foo", &structs.NodeService{ID: "api", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(33, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(33, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(34, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(34, "bar", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"slave"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -466,6 +718,83 @@ func TestGetServices(t *testing.T) {
 	}
 }
 
+func TestConnectServiceNodes(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(11, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(12, "foo", &structs.NodeService{ID: "web", Service: "web", Port: 80}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	proxy := func(id, dest string) *structs.NodeService {
+		return &structs.NodeService{
+			ID:      id,
+			Service: dest + "-proxy",
+			Port:    21000,
+			Kind:    structs.ServiceKindConnectProxy,
+			Proxy: structs.ConnectProxyConfig{
+				DestinationServiceName: dest,
+				Upstreams:              []structs.Upstream{{DestinationName: "db", LocalBindPort: 9191}},
+			},
+		}
+	}
+	if err := store.EnsureService(13, "foo", proxy("web-proxy", "web")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(14, "bar", proxy("web-proxy", "Web")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(15, "bar", proxy("db-proxy", "db")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the proxies of the service are returned
+	idx, nodes := store.ConnectServiceNodes("web")
+	if idx != 15 || len(nodes) != 2 {
+		t.Fatalf("bad: %d %v", idx, nodes)
+	}
+	if nodes[0].Node != "bar" || nodes[0].Address != "127.0.0.2" || nodes[1].Node != "foo" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	if nodes[1].ServiceKind != structs.ServiceKindConnectProxy ||
+		!reflect.DeepEqual(nodes[1].ServiceProxy, proxy("web-proxy", "web").Proxy) {
+		t.Fatalf("bad: %#v", nodes[1])
+	}
+
+	_, checkNodes := store.CheckConnectServiceNodes("web")
+	if len(checkNodes) != 2 || checkNodes[1].Service.Kind != structs.ServiceKindConnectProxy ||
+		checkNodes[1].Service.Proxy.DestinationServiceName != "web" {
+		t.Fatalf("bad: %#v", checkNodes)
+	}
+
+	// The proxy configuration round trips through the node services
+	_, services := store.NodeServices("foo")
+	if !reflect.DeepEqual(services.Services["web-proxy"], proxy("web-proxy", "web")) {
+		t.Fatalf("bad: %#v", services.Services["web-proxy"])
+	}
+
+	// A proxy that stops being one leaves the index
+	if err := store.EnsureService(16, "bar", &structs.NodeService{ID: "web-proxy", Service: "web-proxy", Port: 21000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes = store.ConnectServiceNodes("web")
+	if len(nodes) != 1 || nodes[0].Node != "foo" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, nodes = store.ConnectServiceNodes("")
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestServiceNodes(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -473,31 +802,31 @@ func TestServiceNodes(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(10, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(11, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(11, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{ID: "api", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(13, "bar", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(13, "bar", &structs.NodeService{ID: "api", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(14, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(14, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(15, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(15, "bar", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"slave"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(16, "bar", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false}); err != nil {
+	if err := store.EnsureService(16, "bar", &structs.NodeService{ID: "db2", Service: "db", Tags: []string{"slave"}, Port: 8001}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -508,51 +837,53 @@ func TestServiceNodes(t *testing.T) {
 	if len(nodes) != 3 {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[0].Node != "foo" {
+
+	// Ordered by node, then service ID
+	if nodes[2].Node != "foo" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[0].Address != "127.0.0.1" {
+	if nodes[2].Address != "127.0.0.1" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[0].ServiceID != "db" {
+	if nodes[2].ServiceID != "db" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if !strContains(nodes[0].ServiceTags, "master") {
+	if !strContains(nodes[2].ServiceTags, "master") {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[0].ServicePort != 8000 {
+	if nodes[2].ServicePort != 8000 {
 		t.Fatalf("bad: %v", nodes)
 	}
 
-	if nodes[1].Node != "bar" {
+	if nodes[0].Node != "bar" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[1].Address != "127.0.0.2" {
+	if nodes[0].Address != "127.0.0.2" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[1].ServiceID != "db" {
+	if nodes[0].ServiceID != "db" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if !strContains(nodes[1].ServiceTags, "slave") {
+	if !strContains(nodes[0].ServiceTags, "slave") {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[1].ServicePort != 8000 {
+	if nodes[0].ServicePort != 8000 {
 		t.Fatalf("bad: %v", nodes)
 	}
 
-	if nodes[2].Node != "bar" {
+	if nodes[1].Node != "bar" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[2].Address != "127.0.0.2" {
+	if nodes[1].Address != "127.0.0.2" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[2].ServiceID != "db2" {
+	if nodes[1].ServiceID != "db2" {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if !strContains(nodes[2].ServiceTags, "slave") {
+	if !strContains(nodes[1].ServiceTags, "slave") {
 		t.Fatalf("bad: %v", nodes)
 	}
-	if nodes[2].ServicePort != 8001 {
+	if nodes[1].ServicePort != 8001 {
 		t.Fatalf("bad: %v", nodes)
 	}
 }
@@ -564,23 +895,23 @@ func TestServiceTagNodes(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(15, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(15, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(16, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(16, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(17, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(17, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(18, "foo", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false}); err != nil {
+	if err := store.EnsureService(18, "foo", &structs.NodeService{ID: "db2", Service: "db", Tags: []string{"slave"}, Port: 8001}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(19, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(19, "bar", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"slave"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -612,23 +943,23 @@ func TestServiceTagNodes_MultipleTags(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(15, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(15, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(16, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(16, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(17, "foo", &structs.NodeService{"db", "db", []string{"master", "v2"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(17, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"master", "v2"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(18, "foo", &structs.NodeService{"db2", "db", []string{"slave", "v2", "dev"}, "", 8001, false}); err != nil {
+	if err := store.EnsureService(18, "foo", &structs.NodeService{ID: "db2", Service: "db", Tags: []string{"slave", "v2", "dev"}, Port: 8001}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(19, "bar", &structs.NodeService{"db", "db", []string{"slave", "v2"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(19, "bar", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"slave", "v2"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -688,23 +1019,23 @@ func TestStoreSnapshot(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(8, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(8, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(9, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(9, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(10, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(10, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(11, "foo", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false}); err != nil {
+	if err := store.EnsureService(11, "foo", &structs.NodeService{ID: "db2", Service: "db", Tags: []string{"slave"}, Port: 8001}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(12, "bar", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"slave"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -787,6 +1118,38 @@ func TestStoreSnapshot(t *testing.T) {
 		t.Fatalf("bad: %v", idx)
 	}
 
+	// Check the record counts
+	counts, err := snap.RecordCounts()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := map[string]uint64{
+		dbNodes:          2,
+		dbServices:       3,
+		dbChecks:         1,
+		dbKVS:            2,
+		dbKVSHistory:     0,
+		dbTombstone:      1,
+		dbSessions:       3,
+		dbACLs:           2,
+		dbLockDelays:     0,
+		dbOutboxSubs:     0,
+		dbOutbox:         0,
+		dbServerHealth:   0,
+		dbCatalogAudit:   0,
+		dbExternalClaims: 0,
+		dbMaintenance:    0,
+		dbAutopilot:      0,
+		dbAutoEncrypt:    0,
+		dbAreas:          0,
+		dbPeerings:       0,
+		dbExported:       0,
+		dbImported:       0,
+	}
+	if !reflect.DeepEqual(counts, expect) {
+		t.Fatalf("bad: %v", counts)
+	}
+
 	// Check snapshot has old values
 	nodes := snap.Nodes()
 	if len(nodes) != 2 {
@@ -889,13 +1252,13 @@ func TestStoreSnapshot(t *testing.T) {
 	}
 
 	// Make some changes!
-	if err := store.EnsureService(23, "foo", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(23, "foo", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"slave"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(24, "bar", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(24, "bar", &structs.NodeService{ID: "db", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureNode(25, structs.Node{"baz", "127.0.0.3"}); err != nil {
+	if err := store.EnsureNode(25, structs.Node{Node: "baz", Address: "127.0.0.3"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	checkAfter := &structs.HealthCheck{
@@ -1016,10 +1379,10 @@ func TestEnsureCheck(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db1", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1112,10 +1475,10 @@ func TestDeleteNodeCheck(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db1", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1162,10 +1525,10 @@ func TestCheckServiceNodes(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db1", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1243,10 +1606,10 @@ func BenchmarkCheckServiceNodes(t *testing.B) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db1", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1281,28 +1644,16 @@ func TestSS_Register_Deregister_Query(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	srv := &structs.NodeService{
-		"statsite-box-stats",
-		"statsite-box-stats",
-		nil,
-		"",
-		0,
-		false}
+	srv := &structs.NodeService{ID: "statsite-box-stats", Service: "statsite-box-stats"}
 	if err := store.EnsureService(2, "foo", srv); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	srv = &structs.NodeService{
-		"statsite-share-stats",
-		"statsite-share-stats",
-		nil,
-		"",
-		0,
-		false}
+	srv = &structs.NodeService{ID: "statsite-share-stats", Service: "statsite-share-stats"}
 	if err := store.EnsureService(3, "foo", srv); err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1327,10 +1678,10 @@ func TestNodeInfo(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db1", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1386,16 +1737,16 @@ func TestNodeDump(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db1", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureNode(3, structs.Node{"baz", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "baz", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(4, "baz", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(4, "baz", &structs.NodeService{ID: "db1", Service: "db", Tags: []string{"master"}, Port: 8000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -1637,77 +1988,195 @@ func TestKVSDelete(t *testing.T) {
 	}
 }
 
-func TestKVSDeleteCheckAndSet(t *testing.T) {
+func TestKVSGetAtIndex(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer store.Close()
 
-	// CAS should fail, no entry
-	ok, err := store.KVSDeleteCheckAndSet(1000, "/foo", 100)
-	if err != nil {
+	// Disabled history can only answer for the current entry
+	d := &structs.DirEntry{Key: "/foo", Value: []byte("one")}
+	if err := store.KVSSet(1000, d); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if ok {
-		t.Fatalf("unexpected commit")
+	d = &structs.DirEntry{Key: "/foo", Value: []byte("two")}
+	if err := store.KVSSet(1010, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := store.KVSGetAtIndex("/foo", 1005); err == nil {
+		t.Fatalf("should fail with history disabled")
 	}
 
-	// CAS should work, no entry
-	ok, err = store.KVSDeleteCheckAndSet(1000, "/foo", 0)
-	if err != nil {
+	if err := store.RetentionSet(1015, &structs.RetentionConfig{KVSHistoryVersions: 3}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if !ok {
-		t.Fatalf("unexpected failure")
+	for i, val := range []string{"three", "four", "five"} {
+		d := &structs.DirEntry{Key: "/foo", Value: []byte(val)}
+		if err := store.KVSSet(uint64(1020+10*i), d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := store.KVSDelete(1050, "/foo"); err != nil {
+		t.Fatalf("err: %v", err)
 	}
 
-	// Make an entry
-	d := &structs.DirEntry{Key: "/foo"}
-	if err := store.KVSSet(1000, d); err != nil {
+	// Version at 1030 is still retained
+	idx, d, err := store.KVSGetAtIndex("/foo", 1035)
+	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	if idx != 1050 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if d == nil || string(d.Value) != "four" || d.ModifyIndex != 1030 {
+		t.Fatalf("bad: %#v", d)
+	}
 
-	// Constrain on a wrong modify time
-	ok, err = store.KVSDeleteCheckAndSet(1001, "/foo", 42)
+	// Version at 1040 is retained
+	_, d, err = store.KVSGetAtIndex("/foo", 1040)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if ok {
-		t.Fatalf("unexpected commit")
+	if d == nil || string(d.Value) != "five" {
+		t.Fatalf("bad: %#v", d)
 	}
 
-	// Constrain on a correct modify time
-	ok, err = store.KVSDeleteCheckAndSet(1002, "/foo", 1000)
+	// Deleted at 1050
+	_, d, err = store.KVSGetAtIndex("/foo", 1060)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if !ok {
-		t.Fatalf("expected commit")
+	if d != nil {
+		t.Fatalf("bad: %#v", d)
+	}
+
+	// Version at 1020 was pruned
+	if _, _, err := store.KVSGetAtIndex("/foo", 1025); err == nil {
+		t.Fatalf("should fail for pruned version")
 	}
 }
 
-func TestKVSCheckAndSet(t *testing.T) {
+func TestKVSHistoryReap(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer store.Close()
 
-	// CAS should fail, no entry
-	d := &structs.DirEntry{
-		ModifyIndex: 100,
-		Key:         "/foo",
-		Flags:       42,
-		Value:       []byte("test"),
-	}
-	ok, err := store.KVSCheckAndSet(1000, d)
+	gc, err := NewTombstoneGC(time.Hour, time.Minute)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if ok {
-		t.Fatalf("unexpected commit")
-	}
+	gc.SetEnabled(true)
+	defer gc.SetEnabled(false)
+
+	store.SetKVSHistoryGC(gc)
+	if err := store.RetentionSet(999, &structs.RetentionConfig{KVSHistoryVersions: 10}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i, val := range []string{"one", "two", "three"} {
+		d := &structs.DirEntry{Key: "/foo", Value: []byte(val)}
+		if err := store.KVSSet(uint64(1000+10*i), d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The recorded versions are hinted to the GC
+	if !gc.PendingExpiration() {
+		t.Fatalf("should be pending")
+	}
+
+	if err := store.KVSHistoryReap(1010); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The versions up to the reap index are gone
+	if _, _, err := store.KVSGetAtIndex("/foo", 1015); err == nil {
+		t.Fatalf("should fail for reaped version")
+	}
+
+	// The current entry is still served
+	_, d, err := store.KVSGetAtIndex("/foo", 1025)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "three" {
+		t.Fatalf("bad: %#v", d)
+	}
+}
+
+func TestKVSDeleteCheckAndSet(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// CAS should fail, no entry
+	ok, err := store.KVSDeleteCheckAndSet(1000, "/foo", 100)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("unexpected commit")
+	}
+
+	// CAS should work, no entry
+	ok, err = store.KVSDeleteCheckAndSet(1000, "/foo", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("unexpected failure")
+	}
+
+	// Make an entry
+	d := &structs.DirEntry{Key: "/foo"}
+	if err := store.KVSSet(1000, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Constrain on a wrong modify time
+	ok, err = store.KVSDeleteCheckAndSet(1001, "/foo", 42)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("unexpected commit")
+	}
+
+	// Constrain on a correct modify time
+	ok, err = store.KVSDeleteCheckAndSet(1002, "/foo", 1000)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected commit")
+	}
+}
+
+func TestKVSCheckAndSet(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// CAS should fail, no entry
+	d := &structs.DirEntry{
+		ModifyIndex: 100,
+		Key:         "/foo",
+		Flags:       42,
+		Value:       []byte("test"),
+	}
+	ok, err := store.KVSCheckAndSet(1000, d)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("unexpected commit")
+	}
 
 	// Constrain on not-exist, should work
 	d.ModifyIndex = 0
@@ -2296,7 +2765,7 @@ func TestSessionCreate(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -2323,6 +2792,158 @@ func TestSessionCreate(t *testing.T) {
 	}
 }
 
+func TestSessionCreate_Limit(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i, node := range []string{"foo", "bar"} {
+		if err := store.EnsureNode(uint64(i+1), structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		session := &structs.Session{ID: generateUUID(), Node: "foo"}
+		if err := store.SessionCreateWithLimit(uint64(10+i), session, 2); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The next session on the node is rejected
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	err = store.SessionCreateWithLimit(20, session, 2)
+	limitErr, ok := err.(*SessionLimitError)
+	if !ok {
+		t.Fatalf("err: %v", err)
+	}
+	if limitErr.Node != "foo" || limitErr.Limit != 2 {
+		t.Fatalf("bad: %#v", limitErr)
+	}
+	if _, s, err := store.SessionGet(session.ID); err != nil || s != nil {
+		t.Fatalf("bad: %v %v", s, err)
+	}
+
+	// Other nodes are unaffected
+	if err := store.SessionCreateWithLimit(21, &structs.Session{ID: generateUUID(), Node: "bar"}, 2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without a limit the session is allowed
+	if err := store.SessionCreate(22, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSessionRenew(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := &structs.DirEntry{Key: "/foo", Value: []byte("test")}
+	if err := store.KVSSet(4, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo", TTL: "1h"}
+	if err := store.SessionCreate(1000, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	notify := make(chan struct{}, 1)
+	store.Watch(store.QueryTables("SessionGet"), notify)
+
+	if err := store.SessionRenew(1010, session.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.SessionRenew(1011, "nope"); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Check the watch fired
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("should notify")
+	}
+
+	idx, out, err := store.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1010 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if out.CreateIndex != 1000 || out.ModifyIndex != 1010 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Unrelated tables are untouched
+	if idx, _ := store.Nodes(); idx != 3 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if idx, _, _ := store.KVSGet("/foo"); idx != 4 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	// Sessions are looked up in the order of their IDs, skipping any
+	// that are gone
+	other := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(1020, other); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, sessions, err := store.SessionsByID([]string{other.ID, "nope", session.ID})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1020 || len(sessions) != 2 || sessions[0].ID != other.ID ||
+		sessions[1].ID != session.ID {
+		t.Fatalf("bad: %d %v", idx, sessions)
+	}
+}
+
+func TestSessionListByNode(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(2, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	s1 := &structs.Session{ID: generateUUID(), Node: "foo", TTL: "30s"}
+	s2 := &structs.Session{ID: generateUUID(), Node: "bar", TTL: "10s"}
+	s3 := &structs.Session{ID: generateUUID(), Node: "foo"}
+	for i, session := range []*structs.Session{s1, s2, s3} {
+		if err := store.SessionCreate(uint64(10+i), session); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	idx, out, err := store.SessionListByNode("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 12 || len(out) != 2 {
+		t.Fatalf("bad: %v %v", idx, out)
+	}
+	for _, session := range out {
+		if session.Node != "foo" {
+			t.Fatalf("bad: %v", session)
+		}
+	}
+}
+
 func TestSessionCreate_Invalid(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -2341,7 +2962,7 @@ func TestSessionCreate_Invalid(t *testing.T) {
 	}
 
 	// Check not registered
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	if err := store.SessionCreate(1000, session); err.Error() != "Missing check 'bar' registration" {
@@ -2370,7 +2991,7 @@ func TestSession_Lookups(t *testing.T) {
 	defer store.Close()
 
 	// Create a session
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{
@@ -2455,7 +3076,7 @@ func TestSessionInvalidate_CriticalHealthCheck(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -2499,7 +3120,7 @@ func TestSessionInvalidate_DeleteHealthCheck(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -2542,7 +3163,7 @@ func TestSessionInvalidate_DeleteNode(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -2576,10 +3197,10 @@ func TestSessionInvalidate_DeleteNodeService(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(11, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(11, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{ID: "api", Service: "api", Port: 5000}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -2624,7 +3245,7 @@ func TestKVSLock(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
@@ -2697,7 +3318,7 @@ func TestKVSUnlock(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
@@ -2754,7 +3375,7 @@ func TestSessionInvalidate_KeyUnlock(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 	defer store.Close()
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{
@@ -2822,7 +3443,7 @@ func TestSessionInvalidate_KeyDelete(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{
@@ -2878,6 +3499,123 @@ func TestSessionInvalidate_KeyDelete(t *testing.T) {
 	}
 }
 
+func TestKVSLock_LockDelay(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:        generateUUID(),
+		Node:      "foo",
+		LockDelay: 50 * time.Millisecond,
+	}
+	if err := store.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	held := session.ID
+	d := &structs.DirEntry{Key: "/foo", Session: held}
+	if ok, err := store.KVSLock(3, d); err != nil || !ok {
+		t.Fatalf("err: %v", err)
+	}
+
+	notify := make(chan struct{}, 1)
+	store.Watch(store.QueryTables("LockDelays"), notify)
+
+	// Invalidate the session to open a lock delay window
+	if err := store.SessionDestroy(4, held); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("should notify")
+	}
+
+	idx, delays, err := store.LockDelays()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 4 || len(delays) != 1 {
+		t.Fatalf("bad: %v %v", idx, delays)
+	}
+	if delays[0].Key != "/foo" || delays[0].Session != held ||
+		delays[0].Delay != 50*time.Millisecond || delays[0].CreateIndex != 4 {
+		t.Fatalf("bad: %#v", delays[0])
+	}
+	if store.LockDelayExpires("/foo", held).IsZero() {
+		t.Fatalf("should have expiration")
+	}
+
+	// The lock is rejected while the window is open, even
+	// after the wall-time has passed
+	session.ID = generateUUID()
+	if err := store.SessionCreate(5, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d = &structs.DirEntry{Key: "/foo", Session: session.ID}
+	time.Sleep(60 * time.Millisecond)
+	if ok, err := store.KVSLock(6, d); err != nil || ok {
+		t.Fatalf("should not acquire: %v", err)
+	}
+
+	// Expire the window
+	if err := store.LockDelayExpire(7, "/foo", held); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !store.KVSLockDelay("/foo").IsZero() {
+		t.Fatalf("should not have expiration")
+	}
+	if ok, err := store.KVSLock(8, d); err != nil || !ok {
+		t.Fatalf("should acquire: %v", err)
+	}
+}
+
+func TestKVSLock_LockDelayExactKey(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:        generateUUID(),
+		Node:      "foo",
+		LockDelay: time.Minute,
+	}
+	if err := store.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	held := session.ID
+	if ok, err := store.KVSLock(3, &structs.DirEntry{Key: "a||b", Session: held}); err != nil || !ok {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Open a lock delay window on a||b only
+	if err := store.SessionDestroy(4, held); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session.ID = generateUUID()
+	if err := store.SessionCreate(5, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The window of a||b does not hold a
+	if ok, err := store.KVSLock(6, &structs.DirEntry{Key: "a", Session: session.ID}); err != nil || !ok {
+		t.Fatalf("should acquire: %v", err)
+	}
+	if ok, err := store.KVSLock(7, &structs.DirEntry{Key: "a||b", Session: session.ID}); err != nil || ok {
+		t.Fatalf("should not acquire: %v", err)
+	}
+}
+
 func TestACLSet_Get(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -3022,3 +3760,500 @@ func TestACLList(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestOutbox_RecordAck(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Changes before the subscription are not recorded
+	if err := store.KVSSet(1, &structs.DirEntry{Key: "/deploy/old", Value: []byte("v0")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sub := &structs.OutboxSubscription{Name: "deploy", Prefix: "/deploy/", URL: "http://127.0.0.1/hook"}
+	if err := store.OutboxSubscribe(2, sub); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Record a set, an unrelated key, and a tree delete
+	if err := store.KVSSet(3, &structs.DirEntry{Key: "/deploy/web", Value: []byte("v1")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSSet(4, &structs.DirEntry{Key: "/other", Value: []byte("v1")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSDeleteTree(5, "/deploy/"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, pending, err := store.OutboxPending("deploy", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || len(pending) != 3 {
+		t.Fatalf("bad: %v %v", idx, pending)
+	}
+	if pending[0].Op != structs.KVSSet || pending[0].Entry.Key != "/deploy/web" || pending[0].CreateIndex != 3 {
+		t.Fatalf("bad: %#v", pending[0])
+	}
+	if pending[1].Op != structs.KVSDelete || pending[1].CreateIndex != 5 {
+		t.Fatalf("bad: %#v", pending[1])
+	}
+
+	// The limit returns the oldest entries
+	_, limited, err := store.OutboxPending("deploy", 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(limited) != 1 || limited[0].ID != pending[0].ID {
+		t.Fatalf("bad: %v", limited)
+	}
+
+	// Acks are idempotent
+	acks := []string{pending[0].ID, pending[1].ID}
+	if err := store.OutboxAck(6, "deploy", acks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.OutboxAck(7, "deploy", acks); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, pending, err = store.OutboxPending("deploy", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 6 || len(pending) != 1 {
+		t.Fatalf("bad: %v %v", idx, pending)
+	}
+
+	// The acked entries are no longer counted
+	_, subs, err := store.OutboxSubscriptions()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(subs) != 1 || subs[0].Pending != 1 || subs[0].Dropped != 0 {
+		t.Fatalf("bad: %#v", subs)
+	}
+
+	// Unsubscribing drops the remaining entries
+	if err := store.OutboxUnsubscribe(8, "deploy"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, pending, err = store.OutboxPending("deploy", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("bad: %v", pending)
+	}
+}
+
+func TestOutbox_MaxPending(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	logger := &recordingLogger{}
+	store.SetLogger(logger)
+
+	// Subscriptions to nested prefixes both record a change
+	capped := &structs.OutboxSubscription{Name: "web", Prefix: "/deploy/web", URL: "http://127.0.0.1/hook", MaxPending: 2}
+	if err := store.OutboxSubscribe(1, capped); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	all := &structs.OutboxSubscription{Name: "all", Prefix: "/deploy/", URL: "http://127.0.0.1/hook"}
+	if err := store.OutboxSubscribe(2, all); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := uint64(3); i < 7; i++ {
+		d := &structs.DirEntry{Key: "/deploy/web", Value: []byte("v1")}
+		if err := store.KVSSet(i, d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := store.KVSSet(7, &structs.DirEntry{Key: "/deploy/db", Value: []byte("v1")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The capped subscription only kept the newest entries
+	_, pending, err := store.OutboxPending("web", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(pending) != 2 || pending[0].CreateIndex != 5 || pending[1].CreateIndex != 6 {
+		t.Fatalf("bad: %v", pending)
+	}
+	_, pending, err = store.OutboxPending("all", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(pending) != 5 {
+		t.Fatalf("bad: %v", pending)
+	}
+
+	// The drops mark the subscription as lagging
+	_, subs, err := store.OutboxSubscriptions()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, sub := range subs {
+		switch sub.Name {
+		case "web":
+			if sub.Pending != 2 || sub.Dropped != 2 {
+				t.Fatalf("bad: %#v", sub)
+			}
+		case "all":
+			if sub.Pending != 5 || sub.Dropped != 0 {
+				t.Fatalf("bad: %#v", sub)
+			}
+		}
+	}
+
+	// Each drop is logged
+	drops := 0
+	for _, event := range logger.events {
+		if strings.Contains(event, "Dropped outbox entry") {
+			drops++
+		}
+	}
+	if drops != 2 {
+		t.Fatalf("bad: %v", logger.events)
+	}
+
+	// Moving a subscription to another prefix reindexes it, and keeps
+	// its counts
+	capped = &structs.OutboxSubscription{Name: "web", Prefix: "/other/", URL: "http://127.0.0.1/hook", MaxPending: 2}
+	if err := store.OutboxSubscribe(8, capped); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSSet(9, &structs.DirEntry{Key: "/deploy/web", Value: []byte("v9")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSSet(10, &structs.DirEntry{Key: "/other/key", Value: []byte("v1")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, pending, err = store.OutboxPending("web", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(pending) != 2 || pending[0].CreateIndex != 6 || pending[1].CreateIndex != 10 {
+		t.Fatalf("bad: %v", pending)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	start := time.Now()
+	health := &structs.ServerHealth{
+		Name:        "s1",
+		Address:     "127.0.0.1:8300",
+		Healthy:     true,
+		StableSince: start.UnixNano(),
+	}
+	if err := store.ServerHealthSet(1, health); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The stable time is kept while the health is unchanged
+	later := start.Add(time.Minute)
+	health = &structs.ServerHealth{Name: "s1", Healthy: true, StableSince: later.UnixNano()}
+	if err := store.ServerHealthSet(2, health); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, out, err := store.ServerHealthGet("s1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 2 || out.CreateIndex != 1 || out.ModifyIndex != 2 || out.StableSince != start.UnixNano() {
+		t.Fatalf("bad: %v %#v", idx, out)
+	}
+
+	// A non-voter that has been stable can be promoted
+	promote, err := store.PromotableServers(later, 30*time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(promote) != 1 || promote[0].Name != "s1" {
+		t.Fatalf("bad: %v", promote)
+	}
+	promote, err = store.PromotableServers(later, 2*time.Minute)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(promote) != 0 {
+		t.Fatalf("bad: %v", promote)
+	}
+
+	// A change of health resets the stable time
+	health = &structs.ServerHealth{Name: "s1", Healthy: false, StableSince: later.UnixNano()}
+	if err := store.ServerHealthSet(3, health); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dead, err := store.DeadServers(later.Add(time.Minute), time.Minute)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dead) != 1 || dead[0].StableSince != later.UnixNano() {
+		t.Fatalf("bad: %v", dead)
+	}
+	dead, err = store.DeadServers(later, time.Minute)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dead) != 0 {
+		t.Fatalf("bad: %v", dead)
+	}
+
+	// Remove the server
+	if err := store.ServerHealthDelete(4, "s1"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, servers, err := store.ServerHealthList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 4 || len(servers) != 0 {
+		t.Fatalf("bad: %v %v", idx, servers)
+	}
+}
+
+func TestCatalogAudit(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i, node := range []string{"foo", "bar", "foo", "bar"} {
+		audit := &structs.CatalogAudit{
+			Time: int64(100 * (i + 1)),
+			Op:   catalogAuditRegister,
+			Node: node,
+		}
+		if err := store.CatalogAuditRecord(uint64(i+1), audit); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Nothing is trimmed within the limit
+	trimIndex, err := store.CatalogAuditTrimIndex(4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if trimIndex != 0 {
+		t.Fatalf("bad: %d", trimIndex)
+	}
+
+	// The oldest record is trimmed
+	trimIndex, err = store.CatalogAuditTrimIndex(3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if trimIndex != 1 {
+		t.Fatalf("bad: %d", trimIndex)
+	}
+	if err := store.CatalogAuditTrim(5, trimIndex); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, audits, err := store.CatalogAuditList("", 0, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || len(audits) != 3 || audits[0].CreateIndex != 2 || audits[2].CreateIndex != 4 {
+		t.Fatalf("bad: %v %v", idx, audits)
+	}
+
+	// Filter by node and time range
+	_, audits, err = store.CatalogAuditList("foo", 0, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(audits) != 1 || audits[0].Time != 300 {
+		t.Fatalf("bad: %v", audits)
+	}
+	_, audits, err = store.CatalogAuditList("", 250, 350)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(audits) != 1 || audits[0].Node != "foo" {
+		t.Fatalf("bad: %v", audits)
+	}
+}
+
+func TestStateStore_Stats(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSSet(2, &structs.DirEntry{Key: "/foo", Value: []byte("bar")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Register some watchers
+	ch := make(chan struct{}, 1)
+	store.Watch(store.QueryTables("Nodes"), ch)
+	store.WatchKV("/foo", ch)
+	store.WatchKV("/bar", make(chan struct{}, 1))
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.Objects[dbNodes] != 1 || stats.Objects[dbKVS] != 1 || stats.Objects[dbSessions] != 0 {
+		t.Fatalf("bad: %v", stats.Objects)
+	}
+	if stats.Bytes[dbKVS] == 0 || stats.IndexBytes[dbKVS] == 0 || stats.Bytes[dbSessions] != 0 {
+		t.Fatalf("bad: %v %v", stats.Bytes, stats.IndexBytes)
+	}
+	if stats.Watches[dbNodes] != 1 || stats.Watches[dbKVS] != 0 || stats.KVSWatches != 2 {
+		t.Fatalf("bad: %v %d", stats.Watches, stats.KVSWatches)
+	}
+
+	// Fired watchers are no longer counted
+	if err := store.EnsureNode(3, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stats, err = store.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.Objects[dbNodes] != 2 || stats.Watches[dbNodes] != 0 {
+		t.Fatalf("bad: %v %v", stats.Objects, stats.Watches)
+	}
+}
+
+func TestStateStore_ReapWatches(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Leak a table watch and a KV watch, and clear another KV watch
+	store.Watch(store.QueryTables("Nodes"), make(chan struct{}, 1))
+	store.WatchKV("/foo", make(chan struct{}, 1))
+	ch := make(chan struct{}, 1)
+	store.WatchKV("/bar", ch)
+	store.StopWatchKV("/bar", ch)
+
+	// Nothing is old enough yet
+	if n := store.ReapWatches(time.Hour); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := store.ReapWatches(0); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.Watches[dbNodes] != 0 || stats.KVSWatches != 0 || stats.KVSWatchGroups != 0 {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
+
+func TestStateStore_SetMaxSize(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Zero keeps the default
+	if err := store.SetMaxSize(0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.SetMaxSize(64 * 1024 * 1024); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The store is still usable
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, found, _ := store.GetNode("foo"); !found {
+		t.Fatalf("missing node")
+	}
+}
+
+func TestStateStore_Areas(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// The ID and peer are required
+	if err := store.AreaSet(1, &structs.Area{PeerDatacenter: "dc2"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := store.AreaSet(1, &structs.Area{ID: "a1"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	a1 := &structs.Area{ID: "a1", PeerDatacenter: "dc2", RetryJoin: []string{"10.0.0.1:8300"}}
+	if err := store.AreaSet(1, a1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a2 := &structs.Area{ID: "a2", PeerDatacenter: "dc3", UseTLS: true}
+	if err := store.AreaSet(2, a2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A single area links to a datacenter
+	if err := store.AreaSet(3, &structs.Area{ID: "a3", PeerDatacenter: "dc2"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Updating keeps the create index, and may change the peer
+	update := &structs.Area{ID: "a1", PeerDatacenter: "dc4"}
+	if err := store.AreaSet(4, update); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if update.CreateIndex != 1 || update.ModifyIndex != 4 {
+		t.Fatalf("bad: %#v", update)
+	}
+	if err := store.AreaSet(5, &structs.Area{ID: "a3", PeerDatacenter: "dc2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, area, err := store.AreaGet("a1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || !reflect.DeepEqual(area, update) {
+		t.Fatalf("bad: %d %#v", idx, area)
+	}
+
+	idx, areas, err := store.AreaList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || len(areas) != 3 {
+		t.Fatalf("bad: %d %#v", idx, areas)
+	}
+
+	if err := store.AreaDelete(6, "a2"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, area, err = store.AreaGet("a2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 6 || area != nil {
+		t.Fatalf("bad: %d %#v", idx, area)
+	}
+}
@@ -0,0 +1,215 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// stateVerifier accumulates the problems found while verifying the state
+type stateVerifier struct {
+	report *structs.StateVerifyReport
+}
+
+// problem records an inconsistency of a row
+func (v *stateVerifier) problem(table, key, format string, args ...interface{}) {
+	v.report.Problems = append(v.report.Problems, structs.StateProblem{
+		Table:   table,
+		Key:     key,
+		Problem: fmt.Sprintf(format, args...),
+	})
+}
+
+// order checks that the create index of a row is not after its modify
+// index
+func (v *stateVerifier) order(table, key string, create, modify uint64) {
+	if modify != 0 && create > modify {
+		v.problem(table, key, "create index %d is after modify index %d", create, modify)
+	}
+}
+
+// indexes checks that the indexes of a row are ordered, and not past the
+// last index of its table
+func (v *stateVerifier) indexes(table, key string, create, modify, last uint64) {
+	v.order(table, key, create, modify)
+	if create > last || modify > last {
+		v.problem(table, key, "indexes %d/%d are past the last index %d of the table",
+			create, modify, last)
+	}
+}
+
+// Verify checks the referential integrity of the state store: services
+// and checks belong to existing nodes, checks to existing services,
+// sessions and locks to existing nodes, checks and sessions, and the
+// indexes of the rows are consistent with their tables. The state is
+// verified at a single point in time, and the report lists every problem
+// found. An error is only returned if the state can't be read.
+func (s *StateStore) Verify() (*structs.StateVerifyReport, error) {
+	defer s.measureQuery("Verify", time.Now())
+	tx, err := s.tables.StartTxn(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Abort()
+
+	report := &structs.StateVerifyReport{
+		Rows:     make(map[string]int),
+		Problems: []structs.StateProblem{},
+	}
+	if report.Index, err = s.tables.LastIndexTxn(tx); err != nil {
+		return nil, err
+	}
+	v := &stateVerifier{report: report}
+
+	// get reads every row of a table, along with its last index
+	get := func(table *MDBTable) ([]interface{}, uint64, error) {
+		res, err := table.GetTxn(tx, "id")
+		if err != nil {
+			return nil, 0, err
+		}
+		last, err := table.LastIndexTxn(tx)
+		if err != nil {
+			return nil, 0, err
+		}
+		report.Rows[table.Name] = len(res)
+		return res, last, nil
+	}
+
+	// Nodes
+	res, _, err := get(s.nodeTable)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]struct{}, len(res))
+	for _, r := range res {
+		nodes[r.(*structs.Node).Node] = struct{}{}
+	}
+
+	// Services must be on a known node
+	res, _, err = get(s.serviceTable)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]*structs.ServiceNode, len(res))
+	for _, r := range res {
+		srv := r.(*structs.ServiceNode)
+		key := srv.Node + "/" + srv.ServiceID
+		services[key] = srv
+		if _, ok := nodes[srv.Node]; !ok {
+			v.problem(dbServices, key, "service is registered on unknown node '%s'", srv.Node)
+		}
+	}
+
+	// Checks must be on a known node, and service if any
+	res, _, err = get(s.checkTable)
+	if err != nil {
+		return nil, err
+	}
+	checks := make(map[string]struct{}, len(res))
+	for _, r := range res {
+		check := r.(*structs.HealthCheck)
+		key := check.Node + "/" + check.CheckID
+		checks[key] = struct{}{}
+		if _, ok := nodes[check.Node]; !ok {
+			v.problem(dbChecks, key, "check is registered on unknown node '%s'", check.Node)
+		}
+		if check.ServiceID == "" {
+			continue
+		}
+		srv, ok := services[check.Node+"/"+check.ServiceID]
+		if !ok {
+			v.problem(dbChecks, key, "check is associated with unknown service '%s'", check.ServiceID)
+		} else if srv.ServiceName != check.ServiceName {
+			v.problem(dbChecks, key, "check has service name '%s', but service '%s' is named '%s'",
+				check.ServiceName, check.ServiceID, srv.ServiceName)
+		}
+	}
+
+	// Sessions must be on a known node, bound to known checks
+	res, last, err := get(s.sessionTable)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make(map[string]struct{}, len(res))
+	bindings := make(map[string]struct{})
+	for _, r := range res {
+		session := r.(*structs.Session)
+		sessions[session.ID] = struct{}{}
+		v.indexes(dbSessions, session.ID, session.CreateIndex, session.ModifyIndex, last)
+		if _, ok := nodes[session.Node]; !ok {
+			v.problem(dbSessions, session.ID, "session is on unknown node '%s'", session.Node)
+		}
+		for _, checkID := range session.Checks {
+			bindings[session.Node+"/"+checkID+"/"+session.ID] = struct{}{}
+			if _, ok := checks[session.Node+"/"+checkID]; !ok {
+				v.problem(dbSessions, session.ID, "session is bound to unknown check '%s'", checkID)
+			}
+		}
+	}
+
+	// The session check bindings must match the sessions
+	res, _, err = get(s.sessionCheckTable)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res {
+		sc := r.(*sessionCheck)
+		key := sc.Node + "/" + sc.CheckID + "/" + sc.Session
+		if _, ok := sessions[sc.Session]; !ok {
+			v.problem(dbSessionChecks, key, "binding of unknown session '%s'", sc.Session)
+		} else if _, ok := bindings[key]; !ok {
+			v.problem(dbSessionChecks, key, "session '%s' is not bound to check '%s'", sc.Session, sc.CheckID)
+		}
+		delete(bindings, key)
+	}
+	for key := range bindings {
+		v.problem(dbSessionChecks, key, "missing binding of session to check")
+	}
+
+	// Locks must be held by a known session
+	res, last, err = get(s.kvsTable)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res {
+		ent := r.(*structs.DirEntry)
+		v.indexes(dbKVS, ent.Key, ent.CreateIndex, ent.ModifyIndex, last)
+		if ent.Session == "" {
+			continue
+		}
+		if _, ok := sessions[ent.Session]; !ok {
+			v.problem(dbKVS, ent.Key, "key is locked by unknown session '%s'", ent.Session)
+		}
+	}
+
+	// The last index of the tombstones isn't tracked, since they are
+	// covered by the last index of the KV table
+	res, _, err = get(s.tombstoneTable)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res {
+		ent := r.(*structs.DirEntry)
+		v.order(dbTombstone, ent.Key, ent.CreateIndex, ent.ModifyIndex)
+	}
+
+	res, last, err = get(s.aclTable)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res {
+		acl := r.(*structs.ACL)
+		v.indexes(dbACLs, acl.ID, acl.CreateIndex, acl.ModifyIndex, last)
+	}
+
+	res, last, err = get(s.lockDelayTable)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res {
+		delay := r.(*structs.LockDelay)
+		v.indexes(dbLockDelays, delay.Key+"/"+delay.Session, delay.CreateIndex, 0, last)
+	}
+	return report, nil
+}
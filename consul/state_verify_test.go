@@ -0,0 +1,110 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_Verify(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Build a consistent state
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{ID: "db", Service: "db", Port: 8000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:      "foo",
+		CheckID:   "db",
+		Name:      "db",
+		Status:    structs.HealthPassing,
+		ServiceID: "db",
+	}
+	if err := store.EnsureCheck(3, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo", Checks: []string{"db"}}
+	if err := store.SessionCreate(4, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, err := store.KVSLock(5, &structs.DirEntry{Key: "lock", Session: session.ID}); !ok || err != nil {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+	if err := store.KVSSet(6, &structs.DirEntry{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSDelete(7, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	report, err := store.Verify()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("bad: %v", report.Problems)
+	}
+	if report.Index != 7 || report.Rows[dbServices] != 1 || report.Rows[dbSessionChecks] != 1 {
+		t.Fatalf("bad: %#v", report)
+	}
+
+	// Corrupt the state behind the back of the store
+	orphan := &structs.ServiceNode{Node: "bar", ServiceID: "web", ServiceName: "web"}
+	if err := store.serviceTable.Insert(orphan); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dangling := &structs.HealthCheck{Node: "foo", CheckID: "web", Status: structs.HealthPassing,
+		ServiceID: "web", ServiceName: "web"}
+	if err := store.checkTable.Insert(dangling); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	future := &structs.DirEntry{Key: "future", CreateIndex: 100, ModifyIndex: 100, Session: "nope"}
+	if err := store.kvsTable.Insert(future); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := store.sessionCheckTable.Delete("id", "foo", "db", session.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	report, err = store.Verify()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := map[string]string{
+		dbServices + " bar/web":                   "unknown node 'bar'",
+		dbChecks + " foo/web":                     "unknown service 'web'",
+		dbKVS + " future":                         "past the last index",
+		dbSessionChecks + " foo/db/" + session.ID: "missing binding",
+	}
+	found := make(map[string]bool)
+	for _, p := range report.Problems {
+		key := p.Table + " " + p.Key
+		if expect, ok := expected[key]; ok && strings.Contains(p.Problem, expect) {
+			found[key] = true
+		}
+	}
+	for key := range expected {
+		if !found[key] {
+			t.Fatalf("missing %s: %v", key, report.Problems)
+		}
+	}
+
+	// The unknown session of the lock is reported too
+	var locked bool
+	for _, p := range report.Problems {
+		if p.Table == dbKVS && strings.Contains(p.Problem, "unknown session 'nope'") {
+			locked = true
+		}
+	}
+	if !locked {
+		t.Fatalf("bad: %v", report.Problems)
+	}
+}
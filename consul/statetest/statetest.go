@@ -0,0 +1,231 @@
+// Package statetest provides helpers to write tests against the state
+// store: a store constructor, helpers to register nodes, services and
+// checks, fixture builders, and golden-file comparison of the contents
+// of a store. It is meant for the tests of packages that embed or build
+// on the state store, so they don't have to copy Consul's own helpers.
+package statetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul/consul"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// UpdateGoldenEnv is the environment variable that makes CompareGolden
+// rewrite the golden files instead of comparing against them
+const UpdateGoldenEnv = "CONSUL_UPDATE_GOLDEN"
+
+// NewStore creates an empty state store without a tombstone GC, logging
+// to stderr. The store must be closed by the caller.
+func NewStore(t *testing.T) *consul.StateStore {
+	store, err := consul.NewStateStore(nil, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return store
+}
+
+// RegisterNode registers a node
+func RegisterNode(t *testing.T, store *consul.StateStore, index uint64, node, address string) {
+	if err := store.EnsureNode(index, structs.Node{Node: node, Address: address}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// RegisterService registers a service on an existing node
+func RegisterService(t *testing.T, store *consul.StateStore, index uint64, node string, srv *structs.NodeService) {
+	if err := store.EnsureService(index, node, srv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// EnsureService doesn't report all the failures, so check the result
+	_, services := store.NodeServices(node)
+	if services == nil || services.Services[srv.ID] == nil {
+		t.Fatalf("Failed to register service '%s' on '%s'", srv.ID, node)
+	}
+}
+
+// RegisterCheck registers a check on an existing node
+func RegisterCheck(t *testing.T, store *consul.StateStore, index uint64, check *structs.HealthCheck) {
+	if err := store.EnsureCheck(index, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// Fixture builds the contents of a state store. The entries are applied
+// in the order they were added, at consecutive indexes starting at 1,
+// so the resulting store is always the same.
+type Fixture struct {
+	steps []func(t *testing.T, store *consul.StateStore, index uint64)
+}
+
+// NewFixture creates an empty fixture
+func NewFixture() *Fixture {
+	return &Fixture{}
+}
+
+// Node adds a node
+func (f *Fixture) Node(node, address string) *Fixture {
+	f.steps = append(f.steps, func(t *testing.T, store *consul.StateStore, index uint64) {
+		RegisterNode(t, store, index, node, address)
+	})
+	return f
+}
+
+// Service adds a service to a node, using the name of the service as
+// its ID
+func (f *Fixture) Service(node, service string, port int, tags ...string) *Fixture {
+	return f.ServiceDef(node, &structs.NodeService{
+		ID:      service,
+		Service: service,
+		Port:    port,
+		Tags:    tags,
+	})
+}
+
+// ServiceDef adds a service definition to a node
+func (f *Fixture) ServiceDef(node string, srv *structs.NodeService) *Fixture {
+	f.steps = append(f.steps, func(t *testing.T, store *consul.StateStore, index uint64) {
+		RegisterService(t, store, index, node, srv)
+	})
+	return f
+}
+
+// Check adds a check to a node, associated with a service if serviceID
+// is not empty
+func (f *Fixture) Check(node, checkID, serviceID, status string) *Fixture {
+	f.steps = append(f.steps, func(t *testing.T, store *consul.StateStore, index uint64) {
+		RegisterCheck(t, store, index, &structs.HealthCheck{
+			Node:      node,
+			CheckID:   checkID,
+			Name:      checkID,
+			Status:    status,
+			ServiceID: serviceID,
+		})
+	})
+	return f
+}
+
+// KV adds a KV entry
+func (f *Fixture) KV(key string, value []byte) *Fixture {
+	f.steps = append(f.steps, func(t *testing.T, store *consul.StateStore, index uint64) {
+		if err := store.KVSSet(index, &structs.DirEntry{Key: key, Value: value}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	})
+	return f
+}
+
+// Apply applies the fixture to a store, and returns the last index used
+func (f *Fixture) Apply(t *testing.T, store *consul.StateStore) uint64 {
+	var index uint64
+	for _, step := range f.steps {
+		index++
+		step(t, store, index)
+	}
+	return index
+}
+
+// Store creates a new store with the contents of the fixture. The store
+// must be closed by the caller.
+func (f *Fixture) Store(t *testing.T) *consul.StateStore {
+	store := NewStore(t)
+	f.Apply(t, store)
+	return store
+}
+
+// dumpNode is a node along with its services and checks
+type dumpNode struct {
+	Node     structs.Node
+	Services []*structs.NodeService
+	Checks   structs.HealthChecks
+}
+
+// dump is the contents of a store compared by CompareGolden
+type dump struct {
+	Nodes []*dumpNode
+	KVs   structs.DirEntries
+}
+
+// Dump returns the catalog and KV contents of a store as indented JSON.
+// Everything is sorted, so equal stores always have the same dump.
+func Dump(t *testing.T, store *consul.StateStore) []byte {
+	var d dump
+	_, nodes := store.Nodes()
+	sort.Sort(nodesByName(nodes))
+	for _, node := range nodes {
+		dn := &dumpNode{Node: node}
+		if _, services := store.NodeServices(node.Node); services != nil {
+			for _, srv := range services.Services {
+				dn.Services = append(dn.Services, srv)
+			}
+		}
+		sort.Sort(servicesByID(dn.Services))
+		_, dn.Checks = store.NodeChecks(node.Node)
+		sort.Sort(checksByID(dn.Checks))
+		d.Nodes = append(d.Nodes, dn)
+	}
+
+	_, _, kvs, err := store.KVSList("")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d.KVs = kvs
+
+	buf, err := json.MarshalIndent(&d, "", "  ")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return append(buf, '\n')
+}
+
+// CompareGolden compares the dump of a store against a golden file,
+// failing the test if they differ. If the UpdateGoldenEnv environment
+// variable is set, the golden file is written instead.
+func CompareGolden(t *testing.T, store *consul.StateStore, path string) {
+	update := os.Getenv(UpdateGoldenEnv) != ""
+	if err := compareGolden(Dump(t, store), path, update); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// compareGolden compares a dump against a golden file, or writes it
+func compareGolden(got []byte, path string, update bool) error {
+	if update {
+		return ioutil.WriteFile(path, got, 0644)
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read golden file (set %s=1 to create it): %v",
+			UpdateGoldenEnv, err)
+	}
+	if !bytes.Equal(got, expected) {
+		return fmt.Errorf("State differs from golden file '%s', got:\n%s", path, got)
+	}
+	return nil
+}
+
+type nodesByName structs.Nodes
+
+func (n nodesByName) Len() int           { return len(n) }
+func (n nodesByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesByName) Less(i, j int) bool { return n[i].Node < n[j].Node }
+
+type servicesByID []*structs.NodeService
+
+func (s servicesByID) Len() int           { return len(s) }
+func (s servicesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s servicesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+type checksByID structs.HealthChecks
+
+func (c checksByID) Len() int           { return len(c) }
+func (c checksByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c checksByID) Less(i, j int) bool { return c[i].CheckID < c[j].CheckID }
@@ -0,0 +1,101 @@
+package statetest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func testFixture() *Fixture {
+	return NewFixture().
+		Node("foo", "127.0.0.1").
+		Node("bar", "127.0.0.2").
+		Service("foo", "db", 8000, "master").
+		Service("bar", "db", 8000, "slave").
+		Check("foo", "db", "db", structs.HealthPassing).
+		Check("bar", "mem", "", structs.HealthCritical).
+		KV("foo/bar", []byte("baz"))
+}
+
+func TestFixture(t *testing.T) {
+	store := NewStore(t)
+	defer store.Close()
+
+	if idx := testFixture().Apply(t, store); idx != 7 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	_, nodes := store.ServiceNodes("db")
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, checks := store.NodeChecks("bar")
+	if len(checks) != 1 || checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %v", checks)
+	}
+	_, ent, err := store.KVSGet("foo/bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ent == nil || string(ent.Value) != "baz" || ent.CreateIndex != 7 {
+		t.Fatalf("bad: %v", ent)
+	}
+}
+
+func TestDump(t *testing.T) {
+	store1 := testFixture().Store(t)
+	defer store1.Close()
+	store2 := testFixture().Store(t)
+	defer store2.Close()
+
+	// Equal stores have the same dump
+	dump := Dump(t, store1)
+	if string(dump) != string(Dump(t, store2)) {
+		t.Fatalf("bad: %s", dump)
+	}
+	for _, expect := range []string{`"Node": "bar"`, `"Key": "foo/bar"`, `"Status": "critical"`} {
+		if !strings.Contains(string(dump), expect) {
+			t.Fatalf("missing %s: %s", expect, dump)
+		}
+	}
+
+	// Any change shows
+	RegisterNode(t, store2, 8, "baz", "127.0.0.3")
+	if string(dump) == string(Dump(t, store2)) {
+		t.Fatalf("should differ")
+	}
+}
+
+func TestCompareGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statetest")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.golden")
+
+	store := testFixture().Store(t)
+	defer store.Close()
+	dump := Dump(t, store)
+
+	// A missing golden file fails unless updating
+	if err := compareGolden(dump, path, false); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := compareGolden(dump, path, true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := compareGolden(dump, path, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A changed store fails
+	RegisterNode(t, store, 8, "baz", "127.0.0.3")
+	if err := compareGolden(Dump(t, store), path, false); err == nil {
+		t.Fatalf("should fail")
+	}
+}
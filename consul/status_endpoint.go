@@ -1,5 +1,9 @@
 package consul
 
+import (
+	"github.com/hashicorp/consul/consul/structs"
+)
+
 // Status endpoint is used to check on server status
 type Status struct {
 	server *Server
@@ -31,3 +35,14 @@ func (s *Status) Peers(args struct{}, reply *[]string) error {
 	*reply = peers
 	return nil
 }
+
+// AppliedIndex is used to get the last index applied by the leader.
+// Writes are applied by the leader before they return, so this is at
+// least the index of any completed write.
+func (s *Status) AppliedIndex(args *structs.DCSpecificRequest, reply *uint64) error {
+	if done, err := s.server.forward("Status.AppliedIndex", args, args, reply); done {
+		return err
+	}
+	*reply = s.server.fsm.AppliedIndex()
+	return nil
+}
@@ -0,0 +1,602 @@
+package structs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The hot structs have msgpack encoders and decoders generated by
+// msgpackgen, which avoids the reflection overhead of the generic codec.
+// The generated encoders produce the same map-of-fields layout as the
+// generic codec, so the two are interchangeable on the wire. They are
+// used by Encode and Decode, by the catalog and KV records of the FSM
+// snapshots, and by the RPC codec for the requests and responses of the
+// catalog, health and KV endpoints.
+//go:generate go run msgpackgen/main.go -output structs_msgpack.go -types Node,ServiceNode,NodeService,ConnectProxyConfig,Upstream,HealthCheck,DirEntry,AuditSource,RegisterRequest,DeregisterRequest,DCSpecificRequest,ServiceSpecificRequest,NodeSpecificRequest,IndexedNodes,IndexedServiceNodes,IndexedHealthChecks,KVSRequest,KeyRequest,IndexedDirEntries structs.go
+
+// MsgpackMarshaler is implemented by types with a generated encoder
+type MsgpackMarshaler interface {
+	// MarshalMsgpack appends the encoded object to b
+	MarshalMsgpack(b []byte) []byte
+}
+
+// MsgpackUnmarshaler is implemented by types with a generated decoder
+type MsgpackUnmarshaler interface {
+	// UnmarshalMsgpack decodes an object from the front of b,
+	// returning the remaining bytes
+	UnmarshalMsgpack(b []byte) ([]byte, error)
+}
+
+var (
+	errMsgpackShort = fmt.Errorf("msgpack: unexpected end of input")
+)
+
+// msgpackAppendMapHeader appends the header of a map with n entries
+func msgpackAppendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xde, byte(n>>8), byte(n))
+	default:
+		return append(b, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+// msgpackAppendArrayHeader appends the header of an array with n entries
+func msgpackAppendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xdc, byte(n>>8), byte(n))
+	default:
+		return append(b, 0xdd, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+// msgpackAppendRawHeader appends the header of a raw value. The raw8
+// type is avoided, as it is not understood by older decoders.
+func msgpackAppendRawHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 31:
+		return append(b, 0xa0|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		return append(b, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func msgpackAppendNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+func msgpackAppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+func msgpackAppendString(b []byte, s string) []byte {
+	b = msgpackAppendRawHeader(b, len(s))
+	return append(b, s...)
+}
+
+func msgpackAppendBytes(b []byte, v []byte) []byte {
+	if v == nil {
+		return msgpackAppendNil(b)
+	}
+	b = msgpackAppendRawHeader(b, len(v))
+	return append(b, v...)
+}
+
+func msgpackAppendUint(b []byte, v uint64) []byte {
+	switch {
+	case v <= 0x7f:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return append(b, 0xcd, byte(v>>8), byte(v))
+	case v <= math.MaxUint32:
+		return append(b, 0xce, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		b = append(b, 0xcf)
+		return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func msgpackAppendInt(b []byte, v int64) []byte {
+	if v >= 0 {
+		return msgpackAppendUint(b, uint64(v))
+	}
+	switch {
+	case v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return append(b, 0xd1, byte(v>>8), byte(v))
+	case v >= math.MinInt32:
+		return append(b, 0xd2, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		b = append(b, 0xd3)
+		return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func msgpackAppendStringSlice(b []byte, v []string) []byte {
+	if v == nil {
+		return msgpackAppendNil(b)
+	}
+	b = msgpackAppendArrayHeader(b, len(v))
+	for _, s := range v {
+		b = msgpackAppendString(b, s)
+	}
+	return b
+}
+
+func msgpackAppendStringMap(b []byte, v map[string]string) []byte {
+	if v == nil {
+		return msgpackAppendNil(b)
+	}
+	b = msgpackAppendMapHeader(b, len(v))
+	for k, s := range v {
+		b = msgpackAppendString(b, k)
+		b = msgpackAppendString(b, s)
+	}
+	return b
+}
+
+func msgpackAppendStringSliceMap(b []byte, v map[string][]string) []byte {
+	if v == nil {
+		return msgpackAppendNil(b)
+	}
+	b = msgpackAppendMapHeader(b, len(v))
+	for k, s := range v {
+		b = msgpackAppendString(b, k)
+		b = msgpackAppendStringSlice(b, s)
+	}
+	return b
+}
+
+// MarshalRegisterMsgpack appends a RegisterRequest of the node, with the
+// service or check if not nil, using the generated encoders. Only the
+// fields a snapshot restore reads are encoded.
+func MarshalRegisterMsgpack(b []byte, node *Node, service *NodeService,
+	check *HealthCheck) []byte {
+	n := 3
+	if service != nil {
+		n++
+	}
+	if check != nil {
+		n++
+	}
+	b = msgpackAppendMapHeader(b, n)
+	b = msgpackAppendString(b, "Node")
+	b = msgpackAppendString(b, node.Node)
+	b = msgpackAppendString(b, "Address")
+	b = msgpackAppendString(b, node.Address)
+	b = msgpackAppendString(b, "NodeMeta")
+	b = msgpackAppendStringMap(b, node.Meta)
+	if service != nil {
+		b = msgpackAppendString(b, "Service")
+		b = service.MarshalMsgpack(b)
+	}
+	if check != nil {
+		b = msgpackAppendString(b, "Check")
+		b = check.MarshalMsgpack(b)
+	}
+	return b
+}
+
+// msgpackTake splits n bytes from the front of b
+func msgpackTake(b []byte, n int) ([]byte, []byte, error) {
+	if n < 0 || len(b) < n {
+		return nil, b, errMsgpackShort
+	}
+	return b[:n], b[n:], nil
+}
+
+// msgpackReadLength reads a big endian length of the given width
+func msgpackReadLength(b []byte, width int) (int, []byte, error) {
+	v, b, err := msgpackTake(b, width)
+	if err != nil {
+		return 0, b, err
+	}
+	switch width {
+	case 1:
+		return int(v[0]), b, nil
+	case 2:
+		return int(binary.BigEndian.Uint16(v)), b, nil
+	default:
+		return int(binary.BigEndian.Uint32(v)), b, nil
+	}
+}
+
+// msgpackIsNil checks if the next value is nil, consuming it if so
+func msgpackIsNil(b []byte) (bool, []byte) {
+	if len(b) > 0 && b[0] == 0xc0 {
+		return true, b[1:]
+	}
+	return false, b
+}
+
+// msgpackReadMapHeader reads the number of entries in a map
+func msgpackReadMapHeader(b []byte) (int, []byte, error) {
+	if len(b) == 0 {
+		return 0, b, errMsgpackShort
+	}
+	c := b[0]
+	switch {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), b[1:], nil
+	case c == 0xde:
+		return msgpackReadLength(b[1:], 2)
+	case c == 0xdf:
+		return msgpackReadLength(b[1:], 4)
+	case c == 0xc0:
+		return 0, b[1:], nil
+	}
+	return 0, b, fmt.Errorf("msgpack: expected map, got 0x%02x", c)
+}
+
+// msgpackReadArrayHeader reads the number of entries in an array
+func msgpackReadArrayHeader(b []byte) (int, []byte, error) {
+	if len(b) == 0 {
+		return 0, b, errMsgpackShort
+	}
+	c := b[0]
+	switch {
+	case c&0xf0 == 0x90:
+		return int(c & 0x0f), b[1:], nil
+	case c == 0xdc:
+		return msgpackReadLength(b[1:], 2)
+	case c == 0xdd:
+		return msgpackReadLength(b[1:], 4)
+	}
+	return 0, b, fmt.Errorf("msgpack: expected array, got 0x%02x", c)
+}
+
+// msgpackReadRaw reads a raw, string, or binary value without copying
+func msgpackReadRaw(b []byte) ([]byte, []byte, error) {
+	if len(b) == 0 {
+		return nil, b, errMsgpackShort
+	}
+	c := b[0]
+	var n int
+	var err error
+	rest := b[1:]
+	switch {
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c == 0xd9 || c == 0xc4:
+		n, rest, err = msgpackReadLength(rest, 1)
+	case c == 0xda || c == 0xc5:
+		n, rest, err = msgpackReadLength(rest, 2)
+	case c == 0xdb || c == 0xc6:
+		n, rest, err = msgpackReadLength(rest, 4)
+	default:
+		return nil, b, fmt.Errorf("msgpack: expected raw, got 0x%02x", c)
+	}
+	if err != nil {
+		return nil, b, err
+	}
+	return msgpackTake(rest, n)
+}
+
+func msgpackReadString(b []byte) (string, []byte, error) {
+	if isNil, rest := msgpackIsNil(b); isNil {
+		return "", rest, nil
+	}
+	v, b, err := msgpackReadRaw(b)
+	return string(v), b, err
+}
+
+func msgpackReadBytes(b []byte) ([]byte, []byte, error) {
+	if isNil, rest := msgpackIsNil(b); isNil {
+		return nil, rest, nil
+	}
+	v, b, err := msgpackReadRaw(b)
+	if err != nil {
+		return nil, b, err
+	}
+	out := make([]byte, len(v))
+	copy(out, v)
+	return out, b, nil
+}
+
+func msgpackReadBool(b []byte) (bool, []byte, error) {
+	if len(b) == 0 {
+		return false, b, errMsgpackShort
+	}
+	switch b[0] {
+	case 0xc2, 0xc0:
+		return false, b[1:], nil
+	case 0xc3:
+		return true, b[1:], nil
+	}
+	return false, b, fmt.Errorf("msgpack: expected bool, got 0x%02x", b[0])
+}
+
+// msgpackReadInt reads any integer encoding as an int64
+func msgpackReadInt(b []byte) (int64, []byte, error) {
+	if len(b) == 0 {
+		return 0, b, errMsgpackShort
+	}
+	c := b[0]
+	rest := b[1:]
+	switch {
+	case c <= 0x7f:
+		return int64(c), rest, nil
+	case c >= 0xe0:
+		return int64(int8(c)), rest, nil
+	case c == 0xc0:
+		return 0, rest, nil
+	}
+
+	var width int
+	switch c {
+	case 0xcc, 0xd0:
+		width = 1
+	case 0xcd, 0xd1:
+		width = 2
+	case 0xce, 0xd2:
+		width = 4
+	case 0xcf, 0xd3:
+		width = 8
+	default:
+		return 0, b, fmt.Errorf("msgpack: expected integer, got 0x%02x", c)
+	}
+	v, rest, err := msgpackTake(rest, width)
+	if err != nil {
+		return 0, b, err
+	}
+	signed := c >= 0xd0
+	switch width {
+	case 1:
+		if signed {
+			return int64(int8(v[0])), rest, nil
+		}
+		return int64(v[0]), rest, nil
+	case 2:
+		u := binary.BigEndian.Uint16(v)
+		if signed {
+			return int64(int16(u)), rest, nil
+		}
+		return int64(u), rest, nil
+	case 4:
+		u := binary.BigEndian.Uint32(v)
+		if signed {
+			return int64(int32(u)), rest, nil
+		}
+		return int64(u), rest, nil
+	default:
+		return int64(binary.BigEndian.Uint64(v)), rest, nil
+	}
+}
+
+func msgpackReadUint(b []byte) (uint64, []byte, error) {
+	v, b, err := msgpackReadInt(b)
+	return uint64(v), b, err
+}
+
+func msgpackReadStringSlice(b []byte) ([]string, []byte, error) {
+	if isNil, rest := msgpackIsNil(b); isNil {
+		return nil, rest, nil
+	}
+	n, b, err := msgpackReadArrayHeader(b)
+	if err != nil {
+		return nil, b, err
+	}
+	out := make([]string, n)
+	for i := 0; i < n; i++ {
+		if out[i], b, err = msgpackReadString(b); err != nil {
+			return nil, b, err
+		}
+	}
+	return out, b, nil
+}
+
+func msgpackReadStringMap(b []byte) (map[string]string, []byte, error) {
+	if isNil, rest := msgpackIsNil(b); isNil {
+		return nil, rest, nil
+	}
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return nil, b, err
+	}
+	out := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		var k, v string
+		if k, b, err = msgpackReadString(b); err != nil {
+			return nil, b, err
+		}
+		if v, b, err = msgpackReadString(b); err != nil {
+			return nil, b, err
+		}
+		out[k] = v
+	}
+	return out, b, nil
+}
+
+func msgpackReadStringSliceMap(b []byte) (map[string][]string, []byte, error) {
+	if isNil, rest := msgpackIsNil(b); isNil {
+		return nil, rest, nil
+	}
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return nil, b, err
+	}
+	out := make(map[string][]string, n)
+	for i := 0; i < n; i++ {
+		var k string
+		var v []string
+		if k, b, err = msgpackReadString(b); err != nil {
+			return nil, b, err
+		}
+		if v, b, err = msgpackReadStringSlice(b); err != nil {
+			return nil, b, err
+		}
+		out[k] = v
+	}
+	return out, b, nil
+}
+
+// msgpackSkip skips over the next value, which is used to ignore
+// fields that are not known to the generated decoder
+func msgpackSkip(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return b, errMsgpackShort
+	}
+	c := b[0]
+	rest := b[1:]
+	switch {
+	case c <= 0x7f, c >= 0xe0, c == 0xc0, c == 0xc2, c == 0xc3:
+		return rest, nil
+	case c&0xe0 == 0xa0, c == 0xd9, c == 0xda, c == 0xdb,
+		c == 0xc4, c == 0xc5, c == 0xc6:
+		_, rest, err := msgpackReadRaw(b)
+		return rest, err
+	case c&0xf0 == 0x80, c == 0xde, c == 0xdf:
+		n, rest, err := msgpackReadMapHeader(b)
+		if err != nil {
+			return b, err
+		}
+		return msgpackSkipN(rest, 2*n)
+	case c&0xf0 == 0x90, c == 0xdc, c == 0xdd:
+		n, rest, err := msgpackReadArrayHeader(b)
+		if err != nil {
+			return b, err
+		}
+		return msgpackSkipN(rest, n)
+	case c == 0xcc, c == 0xd0:
+		_, rest, err := msgpackTake(rest, 1)
+		return rest, err
+	case c == 0xcd, c == 0xd1:
+		_, rest, err := msgpackTake(rest, 2)
+		return rest, err
+	case c == 0xce, c == 0xd2, c == 0xca:
+		_, rest, err := msgpackTake(rest, 4)
+		return rest, err
+	case c == 0xcf, c == 0xd3, c == 0xcb:
+		_, rest, err := msgpackTake(rest, 8)
+		return rest, err
+	case c >= 0xd4 && c <= 0xd8:
+		// Fixed size extensions carry a type byte and 2^n data bytes
+		_, rest, err := msgpackTake(rest, 1+(1<<(c-0xd4)))
+		return rest, err
+	case c >= 0xc7 && c <= 0xc9:
+		n, rest, err := msgpackReadLength(rest, 1<<(c-0xc7))
+		if err != nil {
+			return b, err
+		}
+		_, rest, err = msgpackTake(rest, 1+n)
+		return rest, err
+	}
+	return b, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+}
+
+// msgpackSkipN skips over the next n values
+func msgpackSkipN(b []byte, n int) ([]byte, error) {
+	var err error
+	for i := 0; i < n; i++ {
+		if b, err = msgpackSkip(b); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// ReadMsgpack reads the next value from r into buf, without decoding
+// it, so a value of a stream can be decoded by the generated decoders
+func ReadMsgpack(r *bufio.Reader, buf *bytes.Buffer) error {
+	for pending := 1; pending > 0; pending-- {
+		c, err := r.ReadByte()
+		if err != nil {
+			// Only a stream ending between values is a clean EOF
+			if err == io.EOF && buf.Len() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		buf.WriteByte(c)
+
+		// Find the size of the payload, or of the length that precedes
+		// it, and the number of values the map or array contains
+		var size, width int
+		switch {
+		case c <= 0x7f, c >= 0xe0, c == 0xc0, c == 0xc2, c == 0xc3:
+		case c&0xe0 == 0xa0:
+			size = int(c & 0x1f)
+		case c&0xf0 == 0x80:
+			pending += 2 * int(c&0x0f)
+		case c&0xf0 == 0x90:
+			pending += int(c & 0x0f)
+		case c == 0xd9, c == 0xc4, c == 0xc7:
+			width = 1
+		case c == 0xda, c == 0xc5, c == 0xc8, c == 0xdc, c == 0xde:
+			width = 2
+		case c == 0xdb, c == 0xc6, c == 0xc9, c == 0xdd, c == 0xdf:
+			width = 4
+		case c == 0xcc, c == 0xd0:
+			size = 1
+		case c == 0xcd, c == 0xd1:
+			size = 2
+		case c == 0xce, c == 0xd2, c == 0xca:
+			size = 4
+		case c == 0xcf, c == 0xd3, c == 0xcb:
+			size = 8
+		case c >= 0xd4 && c <= 0xd8:
+			// Fixed size extensions carry a type byte and 2^n data bytes
+			size = 1 + (1 << (c - 0xd4))
+		default:
+			return fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+		}
+
+		if width > 0 {
+			if err := msgpackCopyN(r, buf, width); err != nil {
+				return err
+			}
+			n, _, err := msgpackReadLength(buf.Bytes()[buf.Len()-width:], width)
+			if err != nil {
+				return err
+			}
+			switch c {
+			case 0xdc, 0xdd:
+				pending += n
+			case 0xde, 0xdf:
+				pending += 2 * n
+			case 0xc7, 0xc8, 0xc9:
+				size = 1 + n
+			default:
+				size = n
+			}
+		}
+		if err := msgpackCopyN(r, buf, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// msgpackCopyN copies n bytes from r to buf. The buffer only grows as
+// the bytes arrive, so a bogus length can't exhaust the memory.
+func msgpackCopyN(r io.Reader, buf *bytes.Buffer, n int) error {
+	copied, err := buf.ReadFrom(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return err
+	}
+	if copied != int64(n) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
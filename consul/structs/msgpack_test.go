@@ -0,0 +1,357 @@
+package structs
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+func testMsgpackObjects() []interface{} {
+	return []interface{}{
+		&Node{Node: "foo", Address: "127.0.0.1", Meta: map[string]string{"rack": "r1"}},
+		&ServiceNode{
+			Node:           "foo",
+			Address:        "127.0.0.1",
+			ServiceID:      "db1",
+			ServiceName:    "db",
+			ServiceTags:    []string{"master", "v2"},
+			ServiceAddress: "127.0.0.2",
+			ServicePort:    8000,
+			ServiceMeta:    map[string]string{"version": "2"},
+
+			ServiceWeightPassing: 10,
+			ServiceWeightWarning: 1,
+
+			ServiceKind: ServiceKindConnectProxy,
+			ServiceProxy: ConnectProxyConfig{
+				DestinationServiceName: "web",
+				Upstreams:              []Upstream{{DestinationName: "db", LocalBindPort: 9191}},
+			},
+		},
+		&NodeService{
+			ID:                "db1",
+			Service:           "db",
+			Tags:              []string{"master"},
+			Port:              70000,
+			EnableTagOverride: true,
+			Meta:              map[string]string{"version": "2", "lag": ""},
+			WeightPassing:     10,
+			WeightWarning:     1,
+			Kind:              ServiceKindMeshGateway,
+			WANAddress:        "198.51.100.1",
+			WANPort:           443,
+		},
+		&ConnectProxyConfig{
+			DestinationServiceName: "web",
+			DestinationServiceID:   "web1",
+			LocalServiceAddress:    "127.0.0.1",
+			LocalServicePort:       8080,
+			Upstreams: []Upstream{
+				{DestinationName: "db", LocalBindPort: 9191},
+				{DestinationName: "cache", Datacenter: "dc2", LocalBindAddress: "127.0.0.2", LocalBindPort: 9192},
+			},
+		},
+		&Upstream{DestinationName: "db", LocalBindPort: 9191},
+		&HealthCheck{
+			Node:        "foo",
+			CheckID:     "db",
+			Name:        "db check",
+			Status:      HealthPassing,
+			Notes:       "notes",
+			Output:      string(bytes.Repeat([]byte("x"), 70000)),
+			ServiceID:   "db1",
+			ServiceName: "db",
+			Type:        CheckTypeHTTP,
+			Target:      "http://127.0.0.1:8000/health",
+			Method:      "POST",
+			Header:      map[string][]string{"X-Token": []string{"a", "b"}},
+		},
+		&DirEntry{
+			CreateIndex: 1,
+			ModifyIndex: 1 << 40,
+			LockIndex:   300,
+			Key:         "foo/bar",
+			Flags:       42,
+			Value:       []byte("test"),
+			Session:     "adf4238a-882b-9ddc-4a9d-5b6758e4159e",
+		},
+		&RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			NodeMeta:   map[string]string{"rack": "r1"},
+			Service:    &NodeService{ID: "db1", Service: "db", Port: 8000},
+			Checks: HealthChecks{
+				{Node: "foo", CheckID: "db", Status: HealthPassing},
+				{Node: "foo", CheckID: "disk", Status: HealthWarning},
+			},
+			CAS:          true,
+			ModifyIndex:  12,
+			Audit:        AuditSource{Time: 1 << 60, SourceAddr: "127.0.0.1:5000"},
+			WriteRequest: WriteRequest{Token: "root"},
+		},
+		&KVSRequest{
+			Datacenter:   "dc1",
+			Op:           KVSCAS,
+			DirEnt:       DirEntry{Key: "foo", Value: []byte("bar"), ModifyIndex: 2},
+			WriteRequest: WriteRequest{Token: "root"},
+		},
+		&KeyRequest{
+			Datacenter: "dc1",
+			Key:        "foo/*",
+			Glob:       true,
+			QueryOptions: QueryOptions{
+				Token:         "root",
+				MinQueryIndex: 10,
+				MaxQueryTime:  time.Second,
+				AllowStale:    true,
+				Limit:         5,
+				NextToken:     "foo/bar",
+			},
+		},
+		&IndexedServiceNodes{
+			ServiceNodes: ServiceNodes{
+				{Node: "foo", ServiceID: "db1", ServiceName: "db", ServicePort: 8000},
+				{Node: "bar", ServiceID: "db2", ServiceName: "db", ServicePort: 8001},
+			},
+			QueryMeta: QueryMeta{Index: 10, LastContact: time.Millisecond, KnownLeader: true},
+		},
+		&IndexedDirEntries{
+			Entries:   DirEntries{{Key: "foo", Value: []byte("bar"), ModifyIndex: 3}},
+			QueryMeta: QueryMeta{Index: 3, NextToken: "foo"},
+		},
+	}
+}
+
+// msgpackNumFields counts the fields of a struct as the codecs encode
+// them, with the fields of the embedded structs inlined
+func msgpackNumFields(t reflect.Type) int {
+	n := 0
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Anonymous && f.Type.Kind() == reflect.Struct {
+			n += msgpackNumFields(f.Type)
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMsgpack_GeneratedToReflect(t *testing.T) {
+	for _, obj := range testMsgpackObjects() {
+		buf := obj.(MsgpackMarshaler).MarshalMsgpack(nil)
+
+		out := reflect.New(reflect.TypeOf(obj).Elem()).Interface()
+		dec := codec.NewDecoder(bytes.NewReader(buf), msgpackHandle)
+		if err := dec.Decode(out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(obj, out) {
+			t.Fatalf("bad: %#v %#v", obj, out)
+		}
+	}
+}
+
+func TestMsgpack_ReflectToGenerated(t *testing.T) {
+	for _, obj := range testMsgpackObjects() {
+		var buf bytes.Buffer
+		if err := codec.NewEncoder(&buf, msgpackHandle).Encode(obj); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		out := reflect.New(reflect.TypeOf(obj).Elem()).Interface()
+		rest, err := out.(MsgpackUnmarshaler).UnmarshalMsgpack(buf.Bytes())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(rest) != 0 {
+			t.Fatalf("bad: %v", rest)
+		}
+		if !reflect.DeepEqual(obj, out) {
+			t.Fatalf("bad: %#v %#v", obj, out)
+		}
+	}
+}
+
+func TestMsgpack_AllFields(t *testing.T) {
+	// Catch a struct that has grown a field without the
+	// generated code being updated
+	for _, obj := range testMsgpackObjects() {
+		buf := obj.(MsgpackMarshaler).MarshalMsgpack(nil)
+		n, _, err := msgpackReadMapHeader(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if expect := msgpackNumFields(reflect.TypeOf(obj).Elem()); n != expect {
+			t.Fatalf("%T has %d fields but %d are encoded, run go generate",
+				obj, expect, n)
+		}
+	}
+}
+
+func TestMsgpack_SkipUnknown(t *testing.T) {
+	// Encode a superset of the Node fields
+	in := map[string]interface{}{
+		"Node":    "foo",
+		"Extra":   map[string]interface{}{"a": []int{1, -2, 300}},
+		"Address": "127.0.0.1",
+		"Float":   1.5,
+	}
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, msgpackHandle).Encode(in); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var out Node
+	if err := Decode(buf.Bytes(), &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Node != "foo" || out.Address != "127.0.0.1" {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestMsgpack_ReadMsgpack(t *testing.T) {
+	// Stream the objects along with values of the types they don't use
+	values := append(testMsgpackObjects(), -5, 1.5, []interface{}{1, "a", nil},
+		map[string]interface{}{"a": []int{1, 300}, "b": map[string]bool{"c": true}})
+	var stream bytes.Buffer
+	var encoded [][]byte
+	for _, v := range values {
+		var buf bytes.Buffer
+		if err := codec.NewEncoder(&buf, msgpackHandle).Encode(v); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		encoded = append(encoded, buf.Bytes())
+		stream.Write(buf.Bytes())
+	}
+
+	r := bufio.NewReader(bytes.NewReader(stream.Bytes()))
+	for _, expect := range encoded {
+		var buf bytes.Buffer
+		if err := ReadMsgpack(r, &buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), expect) {
+			t.Fatalf("bad: %v %v", buf.Bytes(), expect)
+		}
+	}
+	var buf bytes.Buffer
+	if err := ReadMsgpack(r, &buf); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A value cut short is not a clean EOF
+	truncated := encoded[0][:len(encoded[0])-1]
+	r = bufio.NewReader(bytes.NewReader(truncated))
+	if err := ReadMsgpack(r, &buf); err != io.ErrUnexpectedEOF {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMsgpack_MarshalRegister(t *testing.T) {
+	objs := testMsgpackObjects()
+	node := objs[0].(*Node)
+	var service *NodeService
+	var check *HealthCheck
+	for _, obj := range objs {
+		switch v := obj.(type) {
+		case *NodeService:
+			service = v
+		case *HealthCheck:
+			check = v
+		}
+	}
+
+	cases := []RegisterRequest{
+		{Node: node.Node, Address: node.Address, NodeMeta: node.Meta},
+		{Node: node.Node, Address: node.Address, NodeMeta: node.Meta, Service: service},
+		{Node: node.Node, Address: node.Address, NodeMeta: node.Meta, Check: check},
+	}
+	for _, expect := range cases {
+		buf := MarshalRegisterMsgpack(nil, node, expect.Service, expect.Check)
+
+		var out RegisterRequest
+		dec := codec.NewDecoder(bytes.NewReader(buf), msgpackHandle)
+		if err := dec.Decode(&out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(&expect, &out) {
+			t.Fatalf("bad: %#v %#v", expect, out)
+		}
+	}
+}
+
+func TestMsgpack_Encode(t *testing.T) {
+	in := &DirEntry{Key: "foo", Value: []byte("bar"), ModifyIndex: 10}
+	buf, err := Encode(KVSRequestType, in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if MessageType(buf[0]) != KVSRequestType {
+		t.Fatalf("bad: %v", buf[0])
+	}
+
+	var out DirEntry
+	if err := Decode(buf[1:], &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(in, &out) {
+		t.Fatalf("bad: %#v %#v", in, out)
+	}
+}
+
+func benchmarkDirEntry() *DirEntry {
+	return &DirEntry{
+		CreateIndex: 1000,
+		ModifyIndex: 2000,
+		Key:         "service/web/config",
+		Flags:       42,
+		Value:       bytes.Repeat([]byte("x"), 256),
+	}
+}
+
+func BenchmarkMsgpack_Encode_Generated(b *testing.B) {
+	in := benchmarkDirEntry()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = in.MarshalMsgpack(buf[:0])
+	}
+}
+
+func BenchmarkMsgpack_Encode_Reflect(b *testing.B) {
+	in := benchmarkDirEntry()
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := codec.NewEncoder(&buf, msgpackHandle).Encode(in); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkMsgpack_Decode_Generated(b *testing.B) {
+	buf := benchmarkDirEntry().MarshalMsgpack(nil)
+	for i := 0; i < b.N; i++ {
+		var out DirEntry
+		if _, err := out.UnmarshalMsgpack(buf); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkMsgpack_Decode_Reflect(b *testing.B) {
+	buf := benchmarkDirEntry().MarshalMsgpack(nil)
+	for i := 0; i < b.N; i++ {
+		var out DirEntry
+		dec := codec.NewDecoder(bytes.NewReader(buf), msgpackHandle)
+		if err := dec.Decode(&out); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// msgpackgen generates reflection-free msgpack encoders and decoders for
+// the structs package. The generated code relies on the msgpack helpers
+// in the structs package, so it can only be used there.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// fieldKind describes how a field is encoded
+type fieldKind struct {
+	appendFn string // Helper used to encode the field
+	readFn   string // Helper used to decode the field
+	wireType string // Type produced by readFn / consumed by appendFn
+}
+
+var builtinKinds = map[string]fieldKind{
+	"string":              {"msgpackAppendString", "msgpackReadString", "string"},
+	"bool":                {"msgpackAppendBool", "msgpackReadBool", "bool"},
+	"[]string":            {"msgpackAppendStringSlice", "msgpackReadStringSlice", "[]string"},
+	"[]byte":              {"msgpackAppendBytes", "msgpackReadBytes", "[]byte"},
+	"map[string]string":   {"msgpackAppendStringMap", "msgpackReadStringMap", "map[string]string"},
+	"map[string][]string": {"msgpackAppendStringSliceMap", "msgpackReadStringSliceMap", "map[string][]string"},
+	"int":                 {"msgpackAppendInt", "msgpackReadInt", "int64"},
+	"int8":                {"msgpackAppendInt", "msgpackReadInt", "int64"},
+	"int16":               {"msgpackAppendInt", "msgpackReadInt", "int64"},
+	"int32":               {"msgpackAppendInt", "msgpackReadInt", "int64"},
+	"int64":               {"msgpackAppendInt", "msgpackReadInt", "int64"},
+	"time.Duration":       {"msgpackAppendInt", "msgpackReadInt", "int64"},
+	"uint":                {"msgpackAppendUint", "msgpackReadUint", "uint64"},
+	"uint8":               {"msgpackAppendUint", "msgpackReadUint", "uint64"},
+	"uint16":              {"msgpackAppendUint", "msgpackReadUint", "uint64"},
+	"uint32":              {"msgpackAppendUint", "msgpackReadUint", "uint64"},
+	"uint64":              {"msgpackAppendUint", "msgpackReadUint", "uint64"},
+}
+
+type field struct {
+	Name string
+	Path string // Selector of the field, through any embedded structs
+	Type string
+	Kind fieldKind
+
+	// A field of one of the generated types, by value, by pointer or in
+	// a slice, is encoded by the generated code of the type rather than
+	// a helper
+	Nested  bool
+	Ptr     bool
+	Slice   bool
+	ElemPtr bool
+	Element string
+}
+
+func main() {
+	output := flag.String("output", "", "file to write the generated code to")
+	typeList := flag.String("types", "", "comma separated list of types to generate")
+	flag.Parse()
+	if *output == "" || *typeList == "" || flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: msgpackgen -output file -types T1,T2 files...\n")
+		os.Exit(1)
+	}
+
+	// Collect the struct and named basic types from the inputs
+	fset := token.NewFileSet()
+	structTypes := make(map[string]*ast.StructType)
+	namedTypes := make(map[string]string)
+	for _, path := range flag.Args() {
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			fatalf("failed to parse %s: %v", path, err)
+		}
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				switch t := ts.Type.(type) {
+				case *ast.StructType:
+					structTypes[ts.Name.Name] = t
+				default:
+					namedTypes[ts.Name.Name] = exprString(t)
+				}
+			}
+		}
+	}
+
+	var body bytes.Buffer
+	usesTime := false
+	names := strings.Split(*typeList, ",")
+	generated := make(map[string]bool, len(names))
+	for _, name := range names {
+		generated[name] = true
+	}
+	for _, name := range names {
+		st, ok := structTypes[name]
+		if !ok {
+			fatalf("struct type %s not found", name)
+		}
+		fields, err := structFields(name, "", st, structTypes, namedTypes, generated)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		for _, f := range fields {
+			if strings.HasPrefix(f.Type, "time.") {
+				usesTime = true
+			}
+		}
+		writeEncoder(&body, name, fields)
+		writeDecoder(&body, name, fields)
+	}
+
+	// The decoders convert to the time types, which needs the import
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// generated by msgpackgen; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package structs\n\n")
+	if usesTime {
+		fmt.Fprintf(&buf, "import \"time\"\n\n")
+	}
+	buf.Write(body.Bytes())
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		fatalf("failed to format output: %v", err)
+	}
+	if err := ioutil.WriteFile(*output, src, 0644); err != nil {
+		fatalf("failed to write output: %v", err)
+	}
+}
+
+// structFields resolves the encoding of each field of a struct. The
+// fields of an embedded struct are inlined, as the generic codec does.
+func structFields(name, prefix string, st *ast.StructType, structs map[string]*ast.StructType,
+	named map[string]string, generated map[string]bool) ([]field, error) {
+	var fields []field
+	for _, f := range st.Fields.List {
+		typ := exprString(f.Type)
+		if len(f.Names) == 0 {
+			embedded, ok := structs[typ]
+			if !ok {
+				return nil, fmt.Errorf("%s: unsupported embedded field %s", name, typ)
+			}
+			inlined, err := structFields(name, prefix+typ+".", embedded, structs, named, generated)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, inlined...)
+			continue
+		}
+
+		// Allow the generated types, by value, by pointer or in a
+		// slice, including through a named slice type
+		under := typ
+		if u, isNamed := named[typ]; isNamed {
+			under = u
+		}
+		slice := strings.HasPrefix(under, "[]")
+		elem := strings.TrimPrefix(under, "[]")
+		ptr := strings.HasPrefix(elem, "*")
+		elem = strings.TrimPrefix(elem, "*")
+		if generated[elem] {
+			for _, n := range f.Names {
+				if !n.IsExported() {
+					continue
+				}
+				fields = append(fields, field{Name: n.Name, Path: prefix + n.Name, Type: typ,
+					Nested: true, Ptr: ptr && !slice, Slice: slice, ElemPtr: ptr && slice,
+					Element: elem})
+			}
+			continue
+		}
+
+		kind, ok := builtinKinds[typ]
+		if !ok {
+			// Allow named types with a supported underlying type
+			if under, isNamed := named[typ]; isNamed {
+				kind, ok = builtinKinds[under]
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported field type %s", name, typ)
+		}
+		for _, n := range f.Names {
+			if !n.IsExported() {
+				continue
+			}
+			fields = append(fields, field{Name: n.Name, Path: prefix + n.Name, Type: typ, Kind: kind})
+		}
+	}
+	return fields, nil
+}
+
+func writeEncoder(buf *bytes.Buffer, name string, fields []field) {
+	fmt.Fprintf(buf, "// MarshalMsgpack appends the msgpack encoding of the %s to b\n", name)
+	fmt.Fprintf(buf, "func (x *%s) MarshalMsgpack(b []byte) []byte {\n", name)
+	fmt.Fprintf(buf, "b = msgpackAppendMapHeader(b, %d)\n", len(fields))
+	for _, f := range fields {
+		fmt.Fprintf(buf, "b = msgpackAppendString(b, %q)\n", f.Name)
+		if f.Slice {
+			fmt.Fprintf(buf, "if x.%s == nil {\nb = msgpackAppendNil(b)\n} else {\n", f.Path)
+			fmt.Fprintf(buf, "b = msgpackAppendArrayHeader(b, len(x.%s))\n", f.Path)
+			if f.ElemPtr {
+				fmt.Fprintf(buf, "for j := range x.%s {\nif x.%s[j] == nil {\nb = msgpackAppendNil(b)\n} else {\nb = x.%s[j].MarshalMsgpack(b)\n}\n}\n}\n", f.Path, f.Path, f.Path)
+			} else {
+				fmt.Fprintf(buf, "for j := range x.%s {\nb = x.%s[j].MarshalMsgpack(b)\n}\n}\n", f.Path, f.Path)
+			}
+		} else if f.Ptr {
+			fmt.Fprintf(buf, "if x.%s == nil {\nb = msgpackAppendNil(b)\n} else {\nb = x.%s.MarshalMsgpack(b)\n}\n", f.Path, f.Path)
+		} else if f.Nested {
+			fmt.Fprintf(buf, "b = x.%s.MarshalMsgpack(b)\n", f.Path)
+		} else if f.Type == f.Kind.wireType {
+			fmt.Fprintf(buf, "b = %s(b, x.%s)\n", f.Kind.appendFn, f.Path)
+		} else {
+			fmt.Fprintf(buf, "b = %s(b, %s(x.%s))\n", f.Kind.appendFn, f.Kind.wireType, f.Path)
+		}
+	}
+	fmt.Fprintf(buf, "return b\n}\n\n")
+}
+
+func writeDecoder(buf *bytes.Buffer, name string, fields []field) {
+	fmt.Fprintf(buf, "// UnmarshalMsgpack decodes a %s from the front of b\n", name)
+	fmt.Fprintf(buf, "func (x *%s) UnmarshalMsgpack(b []byte) ([]byte, error) {\n", name)
+	fmt.Fprintf(buf, "n, b, err := msgpackReadMapHeader(b)\n")
+	fmt.Fprintf(buf, "if err != nil {\nreturn b, err\n}\n")
+	fmt.Fprintf(buf, "for i := 0; i < n; i++ {\n")
+	fmt.Fprintf(buf, "var key []byte\n")
+	fmt.Fprintf(buf, "if key, b, err = msgpackReadRaw(b); err != nil {\nreturn b, err\n}\n")
+	fmt.Fprintf(buf, "switch string(key) {\n")
+	for _, f := range fields {
+		fmt.Fprintf(buf, "case %q:\n", f.Name)
+		if f.Slice {
+			fmt.Fprintf(buf, "if isNil, rest := msgpackIsNil(b); isNil {\nx.%s, b = nil, rest\nbreak\n}\n", f.Path)
+			fmt.Fprintf(buf, "var count int\n")
+			fmt.Fprintf(buf, "if count, b, err = msgpackReadArrayHeader(b); err != nil {\nbreak\n}\n")
+			fmt.Fprintf(buf, "x.%s = make(%s, count)\n", f.Path, f.Type)
+			fmt.Fprintf(buf, "for j := range x.%s {\n", f.Path)
+			if f.ElemPtr {
+				fmt.Fprintf(buf, "if isNil, rest := msgpackIsNil(b); isNil {\nb = rest\ncontinue\n}\n")
+				fmt.Fprintf(buf, "x.%s[j] = new(%s)\n", f.Path, f.Element)
+			}
+			fmt.Fprintf(buf, "if b, err = x.%s[j].UnmarshalMsgpack(b); err != nil {\nbreak\n}\n}\n", f.Path)
+		} else if f.Ptr {
+			fmt.Fprintf(buf, "if isNil, rest := msgpackIsNil(b); isNil {\nx.%s, b = nil, rest\nbreak\n}\n", f.Path)
+			fmt.Fprintf(buf, "x.%s = new(%s)\n", f.Path, f.Element)
+			fmt.Fprintf(buf, "b, err = x.%s.UnmarshalMsgpack(b)\n", f.Path)
+		} else if f.Nested {
+			fmt.Fprintf(buf, "b, err = x.%s.UnmarshalMsgpack(b)\n", f.Path)
+		} else if f.Type == f.Kind.wireType {
+			fmt.Fprintf(buf, "x.%s, b, err = %s(b)\n", f.Path, f.Kind.readFn)
+		} else {
+			fmt.Fprintf(buf, "var v %s\n", f.Kind.wireType)
+			fmt.Fprintf(buf, "v, b, err = %s(b)\n", f.Kind.readFn)
+			fmt.Fprintf(buf, "x.%s = %s(v)\n", f.Path, f.Type)
+		}
+	}
+	fmt.Fprintf(buf, "default:\nb, err = msgpackSkip(b)\n}\n")
+	fmt.Fprintf(buf, "if err != nil {\nreturn b, err\n}\n}\n")
+	fmt.Fprintf(buf, "return b, nil\n}\n\n")
+}
+
+// exprString renders a type expression
+func exprString(e ast.Expr) string {
+	switch t := e.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.SelectorExpr:
+		return exprString(t.X) + "." + t.Sel.Name
+	case *ast.StarExpr:
+		return "*" + exprString(t.X)
+	case *ast.ArrayType:
+		return "[]" + exprString(t.Elt)
+	case *ast.MapType:
+		return "map[" + exprString(t.Key) + "]" + exprString(t.Value)
+	default:
+		return fmt.Sprintf("%T", e)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "msgpackgen: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -3,6 +3,8 @@ package structs
 import (
 	"bytes"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/consul/acl"
@@ -13,6 +15,15 @@ var (
 	ErrNoLeader  = fmt.Errorf("No cluster leader")
 	ErrNoDCPath  = fmt.Errorf("No path to datacenter")
 	ErrNoServers = fmt.Errorf("No known Consul servers")
+	ErrStaleRead = fmt.Errorf("Stale read exceeds the staleness bounds")
+
+	// ErrServerLeaving rejects the blocking queries made to a server that
+	// is leaving, clients retry them on another server
+	ErrServerLeaving = fmt.Errorf("Server is leaving")
+
+	// ErrRPCRateLimited rejects the requests over the RPC rate limits of
+	// a server
+	ErrRPCRateLimited = fmt.Errorf("RPC rate limit exceeded")
 )
 
 type MessageType uint8
@@ -24,6 +35,26 @@ const (
 	SessionRequestType
 	ACLRequestType
 	TombstoneRequestType
+	CatalogPatchRequestType
+	LockDelayRequestType
+	OutboxRequestType
+	OutboxEntryType      // Only used in snapshots
+	SnapshotChecksumType // Only used in snapshots
+	ServerHealthRequestType
+	CatalogAuditType // Only used in snapshots
+	ExternalClaimRequestType
+	MaintenanceRequestType
+	SnapshotRestoreRequestType
+	AutopilotRequestType
+	TxnRequestType
+	AutoEncryptRequestType
+	AreaRequestType
+	PeeringRequestType
+	ExportedServicesRequestType
+	ImportedServicesRequestType
+	KVSHistoryRequestType
+	RetentionRequestType
+	CatalogAuditTrimRequestType
 )
 
 const (
@@ -45,6 +76,16 @@ const (
 	HealthCritical = "critical"
 )
 
+const (
+	// The types of the check definitions recorded in the catalog
+	CheckTypeScript = "script"
+	CheckTypeDocker = "docker"
+	CheckTypeHTTP   = "http"
+	CheckTypeTCP    = "tcp"
+	CheckTypeUDP    = "udp"
+	CheckTypeTTL    = "ttl"
+)
+
 func ValidStatus(s string) bool {
 	return s == HealthPassing ||
 		s == HealthWarning ||
@@ -74,6 +115,29 @@ type RPCInfo interface {
 	ACLToken() string
 }
 
+const (
+	// SortByDefault keeps the default order of a list query, which is
+	// documented by each query of the state store
+	SortByDefault = ""
+
+	// SortByName orders the results by name, then by ID
+	SortByName = "name"
+
+	// SortByCreateIndex orders the results by the index they were
+	// created at, oldest first
+	SortByCreateIndex = "create_index"
+)
+
+// ValidSortBy checks if a sort key is known
+func ValidSortBy(by string) bool {
+	switch by {
+	case SortByDefault, SortByName, SortByCreateIndex:
+		return true
+	default:
+		return false
+	}
+}
+
 // QueryOptions is used to specify various flags for read queries
 type QueryOptions struct {
 	// Token is the ACL token ID. If not provided, the 'anonymous'
@@ -94,6 +158,30 @@ type QueryOptions struct {
 	// If set, the leader must verify leadership prior to
 	// servicing the request. Prevents a stale read.
 	RequireConsistent bool
+
+	// If set, the query is not serviced until the server has applied
+	// at least this index. Passing the index of a write allows a stale
+	// read to observe the write, without requiring a leader read.
+	MinAppliedIndex uint64
+
+	// MaxStaleDuration and MaxStaleIndex bound the staleness of an
+	// AllowStale read. A follower rejects the read with ErrStaleRead if
+	// it last heard from the leader longer than MaxStaleDuration ago, or
+	// if it has applied more than MaxStaleIndex fewer entries than the
+	// leader has committed. Zero means unbounded.
+	MaxStaleDuration time.Duration
+	MaxStaleIndex    uint64
+
+	// SortBy orders the results of the session, ACL and KV list queries
+	// by another key than their default one. See the SortBy constants.
+	SortBy string
+
+	// Limit, if set, paginates the results of the catalog node and
+	// service queries and of the health service query, returning at most
+	// Limit entries. The server may cap it. NextToken is the NextToken of
+	// the previous page, to get the following one.
+	Limit     int
+	NextToken string
 }
 
 // QueryOption only applies to reads, so always true
@@ -141,18 +229,36 @@ type QueryMeta struct {
 
 	// Used to indicate if there is a known leader node
 	KnownLeader bool
+
+	// IndexLag is the number of entries committed by the leader that
+	// the follower had not applied yet, for the AllowStale reads that
+	// set MaxStaleIndex
+	IndexLag uint64
+
+	// NextToken is set when a paginated query has more results, and is
+	// passed back with the query to get the next page
+	NextToken string
 }
 
 // RegisterRequest is used for the Catalog.Register endpoint
 // to register a node as providing a service. If no service
 // is provided, the node is registered.
+//
+// If CAS is set, the registration is only applied if the ModifyIndex
+// of the registered entry matches: the service if one is provided,
+// otherwise the check if a single one is provided, otherwise the node.
+// A zero ModifyIndex requires that the entry does not exist yet.
 type RegisterRequest struct {
-	Datacenter string
-	Node       string
-	Address    string
-	Service    *NodeService
-	Check      *HealthCheck
-	Checks     HealthChecks
+	Datacenter  string
+	Node        string
+	Address     string
+	NodeMeta    map[string]string // Replaces the node metadata if provided
+	Service     *NodeService
+	Check       *HealthCheck
+	Checks      HealthChecks
+	CAS         bool
+	ModifyIndex uint64
+	Audit       AuditSource
 	WriteRequest
 }
 
@@ -160,18 +266,175 @@ func (r *RegisterRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// NormalizeAddress returns a node or service address without the
+// brackets of an IPv6 address written as in a host:port pair, so it is
+// served in AAAA records rather than as a host name. Other addresses are
+// returned as is.
+func NormalizeAddress(addr string) (string, error) {
+	if !strings.HasPrefix(addr, "[") && !strings.HasSuffix(addr, "]") {
+		return addr, nil
+	}
+	inner := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if ip := net.ParseIP(inner); ip == nil || ip.To4() != nil || len(inner)+2 != len(addr) {
+		return "", fmt.Errorf("Invalid address %q: only IPv6 addresses can be bracketed", addr)
+	}
+	return inner, nil
+}
+
 // DeregisterRequest is used for the Catalog.Deregister endpoint
 // to deregister a node as providing a service. If no service is
 // provided the entire node is deregistered.
+//
+// If CAS is set, the deregistration is only applied if the ModifyIndex
+// of the deregistered service, check or node matches.
 type DeregisterRequest struct {
+	Datacenter  string
+	Node        string
+	ServiceID   string
+	CheckID     string
+	CAS         bool
+	ModifyIndex uint64
+	Audit       AuditSource
+	WriteRequest
+}
+
+func (r *DeregisterRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// RegistrationConflict is the prefix of the error returned when the
+// ModifyIndex precondition of a registration or deregistration fails
+const RegistrationConflict = "Registration conflict"
+
+// IsRegistrationConflict returns if an error, which may have been
+// returned over RPC, is a failed ModifyIndex precondition
+func IsRegistrationConflict(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), RegistrationConflict)
+}
+
+// CatalogDiffRequest is used to request the changes to the services
+// and checks of a node since an index
+type CatalogDiffRequest struct {
+	Datacenter string
+	Node       string
+	SinceIndex uint64
+	QueryOptions
+}
+
+func (r *CatalogDiffRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// CatalogRemoval is a service or check removed from a node. The name of
+// the service is used to filter the removals by ACLs.
+type CatalogRemoval struct {
+	ID          string
+	ServiceName string
+}
+
+// CatalogDiff holds the services and checks of a node added or changed
+// since an index, and the ones removed. If Full is set, the changes
+// could not be tracked back to the index, and the diff holds every
+// service and check of the node instead: any other one was removed.
+type CatalogDiff struct {
+	Full            bool
+	Services        []*NodeService
+	Checks          HealthChecks
+	RemovedServices []*CatalogRemoval
+	RemovedChecks   []*CatalogRemoval
+}
+
+type IndexedCatalogDiff struct {
+	Diff *CatalogDiff
+	QueryMeta
+}
+
+type PatchOpType string
+
+const (
+	PatchAddTag     PatchOpType = "add-tag"
+	PatchRemoveTag              = "remove-tag"
+	PatchSetMeta                = "set-meta"
+	PatchDeleteMeta             = "delete-meta"
+)
+
+// PatchOp is a single change to the tags or metadata of a
+// node or service. Key is the tag or meta key, and Value is
+// only used when setting a meta key.
+type PatchOp struct {
+	Op    PatchOpType
+	Key   string
+	Value string
+}
+
+// CatalogPatchRequest is used for the Catalog.Patch endpoint to
+// update the tags or metadata of a node, or of one of its services,
+// without a full re-registration. If no service is provided the
+// node itself is patched. The operations are applied atomically.
+type CatalogPatchRequest struct {
 	Datacenter string
 	Node       string
 	ServiceID  string
-	CheckID    string
+	Ops        []PatchOp
 	WriteRequest
 }
 
-func (r *DeregisterRequest) RequestDatacenter() string {
+func (r *CatalogPatchRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// AuditSource describes the origin of a catalog change for the audit
+// table. The time is set by the leader, keeping the FSM deterministic.
+type AuditSource struct {
+	Time       int64  // Unix nanoseconds
+	SourceAddr string // Address of the HTTP client, if known
+}
+
+// CatalogAudit is a record of a catalog change. Before and After are
+// summaries of the affected node, services and checks.
+type CatalogAudit struct {
+	ID          string
+	Time        int64 // Unix nanoseconds
+	Op          string
+	Node        string
+	Accessor    string // Identifies the token, without revealing it
+	SourceAddr  string
+	Before      string
+	After       string
+	CreateIndex uint64
+}
+type CatalogAudits []*CatalogAudit
+
+// CatalogAuditRequest is used to query the audit records of a time
+// range, optionally limited to a node. Times are Unix nanoseconds,
+// and a zero time leaves that end of the range open.
+type CatalogAuditRequest struct {
+	Datacenter string
+	Node       string
+	Start      int64
+	End        int64
+	QueryOptions
+}
+
+func (r *CatalogAuditRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedCatalogAudits struct {
+	Audits CatalogAudits
+	QueryMeta
+}
+
+// CatalogAuditTrimRequest is used by the leader to delete the audit
+// records created at or before TrimIndex, once the table exceeds its
+// limit
+type CatalogAuditTrimRequest struct {
+	Datacenter string
+	TrimIndex  uint64
+	WriteRequest
+}
+
+func (r *CatalogAuditTrimRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
@@ -187,10 +450,13 @@ func (r *DCSpecificRequest) RequestDatacenter() string {
 
 // ServiceSpecificRequest is used to query about a specific node
 type ServiceSpecificRequest struct {
-	Datacenter  string
-	ServiceName string
-	ServiceTag  string
-	TagFilter   bool // Controls tag filtering
+	Datacenter      string
+	ServiceName     string
+	ServiceTag      string
+	TagFilter       bool              // Controls tag filtering
+	NodeMetaFilters map[string]string // Only the nodes with all these metadata
+	Connect         bool              // Return the connect-proxies of the service
+	PeerName        string            // Return the service imported from this peer
 	QueryOptions
 }
 
@@ -198,6 +464,19 @@ func (r *ServiceSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// ServiceResolveRequest is used to resolve a service of a target
+// datacenter to the endpoints the proxies of Datacenter dial to reach it
+type ServiceResolveRequest struct {
+	Datacenter       string
+	TargetDatacenter string // Defaults to Datacenter
+	ServiceName      string
+	QueryOptions
+}
+
+func (r *ServiceResolveRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // NodeSpecificRequest is used to request the information about a single node
 type NodeSpecificRequest struct {
 	Datacenter string
@@ -209,6 +488,18 @@ func (r *NodeSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// AddressSpecificRequest is used to request the nodes registered with
+// an address
+type AddressSpecificRequest struct {
+	Datacenter string
+	Address    string
+	QueryOptions
+}
+
+func (r *AddressSpecificRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // ChecksInStateRequest is used to query for nodes in a state
 type ChecksInStateRequest struct {
 	Datacenter string
@@ -220,10 +511,14 @@ func (r *ChecksInStateRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
-// Used to return information about a node
+// Used to return information about a node. The indexes are maintained
+// by the state store.
 type Node struct {
-	Node    string
-	Address string
+	Node        string
+	Address     string
+	Meta        map[string]string
+	CreateIndex uint64
+	ModifyIndex uint64
 }
 type Nodes []Node
 
@@ -240,6 +535,25 @@ type ServiceNode struct {
 	ServiceTags    []string
 	ServiceAddress string
 	ServicePort    int
+	ServiceMeta    map[string]string
+
+	// ServiceWeightPassing and ServiceWeightWarning are the weights of
+	// the service, see NodeService
+	ServiceWeightPassing int
+	ServiceWeightWarning int
+
+	// ServiceKind and ServiceProxy are the kind of the service and the
+	// configuration of a proxy, see NodeService
+	ServiceKind  ServiceKind
+	ServiceProxy ConnectProxyConfig
+
+	// ServiceWANAddress and ServiceWANPort are where a mesh-gateway is
+	// reached from the other datacenters, see NodeService
+	ServiceWANAddress string
+	ServiceWANPort    int
+
+	CreateIndex uint64
+	ModifyIndex uint64
 }
 type ServiceNodes []ServiceNode
 
@@ -251,7 +565,109 @@ type NodeService struct {
 	Address           string
 	Port              int
 	EnableTagOverride bool
+	Meta              map[string]string
+
+	// WeightPassing and WeightWarning are the weights of the service in
+	// the SRV records of DNS while its checks are passing, and while one
+	// is warning, so degraded instances receive less traffic. Zero is the
+	// DefaultServiceWeight.
+	WeightPassing int
+	WeightWarning int
+
+	// Kind is the kind of the service, and Proxy the configuration of a
+	// connect-proxy, naming the service it fronts
+	Kind  ServiceKind
+	Proxy ConnectProxyConfig
+
+	// WANAddress and WANPort are where a mesh-gateway is reached from the
+	// other datacenters, defaulting to its address and port
+	WANAddress string
+	WANPort    int
+}
+
+// ServiceKind is the kind of a service. A typical service is an
+// application, while the other kinds are proxies of the service mesh.
+type ServiceKind string
+
+const (
+	ServiceKindTypical      ServiceKind = ""
+	ServiceKindConnectProxy ServiceKind = "connect-proxy"
+	ServiceKindMeshGateway  ServiceKind = "mesh-gateway"
+)
+
+// ConnectProxyConfig is the configuration of a connect-proxy. It fronts
+// the instance of its destination service, and exposes its upstreams on
+// local ports.
+type ConnectProxyConfig struct {
+	DestinationServiceName string
+	DestinationServiceID   string
+	LocalServiceAddress    string
+	LocalServicePort       int
+	Upstreams              []Upstream
+}
+
+// Upstream is a service a proxy exposes to the instance it fronts on a
+// local port
+type Upstream struct {
+	DestinationName  string
+	Datacenter       string
+	LocalBindAddress string
+	LocalBindPort    int
+}
+
+// Validate checks the kind of the service and its proxy configuration
+func (s *NodeService) Validate() error {
+	if s.Kind != ServiceKindMeshGateway && (s.WANAddress != "" || s.WANPort != 0) {
+		return fmt.Errorf("WAN address is only valid for a %s service", ServiceKindMeshGateway)
+	}
+	switch s.Kind {
+	case ServiceKindTypical, ServiceKindMeshGateway:
+		if s.Proxy.DestinationServiceName != "" || len(s.Proxy.Upstreams) > 0 {
+			return fmt.Errorf("Proxy configuration is only valid for a %s service", ServiceKindConnectProxy)
+		}
+		if s.Kind == ServiceKindMeshGateway && s.Port == 0 {
+			return fmt.Errorf("Port must be set for a %s service", ServiceKindMeshGateway)
+		}
+		if s.WANPort < 0 {
+			return fmt.Errorf("WAN port can't be negative")
+		}
+	case ServiceKindConnectProxy:
+		if s.Proxy.DestinationServiceName == "" {
+			return fmt.Errorf("Proxy.DestinationServiceName must be set for a %s service", ServiceKindConnectProxy)
+		}
+		if s.Port == 0 {
+			return fmt.Errorf("Port must be set for a %s service", ServiceKindConnectProxy)
+		}
+		for _, upstream := range s.Proxy.Upstreams {
+			if upstream.DestinationName == "" {
+				return fmt.Errorf("Upstream DestinationName must be set")
+			}
+			if upstream.LocalBindPort <= 0 {
+				return fmt.Errorf("Upstream %q must have a LocalBindPort", upstream.DestinationName)
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid service kind %q", s.Kind)
+	}
+	return nil
+}
+
+// DefaultServiceWeight is the weight of a service that doesn't set one
+const DefaultServiceWeight = 1
+
+// Weight returns the weight of the service given the aggregated status
+// of its checks
+func (s *NodeService) Weight(status string) int {
+	weight := s.WeightPassing
+	if status == HealthWarning {
+		weight = s.WeightWarning
+	}
+	if weight == 0 {
+		weight = DefaultServiceWeight
+	}
+	return weight
 }
+
 type NodeServices struct {
 	Node     Node
 	Services map[string]*NodeService
@@ -267,6 +683,45 @@ type HealthCheck struct {
 	Output      string // Holds output of script runs
 	ServiceID   string // optional associated service
 	ServiceName string // optional service name
+	CreateIndex uint64 // Maintained by the state store
+	ModifyIndex uint64 // Maintained by the state store
+
+	// DeregisterCriticalServiceAfter is how long the check of a service
+	// can be critical before the leader deregisters the service. Zero
+	// disables the deregistration.
+	DeregisterCriticalServiceAfter time.Duration
+
+	// SuccessBeforePassing and FailuresBeforeCritical are how many
+	// consecutive passing or critical outcomes the agent waits for before
+	// changing the status of the check, to dampen flapping. Zero applies
+	// every outcome.
+	SuccessBeforePassing   int
+	FailuresBeforeCritical int
+
+	// Type, Target, Interval, Timeout, TTL, TLS and TLSSkipVerify record
+	// how the agent runs the check, so other tools can see how a service
+	// is monitored. Type is one of the CheckType constants, and is empty
+	// for checks registered without a definition. Target is the script,
+	// URL or address probed.
+	Type          string
+	Target        string
+	Interval      time.Duration
+	Timeout       time.Duration
+	TTL           time.Duration
+	TLS           bool
+	TLSSkipVerify bool
+
+	// Method, Header, Body and ExpectedStatus record the request of an
+	// HTTP check, and the status code ranges it considers passing
+	Method         string
+	Header         map[string][]string
+	Body           string
+	ExpectedStatus []string
+
+	// DockerContainerID and Shell record the container a Docker check
+	// runs its script in, and the shell running it
+	DockerContainerID string
+	Shell             string
 }
 type HealthChecks []*HealthCheck
 
@@ -319,6 +774,22 @@ type IndexedHealthChecks struct {
 	QueryMeta
 }
 
+// ServiceHealthSummary is the number of instances of a service in each
+// health state. An instance is as healthy as the worst of its checks and
+// of the checks of its node.
+type ServiceHealthSummary struct {
+	Service  string
+	Passing  int
+	Warning  int
+	Critical int
+}
+type ServiceHealthSummaries []*ServiceHealthSummary
+
+type IndexedServiceHealthSummaries struct {
+	Summaries ServiceHealthSummaries
+	QueryMeta
+}
+
 type IndexedCheckServiceNodes struct {
 	Nodes CheckServiceNodes
 	QueryMeta
@@ -366,10 +837,108 @@ func (r *KVSRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// The verbs of the transaction operations besides the KVSOps. The KV
+// verbs get, check-index and check-session only read, and the catalog
+// operations use set and delete.
+const (
+	TxnGet          = "get"
+	TxnCheckIndex   = "check-index"   // Fails unless the ModifyIndex matches
+	TxnCheckSession = "check-session" // Fails unless the session holds the key
+	TxnSet          = "set"
+	TxnDelete       = "delete"
+)
+
+// TxnKVOp is a Key-Value operation of a transaction
+type TxnKVOp struct {
+	Verb   KVSOp
+	DirEnt DirEntry
+}
+
+// TxnNodeOp is a node operation of a transaction. Deleting a node deletes
+// its services and checks.
+type TxnNodeOp struct {
+	Verb string
+	Node Node
+}
+
+// TxnServiceOp is a service operation of a transaction
+type TxnServiceOp struct {
+	Verb    string
+	Node    string
+	Service NodeService
+}
+
+// TxnCheckOp is a health check operation of a transaction
+type TxnCheckOp struct {
+	Verb  string
+	Check HealthCheck
+}
+
+// TxnOp is a single operation of a transaction, with exactly one of its
+// fields set
+type TxnOp struct {
+	KV      *TxnKVOp
+	Node    *TxnNodeOp
+	Service *TxnServiceOp
+	Check   *TxnCheckOp
+}
+
+// TxnOps is a list of transaction operations
+type TxnOps []*TxnOp
+
+// TxnRequest is used to apply operations atomically. Either all of them
+// are applied, or none if any fails.
+type TxnRequest struct {
+	Datacenter string
+	Ops        TxnOps
+	WriteRequest
+}
+
+func (r *TxnRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// TxnResult is the result of an operation, with the field of its kind
+// set. The KV writes return the entry without its value.
+type TxnResult struct {
+	KV      *DirEntry    `json:",omitempty"`
+	Node    *Node        `json:",omitempty"`
+	Service *NodeService `json:",omitempty"`
+	Check   *HealthCheck `json:",omitempty"`
+}
+
+// TxnResults is the results of the operations of a transaction
+type TxnResults []*TxnResult
+
+// TxnError is the error of an operation, which rolled back the
+// transaction
+type TxnError struct {
+	OpIndex int
+	What    string
+}
+
+func (e TxnError) Error() string {
+	return fmt.Sprintf("op %d: %s", e.OpIndex, e.What)
+}
+
+// TxnErrors is the errors of a transaction
+type TxnErrors []*TxnError
+
+// TxnResponse is the outcome of a transaction, with either the results
+// of every operation, or the errors that rolled it back
+type TxnResponse struct {
+	Results TxnResults
+	Errors  TxnErrors
+}
+
 // KeyRequest is used to request a key, or key prefix
 type KeyRequest struct {
 	Datacenter string
 	Key        string
+
+	// Glob makes a list match the keys against Key as a glob pattern,
+	// such as "config/*/database", instead of using it as a prefix
+	Glob bool
 	QueryOptions
 }
 
@@ -377,6 +946,19 @@ func (r *KeyRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// KeyAtIndexRequest is used to request a key as it existed at a Raft
+// index, from the KV history
+type KeyAtIndexRequest struct {
+	Datacenter string
+	Key        string
+	AtIndex    uint64
+	QueryOptions
+}
+
+func (r *KeyAtIndexRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // KeyListRequest is used to list keys
 type KeyListRequest struct {
 	Datacenter string
@@ -415,6 +997,7 @@ const (
 // This issued to associate node checks with acquired locks.
 type Session struct {
 	CreateIndex uint64
+	ModifyIndex uint64
 	ID          string
 	Name        string
 	Node        string
@@ -425,102 +1008,328 @@ type Session struct {
 }
 type Sessions []*Session
 
-type SessionOp string
+// LockDelay is a window during which a key cannot be locked, after the
+// lock held by Session was forcefully released. The window is created in
+// the FSM and is only removed once the leader commits its expiration, so
+// every server agrees on whether a lock attempt is rejected.
+type LockDelay struct {
+	Key         string
+	Session     string
+	Delay       time.Duration
+	CreateIndex uint64
+}
+
+type LockDelayOp string
 
 const (
-	SessionCreate  SessionOp = "create"
-	SessionDestroy           = "destroy"
+	LockDelayExpire LockDelayOp = "expire"
 )
 
-// SessionRequest is used to operate on sessions
-type SessionRequest struct {
+// LockDelayRequest is used by the leader to manage lock delays
+type LockDelayRequest struct {
 	Datacenter string
-	Op         SessionOp // Which operation are we performing
-	Session    Session   // Which session
+	Op         LockDelayOp
+	Key        string
+	Session    string
 	WriteRequest
 }
 
-func (r *SessionRequest) RequestDatacenter() string {
+func (r *LockDelayRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
-// SessionSpecificRequest is used to request a session by ID
-type SessionSpecificRequest struct {
-	Datacenter string
-	Session    string
-	QueryOptions
+// OutboxSubscription routes the committed changes of the KV entries
+// under a prefix to an external system. Matching changes are recorded
+// in the outbox within the same transaction as the change, and are
+// delivered by the leader until they are acknowledged.
+type OutboxSubscription struct {
+	Name   string
+	Prefix string
+	URL    string // Webhook the entries are delivered to
+
+	// MaxPending caps the undelivered entries. Once it is reached, the
+	// oldest entry is dropped for each new one, and counted in Dropped,
+	// so a subscription whose sink is down can't grow without bound.
+	// Zero, the default, disables the cap.
+	MaxPending int
+
+	// Pending is the number of undelivered entries, and Dropped the
+	// number of entries dropped since the subscription was created. A
+	// subscription that dropped entries is lagging, and its consumer
+	// has missed changes. Both are maintained by the state store.
+	Pending int
+	Dropped uint64
+
+	CreateIndex uint64
+	ModifyIndex uint64
 }
 
-func (r *SessionSpecificRequest) RequestDatacenter() string {
-	return r.Datacenter
+// OutboxEntry is a committed change awaiting delivery. The ID orders
+// the entries of a subscription by the index of the change.
+type OutboxEntry struct {
+	Subscription string
+	ID           string
+	Op           KVSOp // KVSSet or KVSDelete
+	Entry        DirEntry
+	CreateIndex  uint64
 }
 
-type IndexedSessions struct {
-	Sessions Sessions
-	QueryMeta
+type OutboxOp string
+
+const (
+	OutboxSubscribe   OutboxOp = "subscribe"
+	OutboxUnsubscribe          = "unsubscribe"
+	OutboxAck                  = "ack"
+)
+
+// OutboxRequest is used to manage outbox subscriptions, and by the
+// leader to acknowledge delivered entries
+type OutboxRequest struct {
+	Datacenter   string
+	Op           OutboxOp
+	Subscription OutboxSubscription
+	Acks         []string // IDs of the delivered entries
+	WriteRequest
 }
 
-// ACL is used to represent a token and it's rules
-type ACL struct {
+func (r *OutboxRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ServerHealth is the health of a server as observed by the leader.
+// It is committed so that a new leader can continue dead server cleanup
+// and promotions without waiting to observe the servers again. Times are
+// provided by the leader, keeping the FSM deterministic.
+type ServerHealth struct {
+	Name        string
+	Address     string
+	Healthy     bool
+	StableSince int64 // Unix nanoseconds since Healthy last changed
+	LastContact time.Duration
+	LastTerm    uint64
+	LastIndex   uint64
+
+	// Voter is the intended suffrage of the server. New servers are
+	// added as non-voters, and promoted once they have been stable.
+	Voter bool
+
 	CreateIndex uint64
 	ModifyIndex uint64
-	ID          string
-	Name        string
-	Type        string
-	Rules       string
 }
-type ACLs []*ACL
 
-type ACLOp string
+// StableFor returns how long the server has been in its current state
+func (h *ServerHealth) StableFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, h.StableSince))
+}
+
+type ServerHealthOp string
 
 const (
-	ACLSet      ACLOp = "set"
-	ACLForceSet       = "force-set" // Deprecated, left to backwards compatibility
-	ACLDelete         = "delete"
+	ServerHealthSet    ServerHealthOp = "set"
+	ServerHealthDelete                = "delete"
 )
 
-// ACLRequest is used to create, update or delete an ACL
-type ACLRequest struct {
+// ServerHealthRequest is used by the leader to record the health of
+// a server, or to remove a server that has left
+type ServerHealthRequest struct {
 	Datacenter string
-	Op         ACLOp
-	ACL        ACL
+	Op         ServerHealthOp
+	Health     ServerHealth
 	WriteRequest
 }
 
-func (r *ACLRequest) RequestDatacenter() string {
+func (r *ServerHealthRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
-// ACLSpecificRequest is used to request an ACL by ID
-type ACLSpecificRequest struct {
-	Datacenter string
-	ACL        string
-	QueryOptions
-}
+// ExternalClaim marks a node, or one of its services, as monitored by an
+// external health checking process instead of a Consul agent, for nodes
+// that can't run one. A claim is held by a session, so the process keeps
+// its claims alive by renewing the session, and they are released when
+// the session is invalidated, or expires.
+type ExternalClaim struct {
+	Node      string
+	ServiceID string // Empty to claim the node and all its services
+	Owner     string // Name of the claiming process, informational
+	Session   string
 
-func (r *ACLSpecificRequest) RequestDatacenter() string {
-	return r.Datacenter
+	CreateIndex uint64
+	ModifyIndex uint64
 }
 
-// ACLPolicyRequest is used to request an ACL by ID, conditionally
-// filtering on an ID
-type ACLPolicyRequest struct {
+type ExternalClaims []*ExternalClaim
+
+type ExternalClaimOp string
+
+const (
+	ExternalClaimAcquire ExternalClaimOp = "acquire"
+	ExternalClaimRelease                 = "release"
+)
+
+// ExternalClaimRequest is used to acquire or release an external claim
+type ExternalClaimRequest struct {
 	Datacenter string
-	ACL        string
-	ETag       string
-	QueryOptions
+	Op         ExternalClaimOp
+	Claim      ExternalClaim
+	WriteRequest
 }
 
-func (r *ACLPolicyRequest) RequestDatacenter() string {
+func (r *ExternalClaimRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
-type IndexedACLs struct {
-	ACLs ACLs
-	QueryMeta
-}
+// Maintenance puts a node, or one of its service instances, in
+// maintenance mode. The state store keeps a critical check for each
+// flag, so the node or instance drops out of the DNS and the passing
+// health results until the flag is lifted.
+type Maintenance struct {
+	Node      string
+	ServiceID string // Empty for the node and all its services
+	Reason    string
+	Expires   int64 // Unix nanoseconds the leader lifts the flag, zero for never
 
-type ACLPolicy struct {
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+type Maintenances []*Maintenance
+
+type MaintenanceOp string
+
+const (
+	MaintenanceEnable  MaintenanceOp = "enable"
+	MaintenanceDisable               = "disable"
+)
+
+// MaintenanceRequest is used to enable or disable maintenance mode. An
+// enable with a TTL expires after that long. A disable with a non-zero
+// ModifyIndex only applies if the flag is unchanged since.
+type MaintenanceRequest struct {
+	Datacenter  string
+	Op          MaintenanceOp
+	Maintenance Maintenance
+	TTL         time.Duration
+	WriteRequest
+}
+
+func (r *MaintenanceRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedMaintenances struct {
+	Maintenances Maintenances
+	QueryMeta
+}
+
+type SessionOp string
+
+const (
+	SessionCreate  SessionOp = "create"
+	SessionDestroy           = "destroy"
+)
+
+// SessionRequest is used to operate on sessions
+type SessionRequest struct {
+	Datacenter   string
+	Op           SessionOp // Which operation are we performing
+	Session      Session   // Which session
+	SessionLimit int       // Per-node session limit set by the leader, zero disables it
+	WriteRequest
+}
+
+func (r *SessionRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// SessionSpecificRequest is used to request a session by ID
+type SessionSpecificRequest struct {
+	Datacenter string
+	Session    string
+	QueryOptions
+}
+
+func (r *SessionSpecificRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// SessionExpiringRequest is used to list the sessions due to expire
+// within the Window unless they are renewed
+type SessionExpiringRequest struct {
+	Datacenter string
+	Window     time.Duration
+	QueryOptions
+}
+
+func (r *SessionExpiringRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedSessions struct {
+	Sessions Sessions
+	QueryMeta
+}
+
+// ACL is used to represent a token and it's rules
+type ACL struct {
+	CreateIndex uint64
+	ModifyIndex uint64
+	ID          string
+	Name        string
+	Type        string
+	Rules       string
+}
+type ACLs []*ACL
+
+type ACLOp string
+
+const (
+	ACLSet      ACLOp = "set"
+	ACLForceSet       = "force-set" // Deprecated, left to backwards compatibility
+	ACLDelete         = "delete"
+)
+
+// ACLRequest is used to create, update or delete an ACL
+type ACLRequest struct {
+	Datacenter string
+	Op         ACLOp
+	ACL        ACL
+	WriteRequest
+}
+
+func (r *ACLRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ACLSpecificRequest is used to request an ACL by ID
+type ACLSpecificRequest struct {
+	Datacenter string
+	ACL        string
+	QueryOptions
+}
+
+func (r *ACLSpecificRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ACLPolicyRequest is used to request an ACL by ID, conditionally
+// filtering on an ID
+type ACLPolicyRequest struct {
+	Datacenter string
+	ACL        string
+	ETag       string
+	QueryOptions
+}
+
+func (r *ACLPolicyRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedACLs struct {
+	ACLs ACLs
+	QueryMeta
+}
+
+type ACLPolicy struct {
 	ETag   string
 	Parent string
 	Policy *acl.Policy
@@ -528,6 +1337,46 @@ type ACLPolicy struct {
 	QueryMeta
 }
 
+// ACLReplicationStatus is the state of the replication of the ACLs of
+// the ACL datacenter, as run by the leader of a secondary datacenter.
+// ReplicatedIndex is the index of the ACLs in the ACL datacenter when
+// they were last replicated.
+type ACLReplicationStatus struct {
+	Enabled          bool
+	Running          bool
+	SourceDatacenter string
+	ReplicatedIndex  uint64
+	LastSuccess      time.Time
+	LastError        time.Time
+	LastErrorMessage string `json:",omitempty"`
+}
+
+// ACLExplainRequest is used to check whether a token, or a set of rules,
+// allows an operation, like "key:read", on the named resource. The token
+// of the request is checked if neither ACL nor Rules is given.
+type ACLExplainRequest struct {
+	Datacenter string
+	ACL        string
+	Rules      string
+	Operation  string
+	Name       string
+	QueryOptions
+}
+
+func (r *ACLExplainRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ACLExplanation is the decision on an operation, along with the rule
+// that decided it. Rule is empty if no rule matched, in which case the
+// decision was inherited from the Root policy.
+type ACLExplanation struct {
+	Allowed bool
+	Rule    string `json:",omitempty"`
+	Root    string `json:",omitempty"`
+	QueryMeta
+}
+
 // EventFireRequest is used to ask a server to fire
 // a Serf event. It is a bit odd, since it doesn't depend on
 // the catalog or leader. Any node can respond, so it's not quite
@@ -569,16 +1418,334 @@ func (r *TombstoneRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+type KVSHistoryOp string
+
+const (
+	KVSHistoryReap KVSHistoryOp = "reap"
+)
+
+// KVSHistoryRequest is used to reap the versions of the KV history
+// recorded at or before ReapIndex, once they are older than the TTL
+type KVSHistoryRequest struct {
+	Datacenter string
+	Op         KVSHistoryOp
+	ReapIndex  uint64
+	WriteRequest
+}
+
+func (r *KVSHistoryRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// RetentionConfig is how much history the servers retain. It is
+// committed by the leader from its configuration, so that all the
+// servers apply the same limits.
+type RetentionConfig struct {
+	// KVSHistoryVersions is the number of prior versions retained for
+	// each KV entry. Zero disables the history.
+	KVSHistoryVersions int
+
+	// CatalogAuditLimit is the number of catalog changes retained in
+	// the audit table. Zero disables the audit table.
+	CatalogAuditLimit int
+
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// RetentionRequest is used by the leader to set the retention
+type RetentionRequest struct {
+	Datacenter string
+	Config     RetentionConfig
+	WriteRequest
+}
+
+func (r *RetentionRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// StateStats is a point in time view of the size of a server's state
+// store, and of the blocking queries that are watching it
+type StateStats struct {
+	// Server is the name of the server that reported the stats
+	Server string
+
+	// Objects is the number of rows in each table, by table name
+	Objects map[string]int
+
+	// Bytes is the estimated size of the rows of each table, and
+	// IndexBytes the estimated size of its indexes, by table name
+	Bytes      map[string]uint64
+	IndexBytes map[string]uint64
+
+	// Watches is the number of waiting watchers of each table, by
+	// table name
+	Watches map[string]int
+
+	// KVSWatches is the number of waiting watchers of KV prefixes, and
+	// KVSWatchGroups the number of watched prefixes
+	KVSWatches     int
+	KVSWatchGroups int
+}
+
+// SlowQuery describes a state store query that took longer than the
+// slow query threshold
+type SlowQuery struct {
+	Method   string
+	Params   []string // name=value pairs, with sensitive values redacted
+	Duration time.Duration
+	Time     time.Time
+}
+
+// SlowQueryReport is the slow query log of a server
+type SlowQueryReport struct {
+	// Server is the name of the server that reported the queries
+	Server string
+
+	// Threshold is the duration after which a query is logged, zero if
+	// the log is disabled
+	Threshold time.Duration
+
+	// Queries are the most recent slow queries, oldest first
+	Queries []*SlowQuery
+}
+
+// StateProblem is an inconsistency found in a server's state store
+type StateProblem struct {
+	Table   string // Table of the inconsistent row
+	Key     string // Identifies the row, e.g. "node/service-id"
+	Problem string
+}
+
+// StateVerifyReport is the result of checking the integrity of a
+// server's state store
+type StateVerifyReport struct {
+	// Server is the name of the server that verified its state
+	Server string
+
+	// Index is the last index of the state that was verified
+	Index uint64
+
+	// Rows is the number of rows verified in each table, by table name
+	Rows map[string]int
+
+	// Problems are the inconsistencies that were found
+	Problems []StateProblem
+}
+
+// RaftServer is a server of the Raft configuration
+type RaftServer struct {
+	// Node is the name of the server in the LAN pool, or empty if no
+	// member has its address
+	Node string
+
+	// Address is the address of the server for Raft
+	Address string
+
+	// Status is the status of the server in the LAN pool, like "alive"
+	// or "failed", or "unknown" if no member has its address
+	Status string
+
+	// Leader is set for the current leader
+	Leader bool
+}
+
+// RaftConfigurationResponse is the Raft configuration of a datacenter
+type RaftConfigurationResponse struct {
+	Servers []*RaftServer
+	QueryMeta
+}
+
+// RaftPeerRequest is used to remove a server from the Raft configuration
+type RaftPeerRequest struct {
+	Datacenter string
+
+	// Address is the address of the server for Raft
+	Address string
+	WriteRequest
+}
+
+func (r *RaftPeerRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// AutopilotConfig is the operator configuration of autopilot, the
+// management of the servers by the leader. It is kept in the state store
+// so a new leader applies the same configuration.
+type AutopilotConfig struct {
+	// CleanupDeadServers controls if failed servers are removed from the
+	// Raft configuration once healthy replacements have been added
+	CleanupDeadServers bool
+
+	// ServerStabilizationTime is how long a new server must be healthy
+	// before it is added to the Raft configuration, and how long a
+	// server must have failed before it is removed. Zero adds the new
+	// servers as soon as they join.
+	ServerStabilizationTime time.Duration
+
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// AutopilotConfigResponse is the autopilot configuration of a datacenter
+type AutopilotConfigResponse struct {
+	Config AutopilotConfig
+	QueryMeta
+}
+
+// AutopilotSetConfigRequest is used to set the autopilot configuration.
+// With CAS, the configuration is only set if its ModifyIndex matches
+// that of the current configuration, with 0 matching the defaults.
+type AutopilotSetConfigRequest struct {
+	Datacenter string
+	Config     AutopilotConfig
+	CAS        bool
+	WriteRequest
+}
+
+func (r *AutopilotSetConfigRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// SnapshotMeta describes the contents of a snapshot archive
+type SnapshotMeta struct {
+	// Version is the format of the archive
+	Version int
+
+	// Index is the last index of the state in the snapshot
+	Index uint64
+
+	// Datacenter and Server are where the snapshot was taken
+	Datacenter string
+	Server     string
+	Created    time.Time
+
+	// Records is the number of records of each table, by table name
+	Records map[string]uint64
+
+	// Size is the size of the state in bytes
+	Size int64
+
+	// Redacted is set if the secrets of the state were masked, in which
+	// case the ACL tokens and session IDs differ from the datacenter's
+	Redacted bool `json:",omitempty"`
+}
+
+// SnapshotRequest is used to request a snapshot archive of the state.
+// A redacted snapshot has its ACL tokens and session IDs replaced, and
+// the values of the keys under RedactKVPrefixes masked, so it can be
+// shared.
+type SnapshotRequest struct {
+	Datacenter       string
+	Redact           bool
+	RedactKVPrefixes []string
+	QueryOptions
+}
+
+func (r *SnapshotRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// SnapshotResponse is used to return a snapshot archive of the state
+type SnapshotResponse struct {
+	Data []byte
+	QueryMeta
+}
+
+// SnapshotRestoreRequest is used to restore the state from a snapshot
+// archive
+type SnapshotRestoreRequest struct {
+	Datacenter string
+	Data       []byte
+	WriteRequest
+}
+
+func (r *SnapshotRestoreRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// SnapshotRestore is applied through Raft to replace the state of every
+// server with the state of a snapshot. The state is applied in chunks,
+// numbered by Seq from zero, which the servers keep until the last one,
+// the only one without More set.
+type SnapshotRestore struct {
+	ID    string // Identifies the restore the chunk belongs to
+	Seq   int
+	More  bool
+	Meta  SnapshotMeta
+	State []byte
+}
+
+// WatchStatsRequest is used to get the watch statistics of a server
+type WatchStatsRequest struct {
+	Datacenter string
+
+	// Limit is the number of most notified prefixes to return, or
+	// zero for the default
+	Limit int
+	QueryOptions
+}
+
+func (r *WatchStatsRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// WatchFires counts how often a table or watched prefix was notified
+type WatchFires struct {
+	// Name is the table name, or the watched KV prefix or pattern
+	Name string
+
+	// Fires is the number of notifications with waiting watchers, and
+	// Woken the number of watchers they woke up
+	Fires uint64
+	Woken uint64
+
+	// Rate is the number of fires per second over the window
+	Rate float64
+}
+
+// WatchStats shows what the blocking queries of a server are watching,
+// and how often they are woken up, to find the keys causing storms of
+// blocking queries
+type WatchStats struct {
+	// Server is the name of the server that reported the stats
+	Server string
+
+	// Watchers is the number of waiting watchers of each table, by
+	// table name, and KVSWatchers the number of waiting watchers of
+	// each watched KV prefix or pattern
+	Watchers    map[string]int
+	KVSWatchers map[string]int
+
+	// Window is the period covered by the fire counts, which is the
+	// last full minute once the server has been up for one
+	Window time.Duration
+
+	// Tables are the fire counts of the tables, and TopPrefixes the
+	// most notified KV prefixes, most fires first
+	Tables      []*WatchFires
+	TopPrefixes []*WatchFires
+}
+
 // msgpackHandle is a shared handle for encoding/decoding of structs
 var msgpackHandle = &codec.MsgpackHandle{}
 
-// Decode is used to decode a MsgPack encoded object
+// Decode is used to decode a MsgPack encoded object. Types with a
+// generated decoder bypass the reflection based codec.
 func Decode(buf []byte, out interface{}) error {
+	if u, ok := out.(MsgpackUnmarshaler); ok {
+		_, err := u.UnmarshalMsgpack(buf)
+		return err
+	}
 	return codec.NewDecoder(bytes.NewReader(buf), msgpackHandle).Decode(out)
 }
 
-// Encode is used to encode a MsgPack object with type prefix
+// Encode is used to encode a MsgPack object with type prefix. Types
+// with a generated encoder bypass the reflection based codec.
 func Encode(t MessageType, msg interface{}) ([]byte, error) {
+	if m, ok := msg.(MsgpackMarshaler); ok {
+		return m.MarshalMsgpack([]byte{uint8(t)}), nil
+	}
 	var buf bytes.Buffer
 	buf.WriteByte(uint8(t))
 	err := codec.NewEncoder(&buf, msgpackHandle).Encode(msg)
@@ -647,3 +1814,380 @@ func (r *KeyringResponses) Add(v interface{}) {
 func (r *KeyringResponses) New() interface{} {
 	return new(KeyringResponses)
 }
+
+// AutoEncryptToken is a one-time token an agent uses to obtain its TLS
+// certificate from the servers. Only the SHA-256 hash of its secret is
+// kept, so the snapshots don't hold usable tokens. The token is only
+// accepted for the certificate of the named node.
+type AutoEncryptToken struct {
+	Hash        string
+	Node        string
+	Description string
+	ExpiresAt   time.Time
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+type AutoEncryptTokenOp string
+
+const (
+	AutoEncryptTokenCreate  AutoEncryptTokenOp = "create"
+	AutoEncryptTokenConsume AutoEncryptTokenOp = "consume"
+)
+
+// AutoEncryptTokenRequest is used to create or consume a one-time token.
+// Now is the time of the leader, against which the tokens expire.
+type AutoEncryptTokenRequest struct {
+	Datacenter string
+	Op         AutoEncryptTokenOp
+	Token      AutoEncryptToken
+	Now        time.Time
+	WriteRequest
+}
+
+func (r *AutoEncryptTokenRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// AutoEncryptTokenCreateRequest is used to create a one-time token for
+// the certificate of a node, which expires after the TTL
+type AutoEncryptTokenCreateRequest struct {
+	Datacenter  string
+	Node        string
+	Description string
+	TTL         time.Duration
+	WriteRequest
+}
+
+func (r *AutoEncryptTokenCreateRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// AutoEncryptTokenCreateResponse returns the secret of a new one-time
+// token, which can't be read again
+type AutoEncryptTokenCreateResponse struct {
+	Secret    string
+	ExpiresAt time.Time
+}
+
+// AutoEncryptSignRequest is used by an agent to have the servers sign a
+// TLS certificate for its public key, which is DER encoded in PKIX form.
+// The request is authenticated by one of GossipHMAC, the HMAC-SHA256 of
+// SignedBytes with a gossip encryption key, OneTimeToken, the secret of a
+// one-time token, or Certificate, a current certificate of the agent for
+// the same key, to renew it. Source is the IP address the request came
+// from, which the server receiving it sets over any value of the agent.
+type AutoEncryptSignRequest struct {
+	Datacenter   string
+	Node         string
+	PublicKey    []byte
+	GossipHMAC   []byte
+	OneTimeToken string
+	Certificate  string
+	Source       string
+	WriteRequest
+}
+
+func (r *AutoEncryptSignRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// SignedBytes returns the bytes covered by the GossipHMAC
+func (r *AutoEncryptSignRequest) SignedBytes() []byte {
+	buf := make([]byte, 0, len(r.Node)+1+len(r.PublicKey))
+	buf = append(buf, r.Node...)
+	buf = append(buf, 0)
+	return append(buf, r.PublicKey...)
+}
+
+// AutoEncryptSignResponse is the certificate signed for an agent, with
+// the CA certificates to verify the servers, both PEM encoded
+type AutoEncryptSignResponse struct {
+	Certificate string
+	CA          string
+	ExpiresAt   time.Time
+}
+
+// Area is a network area, which links the local datacenter to a single
+// peer datacenter without joining the WAN gossip pool. The servers of
+// the peer are discovered from the server RPC addresses of RetryJoin,
+// and the RPCs of the peer datacenter are forwarded to them. UseTLS
+// requires the servers to use TLS for their outgoing connections, so
+// the links between the datacenters are always encrypted.
+type Area struct {
+	ID             string
+	PeerDatacenter string
+	RetryJoin      []string
+	UseTLS         bool
+	CreateIndex    uint64
+	ModifyIndex    uint64
+}
+type Areas []*Area
+
+type AreaOp string
+
+const (
+	AreaUpsert AreaOp = "upsert"
+	AreaDelete        = "delete"
+)
+
+// AreaRequest is used to create, update or delete a network area. An
+// area is created if its ID is empty, and deleted by its ID.
+type AreaRequest struct {
+	Datacenter string
+	Op         AreaOp
+	Area       Area
+	WriteRequest
+}
+
+func (r *AreaRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// AreaSpecificRequest is used to query a network area by ID
+type AreaSpecificRequest struct {
+	Datacenter string
+	AreaID     string
+	QueryOptions
+}
+
+func (r *AreaSpecificRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedAreas struct {
+	Areas Areas
+	QueryMeta
+}
+
+// AreaServer is a server of the peer datacenter of an area, as seen by
+// the server answering. Healthy is false once an RPC to it failed, until
+// the next refresh of the area reaches it.
+type AreaServer struct {
+	Address     string
+	Healthy     bool
+	LastContact time.Time
+	LastError   string `json:",omitempty"`
+}
+
+// AreaServers are the servers of the peer datacenter of an area
+type AreaServers struct {
+	Datacenter string
+	Servers    []*AreaServer
+}
+
+// ServiceEndpoint is an address dialed to reach a service
+type ServiceEndpoint struct {
+	Node    string
+	Address string
+	Port    int
+}
+
+// ServiceResolution is how the proxies of a datacenter reach a service of
+// a target datacenter. In the same datacenter, they dial the healthy
+// proxies of the service. Otherwise they dial the healthy mesh gateways
+// of their datacenter, which forward to the mesh gateways of the target
+// datacenter at their WAN addresses. The service is unreachable if there
+// is no endpoint.
+type ServiceResolution struct {
+	Datacenter  string
+	ServiceName string
+	Endpoints   []ServiceEndpoint
+	Gateways    []ServiceEndpoint
+	QueryMeta
+}
+
+// PeeringState is the state of a peering, as seen by its side
+type PeeringState string
+
+const (
+	// PeeringPending is the state of a peering a token was generated
+	// for, until the peer dials it with the token
+	PeeringPending PeeringState = "pending"
+
+	// PeeringEstablishing is the state of a peering established from a
+	// token, until the peer first answers
+	PeeringEstablishing = "establishing"
+
+	// PeeringActive is the state of a peering whose last exchange of
+	// services succeeded
+	PeeringActive = "active"
+
+	// PeeringFailing is the state of a peering whose last exchange of
+	// services failed, with the error in LastError
+	PeeringFailing = "failing"
+)
+
+// Peering links the datacenter to a peer cluster, with which it shares
+// the services selected by the exported services configuration, without
+// the clusters being federated over the WAN. The accepting side generates
+// a token, with which the dialing side establishes the peering, and then
+// periodically pulls the services exported to it from the servers of the
+// accepting side. Both sides name the peering after the other one.
+type Peering struct {
+	ID    string
+	Name  string
+	State PeeringState
+
+	// The dialing side keeps the ID of the peering on the accepting side,
+	// and the RPC addresses of its servers, which it dials. They are empty
+	// on the accepting side.
+	PeerID              string
+	PeerDatacenter      string
+	PeerServerAddresses []string
+
+	// SecretHash is the hash of the secret of the token, which the
+	// dialing side authenticates with. Only the dialing side keeps the
+	// secret itself. Neither is returned by the read endpoints.
+	SecretHash string `json:",omitempty"`
+	Secret     string `json:",omitempty"`
+
+	LastError   string `json:",omitempty"`
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+type Peerings []*Peering
+
+// PeeringToken is what the dialing side needs to establish a peering. It
+// is handed over as the base64 encoding of its JSON.
+type PeeringToken struct {
+	Datacenter      string
+	ServerAddresses []string
+	PeerID          string
+	Secret          string
+}
+
+type PeeringOp string
+
+const (
+	PeeringUpsert PeeringOp = "upsert"
+	PeeringDelete           = "delete"
+)
+
+// PeeringRequest is used to write or delete a peering, by name. Deleting
+// a peering also deletes the services imported from it.
+type PeeringRequest struct {
+	Datacenter string
+	Op         PeeringOp
+	Peering    Peering
+	WriteRequest
+}
+
+func (r *PeeringRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// PeeringTokenRequest is used to generate the token of a new peering,
+// or to establish a peering from a token
+type PeeringTokenRequest struct {
+	Datacenter   string
+	PeerName     string
+	PeeringToken string
+	WriteRequest
+}
+
+func (r *PeeringTokenRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// PeeringSpecificRequest is used to query a peering by name
+type PeeringSpecificRequest struct {
+	Datacenter string
+	PeerName   string
+	QueryOptions
+}
+
+func (r *PeeringSpecificRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedPeerings struct {
+	Peerings Peerings
+	QueryMeta
+}
+
+// PeeringResponse is a peering, with the names of the services imported
+// from it. Peering is nil if there is no such peering.
+type PeeringResponse struct {
+	Peering          *Peering
+	ImportedServices []string
+	QueryMeta
+}
+
+// ExportedService selects a service, or all of them if Name is "*", to
+// share with the peers named by Consumers
+type ExportedService struct {
+	Name      string
+	Consumers []string
+}
+
+// ExportedServicesConfig is the configuration of the services shared
+// with the peers
+type ExportedServicesConfig struct {
+	Services    []ExportedService
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// ExportedServicesRequest is used to set the exported services
+// configuration
+type ExportedServicesRequest struct {
+	Datacenter string
+	Config     ExportedServicesConfig
+	WriteRequest
+}
+
+func (r *ExportedServicesRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type ExportedServicesResponse struct {
+	Config ExportedServicesConfig
+	QueryMeta
+}
+
+// ImportedService is a service exported by a peer, with its nodes as of
+// the last exchange
+type ImportedService struct {
+	Peer        string
+	Service     string
+	Nodes       CheckServiceNodes
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+type ImportedServices []*ImportedService
+
+// ImportedServicesRequest is used to replace the services imported from
+// a peer
+type ImportedServicesRequest struct {
+	Datacenter string
+	Peer       string
+	Services   ImportedServices
+	WriteRequest
+}
+
+func (r *ImportedServicesRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// PeeringExchangeRequest is sent by the dialing side of a peering to the
+// accepting side, to fetch the services exported to it. The datacenter
+// is that of the accepting side, and the peering is authenticated by
+// the secret of its token.
+type PeeringExchangeRequest struct {
+	Datacenter string
+	PeerID     string
+	Secret     string
+	WriteRequest
+}
+
+func (r *PeeringExchangeRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// PeeringExchangeResponse holds the services exported to a peer, with
+// the datacenter of the exporting side
+type PeeringExchangeResponse struct {
+	Datacenter string
+	Services   ImportedServices
+}
@@ -0,0 +1,1500 @@
+// generated by msgpackgen; DO NOT EDIT.
+
+package structs
+
+import "time"
+
+// MarshalMsgpack appends the msgpack encoding of the Node to b
+func (x *Node) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 5)
+	b = msgpackAppendString(b, "Node")
+	b = msgpackAppendString(b, x.Node)
+	b = msgpackAppendString(b, "Address")
+	b = msgpackAppendString(b, x.Address)
+	b = msgpackAppendString(b, "Meta")
+	b = msgpackAppendStringMap(b, x.Meta)
+	b = msgpackAppendString(b, "CreateIndex")
+	b = msgpackAppendUint(b, x.CreateIndex)
+	b = msgpackAppendString(b, "ModifyIndex")
+	b = msgpackAppendUint(b, x.ModifyIndex)
+	return b
+}
+
+// UnmarshalMsgpack decodes a Node from the front of b
+func (x *Node) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Node":
+			x.Node, b, err = msgpackReadString(b)
+		case "Address":
+			x.Address, b, err = msgpackReadString(b)
+		case "Meta":
+			x.Meta, b, err = msgpackReadStringMap(b)
+		case "CreateIndex":
+			x.CreateIndex, b, err = msgpackReadUint(b)
+		case "ModifyIndex":
+			x.ModifyIndex, b, err = msgpackReadUint(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the ServiceNode to b
+func (x *ServiceNode) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 16)
+	b = msgpackAppendString(b, "Node")
+	b = msgpackAppendString(b, x.Node)
+	b = msgpackAppendString(b, "Address")
+	b = msgpackAppendString(b, x.Address)
+	b = msgpackAppendString(b, "ServiceID")
+	b = msgpackAppendString(b, x.ServiceID)
+	b = msgpackAppendString(b, "ServiceName")
+	b = msgpackAppendString(b, x.ServiceName)
+	b = msgpackAppendString(b, "ServiceTags")
+	b = msgpackAppendStringSlice(b, x.ServiceTags)
+	b = msgpackAppendString(b, "ServiceAddress")
+	b = msgpackAppendString(b, x.ServiceAddress)
+	b = msgpackAppendString(b, "ServicePort")
+	b = msgpackAppendInt(b, int64(x.ServicePort))
+	b = msgpackAppendString(b, "ServiceMeta")
+	b = msgpackAppendStringMap(b, x.ServiceMeta)
+	b = msgpackAppendString(b, "ServiceWeightPassing")
+	b = msgpackAppendInt(b, int64(x.ServiceWeightPassing))
+	b = msgpackAppendString(b, "ServiceWeightWarning")
+	b = msgpackAppendInt(b, int64(x.ServiceWeightWarning))
+	b = msgpackAppendString(b, "ServiceKind")
+	b = msgpackAppendString(b, string(x.ServiceKind))
+	b = msgpackAppendString(b, "ServiceProxy")
+	b = x.ServiceProxy.MarshalMsgpack(b)
+	b = msgpackAppendString(b, "ServiceWANAddress")
+	b = msgpackAppendString(b, x.ServiceWANAddress)
+	b = msgpackAppendString(b, "ServiceWANPort")
+	b = msgpackAppendInt(b, int64(x.ServiceWANPort))
+	b = msgpackAppendString(b, "CreateIndex")
+	b = msgpackAppendUint(b, x.CreateIndex)
+	b = msgpackAppendString(b, "ModifyIndex")
+	b = msgpackAppendUint(b, x.ModifyIndex)
+	return b
+}
+
+// UnmarshalMsgpack decodes a ServiceNode from the front of b
+func (x *ServiceNode) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Node":
+			x.Node, b, err = msgpackReadString(b)
+		case "Address":
+			x.Address, b, err = msgpackReadString(b)
+		case "ServiceID":
+			x.ServiceID, b, err = msgpackReadString(b)
+		case "ServiceName":
+			x.ServiceName, b, err = msgpackReadString(b)
+		case "ServiceTags":
+			x.ServiceTags, b, err = msgpackReadStringSlice(b)
+		case "ServiceAddress":
+			x.ServiceAddress, b, err = msgpackReadString(b)
+		case "ServicePort":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.ServicePort = int(v)
+		case "ServiceMeta":
+			x.ServiceMeta, b, err = msgpackReadStringMap(b)
+		case "ServiceWeightPassing":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.ServiceWeightPassing = int(v)
+		case "ServiceWeightWarning":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.ServiceWeightWarning = int(v)
+		case "ServiceKind":
+			var v string
+			v, b, err = msgpackReadString(b)
+			x.ServiceKind = ServiceKind(v)
+		case "ServiceProxy":
+			b, err = x.ServiceProxy.UnmarshalMsgpack(b)
+		case "ServiceWANAddress":
+			x.ServiceWANAddress, b, err = msgpackReadString(b)
+		case "ServiceWANPort":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.ServiceWANPort = int(v)
+		case "CreateIndex":
+			x.CreateIndex, b, err = msgpackReadUint(b)
+		case "ModifyIndex":
+			x.ModifyIndex, b, err = msgpackReadUint(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the NodeService to b
+func (x *NodeService) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 13)
+	b = msgpackAppendString(b, "ID")
+	b = msgpackAppendString(b, x.ID)
+	b = msgpackAppendString(b, "Service")
+	b = msgpackAppendString(b, x.Service)
+	b = msgpackAppendString(b, "Tags")
+	b = msgpackAppendStringSlice(b, x.Tags)
+	b = msgpackAppendString(b, "Address")
+	b = msgpackAppendString(b, x.Address)
+	b = msgpackAppendString(b, "Port")
+	b = msgpackAppendInt(b, int64(x.Port))
+	b = msgpackAppendString(b, "EnableTagOverride")
+	b = msgpackAppendBool(b, x.EnableTagOverride)
+	b = msgpackAppendString(b, "Meta")
+	b = msgpackAppendStringMap(b, x.Meta)
+	b = msgpackAppendString(b, "WeightPassing")
+	b = msgpackAppendInt(b, int64(x.WeightPassing))
+	b = msgpackAppendString(b, "WeightWarning")
+	b = msgpackAppendInt(b, int64(x.WeightWarning))
+	b = msgpackAppendString(b, "Kind")
+	b = msgpackAppendString(b, string(x.Kind))
+	b = msgpackAppendString(b, "Proxy")
+	b = x.Proxy.MarshalMsgpack(b)
+	b = msgpackAppendString(b, "WANAddress")
+	b = msgpackAppendString(b, x.WANAddress)
+	b = msgpackAppendString(b, "WANPort")
+	b = msgpackAppendInt(b, int64(x.WANPort))
+	return b
+}
+
+// UnmarshalMsgpack decodes a NodeService from the front of b
+func (x *NodeService) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "ID":
+			x.ID, b, err = msgpackReadString(b)
+		case "Service":
+			x.Service, b, err = msgpackReadString(b)
+		case "Tags":
+			x.Tags, b, err = msgpackReadStringSlice(b)
+		case "Address":
+			x.Address, b, err = msgpackReadString(b)
+		case "Port":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.Port = int(v)
+		case "EnableTagOverride":
+			x.EnableTagOverride, b, err = msgpackReadBool(b)
+		case "Meta":
+			x.Meta, b, err = msgpackReadStringMap(b)
+		case "WeightPassing":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.WeightPassing = int(v)
+		case "WeightWarning":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.WeightWarning = int(v)
+		case "Kind":
+			var v string
+			v, b, err = msgpackReadString(b)
+			x.Kind = ServiceKind(v)
+		case "Proxy":
+			b, err = x.Proxy.UnmarshalMsgpack(b)
+		case "WANAddress":
+			x.WANAddress, b, err = msgpackReadString(b)
+		case "WANPort":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.WANPort = int(v)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the ConnectProxyConfig to b
+func (x *ConnectProxyConfig) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 5)
+	b = msgpackAppendString(b, "DestinationServiceName")
+	b = msgpackAppendString(b, x.DestinationServiceName)
+	b = msgpackAppendString(b, "DestinationServiceID")
+	b = msgpackAppendString(b, x.DestinationServiceID)
+	b = msgpackAppendString(b, "LocalServiceAddress")
+	b = msgpackAppendString(b, x.LocalServiceAddress)
+	b = msgpackAppendString(b, "LocalServicePort")
+	b = msgpackAppendInt(b, int64(x.LocalServicePort))
+	b = msgpackAppendString(b, "Upstreams")
+	if x.Upstreams == nil {
+		b = msgpackAppendNil(b)
+	} else {
+		b = msgpackAppendArrayHeader(b, len(x.Upstreams))
+		for j := range x.Upstreams {
+			b = x.Upstreams[j].MarshalMsgpack(b)
+		}
+	}
+	return b
+}
+
+// UnmarshalMsgpack decodes a ConnectProxyConfig from the front of b
+func (x *ConnectProxyConfig) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "DestinationServiceName":
+			x.DestinationServiceName, b, err = msgpackReadString(b)
+		case "DestinationServiceID":
+			x.DestinationServiceID, b, err = msgpackReadString(b)
+		case "LocalServiceAddress":
+			x.LocalServiceAddress, b, err = msgpackReadString(b)
+		case "LocalServicePort":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.LocalServicePort = int(v)
+		case "Upstreams":
+			if isNil, rest := msgpackIsNil(b); isNil {
+				x.Upstreams, b = nil, rest
+				break
+			}
+			var count int
+			if count, b, err = msgpackReadArrayHeader(b); err != nil {
+				break
+			}
+			x.Upstreams = make([]Upstream, count)
+			for j := range x.Upstreams {
+				if b, err = x.Upstreams[j].UnmarshalMsgpack(b); err != nil {
+					break
+				}
+			}
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the Upstream to b
+func (x *Upstream) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 4)
+	b = msgpackAppendString(b, "DestinationName")
+	b = msgpackAppendString(b, x.DestinationName)
+	b = msgpackAppendString(b, "Datacenter")
+	b = msgpackAppendString(b, x.Datacenter)
+	b = msgpackAppendString(b, "LocalBindAddress")
+	b = msgpackAppendString(b, x.LocalBindAddress)
+	b = msgpackAppendString(b, "LocalBindPort")
+	b = msgpackAppendInt(b, int64(x.LocalBindPort))
+	return b
+}
+
+// UnmarshalMsgpack decodes a Upstream from the front of b
+func (x *Upstream) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "DestinationName":
+			x.DestinationName, b, err = msgpackReadString(b)
+		case "Datacenter":
+			x.Datacenter, b, err = msgpackReadString(b)
+		case "LocalBindAddress":
+			x.LocalBindAddress, b, err = msgpackReadString(b)
+		case "LocalBindPort":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.LocalBindPort = int(v)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the HealthCheck to b
+func (x *HealthCheck) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 26)
+	b = msgpackAppendString(b, "Node")
+	b = msgpackAppendString(b, x.Node)
+	b = msgpackAppendString(b, "CheckID")
+	b = msgpackAppendString(b, x.CheckID)
+	b = msgpackAppendString(b, "Name")
+	b = msgpackAppendString(b, x.Name)
+	b = msgpackAppendString(b, "Status")
+	b = msgpackAppendString(b, x.Status)
+	b = msgpackAppendString(b, "Notes")
+	b = msgpackAppendString(b, x.Notes)
+	b = msgpackAppendString(b, "Output")
+	b = msgpackAppendString(b, x.Output)
+	b = msgpackAppendString(b, "ServiceID")
+	b = msgpackAppendString(b, x.ServiceID)
+	b = msgpackAppendString(b, "ServiceName")
+	b = msgpackAppendString(b, x.ServiceName)
+	b = msgpackAppendString(b, "CreateIndex")
+	b = msgpackAppendUint(b, x.CreateIndex)
+	b = msgpackAppendString(b, "ModifyIndex")
+	b = msgpackAppendUint(b, x.ModifyIndex)
+	b = msgpackAppendString(b, "DeregisterCriticalServiceAfter")
+	b = msgpackAppendInt(b, int64(x.DeregisterCriticalServiceAfter))
+	b = msgpackAppendString(b, "SuccessBeforePassing")
+	b = msgpackAppendInt(b, int64(x.SuccessBeforePassing))
+	b = msgpackAppendString(b, "FailuresBeforeCritical")
+	b = msgpackAppendInt(b, int64(x.FailuresBeforeCritical))
+	b = msgpackAppendString(b, "Type")
+	b = msgpackAppendString(b, x.Type)
+	b = msgpackAppendString(b, "Target")
+	b = msgpackAppendString(b, x.Target)
+	b = msgpackAppendString(b, "Interval")
+	b = msgpackAppendInt(b, int64(x.Interval))
+	b = msgpackAppendString(b, "Timeout")
+	b = msgpackAppendInt(b, int64(x.Timeout))
+	b = msgpackAppendString(b, "TTL")
+	b = msgpackAppendInt(b, int64(x.TTL))
+	b = msgpackAppendString(b, "TLS")
+	b = msgpackAppendBool(b, x.TLS)
+	b = msgpackAppendString(b, "TLSSkipVerify")
+	b = msgpackAppendBool(b, x.TLSSkipVerify)
+	b = msgpackAppendString(b, "Method")
+	b = msgpackAppendString(b, x.Method)
+	b = msgpackAppendString(b, "Header")
+	b = msgpackAppendStringSliceMap(b, x.Header)
+	b = msgpackAppendString(b, "Body")
+	b = msgpackAppendString(b, x.Body)
+	b = msgpackAppendString(b, "ExpectedStatus")
+	b = msgpackAppendStringSlice(b, x.ExpectedStatus)
+	b = msgpackAppendString(b, "DockerContainerID")
+	b = msgpackAppendString(b, x.DockerContainerID)
+	b = msgpackAppendString(b, "Shell")
+	b = msgpackAppendString(b, x.Shell)
+	return b
+}
+
+// UnmarshalMsgpack decodes a HealthCheck from the front of b
+func (x *HealthCheck) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Node":
+			x.Node, b, err = msgpackReadString(b)
+		case "CheckID":
+			x.CheckID, b, err = msgpackReadString(b)
+		case "Name":
+			x.Name, b, err = msgpackReadString(b)
+		case "Status":
+			x.Status, b, err = msgpackReadString(b)
+		case "Notes":
+			x.Notes, b, err = msgpackReadString(b)
+		case "Output":
+			x.Output, b, err = msgpackReadString(b)
+		case "ServiceID":
+			x.ServiceID, b, err = msgpackReadString(b)
+		case "ServiceName":
+			x.ServiceName, b, err = msgpackReadString(b)
+		case "CreateIndex":
+			x.CreateIndex, b, err = msgpackReadUint(b)
+		case "ModifyIndex":
+			x.ModifyIndex, b, err = msgpackReadUint(b)
+		case "DeregisterCriticalServiceAfter":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.DeregisterCriticalServiceAfter = time.Duration(v)
+		case "SuccessBeforePassing":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.SuccessBeforePassing = int(v)
+		case "FailuresBeforeCritical":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.FailuresBeforeCritical = int(v)
+		case "Type":
+			x.Type, b, err = msgpackReadString(b)
+		case "Target":
+			x.Target, b, err = msgpackReadString(b)
+		case "Interval":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.Interval = time.Duration(v)
+		case "Timeout":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.Timeout = time.Duration(v)
+		case "TTL":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.TTL = time.Duration(v)
+		case "TLS":
+			x.TLS, b, err = msgpackReadBool(b)
+		case "TLSSkipVerify":
+			x.TLSSkipVerify, b, err = msgpackReadBool(b)
+		case "Method":
+			x.Method, b, err = msgpackReadString(b)
+		case "Header":
+			x.Header, b, err = msgpackReadStringSliceMap(b)
+		case "Body":
+			x.Body, b, err = msgpackReadString(b)
+		case "ExpectedStatus":
+			x.ExpectedStatus, b, err = msgpackReadStringSlice(b)
+		case "DockerContainerID":
+			x.DockerContainerID, b, err = msgpackReadString(b)
+		case "Shell":
+			x.Shell, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the DirEntry to b
+func (x *DirEntry) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 7)
+	b = msgpackAppendString(b, "CreateIndex")
+	b = msgpackAppendUint(b, x.CreateIndex)
+	b = msgpackAppendString(b, "ModifyIndex")
+	b = msgpackAppendUint(b, x.ModifyIndex)
+	b = msgpackAppendString(b, "LockIndex")
+	b = msgpackAppendUint(b, x.LockIndex)
+	b = msgpackAppendString(b, "Key")
+	b = msgpackAppendString(b, x.Key)
+	b = msgpackAppendString(b, "Flags")
+	b = msgpackAppendUint(b, x.Flags)
+	b = msgpackAppendString(b, "Value")
+	b = msgpackAppendBytes(b, x.Value)
+	b = msgpackAppendString(b, "Session")
+	b = msgpackAppendString(b, x.Session)
+	return b
+}
+
+// UnmarshalMsgpack decodes a DirEntry from the front of b
+func (x *DirEntry) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "CreateIndex":
+			x.CreateIndex, b, err = msgpackReadUint(b)
+		case "ModifyIndex":
+			x.ModifyIndex, b, err = msgpackReadUint(b)
+		case "LockIndex":
+			x.LockIndex, b, err = msgpackReadUint(b)
+		case "Key":
+			x.Key, b, err = msgpackReadString(b)
+		case "Flags":
+			x.Flags, b, err = msgpackReadUint(b)
+		case "Value":
+			x.Value, b, err = msgpackReadBytes(b)
+		case "Session":
+			x.Session, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the AuditSource to b
+func (x *AuditSource) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 2)
+	b = msgpackAppendString(b, "Time")
+	b = msgpackAppendInt(b, x.Time)
+	b = msgpackAppendString(b, "SourceAddr")
+	b = msgpackAppendString(b, x.SourceAddr)
+	return b
+}
+
+// UnmarshalMsgpack decodes a AuditSource from the front of b
+func (x *AuditSource) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Time":
+			x.Time, b, err = msgpackReadInt(b)
+		case "SourceAddr":
+			x.SourceAddr, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the RegisterRequest to b
+func (x *RegisterRequest) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 11)
+	b = msgpackAppendString(b, "Datacenter")
+	b = msgpackAppendString(b, x.Datacenter)
+	b = msgpackAppendString(b, "Node")
+	b = msgpackAppendString(b, x.Node)
+	b = msgpackAppendString(b, "Address")
+	b = msgpackAppendString(b, x.Address)
+	b = msgpackAppendString(b, "NodeMeta")
+	b = msgpackAppendStringMap(b, x.NodeMeta)
+	b = msgpackAppendString(b, "Service")
+	if x.Service == nil {
+		b = msgpackAppendNil(b)
+	} else {
+		b = x.Service.MarshalMsgpack(b)
+	}
+	b = msgpackAppendString(b, "Check")
+	if x.Check == nil {
+		b = msgpackAppendNil(b)
+	} else {
+		b = x.Check.MarshalMsgpack(b)
+	}
+	b = msgpackAppendString(b, "Checks")
+	if x.Checks == nil {
+		b = msgpackAppendNil(b)
+	} else {
+		b = msgpackAppendArrayHeader(b, len(x.Checks))
+		for j := range x.Checks {
+			if x.Checks[j] == nil {
+				b = msgpackAppendNil(b)
+			} else {
+				b = x.Checks[j].MarshalMsgpack(b)
+			}
+		}
+	}
+	b = msgpackAppendString(b, "CAS")
+	b = msgpackAppendBool(b, x.CAS)
+	b = msgpackAppendString(b, "ModifyIndex")
+	b = msgpackAppendUint(b, x.ModifyIndex)
+	b = msgpackAppendString(b, "Audit")
+	b = x.Audit.MarshalMsgpack(b)
+	b = msgpackAppendString(b, "Token")
+	b = msgpackAppendString(b, x.WriteRequest.Token)
+	return b
+}
+
+// UnmarshalMsgpack decodes a RegisterRequest from the front of b
+func (x *RegisterRequest) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Datacenter":
+			x.Datacenter, b, err = msgpackReadString(b)
+		case "Node":
+			x.Node, b, err = msgpackReadString(b)
+		case "Address":
+			x.Address, b, err = msgpackReadString(b)
+		case "NodeMeta":
+			x.NodeMeta, b, err = msgpackReadStringMap(b)
+		case "Service":
+			if isNil, rest := msgpackIsNil(b); isNil {
+				x.Service, b = nil, rest
+				break
+			}
+			x.Service = new(NodeService)
+			b, err = x.Service.UnmarshalMsgpack(b)
+		case "Check":
+			if isNil, rest := msgpackIsNil(b); isNil {
+				x.Check, b = nil, rest
+				break
+			}
+			x.Check = new(HealthCheck)
+			b, err = x.Check.UnmarshalMsgpack(b)
+		case "Checks":
+			if isNil, rest := msgpackIsNil(b); isNil {
+				x.Checks, b = nil, rest
+				break
+			}
+			var count int
+			if count, b, err = msgpackReadArrayHeader(b); err != nil {
+				break
+			}
+			x.Checks = make(HealthChecks, count)
+			for j := range x.Checks {
+				if isNil, rest := msgpackIsNil(b); isNil {
+					b = rest
+					continue
+				}
+				x.Checks[j] = new(HealthCheck)
+				if b, err = x.Checks[j].UnmarshalMsgpack(b); err != nil {
+					break
+				}
+			}
+		case "CAS":
+			x.CAS, b, err = msgpackReadBool(b)
+		case "ModifyIndex":
+			x.ModifyIndex, b, err = msgpackReadUint(b)
+		case "Audit":
+			b, err = x.Audit.UnmarshalMsgpack(b)
+		case "Token":
+			x.WriteRequest.Token, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the DeregisterRequest to b
+func (x *DeregisterRequest) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 8)
+	b = msgpackAppendString(b, "Datacenter")
+	b = msgpackAppendString(b, x.Datacenter)
+	b = msgpackAppendString(b, "Node")
+	b = msgpackAppendString(b, x.Node)
+	b = msgpackAppendString(b, "ServiceID")
+	b = msgpackAppendString(b, x.ServiceID)
+	b = msgpackAppendString(b, "CheckID")
+	b = msgpackAppendString(b, x.CheckID)
+	b = msgpackAppendString(b, "CAS")
+	b = msgpackAppendBool(b, x.CAS)
+	b = msgpackAppendString(b, "ModifyIndex")
+	b = msgpackAppendUint(b, x.ModifyIndex)
+	b = msgpackAppendString(b, "Audit")
+	b = x.Audit.MarshalMsgpack(b)
+	b = msgpackAppendString(b, "Token")
+	b = msgpackAppendString(b, x.WriteRequest.Token)
+	return b
+}
+
+// UnmarshalMsgpack decodes a DeregisterRequest from the front of b
+func (x *DeregisterRequest) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Datacenter":
+			x.Datacenter, b, err = msgpackReadString(b)
+		case "Node":
+			x.Node, b, err = msgpackReadString(b)
+		case "ServiceID":
+			x.ServiceID, b, err = msgpackReadString(b)
+		case "CheckID":
+			x.CheckID, b, err = msgpackReadString(b)
+		case "CAS":
+			x.CAS, b, err = msgpackReadBool(b)
+		case "ModifyIndex":
+			x.ModifyIndex, b, err = msgpackReadUint(b)
+		case "Audit":
+			b, err = x.Audit.UnmarshalMsgpack(b)
+		case "Token":
+			x.WriteRequest.Token, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the DCSpecificRequest to b
+func (x *DCSpecificRequest) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 12)
+	b = msgpackAppendString(b, "Datacenter")
+	b = msgpackAppendString(b, x.Datacenter)
+	b = msgpackAppendString(b, "Token")
+	b = msgpackAppendString(b, x.QueryOptions.Token)
+	b = msgpackAppendString(b, "MinQueryIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MinQueryIndex)
+	b = msgpackAppendString(b, "MaxQueryTime")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.MaxQueryTime))
+	b = msgpackAppendString(b, "AllowStale")
+	b = msgpackAppendBool(b, x.QueryOptions.AllowStale)
+	b = msgpackAppendString(b, "RequireConsistent")
+	b = msgpackAppendBool(b, x.QueryOptions.RequireConsistent)
+	b = msgpackAppendString(b, "MinAppliedIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MinAppliedIndex)
+	b = msgpackAppendString(b, "MaxStaleDuration")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.MaxStaleDuration))
+	b = msgpackAppendString(b, "MaxStaleIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MaxStaleIndex)
+	b = msgpackAppendString(b, "SortBy")
+	b = msgpackAppendString(b, x.QueryOptions.SortBy)
+	b = msgpackAppendString(b, "Limit")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.Limit))
+	b = msgpackAppendString(b, "NextToken")
+	b = msgpackAppendString(b, x.QueryOptions.NextToken)
+	return b
+}
+
+// UnmarshalMsgpack decodes a DCSpecificRequest from the front of b
+func (x *DCSpecificRequest) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Datacenter":
+			x.Datacenter, b, err = msgpackReadString(b)
+		case "Token":
+			x.QueryOptions.Token, b, err = msgpackReadString(b)
+		case "MinQueryIndex":
+			x.QueryOptions.MinQueryIndex, b, err = msgpackReadUint(b)
+		case "MaxQueryTime":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.MaxQueryTime = time.Duration(v)
+		case "AllowStale":
+			x.QueryOptions.AllowStale, b, err = msgpackReadBool(b)
+		case "RequireConsistent":
+			x.QueryOptions.RequireConsistent, b, err = msgpackReadBool(b)
+		case "MinAppliedIndex":
+			x.QueryOptions.MinAppliedIndex, b, err = msgpackReadUint(b)
+		case "MaxStaleDuration":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.MaxStaleDuration = time.Duration(v)
+		case "MaxStaleIndex":
+			x.QueryOptions.MaxStaleIndex, b, err = msgpackReadUint(b)
+		case "SortBy":
+			x.QueryOptions.SortBy, b, err = msgpackReadString(b)
+		case "Limit":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.Limit = int(v)
+		case "NextToken":
+			x.QueryOptions.NextToken, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the ServiceSpecificRequest to b
+func (x *ServiceSpecificRequest) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 18)
+	b = msgpackAppendString(b, "Datacenter")
+	b = msgpackAppendString(b, x.Datacenter)
+	b = msgpackAppendString(b, "ServiceName")
+	b = msgpackAppendString(b, x.ServiceName)
+	b = msgpackAppendString(b, "ServiceTag")
+	b = msgpackAppendString(b, x.ServiceTag)
+	b = msgpackAppendString(b, "TagFilter")
+	b = msgpackAppendBool(b, x.TagFilter)
+	b = msgpackAppendString(b, "NodeMetaFilters")
+	b = msgpackAppendStringMap(b, x.NodeMetaFilters)
+	b = msgpackAppendString(b, "Connect")
+	b = msgpackAppendBool(b, x.Connect)
+	b = msgpackAppendString(b, "PeerName")
+	b = msgpackAppendString(b, x.PeerName)
+	b = msgpackAppendString(b, "Token")
+	b = msgpackAppendString(b, x.QueryOptions.Token)
+	b = msgpackAppendString(b, "MinQueryIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MinQueryIndex)
+	b = msgpackAppendString(b, "MaxQueryTime")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.MaxQueryTime))
+	b = msgpackAppendString(b, "AllowStale")
+	b = msgpackAppendBool(b, x.QueryOptions.AllowStale)
+	b = msgpackAppendString(b, "RequireConsistent")
+	b = msgpackAppendBool(b, x.QueryOptions.RequireConsistent)
+	b = msgpackAppendString(b, "MinAppliedIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MinAppliedIndex)
+	b = msgpackAppendString(b, "MaxStaleDuration")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.MaxStaleDuration))
+	b = msgpackAppendString(b, "MaxStaleIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MaxStaleIndex)
+	b = msgpackAppendString(b, "SortBy")
+	b = msgpackAppendString(b, x.QueryOptions.SortBy)
+	b = msgpackAppendString(b, "Limit")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.Limit))
+	b = msgpackAppendString(b, "NextToken")
+	b = msgpackAppendString(b, x.QueryOptions.NextToken)
+	return b
+}
+
+// UnmarshalMsgpack decodes a ServiceSpecificRequest from the front of b
+func (x *ServiceSpecificRequest) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Datacenter":
+			x.Datacenter, b, err = msgpackReadString(b)
+		case "ServiceName":
+			x.ServiceName, b, err = msgpackReadString(b)
+		case "ServiceTag":
+			x.ServiceTag, b, err = msgpackReadString(b)
+		case "TagFilter":
+			x.TagFilter, b, err = msgpackReadBool(b)
+		case "NodeMetaFilters":
+			x.NodeMetaFilters, b, err = msgpackReadStringMap(b)
+		case "Connect":
+			x.Connect, b, err = msgpackReadBool(b)
+		case "PeerName":
+			x.PeerName, b, err = msgpackReadString(b)
+		case "Token":
+			x.QueryOptions.Token, b, err = msgpackReadString(b)
+		case "MinQueryIndex":
+			x.QueryOptions.MinQueryIndex, b, err = msgpackReadUint(b)
+		case "MaxQueryTime":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.MaxQueryTime = time.Duration(v)
+		case "AllowStale":
+			x.QueryOptions.AllowStale, b, err = msgpackReadBool(b)
+		case "RequireConsistent":
+			x.QueryOptions.RequireConsistent, b, err = msgpackReadBool(b)
+		case "MinAppliedIndex":
+			x.QueryOptions.MinAppliedIndex, b, err = msgpackReadUint(b)
+		case "MaxStaleDuration":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.MaxStaleDuration = time.Duration(v)
+		case "MaxStaleIndex":
+			x.QueryOptions.MaxStaleIndex, b, err = msgpackReadUint(b)
+		case "SortBy":
+			x.QueryOptions.SortBy, b, err = msgpackReadString(b)
+		case "Limit":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.Limit = int(v)
+		case "NextToken":
+			x.QueryOptions.NextToken, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the NodeSpecificRequest to b
+func (x *NodeSpecificRequest) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 13)
+	b = msgpackAppendString(b, "Datacenter")
+	b = msgpackAppendString(b, x.Datacenter)
+	b = msgpackAppendString(b, "Node")
+	b = msgpackAppendString(b, x.Node)
+	b = msgpackAppendString(b, "Token")
+	b = msgpackAppendString(b, x.QueryOptions.Token)
+	b = msgpackAppendString(b, "MinQueryIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MinQueryIndex)
+	b = msgpackAppendString(b, "MaxQueryTime")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.MaxQueryTime))
+	b = msgpackAppendString(b, "AllowStale")
+	b = msgpackAppendBool(b, x.QueryOptions.AllowStale)
+	b = msgpackAppendString(b, "RequireConsistent")
+	b = msgpackAppendBool(b, x.QueryOptions.RequireConsistent)
+	b = msgpackAppendString(b, "MinAppliedIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MinAppliedIndex)
+	b = msgpackAppendString(b, "MaxStaleDuration")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.MaxStaleDuration))
+	b = msgpackAppendString(b, "MaxStaleIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MaxStaleIndex)
+	b = msgpackAppendString(b, "SortBy")
+	b = msgpackAppendString(b, x.QueryOptions.SortBy)
+	b = msgpackAppendString(b, "Limit")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.Limit))
+	b = msgpackAppendString(b, "NextToken")
+	b = msgpackAppendString(b, x.QueryOptions.NextToken)
+	return b
+}
+
+// UnmarshalMsgpack decodes a NodeSpecificRequest from the front of b
+func (x *NodeSpecificRequest) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Datacenter":
+			x.Datacenter, b, err = msgpackReadString(b)
+		case "Node":
+			x.Node, b, err = msgpackReadString(b)
+		case "Token":
+			x.QueryOptions.Token, b, err = msgpackReadString(b)
+		case "MinQueryIndex":
+			x.QueryOptions.MinQueryIndex, b, err = msgpackReadUint(b)
+		case "MaxQueryTime":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.MaxQueryTime = time.Duration(v)
+		case "AllowStale":
+			x.QueryOptions.AllowStale, b, err = msgpackReadBool(b)
+		case "RequireConsistent":
+			x.QueryOptions.RequireConsistent, b, err = msgpackReadBool(b)
+		case "MinAppliedIndex":
+			x.QueryOptions.MinAppliedIndex, b, err = msgpackReadUint(b)
+		case "MaxStaleDuration":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.MaxStaleDuration = time.Duration(v)
+		case "MaxStaleIndex":
+			x.QueryOptions.MaxStaleIndex, b, err = msgpackReadUint(b)
+		case "SortBy":
+			x.QueryOptions.SortBy, b, err = msgpackReadString(b)
+		case "Limit":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.Limit = int(v)
+		case "NextToken":
+			x.QueryOptions.NextToken, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the IndexedNodes to b
+func (x *IndexedNodes) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 6)
+	b = msgpackAppendString(b, "Nodes")
+	if x.Nodes == nil {
+		b = msgpackAppendNil(b)
+	} else {
+		b = msgpackAppendArrayHeader(b, len(x.Nodes))
+		for j := range x.Nodes {
+			b = x.Nodes[j].MarshalMsgpack(b)
+		}
+	}
+	b = msgpackAppendString(b, "Index")
+	b = msgpackAppendUint(b, x.QueryMeta.Index)
+	b = msgpackAppendString(b, "LastContact")
+	b = msgpackAppendInt(b, int64(x.QueryMeta.LastContact))
+	b = msgpackAppendString(b, "KnownLeader")
+	b = msgpackAppendBool(b, x.QueryMeta.KnownLeader)
+	b = msgpackAppendString(b, "IndexLag")
+	b = msgpackAppendUint(b, x.QueryMeta.IndexLag)
+	b = msgpackAppendString(b, "NextToken")
+	b = msgpackAppendString(b, x.QueryMeta.NextToken)
+	return b
+}
+
+// UnmarshalMsgpack decodes a IndexedNodes from the front of b
+func (x *IndexedNodes) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Nodes":
+			if isNil, rest := msgpackIsNil(b); isNil {
+				x.Nodes, b = nil, rest
+				break
+			}
+			var count int
+			if count, b, err = msgpackReadArrayHeader(b); err != nil {
+				break
+			}
+			x.Nodes = make(Nodes, count)
+			for j := range x.Nodes {
+				if b, err = x.Nodes[j].UnmarshalMsgpack(b); err != nil {
+					break
+				}
+			}
+		case "Index":
+			x.QueryMeta.Index, b, err = msgpackReadUint(b)
+		case "LastContact":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryMeta.LastContact = time.Duration(v)
+		case "KnownLeader":
+			x.QueryMeta.KnownLeader, b, err = msgpackReadBool(b)
+		case "IndexLag":
+			x.QueryMeta.IndexLag, b, err = msgpackReadUint(b)
+		case "NextToken":
+			x.QueryMeta.NextToken, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the IndexedServiceNodes to b
+func (x *IndexedServiceNodes) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 6)
+	b = msgpackAppendString(b, "ServiceNodes")
+	if x.ServiceNodes == nil {
+		b = msgpackAppendNil(b)
+	} else {
+		b = msgpackAppendArrayHeader(b, len(x.ServiceNodes))
+		for j := range x.ServiceNodes {
+			b = x.ServiceNodes[j].MarshalMsgpack(b)
+		}
+	}
+	b = msgpackAppendString(b, "Index")
+	b = msgpackAppendUint(b, x.QueryMeta.Index)
+	b = msgpackAppendString(b, "LastContact")
+	b = msgpackAppendInt(b, int64(x.QueryMeta.LastContact))
+	b = msgpackAppendString(b, "KnownLeader")
+	b = msgpackAppendBool(b, x.QueryMeta.KnownLeader)
+	b = msgpackAppendString(b, "IndexLag")
+	b = msgpackAppendUint(b, x.QueryMeta.IndexLag)
+	b = msgpackAppendString(b, "NextToken")
+	b = msgpackAppendString(b, x.QueryMeta.NextToken)
+	return b
+}
+
+// UnmarshalMsgpack decodes a IndexedServiceNodes from the front of b
+func (x *IndexedServiceNodes) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "ServiceNodes":
+			if isNil, rest := msgpackIsNil(b); isNil {
+				x.ServiceNodes, b = nil, rest
+				break
+			}
+			var count int
+			if count, b, err = msgpackReadArrayHeader(b); err != nil {
+				break
+			}
+			x.ServiceNodes = make(ServiceNodes, count)
+			for j := range x.ServiceNodes {
+				if b, err = x.ServiceNodes[j].UnmarshalMsgpack(b); err != nil {
+					break
+				}
+			}
+		case "Index":
+			x.QueryMeta.Index, b, err = msgpackReadUint(b)
+		case "LastContact":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryMeta.LastContact = time.Duration(v)
+		case "KnownLeader":
+			x.QueryMeta.KnownLeader, b, err = msgpackReadBool(b)
+		case "IndexLag":
+			x.QueryMeta.IndexLag, b, err = msgpackReadUint(b)
+		case "NextToken":
+			x.QueryMeta.NextToken, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the IndexedHealthChecks to b
+func (x *IndexedHealthChecks) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 6)
+	b = msgpackAppendString(b, "HealthChecks")
+	if x.HealthChecks == nil {
+		b = msgpackAppendNil(b)
+	} else {
+		b = msgpackAppendArrayHeader(b, len(x.HealthChecks))
+		for j := range x.HealthChecks {
+			if x.HealthChecks[j] == nil {
+				b = msgpackAppendNil(b)
+			} else {
+				b = x.HealthChecks[j].MarshalMsgpack(b)
+			}
+		}
+	}
+	b = msgpackAppendString(b, "Index")
+	b = msgpackAppendUint(b, x.QueryMeta.Index)
+	b = msgpackAppendString(b, "LastContact")
+	b = msgpackAppendInt(b, int64(x.QueryMeta.LastContact))
+	b = msgpackAppendString(b, "KnownLeader")
+	b = msgpackAppendBool(b, x.QueryMeta.KnownLeader)
+	b = msgpackAppendString(b, "IndexLag")
+	b = msgpackAppendUint(b, x.QueryMeta.IndexLag)
+	b = msgpackAppendString(b, "NextToken")
+	b = msgpackAppendString(b, x.QueryMeta.NextToken)
+	return b
+}
+
+// UnmarshalMsgpack decodes a IndexedHealthChecks from the front of b
+func (x *IndexedHealthChecks) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "HealthChecks":
+			if isNil, rest := msgpackIsNil(b); isNil {
+				x.HealthChecks, b = nil, rest
+				break
+			}
+			var count int
+			if count, b, err = msgpackReadArrayHeader(b); err != nil {
+				break
+			}
+			x.HealthChecks = make(HealthChecks, count)
+			for j := range x.HealthChecks {
+				if isNil, rest := msgpackIsNil(b); isNil {
+					b = rest
+					continue
+				}
+				x.HealthChecks[j] = new(HealthCheck)
+				if b, err = x.HealthChecks[j].UnmarshalMsgpack(b); err != nil {
+					break
+				}
+			}
+		case "Index":
+			x.QueryMeta.Index, b, err = msgpackReadUint(b)
+		case "LastContact":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryMeta.LastContact = time.Duration(v)
+		case "KnownLeader":
+			x.QueryMeta.KnownLeader, b, err = msgpackReadBool(b)
+		case "IndexLag":
+			x.QueryMeta.IndexLag, b, err = msgpackReadUint(b)
+		case "NextToken":
+			x.QueryMeta.NextToken, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the KVSRequest to b
+func (x *KVSRequest) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 4)
+	b = msgpackAppendString(b, "Datacenter")
+	b = msgpackAppendString(b, x.Datacenter)
+	b = msgpackAppendString(b, "Op")
+	b = msgpackAppendString(b, string(x.Op))
+	b = msgpackAppendString(b, "DirEnt")
+	b = x.DirEnt.MarshalMsgpack(b)
+	b = msgpackAppendString(b, "Token")
+	b = msgpackAppendString(b, x.WriteRequest.Token)
+	return b
+}
+
+// UnmarshalMsgpack decodes a KVSRequest from the front of b
+func (x *KVSRequest) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Datacenter":
+			x.Datacenter, b, err = msgpackReadString(b)
+		case "Op":
+			var v string
+			v, b, err = msgpackReadString(b)
+			x.Op = KVSOp(v)
+		case "DirEnt":
+			b, err = x.DirEnt.UnmarshalMsgpack(b)
+		case "Token":
+			x.WriteRequest.Token, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the KeyRequest to b
+func (x *KeyRequest) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 14)
+	b = msgpackAppendString(b, "Datacenter")
+	b = msgpackAppendString(b, x.Datacenter)
+	b = msgpackAppendString(b, "Key")
+	b = msgpackAppendString(b, x.Key)
+	b = msgpackAppendString(b, "Glob")
+	b = msgpackAppendBool(b, x.Glob)
+	b = msgpackAppendString(b, "Token")
+	b = msgpackAppendString(b, x.QueryOptions.Token)
+	b = msgpackAppendString(b, "MinQueryIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MinQueryIndex)
+	b = msgpackAppendString(b, "MaxQueryTime")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.MaxQueryTime))
+	b = msgpackAppendString(b, "AllowStale")
+	b = msgpackAppendBool(b, x.QueryOptions.AllowStale)
+	b = msgpackAppendString(b, "RequireConsistent")
+	b = msgpackAppendBool(b, x.QueryOptions.RequireConsistent)
+	b = msgpackAppendString(b, "MinAppliedIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MinAppliedIndex)
+	b = msgpackAppendString(b, "MaxStaleDuration")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.MaxStaleDuration))
+	b = msgpackAppendString(b, "MaxStaleIndex")
+	b = msgpackAppendUint(b, x.QueryOptions.MaxStaleIndex)
+	b = msgpackAppendString(b, "SortBy")
+	b = msgpackAppendString(b, x.QueryOptions.SortBy)
+	b = msgpackAppendString(b, "Limit")
+	b = msgpackAppendInt(b, int64(x.QueryOptions.Limit))
+	b = msgpackAppendString(b, "NextToken")
+	b = msgpackAppendString(b, x.QueryOptions.NextToken)
+	return b
+}
+
+// UnmarshalMsgpack decodes a KeyRequest from the front of b
+func (x *KeyRequest) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Datacenter":
+			x.Datacenter, b, err = msgpackReadString(b)
+		case "Key":
+			x.Key, b, err = msgpackReadString(b)
+		case "Glob":
+			x.Glob, b, err = msgpackReadBool(b)
+		case "Token":
+			x.QueryOptions.Token, b, err = msgpackReadString(b)
+		case "MinQueryIndex":
+			x.QueryOptions.MinQueryIndex, b, err = msgpackReadUint(b)
+		case "MaxQueryTime":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.MaxQueryTime = time.Duration(v)
+		case "AllowStale":
+			x.QueryOptions.AllowStale, b, err = msgpackReadBool(b)
+		case "RequireConsistent":
+			x.QueryOptions.RequireConsistent, b, err = msgpackReadBool(b)
+		case "MinAppliedIndex":
+			x.QueryOptions.MinAppliedIndex, b, err = msgpackReadUint(b)
+		case "MaxStaleDuration":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.MaxStaleDuration = time.Duration(v)
+		case "MaxStaleIndex":
+			x.QueryOptions.MaxStaleIndex, b, err = msgpackReadUint(b)
+		case "SortBy":
+			x.QueryOptions.SortBy, b, err = msgpackReadString(b)
+		case "Limit":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryOptions.Limit = int(v)
+		case "NextToken":
+			x.QueryOptions.NextToken, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// MarshalMsgpack appends the msgpack encoding of the IndexedDirEntries to b
+func (x *IndexedDirEntries) MarshalMsgpack(b []byte) []byte {
+	b = msgpackAppendMapHeader(b, 6)
+	b = msgpackAppendString(b, "Entries")
+	if x.Entries == nil {
+		b = msgpackAppendNil(b)
+	} else {
+		b = msgpackAppendArrayHeader(b, len(x.Entries))
+		for j := range x.Entries {
+			if x.Entries[j] == nil {
+				b = msgpackAppendNil(b)
+			} else {
+				b = x.Entries[j].MarshalMsgpack(b)
+			}
+		}
+	}
+	b = msgpackAppendString(b, "Index")
+	b = msgpackAppendUint(b, x.QueryMeta.Index)
+	b = msgpackAppendString(b, "LastContact")
+	b = msgpackAppendInt(b, int64(x.QueryMeta.LastContact))
+	b = msgpackAppendString(b, "KnownLeader")
+	b = msgpackAppendBool(b, x.QueryMeta.KnownLeader)
+	b = msgpackAppendString(b, "IndexLag")
+	b = msgpackAppendUint(b, x.QueryMeta.IndexLag)
+	b = msgpackAppendString(b, "NextToken")
+	b = msgpackAppendString(b, x.QueryMeta.NextToken)
+	return b
+}
+
+// UnmarshalMsgpack decodes a IndexedDirEntries from the front of b
+func (x *IndexedDirEntries) UnmarshalMsgpack(b []byte) ([]byte, error) {
+	n, b, err := msgpackReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key []byte
+		if key, b, err = msgpackReadRaw(b); err != nil {
+			return b, err
+		}
+		switch string(key) {
+		case "Entries":
+			if isNil, rest := msgpackIsNil(b); isNil {
+				x.Entries, b = nil, rest
+				break
+			}
+			var count int
+			if count, b, err = msgpackReadArrayHeader(b); err != nil {
+				break
+			}
+			x.Entries = make(DirEntries, count)
+			for j := range x.Entries {
+				if isNil, rest := msgpackIsNil(b); isNil {
+					b = rest
+					continue
+				}
+				x.Entries[j] = new(DirEntry)
+				if b, err = x.Entries[j].UnmarshalMsgpack(b); err != nil {
+					break
+				}
+			}
+		case "Index":
+			x.QueryMeta.Index, b, err = msgpackReadUint(b)
+		case "LastContact":
+			var v int64
+			v, b, err = msgpackReadInt(b)
+			x.QueryMeta.LastContact = time.Duration(v)
+		case "KnownLeader":
+			x.QueryMeta.KnownLeader, b, err = msgpackReadBool(b)
+		case "IndexLag":
+			x.QueryMeta.IndexLag, b, err = msgpackReadUint(b)
+		case "NextToken":
+			x.QueryMeta.NextToken, b, err = msgpackReadString(b)
+		default:
+			b, err = msgpackSkip(b)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
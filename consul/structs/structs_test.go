@@ -50,6 +50,105 @@ func TestStructs_Implements(t *testing.T) {
 		_ RPCInfo          = &EventFireRequest{}
 		_ RPCInfo          = &ACLPolicyRequest{}
 		_ RPCInfo          = &KeyringRequest{}
+		_ RPCInfo          = &AddressSpecificRequest{}
 		_ CompoundResponse = &KeyringResponses{}
 	)
 }
+
+func TestNodeService_Weight(t *testing.T) {
+	s := &NodeService{}
+	if w := s.Weight(HealthPassing); w != DefaultServiceWeight {
+		t.Fatalf("bad: %d", w)
+	}
+	s.WeightPassing = 10
+	s.WeightWarning = 2
+	if w := s.Weight(HealthPassing); w != 10 {
+		t.Fatalf("bad: %d", w)
+	}
+	if w := s.Weight(HealthWarning); w != 2 {
+		t.Fatalf("bad: %d", w)
+	}
+}
+
+func TestNodeService_Validate(t *testing.T) {
+	proxy := func() *NodeService {
+		return &NodeService{
+			Service: "web-proxy",
+			Port:    21000,
+			Kind:    ServiceKindConnectProxy,
+			Proxy: ConnectProxyConfig{
+				DestinationServiceName: "web",
+				Upstreams:              []Upstream{{DestinationName: "db", LocalBindPort: 9191}},
+			},
+		}
+	}
+	if err := proxy().Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := (&NodeService{Service: "web"}).Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	gateway := &NodeService{
+		Service:    "mesh-gateway",
+		Port:       8443,
+		Kind:       ServiceKindMeshGateway,
+		WANAddress: "198.51.100.1",
+		WANPort:    443,
+	}
+	if err := gateway.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	bad := []func(s *NodeService){
+		func(s *NodeService) { s.Kind = "sidecar" },
+		func(s *NodeService) { s.Kind = ServiceKindTypical },
+		func(s *NodeService) { s.Proxy.DestinationServiceName = "" },
+		func(s *NodeService) { s.Port = 0 },
+		func(s *NodeService) { s.Proxy.Upstreams[0].DestinationName = "" },
+		func(s *NodeService) { s.Proxy.Upstreams[0].LocalBindPort = 0 },
+		func(s *NodeService) { s.WANAddress = "198.51.100.1" },
+		func(s *NodeService) {
+			s.Kind = ServiceKindMeshGateway
+			s.Proxy = ConnectProxyConfig{}
+			s.Port = 0
+		},
+		func(s *NodeService) {
+			s.Kind = ServiceKindMeshGateway
+			s.Proxy = ConnectProxyConfig{}
+			s.WANPort = -1
+		},
+	}
+	for i, mutate := range bad {
+		s := proxy()
+		mutate(s)
+		if err := s.Validate(); err == nil {
+			t.Fatalf("%d: should fail", i)
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	cases := map[string]string{
+		"":               "",
+		"127.0.0.1":      "127.0.0.1",
+		"::1":            "::1",
+		"[::1]":          "::1",
+		"[2001:db8::1]":  "2001:db8::1",
+		"www.google.com": "www.google.com",
+	}
+	for addr, expect := range cases {
+		out, err := NormalizeAddress(addr)
+		if err != nil {
+			t.Fatalf("%s: err: %v", addr, err)
+		}
+		if out != expect {
+			t.Fatalf("%s: bad: %s", addr, out)
+		}
+	}
+
+	for _, addr := range []string{"[127.0.0.1]", "[foo]", "[::1", "::1]", "[[::1]]"} {
+		if _, err := NormalizeAddress(addr); err == nil {
+			t.Fatalf("%s: should fail", addr)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// TxnRW applies the operations of a transaction atomically. If any
+// operation fails, none is applied, and the errors of every failed
+// operation are returned instead of the results.
+func (s *StateStore) TxnRW(index uint64, ops structs.TxnOps) (structs.TxnResults, structs.TxnErrors) {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return nil, structs.TxnErrors{{What: err.Error()}}
+	}
+	defer tx.Abort()
+
+	results := make(structs.TxnResults, 0, len(ops))
+	var errs structs.TxnErrors
+	for i, op := range ops {
+		var result *structs.TxnResult
+		var err error
+		switch {
+		case op.KV != nil:
+			result, err = s.txnKVS(index, tx, op.KV)
+		case op.Node != nil:
+			result, err = s.txnNode(index, tx, op.Node)
+		case op.Service != nil:
+			result, err = s.txnService(index, tx, op.Service)
+		case op.Check != nil:
+			result, err = s.txnCheck(index, tx, op.Check)
+		default:
+			err = fmt.Errorf("Operation has no KV, Node, Service or Check")
+		}
+		if err != nil {
+			errs = append(errs, &structs.TxnError{OpIndex: i, What: err.Error()})
+			continue
+		}
+		results = append(results, result)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, structs.TxnErrors{{What: err.Error()}}
+	}
+	return results, nil
+}
+
+// txnKVS applies a Key-Value operation of a transaction
+func (s *StateStore) txnKVS(index uint64, tx *MDBTxn, op *structs.TxnKVOp) (*structs.TxnResult, error) {
+	key := op.DirEnt.Key
+	var entry *structs.DirEntry
+	switch op.Verb {
+	case structs.KVSSet:
+		entry = &op.DirEnt
+		if _, err := s.kvsSetTxn(index, tx, entry, kvSet); err != nil {
+			return nil, err
+		}
+
+	case structs.KVSCAS:
+		entry = &op.DirEnt
+		if ok, err := s.kvsSetTxn(index, tx, entry, kvCAS); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("Failed to set key '%s', index is stale", key)
+		}
+
+	case structs.KVSLock:
+		entry = &op.DirEnt
+		if ok, err := s.kvsSetTxn(index, tx, entry, kvLock); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("Failed to lock key '%s', lock is already held or delayed", key)
+		}
+
+	case structs.KVSUnlock:
+		entry = &op.DirEnt
+		if ok, err := s.kvsSetTxn(index, tx, entry, kvUnlock); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("Failed to unlock key '%s', lock isn't held by the session", key)
+		}
+
+	case structs.KVSDelete:
+		if err := s.kvsDeleteWithIndexTxn(index, tx, "id", key); err != nil {
+			return nil, err
+		}
+
+	case structs.KVSDeleteCAS:
+		if ok, err := s.kvsDeleteCASTxn(index, tx, key, op.DirEnt.ModifyIndex); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("Failed to delete key '%s', index is stale", key)
+		}
+
+	case structs.KVSDeleteTree:
+		var err error
+		if key == "" {
+			err = s.kvsDeleteWithIndexTxn(index, tx, "id")
+		} else {
+			err = s.kvsDeleteWithIndexTxn(index, tx, "id_prefix", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	case structs.TxnGet, structs.TxnCheckIndex, structs.TxnCheckSession:
+		res, err := s.kvsTable.GetTxn(tx, "id", key)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) == 0 {
+			return nil, fmt.Errorf("Key '%s' doesn't exist", key)
+		}
+		entry = res[0].(*structs.DirEntry)
+		if op.Verb == structs.TxnCheckIndex && entry.ModifyIndex != op.DirEnt.ModifyIndex {
+			return nil, fmt.Errorf("Key '%s' has a modify index of %d, not %d",
+				key, entry.ModifyIndex, op.DirEnt.ModifyIndex)
+		}
+		if op.Verb == structs.TxnCheckSession && entry.Session != op.DirEnt.Session {
+			return nil, fmt.Errorf("Key '%s' isn't locked by session '%s'", key, op.DirEnt.Session)
+		}
+
+	default:
+		return nil, fmt.Errorf("Unknown KV verb '%s'", op.Verb)
+	}
+
+	// Only a get returns the value
+	if entry != nil && op.Verb != structs.TxnGet {
+		clone := *entry
+		clone.Value = nil
+		entry = &clone
+	}
+	return &structs.TxnResult{KV: entry}, nil
+}
+
+// txnNode applies a node operation of a transaction
+func (s *StateStore) txnNode(index uint64, tx *MDBTxn, op *structs.TxnNodeOp) (*structs.TxnResult, error) {
+	switch op.Verb {
+	case structs.TxnSet:
+		if err := s.ensureNodeTxn(index, op.Node, tx); err != nil {
+			return nil, err
+		}
+	case structs.TxnDelete:
+		if err := s.deleteNodeTxn(index, tx, op.Node.Node); err != nil {
+			return nil, err
+		}
+		return &structs.TxnResult{}, nil
+	case structs.TxnGet:
+	default:
+		return nil, fmt.Errorf("Unknown node verb '%s'", op.Verb)
+	}
+
+	res, err := s.nodeTable.GetTxn(tx, "id", op.Node.Node)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("Node '%s' doesn't exist", op.Node.Node)
+	}
+	return &structs.TxnResult{Node: res[0].(*structs.Node)}, nil
+}
+
+// txnService applies a service operation of a transaction
+func (s *StateStore) txnService(index uint64, tx *MDBTxn, op *structs.TxnServiceOp) (*structs.TxnResult, error) {
+	switch op.Verb {
+	case structs.TxnSet:
+		if err := s.ensureServiceTxn(index, op.Node, &op.Service, tx); err != nil {
+			return nil, err
+		}
+	case structs.TxnDelete:
+		if err := s.deleteNodeServiceTxn(index, tx, op.Node, op.Service.ID); err != nil {
+			return nil, err
+		}
+		return &structs.TxnResult{}, nil
+	case structs.TxnGet:
+	default:
+		return nil, fmt.Errorf("Unknown service verb '%s'", op.Verb)
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "id", op.Node, op.Service.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("Service '%s' of node '%s' doesn't exist", op.Service.ID, op.Node)
+	}
+	service := res[0].(*structs.ServiceNode)
+	return &structs.TxnResult{Service: &structs.NodeService{
+		ID:            service.ServiceID,
+		Service:       service.ServiceName,
+		Tags:          service.ServiceTags,
+		Address:       service.ServiceAddress,
+		Port:          service.ServicePort,
+		Meta:          service.ServiceMeta,
+		WeightPassing: service.ServiceWeightPassing,
+		WeightWarning: service.ServiceWeightWarning,
+		Kind:          service.ServiceKind,
+		Proxy:         service.ServiceProxy,
+		WANAddress:    service.ServiceWANAddress,
+		WANPort:       service.ServiceWANPort,
+	}}, nil
+}
+
+// txnCheck applies a health check operation of a transaction
+func (s *StateStore) txnCheck(index uint64, tx *MDBTxn, op *structs.TxnCheckOp) (*structs.TxnResult, error) {
+	check := &op.Check
+	switch op.Verb {
+	case structs.TxnSet:
+		if err := s.ensureCheckTxn(index, check, tx); err != nil {
+			return nil, err
+		}
+	case structs.TxnDelete:
+		if err := s.deleteNodeCheckTxn(index, tx, check.Node, check.CheckID); err != nil {
+			return nil, err
+		}
+		return &structs.TxnResult{}, nil
+	case structs.TxnGet:
+	default:
+		return nil, fmt.Errorf("Unknown check verb '%s'", op.Verb)
+	}
+
+	res, err := s.checkTable.GetTxn(tx, "id", check.Node, check.CheckID)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("Check '%s' of node '%s' doesn't exist", check.CheckID, check.Node)
+	}
+	return &structs.TxnResult{Check: res[0].(*structs.HealthCheck)}, nil
+}
@@ -0,0 +1,170 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// maxTxnOps bounds the operations of a transaction, which are applied
+// in a single Raft log entry
+const maxTxnOps = 64
+
+// Txn endpoint is used to apply operations to the KV store and the
+// catalog atomically
+type Txn struct {
+	srv *Server
+}
+
+// Apply is used to apply a transaction. Its operations are checked
+// first, and it is only applied if all of them are allowed. The errors
+// that prevent or roll back the transaction are returned in the reply.
+func (t *Txn) Apply(args *structs.TxnRequest, reply *structs.TxnResponse) error {
+	if done, err := t.srv.forward("Txn.Apply", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "txn", "apply"}, time.Now())
+
+	if len(args.Ops) > maxTxnOps {
+		return fmt.Errorf("Transaction has %d operations, more than the %d allowed",
+			len(args.Ops), maxTxnOps)
+	}
+
+	acl, err := t.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	for i, op := range args.Ops {
+		if err := t.checkOp(acl, op); err != nil {
+			reply.Errors = append(reply.Errors, &structs.TxnError{OpIndex: i, What: err.Error()})
+		}
+	}
+	if len(reply.Errors) > 0 {
+		return nil
+	}
+	for _, op := range args.Ops {
+		if op.Check != nil && op.Check.Verb == structs.TxnSet {
+			t.srv.truncateCheckOutput(&op.Check.Check)
+		}
+	}
+
+	resp, err := t.srv.raftApply(structs.TxnRequestType, args)
+	if err != nil {
+		t.srv.logger.Printf("[ERR] consul.txn: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	if txnResp, ok := resp.(structs.TxnResponse); ok {
+		*reply = txnResp
+	}
+
+	// Like for the catalog queries, the services and checks that can't
+	// be read are filtered from the results
+	if acl != nil {
+		for _, result := range reply.Results {
+			if result.Service != nil && !acl.ServiceRead(result.Service.Service) {
+				result.Service = nil
+			}
+			if result.Check != nil && result.Check.ServiceName != "" &&
+				!acl.ServiceRead(result.Check.ServiceName) {
+				result.Check = nil
+			}
+		}
+	}
+	return nil
+}
+
+// checkOp verifies an operation and applies the ACL policy, if any
+func (t *Txn) checkOp(acl acl.ACL, op *structs.TxnOp) error {
+	var err error
+	switch {
+	case op.KV != nil:
+		key := op.KV.DirEnt.Key
+		if key == "" && op.KV.Verb != structs.KVSDeleteTree {
+			return fmt.Errorf("Must provide key")
+		}
+		if acl != nil {
+			switch op.KV.Verb {
+			case structs.TxnGet, structs.TxnCheckIndex, structs.TxnCheckSession:
+				if !acl.KeyRead(key) {
+					return permissionDeniedErr
+				}
+			case structs.KVSDeleteTree:
+				if !acl.KeyWritePrefix(key) {
+					return permissionDeniedErr
+				}
+			default:
+				if !acl.KeyWrite(key) {
+					return permissionDeniedErr
+				}
+			}
+		}
+
+		// Like for the KVS endpoint, a lock-delay is checked with the
+		// wall-time of the leader
+		if op.KV.Verb == structs.KVSLock {
+			expires := t.srv.fsm.State().KVSLockDelay(key)
+			if expires.After(time.Now()) {
+				return fmt.Errorf("Key '%s' is in a lock-delay until %v", key, expires)
+			}
+		}
+
+	case op.Node != nil:
+		if op.Node.Node.Node == "" {
+			return fmt.Errorf("Must provide node")
+		}
+		if op.Node.Verb == structs.TxnSet {
+			if op.Node.Node.Address == "" {
+				return fmt.Errorf("Must provide address")
+			}
+			op.Node.Node.Address, err = structs.NormalizeAddress(op.Node.Node.Address)
+			if err != nil {
+				return err
+			}
+		}
+
+	case op.Service != nil:
+		service := &op.Service.Service
+		if op.Service.Node == "" {
+			return fmt.Errorf("Must provide node")
+		}
+		if service.ID == "" {
+			service.ID = service.Service
+		}
+		if service.ID == "" {
+			return fmt.Errorf("Must provide service ID or name")
+		}
+		if op.Service.Verb == structs.TxnSet {
+			if service.Service == "" {
+				return fmt.Errorf("Must provide service name with ID")
+			}
+			if service.WeightPassing < 0 || service.WeightWarning < 0 {
+				return fmt.Errorf("Service weights can't be negative")
+			}
+			if err := service.Validate(); err != nil {
+				return err
+			}
+			if service.Address, err = structs.NormalizeAddress(service.Address); err != nil {
+				return err
+			}
+			if acl != nil && !acl.ServiceWrite(service.Service) {
+				return permissionDeniedErr
+			}
+		}
+
+	case op.Check != nil:
+		check := &op.Check.Check
+		if check.CheckID == "" {
+			check.CheckID = check.Name
+		}
+		if check.Node == "" || check.CheckID == "" {
+			return fmt.Errorf("Must provide node and check ID or name")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+func TestTxn_Apply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			{KV: &structs.TxnKVOp{Verb: structs.KVSSet,
+				DirEnt: structs.DirEntry{Key: "test", Value: []byte("hello")}}},
+			{Node: &structs.TxnNodeOp{Verb: structs.TxnSet,
+				Node: structs.Node{Node: "foo", Address: "[::1]"}}},
+			{Service: &structs.TxnServiceOp{Verb: structs.TxnSet, Node: "foo",
+				Service: structs.NodeService{Service: "db"}}},
+		},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 0 || len(out.Results) != 3 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("test")
+	if err != nil || d == nil || string(d.Value) != "hello" {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+	_, found, addr := state.GetNode("foo")
+	if !found || addr != "::1" {
+		t.Fatalf("bad: %v %v", found, addr)
+	}
+	_, services := state.NodeServices("foo")
+	if services == nil || services.Services["db"] == nil {
+		t.Fatalf("bad: %v", services)
+	}
+
+	// Invalid operations are reported without applying anything
+	arg.Ops = structs.TxnOps{
+		{KV: &structs.TxnKVOp{Verb: structs.KVSDelete,
+			DirEnt: structs.DirEntry{Key: "test"}}},
+		{KV: &structs.TxnKVOp{Verb: structs.KVSSet}},
+	}
+	out = structs.TxnResponse{}
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 1 || out.Errors[0].OpIndex != 1 ||
+		!strings.Contains(out.Errors[0].What, "Must provide key") {
+		t.Fatalf("bad: %#v", out)
+	}
+	if _, d, _ := state.KVSGet("test"); d == nil {
+		t.Fatalf("should not delete")
+	}
+}
+
+func TestTxn_Apply_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	codec := rpcClient(t, s1)
+	defer codec.Close()
+
+	testutil.WaitForLeader(t, s1.RPC, "dc1")
+
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testListRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := msgpackrpc.CallWithCodec(codec, "ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	txn := structs.TxnRequest{
+		Datacenter: "dc1",
+		Ops: structs.TxnOps{
+			{KV: &structs.TxnKVOp{Verb: structs.KVSSet,
+				DirEnt: structs.DirEntry{Key: "test/ok"}}},
+			{KV: &structs.TxnKVOp{Verb: structs.KVSSet,
+				DirEnt: structs.DirEntry{Key: "foo/denied"}}},
+			{KV: &structs.TxnKVOp{Verb: structs.KVSDeleteTree,
+				DirEnt: structs.DirEntry{Key: "test"}}},
+		},
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	var out structs.TxnResponse
+	if err := msgpackrpc.CallWithCodec(codec, "Txn.Apply", &txn, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Errors) != 2 || out.Errors[0].OpIndex != 1 || out.Errors[1].OpIndex != 2 ||
+		out.Errors[0].What != permissionDenied {
+		t.Fatalf("bad: %#v", out)
+	}
+	if _, d, _ := s1.fsm.State().KVSGet("test/ok"); d != nil {
+		t.Fatalf("should not apply: %v", d)
+	}
+}
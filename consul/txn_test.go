@@ -0,0 +1,88 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_TxnRW(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.KVSSet(1, &structs.DirEntry{Key: "foo", Value: []byte("old")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ops := structs.TxnOps{
+		{KV: &structs.TxnKVOp{Verb: structs.TxnCheckIndex,
+			DirEnt: structs.DirEntry{Key: "foo", ModifyIndex: 1}}},
+		{KV: &structs.TxnKVOp{Verb: structs.KVSSet,
+			DirEnt: structs.DirEntry{Key: "foo", Value: []byte("new")}}},
+		{KV: &structs.TxnKVOp{Verb: structs.TxnGet,
+			DirEnt: structs.DirEntry{Key: "foo"}}},
+		{Node: &structs.TxnNodeOp{Verb: structs.TxnSet,
+			Node: structs.Node{Node: "node1", Address: "127.0.0.1"}}},
+		{Service: &structs.TxnServiceOp{Verb: structs.TxnSet, Node: "node1",
+			Service: structs.NodeService{ID: "web", Service: "web", Port: 80}}},
+		{Check: &structs.TxnCheckOp{Verb: structs.TxnSet,
+			Check: structs.HealthCheck{Node: "node1", CheckID: "web", ServiceID: "web",
+				Status: structs.HealthPassing}}},
+	}
+	results, errs := store.TxnRW(2, ops)
+	if len(errs) != 0 {
+		t.Fatalf("bad: %v", errs)
+	}
+	if len(results) != len(ops) {
+		t.Fatalf("bad: %v", results)
+	}
+
+	// Only the get returns the value
+	if results[1].KV.ModifyIndex != 2 || results[1].KV.Value != nil {
+		t.Fatalf("bad: %v", results[1].KV)
+	}
+	if string(results[2].KV.Value) != "new" {
+		t.Fatalf("bad: %v", results[2].KV)
+	}
+	if results[3].Node.Node != "node1" || results[4].Service.Port != 80 ||
+		results[5].Check.ServiceName != "web" {
+		t.Fatalf("bad: %v %v %v", results[3].Node, results[4].Service, results[5].Check)
+	}
+	_, services := store.NodeServices("node1")
+	if services == nil || services.Services["web"] == nil {
+		t.Fatalf("bad: %v", services)
+	}
+
+	// A failed operation rolls back the whole transaction
+	ops = structs.TxnOps{
+		{KV: &structs.TxnKVOp{Verb: structs.KVSDelete,
+			DirEnt: structs.DirEntry{Key: "foo"}}},
+		{Node: &structs.TxnNodeOp{Verb: structs.TxnDelete,
+			Node: structs.Node{Node: "node1"}}},
+		{KV: &structs.TxnKVOp{Verb: structs.KVSCAS,
+			DirEnt: structs.DirEntry{Key: "bar", ModifyIndex: 5}}},
+		{KV: &structs.TxnKVOp{Verb: "nope",
+			DirEnt: structs.DirEntry{Key: "bar"}}},
+	}
+	results, errs = store.TxnRW(3, ops)
+	if results != nil || len(errs) != 2 {
+		t.Fatalf("bad: %v %v", results, errs)
+	}
+	if errs[0].OpIndex != 2 || !strings.Contains(errs[0].What, "index is stale") {
+		t.Fatalf("bad: %v", errs[0])
+	}
+	if errs[1].OpIndex != 3 || !strings.Contains(errs[1].What, "Unknown KV verb") {
+		t.Fatalf("bad: %v", errs[1])
+	}
+	_, d, err := store.KVSGet("foo")
+	if err != nil || d == nil || string(d.Value) != "new" {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+	if _, found, _ := store.GetNode("node1"); !found {
+		t.Fatalf("node should remain")
+	}
+}
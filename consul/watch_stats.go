@@ -0,0 +1,190 @@
+package consul
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// watchStatsWindow is the period the watch fire counts are kept
+	// for. The stats report the last full window.
+	watchStatsWindow = time.Minute
+
+	// watchStatsMaxPrefixes bounds the number of KV prefixes counted
+	// in a window. The prefixes fired after the bound are not counted.
+	watchStatsMaxPrefixes = 4096
+
+	// watchStatsDefaultLimit is the default number of most notified
+	// prefixes returned
+	watchStatsDefaultLimit = 10
+)
+
+// watchFires is the fire count of a table or prefix in a window
+type watchFires struct {
+	fires uint64
+	woken uint64
+}
+
+// watchWindow holds the fire counts of a window
+type watchWindow struct {
+	start    time.Time
+	end      time.Time
+	tables   map[string]*watchFires
+	prefixes map[string]*watchFires
+}
+
+// newWatchWindow creates an empty window starting at a time
+func newWatchWindow(start time.Time) *watchWindow {
+	return &watchWindow{
+		start:    start,
+		tables:   make(map[string]*watchFires),
+		prefixes: make(map[string]*watchFires),
+	}
+}
+
+// watchStats counts how often the watches of the state store fire, so
+// operators can find which tables and keys cause storms of blocking
+// queries. The counts are kept per window, and the last full window is
+// reported, so the rates reflect the recent load.
+type watchStats struct {
+	l        sync.Mutex
+	current  *watchWindow
+	previous *watchWindow
+}
+
+// newWatchStats creates empty watch stats
+func newWatchStats() *watchStats {
+	return &watchStats{
+		current: newWatchWindow(time.Now()),
+	}
+}
+
+// rotate starts a new window if the current one is over. Must be called
+// with the lock held.
+func (w *watchStats) rotate(now time.Time) {
+	elapsed := now.Sub(w.current.start)
+	if elapsed < watchStatsWindow {
+		return
+	}
+
+	// If a full window went by without any rotation, nothing fired in
+	// it, so it is reported empty
+	if elapsed >= 2*watchStatsWindow {
+		w.previous = newWatchWindow(now.Add(-watchStatsWindow))
+	} else {
+		w.previous = w.current
+	}
+	w.previous.end = w.previous.start.Add(watchStatsWindow)
+	w.current = newWatchWindow(w.previous.end)
+}
+
+// tableFired records a notification of a table that woke up watchers
+func (w *watchStats) tableFired(table string, woken int) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.rotate(time.Now())
+	countFire(w.current.tables, table, woken, 0)
+}
+
+// prefixFired records a notification of a KV prefix or pattern that
+// woke up watchers
+func (w *watchStats) prefixFired(prefix string, woken int) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.rotate(time.Now())
+	countFire(w.current.prefixes, prefix, woken, watchStatsMaxPrefixes)
+}
+
+// countFire adds a fire to a set of counts. If max is set, no more than
+// max names are counted.
+func countFire(counts map[string]*watchFires, name string, woken int, max int) {
+	fires, ok := counts[name]
+	if !ok {
+		if max > 0 && len(counts) >= max {
+			return
+		}
+		fires = &watchFires{}
+		counts[name] = fires
+	}
+	fires.fires++
+	fires.woken += uint64(woken)
+}
+
+// report returns the fire counts of the last full window, or of the
+// current one if none is over yet, with the top prefixes limited to
+// limit entries. The tables are sorted by name.
+func (w *watchStats) report(limit int) (time.Duration, []*structs.WatchFires, []*structs.WatchFires) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	now := time.Now()
+	w.rotate(now)
+	window, length := w.previous, watchStatsWindow
+	if window == nil {
+		window, length = w.current, now.Sub(w.current.start)
+	}
+
+	tables := toWatchFires(window.tables, length)
+	sort.Sort(watchFiresByName(tables))
+	prefixes := toWatchFires(window.prefixes, length)
+	sort.Sort(watchFiresByFires(prefixes))
+	if len(prefixes) > limit {
+		prefixes = prefixes[:limit]
+	}
+	return length, tables, prefixes
+}
+
+// toWatchFires converts the counts of a window to their report
+func toWatchFires(counts map[string]*watchFires, length time.Duration) []*structs.WatchFires {
+	out := make([]*structs.WatchFires, 0, len(counts))
+	for name, fires := range counts {
+		entry := &structs.WatchFires{
+			Name:  name,
+			Fires: fires.fires,
+			Woken: fires.woken,
+		}
+		if length > 0 {
+			entry.Rate = float64(fires.fires) / length.Seconds()
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+type watchFiresByName []*structs.WatchFires
+
+func (w watchFiresByName) Len() int           { return len(w) }
+func (w watchFiresByName) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+func (w watchFiresByName) Less(i, j int) bool { return w[i].Name < w[j].Name }
+
+type watchFiresByFires []*structs.WatchFires
+
+func (w watchFiresByFires) Len() int      { return len(w) }
+func (w watchFiresByFires) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w watchFiresByFires) Less(i, j int) bool {
+	if w[i].Fires != w[j].Fires {
+		return w[i].Fires > w[j].Fires
+	}
+	return w[i].Name < w[j].Name
+}
+
+// WatchStats returns the number of watchers of each table and KV prefix,
+// and how often they were notified recently, along with the limit most
+// notified prefixes
+func (s *StateStore) WatchStats(limit int) *structs.WatchStats {
+	if limit <= 0 {
+		limit = watchStatsDefaultLimit
+	}
+	stats := &structs.WatchStats{
+		Watchers:    make(map[string]int, len(s.tables)),
+		KVSWatchers: s.kvWatch.Watchers(),
+	}
+	for _, table := range s.tables {
+		stats.Watchers[table.Name] = s.watch[table].Count()
+	}
+	stats.Window, stats.Tables, stats.TopPrefixes = s.watchStats.report(limit)
+	return stats
+}
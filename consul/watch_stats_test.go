@@ -0,0 +1,92 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_WatchStats(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Watch a table and a couple of prefixes, and fire them
+	for i := 0; i < 3; i++ {
+		store.Watch(store.QueryTables("Nodes"), make(chan struct{}, 1))
+		store.WatchKV("foo/", make(chan struct{}, 1))
+		store.WatchKV("foo/", make(chan struct{}, 1))
+		if i == 0 {
+			store.WatchKV("bar/", make(chan struct{}, 1))
+		}
+		if err := store.EnsureNode(uint64(3*i+1), structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.KVSSet(uint64(3*i+2), &structs.DirEntry{Key: "foo/bar"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if i == 0 {
+			if err := store.KVSSet(uint64(3*i+3), &structs.DirEntry{Key: "bar/baz"}); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+
+	// A waiting watcher shows up
+	store.WatchKV("baz/", make(chan struct{}, 1))
+	stats := store.WatchStats(1)
+	if stats.KVSWatchers["baz/"] != 1 || stats.Watchers[dbNodes] != 0 {
+		t.Fatalf("bad: %v %v", stats.KVSWatchers, stats.Watchers)
+	}
+
+	var nodes *structs.WatchFires
+	for _, fires := range stats.Tables {
+		if fires.Name == dbNodes {
+			nodes = fires
+		}
+	}
+	if nodes == nil || nodes.Fires != 3 || nodes.Woken != 3 || nodes.Rate <= 0 {
+		t.Fatalf("bad: %v", stats.Tables)
+	}
+
+	// Only the most notified prefix is returned
+	if len(stats.TopPrefixes) != 1 {
+		t.Fatalf("bad: %v", stats.TopPrefixes)
+	}
+	top := stats.TopPrefixes[0]
+	if top.Name != "foo/" || top.Fires != 3 || top.Woken != 6 {
+		t.Fatalf("bad: %v", top)
+	}
+	if stats.Window <= 0 || stats.Window > watchStatsWindow {
+		t.Fatalf("bad: %v", stats.Window)
+	}
+}
+
+func TestWatchStats_Rotate(t *testing.T) {
+	w := newWatchStats()
+	w.prefixFired("foo/", 2)
+
+	// Once the window is over, it is reported in full
+	w.current.start = w.current.start.Add(-watchStatsWindow)
+	w.prefixFired("bar/", 1)
+	window, _, prefixes := w.report(10)
+	if window != watchStatsWindow {
+		t.Fatalf("bad: %v", window)
+	}
+	if len(prefixes) != 1 || prefixes[0].Name != "foo/" || prefixes[0].Woken != 2 {
+		t.Fatalf("bad: %v", prefixes)
+	}
+	expect := 1 / watchStatsWindow.Seconds()
+	if prefixes[0].Rate != expect {
+		t.Fatalf("bad: %v", prefixes[0].Rate)
+	}
+
+	// A window without any rotation is empty
+	w.current.start = w.current.start.Add(-3 * watchStatsWindow)
+	_, _, prefixes = w.report(10)
+	if len(prefixes) != 0 {
+		t.Fatalf("bad: %v", prefixes)
+	}
+}
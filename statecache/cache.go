@@ -0,0 +1,355 @@
+// Package statecache maintains a local, read-only replica of part of the
+// Consul state. A set of services and KV prefixes are kept up to date
+// using blocking queries, and are served from an embedded state store so
+// that reads are local and continue to work while the agent is
+// unreachable.
+package statecache
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/consul"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// defaultWaitTime bounds each blocking query, and so how long Close
+	// may wait for the queries to return
+	defaultWaitTime = 30 * time.Second
+
+	// retryInterval is the base wait after a failed query
+	retryInterval = time.Second
+
+	// maxBackoffTime bounds the wait between failed queries
+	maxBackoffTime = 60 * time.Second
+)
+
+// Config is used to configure a Cache
+type Config struct {
+	// Client is used to query the agent
+	Client *consulapi.Client
+
+	// Datacenter and Token are used for the queries
+	Datacenter string
+	Token      string
+
+	// Services are replicated along with their health checks
+	Services []string
+
+	// Prefixes are the KV prefixes that are replicated
+	Prefixes []string
+
+	// WaitTime bounds each blocking query
+	WaitTime time.Duration
+
+	LogOutput io.Writer
+}
+
+// Cache is a read-only replica of the configured services and prefixes
+type Cache struct {
+	config *Config
+	logger *log.Logger
+	state  *consul.StateStore
+
+	// writeLock serializes the updates from the watches
+	writeLock sync.Mutex
+
+	// pending is the number of watches that have yet to sync
+	pending     int
+	pendingLock sync.Mutex
+	readyCh     chan struct{}
+
+	shutdownCh chan struct{}
+	wg         sync.WaitGroup
+}
+
+// New creates a cache and starts replicating into it
+func New(config *Config) (*Cache, error) {
+	if config.Client == nil {
+		return nil, fmt.Errorf("Missing client")
+	}
+	if config.WaitTime == 0 {
+		config.WaitTime = defaultWaitTime
+	}
+	if config.LogOutput == nil {
+		config.LogOutput = os.Stderr
+	}
+
+	state, err := consul.NewStateStore(nil, config.LogOutput)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		config:     config,
+		logger:     log.New(config.LogOutput, "", log.LstdFlags),
+		state:      state,
+		pending:    len(config.Services) + len(config.Prefixes),
+		readyCh:    make(chan struct{}),
+		shutdownCh: make(chan struct{}),
+	}
+	if c.pending == 0 {
+		close(c.readyCh)
+	}
+	for _, service := range config.Services {
+		c.wg.Add(1)
+		go c.run("service "+service, c.serviceFunc(service))
+	}
+	for _, prefix := range config.Prefixes {
+		c.wg.Add(1)
+		go c.run("prefix "+prefix, c.prefixFunc(prefix))
+	}
+	return c, nil
+}
+
+// Close stops the replication and discards the cache. It waits for any
+// outstanding queries to return, which may take up to the WaitTime.
+func (c *Cache) Close() error {
+	close(c.shutdownCh)
+	c.wg.Wait()
+	return c.state.Close()
+}
+
+// Ready returns a channel that is closed once every service and prefix
+// has been replicated at least once
+func (c *Cache) Ready() <-chan struct{} {
+	return c.readyCh
+}
+
+// ServiceNodes returns the nodes providing a replicated service
+func (c *Cache) ServiceNodes(service string) (uint64, structs.ServiceNodes) {
+	return c.state.ServiceNodes(service)
+}
+
+// CheckServiceNodes returns the nodes providing a replicated service,
+// along with their health checks
+func (c *Cache) CheckServiceNodes(service string) (uint64, structs.CheckServiceNodes) {
+	return c.state.CheckServiceNodes(service)
+}
+
+// KVSGet returns a replicated KV entry
+func (c *Cache) KVSGet(key string) (uint64, *structs.DirEntry, error) {
+	return c.state.KVSGet(key)
+}
+
+// KVSList returns the replicated KV entries under a prefix
+func (c *Cache) KVSList(prefix string) (uint64, uint64, structs.DirEntries, error) {
+	return c.state.KVSList(prefix)
+}
+
+// syncFunc runs a blocking query from the given index, and applies the
+// result to the cache. It returns the index of the result.
+type syncFunc func(index uint64) (uint64, error)
+
+// run invokes a sync function until shutdown, backing off on errors
+func (c *Cache) run(name string, fn syncFunc) {
+	defer c.wg.Done()
+	var index uint64
+	var failures uint
+	synced := false
+	for {
+		newIndex, err := fn(index)
+		select {
+		case <-c.shutdownCh:
+			return
+		default:
+		}
+
+		if err != nil {
+			failures++
+			wait := retryInterval * time.Duration(1<<failures)
+			if wait > maxBackoffTime {
+				wait = maxBackoffTime
+			}
+			c.logger.Printf("[ERR] statecache: Failed to replicate %s: %v (retry in %v)",
+				name, err, wait)
+			select {
+			case <-time.After(wait):
+				continue
+			case <-c.shutdownCh:
+				return
+			}
+		}
+		failures = 0
+		index = newIndex
+
+		if !synced {
+			synced = true
+			c.pendingLock.Lock()
+			c.pending--
+			if c.pending == 0 {
+				close(c.readyCh)
+			}
+			c.pendingLock.Unlock()
+		}
+	}
+}
+
+// queryOptions returns the options of a blocking query from an index
+func (c *Cache) queryOptions(index uint64) *consulapi.QueryOptions {
+	return &consulapi.QueryOptions{
+		Datacenter: c.config.Datacenter,
+		Token:      c.config.Token,
+		WaitIndex:  index,
+		WaitTime:   c.config.WaitTime,
+	}
+}
+
+// serviceFunc replicates the instances and health checks of a service
+func (c *Cache) serviceFunc(service string) syncFunc {
+	return func(index uint64) (uint64, error) {
+		entries, meta, err := c.config.Client.Health().Service(service, "", false, c.queryOptions(index))
+		if err != nil {
+			return 0, err
+		}
+		if meta.LastIndex == index {
+			return index, nil
+		}
+		c.writeLock.Lock()
+		defer c.writeLock.Unlock()
+		return meta.LastIndex, c.syncService(meta.LastIndex, service, entries)
+	}
+}
+
+// syncService applies the current instances of a service
+func (c *Cache) syncService(index uint64, service string, entries []*consulapi.ServiceEntry) error {
+	type instance struct{ node, id string }
+	current := make(map[instance]struct{}, len(entries))
+	for _, entry := range entries {
+		node := structs.Node{
+			Node:    entry.Node.Node,
+			Address: entry.Node.Address,
+			Meta:    entry.Node.Meta,
+		}
+		if err := c.state.EnsureNode(index, node); err != nil {
+			return err
+		}
+		svc := &structs.NodeService{
+			ID:      entry.Service.ID,
+			Service: entry.Service.Service,
+			Tags:    entry.Service.Tags,
+			Address: entry.Service.Address,
+			Port:    entry.Service.Port,
+		}
+		if err := c.state.EnsureService(index, node.Node, svc); err != nil {
+			return err
+		}
+		current[instance{node.Node, svc.ID}] = struct{}{}
+
+		// The entry has the node checks and the checks of this instance
+		checks := make(map[string]struct{}, len(entry.Checks))
+		for _, check := range entry.Checks {
+			hc := &structs.HealthCheck{
+				Node:        check.Node,
+				CheckID:     check.CheckID,
+				Name:        check.Name,
+				Status:      check.Status,
+				Notes:       check.Notes,
+				Output:      check.Output,
+				ServiceID:   check.ServiceID,
+				ServiceName: check.ServiceName,
+			}
+			if err := c.state.EnsureCheck(index, hc); err != nil {
+				return err
+			}
+			checks[check.CheckID] = struct{}{}
+		}
+		_, local := c.state.NodeChecks(node.Node)
+		for _, check := range local {
+			if check.ServiceID != "" && check.ServiceID != svc.ID {
+				continue
+			}
+			if _, ok := checks[check.CheckID]; ok {
+				continue
+			}
+			if err := c.state.DeleteNodeCheck(index, node.Node, check.CheckID); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Remove the instances that are gone, and any nodes left without
+	// a replicated service
+	_, local := c.state.ServiceNodes(service)
+	for _, sn := range local {
+		if _, ok := current[instance{sn.Node, sn.ServiceID}]; ok {
+			continue
+		}
+		if err := c.state.DeleteNodeService(index, sn.Node, sn.ServiceID); err != nil {
+			return err
+		}
+		if _, services := c.state.NodeServices(sn.Node); services == nil || len(services.Services) == 0 {
+			if err := c.state.DeleteNode(index, sn.Node); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prefixFunc replicates the KV entries under a prefix
+func (c *Cache) prefixFunc(prefix string) syncFunc {
+	return func(index uint64) (uint64, error) {
+		pairs, meta, err := c.config.Client.KV().List(prefix, c.queryOptions(index))
+		if err != nil {
+			return 0, err
+		}
+		if meta.LastIndex == index {
+			return index, nil
+		}
+		c.writeLock.Lock()
+		defer c.writeLock.Unlock()
+		return meta.LastIndex, c.syncPrefix(meta.LastIndex, prefix, pairs)
+	}
+}
+
+// syncPrefix applies the current entries under a prefix. Entries are
+// restored as is, so they keep the indexes of the servers.
+func (c *Cache) syncPrefix(index uint64, prefix string, pairs consulapi.KVPairs) error {
+	_, _, local, err := c.state.KVSList(prefix)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]uint64, len(local))
+	for _, d := range local {
+		existing[d.Key] = d.ModifyIndex
+	}
+
+	for _, pair := range pairs {
+		if modify, ok := existing[pair.Key]; ok {
+			delete(existing, pair.Key)
+			if modify == pair.ModifyIndex {
+				continue
+			}
+		}
+		d := &structs.DirEntry{
+			Key:         pair.Key,
+			Value:       pair.Value,
+			Flags:       pair.Flags,
+			Session:     pair.Session,
+			LockIndex:   pair.LockIndex,
+			CreateIndex: pair.CreateIndex,
+			ModifyIndex: pair.ModifyIndex,
+		}
+		if err := c.state.KVSRestore(d); err != nil {
+			return err
+		}
+	}
+
+	// Remove the entries that are gone, the tombstones are not needed
+	if len(existing) == 0 {
+		return nil
+	}
+	for key := range existing {
+		if err := c.state.KVSDelete(index, key); err != nil {
+			return err
+		}
+	}
+	return c.state.ReapTombstones(index)
+}
@@ -0,0 +1,79 @@
+package statecache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestCache_Replicate(t *testing.T) {
+	server := testutil.NewTestServer(t)
+	defer server.Stop()
+
+	conf := consulapi.DefaultConfig()
+	conf.Address = server.HTTPAddr
+	client, err := consulapi.NewClient(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	server.AddService("redis", "passing", nil)
+	server.PopulateKV(map[string][]byte{
+		"config/a": []byte("1"),
+		"config/b": []byte("2"),
+		"other":    []byte("3"),
+	})
+
+	cache, err := New(&Config{
+		Client:   client,
+		Services: []string{"redis"},
+		Prefixes: []string{"config/"},
+		WaitTime: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cache.Close()
+
+	select {
+	case <-cache.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("cache not ready")
+	}
+
+	_, nodes := cache.CheckServiceNodes("redis")
+	if len(nodes) != 1 || nodes[0].Service.Service != "redis" || len(nodes[0].Checks) == 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, d, err := cache.KVSGet("config/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "1" {
+		t.Fatalf("bad: %v", d)
+	}
+	if _, d, _ := cache.KVSGet("other"); d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Changes are replicated, including deletes
+	server.SetKV("config/a", []byte("4"))
+	if _, err := client.KV().Delete("config/b", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		_, _, ents, err := cache.KVSList("config/")
+		if err != nil {
+			return false, err
+		}
+		if len(ents) != 1 || string(ents[0].Value) != "4" {
+			return false, fmt.Errorf("bad: %v", ents)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
@@ -61,6 +61,16 @@ type Config struct {
 
 	// Domain is the Consul TLD being used. Defaults to "consul."
 	Domain string
+
+	// AllowPlaintext accepts non-TLS connections even with VerifyIncoming
+	// set, while the TLS connections must still present a verified
+	// certificate. It is used to roll out TLS to the clients.
+	AllowPlaintext bool
+
+	// AutoEncrypt is used by clients to obtain their certificate, and the
+	// CA certificates to verify the servers, from the servers. It implies
+	// VerifyOutgoing, and the CA file is then optional.
+	AutoEncrypt bool
 }
 
 // AppendCA opens and parses the CA file and adds the certificates to
@@ -100,7 +110,7 @@ func (c *Config) KeyPair() (*tls.Certificate, error) {
 // not use TLS for outgoing connections.
 func (c *Config) OutgoingTLSConfig() (*tls.Config, error) {
 	// If VerifyServerHostname is true, that implies VerifyOutgoing
-	if c.VerifyServerHostname {
+	if c.VerifyServerHostname || c.AutoEncrypt {
 		c.VerifyOutgoing = true
 	}
 	if !c.VerifyOutgoing {
@@ -122,7 +132,7 @@ func (c *Config) OutgoingTLSConfig() (*tls.Config, error) {
 	}
 
 	// Ensure we have a CA if VerifyOutgoing is set
-	if c.VerifyOutgoing && c.CAFile == "" {
+	if c.VerifyOutgoing && c.CAFile == "" && !c.AutoEncrypt {
 		return nil, fmt.Errorf("VerifyOutgoing set, and no CA certificate provided!")
 	}
 
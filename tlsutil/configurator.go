@@ -0,0 +1,233 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAutoEncryptPending is returned for the outgoing connections of an
+// auto-encrypt client until its certificate is obtained
+var ErrAutoEncryptPending = errors.New("TLS certificate not yet obtained from the servers")
+
+// AutoEncryptOU is the organizational unit of the certificates the
+// servers sign for the clients with auto-encrypt. It tells them apart
+// from the certificates of the same CA issued to people and services.
+const AutoEncryptOU = "consul-auto-encrypt"
+
+// Configurator holds the TLS configurations of the RPC connections, and
+// swaps them when the certificates are reloaded. New connections use
+// the reloaded certificates, while the existing ones are kept.
+type Configurator struct {
+	config   Config
+	incoming *tls.Config
+	outgoing *tls.Config
+
+	// stamp identifies the versions of the CA, certificate and key files
+	// the configurations were built from
+	stamp string
+
+	// autoCert and autoCA are the certificate of an auto-encrypt client
+	// and the CA certificates it got from the servers
+	autoCert *tls.Certificate
+	autoCA   *x509.CertPool
+
+	l sync.RWMutex
+}
+
+// NewConfigurator returns a configurator of the given configuration
+func NewConfigurator(config *Config) (*Configurator, error) {
+	c := &Configurator{}
+	if err := c.Update(config); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Update builds the TLS configurations of a new configuration and swaps
+// them in. The current configurations are kept if it fails. Whether the
+// outgoing connections use TLS can't be changed, since the connection
+// pools are set up for one or the other.
+func (c *Configurator) Update(config *Config) error {
+	conf := *config
+	stamp := fileStamp(&conf)
+	incoming, err := conf.IncomingTLSConfig()
+	if err != nil {
+		return err
+	}
+	outgoing, err := conf.OutgoingTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.incoming != nil && (outgoing == nil) != (c.outgoing == nil) {
+		return fmt.Errorf("VerifyOutgoing can't be changed without a restart")
+	}
+	c.config = conf
+	c.incoming = incoming
+	c.outgoing = outgoing
+	c.stamp = stamp
+	return nil
+}
+
+// Reload reads the CA, certificate and key files again
+func (c *Configurator) Reload() error {
+	c.l.RLock()
+	conf := c.config
+	c.l.RUnlock()
+	return c.Update(&conf)
+}
+
+// VerifyIncoming returns if the incoming connections must use TLS
+func (c *Configurator) VerifyIncoming() bool {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return c.config.VerifyIncoming
+}
+
+// AllowPlaintext returns if non-TLS incoming connections are accepted
+// even with VerifyIncoming set
+func (c *Configurator) AllowPlaintext() bool {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return c.config.AllowPlaintext
+}
+
+// IncomingTLSConfig returns the current TLS configuration of the
+// incoming connections
+func (c *Configurator) IncomingTLSConfig() *tls.Config {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return c.incoming
+}
+
+// OutgoingTLSWrapper returns a DCWrapper using the current TLS
+// configuration of the outgoing connections, or nil if they don't use
+// TLS
+func (c *Configurator) OutgoingTLSWrapper() DCWrapper {
+	c.l.RLock()
+	enabled := c.outgoing != nil
+	c.l.RUnlock()
+	if !enabled {
+		return nil
+	}
+
+	return func(dc string, conn net.Conn) (net.Conn, error) {
+		c.l.RLock()
+		conf := *c.outgoing
+		verifyHostname := c.config.VerifyServerHostname
+		domain := strings.TrimSuffix(c.config.Domain, ".")
+		autoEncrypt := c.config.AutoEncrypt
+		autoCert, autoCA := c.autoCert, c.autoCA
+		c.l.RUnlock()
+
+		if autoEncrypt {
+			if autoCert == nil {
+				return nil, ErrAutoEncryptPending
+			}
+			conf.Certificates = []tls.Certificate{*autoCert}
+			conf.RootCAs = autoCA
+		}
+
+		if verifyHostname {
+			conf.ServerName = "server." + dc + "." + domain
+		}
+		return WrapTLSClient(conn, &conf)
+	}
+}
+
+// InsecureIncomingTLSConfig returns the current TLS configuration of the
+// incoming connections without the verification of the client
+// certificates. It serves the agents obtaining their certificates with
+// auto-encrypt, and is nil if there is no certificate to serve.
+func (c *Configurator) InsecureIncomingTLSConfig() *tls.Config {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	if c.incoming == nil || len(c.incoming.Certificates) == 0 {
+		return nil
+	}
+	conf := *c.incoming
+	conf.ClientAuth = tls.NoClientCert
+	return &conf
+}
+
+// SetAutoEncrypt sets the certificate and key of an auto-encrypt client,
+// along with the CA certificates that verify the servers, all PEM
+// encoded. The CA file, if any, is trusted as well.
+func (c *Configurator) SetAutoEncrypt(certPEM, keyPEM, caPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("Failed to load cert/key pair: %v", err)
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	pool := x509.NewCertPool()
+	if err := c.config.AppendCA(pool); err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("Failed to parse any CA certificates")
+	}
+	c.autoCert = &cert
+	c.autoCA = pool
+	return nil
+}
+
+// Watch reloads the files when they change, checking every interval
+// until the stop channel is closed. A failed reload is logged, and the
+// current configurations are kept.
+func (c *Configurator) Watch(interval time.Duration, stopCh <-chan struct{}, logger *log.Logger) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-stopCh:
+			return
+		}
+
+		c.l.RLock()
+		conf := c.config
+		stamp := c.stamp
+		c.l.RUnlock()
+		if fileStamp(&conf) == stamp {
+			continue
+		}
+		if err := c.Update(&conf); err != nil {
+			logger.Printf("[ERR] tlsutil: Failed to reload the TLS certificates: %v", err)
+
+			// The new files are only retried once they change again
+			c.l.Lock()
+			c.stamp = fileStamp(&conf)
+			c.l.Unlock()
+			continue
+		}
+		logger.Printf("[INFO] tlsutil: Reloaded the TLS certificates")
+	}
+}
+
+// fileStamp returns the sizes and modification times of the files of a
+// configuration, to detect changes
+func fileStamp(c *Config) string {
+	var parts []string
+	for _, path := range []string{c.CAFile, c.CertFile, c.KeyFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			parts = append(parts, path+":missing")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,202 @@
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigurator_Update(t *testing.T) {
+	c, err := NewConfigurator(&Config{
+		CAFile:         "../test/ca/root.cer",
+		CertFile:       "../test/key/ourdomain.cer",
+		KeyFile:        "../test/key/ourdomain.key",
+		VerifyIncoming: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	incoming := c.IncomingTLSConfig()
+	if len(incoming.Certificates) != 1 || incoming.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("bad: %#v", incoming)
+	}
+	if !c.VerifyIncoming() || c.AllowPlaintext() {
+		t.Fatalf("bad: %#v", c.config)
+	}
+	if c.OutgoingTLSWrapper() != nil {
+		t.Fatalf("should not wrap")
+	}
+
+	// A config that fails to load is rejected, and the current one kept
+	err = c.Update(&Config{
+		CAFile:         "../test/ca/missing.cer",
+		VerifyIncoming: true,
+	})
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+	if c.IncomingTLSConfig() != incoming {
+		t.Fatalf("should keep the config")
+	}
+
+	// So is a change of the outgoing connections
+	err = c.Update(&Config{
+		CAFile:         "../test/ca/root.cer",
+		VerifyOutgoing: true,
+	})
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// The incoming connections can move to TLS
+	err = c.Update(&Config{
+		CAFile:         "../test/ca/root.cer",
+		CertFile:       "../test/key/ourdomain.cer",
+		KeyFile:        "../test/key/ourdomain.key",
+		VerifyIncoming: true,
+		AllowPlaintext: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !c.AllowPlaintext() || c.IncomingTLSConfig() == incoming {
+		t.Fatalf("bad: %#v", c.config)
+	}
+}
+
+func TestConfigurator_OutgoingTLSWrapper(t *testing.T) {
+	config := &Config{
+		CAFile:               "../test/hostname/CertAuth.crt",
+		CertFile:             "../test/hostname/Alice.crt",
+		KeyFile:              "../test/hostname/Alice.key",
+		VerifyServerHostname: true,
+		Domain:               "consul",
+	}
+	c, err := NewConfigurator(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, errc := startTLSServer(config)
+	if client == nil {
+		t.Fatalf("startTLSServer err: %v", <-errc)
+	}
+	tlsClient, err := c.OutgoingTLSWrapper()("dc1", client)
+	if err != nil {
+		t.Fatalf("wrapTLS err: %v", err)
+	}
+	defer tlsClient.Close()
+	if err := tlsClient.(*tls.Conn).Handshake(); err != nil {
+		t.Fatalf("write err: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+}
+
+func TestConfigurator_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	copyFile := func(src, dst string) {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, dst), data, 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	copyFile("../test/key/ourdomain.cer", "cert")
+	copyFile("../test/key/ourdomain.key", "key")
+
+	c, err := NewConfigurator(&Config{
+		CertFile: filepath.Join(dir, "cert"),
+		KeyFile:  filepath.Join(dir, "key"),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	before := c.IncomingTLSConfig().Certificates[0].Certificate[0]
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.Watch(10*time.Millisecond, stopCh, log.New(os.Stderr, "", log.LstdFlags))
+
+	// Replace the certificate, the new one is picked up
+	copyFile("../test/hostname/Alice.crt", "cert")
+	copyFile("../test/hostname/Alice.key", "key")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		after := c.IncomingTLSConfig().Certificates[0].Certificate[0]
+		if !bytes.Equal(before, after) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConfigurator_AutoEncrypt(t *testing.T) {
+	c, err := NewConfigurator(&Config{AutoEncrypt: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	wrap := c.OutgoingTLSWrapper()
+	if wrap == nil {
+		t.Fatalf("should wrap")
+	}
+
+	// The connections fail until the certificate is set
+	if _, err := wrap("dc1", nil); err != ErrAutoEncryptPending {
+		t.Fatalf("err: %v", err)
+	}
+
+	certPEM, err := ioutil.ReadFile("../test/key/ourdomain.cer")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyPEM, err := ioutil.ReadFile("../test/key/ourdomain.key")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	caPEM, err := ioutil.ReadFile("../test/ca/root.cer")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := c.SetAutoEncrypt(certPEM, keyPEM, []byte("nope")); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := c.SetAutoEncrypt(certPEM, keyPEM, caPEM); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The certificate is presented to the servers, and verifies them
+	client, errc := startTLSServer(&Config{
+		CAFile:         "../test/ca/root.cer",
+		CertFile:       "../test/key/ourdomain.cer",
+		KeyFile:        "../test/key/ourdomain.key",
+		VerifyIncoming: true,
+	})
+	if client == nil {
+		t.Fatalf("startTLSServer err: %v", <-errc)
+	}
+	tlsClient, err := wrap("dc1", client)
+	if err != nil {
+		t.Fatalf("wrapTLS err: %v", err)
+	}
+	defer tlsClient.Close()
+	if err := <-errc; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package watch
+
+import (
+	"fmt"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// SetHandler sets the handler of the plan from a function taking the
+// index and the typed result of its watch type, or a HandlerFunc. The
+// typed handlers are:
+//
+//	key        func(uint64, *api.KVPair), given nil if the key is missing
+//	keyprefix  func(uint64, api.KVPairs)
+//	services   func(uint64, map[string][]string)
+//	nodes      func(uint64, []*api.Node)
+//	service    func(uint64, []*api.ServiceEntry)
+//	checks     func(uint64, []*api.HealthCheck)
+//	event      func(uint64, []*api.UserEvent)
+//
+// An error is returned if the handler doesn't match the watch type.
+func (p *WatchPlan) SetHandler(handler interface{}) error {
+	var fn HandlerFunc
+	var handlerType string
+	switch h := handler.(type) {
+	case HandlerFunc:
+		fn = h
+	case func(uint64, interface{}):
+		fn = h
+	case func(uint64, *consulapi.KVPair):
+		handlerType = "key"
+		fn = func(idx uint64, raw interface{}) {
+			pair, _ := raw.(*consulapi.KVPair)
+			h(idx, pair)
+		}
+	case func(uint64, consulapi.KVPairs):
+		handlerType = "keyprefix"
+		fn = func(idx uint64, raw interface{}) {
+			h(idx, raw.(consulapi.KVPairs))
+		}
+	case func(uint64, map[string][]string):
+		handlerType = "services"
+		fn = func(idx uint64, raw interface{}) {
+			h(idx, raw.(map[string][]string))
+		}
+	case func(uint64, []*consulapi.Node):
+		handlerType = "nodes"
+		fn = func(idx uint64, raw interface{}) {
+			h(idx, raw.([]*consulapi.Node))
+		}
+	case func(uint64, []*consulapi.ServiceEntry):
+		handlerType = "service"
+		fn = func(idx uint64, raw interface{}) {
+			h(idx, raw.([]*consulapi.ServiceEntry))
+		}
+	case func(uint64, []*consulapi.HealthCheck):
+		handlerType = "checks"
+		fn = func(idx uint64, raw interface{}) {
+			h(idx, raw.([]*consulapi.HealthCheck))
+		}
+	case func(uint64, []*consulapi.UserEvent):
+		handlerType = "event"
+		fn = func(idx uint64, raw interface{}) {
+			h(idx, raw.([]*consulapi.UserEvent))
+		}
+	default:
+		return fmt.Errorf("Unsupported handler: %T", handler)
+	}
+
+	if handlerType != "" && handlerType != p.Type {
+		return fmt.Errorf("Handler %T is for '%s' watches, not '%s'",
+			handler, handlerType, p.Type)
+	}
+	p.Handler = fn
+	return nil
+}
@@ -0,0 +1,63 @@
+package watch
+
+import (
+	"strings"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestSetHandler(t *testing.T) {
+	plan := mustParse(t, `{"type":"key", "key":"foo"}`)
+
+	var got *consulapi.KVPair
+	calls := 0
+	err := plan.SetHandler(func(idx uint64, pair *consulapi.KVPair) {
+		got = pair
+		calls++
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A missing key is given as nil
+	plan.Handler(1, nil)
+	if calls != 1 || got != nil {
+		t.Fatalf("bad: %d %v", calls, got)
+	}
+	pair := &consulapi.KVPair{Key: "foo"}
+	plan.Handler(2, pair)
+	if calls != 2 || got != pair {
+		t.Fatalf("bad: %d %v", calls, got)
+	}
+
+	// The handler must match the watch type
+	err = plan.SetHandler(func(idx uint64, entries []*consulapi.ServiceEntry) {})
+	if err == nil || !strings.Contains(err.Error(), "'service' watches") {
+		t.Fatalf("err: %v", err)
+	}
+	err = plan.SetHandler(func(idx uint64) {})
+	if err == nil || !strings.Contains(err.Error(), "Unsupported handler") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An untyped handler is always accepted
+	if err := plan.SetHandler(func(idx uint64, raw interface{}) {}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSetHandler_Service(t *testing.T) {
+	plan := mustParse(t, `{"type":"service", "service":"redis"}`)
+	var got []*consulapi.ServiceEntry
+	err := plan.SetHandler(func(idx uint64, entries []*consulapi.ServiceEntry) {
+		got = entries
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	plan.Handler(1, []*consulapi.ServiceEntry{{}})
+	if len(got) != 1 {
+		t.Fatalf("bad: %v", got)
+	}
+}
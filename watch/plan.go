@@ -45,7 +45,7 @@ func (p *WatchPlan) Run(address string) error {
 OUTER:
 	for !p.shouldStop() {
 		// Invoke the handler
-		index, result, err := p.Func(p)
+		index, result, err := p.invoke()
 
 		// Check if we should terminate since the function
 		// could have blocked for a while
@@ -57,10 +57,7 @@ OUTER:
 		if err != nil {
 			// Perform an exponential backoff
 			failures++
-			retry := retryInterval * time.Duration(failures*failures)
-			if retry > maxBackoffTime {
-				retry = maxBackoffTime
-			}
+			retry := p.backoff(failures)
 			logger.Printf("consul.watch: Watch (type: %s) errored: %v, retry in %v",
 				p.Type, err, retry)
 			select {
@@ -95,7 +92,49 @@ OUTER:
 	return nil
 }
 
-// Stop is used to stop running the watch plan
+// watchResult is the outcome of a watch function
+type watchResult struct {
+	index  uint64
+	result interface{}
+	err    error
+}
+
+// invoke runs the watch function, returning as soon as the plan is
+// stopped rather than waiting on a blocking query in flight, which is
+// then abandoned.
+func (p *WatchPlan) invoke() (uint64, interface{}, error) {
+	resultCh := make(chan watchResult, 1)
+	go func() {
+		index, result, err := p.Func(p)
+		resultCh <- watchResult{index, result, err}
+	}()
+	select {
+	case r := <-resultCh:
+		return r.index, r.result, r.err
+	case <-p.stopCh:
+		return 0, nil, nil
+	}
+}
+
+// backoff returns the time to wait after the given number of
+// consecutive failures
+func (p *WatchPlan) backoff(failures int) time.Duration {
+	base, max := p.RetryInterval, p.MaxBackoff
+	if base <= 0 {
+		base = retryInterval
+	}
+	if max <= 0 {
+		max = maxBackoffTime
+	}
+	retry := base * time.Duration(failures*failures)
+	if retry > max || retry <= 0 {
+		retry = max
+	}
+	return retry
+}
+
+// Stop is used to stop running the watch plan. Run returns promptly,
+// even during a blocking query.
 func (p *WatchPlan) Stop() {
 	p.stopLock.Lock()
 	defer p.stopLock.Unlock()
@@ -52,3 +52,52 @@ func TestRun_Stop(t *testing.T) {
 		t.Fatalf("Bad: %d", expect)
 	}
 }
+
+func TestRun_StopBlocked(t *testing.T) {
+	plan := mustParse(t, `{"type":"noop"}`)
+	block := make(chan struct{})
+	defer close(block)
+	plan.Func = func(p *WatchPlan) (uint64, interface{}, error) {
+		<-block
+		return 1, nil, nil
+	}
+	plan.Handler = func(idx uint64, val interface{}) {
+		t.Fatalf("should not be called")
+	}
+
+	time.AfterFunc(10*time.Millisecond, func() {
+		plan.Stop()
+	})
+
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- plan.Run("127.0.0.1:8500")
+	}()
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("should stop during the blocking call")
+	}
+}
+
+func TestWatchPlan_Backoff(t *testing.T) {
+	plan := mustParse(t, `{"type":"noop"}`)
+	if retry := plan.backoff(1); retry != retryInterval {
+		t.Fatalf("bad: %v", retry)
+	}
+	if retry := plan.backoff(100); retry != maxBackoffTime {
+		t.Fatalf("bad: %v", retry)
+	}
+
+	plan.RetryInterval = time.Second
+	plan.MaxBackoff = 10 * time.Second
+	if retry := plan.backoff(3); retry != 9*time.Second {
+		t.Fatalf("bad: %v", retry)
+	}
+	if retry := plan.backoff(4); retry != 10*time.Second {
+		t.Fatalf("bad: %v", retry)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 )
@@ -22,6 +23,12 @@ type WatchPlan struct {
 	Handler   HandlerFunc
 	LogOutput io.Writer
 
+	// RetryInterval is the base of the backoff after the watch fails,
+	// growing with the square of the consecutive failures up to
+	// MaxBackoff. They default to 5 seconds and 3 minutes.
+	RetryInterval time.Duration
+	MaxBackoff    time.Duration
+
 	address    string
 	client     *consulapi.Client
 	lastIndex  uint64
@@ -35,7 +42,8 @@ type WatchPlan struct {
 // WatchFunc is used to watch for a diff
 type WatchFunc func(*WatchPlan) (uint64, interface{}, error)
 
-// HandlerFunc is used to handle new data
+// HandlerFunc is used to handle new data. SetHandler sets a handler
+// taking the typed data of the watch type.
 type HandlerFunc func(uint64, interface{})
 
 // Parse takes a watch query and compiles it into a WatchPlan or an error